@@ -0,0 +1,82 @@
+package backend
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+)
+
+type KeyAlgorithm string
+
+const (
+	RSA2048 KeyAlgorithm = "rsa-2048"
+	RSA4096 KeyAlgorithm = "rsa-4096"
+)
+
+var (
+	KeyAlgorithms = []string{
+		string(RSA2048),
+		string(RSA4096),
+	}
+
+	// The PKCS#7 implementation in go-uefi only produces RSA signatures
+	ErrUnsupportedSigningAlgorithm = errors.New("signing is only supported with RSA keys")
+)
+
+// DefaultKeyAlgorithm is used when no algorithm is configured
+func DefaultKeyAlgorithm() KeyAlgorithm {
+	if RSAKeySize == 2048 {
+		return RSA2048
+	}
+	return RSA4096
+}
+
+func ParseKeyAlgorithm(s string) (KeyAlgorithm, error) {
+	switch KeyAlgorithm(s) {
+	case "":
+		return DefaultKeyAlgorithm(), nil
+	case RSA2048, RSA4096:
+		return KeyAlgorithm(s), nil
+	}
+	return "", fmt.Errorf("unknown key algorithm: %s", s)
+}
+
+func (k KeyAlgorithm) generateKey() (crypto.Signer, error) {
+	switch k {
+	case RSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case RSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	}
+	return nil, fmt.Errorf("unknown key algorithm: %s", k)
+}
+
+// AlgorithmFromPublicKey returns the key algorithm for a public key, or an
+// empty string if it is not one we support.
+func AlgorithmFromPublicKey(pub crypto.PublicKey) KeyAlgorithm {
+	if pub, ok := pub.(*rsa.PublicKey); ok {
+		switch pub.N.BitLen() {
+		case 2048:
+			return RSA2048
+		case 4096:
+			return RSA4096
+		}
+	}
+	return ""
+}
+
+// GetKeyAlgorithm returns the algorithm of the key held by the backend
+func GetKeyAlgorithm(kb KeyBackend) KeyAlgorithm {
+	return AlgorithmFromPublicKey(kb.Certificate().PublicKey)
+}
+
+// CheckSigningAlgorithm returns an error if the backend can't be used to
+// produce authenticode or authenticated variable signatures.
+func CheckSigningAlgorithm(kb KeyBackend) error {
+	if _, ok := kb.Certificate().PublicKey.(*rsa.PublicKey); !ok {
+		return fmt.Errorf("%s: %w", kb.Certificate().Subject.CommonName, ErrUnsupportedSigningAlgorithm)
+	}
+	return nil
+}
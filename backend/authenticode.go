@@ -0,0 +1,433 @@
+package backend
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/foxboron/go-uefi/pkcs7"
+	"golang.org/x/crypto/cryptobyte"
+	cbasn1 "golang.org/x/crypto/cryptobyte/asn1"
+)
+
+// go-uefi only produces SHA256 authenticode signatures, and doesn't check the
+// message digest when verifying them. The SHA384 and SHA512 signatures are
+// built here with the same layout, and all of them are verified here with the
+// digest algorithm the signature names.
+
+type HashAlgorithm string
+
+const (
+	SHA256 HashAlgorithm = "sha256"
+	SHA384 HashAlgorithm = "sha384"
+	SHA512 HashAlgorithm = "sha512"
+)
+
+var (
+	HashAlgorithms = []string{
+		string(SHA256),
+		string(SHA384),
+		string(SHA512),
+	}
+
+	ErrUnsupportedHashAlgorithm = errors.New("unsupported authenticode digest algorithm")
+
+	oidDigestAlgorithmSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidDigestAlgorithmSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+)
+
+// ParseHashAlgorithm returns the digest algorithm for signatures, SHA256 when
+// s is empty
+func ParseHashAlgorithm(s string) (HashAlgorithm, error) {
+	switch HashAlgorithm(s) {
+	case "":
+		return SHA256, nil
+	case SHA256, SHA384, SHA512:
+		return HashAlgorithm(s), nil
+	}
+	return "", fmt.Errorf("unknown hash algorithm: %s", s)
+}
+
+// IsCommon returns true if UEFI firmware can generally be expected to verify
+// signatures with the algorithm. Most implementations only support SHA256.
+func (h HashAlgorithm) IsCommon() bool {
+	return h == SHA256
+}
+
+func (h HashAlgorithm) Hash() crypto.Hash {
+	switch h {
+	case SHA384:
+		return crypto.SHA384
+	case SHA512:
+		return crypto.SHA512
+	default:
+		return crypto.SHA256
+	}
+}
+
+func digestOID(h crypto.Hash) asn1.ObjectIdentifier {
+	switch h {
+	case crypto.SHA384:
+		return oidDigestAlgorithmSHA384
+	case crypto.SHA512:
+		return oidDigestAlgorithmSHA512
+	default:
+		return pkcs7.OIDDigestAlgorithmSHA256
+	}
+}
+
+func digestHash(oid asn1.ObjectIdentifier) (crypto.Hash, error) {
+	switch {
+	case oid.Equal(pkcs7.OIDDigestAlgorithmSHA256):
+		return crypto.SHA256, nil
+	case oid.Equal(oidDigestAlgorithmSHA384):
+		return crypto.SHA384, nil
+	case oid.Equal(oidDigestAlgorithmSHA512):
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("%w: %s", ErrUnsupportedHashAlgorithm, oid)
+}
+
+// AuthenticodeHash returns the digest algorithm of the authenticode signature
+func AuthenticodeHash(auth *authenticode.Authenticode) (crypto.Hash, error) {
+	return digestHash(auth.Algid.Algorithm)
+}
+
+func addAlgorithmIdentifier(b *cryptobyte.Builder, oid asn1.ObjectIdentifier) {
+	b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		b.AddASN1ObjectIdentifier(oid)
+		b.AddASN1NULL()
+	})
+}
+
+// spcIndirectDataContent returns the SpcIndirectDataContent of go-uefi with
+// the digest algorithm of h
+func spcIndirectDataContent(digest []byte, h crypto.Hash) ([]byte, error) {
+	spc, err := authenticode.CreateSpcIndirectDataContent(digest, h)
+	if err != nil {
+		return nil, err
+	}
+	s := cryptobyte.String(spc)
+	var data cryptobyte.String
+	if !s.ReadASN1Element(&data, cbasn1.SEQUENCE) {
+		return nil, errors.New("malformed SpcIndirectDataContent")
+	}
+	b := cryptobyte.NewBuilder(nil)
+	b.AddBytes(data)
+	// DigestInfo
+	b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		addAlgorithmIdentifier(b, digestOID(h))
+		b.AddASN1OctetString(digest)
+	})
+	return b.Bytes()
+}
+
+// signedAttributes returns the SpcIndirectDataContent of the authenticode
+// content of a binary, hashed with h, and the DER encoded signed attributes
+// over it. The signing time is left out when it is zero.
+func signedAttributes(img []byte, h crypto.Hash, signingTime time.Time) ([]byte, []byte, error) {
+	digest := h.New()
+	digest.Write(img)
+	content, err := spcIndirectDataContent(digest.Sum(nil), h)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed creating SpcIndirectDataContent: %w", err)
+	}
+
+	contentDigest := h.New()
+	contentDigest.Write(content)
+	attrs := &pkcs7.Attributes{
+		ContentType:   authenticode.OIDSpcIndirectDataContent,
+		MessageDigest: contentDigest.Sum(nil),
+		SigningTime:   signingTime,
+	}
+	return content, attrs.Marshal(), nil
+}
+
+// SignAuthenticode returns the authenticode signature of the authenticode
+// content of a binary, hashed with h
+func SignAuthenticode(signer crypto.Signer, cert *x509.Certificate, img []byte, h crypto.Hash) ([]byte, error) {
+	if h == crypto.SHA256 {
+		return authenticode.SignAuthenticode(signer, cert, img, h)
+	}
+	content, attributes, err := signedAttributes(img, h, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	attrsDigest := h.New()
+	attrsDigest.Write(attributes)
+	sig, err := signer.Sign(rand.Reader, attrsDigest.Sum(nil), h)
+	if err != nil {
+		return nil, err
+	}
+	return buildAuthenticode(content, h, authenticodeSigner{cert, attributes, sig})
+}
+
+// ExternalSignedAttributes returns the DER encoded signed attributes of a
+// SHA256 authenticode signature of the authenticode content of a binary, for
+// an external signer to sign. They don't include a signing time, so
+// ExternalAuthenticode builds the same attributes when the signature comes
+// back.
+func ExternalSignedAttributes(img []byte) ([]byte, error) {
+	_, attributes, err := signedAttributes(img, crypto.SHA256, time.Time{})
+	return attributes, err
+}
+
+// ExternalAuthenticode returns the authenticode signature of the authenticode
+// content of a binary, from the raw PKCS#1 v1.5 signature sig the key of cert
+// made over the SHA256 digest of ExternalSignedAttributes
+func ExternalAuthenticode(cert *x509.Certificate, img, sig []byte) ([]byte, error) {
+	content, attributes, err := signedAttributes(img, crypto.SHA256, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return buildAuthenticode(content, crypto.SHA256, authenticodeSigner{cert, attributes, sig})
+}
+
+// authenticodeSigner is a SignerInfo of an authenticode signature, the raw
+// signature of the DER encoded signed attributes by the key of cert
+type authenticodeSigner struct {
+	cert       *x509.Certificate
+	attributes []byte
+	sig        []byte
+}
+
+// buildAuthenticode returns the PKCS#7 SignedData of an authenticode
+// signature over the SpcIndirectDataContent content
+func buildAuthenticode(content []byte, h crypto.Hash, signers ...authenticodeSigner) ([]byte, error) {
+	for _, s := range signers {
+		if _, ok := s.cert.PublicKey.(*rsa.PublicKey); !ok {
+			return nil, fmt.Errorf("%s: %w", s.cert.Subject.CommonName, ErrUnsupportedSigningAlgorithm)
+		}
+	}
+	b := cryptobyte.NewBuilder(nil)
+	// ContentInfo
+	b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		b.AddASN1ObjectIdentifier(pkcs7.OIDSignedData)
+		b.AddASN1(cbasn1.Tag(0).ContextSpecific().Constructed(), func(b *cryptobyte.Builder) {
+			// SignedData
+			b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+				b.AddASN1Int64(1)
+				b.AddASN1(cbasn1.SET, func(b *cryptobyte.Builder) {
+					addAlgorithmIdentifier(b, digestOID(h))
+				})
+				b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+					b.AddASN1ObjectIdentifier(authenticode.OIDSpcIndirectDataContent)
+					b.AddASN1(cbasn1.Tag(0).ContextSpecific().Constructed(), func(b *cryptobyte.Builder) {
+						b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+							b.AddBytes(content)
+						})
+					})
+				})
+				b.AddASN1(cbasn1.Tag(0).ContextSpecific().Constructed(), func(b *cryptobyte.Builder) {
+					var added []*x509.Certificate
+					for _, s := range signers {
+						if slices.ContainsFunc(added, s.cert.Equal) {
+							continue
+						}
+						added = append(added, s.cert)
+						b.AddBytes(s.cert.Raw)
+					}
+				})
+				b.AddASN1(cbasn1.SET, func(b *cryptobyte.Builder) {
+					for _, s := range signers {
+						// SignerInfo
+						b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+							b.AddASN1Int64(1)
+							b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+								b.AddBytes(s.cert.RawIssuer)
+								b.AddASN1BigInt(s.cert.SerialNumber)
+							})
+							addAlgorithmIdentifier(b, digestOID(h))
+							b.AddASN1(cbasn1.Tag(0).ContextSpecific().Constructed(), func(b *cryptobyte.Builder) {
+								set := cryptobyte.String(s.attributes)
+								var inner cryptobyte.String
+								set.ReadASN1(&inner, cbasn1.SET)
+								b.AddBytes(inner)
+							})
+							addAlgorithmIdentifier(b, pkcs7.OIDEncryptionAlgorithmRSA)
+							b.AddASN1OctetString(s.sig)
+						})
+					}
+				})
+			})
+		})
+	})
+	return b.Bytes()
+}
+
+// VerifyAuthenticode checks the authenticode signature against cert and the
+// authenticode content of a binary, with the digest algorithm the signature
+// uses. Every signer of cert is tried, so one with a bad digest or signature
+// doesn't hide a valid one.
+func VerifyAuthenticode(auth *authenticode.Authenticode, cert *x509.Certificate, img []byte) (bool, error) {
+	h, err := AuthenticodeHash(auth)
+	if err != nil {
+		return false, err
+	}
+
+	digest := h.New()
+	digest.Write(img)
+	if !bytes.Equal(digest.Sum(nil), auth.Digest) {
+		return false, errors.New("incorrect digest")
+	}
+	content := cryptobyte.String(auth.Pkcs.ContentInfo)
+	if !content.ReadASN1(&content, cbasn1.SEQUENCE) {
+		return false, errors.New("no spcindirectdatacontent")
+	}
+	contentDigest := h.New()
+	contentDigest.Write(content)
+
+	var sigAlg x509.SignatureAlgorithm
+	switch h {
+	case crypto.SHA256:
+		sigAlg = x509.SHA256WithRSA
+	case crypto.SHA384:
+		sigAlg = x509.SHA384WithRSA
+	case crypto.SHA512:
+		sigAlg = x509.SHA512WithRSA
+	}
+	var errs []error
+	for _, si := range auth.Pkcs.SignerInfo {
+		if !bytes.Equal(cert.RawIssuer, si.IssuerAndSerialnumber.RawIssuer) || cert.SerialNumber.Cmp(si.IssuerAndSerialnumber.SerialNumber) != 0 {
+			continue
+		}
+		if si.AuthenticatedAttributes == nil || !bytes.Equal(si.AuthenticatedAttributes.MessageDigest, contentDigest.Sum(nil)) {
+			errs = append(errs, errors.New("incorrect message digest"))
+			continue
+		}
+		if err := cert.CheckSignature(sigAlg, si.AuthenticatedAttributes.Marshal(), si.EncryptedDigest); err != nil {
+			errs = append(errs, fmt.Errorf("failed validating signature: %w", err))
+			continue
+		}
+		return true, nil
+	}
+	return false, errors.Join(errs...)
+}
+
+// VerifyPEBinary is PECOFFBinary.Verify for signatures with any of the
+// supported digest algorithms. Every signature is tried, so an invalid one
+// doesn't hide a valid signature after it. The errors of the signatures are
+// returned along with ErrNoValidSignatures if none of them verify.
+func VerifyPEBinary(peBinary *authenticode.PECOFFBinary, cert *x509.Certificate) (bool, error) {
+	return verifyPEBinary(peBinary, cert, 0)
+}
+
+// VerifyPEBinaryHash is VerifyPEBinary for the signatures made with the digest
+// algorithm h, the other signatures are ignored
+func VerifyPEBinaryHash(peBinary *authenticode.PECOFFBinary, cert *x509.Certificate, h crypto.Hash) (bool, error) {
+	return verifyPEBinary(peBinary, cert, h)
+}
+
+func verifyPEBinary(peBinary *authenticode.PECOFFBinary, cert *x509.Certificate, h crypto.Hash) (bool, error) {
+	sigs, err := peBinary.Signatures()
+	if err != nil {
+		return false, fmt.Errorf("failed fetching certificates from binary: %v", err)
+	}
+	if len(sigs) == 0 {
+		return false, authenticode.ErrNoSignatures
+	}
+	var errs []error
+	for i, sig := range sigs {
+		auth, err := authenticode.ParseAuthenticode(sig.Certificate)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("signature %d: failed parsing pkcs7 signature from binary: %v", i+1, err))
+			continue
+		}
+		if h != 0 {
+			if sigHash, err := AuthenticodeHash(auth); err != nil || sigHash != h {
+				continue
+			}
+		}
+		ok, err := VerifyAuthenticode(auth, cert, peBinary.HashContent.Bytes())
+		if err != nil {
+			errs = append(errs, fmt.Errorf("signature %d: %w", i+1, err))
+			continue
+		}
+		if ok {
+			return true, nil
+		}
+	}
+	if len(errs) != 0 {
+		return false, fmt.Errorf("%w: %w", authenticode.ErrNoValidSignatures, errors.Join(errs...))
+	}
+	return false, authenticode.ErrNoValidSignatures
+}
+
+// VerifyPEBinaryChain reports if a signature of the binary is made by cert, or
+// by a certificate which chains up to cert through the certificates embedded
+// in the signature, the way the firmware verifies the X509 entries of db
+func VerifyPEBinaryChain(peBinary *authenticode.PECOFFBinary, cert *x509.Certificate) (bool, error) {
+	sigs, err := peBinary.Signatures()
+	if err != nil {
+		return false, fmt.Errorf("failed fetching certificates from binary: %v", err)
+	}
+	if len(sigs) == 0 {
+		return false, authenticode.ErrNoSignatures
+	}
+	var errs []error
+	for _, sig := range sigs {
+		auth, err := authenticode.ParseAuthenticode(sig.Certificate)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed parsing pkcs7 signature from binary: %v", err))
+			continue
+		}
+		signers := auth.Pkcs.Certs
+		if !slices.ContainsFunc(signers, cert.Equal) {
+			signers = append(slices.Clip(signers), cert)
+		}
+		for _, signer := range signers {
+			if !chainsTo(signer, auth.Pkcs.Certs, cert) {
+				continue
+			}
+			ok, err := VerifyAuthenticode(auth, signer, peBinary.HashContent.Bytes())
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if ok {
+				return true, nil
+			}
+		}
+	}
+	if len(errs) != 0 {
+		return false, fmt.Errorf("%w: %w", authenticode.ErrNoValidSignatures, errors.Join(errs...))
+	}
+	return false, authenticode.ErrNoValidSignatures
+}
+
+// chainsTo reports if cert is anchor, or is issued by anchor through the
+// intermediate certificates
+func chainsTo(cert *x509.Certificate, intermediates []*x509.Certificate, anchor *x509.Certificate) bool {
+	// Every certificate is on the chain at most once
+	for range len(intermediates) + 1 {
+		if cert.Equal(anchor) || cert.CheckSignatureFrom(anchor) == nil {
+			return true
+		}
+		i := slices.IndexFunc(intermediates, func(c *x509.Certificate) bool {
+			return !c.Equal(cert) && cert.CheckSignatureFrom(c) == nil
+		})
+		if i == -1 {
+			return false
+		}
+		cert = intermediates[i]
+	}
+	return false
+}
+
+// SignatureDigestMatches returns true if the authenticode signature is for
+// the binary
+func SignatureDigestMatches(auth *authenticode.Authenticode, peBinary *authenticode.PECOFFBinary) (bool, error) {
+	h, err := AuthenticodeHash(auth)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(auth.Digest, peBinary.Hash(h)), nil
+}
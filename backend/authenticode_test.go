@@ -0,0 +1,169 @@
+package backend
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/foxboron/sbctl/hierarchy"
+	"golang.org/x/crypto/cryptobyte"
+	cbasn1 "golang.org/x/crypto/cryptobyte/asn1"
+)
+
+func TestSignAuthenticodeOpenSSL(t *testing.T) {
+	key, err := NewFileKey(hierarchy.Db, "Database Key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := []byte("authenticode content of a binary")
+	openssl, lookErr := exec.LookPath("openssl")
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "db.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: key.Certificate().Raw}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, alg := range HashAlgorithms {
+		h := HashAlgorithm(alg).Hash()
+		sig, err := SignAuthenticode(key.Signer(), key.Certificate(), img, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		auth, err := authenticode.ParseAuthenticode(sig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := AuthenticodeHash(auth); err != nil || got != h {
+			t.Fatalf("%s: unexpected digest algorithm %v: %v", alg, got, err)
+		}
+		if ok, err := VerifyAuthenticode(auth, key.Certificate(), img); err != nil || !ok {
+			t.Fatalf("%s: failed verifying the signature: %v", alg, err)
+		}
+		if lookErr != nil {
+			continue
+		}
+
+		// The message digest of authenticode covers the value of the
+		// SpcIndirectDataContent, which is passed as detached content the
+		// way sbverify and osslsigncode do
+		content := cryptobyte.String(auth.Pkcs.ContentInfo)
+		if !content.ReadASN1(&content, cbasn1.SEQUENCE) {
+			t.Fatal("no spcindirectdatacontent")
+		}
+		sigFile := filepath.Join(dir, alg+".p7")
+		contentFile := filepath.Join(dir, alg+".content")
+		if err := os.WriteFile(sigFile, sig, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(contentFile, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		out, err := exec.Command(openssl, "smime", "-verify", "-inform", "DER", "-in", sigFile, "-content", contentFile,
+			"-binary", "-CAfile", filepath.Join(dir, "db.pem"), "-purpose", "any", "-out", os.DevNull).CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s: openssl failed verifying the signature: %v\n%s", alg, err, out)
+		}
+	}
+	if lookErr != nil {
+		t.Skip("openssl is not installed")
+	}
+}
+
+func TestVerifyAuthenticodeSigners(t *testing.T) {
+	key, err := NewFileKey(hierarchy.Db, "Database Key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := []byte("authenticode content of a binary")
+	h := crypto.SHA384
+	content, attributes, err := signedAttributes(img, h, time.Now().UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(attributes []byte) authenticodeSigner {
+		digest := h.New()
+		digest.Write(attributes)
+		sig, err := key.Signer().Sign(rand.Reader, digest.Sum(nil), h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return authenticodeSigner{key.Certificate(), attributes, sig}
+	}
+	// A signer of the certificate over the attributes of another binary
+	_, otherAttributes, err := signedAttributes([]byte("another binary"), h, time.Now().UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad := sign(otherAttributes)
+	good := sign(attributes)
+
+	verify := func(signers ...authenticodeSigner) (bool, error) {
+		sig, err := buildAuthenticode(content, h, signers...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		auth, err := authenticode.ParseAuthenticode(sig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return VerifyAuthenticode(auth, key.Certificate(), img)
+	}
+	if ok, err := verify(bad, good); err != nil || !ok {
+		t.Fatalf("expected the second signer to verify, got %v: %v", ok, err)
+	}
+	if ok, err := verify(bad); err == nil || ok {
+		t.Fatalf("expected an incorrect message digest, got %v: %v", ok, err)
+	}
+}
+
+func TestVerifyPEBinarySignatures(t *testing.T) {
+	key, err := NewFileKey(hierarchy.Db, "Database Key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile("../tests/binaries/test.pecoff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peBinary, err := authenticode.Parse(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first signature is for another binary
+	bad, err := SignAuthenticode(key.Signer(), key.Certificate(), []byte("another binary"), crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peBinary.AppendSignature(bad); err != nil {
+		t.Fatal(err)
+	}
+	verify := func() (bool, error) {
+		peBinary, err := authenticode.Parse(bytes.NewReader(peBinary.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return VerifyPEBinary(peBinary, key.Certificate())
+	}
+	if ok, err := verify(); ok || !errors.Is(err, authenticode.ErrNoValidSignatures) || !strings.Contains(err.Error(), "incorrect digest") {
+		t.Fatalf("expected ErrNoValidSignatures with the digest error, got %v: %v", ok, err)
+	}
+
+	good, err := SignAuthenticode(key.Signer(), key.Certificate(), peBinary.HashContent.Bytes(), crypto.SHA384)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peBinary.AppendSignature(good); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := verify(); err != nil || !ok {
+		t.Fatalf("expected the second signature to verify, got %v: %v", ok, err)
+	}
+}
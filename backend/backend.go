@@ -2,7 +2,9 @@ package backend
 
 import (
 	"crypto"
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
 	"errors"
 	"fmt"
@@ -10,6 +12,7 @@ import (
 	"os"
 	"path/filepath"
 
+	keyfile "github.com/foxboron/go-tpm-keyfiles"
 	"github.com/foxboron/go-uefi/authenticode"
 	"github.com/foxboron/go-uefi/efivar"
 	"github.com/foxboron/sbctl/config"
@@ -24,6 +27,11 @@ const (
 	FileBackend    BackendType = "file"
 	YubikeyBackend BackendType = "yubikey"
 	TPMBackend     BackendType = "tpm"
+	PKCS11Backend  BackendType = "pkcs11"
+	GPGBackend     BackendType = "gpg"
+	SealedBackend  BackendType = "tpm-sealed"
+	// File keys encrypted with a passphrase
+	EncryptedBackend BackendType = "encrypted"
 )
 
 type KeyBackend interface {
@@ -46,19 +54,25 @@ type KeyHierarchy struct {
 func (k *KeyHierarchy) GetConfig(keydir string) *config.Keys {
 	return &config.Keys{
 		PK: &config.KeyConfig{
-			Privkey: filepath.Join(keydir, "PK/PK.key"),
-			Pubkey:  filepath.Join(keydir, "PK/PK.pem"),
-			Type:    string(k.PK.Type()),
+			Privkey:   filepath.Join(keydir, "PK/PK.key"),
+			Pubkey:    filepath.Join(keydir, "PK/PK.pem"),
+			Type:      string(k.PK.Type()),
+			Algorithm: string(GetKeyAlgorithm(k.PK)),
+			PCRs:      sealedPCRs(k.PK),
 		},
 		KEK: &config.KeyConfig{
-			Privkey: filepath.Join(keydir, "KEK/KEK.key"),
-			Pubkey:  filepath.Join(keydir, "KEK/KEK.pem"),
-			Type:    string(k.KEK.Type()),
+			Privkey:   filepath.Join(keydir, "KEK/KEK.key"),
+			Pubkey:    filepath.Join(keydir, "KEK/KEK.pem"),
+			Type:      string(k.KEK.Type()),
+			Algorithm: string(GetKeyAlgorithm(k.KEK)),
+			PCRs:      sealedPCRs(k.KEK),
 		},
 		Db: &config.KeyConfig{
-			Privkey: filepath.Join(keydir, "db/db.key"),
-			Pubkey:  filepath.Join(keydir, "db/db.pem"),
-			Type:    string(k.Db.Type()),
+			Privkey:   filepath.Join(keydir, "db/db.key"),
+			Pubkey:    filepath.Join(keydir, "db/db.pem"),
+			Type:      string(k.Db.Type()),
+			Algorithm: string(GetKeyAlgorithm(k.Db)),
+			PCRs:      sealedPCRs(k.Db),
 		},
 	}
 }
@@ -128,11 +142,11 @@ func (k *KeyHierarchy) RotateKeyWithBackend(hier hierarchy.Hierarchy, backend Ba
 	var err error
 	switch hier {
 	case hierarchy.PK:
-		k.PK, err = createKey(k.state, string(backend), hier, k.PK.Description())
+		k.PK, err = createKey(k.state, string(backend), hier, k.PK.Description(), string(GetKeyAlgorithm(k.PK)), sealedPCRs(k.PK))
 	case hierarchy.KEK:
-		k.KEK, err = createKey(k.state, string(backend), hier, k.KEK.Description())
+		k.KEK, err = createKey(k.state, string(backend), hier, k.KEK.Description(), string(GetKeyAlgorithm(k.KEK)), sealedPCRs(k.KEK))
 	case hierarchy.Db:
-		k.Db, err = createKey(k.state, string(backend), hier, k.Db.Description())
+		k.Db, err = createKey(k.state, string(backend), hier, k.Db.Description(), string(GetKeyAlgorithm(k.Db)), sealedPCRs(k.Db))
 	}
 	return err
 }
@@ -171,7 +185,7 @@ func (k *KeyHierarchy) VerifyFile(hier hierarchy.Hierarchy, r io.ReaderAt) (bool
 		return false, nil
 	}
 
-	ok, err := peBinary.Verify(kk.Certificate())
+	ok, err := VerifyPEBinary(peBinary, kk.Certificate())
 	if errors.Is(err, authenticode.ErrNoValidSignatures) {
 		return false, nil
 	} else if err != nil {
@@ -182,6 +196,9 @@ func (k *KeyHierarchy) VerifyFile(hier hierarchy.Hierarchy, r io.ReaderAt) (bool
 
 func (k *KeyHierarchy) SignFile(hier hierarchy.Hierarchy, peBinary *authenticode.PECOFFBinary) ([]byte, error) {
 	kk := k.GetKeyBackend(hier.Efivar())
+	if err := CheckSigningAlgorithm(kk); err != nil {
+		return nil, err
+	}
 	signer := kk.Signer()
 
 	_, err := peBinary.Sign(signer, kk.Certificate())
@@ -191,17 +208,78 @@ func (k *KeyHierarchy) SignFile(hier hierarchy.Hierarchy, peBinary *authenticode
 	return peBinary.Bytes(), nil
 }
 
-func createKey(state *config.State, backend string, hier hierarchy.Hierarchy, desc string) (KeyBackend, error) {
+// sealedPCRs returns the PCRs a rotated key should be sealed to
+func sealedPCRs(kb KeyBackend) []uint {
+	if sk, ok := kb.(*SealedKey); ok {
+		return sk.PCRs()
+	}
+	return nil
+}
+
+// SignFileDetached returns the PKCS#7 authenticode signature of the binary
+// without embedding it, as produced by sbsign --detached. The binary is hashed
+// with alg.
+func (k *KeyHierarchy) SignFileDetached(hier hierarchy.Hierarchy, peBinary *authenticode.PECOFFBinary, alg HashAlgorithm) ([]byte, error) {
+	kk := k.GetKeyBackend(hier.Efivar())
+	if err := CheckSigningAlgorithm(kk); err != nil {
+		return nil, err
+	}
+	return SignAuthenticode(kk.Signer(), kk.Certificate(), peBinary.HashContent.Bytes(), alg.Hash())
+}
+
+// VerifyFileDetached checks a detached PKCS#7 authenticode signature of r
+func (k *KeyHierarchy) VerifyFileDetached(hier hierarchy.Hierarchy, r io.ReaderAt, sig []byte) (bool, error) {
+	kk := k.GetKeyBackend(hier.Efivar())
+
+	peBinary, err := authenticode.Parse(r)
+	if err != nil {
+		return false, err
+	}
+
+	auth, err := authenticode.ParseAuthenticode(sig)
+	if err != nil {
+		return false, err
+	}
+	// The signature is for a different binary
+	if ok, err := SignatureDigestMatches(auth, peBinary); err != nil || !ok {
+		return false, err
+	}
+	ok, err := VerifyAuthenticode(auth, kk.Certificate(), peBinary.HashContent.Bytes())
+	if err != nil {
+		return false, err
+	}
+	return ok, nil
+}
+
+func createKey(state *config.State, backend string, hier hierarchy.Hierarchy, desc string, algorithm string, pcrs []uint) (KeyBackend, error) {
 	if desc == "" {
 		desc = hier.Description()
 	}
 	switch backend {
-	case "file", "":
-		return NewFileKey(hier, desc)
+	case string(SealedBackend):
+		alg, err := ParseKeyAlgorithm(algorithm)
+		if err != nil {
+			return nil, err
+		}
+		return NewSealedKey(state.TPM, hier, desc, alg, pcrs)
+	case string(EncryptedBackend):
+		alg, err := ParseKeyAlgorithm(algorithm)
+		if err != nil {
+			return nil, err
+		}
+		return NewEncryptedKey(state.Passphrase, hier, desc, alg)
 	case "tpm":
-		return NewTPMKey(state.TPM, desc)
+		// TPM keys are always RSA 2048
+		if algorithm != "" && KeyAlgorithm(algorithm) != RSA2048 {
+			return nil, fmt.Errorf("tpm keys only support %s", RSA2048)
+		}
+		return NewTPMKey(state.TPM, hier, desc)
 	default:
-		return NewFileKey(hier, desc)
+		alg, err := ParseKeyAlgorithm(algorithm)
+		if err != nil {
+			return nil, err
+		}
+		return NewFileKeyWithAlgorithm(hier, desc, alg)
 	}
 }
 
@@ -210,17 +288,17 @@ func CreateKeys(state *config.State) (*KeyHierarchy, error) {
 	var err error
 
 	c := state.Config
-	hier.PK, err = createKey(state, c.Keys.PK.Type, hierarchy.PK, c.Keys.PK.Description)
+	hier.PK, err = createKey(state, c.Keys.PK.Type, hierarchy.PK, c.Keys.PK.Description, c.Keys.PK.Algorithm, c.Keys.PK.PCRs)
 	if err != nil {
 		return nil, err
 	}
 
-	hier.KEK, err = createKey(state, c.Keys.KEK.Type, hierarchy.KEK, c.Keys.KEK.Description)
+	hier.KEK, err = createKey(state, c.Keys.KEK.Type, hierarchy.KEK, c.Keys.KEK.Description, c.Keys.KEK.Algorithm, c.Keys.KEK.PCRs)
 	if err != nil {
 		return nil, err
 	}
 
-	hier.Db, err = createKey(state, c.Keys.Db.Type, hierarchy.Db, c.Keys.Db.Description)
+	hier.Db, err = createKey(state, c.Keys.Db.Type, hierarchy.Db, c.Keys.Db.Description, c.Keys.Db.Algorithm, c.Keys.Db.PCRs)
 	if err != nil {
 		return nil, err
 	}
@@ -255,6 +333,10 @@ func readKey(state *config.State, keydir string, kc *config.KeyConfig, hier hier
 		return FileKeyFromBytes(keyb, pemb)
 	case TPMBackend:
 		return TPMKeyFromBytes(state.TPM, keyb, pemb)
+	case SealedBackend:
+		return SealedKeyFromBytes(state.TPM, keyb, pemb)
+	case EncryptedBackend:
+		return EncryptedKeyFromBytes(state.Passphrase, keyb, pemb)
 	default:
 		return nil, fmt.Errorf("unknown key")
 	}
@@ -296,20 +378,73 @@ func GetKeyHierarchy(vfs afero.Fs, state *config.State) (*KeyHierarchy, error) {
 
 func GetBackendType(b []byte) (BackendType, error) {
 	block, _ := pem.Decode(b)
+	if block == nil {
+		return "", fmt.Errorf("no pem block")
+	}
 	// TODO: Add TSS2 keys
 	switch block.Type {
 	case "PRIVATE KEY":
 		return FileBackend, nil
 	case "TSS2 PRIVATE KEY":
+		key, err := keyfile.Parse(block.Bytes)
+		if err == nil && key.Keytype.Equal(keyfile.OIDSealedKey) {
+			return SealedBackend, nil
+		}
 		return TPMBackend, nil
+	case encryptedKeyPEMType:
+		return EncryptedBackend, nil
 	default:
 		return "", fmt.Errorf("unknown file type: %s", block.Type)
 	}
 }
 
-// TODO: fix this
-func ImportKeys(keydir string) (*KeyHierarchy, error) {
-	return nil, nil
+// ImportKeys reads a key hierarchy from a key directory other than the
+// configured one
+func ImportKeys(state *config.State, keydir string) (*KeyHierarchy, error) {
+	conf := *state.Config
+	conf.Keydir = keydir
+	importState := *state
+	importState.Config = &conf
+	kh, err := GetKeyHierarchy(state.Fs, &importState)
+	if err != nil {
+		return nil, err
+	}
+	kh.state = state
+	return kh, nil
+}
+
+var ErrKeyMismatch = errors.New("the certificate is not for the key")
+
+// SigningKeyHierarchy returns a hierarchy with the key and certificate in the
+// files as the db key, for signing with keys outside of the key directory.
+// The PK and KEK are unset.
+func SigningKeyHierarchy(state *config.State, keyFile, certFile string) (*KeyHierarchy, error) {
+	keyb, err := fs.ReadFile(state.Fs, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	pemb, err := fs.ReadFile(state.Fs, certFile)
+	if err != nil {
+		return nil, err
+	}
+	kb, err := InitBackendFromKeys(state, keyb, pemb, hierarchy.Db)
+	if err != nil {
+		return nil, fmt.Errorf("can't read %s and %s: %w", keyFile, certFile, err)
+	}
+	pub, ok := kb.Signer().Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(kb.Certificate().PublicKey) {
+		return nil, fmt.Errorf("%s: %w %s", certFile, ErrKeyMismatch, keyFile)
+	}
+	return &KeyHierarchy{
+		Db:    kb,
+		state: state,
+	}, nil
+}
+
+// Fingerprint returns the hex encoded SHA256 digest of the certificate
+func Fingerprint(kb KeyBackend) string {
+	sum := sha256.Sum256(kb.Certificate().Raw)
+	return hex.EncodeToString(sum[:])
 }
 
 func InitBackendFromKeys(state *config.State, priv, pem []byte, hier hierarchy.Hierarchy) (KeyBackend, error) {
@@ -322,6 +457,10 @@ func InitBackendFromKeys(state *config.State, priv, pem []byte, hier hierarchy.H
 		return FileKeyFromBytes(priv, pem)
 	case "tpm":
 		return TPMKeyFromBytes(state.TPM, priv, pem)
+	case SealedBackend:
+		return SealedKeyFromBytes(state.TPM, priv, pem)
+	case EncryptedBackend:
+		return EncryptedKeyFromBytes(state.Passphrase, priv, pem)
 	default:
 		return nil, fmt.Errorf("unknown key backend: %s", t)
 	}
@@ -41,3 +41,34 @@ func TestCreateKeys(t *testing.T) {
 	}
 	fmt.Println(key.Certificate().Subject.CommonName)
 }
+
+func TestCreateKeysAlgorithm(t *testing.T) {
+	c := &config.Config{
+		Keydir: t.TempDir(),
+		Keys: &config.Keys{
+			PK:  &config.KeyConfig{Algorithm: "ecdsa-p256"},
+			KEK: &config.KeyConfig{},
+			Db:  &config.KeyConfig{},
+		},
+	}
+	state := &config.State{
+		Fs:     afero.NewOsFs(),
+		Config: c,
+	}
+	// sbctl only signs with RSA keys
+	if _, err := CreateKeys(state); err == nil {
+		t.Fatal("expected an unknown key algorithm to be refused")
+	}
+
+	c.Keys.PK.Algorithm = string(RSA2048)
+	kh, err := CreateKeys(state)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if alg := GetKeyAlgorithm(kh.PK); alg != RSA2048 {
+		t.Fatalf("expected %s, got %s", RSA2048, alg)
+	}
+	if err := CheckSigningAlgorithm(kh.PK); err != nil {
+		t.Fatalf("%v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package backend
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/foxboron/sbctl/hierarchy"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted keys are file keys where the PEM encoded private key is encrypted
+// with AES-256-GCM, using a key derived from a passphrase with scrypt.
+//
+// Layout: salt | nonce | ciphertext
+const (
+	encryptedKeyPEMType  = "SBCTL ENCRYPTED PRIVATE KEY"
+	encryptedKeySaltSize = 16
+)
+
+var (
+	ErrNoPassphrase    = errors.New("the key is encrypted, but no passphrase is available")
+	ErrWrongPassphrase = errors.New("wrong passphrase or corrupted key")
+)
+
+// PassphraseFunc returns the passphrase of encrypted keys. With confirm the
+// passphrase is for a new key, and should be asked for twice.
+type PassphraseFunc func(confirm bool) ([]byte, error)
+
+// EncryptedKey is a file key where the private key is encrypted with a
+// passphrase. The key is only decrypted in memory, when the first signature is
+// made.
+type EncryptedKey struct {
+	encrypted  []byte
+	cert       *x509.Certificate
+	passphrase PassphraseFunc
+	// Decrypted key, only available after the first signature. Signatures can
+	// be made concurrently by sign-all.
+	mu  sync.Mutex
+	key *FileKey
+}
+
+func encryptedKeyCipher(passphrase, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key)
+	return newGCM(key)
+}
+
+func readKeyPassphrase(passphrase PassphraseFunc, confirm bool) ([]byte, error) {
+	if passphrase == nil {
+		return nil, ErrNoPassphrase
+	}
+	return passphrase(confirm)
+}
+
+// NewEncryptedKey creates a file key and encrypts it with the passphrase
+func NewEncryptedKey(passphrase PassphraseFunc, hier hierarchy.Hierarchy, desc string, alg KeyAlgorithm) (*EncryptedKey, error) {
+	key, err := NewFileKeyWithAlgorithm(hier, desc, alg)
+	if err != nil {
+		return nil, err
+	}
+	p, err := readKeyPassphrase(passphrase, true)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(p)
+
+	salt := make([]byte, encryptedKeySaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	gcm, err := encryptedKeyCipher(p, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	keyb := key.PrivateKeyBytes()
+	defer clear(keyb)
+	encrypted := append(salt, nonce...)
+	encrypted = gcm.Seal(encrypted, nonce, keyb, nil)
+	return &EncryptedKey{
+		encrypted:  encrypted,
+		cert:       key.Certificate(),
+		passphrase: passphrase,
+		key:        key,
+	}, nil
+}
+
+// EncryptedKeyFromBytes reads an encrypted key. The passphrase is only asked
+// for when the key is used for signing.
+func EncryptedKeyFromBytes(passphrase PassphraseFunc, keyb, pemb []byte) (*EncryptedKey, error) {
+	encBlock, _ := pem.Decode(keyb)
+	if encBlock == nil || encBlock.Type != encryptedKeyPEMType {
+		return nil, fmt.Errorf("missing encrypted private key")
+	}
+	block, _ := pem.Decode(pemb)
+	if block == nil {
+		return nil, fmt.Errorf("no pem block")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse cert: %w", err)
+	}
+	return &EncryptedKey{
+		encrypted:  encBlock.Bytes,
+		cert:       cert,
+		passphrase: passphrase,
+	}, nil
+}
+
+// Decrypt decrypts the private key with the passphrase. The decrypted key is
+// kept in memory, and never written to disk.
+func (e *EncryptedKey) Decrypt() (*FileKey, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.key != nil {
+		return e.key, nil
+	}
+	if len(e.encrypted) < encryptedKeySaltSize {
+		return nil, fmt.Errorf("malformed encrypted private key")
+	}
+	p, err := readKeyPassphrase(e.passphrase, false)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(p)
+	salt, rest := e.encrypted[:encryptedKeySaltSize], e.encrypted[encryptedKeySaltSize:]
+	gcm, err := encryptedKeyCipher(p, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < gcm.NonceSize() {
+		return nil, fmt.Errorf("malformed encrypted private key")
+	}
+	nonce, ciphertext := rest[:gcm.NonceSize()], rest[gcm.NonceSize():]
+	keyb, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	defer clear(keyb)
+	e.key, err = FileKeyFromBytes(keyb, e.CertificateBytes())
+	if err != nil {
+		return nil, err
+	}
+	return e.key, nil
+}
+
+func (e *EncryptedKey) Type() BackendType              { return EncryptedBackend }
+func (e *EncryptedKey) Certificate() *x509.Certificate { return e.cert }
+func (e *EncryptedKey) Description() string            { return e.cert.Subject.SerialNumber }
+func (e *EncryptedKey) Signer() crypto.Signer          { return &encryptedSigner{e} }
+
+// PrivateKeyBytes returns the encrypted private key
+func (e *EncryptedKey) PrivateKeyBytes() []byte {
+	b := new(bytes.Buffer)
+	if err := pem.Encode(b, &pem.Block{Type: encryptedKeyPEMType, Bytes: e.encrypted}); err != nil {
+		panic("failed producing PEM encoded encrypted key")
+	}
+	return b.Bytes()
+}
+
+func (e *EncryptedKey) CertificateBytes() []byte {
+	b := new(bytes.Buffer)
+	if err := pem.Encode(b, &pem.Block{Type: "CERTIFICATE", Bytes: e.cert.Raw}); err != nil {
+		panic("failed producing PEM encoded certificate")
+	}
+	return b.Bytes()
+}
+
+// encryptedSigner decrypts the key when the first signature is made, so
+// reading the key hierarchy does not require the passphrase.
+type encryptedSigner struct {
+	key *EncryptedKey
+}
+
+func (s *encryptedSigner) Public() crypto.PublicKey { return s.key.cert.PublicKey }
+
+func (s *encryptedSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	key, err := s.key.Decrypt()
+	if err != nil {
+		return nil, err
+	}
+	return key.Signer().Sign(rand, digest, opts)
+}
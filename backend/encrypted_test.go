@@ -0,0 +1,68 @@
+package backend
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/foxboron/sbctl/hierarchy"
+)
+
+func TestEncryptedKey(t *testing.T) {
+	passphrase := func(confirm bool) ([]byte, error) { return []byte("secret"), nil }
+	key, err := NewEncryptedKey(passphrase, hierarchy.Db, "test", RSA2048)
+	if err != nil {
+		t.Fatalf("failed encrypting key: %v", err)
+	}
+
+	if bt, err := GetBackendType(key.PrivateKeyBytes()); err != nil || bt != EncryptedBackend {
+		t.Fatalf("expected encrypted backend, got %v: %v", bt, err)
+	}
+	plain, err := key.Decrypt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(key.PrivateKeyBytes(), plain.PrivateKeyBytes()) {
+		t.Fatal("the private key is stored in plaintext")
+	}
+
+	// Read the key back so it's decrypted with the passphrase
+	asked := 0
+	key, err = EncryptedKeyFromBytes(func(bool) ([]byte, error) {
+		asked++
+		return []byte("secret"), nil
+	}, key.PrivateKeyBytes(), key.CertificateBytes())
+	if err != nil {
+		t.Fatalf("failed reading encrypted key: %v", err)
+	}
+	if asked != 0 {
+		t.Fatal("expected the passphrase to be read when signing")
+	}
+	digest := sha256.Sum256([]byte("test"))
+	for range 2 {
+		if _, err := key.Signer().Sign(nil, digest[:], crypto.SHA256); err != nil {
+			t.Fatalf("failed signing with encrypted key: %v", err)
+		}
+	}
+	if asked != 1 {
+		t.Fatalf("expected the passphrase to be read once, got %d", asked)
+	}
+
+	key, err = EncryptedKeyFromBytes(func(bool) ([]byte, error) { return []byte("wrong"), nil }, key.PrivateKeyBytes(), key.CertificateBytes())
+	if err != nil {
+		t.Fatalf("failed reading encrypted key: %v", err)
+	}
+	if _, err := key.Signer().Sign(nil, digest[:], crypto.SHA256); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("expected ErrWrongPassphrase, got %v", err)
+	}
+
+	key, err = EncryptedKeyFromBytes(nil, key.PrivateKeyBytes(), key.CertificateBytes())
+	if err != nil {
+		t.Fatalf("failed reading encrypted key: %v", err)
+	}
+	if _, err := key.Signer().Sign(nil, digest[:], crypto.SHA256); !errors.Is(err, ErrNoPassphrase) {
+		t.Fatalf("expected ErrNoPassphrase, got %v", err)
+	}
+}
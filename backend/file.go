@@ -3,6 +3,7 @@ package backend
 import (
 	"bytes"
 	"crypto"
+	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
@@ -11,6 +12,7 @@ import (
 	"fmt"
 	"math/big"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/foxboron/sbctl/fs"
@@ -21,13 +23,105 @@ import (
 
 var RSAKeySize = 4096
 
+// NotAfter is when the certificates of created keys expire. They are valid
+// for five years if it is unset.
+var NotAfter time.Time
+
+func certificateNotAfter() time.Time {
+	if NotAfter.IsZero() {
+		return time.Now().AddDate(5, 0, 0)
+	}
+	return NotAfter
+}
+
+// Subject is the subject of the certificates of created keys. A common name
+// is used as it is for every key. Without one, the name of the hierarchy is
+// appended to the organization, e.g. "My Org PK". The key description is the
+// subject if it is empty.
+var Subject pkix.Name
+
+func certificateSubject(hier hierarchy.Hierarchy, desc string) pkix.Name {
+	if len(Subject.ToRDNSequence()) == 0 {
+		return pkix.Name{
+			Country:    []string{desc},
+			CommonName: desc,
+		}
+	}
+	name := Subject
+	switch {
+	case name.CommonName != "":
+	case len(name.Organization) != 0:
+		name.CommonName = name.Organization[0] + " " + hier.String()
+	default:
+		name.CommonName = desc
+	}
+	return name
+}
+
+// ParseSubject parses a distinguished name, either comma separated like
+// "CN=My Org,O=My Org,C=US" or slash separated like "/CN=My Org/O=My Org".
+// Separators in values are escaped with a backslash.
+func ParseSubject(dn string) (pkix.Name, error) {
+	var name pkix.Name
+	s, sep := dn, ','
+	if strings.HasPrefix(s, "/") {
+		s, sep = s[1:], '/'
+	}
+	var attrs []string
+	var cur strings.Builder
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == sep:
+			attrs = append(attrs, cur.String())
+			cur.Reset()
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	attrs = append(attrs, cur.String())
+	for _, attr := range attrs {
+		k, v, ok := strings.Cut(attr, "=")
+		k, v = strings.TrimSpace(k), strings.TrimSpace(v)
+		if !ok || v == "" {
+			return pkix.Name{}, fmt.Errorf("invalid attribute %q in subject %q", attr, dn)
+		}
+		switch strings.ToUpper(k) {
+		case "CN":
+			name.CommonName = v
+		case "O":
+			name.Organization = append(name.Organization, v)
+		case "OU":
+			name.OrganizationalUnit = append(name.OrganizationalUnit, v)
+		case "C":
+			name.Country = append(name.Country, v)
+		case "L":
+			name.Locality = append(name.Locality, v)
+		case "ST":
+			name.Province = append(name.Province, v)
+		default:
+			return pkix.Name{}, fmt.Errorf("unsupported attribute %s in subject %q, supported are CN, O, OU, C, L and ST", k, dn)
+		}
+	}
+	return name, nil
+}
+
 type FileKey struct {
 	keytype BackendType
 	cert    *x509.Certificate
-	privkey *rsa.PrivateKey
+	privkey crypto.Signer
 }
 
-func NewFileKey(_ hierarchy.Hierarchy, desc string) (*FileKey, error) {
+func NewFileKey(hier hierarchy.Hierarchy, desc string) (*FileKey, error) {
+	return NewFileKeyWithAlgorithm(hier, desc, DefaultKeyAlgorithm())
+}
+
+func NewFileKeyWithAlgorithm(hier hierarchy.Hierarchy, desc string, alg KeyAlgorithm) (*FileKey, error) {
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, _ := rand.Int(rand.Reader, serialNumberLimit)
 	c := x509.Certificate{
@@ -35,17 +129,14 @@ func NewFileKey(_ hierarchy.Hierarchy, desc string) (*FileKey, error) {
 		PublicKeyAlgorithm: x509.RSA,
 		SignatureAlgorithm: x509.SHA256WithRSA,
 		NotBefore:          time.Now(),
-		NotAfter:           time.Now().AddDate(5, 0, 0),
-		Subject: pkix.Name{
-			Country:    []string{desc},
-			CommonName: desc,
-		},
+		NotAfter:           certificateNotAfter(),
+		Subject:            certificateSubject(hier, desc),
 	}
-	priv, err := rsa.GenerateKey(rand.Reader, RSAKeySize)
+	priv, err := alg.generateKey()
 	if err != nil {
 		return nil, err
 	}
-	derBytes, err := x509.CreateCertificate(rand.Reader, &c, &c, &priv.PublicKey, priv)
+	derBytes, err := x509.CreateCertificate(rand.Reader, &c, &c, priv.Public(), priv)
 	if err != nil {
 		return nil, err
 	}
@@ -90,10 +181,12 @@ func FileKeyFromBytes(keyb, pemb []byte) (*FileKey, error) {
 		return nil, fmt.Errorf("failed to parse key: %w", err)
 	}
 
-	var key *rsa.PrivateKey
+	var key crypto.Signer
 	switch priv := priv.(type) {
 	case *rsa.PrivateKey:
 		key = priv
+	case *ecdsa.PrivateKey:
+		key = priv
 	default:
 		return nil, fmt.Errorf("unknown type of public key")
 	}
@@ -0,0 +1,357 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/foxboron/sbctl/hierarchy"
+)
+
+var ErrGPGKeyNotFound = errors.New("no RSA signing key found in gpg")
+
+// Hash algorithm numbers of libgcrypt, which SETHASH takes
+var gpgHashAlgos = map[crypto.Hash]int{
+	crypto.SHA1:   2,
+	crypto.SHA256: 8,
+	crypto.SHA384: 9,
+	crypto.SHA512: 10,
+}
+
+// GPGKey is a private key held by gpg-agent, like a key on an OpenPGP card.
+// The digest is signed by the agent, which asks for the PIN itself. The
+// certificate is read from the key directory.
+type GPGKey struct {
+	keyID   string
+	keygrip string
+	socket  string
+	pub     *rsa.PublicKey
+	cert    *x509.Certificate
+}
+
+// OpenGPGKey looks up the signing key of keyID with gpg and reads its public
+// key from gpg-agent. keyID can be anything gpg accepts to select a key, like
+// a fingerprint, or a keygrip prefixed with &. This needs to happen before
+// landlock is enabled as gpg and gpgconf are executed.
+func OpenGPGKey(keyID string) (*GPGKey, error) {
+	out, err := exec.Command("gpgconf", "--list-dirs", "agent-socket").Output()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't find the gpg-agent socket: %w", err)
+	}
+	socket := strings.TrimSpace(string(out))
+
+	keygrip, ok := strings.CutPrefix(keyID, "&")
+	if !ok {
+		out, err := exec.Command("gpg", "--batch", "--with-colons", "--with-keygrip", "--list-secret-keys", "--", keyID).Output()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't list the gpg key %s: %w", keyID, err)
+		}
+		if keygrip, err = gpgSigningKeygrip(out); err != nil {
+			return nil, fmt.Errorf("%s: %w", keyID, err)
+		}
+	}
+	return openGPGKey(keyID, keygrip, socket)
+}
+
+func openGPGKey(keyID, keygrip, socket string) (*GPGKey, error) {
+	key := &GPGKey{keyID: keyID, keygrip: keygrip, socket: socket}
+	conn, err := dialAssuan(socket)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	b, err := conn.transact("READKEY " + keygrip)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read the public key of %s: %w", keyID, err)
+	}
+	s, err := parseSexp(b)
+	if err != nil {
+		return nil, err
+	}
+	n, e := s.value("n"), s.value("e")
+	if s.find("rsa") == nil || n == nil || e == nil {
+		return nil, fmt.Errorf("%s: %w", keyID, ErrGPGKeyNotFound)
+	}
+	key.pub = &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}
+	return key, nil
+}
+
+// gpgSigningKeygrip returns the keygrip of the first RSA key with the sign
+// capability in the output of gpg --with-colons --with-keygrip
+func gpgSigningKeygrip(colons []byte) (string, error) {
+	var signing bool
+	for _, line := range strings.Split(string(colons), "\n") {
+		fields := strings.Split(line, ":")
+		switch fields[0] {
+		case "sec", "ssb":
+			// Lowercase capabilities are the ones of the key itself, RSA
+			// is algorithm 1
+			signing = len(fields) > 11 && fields[3] == "1" && strings.Contains(fields[11], "s")
+		case "grp":
+			if signing && len(fields) > 9 && fields[9] != "" {
+				return fields[9], nil
+			}
+		}
+	}
+	return "", ErrGPGKeyNotFound
+}
+
+func (g *GPGKey) Close() error { return nil }
+
+func (g *GPGKey) Public() crypto.PublicKey { return g.pub }
+
+func (g *GPGKey) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if _, ok := opts.(*rsa.PSSOptions); ok {
+		return nil, fmt.Errorf("PSS signatures are not supported with gpg keys")
+	}
+	algo, ok := gpgHashAlgos[opts.HashFunc()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash function: %v", opts.HashFunc())
+	}
+	conn, err := dialAssuan(g.socket)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// The agent starts pinentry on the terminal of its own environment
+	// unless it's told about ours
+	for _, opt := range []struct{ name, env string }{
+		{"ttyname", "GPG_TTY"},
+		{"ttytype", "TERM"},
+		{"display", "DISPLAY"},
+	} {
+		if v := os.Getenv(opt.env); v != "" {
+			_, _ = conn.transact(fmt.Sprintf("OPTION %s=%s", opt.name, v))
+		}
+	}
+	for _, cmd := range []string{
+		"SIGKEY " + g.keygrip,
+		fmt.Sprintf("SETHASH %d %s", algo, strings.ToUpper(hex.EncodeToString(digest))),
+	} {
+		if _, err := conn.transact(cmd); err != nil {
+			return nil, fmt.Errorf("couldn't sign with gpg key %s: %w", g.keyID, err)
+		}
+	}
+	b, err := conn.transact("PKSIGN")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't sign with gpg key %s: %w", g.keyID, err)
+	}
+	s, err := parseSexp(b)
+	if err != nil {
+		return nil, err
+	}
+	sig := s.value("s")
+	if sig == nil {
+		return nil, fmt.Errorf("gpg-agent returned no RSA signature")
+	}
+	// Leading zeros are stripped from the signature
+	size := (g.pub.N.BitLen() + 7) / 8
+	if len(sig) < size {
+		sig = append(make([]byte, size-len(sig)), sig...)
+	}
+	return sig, nil
+}
+
+func (g *GPGKey) Type() BackendType              { return GPGBackend }
+func (g *GPGKey) Certificate() *x509.Certificate { return g.cert }
+func (g *GPGKey) Description() string            { return g.cert.Subject.CommonName }
+func (g *GPGKey) Signer() crypto.Signer          { return g }
+
+// PrivateKeyBytes returns the key ID, the private key never leaves gpg
+func (g *GPGKey) PrivateKeyBytes() []byte { return []byte("gpg:" + g.keyID) }
+
+func (g *GPGKey) CertificateBytes() []byte {
+	b := new(bytes.Buffer)
+	if err := pem.Encode(b, &pem.Block{Type: "CERTIFICATE", Bytes: g.cert.Raw}); err != nil {
+		panic("failed producing PEM encoded certificate")
+	}
+	return b.Bytes()
+}
+
+// UseGPGKey replaces the key in the hierarchy whose certificate matches the
+// public key of the gpg key.
+func (k *KeyHierarchy) UseGPGKey(key *GPGKey) (hierarchy.Hierarchy, error) {
+	for _, hier := range []hierarchy.Hierarchy{hierarchy.PK, hierarchy.KEK, hierarchy.Db} {
+		kb := k.GetKeyBackend(hier.Efivar())
+		if !key.pub.Equal(kb.Certificate().PublicKey) {
+			continue
+		}
+		key.cert = kb.Certificate()
+		switch hier {
+		case hierarchy.PK:
+			k.PK = key
+		case hierarchy.KEK:
+			k.KEK = key
+		case hierarchy.Db:
+			k.Db = key
+		}
+		return hier, nil
+	}
+	return 0, fmt.Errorf("the gpg key does not match any certificate in the key directory")
+}
+
+// assuanConn is a connection to gpg-agent speaking the Assuan protocol
+type assuanConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialAssuan(socket string) (*assuanConn, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to gpg-agent: %w", err)
+	}
+	a := &assuanConn{conn: conn, r: bufio.NewReader(conn)}
+	// The agent greets with OK
+	if _, err := a.response(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *assuanConn) Close() error {
+	return a.conn.Close()
+}
+
+// transact sends the command and returns the data of the response
+func (a *assuanConn) transact(cmd string) ([]byte, error) {
+	if _, err := io.WriteString(a.conn, cmd+"\n"); err != nil {
+		return nil, err
+	}
+	return a.response()
+}
+
+func (a *assuanConn) response() ([]byte, error) {
+	var data []byte
+	for {
+		line, err := a.r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("gpg-agent: %w", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "OK" || strings.HasPrefix(line, "OK "):
+			return data, nil
+		case strings.HasPrefix(line, "ERR "):
+			return nil, fmt.Errorf("gpg-agent: %s", strings.TrimPrefix(line, "ERR "))
+		case strings.HasPrefix(line, "D "):
+			data = append(data, assuanUnescape(line[2:])...)
+		case strings.HasPrefix(line, "INQUIRE "):
+			// Inquiries like PINENTRY_LAUNCHED are only informational
+			if _, err := io.WriteString(a.conn, "END\n"); err != nil {
+				return nil, err
+			}
+		}
+		// Status lines and comments are ignored
+	}
+}
+
+// assuanUnescape decodes the percent escapes of a data line
+func assuanUnescape(s string) []byte {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+				b = append(b, byte(n))
+				i += 2
+				continue
+			}
+		}
+		b = append(b, s[i])
+	}
+	return b
+}
+
+// sexp is a canonical S-expression as used by gpg-agent, with the list
+// elements being []byte or sexp
+type sexp []any
+
+func parseSexp(b []byte) (sexp, error) {
+	s, rest, err := parseSexpList(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, errors.New("trailing data after S-expression")
+	}
+	return s, nil
+}
+
+func parseSexpList(b []byte) (sexp, []byte, error) {
+	if len(b) == 0 || b[0] != '(' {
+		return nil, nil, errors.New("invalid S-expression")
+	}
+	b = b[1:]
+	var s sexp
+	for {
+		switch {
+		case len(b) == 0:
+			return nil, nil, errors.New("unterminated S-expression")
+		case b[0] == ')':
+			return s, b[1:], nil
+		case b[0] == '(':
+			sub, rest, err := parseSexpList(b)
+			if err != nil {
+				return nil, nil, err
+			}
+			s = append(s, sub)
+			b = rest
+		default:
+			i := bytes.IndexByte(b, ':')
+			if i < 1 {
+				return nil, nil, errors.New("invalid S-expression")
+			}
+			n, err := strconv.Atoi(string(b[:i]))
+			if err != nil || n < 0 || i+1+n > len(b) {
+				return nil, nil, errors.New("invalid S-expression length")
+			}
+			s = append(s, b[i+1:i+1+n])
+			b = b[i+1+n:]
+		}
+	}
+}
+
+// find returns the first list named name, searching depth first
+func (s sexp) find(name string) sexp {
+	if len(s) > 0 {
+		if n, ok := s[0].([]byte); ok && string(n) == name {
+			return s
+		}
+	}
+	for _, e := range s {
+		if sub, ok := e.(sexp); ok {
+			if found := sub.find(name); found != nil {
+				return found
+			}
+		}
+	}
+	return nil
+}
+
+// value returns the value of the list (name value)
+func (s sexp) value(name string) []byte {
+	l := s.find(name)
+	if len(l) < 2 {
+		return nil
+	}
+	v, _ := l[1].([]byte)
+	return v
+}
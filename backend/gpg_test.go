@@ -0,0 +1,137 @@
+package backend
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestGPGSigningKeygrip(t *testing.T) {
+	colons := `sec:u:3072:1:0123456789ABCDEF:1700000000:::u:::cC:::+:::23::0:
+fpr:::::::::0123456789ABCDEF0123456789ABCDEF01234567:
+grp:::::::::AAAA:
+uid:u::::1700000000::HASH::sbctl <sbctl@example.com>::::::::::0:
+ssb:u:2048:22:1111111111111111:1700000000::::::s:::+:::23:
+fpr:::::::::1111111111111111111111111111111111111111:
+grp:::::::::BBBB:
+ssb:u:2048:1:2222222222222222:1700000000::::::s:::D2760001240103040006:::23:
+fpr:::::::::2222222222222222222222222222222222222222:
+grp:::::::::CCCC:
+`
+	grip, err := gpgSigningKeygrip([]byte(colons))
+	if err != nil || grip != "CCCC" {
+		t.Fatalf("expected keygrip CCCC, got %s: %v", grip, err)
+	}
+	if _, err := gpgSigningKeygrip([]byte(colons[:strings.Index(colons, "ssb:u:2048:1")])); !errors.Is(err, ErrGPGKeyNotFound) {
+		t.Fatalf("expected ErrGPGKeyNotFound, got %v", err)
+	}
+}
+
+func TestParseSexp(t *testing.T) {
+	s, err := parseSexp(assuanUnescape("(7:sig-val(3:rsa(1:s3:a%0Ab)))"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if s.find("rsa") == nil || string(s.value("s")) != "a\nb" {
+		t.Fatalf("unexpected S-expression: %v", s)
+	}
+	for _, b := range []string{"", "(1:s", "(9:s)", "(1:s)x", "s"} {
+		if _, err := parseSexp([]byte(b)); err == nil {
+			t.Fatalf("%q: expected error", b)
+		}
+	}
+}
+
+func sexpAtom(b []byte) string {
+	return strconv.Itoa(len(b)) + ":" + string(b)
+}
+
+func assuanEscape(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// fakeGPGAgent serves READKEY and PKSIGN for key on a unix socket
+func fakeGPGAgent(t *testing.T, key *rsa.PrivateKey) string {
+	socket := filepath.Join(t.TempDir(), "S.gpg-agent")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				fmt.Fprintf(conn, "OK Pleased to meet you\n")
+				var digest []byte
+				r := bufio.NewScanner(conn)
+				for r.Scan() {
+					cmd, arg, _ := strings.Cut(r.Text(), " ")
+					switch cmd {
+					case "READKEY":
+						e := []byte{byte(key.E >> 16), byte(key.E >> 8), byte(key.E)}
+						s := "(10:public-key(3:rsa(1:n" + sexpAtom(key.N.Bytes()) + ")(1:e" + sexpAtom(e) + ")))"
+						fmt.Fprintf(conn, "D %s\nOK\n", assuanEscape(s))
+					case "SETHASH":
+						_, h, _ := strings.Cut(arg, " ")
+						digest, _ = hex.DecodeString(h)
+						fmt.Fprintf(conn, "OK\n")
+					case "PKSIGN":
+						sig, err := rsa.SignPKCS1v15(nil, key, crypto.SHA256, digest)
+						if err != nil {
+							fmt.Fprintf(conn, "ERR 1 %v\n", err)
+							continue
+						}
+						fmt.Fprintf(conn, "INQUIRE PINENTRY_LAUNCHED 1234\n")
+						r.Scan()
+						s := "(7:sig-val(3:rsa(1:s" + sexpAtom(sig) + ")))"
+						fmt.Fprintf(conn, "D %s\nOK\n", assuanEscape(s))
+					default:
+						fmt.Fprintf(conn, "OK\n")
+					}
+				}
+			}(conn)
+		}
+	}()
+	return socket
+}
+
+func TestGPGKeySign(t *testing.T) {
+	pk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	key, err := openGPGKey("0123456789ABCDEF", "AAAA", fakeGPGAgent(t, pk))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !key.pub.Equal(&pk.PublicKey) {
+		t.Fatalf("unexpected public key")
+	}
+
+	digest := sha256.Sum256([]byte("sbctl"))
+	sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := rsa.VerifyPKCS1v15(&pk.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+		t.Fatalf("signature does not verify: %v", err)
+	}
+	if _, err := key.Sign(rand.Reader, digest[:], &rsa.PSSOptions{Hash: crypto.SHA256}); err == nil {
+		t.Fatalf("expected PSS to be rejected")
+	}
+}
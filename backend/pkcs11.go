@@ -0,0 +1,233 @@
+//go:build cgo
+
+package backend
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+
+	"github.com/foxboron/sbctl/hierarchy"
+	"github.com/miekg/pkcs11"
+)
+
+// PKCS11Supported is true when sbctl is built with support for PKCS#11 tokens
+const PKCS11Supported = true
+
+// DER encoded DigestInfo prefixes, CKM_RSA_PKCS expects the caller to add them
+var digestInfoPrefix = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// PKCS11Key is a private key held on a PKCS#11 token. The certificate is read
+// from the key directory.
+type PKCS11Key struct {
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	handle  pkcs11.ObjectHandle
+	uri     string
+	pub     *rsa.PublicKey
+	cert    *x509.Certificate
+}
+
+// OpenPKCS11Key loads the PKCS#11 module, logs into the token and looks up the
+// private key referenced by the URI. pin is only called if the token requires
+// a login and the URI has no pin-value.
+func OpenPKCS11Key(module string, uri string, pin func() ([]byte, error)) (*PKCS11Key, error) {
+	u, err := ParsePKCS11URI(uri)
+	if err != nil {
+		return nil, err
+	}
+	module, err = u.Module(module)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := pkcs11.New(module)
+	if ctx == nil {
+		return nil, fmt.Errorf("couldn't load pkcs11 module %s", module)
+	}
+	key := &PKCS11Key{ctx: ctx, uri: uri}
+	if err := ctx.Initialize(); err != nil {
+		ctx.Destroy()
+		return nil, fmt.Errorf("couldn't initialize pkcs11 module %s: %w", module, err)
+	}
+	if err := key.open(u, pin); err != nil {
+		key.Close()
+		return nil, err
+	}
+	return key, nil
+}
+
+func (p *PKCS11Key) findSlot(u *PKCS11URI) (uint, pkcs11.TokenInfo, error) {
+	slots, err := p.ctx.GetSlotList(true)
+	if err != nil {
+		return 0, pkcs11.TokenInfo{}, fmt.Errorf("couldn't list pkcs11 slots: %w", err)
+	}
+	for _, slot := range slots {
+		info, err := p.ctx.GetTokenInfo(slot)
+		if err != nil {
+			continue
+		}
+		if u.Token != "" && strings.TrimRight(info.Label, " ") != u.Token {
+			continue
+		}
+		if u.Serial != "" && strings.TrimRight(info.SerialNumber, " ") != u.Serial {
+			continue
+		}
+		return slot, info, nil
+	}
+	if u.Token != "" {
+		return 0, pkcs11.TokenInfo{}, fmt.Errorf("couldn't find pkcs11 token %q", u.Token)
+	}
+	return 0, pkcs11.TokenInfo{}, fmt.Errorf("couldn't find any pkcs11 token")
+}
+
+func (p *PKCS11Key) open(u *PKCS11URI, pin func() ([]byte, error)) error {
+	slot, info, err := p.findSlot(u)
+	if err != nil {
+		return err
+	}
+	p.session, err = p.ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return fmt.Errorf("couldn't open pkcs11 session: %w", err)
+	}
+
+	if info.Flags&pkcs11.CKF_LOGIN_REQUIRED != 0 {
+		userPin := u.PinValue
+		// Tokens with a protected authentication path read the PIN themselves
+		if userPin == "" && info.Flags&pkcs11.CKF_PROTECTED_AUTHENTICATION_PATH == 0 {
+			b, err := pin()
+			if err != nil {
+				return err
+			}
+			defer clear(b)
+			userPin = string(b)
+		}
+		err = p.ctx.Login(p.session, pkcs11.CKU_USER, userPin)
+		if err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+			return fmt.Errorf("couldn't log into pkcs11 token: %w", err)
+		}
+	}
+
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+	}
+	if u.Object != "" {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_LABEL, u.Object))
+	}
+	if len(u.ID) != 0 {
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_ID, u.ID))
+	}
+	if err := p.ctx.FindObjectsInit(p.session, template); err != nil {
+		return fmt.Errorf("couldn't search pkcs11 token: %w", err)
+	}
+	objs, _, err := p.ctx.FindObjects(p.session, 2)
+	p.ctx.FindObjectsFinal(p.session)
+	if err != nil {
+		return fmt.Errorf("couldn't search pkcs11 token: %w", err)
+	}
+	switch len(objs) {
+	case 0:
+		return fmt.Errorf("couldn't find a private key matching %s", p.uri)
+	case 1:
+		p.handle = objs[0]
+	default:
+		return fmt.Errorf("more than one private key matches %s", p.uri)
+	}
+
+	attrs, err := p.ctx.GetAttributeValue(p.session, p.handle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't read the public key from the token: %w", err)
+	}
+	if !bytes.Equal(attrs[0].Value, pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA).Value) {
+		return fmt.Errorf("token key: %w", ErrUnsupportedSigningAlgorithm)
+	}
+	p.pub = &rsa.PublicKey{
+		N: new(big.Int).SetBytes(attrs[1].Value),
+		E: int(new(big.Int).SetBytes(attrs[2].Value).Int64()),
+	}
+	return nil
+}
+
+// Close logs out of the token and unloads the module
+func (p *PKCS11Key) Close() error {
+	p.ctx.Logout(p.session)
+	p.ctx.CloseSession(p.session)
+	err := p.ctx.Finalize()
+	p.ctx.Destroy()
+	return err
+}
+
+func (p *PKCS11Key) Public() crypto.PublicKey { return p.pub }
+
+func (p *PKCS11Key) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if _, ok := opts.(*rsa.PSSOptions); ok {
+		return nil, fmt.Errorf("PSS signatures are not supported with pkcs11 keys")
+	}
+	prefix, ok := digestInfoPrefix[opts.HashFunc()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash function: %v", opts.HashFunc())
+	}
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)}
+	if err := p.ctx.SignInit(p.session, mech, p.handle); err != nil {
+		return nil, fmt.Errorf("couldn't sign with pkcs11 key: %w", err)
+	}
+	sig, err := p.ctx.Sign(p.session, append(prefix, digest...))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't sign with pkcs11 key: %w", err)
+	}
+	return sig, nil
+}
+
+func (p *PKCS11Key) Type() BackendType              { return PKCS11Backend }
+func (p *PKCS11Key) Certificate() *x509.Certificate { return p.cert }
+func (p *PKCS11Key) Description() string            { return p.cert.Subject.CommonName }
+func (p *PKCS11Key) Signer() crypto.Signer          { return p }
+
+// PrivateKeyBytes returns the URI, the private key never leaves the token
+func (p *PKCS11Key) PrivateKeyBytes() []byte { return []byte(p.uri) }
+
+func (p *PKCS11Key) CertificateBytes() []byte {
+	b := new(bytes.Buffer)
+	if err := pem.Encode(b, &pem.Block{Type: "CERTIFICATE", Bytes: p.cert.Raw}); err != nil {
+		panic("failed producing PEM encoded certificate")
+	}
+	return b.Bytes()
+}
+
+// UseTokenKey replaces the key in the hierarchy whose certificate matches the
+// public key on the token.
+func (k *KeyHierarchy) UseTokenKey(key *PKCS11Key) (hierarchy.Hierarchy, error) {
+	for _, hier := range []hierarchy.Hierarchy{hierarchy.PK, hierarchy.KEK, hierarchy.Db} {
+		kb := k.GetKeyBackend(hier.Efivar())
+		if !key.pub.Equal(kb.Certificate().PublicKey) {
+			continue
+		}
+		key.cert = kb.Certificate()
+		switch hier {
+		case hierarchy.PK:
+			k.PK = key
+		case hierarchy.KEK:
+			k.KEK = key
+		case hierarchy.Db:
+			k.Db = key
+		}
+		return hier, nil
+	}
+	return 0, fmt.Errorf("the token key does not match any certificate in the key directory")
+}
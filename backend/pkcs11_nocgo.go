@@ -0,0 +1,29 @@
+//go:build !cgo
+
+package backend
+
+import (
+	"errors"
+
+	"github.com/foxboron/sbctl/hierarchy"
+)
+
+var ErrPKCS11Unsupported = errors.New("sbctl was built without cgo, pkcs11 tokens are not supported")
+
+// PKCS11Supported is true when sbctl is built with support for PKCS#11 tokens
+const PKCS11Supported = false
+
+type PKCS11Key struct{}
+
+func OpenPKCS11Key(module string, uri string, pin func() ([]byte, error)) (*PKCS11Key, error) {
+	if _, err := ParsePKCS11URI(uri); err != nil {
+		return nil, err
+	}
+	return nil, ErrPKCS11Unsupported
+}
+
+func (p *PKCS11Key) Close() error { return nil }
+
+func (k *KeyHierarchy) UseTokenKey(key *PKCS11Key) (hierarchy.Hierarchy, error) {
+	return 0, ErrPKCS11Unsupported
+}
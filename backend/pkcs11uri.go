@@ -0,0 +1,101 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+var (
+	ErrInvalidPKCS11URI = errors.New("invalid pkcs11 uri")
+	ErrNoPKCS11Module   = errors.New("no pkcs11 module configured, set pkcs11_module in the configuration")
+)
+
+// PKCS11URI holds the subset of RFC 7512 attributes used to locate a signing
+// key on a token.
+type PKCS11URI struct {
+	Token      string
+	Serial     string
+	Object     string
+	ID         []byte
+	ModulePath string
+	PinValue   string
+}
+
+func unescapePKCS11(attr, value string) (string, error) {
+	v, err := url.PathUnescape(value)
+	if err != nil {
+		return "", fmt.Errorf("%w: attribute %s: %v", ErrInvalidPKCS11URI, attr, err)
+	}
+	return v, nil
+}
+
+// ParsePKCS11URI parses a "pkcs11:token=...;object=..." URI
+func ParsePKCS11URI(s string) (*PKCS11URI, error) {
+	rest, ok := strings.CutPrefix(s, "pkcs11:")
+	if !ok {
+		return nil, fmt.Errorf("%w: missing pkcs11: scheme", ErrInvalidPKCS11URI)
+	}
+	path, query, _ := strings.Cut(rest, "?")
+
+	var uri PKCS11URI
+	for _, attr := range strings.Split(path, ";") {
+		if attr == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(attr, "=")
+		if !ok {
+			return nil, fmt.Errorf("%w: malformed attribute %q", ErrInvalidPKCS11URI, attr)
+		}
+		v, err := unescapePKCS11(k, v)
+		if err != nil {
+			return nil, err
+		}
+		switch k {
+		case "token":
+			uri.Token = v
+		case "serial":
+			uri.Serial = v
+		case "object":
+			uri.Object = v
+		case "id":
+			uri.ID = []byte(v)
+		}
+	}
+	for _, attr := range strings.Split(query, "&") {
+		if attr == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(attr, "=")
+		if !ok {
+			return nil, fmt.Errorf("%w: malformed query attribute %q", ErrInvalidPKCS11URI, attr)
+		}
+		v, err := unescapePKCS11(k, v)
+		if err != nil {
+			return nil, err
+		}
+		switch k {
+		case "module-path":
+			uri.ModulePath = v
+		case "pin-value":
+			uri.PinValue = v
+		}
+	}
+	if uri.Object == "" && len(uri.ID) == 0 {
+		return nil, fmt.Errorf("%w: object or id needs to be set", ErrInvalidPKCS11URI)
+	}
+	return &uri, nil
+}
+
+// Module returns the module path from the URI, falling back to the configured
+// module.
+func (u *PKCS11URI) Module(configured string) (string, error) {
+	if u.ModulePath != "" {
+		return u.ModulePath, nil
+	}
+	if configured != "" {
+		return configured, nil
+	}
+	return "", ErrNoPKCS11Module
+}
@@ -0,0 +1,45 @@
+package backend
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParsePKCS11URI(t *testing.T) {
+	uri, err := ParsePKCS11URI("pkcs11:token=My%20YubiKey;object=sbctl;id=%01?module-path=/usr/lib/libykcs11.so&pin-value=123456")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if uri.Token != "My YubiKey" || uri.Object != "sbctl" || string(uri.ID) != "\x01" {
+		t.Fatalf("unexpected path attributes: %+v", uri)
+	}
+	if uri.ModulePath != "/usr/lib/libykcs11.so" || uri.PinValue != "123456" {
+		t.Fatalf("unexpected query attributes: %+v", uri)
+	}
+
+	module, err := uri.Module("/usr/lib/other.so")
+	if err != nil || module != "/usr/lib/libykcs11.so" {
+		t.Fatalf("expected module from uri, got %s: %v", module, err)
+	}
+}
+
+func TestParsePKCS11URIInvalid(t *testing.T) {
+	for _, s := range []string{
+		"token=YubiKey;object=sbctl",
+		"pkcs11:token=YubiKey",
+		"pkcs11:token;object=sbctl",
+		"pkcs11:object=%zz",
+	} {
+		if _, err := ParsePKCS11URI(s); !errors.Is(err, ErrInvalidPKCS11URI) {
+			t.Fatalf("%s: expected ErrInvalidPKCS11URI, got %v", s, err)
+		}
+	}
+
+	uri, err := ParsePKCS11URI("pkcs11:object=sbctl")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := uri.Module(""); !errors.Is(err, ErrNoPKCS11Module) {
+		t.Fatalf("expected ErrNoPKCS11Module, got %v", err)
+	}
+}
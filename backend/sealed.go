@@ -0,0 +1,452 @@
+package backend
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	keyfile "github.com/foxboron/go-tpm-keyfiles"
+	"github.com/foxboron/sbctl/hierarchy"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+)
+
+const sealedKeyPEMType = "SBCTL SEALED PRIVATE KEY"
+
+var (
+	ErrNoTPM          = errors.New("no TPM available")
+	ErrPCRsChanged    = errors.New("the PCR values the key was sealed to have changed")
+	ErrNotASealedKey  = errors.New("not a TPM sealed key")
+	ErrTooManyPCRs    = errors.New("at most 8 PCRs can be sealed to")
+	ErrInvalidPCR     = errors.New("invalid PCR index")
+	sealedKeyPCRsHash = tpm2.TPMAlgSHA256
+)
+
+// SealedKey is a file key where the private key is encrypted with a wrapping
+// key sealed to the TPM. The wrapping key can be bound to a set of PCRs so the
+// private key is only usable on this machine in a known state.
+type SealedKey struct {
+	sealed    *keyfile.TPMKey
+	encrypted []byte
+	pcrs      []uint
+	cert      *x509.Certificate
+	tpm       func() transport.TPMCloser
+	// Unsealed key, only available after the first signature
+	key *FileKey
+}
+
+// ParsePCRs parses a list of PCR indexes, like "0,7"
+func ParsePCRs(s []string) ([]uint, error) {
+	pcrs := []uint{}
+	for _, v := range s {
+		for _, p := range strings.Split(v, ",") {
+			if p == "" {
+				continue
+			}
+			i, err := strconv.ParseUint(p, 10, 8)
+			if err != nil || i > 23 {
+				return nil, fmt.Errorf("%w: %s", ErrInvalidPCR, p)
+			}
+			pcrs = append(pcrs, uint(i))
+		}
+	}
+	if len(pcrs) > 8 {
+		return nil, ErrTooManyPCRs
+	}
+	return pcrs, nil
+}
+
+func formatPCRs(pcrs []uint) string {
+	s := make([]string, len(pcrs))
+	for i, p := range pcrs {
+		s[i] = strconv.FormatUint(uint64(p), 10)
+	}
+	return strings.Join(s, ",")
+}
+
+func pcrSelection(pcrs []uint) tpm2.TPMLPCRSelection {
+	return tpm2.TPMLPCRSelection{
+		PCRSelections: []tpm2.TPMSPCRSelection{
+			{
+				Hash:      sealedKeyPCRsHash,
+				PCRSelect: tpm2.PCClientCompatible.PCRs(pcrs...),
+			},
+		},
+	}
+}
+
+func selectionPCRs(sel tpm2.TPMLPCRSelection) []uint {
+	pcrs := []uint{}
+	for _, s := range sel.PCRSelections {
+		for i, b := range s.PCRSelect {
+			for bit := 0; bit < 8; bit++ {
+				if b&(1<<bit) != 0 {
+					pcrs = append(pcrs, uint(i*8+bit))
+				}
+			}
+		}
+	}
+	return pcrs
+}
+
+// pcrDigest returns the digest of the current PCR values as used by
+// TPM2_PolicyPCR
+func pcrDigest(rwc transport.TPM, sel tpm2.TPMLPCRSelection) ([]byte, error) {
+	rsp, err := tpm2.PCRRead{PCRSelectionIn: sel}.Execute(rwc)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading PCRs: %w", err)
+	}
+	h := sha256.New()
+	for _, d := range rsp.PCRValues.Digests {
+		h.Write(d.Buffer)
+	}
+	return h.Sum(nil), nil
+}
+
+// The command policy of TPM2_PolicyPCR is the marshalled pcrDigest and pcrs
+// parameters
+func marshalPolicyPCR(digest []byte, sel tpm2.TPMLPCRSelection) []byte {
+	var b []byte
+	b = append(b, tpm2.Marshal(tpm2.TPM2BDigest{Buffer: digest})...)
+	b = append(b, tpm2.Marshal(sel)...)
+	return b
+}
+
+func unmarshalPolicyPCR(b []byte) ([]byte, *tpm2.TPMLPCRSelection, error) {
+	if len(b) < 2 {
+		return nil, nil, fmt.Errorf("malformed PolicyPCR policy")
+	}
+	size := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+size {
+		return nil, nil, fmt.Errorf("malformed PolicyPCR policy")
+	}
+	sel, err := tpm2.Unmarshal[tpm2.TPMLPCRSelection](b[2+size:])
+	if err != nil {
+		return nil, nil, fmt.Errorf("malformed PolicyPCR policy: %w", err)
+	}
+	return b[2 : 2+size], sel, nil
+}
+
+func openTPM(tpmcb func() transport.TPMCloser) (transport.TPMCloser, error) {
+	if tpmcb == nil {
+		return nil, ErrNoTPM
+	}
+	rwc := tpmcb()
+	if rwc == nil {
+		return nil, ErrNoTPM
+	}
+	return rwc, nil
+}
+
+// seal seals data to the TPM owner hierarchy. If pcrs is not empty the data
+// can only be unsealed while the PCRs have their current values.
+func seal(rwc transport.TPMCloser, data []byte, pcrs []uint, desc string) (*keyfile.TPMKey, error) {
+	sess := keyfile.NewTPMSession(rwc)
+	srk, srkPub, err := keyfile.CreateSRK(sess, tpm2.TPMRHOwner, []byte(nil))
+	if err != nil {
+		return nil, err
+	}
+	defer keyfile.FlushHandle(rwc, srk)
+	sess.SetSalted(srk.Handle, *srkPub)
+
+	public := tpm2.TPMTPublic{
+		Type:    tpm2.TPMAlgKeyedHash,
+		NameAlg: tpm2.TPMAlgSHA256,
+		ObjectAttributes: tpm2.TPMAObject{
+			FixedTPM:     true,
+			FixedParent:  true,
+			NoDA:         true,
+			UserWithAuth: len(pcrs) == 0,
+		},
+	}
+
+	var policy []*keyfile.TPMPolicy
+	if len(pcrs) != 0 {
+		sel := pcrSelection(pcrs)
+		digest, err := pcrDigest(rwc, sel)
+		if err != nil {
+			return nil, err
+		}
+		calc, err := tpm2.NewPolicyCalculator(tpm2.TPMAlgSHA256)
+		if err != nil {
+			return nil, err
+		}
+		policyPCR := tpm2.PolicyPCR{
+			PcrDigest: tpm2.TPM2BDigest{Buffer: digest},
+			Pcrs:      sel,
+		}
+		if err := policyPCR.Update(calc); err != nil {
+			return nil, err
+		}
+		public.AuthPolicy = tpm2.TPM2BDigest{Buffer: calc.Hash().Digest}
+		policy = append(policy, &keyfile.TPMPolicy{
+			CommandCode:   int(tpm2.TPMCCPolicyPCR),
+			CommandPolicy: marshalPolicyPCR(digest, sel),
+		})
+	}
+
+	create := tpm2.Create{
+		ParentHandle: *srk,
+		InSensitive: tpm2.TPM2BSensitiveCreate{
+			Sensitive: &tpm2.TPMSSensitiveCreate{
+				Data: tpm2.NewTPMUSensitiveCreate(&tpm2.TPM2BSensitiveData{
+					Buffer: data,
+				}),
+			},
+		},
+		InPublic: tpm2.New2B(public),
+	}
+	rsp, err := create.Execute(rwc, sess.GetHMACIn())
+	if err != nil {
+		return nil, fmt.Errorf("failed sealing key: %w", err)
+	}
+	return keyfile.NewTPMKey(keyfile.OIDSealedKey, rsp.OutPublic, rsp.OutPrivate,
+		keyfile.WithPolicy(policy),
+		keyfile.WithDescription(desc),
+	), nil
+}
+
+// unseal loads the sealed object and satisfies its PCR policy
+func unseal(rwc transport.TPMCloser, key *keyfile.TPMKey) ([]byte, error) {
+	sess := keyfile.NewTPMSession(rwc)
+	srk, srkPub, err := keyfile.CreateSRK(sess, tpm2.TPMRHOwner, []byte(nil))
+	if err != nil {
+		return nil, err
+	}
+	defer keyfile.FlushHandle(rwc, srk)
+	sess.SetSalted(srk.Handle, *srkPub)
+
+	handle, err := keyfile.LoadKeyWithParent(sess, *srk, key)
+	if err != nil {
+		return nil, err
+	}
+	defer keyfile.FlushHandle(rwc, handle)
+
+	auth := tpm2.PasswordAuth(nil)
+	if len(key.Policy) != 0 {
+		policySess, closer, err := tpm2.PolicySession(rwc, tpm2.TPMAlgSHA256, 16)
+		if err != nil {
+			return nil, fmt.Errorf("failed creating policy session: %w", err)
+		}
+		defer closer()
+		for _, p := range key.Policy {
+			if tpm2.TPMCC(p.CommandCode) != tpm2.TPMCCPolicyPCR {
+				return nil, fmt.Errorf("unsupported policy command: 0x%x", p.CommandCode)
+			}
+			digest, sel, err := unmarshalPolicyPCR(p.CommandPolicy)
+			if err != nil {
+				return nil, err
+			}
+			_, err = tpm2.PolicyPCR{
+				PolicySession: policySess.Handle(),
+				PcrDigest:     tpm2.TPM2BDigest{Buffer: digest},
+				Pcrs:          *sel,
+			}.Execute(rwc)
+			if errors.Is(err, tpm2.TPMRCValue) {
+				return nil, fmt.Errorf("%w: PCR %s", ErrPCRsChanged, formatPCRs(selectionPCRs(*sel)))
+			} else if err != nil {
+				return nil, fmt.Errorf("failed satisfying PCR policy: %w", err)
+			}
+		}
+		auth = policySess
+	}
+
+	rsp, err := tpm2.Unseal{
+		ItemHandle: tpm2.AuthHandle{
+			Handle: handle.Handle,
+			Name:   handle.Name,
+			Auth:   auth,
+		},
+	}.Execute(rwc)
+	if errors.Is(err, tpm2.TPMRCPolicyFail) {
+		return nil, ErrPCRsChanged
+	} else if err != nil {
+		return nil, fmt.Errorf("failed unsealing key: %w", err)
+	}
+	return rsp.OutData.Buffer, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// NewSealedKey creates a file key and seals it to the TPM, bound to pcrs
+func NewSealedKey(tpmcb func() transport.TPMCloser, hier hierarchy.Hierarchy, desc string, alg KeyAlgorithm, pcrs []uint) (*SealedKey, error) {
+	rwc, err := openTPM(tpmcb)
+	if err != nil {
+		return nil, err
+	}
+	if len(pcrs) > 8 {
+		return nil, ErrTooManyPCRs
+	}
+	key, err := NewFileKeyWithAlgorithm(hier, desc, alg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sealed objects are limited to 128 bytes, so we seal a wrapping key
+	wrapkey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, wrapkey); err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(wrapkey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	encrypted := gcm.Seal(nonce, nonce, key.PrivateKeyBytes(), nil)
+
+	sealed, err := seal(rwc, wrapkey, pcrs, desc)
+	if err != nil {
+		return nil, err
+	}
+	return &SealedKey{
+		sealed:    sealed,
+		encrypted: encrypted,
+		pcrs:      pcrs,
+		cert:      key.Certificate(),
+		tpm:       tpmcb,
+	}, nil
+}
+
+// SealedKeyFromBytes reads a sealed key. The key is only unsealed when it is
+// used for signing.
+func SealedKeyFromBytes(tpmcb func() transport.TPMCloser, keyb, pemb []byte) (*SealedKey, error) {
+	sealedBlock, rest := pem.Decode(keyb)
+	if sealedBlock == nil {
+		return nil, ErrNotASealedKey
+	}
+	sealed, err := keyfile.Parse(sealedBlock.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing tpm keyfile: %v", err)
+	}
+	if !sealed.Keytype.Equal(keyfile.OIDSealedKey) {
+		return nil, ErrNotASealedKey
+	}
+	encBlock, _ := pem.Decode(rest)
+	if encBlock == nil || encBlock.Type != sealedKeyPEMType {
+		return nil, fmt.Errorf("missing encrypted private key")
+	}
+
+	pcrs := []uint{}
+	for _, p := range sealed.Policy {
+		if tpm2.TPMCC(p.CommandCode) != tpm2.TPMCCPolicyPCR {
+			continue
+		}
+		_, sel, err := unmarshalPolicyPCR(p.CommandPolicy)
+		if err != nil {
+			return nil, err
+		}
+		pcrs = append(pcrs, selectionPCRs(*sel)...)
+	}
+
+	block, _ := pem.Decode(pemb)
+	if block == nil {
+		return nil, fmt.Errorf("no pem block")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse cert: %w", err)
+	}
+	return &SealedKey{
+		sealed:    sealed,
+		encrypted: encBlock.Bytes,
+		pcrs:      pcrs,
+		cert:      cert,
+		tpm:       tpmcb,
+	}, nil
+}
+
+// Unseal decrypts the private key with the wrapping key sealed to the TPM
+func (s *SealedKey) Unseal() (*FileKey, error) {
+	if s.key != nil {
+		return s.key, nil
+	}
+	rwc, err := openTPM(s.tpm)
+	if err != nil {
+		return nil, err
+	}
+	wrapkey, err := unseal(rwc, s.sealed)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(wrapkey)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.encrypted) < gcm.NonceSize() {
+		return nil, fmt.Errorf("malformed encrypted private key")
+	}
+	nonce, ciphertext := s.encrypted[:gcm.NonceSize()], s.encrypted[gcm.NonceSize():]
+	keyb, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed decrypting private key: %w", err)
+	}
+	pemb := s.CertificateBytes()
+	s.key, err = FileKeyFromBytes(keyb, pemb)
+	if err != nil {
+		return nil, err
+	}
+	return s.key, nil
+}
+
+// PCRs returns the PCRs the key is sealed to
+func (s *SealedKey) PCRs() []uint { return s.pcrs }
+
+func (s *SealedKey) Type() BackendType              { return SealedBackend }
+func (s *SealedKey) Certificate() *x509.Certificate { return s.cert }
+func (s *SealedKey) Description() string            { return s.sealed.Description }
+func (s *SealedKey) Signer() crypto.Signer          { return &sealedSigner{s} }
+
+func (s *SealedKey) PrivateKeyBytes() []byte {
+	b := new(bytes.Buffer)
+	if err := keyfile.Encode(b, s.sealed); err != nil {
+		panic("failed producing PEM encoded sealed key")
+	}
+	if err := pem.Encode(b, &pem.Block{Type: sealedKeyPEMType, Bytes: s.encrypted}); err != nil {
+		panic("failed producing PEM encoded sealed key")
+	}
+	return b.Bytes()
+}
+
+func (s *SealedKey) CertificateBytes() []byte {
+	b := new(bytes.Buffer)
+	if err := pem.Encode(b, &pem.Block{Type: "CERTIFICATE", Bytes: s.cert.Raw}); err != nil {
+		panic("failed producing PEM encoded certificate")
+	}
+	return b.Bytes()
+}
+
+// sealedSigner unseals the key when the first signature is made, so reading
+// the key hierarchy does not require the PCR policy to be satisfied.
+type sealedSigner struct {
+	key *SealedKey
+}
+
+func (s *sealedSigner) Public() crypto.PublicKey { return s.key.cert.PublicKey }
+
+func (s *sealedSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	key, err := s.key.Unseal()
+	if err != nil {
+		return nil, err
+	}
+	return key.Signer().Sign(rand, digest, opts)
+}
@@ -0,0 +1,83 @@
+package backend
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/foxboron/sbctl/hierarchy"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+)
+
+func TestParsePCRs(t *testing.T) {
+	pcrs, err := ParsePCRs([]string{"0,7", "11"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !reflect.DeepEqual(pcrs, []uint{0, 7, 11}) {
+		t.Fatalf("unexpected pcrs: %v", pcrs)
+	}
+	if _, err := ParsePCRs([]string{"24"}); !errors.Is(err, ErrInvalidPCR) {
+		t.Fatalf("expected ErrInvalidPCR, got %v", err)
+	}
+}
+
+func TestSealedKey(t *testing.T) {
+	rwc, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rwc.Close()
+	tpmcb := func() transport.TPMCloser { return rwc }
+
+	key, err := NewSealedKey(tpmcb, hierarchy.Db, "test", RSA2048, []uint{7})
+	if err != nil {
+		t.Fatalf("failed sealing key: %v", err)
+	}
+
+	if bt, err := GetBackendType(key.PrivateKeyBytes()); err != nil || bt != SealedBackend {
+		t.Fatalf("expected sealed backend, got %v: %v", bt, err)
+	}
+
+	// Read the key back so we unseal through the TPM
+	key, err = SealedKeyFromBytes(tpmcb, key.PrivateKeyBytes(), key.CertificateBytes())
+	if err != nil {
+		t.Fatalf("failed reading sealed key: %v", err)
+	}
+	if !reflect.DeepEqual(key.PCRs(), []uint{7}) {
+		t.Fatalf("unexpected pcrs: %v", key.PCRs())
+	}
+
+	digest := sha256.Sum256([]byte("test"))
+	if _, err := key.Signer().Sign(nil, digest[:], crypto.SHA256); err != nil {
+		t.Fatalf("failed signing with sealed key: %v", err)
+	}
+
+	// Changing PCR 7 should make the key unusable
+	_, err = tpm2.PCRExtend{
+		PCRHandle: tpm2.AuthHandle{
+			Handle: tpm2.TPMHandle(7),
+			Auth:   tpm2.PasswordAuth(nil),
+		},
+		Digests: tpm2.TPMLDigestValues{
+			Digests: []tpm2.TPMTHA{
+				{HashAlg: tpm2.TPMAlgSHA256, Digest: digest[:]},
+			},
+		},
+	}.Execute(rwc)
+	if err != nil {
+		t.Fatalf("failed extending PCR: %v", err)
+	}
+
+	key, err = SealedKeyFromBytes(tpmcb, key.PrivateKeyBytes(), key.CertificateBytes())
+	if err != nil {
+		t.Fatalf("failed reading sealed key: %v", err)
+	}
+	if _, err := key.Signer().Sign(nil, digest[:], crypto.SHA256); !errors.Is(err, ErrPCRsChanged) {
+		t.Fatalf("expected ErrPCRsChanged, got %v", err)
+	}
+}
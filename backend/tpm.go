@@ -5,7 +5,6 @@ import (
 	"crypto"
 	"crypto/rand"
 	"crypto/x509"
-	"crypto/x509/pkix"
 	"encoding/pem"
 	"fmt"
 	"math/big"
@@ -27,7 +26,7 @@ type TPMKey struct {
 	tpm     func() transport.TPMCloser
 }
 
-func NewTPMKey(tpmcb func() transport.TPMCloser, desc string) (*TPMKey, error) {
+func NewTPMKey(tpmcb func() transport.TPMCloser, hier hierarchy.Hierarchy, desc string) (*TPMKey, error) {
 	rwc := tpmcb()
 	key, err := keyfile.NewLoadableKey(rwc, tpm2.TPMAlgRSA, 2048, []byte(nil),
 		keyfile.WithDescription(desc),
@@ -43,11 +42,8 @@ func NewTPMKey(tpmcb func() transport.TPMCloser, desc string) (*TPMKey, error) {
 		PublicKeyAlgorithm: x509.RSA,
 		SignatureAlgorithm: x509.SHA256WithRSA,
 		NotBefore:          time.Now(),
-		NotAfter:           time.Now().AddDate(5, 0, 0),
-		Subject: pkix.Name{
-			Country:    []string{desc},
-			CommonName: desc,
-		},
+		NotAfter:           certificateNotAfter(),
+		Subject:            certificateSubject(hier, desc),
 	}
 
 	pubkey, err := key.PublicKey()
@@ -0,0 +1,156 @@
+package sbctl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/foxboron/go-uefi/efivarfs"
+)
+
+// LOAD_OPTION_ACTIVE from section 3.1.3 of the UEFI specification
+const loadOptionActive = 0x1
+
+// Device path node types for the file path media device path, and the end of
+// the device path
+const (
+	devicePathMedia    = 0x04
+	devicePathFilePath = 0x04
+	devicePathEnd      = 0x7f
+)
+
+var ErrInvalidLoadOption = errors.New("invalid EFI load option")
+
+// BootEntry is a Boot#### variable referenced by BootOrder
+type BootEntry struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Active      bool   `json:"active"`
+	// Path on the ESP of the binary the entry loads. Empty for entries which
+	// don't load a file, like network boot or the firmware setup.
+	File string `json:"file,omitempty"`
+	// Set for stale entries in BootOrder whose Boot#### variable doesn't
+	// exist
+	Missing bool `json:"missing,omitempty"`
+}
+
+type loadOption struct {
+	attributes  uint32
+	description string
+	filePath    string
+}
+
+func decodeUTF16(b []byte) string {
+	u := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		c := binary.LittleEndian.Uint16(b[i:])
+		if c == 0 {
+			break
+		}
+		u = append(u, c)
+	}
+	return string(utf16.Decode(u))
+}
+
+// Unmarshal parses an EFI_LOAD_OPTION
+func (l *loadOption) Unmarshal(buf *bytes.Buffer) error {
+	b := buf.Bytes()
+	if len(b) < 6 {
+		return ErrInvalidLoadOption
+	}
+	l.attributes = binary.LittleEndian.Uint32(b)
+	pathLen := int(binary.LittleEndian.Uint16(b[4:]))
+	b = b[6:]
+
+	end := -1
+	for i := 0; i+1 < len(b); i += 2 {
+		if b[i] == 0 && b[i+1] == 0 {
+			end = i
+			break
+		}
+	}
+	if end == -1 {
+		return ErrInvalidLoadOption
+	}
+	l.description = decodeUTF16(b[:end])
+	b = b[end+2:]
+	if pathLen > len(b) {
+		return ErrInvalidLoadOption
+	}
+	filePath, err := devicePathFile(b[:pathLen])
+	if err != nil {
+		return err
+	}
+	l.filePath = filePath
+	return nil
+}
+
+// devicePathFile returns the file path in a device path. The nodes are walked
+// by their length so unknown nodes are skipped.
+func devicePathFile(b []byte) (string, error) {
+	var filePath string
+	for len(b) >= 4 {
+		nodeType, subType := b[0], b[1]
+		nodeLen := int(binary.LittleEndian.Uint16(b[2:]))
+		if nodeLen < 4 || nodeLen > len(b) {
+			return "", ErrInvalidLoadOption
+		}
+		if nodeType == devicePathEnd {
+			break
+		}
+		if nodeType == devicePathMedia && subType == devicePathFilePath {
+			// Paths can be split over several nodes
+			filePath += decodeUTF16(b[4:nodeLen])
+		}
+		b = b[nodeLen:]
+	}
+	return filePath, nil
+}
+
+type bootOrder []string
+
+func (o *bootOrder) Unmarshal(buf *bytes.Buffer) error {
+	b := buf.Bytes()
+	for i := 0; i+1 < len(b); i += 2 {
+		*o = append(*o, fmt.Sprintf("Boot%04X", binary.LittleEndian.Uint16(b[i:])))
+	}
+	return nil
+}
+
+// GetBootEntries returns the boot entries in BootOrder, with their files
+// resolved on the ESP. Entries whose variable doesn't exist are returned as
+// missing.
+func GetBootEntries(ev *efivarfs.Efivarfs, esp string) ([]BootEntry, error) {
+	var order bootOrder
+	if err := ev.GetVar(efivar.BootOrder, &order); err != nil {
+		return nil, fmt.Errorf("can't read BootOrder: %w", err)
+	}
+	entries := []BootEntry{}
+	for _, name := range order {
+		v := efivar.BootEntry
+		v.Name = name
+		var opt loadOption
+		if err := ev.GetVar(v, &opt); errors.Is(err, os.ErrNotExist) {
+			entries = append(entries, BootEntry{Name: name, Missing: true})
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("can't read %s: %w", name, err)
+		}
+		entry := BootEntry{
+			Name:        name,
+			Description: opt.description,
+			Active:      opt.attributes&loadOptionActive != 0,
+		}
+		if opt.filePath != "" {
+			entry.File = filepath.Join(esp, strings.ReplaceAll(opt.filePath, `\`, "/"))
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -1,10 +1,13 @@
 package sbctl
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"debug/pe"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"runtime"
@@ -56,12 +59,17 @@ func WriteBundleDatabase(vfs afero.Fs, dbpath string, bundles Bundles) error {
 	return nil
 }
 
+// BundleIter calls fn with the bundles in the bundle database. Bundles saved
+// without a kernel command line use the cmdline_file of the configuration.
 func BundleIter(state *config.State, fn func(s *Bundle) error) error {
 	files, err := ReadBundleDatabase(state.Fs, state.Config.BundlesDb)
 	if err != nil {
 		return err
 	}
 	for _, s := range files {
+		if s.Cmdline == "" {
+			s.Cmdline = state.Config.CmdlineFile
+		}
 		if err := fn(s); err != nil {
 			return err
 		}
@@ -131,18 +139,109 @@ func NewBundle(vfs afero.Fs) (bundle *Bundle, err error) {
 // Reference ukify from systemd:
 // https://github.com/systemd/systemd/blob/d09df6b94e0c4924ea7064c79ab0441f5aff469b/src/ukify/ukify.py
 
-func GenerateBundle(vfs afero.Fs, bundle *Bundle) (bool, error) {
-	type section struct {
-		section string
-		file    string
-	}
-	sections := []section{
+type bundleSection struct {
+	section string
+	file    string
+}
+
+func bundleSections(bundle *Bundle) []bundleSection {
+	return []bundleSection{
 		{".osrel", bundle.OSRelease},
 		{".cmdline", bundle.Cmdline},
 		{".splash", bundle.Splash},
 		{".initrd", bundle.Initramfs},
 		{".linux", bundle.KernelImage},
 	}
+}
+
+// sectionStale reports if the section of the bundle differs from the input
+// files it is generated from
+func sectionStale(vfs afero.Fs, uki *UKI, bundle *Bundle, s bundleSection) (bool, error) {
+	files := []string{s.file}
+	// The microcode is prepended to the initramfs
+	if s.section == ".initrd" {
+		if bundle.IntelMicrocode != "" {
+			files = []string{bundle.IntelMicrocode, s.file}
+		} else if bundle.AMDMicrocode != "" {
+			files = []string{bundle.AMDMicrocode, s.file}
+		}
+	}
+	h := sha256.New()
+	for _, file := range files {
+		f, err := vfs.Open(file)
+		if err != nil {
+			return false, err
+		}
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return false, err
+		}
+	}
+	section := uki.Section(s.section)
+	if section == nil {
+		return true, nil
+	}
+	sum := sha256.Sum256(section.data)
+	return !bytes.Equal(sum[:], h.Sum(nil)), nil
+}
+
+// BundleStale reports if the bundle needs to be regenerated. This is the case
+// if the output is missing or can't be read, or if any of its sections differ
+// from the input files the bundle is generated from.
+func BundleStale(vfs afero.Fs, bundle *Bundle) (bool, error) {
+	uki, err := ReadUKI(vfs, bundle.Output)
+	if err != nil {
+		return true, nil
+	}
+	for _, s := range bundleSections(bundle) {
+		if s.file == "" {
+			continue
+		}
+		if stale, err := sectionStale(vfs, uki, bundle, s); err != nil || stale {
+			return stale, err
+		}
+	}
+	return false, nil
+}
+
+// BundleCmdlineChanged reports if the kernel command line of the generated
+// bundle differs from its cmdline file. It is false if the bundle hasn't been
+// generated.
+func BundleCmdlineChanged(vfs afero.Fs, bundle *Bundle) (bool, error) {
+	uki, err := ReadUKI(vfs, bundle.Output)
+	if err != nil || uki.Section(".cmdline") == nil {
+		return false, nil
+	}
+	return sectionStale(vfs, uki, bundle, bundleSection{".cmdline", bundle.Cmdline})
+}
+
+// BundleStatus is the state of a bundle relative to its input files
+type BundleStatus string
+
+const (
+	BundleFresh        BundleStatus = "fresh"
+	BundleOutdated     BundleStatus = "stale"
+	BundleMissingInput BundleStatus = "missing-input"
+)
+
+// VerifyBundle checks if the bundle is up to date with the input files it is
+// generated from, see BundleStale
+func VerifyBundle(vfs afero.Fs, bundle *Bundle) (BundleStatus, error) {
+	stale, err := BundleStale(vfs, bundle)
+	if errors.Is(err, os.ErrNotExist) {
+		return BundleMissingInput, nil
+	} else if err != nil {
+		return "", err
+	}
+	if stale {
+		return BundleOutdated, nil
+	}
+	return BundleFresh, nil
+}
+
+func GenerateBundle(vfs afero.Fs, bundle *Bundle) (bool, error) {
+	sections := bundleSections(bundle)
 
 	if bundle.EFIStub == "" {
 		return false, fmt.Errorf("could not find EFI stub binary, please install systemd-boot or provide --efi-stub on the command line")
@@ -0,0 +1,123 @@
+package sbctl
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/foxboron/sbctl/config"
+	"github.com/spf13/afero"
+)
+
+func TestBundleStale(t *testing.T) {
+	vfs := afero.NewOsFs()
+	output := mkUKI(t, ".linux", ".osrel", ".initrd")
+	dir := filepath.Dir(output)
+	bundle := &Bundle{
+		Output:      output,
+		KernelImage: filepath.Join(dir, "linux"),
+		Initramfs:   filepath.Join(dir, "initrd"),
+		OSRelease:   filepath.Join(dir, "osrel"),
+	}
+
+	stale, err := BundleStale(vfs, bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stale {
+		t.Fatalf("bundle should be up to date with its inputs")
+	}
+
+	if err := os.WriteFile(bundle.Initramfs, []byte("updated initramfs"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if stale, err = BundleStale(vfs, bundle); err != nil || !stale {
+		t.Fatalf("bundle should be stale after the initramfs changed: %v", err)
+	}
+
+	bundle.Output = filepath.Join(dir, "missing.efi")
+	if stale, err = BundleStale(vfs, bundle); err != nil || !stale {
+		t.Fatalf("bundle should be stale without an output: %v", err)
+	}
+}
+
+func TestVerifyBundle(t *testing.T) {
+	vfs := afero.NewOsFs()
+	output := mkUKI(t, ".linux", ".osrel", ".initrd")
+	dir := filepath.Dir(output)
+	bundle := &Bundle{
+		Output:      output,
+		KernelImage: filepath.Join(dir, "linux"),
+		Initramfs:   filepath.Join(dir, "initrd"),
+		OSRelease:   filepath.Join(dir, "osrel"),
+	}
+
+	for _, test := range []struct {
+		update func()
+		status BundleStatus
+	}{
+		{func() {}, BundleFresh},
+		{func() { os.WriteFile(bundle.KernelImage, []byte("updated kernel"), 0o644) }, BundleOutdated},
+		{func() { os.Remove(bundle.Initramfs) }, BundleMissingInput},
+	} {
+		test.update()
+		status, err := VerifyBundle(vfs, bundle)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != test.status {
+			t.Fatalf("expected %s, got %s", test.status, status)
+		}
+	}
+}
+
+func TestBundleCmdlineChanged(t *testing.T) {
+	vfs := afero.NewOsFs()
+	output := mkUKI(t, ".linux", ".cmdline")
+	dir := filepath.Dir(output)
+	bundle := &Bundle{
+		Output:      output,
+		KernelImage: filepath.Join(dir, "linux"),
+		Cmdline:     filepath.Join(dir, "cmdline"),
+	}
+
+	if changed, err := BundleCmdlineChanged(vfs, bundle); err != nil || changed {
+		t.Fatalf("the cmdline shouldn't have changed: %v", err)
+	}
+	if err := os.WriteFile(bundle.Cmdline, []byte("quiet rw"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := BundleCmdlineChanged(vfs, bundle); err != nil || !changed {
+		t.Fatalf("the cmdline should have changed: %v", err)
+	}
+
+	bundle.Output = filepath.Join(dir, "missing.efi")
+	if changed, err := BundleCmdlineChanged(vfs, bundle); err != nil || changed {
+		t.Fatalf("a bundle which isn't generated has no changed cmdline: %v", err)
+	}
+}
+
+func TestBundleIterCmdline(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.CmdlineFile = "/etc/kernel/generated-cmdline"
+	state := &config.State{Fs: afero.NewMemMapFs(), Config: conf}
+	bundles := Bundles{
+		"/efi/default.efi": {Output: "/efi/default.efi"},
+		"/efi/own.efi":     {Output: "/efi/own.efi", Cmdline: "/etc/kernel/own-cmdline"},
+	}
+	if err := WriteBundleDatabase(state.Fs, conf.BundlesDb, bundles); err != nil {
+		t.Fatal(err)
+	}
+
+	cmdlines := map[string]string{}
+	err := BundleIter(state, func(b *Bundle) error {
+		cmdlines[b.Output] = b.Cmdline
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmdlines["/efi/default.efi"] != conf.CmdlineFile || cmdlines["/efi/own.efi"] != "/etc/kernel/own-cmdline" {
+		t.Fatalf("unexpected cmdlines %v", cmdlines)
+	}
+}
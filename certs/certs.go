@@ -1,10 +1,15 @@
 package certs
 
 import (
+	"bytes"
+	"crypto/x509"
 	"embed"
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
+	"time"
 
 	"github.com/foxboron/go-uefi/efi/signature"
 	"github.com/foxboron/go-uefi/efi/util"
@@ -32,6 +37,13 @@ func GetVendors() []string {
 }
 
 func GetOEMCerts(oem string, variable string) (*signature.SignatureDatabase, error) {
+	return GetOEMCertsGeneration(oem, variable, "")
+}
+
+// GetOEMCertsGeneration returns the OEM certificates of the given CA
+// generation, see CertGeneration. An empty generation returns all
+// certificates.
+func GetOEMCertsGeneration(oem string, variable string, generation string) (*signature.SignatureDatabase, error) {
 	GUID, ok := oemGUID[oem]
 	if !ok {
 		return nil, fmt.Errorf("invalid OEM")
@@ -44,6 +56,19 @@ func GetOEMCerts(oem string, variable string) (*signature.SignatureDatabase, err
 			continue
 		}
 		buf, _ := content.ReadFile(path)
+		if generation != "" {
+			cert, err := x509.ParseCertificate(buf)
+			if err != nil {
+				return nil, fmt.Errorf("can't parse %s: %w", path, err)
+			}
+			g, err := CertGeneration(oem, cert)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			if g != generation {
+				continue
+			}
+		}
 		if err := sigdb.Append(signature.CERT_X509_GUID, GUID, buf); err != nil {
 			return nil, err
 		}
@@ -51,6 +76,34 @@ func GetOEMCerts(oem string, variable string) (*signature.SignatureDatabase, err
 	return sigdb, nil
 }
 
+// microsoftGenerations are the Microsoft CAs by their common name, with the
+// generation they belong to. The 2011 CAs expire from 2026 on, and are
+// replaced by the 2023 CAs.
+var microsoftGenerations = map[string]string{
+	"Microsoft Corporation KEK CA 2011":     "2011",
+	"Microsoft Corporation UEFI CA 2011":    "2011",
+	"Microsoft Windows Production PCA 2011": "2011",
+	"Microsoft Corporation KEK 2K CA 2023":  "2023",
+	"Windows UEFI CA 2023":                  "2023",
+	"Microsoft UEFI CA 2023":                "2023",
+	"Microsoft Option ROM UEFI CA 2023":     "2023",
+}
+
+// CertGeneration returns the CA generation of a certificate bundled for the
+// OEM. Only the Microsoft certificates have generations, and bundled
+// certificates missing from the table are an error rather than being left
+// out of every generation.
+func CertGeneration(oem string, cert *x509.Certificate) (string, error) {
+	if oem != "microsoft" {
+		return "", nil
+	}
+	generation, ok := microsoftGenerations[cert.Subject.CommonName]
+	if !ok {
+		return "", fmt.Errorf("unknown generation of %s", cert.Subject.CommonName)
+	}
+	return generation, nil
+}
+
 func GetCustomCerts(keydir string, variable string) (*signature.SignatureDatabase, error) {
 	GUID, ok := oemGUID["custom"]
 	if !ok {
@@ -71,6 +124,22 @@ func GetCustomCerts(keydir string, variable string) (*signature.SignatureDatabas
 	return sigdb, nil
 }
 
+// GetCertsDatabase returns a signature database of the certificates, owned by
+// the GUID of the custom certificates
+func GetCertsDatabase(certs []*x509.Certificate) (*signature.SignatureDatabase, error) {
+	GUID, ok := oemGUID["custom"]
+	if !ok {
+		return nil, fmt.Errorf("GUID for custom certs not found")
+	}
+	sigdb := signature.NewSignatureDatabase()
+	for _, cert := range certs {
+		if err := sigdb.Append(signature.CERT_X509_GUID, GUID, cert.Raw); err != nil {
+			return nil, err
+		}
+	}
+	return sigdb, nil
+}
+
 func GetDefaultCerts(variable string) (*signature.SignatureDatabase, error) {
 	sigdb := signature.NewSignatureDatabase()
 	for _, oem := range defaultCerts {
@@ -99,3 +168,127 @@ func DetectVendorCerts(sb *signature.SignatureDatabase) []string {
 	}
 	return oems
 }
+
+// BundledCertVendor returns the vendor of the DER encoded certificate if it
+// is one of the vendor certificates bundled with sbctl, or an empty string.
+// Unlike DetectMicrosoftCAs the certificate itself is compared, so a
+// certificate with a Microsoft name isn't mistaken for one.
+func BundledCertVendor(der []byte) string {
+	for _, vendor := range GetVendors() {
+		for _, variable := range []string{"db", "KEK", "PK"} {
+			files, _ := content.ReadDir(filepath.Join(vendor, variable))
+			for _, file := range files {
+				if !file.Type().IsRegular() {
+					continue
+				}
+				buf, _ := content.ReadFile(filepath.Join(vendor, variable, file.Name()))
+				if bytes.Equal(buf, der) {
+					return vendor
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// IsMicrosoftCert reports if the DER encoded certificate is one of the
+// Microsoft certificates bundled with sbctl
+func IsMicrosoftCert(der []byte) bool {
+	return BundledCertVendor(der) == "microsoft"
+}
+
+// BundledCert is a certificate embedded into sbctl
+type BundledCert struct {
+	Vendor     string `json:"vendor"`
+	Variable   string `json:"variable"`
+	Name       string `json:"name"`
+	Generation string `json:"generation"`
+	// Date the certificate was issued
+	Date string `json:"date"`
+}
+
+// Bundle describes the vendor certificates embedded into sbctl
+type Bundle struct {
+	// Issue date of the newest certificate
+	Date string `json:"date"`
+	// Generations of the CAs, see CertGeneration
+	Generations  []string      `json:"generations"`
+	Certificates []BundledCert `json:"certificates"`
+}
+
+// EmbeddedBundle returns the vendor certificates embedded into sbctl
+func EmbeddedBundle() (*Bundle, error) {
+	bundle := &Bundle{Generations: []string{}, Certificates: []BundledCert{}}
+	for _, vendor := range GetVendors() {
+		for _, variable := range []string{"db", "KEK", "PK"} {
+			files, _ := content.ReadDir(filepath.Join(vendor, variable))
+			for _, file := range files {
+				if !file.Type().IsRegular() {
+					continue
+				}
+				buf, _ := content.ReadFile(filepath.Join(vendor, variable, file.Name()))
+				cert, err := x509.ParseCertificate(buf)
+				if err != nil {
+					return nil, fmt.Errorf("can't parse %s: %w", file.Name(), err)
+				}
+				generation, err := CertGeneration(vendor, cert)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", file.Name(), err)
+				}
+				bc := BundledCert{
+					Vendor:     vendor,
+					Variable:   variable,
+					Name:       cert.Subject.CommonName,
+					Generation: generation,
+					Date:       cert.NotBefore.UTC().Format(time.DateOnly),
+				}
+				bundle.Certificates = append(bundle.Certificates, bc)
+				if generation != "" && !slices.Contains(bundle.Generations, generation) {
+					bundle.Generations = append(bundle.Generations, generation)
+				}
+				// The dates sort as strings
+				if bc.Date > bundle.Date {
+					bundle.Date = bc.Date
+				}
+			}
+		}
+	}
+	slices.Sort(bundle.Generations)
+	return bundle, nil
+}
+
+// MicrosoftCA is an enrolled Microsoft certificate authority
+type MicrosoftCA struct {
+	Name       string `json:"name"`
+	Variable   string `json:"variable"`
+	Generation string `json:"generation"`
+}
+
+// The Microsoft CAs carry the year they were issued at the end of their name,
+// e.g. "Microsoft Corporation KEK CA 2011" or "Windows UEFI CA 2023"
+var microsoftCAGeneration = regexp.MustCompile(`\b(20\d\d)$`)
+
+// DetectMicrosoftCAs returns the Microsoft CAs in the signature database.
+// They are matched by name so CAs which are not bundled with sbctl are also
+// detected.
+func DetectMicrosoftCAs(variable string, sb *signature.SignatureDatabase) []MicrosoftCA {
+	cas := []MicrosoftCA{}
+	for _, l := range *sb {
+		if !util.CmpEFIGUID(l.SignatureType, signature.CERT_X509_GUID) {
+			continue
+		}
+		for _, sig := range l.Signatures {
+			cert, err := x509.ParseCertificate(sig.Data)
+			if err != nil {
+				continue
+			}
+			name := cert.Subject.CommonName
+			m := microsoftCAGeneration.FindStringSubmatch(name)
+			if m == nil || !slices.Contains(cert.Subject.Organization, "Microsoft Corporation") {
+				continue
+			}
+			cas = append(cas, MicrosoftCA{Name: name, Variable: variable, Generation: m[1]})
+		}
+	}
+	return cas
+}
@@ -1,6 +1,9 @@
 package certs
 
 import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"path/filepath"
 	"reflect"
 	"testing"
 )
@@ -26,6 +29,57 @@ func TestGetOEMCertsKek(t *testing.T) {
 	}
 }
 
+func TestGetOEMCertsGeneration(t *testing.T) {
+	kek, _ := GetOEMCertsGeneration("microsoft", "KEK", "2011")
+	if len(*kek) != 1 {
+		t.Fatalf("GetOEMCertsGeneration: not correct size, got %d, expected %d", len(*kek), 1)
+	}
+	db, _ := GetOEMCertsGeneration("microsoft", "db", "2011")
+	if len(*db) != 2 {
+		t.Fatalf("GetOEMCertsGeneration: not correct size, got %d, expected %d", len(*db), 2)
+	}
+	db, _ = GetOEMCertsGeneration("microsoft", "db", "1999")
+	if len(*db) != 0 {
+		t.Fatalf("GetOEMCertsGeneration: not correct size, got %d, expected %d", len(*db), 0)
+	}
+}
+
+func TestCertGeneration(t *testing.T) {
+	// Every bundled certificate needs to be in the generation table, or it
+	// would be left out of the granular enrollment flags
+	for _, vendor := range GetVendors() {
+		for _, variable := range []string{"db", "KEK", "PK"} {
+			files, _ := content.ReadDir(filepath.Join(vendor, variable))
+			for _, file := range files {
+				buf, _ := content.ReadFile(filepath.Join(vendor, variable, file.Name()))
+				cert, err := x509.ParseCertificate(buf)
+				if err != nil {
+					t.Fatalf("%s: %v", file.Name(), err)
+				}
+				if _, err := CertGeneration(vendor, cert); err != nil {
+					t.Fatalf("%s: %v", file.Name(), err)
+				}
+			}
+		}
+	}
+
+	// The generation is taken from the table, not from the year in the name
+	for name, expected := range map[string]string{
+		"Windows UEFI CA 2023":                  "2023",
+		"Microsoft Option ROM UEFI CA 2023":     "2023",
+		"Microsoft Windows Production PCA 2011": "2011",
+	} {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: name}}
+		if generation, err := CertGeneration("microsoft", cert); err != nil || generation != expected {
+			t.Fatalf("CertGeneration(%q): got %q, %v, expected %q", name, generation, err, expected)
+		}
+	}
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "Contoso UEFI CA 2023"}}
+	if _, err := CertGeneration("microsoft", cert); err == nil {
+		t.Fatal("CertGeneration: expected an error for an unknown CA")
+	}
+}
+
 func TestDefaultCertsDb(t *testing.T) {
 	db, _ := GetDefaultCerts("db")
 	if len(*db) != 2 {
@@ -39,3 +93,49 @@ func TestDefaultCertsKek(t *testing.T) {
 		t.Fatalf("GetDefaultCerts: not correct size, got %d, expected %d", len(*kek), 1)
 	}
 }
+
+func TestDetectMicrosoftCAs(t *testing.T) {
+	db, _ := GetOEMCerts("microsoft", "db")
+	cas := DetectMicrosoftCAs("db", db)
+	if len(cas) != 2 {
+		t.Fatalf("DetectMicrosoftCAs: not correct size, got %d, expected %d", len(cas), 2)
+	}
+	for _, ca := range cas {
+		if ca.Generation != "2011" || ca.Variable != "db" {
+			t.Fatalf("DetectMicrosoftCAs: unexpected CA %+v", ca)
+		}
+	}
+}
+
+func TestEmbeddedBundle(t *testing.T) {
+	bundle, err := EmbeddedBundle()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bundle.Certificates) != 3 {
+		t.Fatalf("EmbeddedBundle: not correct size, got %d, expected %d", len(bundle.Certificates), 3)
+	}
+	if len(bundle.Generations) != 1 || bundle.Generations[0] != "2011" {
+		t.Fatalf("EmbeddedBundle: unexpected generations %v", bundle.Generations)
+	}
+	if bundle.Date != "2011-10-19" {
+		t.Fatalf("EmbeddedBundle: unexpected date %s", bundle.Date)
+	}
+}
+
+func TestBundledCertVendor(t *testing.T) {
+	// Every bundled certificate is known, whatever variable it is bundled for
+	for _, variable := range []string{"db", "KEK"} {
+		sigdb, _ := GetOEMCerts("microsoft", variable)
+		for _, list := range *sigdb {
+			for _, sig := range list.Signatures {
+				if vendor := BundledCertVendor(sig.Data); vendor != "microsoft" {
+					t.Fatalf("BundledCertVendor: got %q for a %s certificate", vendor, variable)
+				}
+			}
+		}
+	}
+	if vendor := BundledCertVendor([]byte("not a certificate")); vendor != "" {
+		t.Fatalf("BundledCertVendor: got %q, expected no vendor", vendor)
+	}
+}
@@ -0,0 +1,281 @@
+package sbctl
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/cryptobyte"
+	cbasn1 "golang.org/x/crypto/cryptobyte/asn1"
+)
+
+// The db key can be certified by a CA instead of being self-signed. The
+// certificate issued by the CA replaces db.pem and its chain is kept in
+// db.chain.pem, ordered from the issuer of the db certificate up to the
+// self-signed root CA. Signatures made with the db key embed the intermediate
+// certificates, and the root CA is enrolled into db instead of the db
+// certificate.
+
+var (
+	ErrCertificateMismatch = errors.New("the certificate is not for the db key")
+	ErrInvalidChain        = errors.New("invalid certificate chain")
+)
+
+// DbCSRPath returns the path of the certificate signing request for the db key
+func DbCSRPath(conf *config.Config) string {
+	return filepath.Join(conf.Keydir, "db", "db.csr")
+}
+
+// DbChainPath returns the path of the certificate chain of the db certificate
+func DbChainPath(conf *config.Config) string {
+	return filepath.Join(conf.Keydir, "db", "db.chain.pem")
+}
+
+// CreateDbCSR writes a certificate signing request for the db key, with the
+// subject of the db certificate, and returns its path
+func CreateDbCSR(state *config.State, kh *backend.KeyHierarchy) (string, error) {
+	tmpl := &x509.CertificateRequest{Subject: kh.Db.Certificate().Subject}
+	der, err := x509.CreateCertificateRequest(rand.Reader, tmpl, kh.Db.Signer())
+	if err != nil {
+		return "", fmt.Errorf("can't create the certificate signing request: %w", err)
+	}
+	path := DbCSRPath(state.Config)
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+	if err := fs.WriteFile(state.Fs, path, b, 0o644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// parseCertificates reads the PEM encoded certificates in b, or a single DER
+// encoded certificate
+func parseCertificates(b []byte) ([]*x509.Certificate, error) {
+	if block, _ := pem.Decode(b); block == nil {
+		cert, err := ParseCertificate(b)
+		if err != nil {
+			return nil, err
+		}
+		return []*x509.Certificate{cert}, nil
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidCertificate, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, ErrInvalidCertificate
+	}
+	return certs, nil
+}
+
+// checkChain checks that every certificate is issued by the next one in the
+// chain
+func checkChain(leaf *x509.Certificate, chain []*x509.Certificate) error {
+	cert := leaf
+	for _, issuer := range chain {
+		if !issuer.IsCA {
+			return fmt.Errorf("%w: %s is not a CA", ErrInvalidChain, issuer.Subject)
+		}
+		if err := cert.CheckSignatureFrom(issuer); err != nil {
+			return fmt.Errorf("%w: %s is not issued by %s: %v", ErrInvalidChain, cert.Subject, issuer.Subject, err)
+		}
+		cert = issuer
+	}
+	return nil
+}
+
+// isSelfSigned reports whether cert is a root certificate
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
+}
+
+// ImportSignedCert replaces the db certificate with the certificate in
+// certFile, which a CA issued for the db key. The chain in chainFile is
+// installed along with it and has to end with the self-signed root CA.
+// chainFile may only be empty for a self-signed certificate.
+func ImportSignedCert(state *config.State, kh *backend.KeyHierarchy, certFile, chainFile string) (*x509.Certificate, error) {
+	b, err := fs.ReadFile(state.Fs, certFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := ParseCertificate(b)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := kh.Db.Signer().Public().(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(cert.PublicKey) {
+		return nil, ErrCertificateMismatch
+	}
+
+	var chain []*x509.Certificate
+	if chainFile != "" {
+		b, err := fs.ReadFile(state.Fs, chainFile)
+		if err != nil {
+			return nil, err
+		}
+		if chain, err = parseCertificates(b); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkChain(cert, chain); err != nil {
+		return nil, err
+	}
+	root := cert
+	if len(chain) != 0 {
+		root = chain[len(chain)-1]
+	}
+	if !isSelfSigned(root) {
+		return nil, fmt.Errorf("%w: the chain doesn't end with a self-signed root CA", ErrInvalidChain)
+	}
+
+	// The key files are read-only, so they are replaced instead of written to.
+	// Both files are written before either is replaced, and the chain goes
+	// first since DbCertChain ignores a chain which didn't issue db.pem.
+	certPath := filepath.Join(state.Config.Keydir, "db", "db.pem")
+	certTmp, err := writeTempFile(state.Fs, certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o400)
+	if err != nil {
+		return nil, err
+	}
+	defer state.Fs.Remove(certTmp)
+	chainPath := DbChainPath(state.Config)
+	if len(chain) == 0 {
+		if err := state.Fs.Remove(chainPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	} else {
+		var chainPem []byte
+		for _, c := range chain {
+			chainPem = append(chainPem, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+		}
+		chainTmp, err := writeTempFile(state.Fs, chainPath, chainPem, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		defer state.Fs.Remove(chainTmp)
+		if err := state.Fs.Rename(chainTmp, chainPath); err != nil {
+			return nil, err
+		}
+	}
+	if err := state.Fs.Rename(certTmp, certPath); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// writeTempFile writes b to a temporary file next to name, which replaces name
+// when it's renamed to it. A crash never leaves a truncated file behind.
+func writeTempFile(vfs afero.Fs, name string, b []byte, perm os.FileMode) (string, error) {
+	f, err := afero.TempFile(vfs, filepath.Dir(name), "."+filepath.Base(name)+"-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(b)
+	if err1 := f.Close(); err1 != nil && err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = vfs.Chmod(f.Name(), perm)
+	}
+	if err != nil {
+		vfs.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// DbCertChain returns the certificate chain of the db certificate, ending with
+// the root CA. It is empty for a self-signed db certificate, or if the chain doesn't issue the
+// current db certificate, as after rotating the db key.
+func DbCertChain(state *config.State, kh *backend.KeyHierarchy) ([]*x509.Certificate, error) {
+	// Keys given on the command line don't have a key directory
+	if state.Config.Keydir == "" {
+		return nil, nil
+	}
+	b, err := fs.ReadFile(state.Fs, DbChainPath(state.Config))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	chain, err := parseCertificates(b)
+	if err != nil {
+		return nil, fmt.Errorf("can't read %s: %w", DbChainPath(state.Config), err)
+	}
+	if checkChain(kh.Db.Certificate(), chain) != nil {
+		return nil, nil
+	}
+	return chain, nil
+}
+
+// DbEnrollCertificate returns the certificate enrolled into db for the db key,
+// the root CA of its chain or the db certificate itself
+func DbEnrollCertificate(state *config.State, kh *backend.KeyHierarchy) ([]byte, error) {
+	chain, err := DbCertChain(state, kh)
+	if err != nil {
+		return nil, err
+	}
+	if len(chain) == 0 {
+		return kh.Db.Certificate().Raw, nil
+	}
+	return chain[len(chain)-1].Raw, nil
+}
+
+var certificatesTag = cbasn1.Tag(0).ContextSpecific().Constructed()
+
+// embedCertificates adds the certificates to the certificates of an
+// authenticode signature
+func embedCertificates(sig []byte, certs []*x509.Certificate) ([]byte, error) {
+	s, err := parseSignerInfoElements(sig)
+	if err != nil {
+		return nil, err
+	}
+	// The certificates follow the version, digest algorithms and content
+	i := 3
+	if len(s.signedData) < i {
+		return nil, errors.New("malformed signed data")
+	}
+	var existing cryptobyte.String
+	if len(s.signedData) > i {
+		elem := s.signedData[i]
+		if elem.PeekASN1Tag(certificatesTag) {
+			if !elem.ReadASN1(&existing, certificatesTag) {
+				return nil, errors.New("malformed certificates")
+			}
+			s.signedData = append(s.signedData[:i], s.signedData[i+1:]...)
+		}
+	}
+	b := cryptobyte.NewBuilder(nil)
+	b.AddASN1(certificatesTag, func(b *cryptobyte.Builder) {
+		b.AddBytes(existing)
+		for _, c := range certs {
+			b.AddBytes(c.Raw)
+		}
+	})
+	elem, err := b.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	s.signedData = append(s.signedData[:i], append([]cryptobyte.String{elem}, s.signedData[i:]...)...)
+	return s.bytes()
+}
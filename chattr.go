@@ -48,3 +48,20 @@ func GetAttr(f *os.File) (int32, error) {
 func SetAttr(f *os.File, attr int32) error {
 	return unix.IoctlSetPointerInt(int(f.Fd()), unix.FS_IOC_SETFLAGS, int(attr))
 }
+
+// UnsetImmutableAttr clears the immutable attribute of a file
+func UnsetImmutableAttr(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	attr, err := GetAttr(f)
+	if err != nil {
+		return err
+	}
+	if attr&FS_IMMUTABLE_FL == 0 {
+		return nil
+	}
+	return SetAttr(f, attr&^FS_IMMUTABLE_FL)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/landlock-lsm/go-landlock/landlock"
+	"github.com/spf13/cobra"
+)
+
+type BackupCmdOptions struct {
+	Output string
+}
+
+var (
+	backupCmdOptions = BackupCmdOptions{}
+	backupCmd        = &cobra.Command{
+		Use:   "backup",
+		Short: "Back up the Secure Boot variables of the firmware",
+		Long: `Back up PK, KEK, db and dbx exactly as the firmware has them, including
+the vendor certificates, into a tarball which can be written back with
+sbctl restore.`,
+		RunE: RunBackup,
+	}
+)
+
+func RunBackup(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+
+	if backupCmdOptions.Output == "" {
+		return fmt.Errorf("--output needs to be set")
+	}
+	output, err := filepath.Abs(backupCmdOptions.Output)
+	if err != nil {
+		return err
+	}
+
+	if state.Config.Landlock {
+		lsm.RestrictAdditionalPaths(
+			landlock.RWDirs(filepath.Dir(output)),
+		)
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+
+	vars, err := sbctl.BackupFirmwareVariables(state.Efivarfs)
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	if err := sbctl.WriteFirmwareBackup(&b, vars); err != nil {
+		return err
+	}
+	if err := fs.WriteFile(state.Fs, output, b.Bytes(), 0o644); err != nil {
+		return fmt.Errorf("couldn't write the backup: %w", err)
+	}
+	for _, v := range vars {
+		logging.Ok("Backed up %s (%d bytes, attributes %#x)", v.Var.Name, len(v.Data), uint32(v.Attributes))
+	}
+	logging.Print("Wrote %s\n", output)
+	return nil
+}
+
+func backupCmdFlags(cmd *cobra.Command) {
+	f := cmd.Flags()
+	f.StringVarP(&backupCmdOptions.Output, "output", "o", "", "path of the backup")
+}
+
+func init() {
+	backupCmdFlags(backupCmd)
+	CliCommands = append(CliCommands, cliCommand{
+		Cmd:      backupCmd,
+		Efivarfs: true,
+	})
+}
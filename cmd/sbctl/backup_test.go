@@ -0,0 +1,80 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/spf13/cobra"
+)
+
+func TestBackupRestore(t *testing.T) {
+	state := setupRotateState(t)
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.WithValue(context.Background(), stateDataKey{}, state))
+
+	backupCmdOptions.Output = "/backup/fwstate.tar"
+	defer func() { backupCmdOptions.Output = "" }()
+	if err := RunBackup(cmd, nil); err != nil {
+		t.Fatalf("failed backing up the variables: %v", err)
+	}
+
+	b, err := fs.ReadFile(state.Fs, "/backup/fwstate.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vars, err := sbctl.ReadFirmwareBackup(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("failed reading the backup: %v", err)
+	}
+	var names []string
+	for _, v := range vars {
+		names = append(names, v.Var.Name)
+	}
+	// dbx isn't set after setup, PK is restored last
+	if len(names) != 3 || names[0] != "db" || names[1] != "KEK" || names[2] != "PK" {
+		t.Fatalf("unexpected variables in the backup: %v", names)
+	}
+
+	// Restore into a system in Setup Mode
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := setupEnrollState(t)
+	if err := sbctl.RestoreFirmwareVariables(target.Efivarfs, kh, vars); err != nil {
+		t.Fatalf("failed restoring the variables: %v", err)
+	}
+	restored, err := sbctl.BackupFirmwareVariables(target.Efivarfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != len(vars) {
+		t.Fatalf("expected %d restored variables, got %d", len(vars), len(restored))
+	}
+	for i := range vars {
+		if !bytes.Equal(restored[i].Data, vars[i].Data) {
+			t.Fatalf("%s was not restored as backed up", vars[i].Var.Name)
+		}
+	}
+}
+
+func TestReadFirmwareBackupUnknownEntry(t *testing.T) {
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	if err := tw.WriteHeader(&tar.Header{Name: "BootOrder-8be4df61-93ca-11d2-aa0d-00e098032b8c", Mode: 0644, Size: 4}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write([]byte{0x07, 0x00, 0x00, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+	if _, err := sbctl.ReadFirmwareBackup(&b); !errors.Is(err, sbctl.ErrInvalidFirmwareBackup) {
+		t.Fatalf("expected ErrInvalidFirmwareBackup, got %v", err)
+	}
+}
@@ -1,13 +1,14 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 
 	"github.com/foxboron/sbctl"
 	"github.com/foxboron/sbctl/config"
 	"github.com/foxboron/sbctl/logging"
-	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
 )
 
@@ -21,9 +22,18 @@ var (
 	cmdline    string
 	initramfs  string
 	espPath    string
+	espDetect  bool
 	saveBundle bool
 )
 
+// bundleESP returns the ESP for --esp and --esp-detect
+func bundleESP(state *config.State) (string, error) {
+	if espDetect {
+		return sbctl.DetectESP()
+	}
+	return sbctl.ResolveESP(state, espPath)
+}
+
 var bundleCmd = &cobra.Command{
 	Use:   "bundle",
 	Short: "Bundle the needed files for an EFI stub image",
@@ -32,11 +42,21 @@ var bundleCmd = &cobra.Command{
 
 		logging.Errorf("The bundle/uki support in sbctl is deprecated. Please move to dracut/mkinitcpio/ukify.")
 
-		if len(args) < 1 {
-			logging.Print("Requires a file to sign...\n")
-			os.Exit(1)
+		if espDetect && espPath != "" {
+			return fmt.Errorf("--esp can't be combined with --esp-detect")
+		}
+		// The ESP is only required for the default output path, but we
+		// don't guess between several ESPs
+		esp, err := bundleESP(state)
+		if err != nil && (len(args) < 1 || errors.Is(err, sbctl.ErrMultipleESP)) {
+			return err
+		}
+		// Bundles saved without --cmdline follow cmdline_file
+		bundleCmdline := cmdline
+		if bundleCmdline == "" {
+			bundleCmdline = state.Config.CmdlineFile
 		}
-		checkFiles := []string{amducode, intelucode, splashImg, osRelease, efiStub, kernelImg, cmdline, initramfs}
+		checkFiles := []string{amducode, intelucode, splashImg, osRelease, efiStub, kernelImg, bundleCmdline, initramfs}
 		for _, path := range checkFiles {
 			if path == "" {
 				continue
@@ -50,9 +70,12 @@ var bundleCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
-		output, err := filepath.Abs(args[0])
-		if err != nil {
-			return err
+		// Default to the directory systemd-boot discovers EFI bundles in
+		output := filepath.Join(esp, "EFI", "Linux", filepath.Base(kernelImg)+".efi")
+		if len(args) > 0 {
+			if output, err = filepath.Abs(args[0]); err != nil {
+				return err
+			}
 		}
 		// Fail early if user wants to save bundle but doesn't have permissions
 		var bundles sbctl.Bundles
@@ -69,16 +92,17 @@ var bundleCmd = &cobra.Command{
 		bundle.AMDMicrocode = amducode
 		bundle.KernelImage = kernelImg
 		bundle.Initramfs = initramfs
-		bundle.Cmdline = cmdline
+		bundle.Cmdline = bundleCmdline
 		bundle.Splash = splashImg
 		bundle.OSRelease = osRelease
 		bundle.EFIStub = efiStub
-		bundle.ESP = espPath
+		bundle.ESP = esp
 		if err = sbctl.CreateBundle(state, *bundle); err != nil {
 			return err
 		}
 		logging.Print("Wrote EFI bundle %s\n", bundle.Output)
 		if saveBundle {
+			bundle.Cmdline = cmdline
 			bundles[bundle.Output] = bundle
 			err := sbctl.WriteBundleDatabase(state.Fs, state.Config.BundlesDb, bundles)
 			if err != nil {
@@ -90,7 +114,6 @@ var bundleCmd = &cobra.Command{
 }
 
 func bundleCmdFlags(cmd *cobra.Command) {
-	esp, _ := sbctl.GetESP(afero.NewOsFs())
 	f := cmd.Flags()
 	f.StringVarP(&amducode, "amducode", "a", "", "AMD microcode location")
 	f.StringVarP(&intelucode, "intelucode", "i", "", "Intel microcode location")
@@ -98,15 +121,17 @@ func bundleCmdFlags(cmd *cobra.Command) {
 	f.StringVarP(&osRelease, "os-release", "o", "/usr/lib/os-release", "OS Release file location")
 	f.StringVarP(&efiStub, "efi-stub", "e", "/usr/lib/systemd/boot/efi/linuxx64.efi.stub", "EFI Stub location")
 	f.StringVarP(&kernelImg, "kernel-img", "k", "/boot/vmlinuz-linux", "Kernel image location")
-	f.StringVarP(&cmdline, "cmdline", "c", "/etc/kernel/cmdline", "Cmdline location")
+	f.StringVarP(&cmdline, "cmdline", "c", "", "Cmdline location. Defaults to cmdline_file from the configuration")
 	f.StringVarP(&initramfs, "initramfs", "f", "/boot/initramfs-linux.img", "Initramfs location")
-	f.StringVarP(&espPath, "esp", "p", esp, "ESP location")
+	f.StringVarP(&espPath, "esp", "p", "", "ESP location. Defaults to esp_mountpoint from the configuration, or the detected ESP")
+	f.BoolVarP(&espDetect, "esp-detect", "", false, "detect the ESP from the mounted filesystems, ignoring the configuration")
 	f.BoolVarP(&saveBundle, "save", "s", false, "save bundle to the database")
 }
 
 func init() {
 	bundleCmdFlags(bundleCmd)
 	CliCommands = append(CliCommands, cliCommand{
-		Cmd: bundleCmd,
+		Cmd:  bundleCmd,
+		Lock: true,
 	})
 }
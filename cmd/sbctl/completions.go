@@ -2,7 +2,13 @@ package main
 
 import (
 	"os"
+	"slices"
+	"strings"
 
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/stringset"
+	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
 )
 
@@ -41,10 +47,130 @@ func completionFishCmd() *cobra.Command {
 	return completionCmd
 }
 
+func completionPowershellCmd() *cobra.Command {
+	var completionCmd = &cobra.Command{
+		Use:    "powershell",
+		Hidden: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return rootCmd.GenPowerShellCompletionWithDesc(os.Stdout)
+		},
+	}
+	return completionCmd
+}
+
+// completeFiles completes file paths for commands taking files as arguments
+func completeFiles(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return nil, cobra.ShellCompDirectiveDefault
+}
+
+// completionFs is the filesystem completions read the databases from.
+// Completions run without the state setup by the root command.
+var completionFs = afero.NewOsFs()
+
+// completionState returns the state with the configuration for completions
+func completionState() (*config.State, error) {
+	conf, err := readConfig(completionFs)
+	if err != nil {
+		return nil, err
+	}
+	return &config.State{Fs: completionFs, Config: conf}, nil
+}
+
+// completeNames returns the sorted names starting with toComplete
+func completeNames(names []string, toComplete string) []string {
+	var matches []string
+	for _, name := range names {
+		if strings.HasPrefix(name, toComplete) {
+			matches = append(matches, name)
+		}
+	}
+	slices.Sort(matches)
+	return matches
+}
+
+// completeTrackedFiles completes the files in the file database
+func completeTrackedFiles(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) != 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	state, err := completionState()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	// Don't create the database when reading it
+	if ok, _ := afero.Exists(state.Fs, state.Config.FilesDb); !ok {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	files, err := sbctl.ReadFileDatabase(state.Fs, state.Config.FilesDb)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	return completeNames(names, toComplete), cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeBundles completes the names of the bundles in the bundle database
+func completeBundles(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) != 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	state, err := completionState()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	if ok, _ := afero.Exists(state.Fs, state.Config.BundlesDb); !ok {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	bundles, err := sbctl.ReadBundleDatabase(state.Fs, state.Config.BundlesDb)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveError
+	}
+	var names []string
+	for name := range bundles {
+		names = append(names, name)
+	}
+	return completeNames(names, toComplete), cobra.ShellCompDirectiveNoFileComp
+}
+
+// configLocations are the places configuration files are usually kept
+var configLocations = []string{
+	"/etc/sbctl/*.conf",
+	"/etc/sbctl/*.yaml",
+}
+
+// completeConfigFiles completes --config with the configuration files in the
+// usual locations, and falls back to completing any file
+func completeConfigFiles(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	var names []string
+	for _, pattern := range configLocations {
+		matches, err := afero.Glob(completionFs, pattern)
+		if err != nil {
+			continue
+		}
+		names = append(names, matches...)
+	}
+	names = completeNames(names, toComplete)
+	if len(names) == 0 {
+		return nil, cobra.ShellCompDirectiveDefault
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeStringSet completes the allowed values of a flag
+func completeStringSet(set *stringset.StringSet) func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return completeNames(set.Allowed, toComplete), cobra.ShellCompDirectiveNoFileComp
+	}
+}
+
 func init() {
 	completionCmd.AddCommand(completionBashCmd())
 	completionCmd.AddCommand(completionZshCmd())
 	completionCmd.AddCommand(completionFishCmd())
+	completionCmd.AddCommand(completionPowershellCmd())
 	CliCommands = append(CliCommands, cliCommand{
 		Cmd: completionCmd,
 	})
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/config"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+func TestCompletions(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	old := completionFs
+	completionFs = fs
+	t.Cleanup(func() { completionFs = old })
+
+	if files, _ := completeTrackedFiles(removeFileCmd, nil, ""); len(files) != 0 {
+		t.Fatalf("expected no files without a database, got %v", files)
+	}
+	if ok, _ := afero.Exists(fs, config.DefaultConfig().FilesDb); ok {
+		t.Fatal("completion created the file database")
+	}
+
+	conf := config.DefaultConfig()
+	files := sbctl.SigningEntries{
+		"/boot/vmlinuz-linux":   {File: "/boot/vmlinuz-linux", OutputFile: "/boot/vmlinuz-linux"},
+		"/boot/EFI/BOOTX64.EFI": {File: "/boot/EFI/BOOTX64.EFI", OutputFile: "/boot/EFI/BOOTX64.EFI"},
+		"/efi/systemd.efi":      {File: "/efi/systemd.efi", OutputFile: "/efi/systemd.efi"},
+	}
+	if err := sbctl.WriteFileDatabase(fs, conf.FilesDb, files); err != nil {
+		t.Fatal(err)
+	}
+	got, directive := completeTrackedFiles(removeFileCmd, nil, "/boot/")
+	if want := []string{"/boot/EFI/BOOTX64.EFI", "/boot/vmlinuz-linux"}; !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if directive != cobra.ShellCompDirectiveNoFileComp {
+		t.Fatalf("unexpected directive %v", directive)
+	}
+	if got, _ := completeTrackedFiles(removeFileCmd, []string{"/efi/systemd.efi"}, ""); len(got) != 0 {
+		t.Fatalf("expected one argument to be completed, got %v", got)
+	}
+
+	for _, f := range []string{"/etc/sbctl/sbctl.conf", "/etc/sbctl/laptop.conf", "/etc/sbctl/notes.txt"} {
+		if err := afero.WriteFile(fs, f, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, _ = completeConfigFiles(rootCmd, nil, "/etc/sbctl/")
+	if want := []string{"/etc/sbctl/laptop.conf", "/etc/sbctl/sbctl.conf"}; !slices.Equal(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	if _, directive := completeConfigFiles(rootCmd, nil, "./"); directive != cobra.ShellCompDirectiveDefault {
+		t.Fatalf("expected file completion outside the config locations, got %v", directive)
+	}
+
+	got, _ = completeStringSet(&enrollKeysCmdOptions.Partial)(enrollKeysCmd, nil, "")
+	if len(got) == 0 || !slices.Contains(got, "PK") {
+		t.Fatalf("unexpected key names %v", got)
+	}
+}
@@ -0,0 +1,653 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/google/uuid"
+	"github.com/landlock-lsm/go-landlock/landlock"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+
+	yaml "github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/parser"
+)
+
+type FieldCheck struct {
+	Field string `json:"field"`
+	Error string `json:"error,omitempty"`
+}
+
+type ConfigValidation struct {
+	File   string       `json:"file"`
+	Valid  bool         `json:"valid"`
+	Fields []FieldCheck `json:"fields"`
+}
+
+// Values accepted in db_additions, see enroll-keys
+var dbAdditions = []string{
+	"microsoft",
+	"microsoft-kek",
+	"microsoft-db",
+	"microsoft-2023",
+	"tpm-eventlog",
+	"custom",
+	"firmware-builtin",
+}
+
+var (
+	configCmd = &cobra.Command{
+		Use:   "config",
+		Short: "Manage the sbctl configuration",
+	}
+	configValidateCmd = &cobra.Command{
+		Use:   "validate [path]",
+		Short: "Check the configuration file for errors",
+		Long: `Check the configuration file for errors.
+
+Defaults to the file given with --config, or /etc/sbctl/sbctl.conf. Exits
+with 1 if the configuration is invalid.`,
+		Args:              cobra.MaximumNArgs(1),
+		ValidArgsFunction: completeFiles,
+		RunE:              RunConfigValidate,
+	}
+	configGetCmd = &cobra.Command{
+		Use:   "get <key>",
+		Short: "Print a value from the configuration",
+		Args:  cobra.ExactArgs(1),
+		RunE:  RunConfigGet,
+	}
+	configSetCmd = &cobra.Command{
+		Use:   "set <key> <value>",
+		Short: "Change a value in the configuration file",
+		Long: `Change a value in the configuration file.
+
+Keys are the fields of the configuration file, like landlock, keydir or
+keys.db.type. key-type sets the type of all the keys. db_additions takes a
+comma separated list. Other fields and comments in the file are kept, except
+for TOML files which are written out again without their comments.`,
+		Args: cobra.ExactArgs(2),
+		RunE: RunConfigSet,
+	}
+
+	ErrUnknownConfigKey = errors.New("unknown configuration key")
+)
+
+// Alias for the type of all the keys
+const configKeyType = "key_type"
+
+// configPath returns the configuration file used by sbctl
+func configPath() string {
+	if p := explicitConfigPath(); p != "" {
+		return p
+	}
+	return "/etc/sbctl/sbctl.conf"
+}
+
+// configKeyPaths normalizes the key and expands the key-type alias
+func configKeyPaths(key string) []string {
+	key = strings.ReplaceAll(key, "-", "_")
+	if key == configKeyType {
+		return []string{"keys.pk.type", "keys.kek.type", "keys.db.type"}
+	}
+	return []string{key}
+}
+
+// parseConfigValue validates the value for a field of the configuration
+func parseConfigValue(key, value string) (any, error) {
+	absPath := func() (any, error) {
+		if !filepath.IsAbs(value) {
+			return nil, fmt.Errorf("%s needs to be an absolute path", key)
+		}
+		return value, nil
+	}
+	switch key {
+	case "landlock", "fix_pe_checksum":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s needs to be true or false", key)
+		}
+		return b, nil
+	case "keydir", "guid", "files_db", "bundles_db", "profiles_dir", "esp_mountpoint", "pkcs11_module":
+		return absPath()
+	case "efivar_retries":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%s needs to be 0 or a positive number", key)
+		}
+		return n, nil
+	case "efivar_backoff":
+		conf := config.Config{EfivarBackoff: value}
+		if _, err := conf.EfivarBackoffDuration(); err != nil {
+			return nil, err
+		}
+		return value, nil
+	case "landlock_extra_paths":
+		values := []any{}
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v == "" {
+				continue
+			}
+			if !filepath.IsAbs(v) {
+				return nil, fmt.Errorf("%s needs to be a list of absolute paths", key)
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	case "db_additions":
+		values := []any{}
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v == "" {
+				continue
+			}
+			if !slices.Contains(dbAdditions, v) {
+				return nil, fmt.Errorf("unknown value %q, valid values are: %s", v, strings.Join(dbAdditions, ", "))
+			}
+			values = append(values, v)
+		}
+		return values, nil
+	}
+
+	parts := strings.Split(key, ".")
+	if len(parts) != 3 || parts[0] != "keys" || !slices.Contains([]string{"pk", "kek", "db"}, parts[1]) {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownConfigKey, key)
+	}
+	switch parts[2] {
+	case "privkey", "pubkey":
+		return absPath()
+	case "type":
+		switch backend.BackendType(value) {
+		case backend.FileBackend, backend.TPMBackend, backend.SealedBackend, backend.EncryptedBackend:
+			return value, nil
+		}
+		return nil, fmt.Errorf("unknown key type %q, valid values are: %s, %s, %s, %s", value, backend.FileBackend, backend.TPMBackend, backend.SealedBackend, backend.EncryptedBackend)
+	case "algorithm":
+		if _, err := backend.ParseKeyAlgorithm(value); err != nil {
+			return nil, err
+		}
+		return value, nil
+	case "description":
+		return value, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownConfigKey, key)
+}
+
+// configValues returns the configuration file with the defaults filled in
+func configValues(vfs afero.Fs, file string) ([]byte, map[string]any, error) {
+	b, err := fs.ReadFile(vfs, file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, err
+	}
+	conf, err := config.NewConfigFormat(b, config.DetectFormat(file, b))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse %s: %w", file, err)
+	}
+	j, err := json.Marshal(conf)
+	if err != nil {
+		return nil, nil, err
+	}
+	values := map[string]any{}
+	if err := json.Unmarshal(j, &values); err != nil {
+		return nil, nil, err
+	}
+	return b, values, nil
+}
+
+func lookupConfigValue(values map[string]any, parts []string) (any, bool) {
+	var v any = values
+	for _, p := range parts {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[p]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func setConfigValue(values map[string]any, parts []string, value any) {
+	m := values
+	for _, p := range parts[:len(parts)-1] {
+		next, ok := m[p].(map[string]any)
+		if !ok {
+			next = map[string]any{}
+			m[p] = next
+		}
+		m = next
+	}
+	m[parts[len(parts)-1]] = value
+}
+
+// updateConfigFile writes the value into the configuration file. The closest
+// node in the file is replaced, so the comments elsewhere are kept. Fields
+// which are missing in the file are filled in from the defaults.
+func updateConfigFile(b []byte, values map[string]any, parts []string) ([]byte, error) {
+	f, err := parser.ParseBytes(b, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(parts); i > 0; i-- {
+		p, err := yaml.PathString("$." + strings.Join(parts[:i], "."))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.FilterFile(f); err != nil {
+			continue
+		}
+		v, _ := lookupConfigValue(values, parts[:i])
+		node, err := yaml.ValueToNode(v)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.ReplaceWithNode(f, node); err != nil {
+			return nil, err
+		}
+		return []byte(strings.TrimRight(f.String(), "\n") + "\n"), nil
+	}
+	// Add the field to the end of the file
+	v, _ := lookupConfigValue(values, parts[:1])
+	added, err := yaml.Marshal(map[string]any{parts[0]: v})
+	if err != nil {
+		return nil, err
+	}
+	out := strings.TrimRight(string(b), "\n")
+	if out != "" {
+		out += "\n"
+	}
+	return []byte(out + string(added)), nil
+}
+
+// updateTOMLConfigFile writes the value into a TOML configuration file. The
+// file is written out again, which loses the comments and the order of the
+// fields. Fields which are missing in the file are filled in from the
+// defaults.
+func updateTOMLConfigFile(b []byte, values map[string]any, parts []string) ([]byte, error) {
+	m, err := config.DecodeTOML(b)
+	if err != nil {
+		return nil, err
+	}
+	i := len(parts)
+	for ; i > 1; i-- {
+		if _, ok := lookupConfigValue(m, parts[:i]); ok {
+			break
+		}
+	}
+	v, _ := lookupConfigValue(values, parts[:i])
+	setConfigValue(m, parts[:i], v)
+	return config.EncodeTOML(m)
+}
+
+// GetConfigValue returns the value of a key in the configuration
+func GetConfigValue(vfs afero.Fs, file, key string) (any, error) {
+	_, values, err := configValues(vfs, file)
+	if err != nil {
+		return nil, err
+	}
+	var found []any
+	for _, path := range configKeyPaths(key) {
+		v, ok := lookupConfigValue(values, strings.Split(path, "."))
+		if !ok {
+			// Fields can be omitted when they are unset
+			if _, err := parseConfigValue(path, ""); errors.Is(err, ErrUnknownConfigKey) {
+				return nil, fmt.Errorf("%w: %s", ErrUnknownConfigKey, key)
+			}
+			v = ""
+		}
+		if len(found) > 0 && found[0] != v {
+			return nil, fmt.Errorf("the keys have different types, use keys.<pk|kek|db>.type")
+		}
+		found = append(found, v)
+	}
+	return found[0], nil
+}
+
+// SetConfigValue validates the value and changes the key in the configuration
+// file
+func SetConfigValue(vfs afero.Fs, file, key, value string) error {
+	b, values, err := configValues(vfs, file)
+	if err != nil {
+		return err
+	}
+	format := config.DetectFormat(file, b)
+	update := updateConfigFile
+	if format == config.FormatTOML {
+		update = updateTOMLConfigFile
+	}
+	for _, path := range configKeyPaths(key) {
+		v, err := parseConfigValue(path, value)
+		if err != nil {
+			return err
+		}
+		parts := strings.Split(path, ".")
+		setConfigValue(values, parts, v)
+		if b, err = update(b, values, parts); err != nil {
+			return fmt.Errorf("failed to update %s: %w", file, err)
+		}
+	}
+	if _, err := config.NewConfigFormat(b, format); err != nil {
+		return fmt.Errorf("invalid configuration after setting %s: %w", key, err)
+	}
+	return fs.WriteFile(vfs, file, b, 0o644)
+}
+
+func RunConfigGet(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+	file := configPath()
+	if state.Config.Landlock {
+		lsm.RestrictAdditionalPaths(landlock.ROFiles(file).IgnoreIfMissing())
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+	v, err := GetConfigValue(state.Fs, file, args[0])
+	if err != nil {
+		return err
+	}
+	if cmdOptions.StructuredOutput() {
+		return StructuredOut(v)
+	}
+	switch v.(type) {
+	case map[string]any, []any:
+		b, err := yaml.Marshal(v)
+		if err != nil {
+			return err
+		}
+		logging.Print("%s", b)
+	default:
+		logging.Print("%v\n", v)
+	}
+	return nil
+}
+
+func RunConfigSet(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+	file := configPath()
+	if state.Config.Landlock {
+		lsm.RestrictAdditionalPaths(landlock.RWDirs(filepath.Dir(file)))
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+	if err := SetConfigValue(state.Fs, file, args[0], args[1]); err != nil {
+		return err
+	}
+	logging.Ok("Set %s to %s in %s", args[0], args[1], file)
+	return nil
+}
+
+type configValidator struct {
+	vfs    afero.Fs
+	fields []FieldCheck
+}
+
+func (v *configValidator) check(field string, err error) {
+	c := FieldCheck{Field: field}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	v.fields = append(v.fields, c)
+}
+
+func (v *configValidator) checkPath(field, path string, dir bool) {
+	if path == "" {
+		v.check(field, fmt.Errorf("path is empty"))
+		return
+	}
+	fi, err := v.vfs.Stat(path)
+	switch {
+	case err != nil:
+		v.check(field, fmt.Errorf("%s: %w", path, err))
+	case dir && !fi.IsDir():
+		v.check(field, fmt.Errorf("%s is not a directory", path))
+	case !dir && !fi.Mode().IsRegular():
+		v.check(field, fmt.Errorf("%s is not a file", path))
+	default:
+		v.check(field, nil)
+	}
+}
+
+func (v *configValidator) checkWritable(field, dir string) {
+	fi, err := v.vfs.Stat(dir)
+	if err != nil {
+		v.check(field, fmt.Errorf("%s: %w", dir, err))
+		return
+	}
+	if !fi.IsDir() {
+		v.check(field, fmt.Errorf("%s is not a directory", dir))
+		return
+	}
+	f, err := afero.TempFile(v.vfs, dir, ".sbctl-validate-")
+	if err != nil {
+		v.check(field, fmt.Errorf("%s is not writable: %w", dir, err))
+		return
+	}
+	f.Close()
+	v.check(field, v.vfs.Remove(f.Name()))
+}
+
+func (v *configValidator) checkKey(field string, kc *config.KeyConfig) {
+	if kc == nil {
+		v.check(field, fmt.Errorf("key is not configured"))
+		return
+	}
+	v.checkPath(field+".privkey", kc.Privkey, false)
+	v.checkPath(field+".pubkey", kc.Pubkey, false)
+
+	var err error
+	backendType := backend.BackendType(kc.Type)
+	switch backendType {
+	case backend.FileBackend, backend.TPMBackend, backend.SealedBackend, backend.EncryptedBackend:
+	default:
+		err = fmt.Errorf("unknown key type %q, valid values are: %s, %s, %s, %s", kc.Type, backend.FileBackend, backend.TPMBackend, backend.SealedBackend, backend.EncryptedBackend)
+	}
+	v.check(field+".type", err)
+
+	_, err = backend.ParseKeyAlgorithm(kc.Algorithm)
+	if err == nil && backendType == backend.TPMBackend && kc.Algorithm != "" && backend.KeyAlgorithm(kc.Algorithm) != backend.RSA2048 {
+		err = fmt.Errorf("tpm keys only support %s", backend.RSA2048)
+	}
+	v.check(field+".algorithm", err)
+
+	if len(kc.PCRs) == 0 {
+		return
+	}
+	err = nil
+	if backendType != backend.SealedBackend {
+		err = fmt.Errorf("pcrs are only used by %s keys", backend.SealedBackend)
+	}
+	for _, pcr := range kc.PCRs {
+		if pcr > 23 {
+			err = fmt.Errorf("invalid PCR %d", pcr)
+		}
+	}
+	v.check(field+".pcrs", err)
+}
+
+// ValidateConfig parses the configuration file and checks the values
+func ValidateConfig(vfs afero.Fs, file string) (*ConfigValidation, error) {
+	b, err := fs.ReadFile(vfs, file)
+	if err != nil {
+		return nil, err
+	}
+	result := &ConfigValidation{File: file}
+	conf := config.DefaultConfig()
+	// Catch unknown fields, NewConfig ignores them
+	if config.DetectFormat(file, b) == config.FormatTOML {
+		err = config.UnmarshalTOML(b, conf, true)
+	} else {
+		err = yaml.UnmarshalWithOptions(b, conf, yaml.Strict())
+	}
+	if err != nil {
+		result.Fields = []FieldCheck{{Field: "file", Error: err.Error()}}
+		return result, nil
+	}
+
+	v := &configValidator{vfs: vfs}
+	v.checkWritable("keydir", conf.Keydir)
+	v.checkPath("guid", conf.GUID, false)
+	if conf.OwnerGUID != "" {
+		_, err := uuid.Parse(conf.OwnerGUID)
+		v.check("owner_guid", err)
+	}
+	v.checkPath("files_db", conf.FilesDb, false)
+	v.checkPath("bundles_db", conf.BundlesDb, false)
+	// Profiles are optional
+	if ok, _ := afero.Exists(vfs, conf.ProfilesDir); ok {
+		v.checkPath("profiles_dir", conf.ProfilesDir, true)
+	}
+	if conf.ESPMountpoint != "" {
+		v.checkPath("esp_mountpoint", conf.ESPMountpoint, true)
+	}
+	if conf.IPEPolicy != "" {
+		v.checkPath("ipe_policy", filepath.Dir(conf.IPEPolicy), true)
+	}
+	if conf.PKCS11Module != "" {
+		v.checkPath("pkcs11_module", conf.PKCS11Module, false)
+	}
+	var retriesErr error
+	if conf.EfivarRetries < 0 {
+		retriesErr = fmt.Errorf("efivar_retries can't be negative")
+	}
+	v.check("efivar_retries", retriesErr)
+	_, err = conf.EfivarBackoffDuration()
+	v.check("efivar_backoff", err)
+	if conf.HashAlgo != "" {
+		_, err := backend.ParseHashAlgorithm(conf.HashAlgo)
+		v.check("hash_algo", err)
+	}
+	for i, p := range conf.LandlockExtraPaths {
+		v.checkPath(fmt.Sprintf("landlock_extra_paths[%d]", i), p, true)
+	}
+	for i, add := range conf.DbAdditions {
+		var err error
+		if !slices.Contains(dbAdditions, add) {
+			err = fmt.Errorf("unknown value %q, valid values are: %s", add, strings.Join(dbAdditions, ", "))
+		}
+		v.check(fmt.Sprintf("db_additions[%d]", i), err)
+	}
+	for i, f := range conf.Files {
+		field := fmt.Sprintf("files[%d]", i)
+		v.checkPath(field+".path", f.Path, false)
+		if f.Output != "" {
+			v.checkPath(field+".output", filepath.Dir(f.Output), true)
+		}
+	}
+	if conf.Keys == nil {
+		v.check("keys", fmt.Errorf("keys are not configured"))
+	} else {
+		v.checkKey("keys.pk", conf.Keys.PK)
+		v.checkKey("keys.kek", conf.Keys.KEK)
+		v.checkKey("keys.db", conf.Keys.Db)
+	}
+	if p := conf.PCRPolicy; p != nil {
+		v.checkPath("pcr_policy.privkey", p.Privkey, false)
+		if p.Pubkey != "" {
+			v.checkPath("pcr_policy.pubkey", p.Pubkey, false)
+		}
+		var typeErr error
+		if t := p.KeyType(); t != config.PCRPolicyTPM && t != config.PCRPolicyFile {
+			typeErr = fmt.Errorf("unknown type %q, valid types are tpm and file", t)
+		}
+		v.check("pcr_policy.type", typeErr)
+	}
+	if h := conf.Hooks; h != nil {
+		for _, hook := range []struct {
+			name string
+			cmds []string
+		}{
+			{"pre_sign", h.PreSign},
+			{"post_sign", h.PostSign},
+			{"pre_enroll", h.PreEnroll},
+			{"post_enroll", h.PostEnroll},
+		} {
+			for i, c := range hook.cmds {
+				var err error
+				if strings.TrimSpace(c) == "" {
+					err = fmt.Errorf("empty hook command")
+				}
+				v.check(fmt.Sprintf("hooks.%s[%d]", hook.name, i), err)
+			}
+		}
+	}
+
+	result.Fields = v.fields
+	result.Valid = true
+	for _, f := range result.Fields {
+		if f.Error != "" {
+			result.Valid = false
+		}
+	}
+	return result, nil
+}
+
+func RunConfigValidate(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+
+	file := configPath()
+	if len(args) > 0 {
+		file = args[0]
+	}
+
+	if state.Config.Landlock {
+		lsm.RestrictAdditionalPaths(
+			landlock.ROFiles(file).IgnoreIfMissing(),
+		)
+		if b, err := os.ReadFile(file); err == nil {
+			// The key directory is checked by creating a file in it
+			if conf, err := config.NewConfigFormat(b, config.DetectFormat(file, b)); err == nil {
+				lsm.RestrictAdditionalPaths(landlock.RWDirs(conf.Keydir).IgnoreIfMissing())
+			}
+		}
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+
+	result, err := ValidateConfig(state.Fs, file)
+	if err != nil {
+		return err
+	}
+	if cmdOptions.StructuredOutput() {
+		if err := StructuredOut(result); err != nil {
+			return err
+		}
+	} else {
+		for _, f := range result.Fields {
+			if f.Error != "" {
+				logging.NotOk("%s: %s", f.Field, f.Error)
+			} else {
+				logging.Ok("%s", f.Field)
+			}
+		}
+	}
+	if !result.Valid {
+		return &ExitCodeError{Code: 1, Err: fmt.Errorf("%s is not a valid configuration", file)}
+	}
+	logging.Print("\n%s is valid\n", file)
+	return nil
+}
+
+func init() {
+	configCmd.AddCommand(configValidateCmd)
+	configCmd.AddCommand(configGetCmd)
+	configCmd.AddCommand(configSetCmd)
+	CliCommands = append(CliCommands, cliCommand{
+		Cmd: configCmd,
+	}, cliCommand{
+		Cmd:  configSetCmd,
+		Lock: true,
+	})
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/foxboron/sbctl/config"
+	"github.com/spf13/afero"
+)
+
+const validateTestConfig = `---
+keydir: /var/lib/sbctl/keys
+guid: /var/lib/sbctl/GUID
+files_db: /var/lib/sbctl/files.json
+bundles_db: /var/lib/sbctl/bundles.json
+db_additions:
+- microsoft
+keys:
+  pk:
+    privkey: /var/lib/sbctl/keys/PK/PK.key
+    pubkey: /var/lib/sbctl/keys/PK/PK.pem
+    type: file
+  kek:
+    privkey: /var/lib/sbctl/keys/KEK/KEK.key
+    pubkey: /var/lib/sbctl/keys/KEK/KEK.pem
+    type: file
+  db:
+    privkey: /var/lib/sbctl/keys/db/db.key
+    pubkey: /var/lib/sbctl/keys/db/db.pem
+    type: %s
+`
+
+func validateTestFs(t *testing.T, conf string) afero.Fs {
+	vfs := afero.NewMemMapFs()
+	for _, f := range []string{
+		"GUID", "files.json", "bundles.json",
+		"keys/PK/PK.key", "keys/PK/PK.pem",
+		"keys/KEK/KEK.key", "keys/KEK/KEK.pem",
+		"keys/db/db.key", "keys/db/db.pem",
+	} {
+		if err := afero.WriteFile(vfs, "/var/lib/sbctl/"+f, []byte{}, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := afero.WriteFile(vfs, "/etc/sbctl/sbctl.conf", []byte(conf), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return vfs
+}
+
+func failedFields(result *ConfigValidation) string {
+	var fields []string
+	for _, f := range result.Fields {
+		if f.Error != "" {
+			fields = append(fields, f.Field)
+		}
+	}
+	return strings.Join(fields, ",")
+}
+
+func TestValidateConfig(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		conf   string
+		failed string
+	}{
+		{"valid", strings.Replace(validateTestConfig, "%s", "file", 1), ""},
+		{"key type", strings.Replace(validateTestConfig, "%s", "yubikey", 1), "keys.db.type"},
+		{"unknown field", strings.Replace(validateTestConfig, "%s", "file", 1) + "landlocked: true\n", "file"},
+		{"db additions", strings.Replace(strings.Replace(validateTestConfig, "%s", "file", 1), "- microsoft", "- microsfot", 1), "db_additions[0]"},
+		{"missing file", strings.Replace(strings.Replace(validateTestConfig, "%s", "file", 1), "files.json", "missing.json", 1), "files_db"},
+		{"toml", "landlock = false\ndb_additions = [\"microsoft\"]\n", ""},
+		{"toml unknown field", "landlocked = true\n", "file"},
+		{"landlock extra paths", strings.Replace(validateTestConfig, "%s", "file", 1) + "landlock_extra_paths:\n- /var/lib/sbctl/keys\n- /var/lib/sbctl/GUID\n", "landlock_extra_paths[1]"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			vfs := validateTestFs(t, c.conf)
+			result, err := ValidateConfig(vfs, "/etc/sbctl/sbctl.conf")
+			if err != nil {
+				t.Fatalf("failed validating config: %v", err)
+			}
+			if failed := failedFields(result); failed != c.failed {
+				t.Fatalf("expected %q to fail, got %q: %+v", c.failed, failed, result.Fields)
+			}
+			if result.Valid != (c.failed == "") {
+				t.Fatalf("unexpected validity %v", result.Valid)
+			}
+		})
+	}
+}
+
+func TestConfigSetGet(t *testing.T) {
+	vfs := afero.NewMemMapFs()
+	conf := `---
+# Managed by provisioning
+landlock: true
+keys:
+  db:
+    # Keep the db key in a file
+    type: file
+`
+	if err := afero.WriteFile(vfs, "/etc/sbctl/sbctl.conf", []byte(conf), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		key, value string
+	}{
+		{"landlock", "false"},
+		{"keydir", "/etc/sbctl/keys"},
+		{"key-type", "tpm"},
+		{"keys.db.algorithm", "rsa-4096"},
+		{"db_additions", "microsoft,custom"},
+	} {
+		if err := SetConfigValue(vfs, "/etc/sbctl/sbctl.conf", c.key, c.value); err != nil {
+			t.Fatalf("failed setting %s: %v", c.key, err)
+		}
+	}
+	for key, want := range map[string]any{
+		"landlock":          false,
+		"keydir":            "/etc/sbctl/keys",
+		"key-type":          "tpm",
+		"keys.db.algorithm": "rsa-4096",
+		"keys.pk.privkey":   "/var/lib/sbctl/keys/PK/PK.key",
+	} {
+		v, err := GetConfigValue(vfs, "/etc/sbctl/sbctl.conf", key)
+		if err != nil {
+			t.Fatalf("failed getting %s: %v", key, err)
+		}
+		if v != want {
+			t.Fatalf("expected %s to be %v, got %v", key, want, v)
+		}
+	}
+
+	b, err := afero.ReadFile(vfs, "/etc/sbctl/sbctl.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), "# Managed by provisioning") {
+		t.Fatalf("comments should be kept:\n%s", b)
+	}
+
+	if err := SetConfigValue(vfs, "/etc/sbctl/sbctl.conf", "landlock", "maybe"); err == nil {
+		t.Fatalf("expected an invalid value to be rejected")
+	}
+	if err := SetConfigValue(vfs, "/etc/sbctl/sbctl.conf", "keys.db.type", "yubikey"); err == nil {
+		t.Fatalf("expected an invalid key type to be rejected")
+	}
+	if err := SetConfigValue(vfs, "/etc/sbctl/sbctl.conf", "keys.db.algorithm", "ecdsa-p256"); err == nil {
+		t.Fatalf("expected an unknown key algorithm to be rejected")
+	}
+	if _, err := GetConfigValue(vfs, "/etc/sbctl/sbctl.conf", "nonexistent"); !errors.Is(err, ErrUnknownConfigKey) {
+		t.Fatalf("expected ErrUnknownConfigKey, got %v", err)
+	}
+}
+
+func TestConfigSetGetTOML(t *testing.T) {
+	vfs := afero.NewMemMapFs()
+	conf := `# Managed by provisioning
+landlock = true
+
+[keys.db]
+type = "file"
+`
+	if err := afero.WriteFile(vfs, "/etc/sbctl/sbctl.conf", []byte(conf), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		key, value string
+	}{
+		{"landlock", "false"},
+		{"efivar_retries", "3"},
+		{"keys.db.algorithm", "rsa-4096"},
+		{"keys.pk.type", "tpm"},
+		{"db_additions", "microsoft,custom"},
+	} {
+		if err := SetConfigValue(vfs, "/etc/sbctl/sbctl.conf", c.key, c.value); err != nil {
+			t.Fatalf("failed setting %s: %v", c.key, err)
+		}
+	}
+	for key, want := range map[string]any{
+		"landlock":          false,
+		"efivar_retries":    float64(3),
+		"keys.db.type":      "file",
+		"keys.db.algorithm": "rsa-4096",
+		"keys.pk.type":      "tpm",
+		"keys.pk.privkey":   "/var/lib/sbctl/keys/PK/PK.key",
+	} {
+		v, err := GetConfigValue(vfs, "/etc/sbctl/sbctl.conf", key)
+		if err != nil {
+			t.Fatalf("failed getting %s: %v", key, err)
+		}
+		if v != want {
+			t.Fatalf("expected %s to be %v, got %v", key, want, v)
+		}
+	}
+
+	// The file stays TOML
+	b, err := afero.ReadFile(vfs, "/etc/sbctl/sbctl.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"landlock = false", "efivar_retries = 3", `db_additions = ["microsoft", "custom"]`, "[keys.db]", `algorithm = "rsa-4096"`} {
+		if !strings.Contains(string(b), line+"\n") {
+			t.Fatalf("expected %q in the file:\n%s", line, b)
+		}
+	}
+	if config.DetectFormat("", b) != config.FormatTOML {
+		t.Fatalf("expected the file to be TOML:\n%s", b)
+	}
+}
+
+func TestReadConfigOnly(t *testing.T) {
+	vfs := afero.NewMemMapFs()
+	cmdOptions.ConfigOnly = true
+	t.Cleanup(func() { cmdOptions.ConfigOnly = false })
+
+	t.Setenv(configEnv, "")
+	if _, err := readConfig(vfs); !errors.Is(err, ErrNoExplicitConfig) {
+		t.Fatalf("expected ErrNoExplicitConfig, got %v", err)
+	}
+
+	file := filepath.Join(t.TempDir(), "sbctl.conf")
+	if err := os.WriteFile(file, []byte("keydir: /build/keys\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(configEnv, file)
+	conf, err := readConfig(vfs)
+	if err != nil {
+		t.Fatalf("failed reading %s: %v", file, err)
+	}
+	if conf.Keydir != "/build/keys" {
+		t.Fatalf("expected the keydir from %s, got %s", file, conf.Keydir)
+	}
+
+	t.Setenv(configEnv, filepath.Join(t.TempDir(), "missing.conf"))
+	if _, err := readConfig(vfs); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected a missing configuration to fail, got %v", err)
+	}
+}
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"crypto/x509/pkix"
 	"fmt"
 	"path"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/foxboron/sbctl"
 	"github.com/foxboron/sbctl/backend"
 	"github.com/foxboron/sbctl/config"
 	"github.com/foxboron/sbctl/logging"
 	"github.com/foxboron/sbctl/lsm"
+	"github.com/foxboron/sbctl/stringset"
 	"github.com/landlock-lsm/go-landlock/landlock"
 	"github.com/spf13/cobra"
 )
@@ -19,6 +24,17 @@ var (
 	databasePath                     string
 	Keytype                          string
 	PKKeytype, KEKKeytype, DbKeytype string
+	KeyAlgorithm                     = stringset.StringSet{Allowed: backend.KeyAlgorithms}
+	SealTPM                          bool
+	SealPCRs                         []string
+	EncryptKeys                      bool
+	ValidFor                         string
+	NotAfter                         string
+	CreateCSR                        bool
+	SubjectDN                        string
+	SubjectCN                        string
+	SubjectOrg                       string
+	SubjectCountry                   string
 )
 
 var createKeysCmd = &cobra.Command{
@@ -30,7 +46,97 @@ var createKeysCmd = &cobra.Command{
 	},
 }
 
+// parseValidity parses a validity period like 90d, 12w or 2y, or a Go
+// duration, into the expiry date relative to now
+func parseValidity(s string, now time.Time) (time.Time, error) {
+	if len(s) > 1 {
+		n, err := strconv.Atoi(s[:len(s)-1])
+		if err == nil && n > 0 {
+			switch s[len(s)-1] {
+			case 'd':
+				return now.AddDate(0, 0, n), nil
+			case 'w':
+				return now.AddDate(0, 0, 7*n), nil
+			case 'y':
+				return now.AddDate(n, 0, 0), nil
+			}
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return time.Time{}, fmt.Errorf("invalid validity period %q, use e.g. 90d, 12w or 2y", s)
+	}
+	return now.Add(d), nil
+}
+
+// parseNotAfter parses the expiry date of the certificates from --valid-for
+// or --not-after
+func parseNotAfter(validFor, notAfter string, now time.Time) (time.Time, error) {
+	switch {
+	case validFor != "" && notAfter != "":
+		return time.Time{}, fmt.Errorf("--valid-for and --not-after can't be used together")
+	case validFor != "":
+		return parseValidity(validFor, now)
+	case notAfter != "":
+		t, err := time.Parse(time.DateOnly, notAfter)
+		if err != nil {
+			t, err = time.Parse(time.RFC3339, notAfter)
+		}
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid date %q, use YYYY-MM-DD or RFC 3339", notAfter)
+		}
+		if !t.After(now) {
+			return time.Time{}, fmt.Errorf("--not-after %s is in the past", notAfter)
+		}
+		return t, nil
+	}
+	return time.Time{}, nil
+}
+
+// parseSubject builds the subject of the certificates from --subject, or from
+// --cn, --org and --country
+func parseSubject(dn, cn, org, country string) (pkix.Name, error) {
+	var name pkix.Name
+	if dn != "" {
+		if cn != "" || org != "" || country != "" {
+			return pkix.Name{}, fmt.Errorf("--subject can't be combined with --cn, --org or --country")
+		}
+		var err error
+		name, err = backend.ParseSubject(dn)
+		if err != nil {
+			return pkix.Name{}, err
+		}
+	} else {
+		name.CommonName = cn
+		if org != "" {
+			name.Organization = []string{org}
+		}
+		if country != "" {
+			name.Country = []string{country}
+		}
+	}
+	for i, c := range name.Country {
+		if len(c) != 2 {
+			return pkix.Name{}, fmt.Errorf("invalid country %q, use a two letter code like US", c)
+		}
+		name.Country[i] = strings.ToUpper(c)
+	}
+	return name, nil
+}
+
 func RunCreateKeys(state *config.State) error {
+	notAfter, err := parseNotAfter(ValidFor, NotAfter, time.Now())
+	if err != nil {
+		return err
+	}
+	backend.NotAfter = notAfter
+
+	subject, err := parseSubject(SubjectDN, SubjectCN, SubjectOrg, SubjectCountry)
+	if err != nil {
+		return err
+	}
+	backend.Subject = subject
+
 	if state.Config.Landlock {
 		lsm.RestrictAdditionalPaths(
 			landlock.RWDirs(filepath.Dir(filepath.Dir(filepath.Clean(state.Config.Keydir)))),
@@ -72,6 +178,37 @@ func RunCreateKeys(state *config.State) error {
 		}
 	}
 
+	if SealTPM {
+		pcrs, err := backend.ParsePCRs(SealPCRs)
+		if err != nil {
+			return err
+		}
+		for _, kc := range state.Config.Keys.GetKeysConfigs() {
+			kc.Type = string(backend.SealedBackend)
+			kc.PCRs = pcrs
+		}
+	} else if len(SealPCRs) != 0 {
+		return fmt.Errorf("--pcr requires --seal-tpm")
+	}
+
+	if EncryptKeys {
+		if SealTPM {
+			return fmt.Errorf("--encrypt can't be combined with --seal-tpm")
+		}
+		for _, kc := range state.Config.Keys.GetKeysConfigs() {
+			kc.Type = string(backend.EncryptedBackend)
+		}
+	}
+
+	if KeyAlgorithm.Value != "" {
+		if _, err := backend.ParseKeyAlgorithm(KeyAlgorithm.Value); err != nil {
+			return err
+		}
+		state.Config.Keys.PK.Algorithm = KeyAlgorithm.Value
+		state.Config.Keys.KEK.Algorithm = KeyAlgorithm.Value
+		state.Config.Keys.Db.Algorithm = KeyAlgorithm.Value
+	}
+
 	uuid, err := sbctl.CreateGUID(state.Fs, state.Config.GUID)
 	if err != nil {
 		return err
@@ -95,6 +232,19 @@ func RunCreateKeys(state *config.State) error {
 	} else {
 		logging.Ok("Secure boot keys have already been created!")
 	}
+
+	if CreateCSR {
+		kh, err := backend.GetKeyHierarchy(state.Fs, state)
+		if err != nil {
+			return err
+		}
+		csr, err := sbctl.CreateDbCSR(state, kh)
+		if err != nil {
+			return err
+		}
+		logging.Print("Wrote a certificate signing request for the db key to %s\n", csr)
+		logging.Print("Install the certificate issued by your CA with import-signed-cert\n")
+	}
 	return nil
 }
 
@@ -106,12 +256,24 @@ func createKeysCmdFlags(cmd *cobra.Command) {
 	f.StringVarP(&PKKeytype, "pk-keytype", "", "", "PK key type (default: file)")
 	f.StringVarP(&KEKKeytype, "kek-keytype", "", "", "KEK key type (default: file)")
 	f.StringVarP(&DbKeytype, "db-keytype", "", "", "db key type (defualt: file)")
+	f.VarPF(&KeyAlgorithm, "key-algorithm", "", "key algorithm for all keys (default: rsa-4096)")
+	f.BoolVarP(&SealTPM, "seal-tpm", "", false, "seal the private keys to the TPM")
+	f.StringSliceVarP(&SealPCRs, "pcr", "", nil, "PCRs the sealed keys are bound to, can be passed multiple times")
+	f.BoolVarP(&EncryptKeys, "encrypt", "", false, "encrypt the private keys with a passphrase, read from $SBCTL_PASSPHRASE or prompted for")
+	f.StringVarP(&ValidFor, "valid-for", "", "", "validity period of the certificates, e.g. 90d, 12w or 2y (default 5y)")
+	f.StringVarP(&NotAfter, "not-after", "", "", "expiry date of the certificates, YYYY-MM-DD or RFC 3339")
+	f.StringVarP(&SubjectCN, "cn", "", "", "common name of all the certificates (default: the organization followed by PK, KEK or db)")
+	f.StringVarP(&SubjectOrg, "org", "", "", "organization of the certificates")
+	f.StringVarP(&SubjectCountry, "country", "", "", "two letter country code of the certificates")
+	f.StringVarP(&SubjectDN, "subject", "", "", "subject of the certificates as a distinguished name, e.g. \"CN=My Org,O=My Org,C=US\"")
+	f.BoolVarP(&CreateCSR, "csr", "", false, "write a certificate signing request for the db key, to have the db certificate issued by a CA")
 }
 
 func init() {
 	createKeysCmdFlags(createKeysCmd)
 
 	CliCommands = append(CliCommands, cliCommand{
-		Cmd: createKeysCmd,
+		Cmd:  createKeysCmd,
+		Lock: true,
 	})
 }
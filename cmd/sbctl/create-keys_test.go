@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/fs"
+)
+
+func TestParseNotAfter(t *testing.T) {
+	now := time.Date(2026, 1, 31, 12, 0, 0, 0, time.UTC)
+	for _, c := range []struct {
+		validFor, notAfter string
+		want               time.Time
+	}{
+		{"", "", time.Time{}},
+		{"90d", "", now.AddDate(0, 0, 90)},
+		{"2w", "", now.AddDate(0, 0, 14)},
+		{"2y", "", now.AddDate(2, 0, 0)},
+		{"36h", "", now.Add(36 * time.Hour)},
+		{"", "2027-06-01", time.Date(2027, 6, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		got, err := parseNotAfter(c.validFor, c.notAfter, now)
+		if err != nil {
+			t.Fatalf("%q %q: %v", c.validFor, c.notAfter, err)
+		}
+		if !got.Equal(c.want) {
+			t.Fatalf("%q %q: expected %s, got %s", c.validFor, c.notAfter, c.want, got)
+		}
+	}
+	for _, c := range [][2]string{{"0d", ""}, {"2x", ""}, {"", "2025-01-01"}, {"", "tomorrow"}, {"1y", "2027-01-01"}} {
+		if _, err := parseNotAfter(c[0], c[1], now); err == nil {
+			t.Fatalf("%q %q: expected an error", c[0], c[1])
+		}
+	}
+}
+
+func TestCreateKeysValidFor(t *testing.T) {
+	state := setupEnrollState(t)
+	ValidFor = "10d"
+	t.Cleanup(func() {
+		ValidFor = ""
+		backend.NotAfter = time.Time{}
+	})
+
+	if err := RunCreateKeys(state); err != nil {
+		t.Fatalf("failed creating keys: %v", err)
+	}
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Until(kh.Db.Certificate().NotAfter); d > 10*24*time.Hour || d < 9*24*time.Hour {
+		t.Fatalf("unexpected expiry %s", kh.Db.Certificate().NotAfter)
+	}
+
+	stat := &Status{Installed: true, SecureBoot: true, InstalledKeys: InstalledKeys{true, true, true}, KeyExpiry: map[string]time.Time{
+		"PK":  kh.PK.Certificate().NotAfter,
+		"KEK": time.Now().AddDate(1, 0, 0),
+		"db":  time.Now().AddDate(0, 0, -1),
+	}}
+	statusCmdOptions.ExpiryWarning = 30
+	issues := statusIssues(stat)
+	if len(issues) != 2 || issues[0].ID != statusIssueCertExpiring || issues[1].ID != statusIssueCertExpired {
+		t.Fatalf("unexpected issues: %+v", issues)
+	}
+}
+
+func TestCreateKeysEncrypt(t *testing.T) {
+	state := setupEnrollState(t)
+	asked := 0
+	state.Passphrase = func(confirm bool) ([]byte, error) {
+		asked++
+		return []byte("secret"), nil
+	}
+	EncryptKeys = true
+	t.Cleanup(func() { EncryptKeys = false })
+
+	if err := RunCreateKeys(state); err != nil {
+		t.Fatalf("failed creating keys: %v", err)
+	}
+	b, err := fs.ReadFile(state.Fs, state.Config.Keys.Db.Privkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bt, err := backend.GetBackendType(b); err != nil || bt != backend.EncryptedBackend {
+		t.Fatalf("expected an encrypted key, got %v: %v", bt, err)
+	}
+
+	// The keys are decrypted when they sign the enrolled variables
+	asked = 0
+	if err := RunEnrollKeys(state); err != nil {
+		t.Fatalf("failed enrolling keys: %v", err)
+	}
+	if asked == 0 {
+		t.Fatal("expected the passphrase to be read to enroll the keys")
+	}
+	b2, err := fs.ReadFile(state.Fs, state.Config.Keys.Db.Privkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, b2) {
+		t.Fatal("the encrypted key was rewritten")
+	}
+
+	stat, err := GetStatus(state, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.KeyTypes["db"] != string(backend.EncryptedBackend) {
+		t.Fatalf("expected the status to show encrypted keys, got %v", stat.KeyTypes)
+	}
+}
+
+func TestParseSubject(t *testing.T) {
+	for _, c := range []struct {
+		dn, cn, org, country string
+		want                 string
+	}{
+		{"", "", "", "", ""},
+		{"", "", "My Org", "us", "O=My Org,C=US"},
+		{"", "Key", "My Org", "", "CN=Key,O=My Org"},
+		{"CN=My Org,O=My Org\\, Inc.,C=US", "", "", "", "CN=My Org,O=My Org\\, Inc.,C=US"},
+		{"/CN=My Org/OU=IT/O=My Org", "", "", "", "CN=My Org,OU=IT,O=My Org"},
+	} {
+		name, err := parseSubject(c.dn, c.cn, c.org, c.country)
+		if err != nil {
+			t.Fatalf("%q: %v", c.dn, err)
+		}
+		if name.String() != c.want {
+			t.Fatalf("%q: expected %q, got %q", c.dn, c.want, name.String())
+		}
+	}
+	for _, c := range [][4]string{{"CN=a", "b", "", ""}, {"CN", "", "", ""}, {"E=a@b", "", "", ""}, {"", "", "", "USA"}} {
+		if _, err := parseSubject(c[0], c[1], c[2], c[3]); err == nil {
+			t.Fatalf("%q: expected an error", c)
+		}
+	}
+}
+
+func TestCreateKeysSubject(t *testing.T) {
+	state := setupEnrollState(t)
+	SubjectOrg = "My Org"
+	SubjectCountry = "US"
+	t.Cleanup(func() {
+		SubjectOrg = ""
+		SubjectCountry = ""
+		backend.Subject = pkix.Name{}
+	})
+
+	if err := RunCreateKeys(state); err != nil {
+		t.Fatalf("failed creating keys: %v", err)
+	}
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		key  backend.KeyBackend
+		want string
+	}{
+		{kh.PK, "CN=My Org PK,O=My Org,C=US"},
+		{kh.KEK, "CN=My Org KEK,O=My Org,C=US"},
+		{kh.Db, "CN=My Org db,O=My Org,C=US"},
+	} {
+		if got := c.key.Certificate().Subject.String(); got != c.want {
+			t.Fatalf("expected subject %q, got %q", c.want, got)
+		}
+	}
+
+	// The common name is used verbatim
+	state = setupEnrollState(t)
+	SubjectCN = "My Org PK"
+	t.Cleanup(func() { SubjectCN = "" })
+	if err := RunCreateKeys(state); err != nil {
+		t.Fatalf("failed creating keys: %v", err)
+	}
+	kh, err = backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := kh.PK.Certificate().Subject.String(); got != "CN=My Org PK,O=My Org,C=US" {
+		t.Fatalf("expected the common name as given, got %q", got)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/spf13/cobra"
+)
+
+type DiffResult struct {
+	PK  *sbctl.SignatureDiff `json:"PK"`
+	KEK *sbctl.SignatureDiff `json:"KEK"`
+	Db  *sbctl.SignatureDiff `json:"db"`
+}
+
+var diffCmd = &cobra.Command{
+	Use:   "diff",
+	Short: "Show the changes enroll-keys would make to the enrolled keys",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		state := cmd.Context().Value(stateDataKey{}).(*config.State)
+		if state.Config.Landlock {
+			if err := lsm.Restrict(); err != nil {
+				return err
+			}
+		}
+
+		result, err := RunDiff(state)
+		if err != nil {
+			return err
+		}
+		if cmdOptions.StructuredOutput() {
+			return StructuredOut(result)
+		}
+		printDiff("PK", result.PK)
+		printDiff("KEK", result.KEK)
+		printDiff("db", result.Db)
+		return nil
+	},
+}
+
+func RunDiff(state *config.State) (*DiffResult, error) {
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		return nil, err
+	}
+	current, err := sbctl.SystemEFIVariables(state.Efivarfs)
+	if err != nil {
+		return nil, fmt.Errorf("can't read efivariables: %v", err)
+	}
+
+	// ExpectedEFIVariables reports which vendor certificates are included,
+	// which is just noise here
+	if !cmdOptions.StructuredOutput() {
+		logging.PrintOff()
+		defer logging.PrintOn()
+	}
+	expected, err := ExpectedEFIVariables(state, kh, enrollOEMs(state))
+	if err != nil {
+		return nil, err
+	}
+	return &DiffResult{
+		PK:  sbctl.DiffSignatureDatabase(current.PK, expected.PK),
+		KEK: sbctl.DiffSignatureDatabase(current.KEK, expected.KEK),
+		Db:  sbctl.DiffSignatureDatabase(current.Db, expected.Db),
+	}, nil
+}
+
+func printDiff(name string, diff *sbctl.SignatureDiff) {
+	logging.Println(name + ":")
+	if !diff.HasChanges() {
+		logging.Println("  No changes")
+		return
+	}
+	for _, e := range diff.Added {
+		logging.Print("  + %s %s %s\n", e.Type, e.Fingerprint, e.Description)
+	}
+	for _, e := range diff.Removed {
+		logging.Print("  - %s %s %s\n", e.Type, e.Fingerprint, e.Description)
+	}
+}
+
+func diffCmdFlags(cmd *cobra.Command) {
+	f := cmd.Flags()
+	f.BoolVarP(&enrollKeysCmdOptions.Append, "append", "a", false, "compare against appending the keys to the existing ones")
+}
+
+func init() {
+	diffCmdFlags(diffCmd)
+	vendorFlags(diffCmd)
+	CliCommands = append(CliCommands, cliCommand{
+		Cmd:      diffCmd,
+		Efivarfs: true,
+	})
+}
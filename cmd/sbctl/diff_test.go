@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDiffSetupMode(t *testing.T) {
+	state := setupEnrollState(t)
+
+	if err := RunCreateKeys(state); err != nil {
+		t.Fatalf("failed creating keys: %v", err)
+	}
+
+	result, err := RunDiff(state)
+	if err != nil {
+		t.Fatalf("failed running diff: %v", err)
+	}
+	for name, diff := range map[string]int{
+		"PK":  len(result.PK.Added),
+		"KEK": len(result.KEK.Added),
+		"db":  len(result.Db.Added),
+	} {
+		if diff != 1 {
+			t.Fatalf("expected one added certificate in %s, got %d", name, diff)
+		}
+	}
+	if len(result.PK.Removed)+len(result.KEK.Removed)+len(result.Db.Removed) != 0 {
+		t.Fatalf("expected no removed certificates in setup mode")
+	}
+}
+
+func TestDiffEnrolled(t *testing.T) {
+	state := setupEnrollState(t)
+
+	if err := SetupInstallation(state); err != nil {
+		t.Fatalf("failed running SetupInstallation: %v", err)
+	}
+
+	result, err := RunDiff(state)
+	if err != nil {
+		t.Fatalf("failed running diff: %v", err)
+	}
+	if result.PK.HasChanges() || result.KEK.HasChanges() || result.Db.HasChanges() {
+		t.Fatalf("expected no changes after enrolling: %+v", result)
+	}
+}
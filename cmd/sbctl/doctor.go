@@ -0,0 +1,269 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/landlock-lsm/go-landlock/landlock"
+	"github.com/spf13/cobra"
+)
+
+// Severities of the doctor problems. Critical problems make enrolling keys or
+// booting fail, and doctor exits non-zero when one is found.
+const (
+	doctorCritical = "critical"
+	doctorWarning  = "warning"
+)
+
+// DoctorProblem is a misconfiguration found by doctor, with the fix for it
+type DoctorProblem struct {
+	ID       string `json:"id"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	Fix      string `json:"fix"`
+	// The sentinel error the problem fails commands with, if any
+	Err error `json:"-"`
+}
+
+type DoctorReport struct {
+	Critical bool            `json:"critical"`
+	Problems []DoctorProblem `json:"problems"`
+}
+
+var (
+	// Replaced by the tests
+	doctorGeteuid = os.Geteuid
+	doctorCmd     = &cobra.Command{
+		Use:   "doctor",
+		Short: "Diagnose common problems with the Secure Boot setup",
+		Long: `Diagnose common problems with the Secure Boot setup.
+
+Checks the things commands most often fail on, such as running without root,
+Setup Mode being disabled, OptionROMs, a missing TPM, immutable EFI variables
+and stale bundles, and prints how to fix them. Critical problems are listed
+first, and make doctor exit with a non-zero status.`,
+		RunE: RunDoctor,
+	}
+)
+
+// doctorCheck appends the problems it finds to the report
+type doctorCheck func(state *config.State, report *doctorReporter)
+
+type doctorReporter struct {
+	problems []DoctorProblem
+	// The EFI variables can't be read, which makes the firmware checks
+	// pointless
+	noEfivarfs bool
+	// All of the sbctl keys are enrolled in the firmware
+	enrolled bool
+}
+
+func (r *doctorReporter) add(id, severity string, err error, fix string, msg string, a ...any) {
+	r.problems = append(r.problems, DoctorProblem{
+		ID:       id,
+		Severity: severity,
+		Message:  fmt.Sprintf(msg, a...),
+		Fix:      fix,
+		Err:      err,
+	})
+}
+
+var doctorChecks = []doctorCheck{
+	func(state *config.State, r *doctorReporter) {
+		if doctorGeteuid() != 0 {
+			r.add("not_root", doctorCritical, os.ErrPermission,
+				"Run sbctl as root, for example with sudo.",
+				"sbctl is not running as root")
+		}
+	},
+	func(state *config.State, r *doctorReporter) {
+		if !sbctl.EfivarfsAvailable(state.Efivarfs) {
+			r.noEfivarfs = true
+			r.add("no_efivarfs", doctorCritical, sbctl.ErrNoEfivarfs,
+				"Boot the system with UEFI, and mount efivarfs with: mount -t efivarfs efivarfs /sys/firmware/efi/efivars",
+				"the EFI variables can't be read")
+		}
+	},
+	func(state *config.State, r *doctorReporter) {
+		if !state.IsInstalled() {
+			r.add("not_installed", doctorWarning, nil,
+				"Create the keys with: sbctl create-keys",
+				"there are no sbctl keys in %s", state.Config.Keydir)
+			return
+		}
+		if r.noEfivarfs {
+			return
+		}
+		if keys, err := EnrolledSbctlKeys(state); err == nil {
+			r.enrolled = keys.PK && keys.KEK && keys.Db
+		}
+	},
+	func(state *config.State, r *doctorReporter) {
+		if r.noEfivarfs || r.enrolled {
+			return
+		}
+		if ok, err := state.Efivarfs.GetSetupMode(); err == nil && !ok {
+			r.add("setup_mode_disabled", doctorCritical, ErrSetupModeDisabled,
+				setupModeDisabled,
+				"the sbctl keys are not enrolled and Setup Mode is disabled")
+		}
+	},
+	func(state *config.State, r *doctorReporter) {
+		// The OptionROMs only matter until the keys are enrolled
+		if r.noEfivarfs || r.enrolled {
+			return
+		}
+		err := sbctl.CheckEventlogOprom(state.Fs, systemEventlog)
+		switch {
+		case errors.Is(err, sbctl.ErrOprom):
+			r.add("oprom", doctorCritical, err,
+				opromErrorMsg,
+				"the TPM eventlog contains OptionROMs which have to be allowed in db")
+		case errors.Is(err, sbctl.ErrNoEventlog):
+			r.add("no_eventlog", doctorWarning, err,
+				noEventlogErrorMsg,
+				"there is no TPM eventlog to check for OptionROMs")
+		case err != nil:
+			r.add("eventlog", doctorWarning, err,
+				"Check that the TPM eventlog is readable.",
+				"can't read the TPM eventlog: %v", err)
+		}
+	},
+	func(state *config.State, r *doctorReporter) {
+		if !state.HasTPM() {
+			r.add("no_tpm", doctorWarning, nil,
+				"Enable the TPM in the firmware settings if the system has one. Keys can't be sealed to the TPM without it.",
+				"no TPM was found")
+		}
+	},
+	func(state *config.State, r *doctorReporter) {
+		if r.noEfivarfs {
+			return
+		}
+		var immutable []string
+		for _, file := range sbctl.EfivarFSFiles {
+			if errors.Is(sbctl.IsImmutable(state.Fs, file), sbctl.ErrImmutable) {
+				immutable = append(immutable, file)
+			}
+		}
+		if len(immutable) != 0 {
+			r.add("immutable_efivars", doctorWarning, sbctl.ErrImmutable,
+				"Commands writing EFI variables clear the attribute unless --chattr-auto=false is passed. Run chattr -i on the files if clearing it fails.",
+				"EFI variables are immutable: %s", strings.Join(immutable, ", "))
+		}
+	},
+	func(state *config.State, r *doctorReporter) {
+		err := sbctl.BundleIter(state, func(bundle *sbctl.Bundle) error {
+			status, err := sbctl.VerifyBundle(state.Fs, bundle)
+			switch {
+			case err != nil:
+				r.add("bundle_unreadable", doctorWarning, err,
+					"Check the input files of the bundle.",
+					"can't check the bundle %s: %v", bundle.Output, err)
+			case status == sbctl.BundleOutdated:
+				r.add("bundle_stale", doctorWarning, nil,
+					"Regenerate the bundles with: sbctl generate-bundles --sign",
+					"the bundle %s is older than its input files", bundle.Output)
+			case status == sbctl.BundleMissingInput:
+				r.add("bundle_missing_input", doctorWarning, nil,
+					"Update or remove the bundle with: sbctl remove-bundle "+bundle.Output,
+					"input files of the bundle %s are missing", bundle.Output)
+			}
+			return nil
+		})
+		if err != nil {
+			r.add("bundle_database", doctorWarning, err,
+				"Check the bundle database "+state.Config.BundlesDb+".",
+				"can't read the bundle database: %v", err)
+		}
+	},
+}
+
+// Doctor runs the checks, and returns the problems with the critical ones
+// first
+func Doctor(state *config.State) *DoctorReport {
+	r := &doctorReporter{}
+	for _, check := range doctorChecks {
+		check(state, r)
+	}
+	slices.SortStableFunc(r.problems, func(a, b DoctorProblem) int {
+		if a.Severity == b.Severity {
+			return 0
+		}
+		if a.Severity == doctorCritical {
+			return -1
+		}
+		return 1
+	})
+	report := &DoctorReport{Problems: r.problems}
+	if report.Problems == nil {
+		report.Problems = []DoctorProblem{}
+	}
+	report.Critical = slices.ContainsFunc(report.Problems, func(p DoctorProblem) bool { return p.Severity == doctorCritical })
+	return report
+}
+
+// doctorBundleFiles returns the files the bundles are read from
+func doctorBundleFiles(state *config.State) []string {
+	var files []string
+	_ = sbctl.BundleIter(state, func(bundle *sbctl.Bundle) error {
+		for _, f := range []string{bundle.Output, bundle.KernelImage, bundle.Initramfs, bundle.IntelMicrocode, bundle.AMDMicrocode,
+			bundle.Cmdline, bundle.Splash, bundle.OSRelease, bundle.EFIStub} {
+			if f != "" {
+				files = append(files, f)
+			}
+		}
+		return nil
+	})
+	return files
+}
+
+func RunDoctor(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+
+	if state.Config.Landlock {
+		if files := doctorBundleFiles(state); len(files) != 0 {
+			lsm.RestrictAdditionalPaths(
+				landlock.ROFiles(files...).IgnoreIfMissing(),
+			)
+		}
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+
+	report := Doctor(state)
+	if cmdOptions.StructuredOutput() {
+		if err := StructuredOut(report); err != nil {
+			return err
+		}
+	} else if len(report.Problems) == 0 {
+		logging.Ok("No problems found")
+	} else {
+		for _, p := range report.Problems {
+			if p.Severity == doctorCritical {
+				logging.NotOk("%s", p.Message)
+			} else {
+				logging.Print(logging.Warnf("%s", p.Message))
+			}
+			logging.Print("  Fix: %s\n", strings.ReplaceAll(p.Fix, "\n", "\n  "))
+		}
+	}
+	if report.Critical {
+		return &ExitCodeError{Code: 1}
+	}
+	return nil
+}
+
+func init() {
+	CliCommands = append(CliCommands, cliCommand{
+		Cmd: doctorCmd,
+	})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"testing"
+)
+
+func doctorProblemIDs(report *DoctorReport) []string {
+	ids := []string{}
+	for _, p := range report.Problems {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+func TestDoctor(t *testing.T) {
+	t.Cleanup(func() { doctorGeteuid = os.Geteuid })
+	doctorGeteuid = func() int { return 1000 }
+
+	state := setupEnrollState(t)
+	report := Doctor(state)
+	if !report.Critical {
+		t.Fatalf("expected a critical problem, got %+v", report.Problems)
+	}
+	ids := doctorProblemIDs(report)
+	for _, id := range []string{"not_root", "not_installed", "no_tpm"} {
+		if !slices.Contains(ids, id) {
+			t.Fatalf("expected the %s problem, got %v", id, ids)
+		}
+	}
+	if report.Problems[0].ID != "not_root" || !errors.Is(report.Problems[0].Err, os.ErrPermission) {
+		t.Fatalf("expected the critical problems first, got %v", ids)
+	}
+	var warnings bool
+	for _, p := range report.Problems {
+		if p.Severity == doctorWarning {
+			warnings = true
+		} else if warnings {
+			t.Fatalf("critical problem %s listed after a warning: %v", p.ID, ids)
+		}
+	}
+
+	doctorGeteuid = func() int { return 0 }
+	state = setupRotateState(t)
+	report = Doctor(state)
+	if report.Critical {
+		t.Fatalf("expected no critical problems with the keys enrolled, got %+v", report.Problems)
+	}
+	if ids := doctorProblemIDs(report); slices.Contains(ids, "setup_mode_disabled") || slices.Contains(ids, "oprom") {
+		t.Fatalf("the enrollment problems should be skipped with the keys enrolled, got %v", ids)
+	}
+}
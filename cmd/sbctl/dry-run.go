@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/spf13/cobra"
+)
+
+// Writes to the EFI variables skipped by --dry-run
+var dryRunPlan *sbctl.DryRun
+
+func dryRunFlags(cmd *cobra.Command) {
+	f := cmd.Flags()
+	f.BoolVarP(&cmdOptions.DryRun, "dry-run", "", false, "print the EFI variables that would be written without writing them")
+}
+
+// printDryRun prints the writes a command skipped with --dry-run
+func printDryRun(plan *sbctl.DryRun) error {
+	if cmdOptions.StructuredOutput() {
+		return StructuredOut(plan)
+	}
+	if len(plan.Writes) == 0 {
+		logging.Println("\nDry run, no EFI variables would be written.")
+		return nil
+	}
+	logging.Println("\nDry run, nothing has been written. The following EFI variables would be written:")
+	for _, w := range plan.Writes {
+		details := []string{w.GUID, w.Attributes}
+		if w.Signed {
+			details = append(details, "signed")
+		}
+		if w.Append {
+			details = append(details, "append")
+		}
+		logging.Print("  %s (%s), %d bytes\n", w.Variable, strings.Join(details, ", "), w.Size)
+		for _, e := range w.Entries {
+			logging.Print("    %s %s\n", e.Type, e.Value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/logging"
+)
+
+func setupDryRun(t *testing.T, state *config.State) {
+	state.Efivarfs, dryRunPlan = sbctl.DryRunEfivarWrites(state.Efivarfs)
+	cmdOptions.DryRun = true
+	t.Cleanup(func() {
+		cmdOptions.DryRun = false
+		cmdOptions.JsonOutput = false
+		dryRunPlan = nil
+	})
+}
+
+func TestDryRunEnrollKeys(t *testing.T) {
+	state := setupEnrollState(t)
+	if err := RunCreateKeys(state); err != nil {
+		t.Fatal(err)
+	}
+	setupDryRun(t, state)
+
+	if err := RunEnrollKeys(state); err != nil {
+		t.Fatalf("failed enrolling with --dry-run: %v", err)
+	}
+	for _, get := range []func() error{
+		func() error { _, err := state.Efivarfs.Getdb(); return err },
+		func() error { _, err := state.Efivarfs.GetKEK(); return err },
+		func() error { _, err := state.Efivarfs.GetPK(); return err },
+	} {
+		if err := get(); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("expected nothing to be written with --dry-run, got %v", err)
+		}
+	}
+
+	var plan sbctl.DryRun
+	if err := captureJsonOutput(&plan, func() error { return printDryRun(dryRunPlan) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Writes) != 3 {
+		t.Fatalf("expected db, KEK and PK to be planned, got %+v", plan.Writes)
+	}
+	for _, w := range plan.Writes {
+		if !w.Signed || w.Size == 0 || len(w.Entries) != 1 || w.Entries[0].Type != "X509" {
+			t.Fatalf("expected a signed update with the sbctl certificate, got %+v", w)
+		}
+	}
+	if plan.Writes[0].Variable != "db" || plan.Writes[2].Variable != "PK" {
+		t.Fatalf("expected the writes in the enrollment order, got %+v", plan.Writes)
+	}
+
+	cmdOptions.JsonOutput = false
+	logging.PrintOn()
+	out, err := captureOutput(func() error { return printDryRun(dryRunPlan) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(out, []byte("nothing has been written")) || !bytes.Contains(out, []byte("X509")) {
+		t.Fatalf("unexpected dry run output: %s", out)
+	}
+}
+
+func TestDryRunReset(t *testing.T) {
+	state := resetTestState(t)
+	setupDryRun(t, state)
+	before, err := state.Efivarfs.GetPK()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No confirmation is asked for with --dry-run
+	if _, err := resetKeys(state); err != nil {
+		t.Fatalf("failed resetting with --dry-run: %v", err)
+	}
+	after, err := state.Efivarfs.GetPK()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*after) != len(*before) {
+		t.Fatalf("PK was changed with --dry-run")
+	}
+	if len(dryRunPlan.Writes) != 3 || len(dryRunPlan.Writes[2].Entries) != 0 {
+		t.Fatalf("expected three writes emptying the variables, got %+v", dryRunPlan.Writes)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/landlock-lsm/go-landlock/landlock"
+	"github.com/spf13/cobra"
+)
+
+type EnrollDbxCmdOptions struct {
+	FromFile    string
+	Force       bool
+	AppendWrite bool
+	NoTimeBased bool
+}
+
+var (
+	enrollDbxCmdOptions = EnrollDbxCmdOptions{}
+	enrollDbxCmd        = &cobra.Command{
+		Use:   "enroll-dbx",
+		Short: "Append revocations to the forbidden signature database (dbx)",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			state := cmd.Context().Value(stateDataKey{}).(*config.State)
+			if enrollDbxCmdOptions.FromFile == "" {
+				return fmt.Errorf("--from-file needs to be set")
+			}
+			file, err := filepath.Abs(enrollDbxCmdOptions.FromFile)
+			if err != nil {
+				return err
+			}
+			// Append writes have to be authenticated, so dbx is replaced
+			if enrollDbxCmdOptions.NoTimeBased && !cmd.Flags().Changed("append-write") {
+				enrollDbxCmdOptions.AppendWrite = false
+			}
+
+			// Needs to be resolved before landlock as we call lsblk
+			bootloader := ""
+			if esp, err := sbctl.GetESP(state.Fs); err == nil {
+				bootloader, _ = sbctl.GetRunningBootloader(state.Efivarfs, esp)
+			}
+
+			if state.Config.Landlock {
+				lsm.RestrictAdditionalPaths(
+					landlock.ROFiles(file),
+				)
+				if bootloader != "" {
+					lsm.RestrictAdditionalPaths(
+						landlock.ROFiles(bootloader).IgnoreIfMissing(),
+					)
+				}
+				if err := lsm.Restrict(); err != nil {
+					return err
+				}
+			}
+			return RunEnrollDbx(state, file, bootloader)
+		},
+	}
+	ErrRevokesBootloader = errors.New("the revocation list forbids the running bootloader")
+)
+
+// checkBootloaderRevoked warns if dbx forbids the bootloader we are running
+// from. The machine won't boot again if that is the case.
+func checkBootloaderRevoked(state *config.State, efistate *sbctl.EFIVariables, bootloader string) error {
+	if bootloader == "" {
+		logging.Warn("Couldn't determine the running bootloader, it has not been checked against the revocations")
+		return nil
+	}
+	f, err := state.Fs.Open(bootloader)
+	if errors.Is(err, os.ErrNotExist) {
+		logging.Warn("Couldn't find the running bootloader %s, it has not been checked against the revocations", bootloader)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	revoked, err := sbctl.RevokedBy(efistate.Dbx, f)
+	if err != nil {
+		return fmt.Errorf("couldn't check %s against the revocations: %w", bootloader, err)
+	}
+	if len(revoked) == 0 {
+		return nil
+	}
+	logging.Warn("The running bootloader %s is forbidden by the following dbx entries:", bootloader)
+	for _, entry := range revoked {
+		logging.Warn("  %s %s", entry.Type, entry.Value)
+	}
+	logging.Warn("The system will not boot with Secure Boot enabled, update the bootloader first!")
+	if enrollDbxCmdOptions.Force {
+		return nil
+	}
+	return ErrRevokesBootloader
+}
+
+func RunEnrollDbx(state *config.State, file, bootloader string) error {
+	attrs := sbctl.WriteAttributes{
+		AppendWrite: enrollDbxCmdOptions.AppendWrite,
+		NoTimeBased: enrollDbxCmdOptions.NoTimeBased,
+	}
+	setupMode, _ := state.Efivarfs.GetSetupMode()
+	if err := attrs.Validate(efivar.Dbx, setupMode); err != nil {
+		return err
+	}
+
+	update, err := sbctl.ReadDbxUpdate(state.Fs, file)
+	if err != nil {
+		return err
+	}
+
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		return err
+	}
+
+	efistate, err := sbctl.SystemEFIVariables(state.Efivarfs)
+	if err != nil {
+		return fmt.Errorf("couldn't read efivariables: %w", err)
+	}
+
+	// Only the new entries are written with append writes, and the firmware
+	// appends them to its own revocations
+	appended := signature.NewSignatureDatabase()
+	for _, list := range *update {
+		for _, sig := range list.Signatures {
+			if efistate.Dbx.SigDataExists(list.SignatureType, &sig) {
+				continue
+			}
+			if err := appended.Append(list.SignatureType, sig.Owner, sig.Data); err != nil {
+				return err
+			}
+		}
+	}
+
+	// dbx is append-only, we only add entries to the ones already enrolled
+	added, err := sbctl.MergeDbx(efistate.Dbx, update)
+	if err != nil {
+		return err
+	}
+	if len(added) == 0 {
+		logging.Ok("All revocations are already enrolled")
+		return nil
+	}
+
+	if err := checkBootloaderRevoked(state, efistate, bootloader); err != nil {
+		return err
+	}
+
+	efistate.Attributes = attrs
+	if attrs.AppendWrite {
+		efistate.Dbx = appended
+	}
+	logging.Print("Enrolling %d revocations to dbx...", len(added))
+	if err := efistate.EnrollKey(efivar.Dbx, kh); err != nil {
+		logging.NotOk("")
+		return fmt.Errorf("couldn't enroll dbx: %w", err)
+	}
+	logging.Ok("\nEnrolled revocations to dbx!")
+	return nil
+}
+
+func enrollDbxCmdFlags(cmd *cobra.Command) {
+	f := cmd.Flags()
+	f.StringVarP(&enrollDbxCmdOptions.FromFile, "from-file", "", "", "EFI signature list with the revocations to enroll")
+	f.BoolVarP(&enrollDbxCmdOptions.Force, "yes-this-might-brick-my-machine", "", false, "enroll even if the running bootloader is revoked")
+	f.BoolVarP(&enrollDbxCmdOptions.AppendWrite, "append-write", "", true, "only write the new revocations with the append write attribute, so the firmware appends them. Otherwise dbx is replaced with the merged revocations")
+	f.BoolVarP(&enrollDbxCmdOptions.NoTimeBased, "no-time-based", "", false, "write dbx without time based authentication, only accepted in setup mode")
+}
+
+func init() {
+	enrollDbxCmdFlags(enrollDbxCmd)
+	CliCommands = append(CliCommands, cliCommand{
+		Cmd:      enrollDbxCmd,
+		Efivarfs: true,
+		DryRun:   true,
+		Lock:     true,
+		Hooks:    true,
+	})
+}
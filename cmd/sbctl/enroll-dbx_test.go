@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/config"
+	"github.com/spf13/afero"
+)
+
+func writeDbxUpdate(t *testing.T, state *config.State, file string, hashes ...[]byte) {
+	guid, err := state.Config.GetGUID(state.Fs)
+	if err != nil {
+		t.Fatalf("can't read guid: %v", err)
+	}
+	db := signature.NewSignatureDatabase()
+	for _, h := range hashes {
+		if err := db.Append(signature.CERT_SHA256_GUID, *guid, h); err != nil {
+			t.Fatalf("can't append hash: %v", err)
+		}
+	}
+	if err := afero.WriteFile(state.Fs, file, db.Bytes(), 0o644); err != nil {
+		t.Fatalf("can't write dbx update: %v", err)
+	}
+}
+
+func TestEnrollDbx(t *testing.T) {
+	state := setupRotateState(t)
+
+	revoked := sha256.Sum256([]byte("revoked bootloader"))
+	writeDbxUpdate(t, state, "/tmp/dbx.esl", revoked[:])
+
+	if err := RunEnrollDbx(state, "/tmp/dbx.esl", "/boot/test.efi"); err != nil {
+		t.Fatalf("failed enrolling dbx: %v", err)
+	}
+	// Enrolling the same list again should not duplicate the entries
+	if err := RunEnrollDbx(state, "/tmp/dbx.esl", "/boot/test.efi"); err != nil {
+		t.Fatalf("failed enrolling dbx: %v", err)
+	}
+
+	dbx, err := state.Efivarfs.Getdbx()
+	if err != nil {
+		t.Fatalf("can't read dbx: %v", err)
+	}
+	entries := sbctl.ListDbx(dbx)
+	if len(entries) != 1 || entries[0].Type != "SHA256" {
+		t.Fatalf("unexpected dbx entries: %+v", entries)
+	}
+}
+
+func TestEnrollDbxRevokesBootloader(t *testing.T) {
+	state := setupRotateState(t)
+
+	peBinary, err := authenticode.Parse(bytes.NewReader(mustBytes("../../tests/binaries/test.pecoff")))
+	if err != nil {
+		t.Fatalf("can't parse binary: %v", err)
+	}
+	writeDbxUpdate(t, state, "/tmp/dbx.esl", peBinary.Hash(crypto.SHA256))
+
+	if err := RunEnrollDbx(state, "/tmp/dbx.esl", "/boot/test.efi"); !errors.Is(err, ErrRevokesBootloader) {
+		t.Fatalf("expected ErrRevokesBootloader, got %v", err)
+	}
+}
+
+func TestEnrollDbxAttributes(t *testing.T) {
+	state := setupRotateState(t)
+	defer func() { enrollDbxCmdOptions.AppendWrite, enrollDbxCmdOptions.NoTimeBased = true, false }()
+
+	enrolled := sha256.Sum256([]byte("enrolled"))
+	writeDbxUpdate(t, state, "/tmp/dbx.esl", enrolled[:])
+	if err := RunEnrollDbx(state, "/tmp/dbx.esl", "/boot/test.efi"); err != nil {
+		t.Fatalf("failed enrolling dbx: %v", err)
+	}
+
+	added := sha256.Sum256([]byte("added"))
+	writeDbxUpdate(t, state, "/tmp/dbx.esl", enrolled[:], added[:])
+	efivars := state.Efivarfs
+	var plan *sbctl.DryRun
+	state.Efivarfs, plan = sbctl.DryRunEfivarWrites(efivars)
+
+	// By default only the new revocation is written, and appended by the
+	// firmware
+	if err := RunEnrollDbx(state, "/tmp/dbx.esl", "/boot/test.efi"); err != nil {
+		t.Fatalf("failed enrolling dbx: %v", err)
+	}
+	if len(plan.Writes) != 1 || !plan.Writes[0].Append || !plan.Writes[0].Signed || len(plan.Writes[0].Entries) != 1 {
+		t.Fatalf("expected an append write of the new revocation, got %+v", plan.Writes)
+	}
+
+	enrollDbxCmdOptions.NoTimeBased = true
+	if err := RunEnrollDbx(state, "/tmp/dbx.esl", "/boot/test.efi"); !errors.Is(err, sbctl.ErrInvalidAttributes) {
+		t.Fatalf("expected ErrInvalidAttributes, got %v", err)
+	}
+
+	enrollDbxCmdOptions.AppendWrite = false
+	if err := RunEnrollDbx(state, "/tmp/dbx.esl", "/boot/test.efi"); err != nil {
+		t.Fatalf("failed enrolling dbx: %v", err)
+	}
+	if w := plan.Writes[1]; w.Append || w.Signed || len(w.Entries) != 2 {
+		t.Fatalf("expected an unauthenticated write of dbx, got %+v", w)
+	}
+}
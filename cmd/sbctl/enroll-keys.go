@@ -1,8 +1,13 @@
 package main
 
 import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
 	"slices"
 	"strings"
@@ -11,14 +16,15 @@ import (
 	"github.com/foxboron/go-uefi/efivar"
 	"github.com/foxboron/sbctl"
 	"github.com/foxboron/sbctl/backend"
-	"github.com/foxboron/sbctl/certs"
 	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/dmi"
 	"github.com/foxboron/sbctl/fs"
 	"github.com/foxboron/sbctl/logging"
 	"github.com/foxboron/sbctl/lsm"
+	"github.com/foxboron/sbctl/quirks"
 	"github.com/foxboron/sbctl/stringset"
+	"github.com/google/uuid"
 	"github.com/landlock-lsm/go-landlock/landlock"
-	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
 )
 
@@ -43,6 +49,9 @@ func (f *FirmwareBuiltinFlags) Type() string {
 type EnrollKeysCmdOptions struct {
 	Append               bool
 	MicrosoftKeys        bool
+	MicrosoftKEK         bool
+	MicrosoftDb          bool
+	Microsoft2023        bool
 	IgnoreImmutable      bool
 	Force                bool
 	TPMEventlogChecksums bool
@@ -50,11 +59,54 @@ type EnrollKeysCmdOptions struct {
 	CustomBytes          string
 	Partial              stringset.StringSet
 	BuiltinFirmwareCerts FirmwareBuiltinFlags
+	KeepEnrolledCerts    bool
 	Export               stringset.StringSet
+	Token                TokenCmdOptions
+	DbESL                string
+	KEKESL               string
+	PKESL                string
+	DbAuth               string
+	KEKAuth              string
+	PKAuth               string
+	DbURL                string
+	KEKURL               string
+	PKURL                string
+	PKCert               string
+	CACert               string
+	SHA256               map[string]string
+	EnrollmentOrder      string
+	CheckAttributes      bool
+	Progress             bool
+	OwnerGUID            string
+	CustomDbCerts        []string
+	ResetBefore          bool
+	AppendWrite          bool
+	NoTimeBased          bool
+}
+
+// signatureFile is a signature list or signed update passed on the command
+// line for one of the variables. Cert is only used for PK.
+type signatureFile struct {
+	Var  efivar.Efivar
+	ESL  string
+	Auth string
+	URL  string
+	Cert string
+}
+
+func (f signatureFile) flag(kind string) string {
+	return fmt.Sprintf("--%s-%s", strings.ToLower(f.Var.Name), kind)
 }
 
 var (
-	systemEventlog       = "/sys/kernel/security/tpm0/binary_bios_measurements"
+	systemEventlog = "/sys/kernel/security/tpm0/binary_bios_measurements"
+	// Receives the --progress objects with --json
+	enrollProgressOutput io.Writer = os.Stderr
+	enrollTokenKey       *tokenKey
+	// Certificates read from --custom-db-cert
+	enrollDbCerts []*x509.Certificate
+	// Signed updates downloaded from the --*-url flags by variable name
+	enrollRemoteUpdates  = map[string][]byte{}
 	enrollKeysCmdOptions = EnrollKeysCmdOptions{
 		Partial: stringset.StringSet{Allowed: []string{"PK", "KEK", "db"}},
 		Export:  stringset.StringSet{Allowed: []string{"esl", "auth"}},
@@ -64,6 +116,19 @@ var (
 		Short: "Enroll the current keys to EFI",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			state := cmd.Context().Value(stateDataKey{}).(*config.State)
+			var err error
+			enrollTokenKey, err = openToken(state, &enrollKeysCmdOptions.Token)
+			if err != nil {
+				return err
+			}
+			if enrollTokenKey != nil {
+				defer enrollTokenKey.Close()
+			}
+			// Downloads need DNS and the CA certificates, so they are done
+			// before landlock
+			if err := fetchRemoteUpdates(state, enrollSignatureFiles()); err != nil {
+				return err
+			}
 			if state.Config.Landlock {
 				if enrollKeysCmdOptions.Export.Value != "" {
 					wd, err := os.Getwd()
@@ -74,6 +139,20 @@ var (
 						landlock.RWDirs(wd),
 					)
 				}
+				for _, f := range enrollKeysCmdOptions.CustomDbCerts {
+					lsm.RestrictAdditionalPaths(
+						landlock.ROFiles(f),
+					)
+				}
+				for _, f := range enrollSignatureFiles() {
+					for _, file := range []string{f.ESL, f.Auth, f.Cert} {
+						if file != "" {
+							lsm.RestrictAdditionalPaths(
+								landlock.ROFiles(file),
+							)
+						}
+					}
+				}
 				if err := lsm.Restrict(); err != nil {
 					return err
 				}
@@ -81,11 +160,19 @@ var (
 			return RunEnrollKeys(state)
 		},
 	}
-	ErrSetupModeDisabled = errors.New("setup mode is disabled")
+	ErrSetupModeDisabled    = errors.New("setup mode is disabled")
+	ErrResetBeforeConfirm   = errors.New("--reset-before removes the enrolled keys, pass --yes-this-might-brick-my-machine to confirm")
+	ErrResetBeforeArgs      = errors.New("--reset-before can't be combined with --export, --partial, --append, --custom-bytes or signature lists")
+	ErrWriteAttributesArgs  = errors.New("--append-write and --no-time-based can't be combined with --append, --export or --custom-bytes")
+	ErrUnprotectedVariables = errors.New("the firmware doesn't require authenticated writes to the enrolled variables")
+	ErrNoMicrosoft2023Certs = sbctl.ErrNoMicrosoft2023Certs
 )
 
 func SignSiglist(k *backend.KeyHierarchy, e efivar.Efivar, sigdb efivar.Marshallable) ([]byte, error) {
 	signer := k.GetKeyBackend(e)
+	if err := backend.CheckSigningAlgorithm(signer); err != nil {
+		return nil, err
+	}
 	_, em, err := signature.SignEFIVariable(e, sigdb, signer.Signer(), signer.Certificate())
 	if err != nil {
 		return nil, err
@@ -93,106 +180,138 @@ func SignSiglist(k *backend.KeyHierarchy, e efivar.Efivar, sigdb efivar.Marshall
 	return em.Bytes(), nil
 }
 
-// Sync keys from a key directory into efivarfs
-func KeySync(state *config.State, oems []string) error {
-	kh, err := backend.GetKeyHierarchy(state.Fs, state)
-	if err != nil {
-		return err
+// enrollWriteAttributes returns the attributes set with --append-write and
+// --no-time-based
+func enrollWriteAttributes() sbctl.WriteAttributes {
+	return sbctl.WriteAttributes{
+		AppendWrite: enrollKeysCmdOptions.AppendWrite,
+		NoTimeBased: enrollKeysCmdOptions.NoTimeBased,
 	}
+}
 
-	guid, err := state.Config.GetGUID(state.Fs)
-	if err != nil {
-		return err
+// checkWriteAttributes validates the attributes for every variable written
+func checkWriteAttributes(state *config.State, vars []efivar.Efivar) error {
+	attrs := enrollWriteAttributes()
+	if attrs == (sbctl.WriteAttributes{}) {
+		return nil
 	}
-
-	var efistate *sbctl.EFIVariables
-
-	if !enrollKeysCmdOptions.Append {
-		efistate = sbctl.NewEFIVariables(state.Efivarfs)
-	} else {
-		efistate, err = sbctl.SystemEFIVariables(state.Efivarfs)
-		if err != nil {
-			return fmt.Errorf("can't read efivariables: %v", err)
+	setupMode, _ := state.Efivarfs.GetSetupMode()
+	for _, v := range vars {
+		if err := attrs.Validate(v, setupMode); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	if err = efistate.Db.Append(signature.CERT_X509_GUID, *guid, kh.Db.CertificateBytes()); err != nil {
-		return err
-	}
+// vendorMessages are printed for the vendor certificates included by
+// enroll-keys
+var vendorMessages = map[string]string{
+	"tpm-eventlog":      "With checksums from the TPM Eventlog...",
+	"microsoft":         "With vendor keys from microsoft...",
+	"microsoft-kek":     "With the microsoft KEK...",
+	"microsoft-db":      "With the microsoft db certificates...",
+	"microsoft-2023":    "With the microsoft 2023 certificates...",
+	"custom":            "With custom keys...",
+	"firmware-builtin":  "With vendor certificates built into the firmware...",
+	"firmware-enrolled": "With the certificates enrolled in db and KEK...",
+}
 
-	if err = efistate.KEK.Append(signature.CERT_X509_GUID, *guid, kh.KEK.CertificateBytes()); err != nil {
-		return err
-	}
+func newEnroller(state *config.State, kh *backend.KeyHierarchy, oems []string) *sbctl.Enroller {
+	e := sbctl.NewEnroller(state, kh)
+	e.Append = enrollKeysCmdOptions.Append
+	e.Vendors = oems
+	e.FirmwareBuiltin = enrollKeysCmdOptions.BuiltinFirmwareCerts
+	e.DbCerts = enrollDbCerts
+	e.Eventlog = systemEventlog
+	e.Progress = enrollProgress
+	return e
+}
 
-	if err = efistate.PK.Append(signature.CERT_X509_GUID, *guid, kh.PK.CertificateBytes()); err != nil {
-		return err
+// enrollProgress prints the variable about to be written with --progress.
+// With --json the progress is written to stderr instead, one JSON object per
+// line, and --quiet silences it.
+func enrollProgress(p sbctl.EnrollProgress) {
+	if !enrollKeysCmdOptions.Progress || logging.DisableInfo {
+		return
 	}
+	if cmdOptions.JsonOutput {
+		b, err := json.Marshal(p)
+		if err != nil {
+			return
+		}
+		enrollProgressOutput.Write(append(b, '\n'))
+		return
+	}
+	logging.Print("\nWriting %s (%d/%d, %d bytes)...", p.Variable, p.Step, p.Total, p.Size)
+}
 
-	// If we want OEM certs, we do that here
+// ExpectedEFIVariables returns the signature databases enroll-keys would
+// enroll with the given vendor certificates
+func ExpectedEFIVariables(state *config.State, kh *backend.KeyHierarchy, oems []string) (*sbctl.EFIVariables, error) {
 	for _, oem := range oems {
-		switch oem {
-		case "tpm-eventlog":
-			logging.Print("\nWith checksums from the TPM Eventlog...")
-			eventlogDB, err := sbctl.GetEventlogChecksums(state.Fs, systemEventlog)
-			if err != nil {
-				return fmt.Errorf("could not enroll db keys: %w", err)
-			}
-			if len((*eventlogDB)) == 0 {
-				return fmt.Errorf("could not find any OpROM entries in the TPM eventlog")
-			}
-			efistate.Db.AppendDatabase(eventlogDB)
-		case "microsoft":
-			logging.Print("\nWith vendor keys from microsoft...")
-
-			// db
-			oemSigDb, err := certs.GetOEMCerts(oem, "db")
-			if err != nil {
-				return fmt.Errorf("could not enroll db keys: %w", err)
-			}
-			efistate.Db.AppendDatabase(oemSigDb)
+		if msg, ok := vendorMessages[oem]; ok {
+			logging.Print("\n%s", msg)
+		}
+	}
+	return newEnroller(state, kh, oems).Variables()
+}
 
-			// KEK
-			oemSigKEK, err := certs.GetOEMCerts(oem, "KEK")
-			if err != nil {
-				return fmt.Errorf("could not enroll KEK keys: %w", err)
-			}
-			efistate.KEK.AppendDatabase(oemSigKEK)
+var enrollmentVars = map[string]efivar.Efivar{
+	"db":  efivar.Db,
+	"kek": efivar.KEK,
+	"pk":  efivar.PK,
+}
 
-			// We are not enrolling PK keys from Microsoft
-		case "custom":
-			logging.Print("\nWith custom keys...")
+// parseEnrollmentOrder parses a comma separated list naming db, KEK and PK
+// exactly once each
+func parseEnrollmentOrder(order []string) ([]efivar.Efivar, error) {
+	vars := []efivar.Efivar{}
+	seen := map[string]bool{}
+	for _, name := range order {
+		name = strings.ToLower(strings.TrimSpace(name))
+		v, ok := enrollmentVars[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown variable in enrollment order: %q, allowed values are: db, KEK, PK", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("%s is listed twice in the enrollment order", v.Name)
+		}
+		seen[name] = true
+		vars = append(vars, v)
+	}
+	if len(vars) != len(enrollmentVars) {
+		return nil, fmt.Errorf("the enrollment order needs to list db, KEK and PK")
+	}
+	return vars, nil
+}
 
-			// db
-			customSigDb, err := certs.GetCustomCerts(state.Config.Keydir, "db")
-			if err != nil {
-				return fmt.Errorf("could not enroll custom db keys: %w", err)
-			}
-			efistate.Db.AppendDatabase(customSigDb)
+// enrollmentOrder returns the order the variables are written in. The
+// --enrollment-order flag takes precedence over the firmware quirks.
+func enrollmentOrder(state *config.State) ([]efivar.Efivar, error) {
+	if enrollKeysCmdOptions.EnrollmentOrder != "" {
+		return parseEnrollmentOrder(strings.Split(enrollKeysCmdOptions.EnrollmentOrder, ","))
+	}
+	order, vendor := quirks.EnrollmentOrder(dmi.ParseDMI(state))
+	if vendor != "" {
+		logging.Print("\nUsing the enrollment order for %s firmware: %s", vendor, strings.Join(order, ", "))
+	}
+	return parseEnrollmentOrder(order)
+}
 
-			// KEK
-			customSigKEK, err := certs.GetCustomCerts(state.Config.Keydir, "KEK")
-			if err != nil {
-				return fmt.Errorf("could not enroll custom KEK keys: %w", err)
-			}
-			efistate.KEK.AppendDatabase(customSigKEK)
-		case "firmware-builtin":
-			logging.Print("\nWith vendor certificates built into the firmware...")
+// Sync keys from a key directory into efivarfs
+func KeySync(state *config.State, oems []string) error {
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		return err
+	}
+	if err := useToken(kh, enrollTokenKey); err != nil {
+		return err
+	}
 
-			for _, cert := range enrollKeysCmdOptions.BuiltinFirmwareCerts {
-				builtinSigDb, err := certs.GetBuiltinCertificates(cert)
-				if err != nil {
-					return fmt.Errorf("could not enroll built-in firmware keys: %w", err)
-				}
-				switch cert {
-				case "db":
-					efistate.Db.AppendDatabase(builtinSigDb)
-				case "KEK":
-					efistate.KEK.AppendDatabase(builtinSigDb)
-				case "PK":
-					efistate.PK.AppendDatabase(builtinSigDb)
-				}
-			}
-		}
+	efistate, err := ExpectedEFIVariables(state, kh, oems)
+	if err != nil {
+		return err
 	}
 
 	if enrollKeysCmdOptions.Export.Value != "" {
@@ -235,42 +354,74 @@ func KeySync(state *config.State, oems []string) error {
 		return nil
 	}
 
+	efistate.Attributes = enrollWriteAttributes()
+	var vars []efivar.Efivar
 	if enrollKeysCmdOptions.Partial.Value != "" {
 		switch value := enrollKeysCmdOptions.Partial.Value; value {
 		case "db":
-			if err := efistate.EnrollKey(efivar.Db, kh); err != nil {
-				return err
-			}
+			vars = append(vars, efivar.Db)
 		case "KEK":
-			if err := efistate.EnrollKey(efivar.KEK, kh); err != nil {
-				return err
-			}
+			vars = append(vars, efivar.KEK)
 		case "PK":
-			if err := efistate.EnrollKey(efivar.PK, kh); err != nil {
-				return err
-			}
+			vars = append(vars, efivar.PK)
 		default:
 			return fmt.Errorf("unsupported key type to enroll: %s, allowed values are: %s", value, enrollKeysCmdOptions.Partial.Type())
 		}
-
-		return nil
+	} else {
+		vars, err = enrollmentOrder(state)
+		if err != nil {
+			return err
+		}
 	}
-
-	if err := efistate.EnrollAllKeys(kh); err != nil {
+	if err := checkWriteAttributes(state, vars); err != nil {
 		return err
 	}
-
-	return nil
+	return newEnroller(state, kh, oems).EnrollVariables(efistate, vars...)
 }
 
 func RunEnrollKeys(state *config.State) error {
+	if enrollKeysCmdOptions.OwnerGUID != "" {
+		if _, err := uuid.Parse(enrollKeysCmdOptions.OwnerGUID); err != nil {
+			return fmt.Errorf("invalid --owner-guid: %w", err)
+		}
+		state.Config.OwnerGUID = enrollKeysCmdOptions.OwnerGUID
+	}
+	var err error
+	if enrollDbCerts, err = readCustomDbCerts(state, enrollKeysCmdOptions.CustomDbCerts); err != nil {
+		return err
+	}
+	if len(enrollDbCerts) != 0 && (enrollKeysCmdOptions.CustomBytes != "" || len(enrollSignatureFiles()) != 0) {
+		return errors.New("--custom-db-cert can't be combined with --custom-bytes or signature lists")
+	}
+	if enrollKeysCmdOptions.ResetBefore {
+		if enrollKeysCmdOptions.Export.Value != "" || enrollKeysCmdOptions.Partial.Value != "" || enrollKeysCmdOptions.Append ||
+			enrollKeysCmdOptions.CustomBytes != "" || len(enrollSignatureFiles()) != 0 {
+			return ErrResetBeforeArgs
+		}
+		if !enrollKeysCmdOptions.Force {
+			return ErrResetBeforeConfirm
+		}
+	}
+	if (enrollKeysCmdOptions.AppendWrite || enrollKeysCmdOptions.NoTimeBased) &&
+		(enrollKeysCmdOptions.Append || enrollKeysCmdOptions.Export.Value != "" || enrollKeysCmdOptions.CustomBytes != "") {
+		return ErrWriteAttributesArgs
+	}
 	ok, err := state.Efivarfs.GetSetupMode()
 	// EFI variables are missing in some CI / build environments and setup mode is not needed for exporting keys
 	if err != nil && enrollKeysCmdOptions.Export.Value == "" {
+		if errors.Is(err, os.ErrNotExist) {
+			return sbctl.ErrNoEfivarfs
+		}
 		return err
 	}
-	// SetupMode is not necessarily required for a partial enrollment and not needed for exporting keys
-	if !ok && enrollKeysCmdOptions.Partial.Value == "" && enrollKeysCmdOptions.Export.Value == "" {
+	if !ok && enrollKeysCmdOptions.ResetBefore {
+		if ok, err = resetBeforeEnroll(state); err != nil {
+			return err
+		}
+	}
+	// SetupMode is not necessarily required for a partial enrollment and not needed for exporting keys.
+	// Signature lists are signed by the owning key and can be enrolled outside of setup mode.
+	if !ok && enrollKeysCmdOptions.Partial.Value == "" && enrollKeysCmdOptions.Export.Value == "" && len(enrollSignatureFiles()) == 0 {
 		return ErrSetupModeDisabled
 	}
 
@@ -283,7 +434,7 @@ func RunEnrollKeys(state *config.State) error {
 		}
 		logging.Print("Enrolling custom bytes to EFI variables...")
 
-		if err := customKey(state.Fs, enrollKeysCmdOptions.Partial.Value, enrollKeysCmdOptions.CustomBytes); err != nil {
+		if err := customKey(state, enrollKeysCmdOptions.Partial.Value, enrollKeysCmdOptions.CustomBytes); err != nil {
 			logging.NotOk("")
 
 			return fmt.Errorf("couldn't roll out custom bytes from %s for hierarchy %s: %w", enrollKeysCmdOptions.CustomBytes, enrollKeysCmdOptions.Partial, err)
@@ -294,34 +445,24 @@ func RunEnrollKeys(state *config.State) error {
 		return nil
 	}
 
-	oems := []string{}
-	if enrollKeysCmdOptions.MicrosoftKeys {
-		oems = append(oems, "microsoft")
-	}
-	if enrollKeysCmdOptions.TPMEventlogChecksums {
-		oems = append(oems, "tpm-eventlog")
-	}
-	if enrollKeysCmdOptions.Custom {
-		oems = append(oems, "custom")
-	}
-	if len(enrollKeysCmdOptions.BuiltinFirmwareCerts) >= 1 {
-		oems = append(oems, "firmware-builtin")
-	}
+	oems := enrollOEMs(state)
 
-	if len(state.Config.DbAdditions) != 0 {
-		for _, k := range state.Config.DbAdditions {
-			if !slices.Contains(oems, k) {
-				oems = append(oems, k)
-			}
+	if !enrollKeysCmdOptions.IgnoreImmutable && enrollKeysCmdOptions.Export.Value == "" {
+		if err := checkImmutable(state); err != nil {
+			return err
 		}
 	}
 
-	if !enrollKeysCmdOptions.IgnoreImmutable && enrollKeysCmdOptions.Export.Value == "" {
-		if err := sbctl.CheckImmutable(state.Fs); err != nil {
+	if files := enrollSignatureFiles(); len(files) != 0 {
+		if enrollKeysCmdOptions.Export.Value != "" || enrollKeysCmdOptions.Partial.Value != "" {
+			return fmt.Errorf("signature lists can't be enrolled with --export or --partial")
+		}
+		if err := EnrollSignatureFiles(state, files); err != nil {
 			return err
 		}
+		return checkEnrolledAttributes(state)
 	}
-	if !enrollKeysCmdOptions.Force && !enrollKeysCmdOptions.TPMEventlogChecksums && !enrollKeysCmdOptions.MicrosoftKeys && !enrollKeysCmdOptions.Append {
+	if !enrollKeysCmdOptions.Force && !enrollKeysCmdOptions.TPMEventlogChecksums && !includesMicrosoftDb() && !enrollKeysCmdOptions.Append {
 		if err := sbctl.CheckEventlogOprom(state.Fs, systemEventlog); err != nil {
 			return err
 		}
@@ -338,15 +479,351 @@ func RunEnrollKeys(state *config.State) error {
 	}
 	if enrollKeysCmdOptions.Export.Value != "" {
 		logging.Ok("\nExported files!")
+		return nil
+	}
+	logging.Ok("\nEnrolled keys to the EFI variables!")
+	return checkEnrolledAttributes(state)
+}
+
+// resetBeforeEnroll removes the enrolled keys with --reset-before, the way
+// reset does, to put the firmware into Setup Mode before the keys are
+// enrolled. It reports if the firmware is in Setup Mode afterwards.
+func resetBeforeEnroll(state *config.State) (bool, error) {
+	if !enrollKeysCmdOptions.IgnoreImmutable {
+		if err := checkImmutable(state); err != nil {
+			return false, err
+		}
+	}
+	logging.Print("Removing the enrolled keys...\n")
+	for _, ev := range resetOrder {
+		if err := resetDatabase(state, ev); err != nil {
+			return false, fmt.Errorf("could not reset %s, the enrolled keys have to be removed in the firmware setup: %w", ev.Name, err)
+		}
+		logging.Ok("Removed %s!", resetNames[ev.Name])
+	}
+	// The writes are only printed
+	if cmdOptions.DryRun {
+		return true, nil
+	}
+	ok, err := state.Efivarfs.GetSetupMode()
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, fmt.Errorf("the firmware is not in Setup Mode after removing the keys: %w", ErrSetupModeDisabled)
+	}
+	return true, nil
+}
+
+// checkEnrolledAttributes reads back the attributes of the Secure Boot
+// variables with --append-only-dbx-lock, and warns about attributes the
+// firmware stripped. Variables which can be written without a signed update
+// fail the enrollment. Nothing is written to the variables.
+func checkEnrolledAttributes(state *config.State) error {
+	// Nothing has been written with --dry-run
+	if !enrollKeysCmdOptions.CheckAttributes || cmdOptions.DryRun {
+		return nil
+	}
+	logging.Print("\nChecking the attributes of the enrolled variables...\n")
+	results, err := sbctl.ReadVariableAttributes(state.Efivarfs, efivar.PK, efivar.KEK, efivar.Db, efivar.Dbx)
+	if err != nil {
+		return err
+	}
+	var unprotected bool
+	for _, r := range results {
+		switch {
+		case !r.Exists:
+			logging.Unknown("%s is not set", r.Variable)
+			continue
+		case r.Authenticated:
+			logging.Ok("%s requires authenticated writes (%s)", r.Variable, r.Attributes)
+		default:
+			unprotected = true
+			logging.NotOk("%s can be written without a signed update (%s)", r.Variable, r.Attributes)
+		}
+		if len(r.Missing) != 0 {
+			logging.Warn("The firmware stripped %s from %s", strings.Join(r.Missing, ", "), r.Variable)
+		}
+		if r.Variable != efivar.Dbx.Name {
+			continue
+		}
+		if r.AppendWrite {
+			logging.Ok("%s reports append-only writes", r.Variable)
+		} else {
+			logging.Unknown("%s doesn't report append-only writes, most firmware doesn't keep the APPEND_WRITE attribute", r.Variable)
+		}
+	}
+	if unprotected {
+		return ErrUnprotectedVariables
+	}
+	return nil
+}
+
+// enrollSignatureFiles returns the signature files passed with the --*-esl,
+// --*-auth, --*-url and --pk-cert flags. PK comes last as enrolling it ends
+// setup mode.
+func enrollSignatureFiles() []signatureFile {
+	files := []signatureFile{}
+	for _, f := range []signatureFile{
+		{efivar.Db, enrollKeysCmdOptions.DbESL, enrollKeysCmdOptions.DbAuth, enrollKeysCmdOptions.DbURL, ""},
+		{efivar.KEK, enrollKeysCmdOptions.KEKESL, enrollKeysCmdOptions.KEKAuth, enrollKeysCmdOptions.KEKURL, ""},
+		{efivar.PK, enrollKeysCmdOptions.PKESL, enrollKeysCmdOptions.PKAuth, enrollKeysCmdOptions.PKURL, enrollKeysCmdOptions.PKCert},
+	} {
+		if f.ESL != "" || f.Auth != "" || f.URL != "" || f.Cert != "" {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// fetchRemoteUpdates downloads the signed updates passed with the --*-url flags
+// which haven't been downloaded yet. The server is verified against --ca-cert
+// if it is passed, and each download against the --sha256 checksum of its
+// variable.
+func fetchRemoteUpdates(state *config.State, files []signatureFile) error {
+	for name := range enrollKeysCmdOptions.SHA256 {
+		if !slices.ContainsFunc(files, func(f signatureFile) bool { return f.URL != "" && strings.EqualFold(f.Var.Name, name) }) {
+			return fmt.Errorf("--sha256 %s: no --%s-url to check the checksum against", name, strings.ToLower(name))
+		}
+	}
+	var client *http.Client
+	for _, f := range files {
+		if f.URL == "" || enrollRemoteUpdates[f.Var.Name] != nil {
+			continue
+		}
+		if f.ESL != "" || f.Auth != "" || f.Cert != "" {
+			return fmt.Errorf("%s can only be used on its own, not with the other %s flags", f.flag("url"), f.Var.Name)
+		}
+		if client == nil {
+			var ca []byte
+			if enrollKeysCmdOptions.CACert != "" {
+				var err error
+				ca, err = fs.ReadFile(state.Fs, enrollKeysCmdOptions.CACert)
+				if err != nil {
+					return fmt.Errorf("can't read CA certificate: %w", err)
+				}
+			}
+			var err error
+			client, err = sbctl.NewHTTPSClient(ca)
+			if err != nil {
+				return fmt.Errorf("%s: %w", enrollKeysCmdOptions.CACert, err)
+			}
+		}
+		logging.Print("Downloading %s for %s...", f.URL, f.Var.Name)
+		update, err := sbctl.FetchSignedUpdate(client, f.URL, updateChecksum(f.Var))
+		if err != nil {
+			logging.NotOk("")
+			return err
+		}
+		logging.Ok("")
+		enrollRemoteUpdates[f.Var.Name] = update
+	}
+	return nil
+}
+
+// updateChecksum returns the --sha256 checksum passed for the variable
+func updateChecksum(v efivar.Efivar) string {
+	for name, sum := range enrollKeysCmdOptions.SHA256 {
+		if strings.EqualFold(v.Name, name) {
+			return sum
+		}
+	}
+	return ""
+}
+
+// EnrollSignatureFiles enrolls signature lists and signed updates into their
+// variables. Signature lists are signed with the owning key, KEK for db and PK
+// for KEK and PK, while signed updates are written as-is. A PK certificate is
+// enrolled without a signature, which requires setup mode. All files are
+// read, downloaded and validated before anything is written.
+func EnrollSignatureFiles(state *config.State, files []signatureFile) error {
+	if err := fetchRemoteUpdates(state, files); err != nil {
+		return err
+	}
+
+	var err error
+	var efistate *sbctl.EFIVariables
+	if enrollKeysCmdOptions.Append {
+		efistate, err = sbctl.SystemEFIVariables(state.Efivarfs)
+		if err != nil {
+			return fmt.Errorf("can't read efivariables: %v", err)
+		}
 	} else {
-		logging.Ok("\nEnrolled keys to the EFI variables!")
+		efistate = sbctl.NewEFIVariables(state.Efivarfs)
 	}
+	efistate.Attributes = enrollWriteAttributes()
+
+	vars := []efivar.Efivar{}
+	for _, f := range files {
+		// The attributes of signed updates are part of their signature
+		if enrollKeysCmdOptions.NoTimeBased && f.ESL == "" {
+			return fmt.Errorf("%w: signed updates are always time based, --no-time-based only applies to %s", sbctl.ErrInvalidAttributes, f.flag("esl"))
+		}
+		vars = append(vars, f.Var)
+	}
+	if err := checkWriteAttributes(state, vars); err != nil {
+		return err
+	}
+
+	var kh *backend.KeyHierarchy
+	updates := map[string][]byte{}
+	for _, f := range files {
+		if f.ESL != "" && f.Auth != "" {
+			return fmt.Errorf("%s and %s can't be used together", f.flag("esl"), f.flag("auth"))
+		}
+		if f.Cert != "" {
+			if f.ESL != "" || f.Auth != "" {
+				return fmt.Errorf("%s can't be used together with %s or %s", f.flag("cert"), f.flag("esl"), f.flag("auth"))
+			}
+			update, err := setupModePKUpdate(state, f.Cert)
+			if err != nil {
+				return err
+			}
+			updates[f.Var.Name] = update
+			continue
+		}
+		if f.URL != "" {
+			updates[f.Var.Name] = enrollRemoteUpdates[f.Var.Name]
+		}
+		if f.Auth != "" {
+			update, err := sbctl.ReadSignedUpdate(state.Fs, f.Auth)
+			if err != nil {
+				return err
+			}
+			updates[f.Var.Name] = update
+		}
+		if f.URL != "" || f.Auth != "" {
+			if f.Var == efivar.PK {
+				if _, err := sbctl.ValidatePKUpdate(updates[f.Var.Name], f.Auth+f.URL); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		list, err := sbctl.ReadSignatureList(state.Fs, f.ESL)
+		if err != nil {
+			return err
+		}
+		if kh == nil {
+			kh, err = backend.GetKeyHierarchy(state.Fs, state)
+			if err != nil {
+				return err
+			}
+			if err := useToken(kh, enrollTokenKey); err != nil {
+				return err
+			}
+		}
+		sigdb := efistate.GetSiglist(f.Var)
+		if !enrollKeysCmdOptions.Append {
+			*sigdb = signature.SignatureDatabase{}
+		}
+		sigdb.AppendDatabase(list)
+		if f.Var == efivar.Db && !enrollKeysCmdOptions.Append {
+			if err := keepSbctlDbCertificate(state, kh, sigdb); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i, f := range files {
+		size := len(updates[f.Var.Name])
+		if f.ESL != "" {
+			size = len(efistate.GetSiglist(f.Var).Bytes())
+		}
+		enrollProgress(sbctl.EnrollProgress{Variable: f.Var.Name, Step: i + 1, Total: len(files), Size: size})
+		if f.Cert != "" {
+			logging.Print("Enrolling certificate %s to %s...", f.Cert, f.Var.Name)
+			err = efistate.WriteSignedUpdate(f.Var, updates[f.Var.Name], false)
+		} else if f.Auth != "" || f.URL != "" {
+			logging.Print("Enrolling signed update %s to %s...", f.Auth+f.URL, f.Var.Name)
+			err = efistate.WriteSignedUpdate(f.Var, updates[f.Var.Name], enrollKeysCmdOptions.Append || enrollKeysCmdOptions.AppendWrite)
+		} else {
+			logging.Print("Enrolling signature list %s to %s...", f.ESL, f.Var.Name)
+			err = efistate.EnrollKey(f.Var, kh)
+		}
+		if err != nil {
+			logging.NotOk("")
+			return fmt.Errorf("couldn't enroll %s: %w", f.Var.Name, err)
+		}
+		logging.Ok("")
+	}
+	logging.Ok("Enrolled signature lists to the EFI variables!")
 	return nil
 }
 
+// keepSbctlDbCertificate adds the sbctl db certificate to a signature list
+// replacing db, so the files signed by sbctl keep booting
+func keepSbctlDbCertificate(state *config.State, kh *backend.KeyHierarchy, sigdb *signature.SignatureDatabase) error {
+	cert, err := sbctl.DbEnrollCertificate(state, kh)
+	if err != nil {
+		return err
+	}
+	if _, ok := sbctl.CertificateOwner(sigdb, cert); ok {
+		return nil
+	}
+	guid, err := state.Config.GetGUID(state.Fs)
+	if err != nil {
+		return err
+	}
+	logging.Print("Adding the sbctl db certificate to the signature list...\n")
+	return sigdb.Append(signature.CERT_X509_GUID, *guid, cert)
+}
+
+// setupModePKUpdate reads the --pk-cert certificate and returns the unsigned
+// update enrolling it as PK. The private key of the PK doesn't have to be
+// available, only firmware in setup mode accepts the update.
+func setupModePKUpdate(state *config.State, file string) ([]byte, error) {
+	ok, err := state.Efivarfs.GetSetupMode()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("--pk-cert: %w, use --pk-auth with an update signed by the current PK instead", ErrSetupModeDisabled)
+	}
+	b, err := fs.ReadFile(state.Fs, file)
+	if err != nil {
+		return nil, fmt.Errorf("can't read --pk-cert: %w", err)
+	}
+	cert, err := sbctl.ParseCertificate(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	guid, err := state.Config.GetGUID(state.Fs)
+	if err != nil {
+		return nil, fmt.Errorf("can't read the owner GUID, pass --owner-guid: %w", err)
+	}
+	return sbctl.SetupModePKUpdate(cert, *guid)
+}
+
+// readCustomDbCerts reads the certificates given with --custom-db-cert. Each
+// has to be a single PEM or DER encoded X.509 certificate.
+func readCustomDbCerts(state *config.State, files []string) ([]*x509.Certificate, error) {
+	var dbCerts []*x509.Certificate
+	seen := map[string]string{}
+	for _, file := range files {
+		b, err := fs.ReadFile(state.Fs, file)
+		if err != nil {
+			return nil, fmt.Errorf("can't read --custom-db-cert: %w", err)
+		}
+		cert, err := sbctl.ParseCertificate(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		if prev, ok := seen[string(cert.Raw)]; ok {
+			return nil, fmt.Errorf("%s is the same certificate as %s", file, prev)
+		}
+		seen[string(cert.Raw)] = file
+		if _, ok := cert.PublicKey.(*rsa.PublicKey); !ok {
+			logging.Warn("%s is not an RSA certificate, most UEFI firmware only verifies RSA signatures", file)
+		}
+		dbCerts = append(dbCerts, cert)
+	}
+	return dbCerts, nil
+}
+
 // write custom key from a filePath into an efivar
-func customKey(vfs afero.Fs, hierarchy string, filePath string) error {
-	customBytes, err := fs.ReadFile(vfs, filePath)
+func customKey(state *config.State, hierarchy string, filePath string) error {
+	customBytes, err := fs.ReadFile(state.Fs, filePath)
 	if err != nil {
 		return err
 	}
@@ -357,7 +834,7 @@ func customKey(vfs afero.Fs, hierarchy string, filePath string) error {
 	case "KEK":
 		fallthrough
 	case "PK":
-		if err := sbctl.EnrollCustom(customBytes, hierarchy); err != nil {
+		if err := sbctl.EnrollCustom(state.Efivarfs, customBytes, hierarchy); err != nil {
 			return err
 		}
 	default:
@@ -367,14 +844,66 @@ func customKey(vfs afero.Fs, hierarchy string, filePath string) error {
 	return nil
 }
 
+// enrollOEMs returns the vendor certificates selected by the vendor flags and
+// the db_additions configuration
+func enrollOEMs(state *config.State) []string {
+	oems := []string{}
+	if enrollKeysCmdOptions.MicrosoftKeys {
+		oems = append(oems, "microsoft")
+	} else {
+		// --microsoft already includes all of the granular sets
+		if enrollKeysCmdOptions.MicrosoftKEK {
+			oems = append(oems, "microsoft-kek")
+		}
+		if enrollKeysCmdOptions.MicrosoftDb {
+			oems = append(oems, "microsoft-db")
+		}
+		if enrollKeysCmdOptions.Microsoft2023 {
+			oems = append(oems, "microsoft-2023")
+		}
+	}
+	if enrollKeysCmdOptions.TPMEventlogChecksums {
+		oems = append(oems, "tpm-eventlog")
+	}
+	if enrollKeysCmdOptions.Custom {
+		oems = append(oems, "custom")
+	}
+	if len(enrollKeysCmdOptions.BuiltinFirmwareCerts) >= 1 {
+		oems = append(oems, "firmware-builtin")
+	}
+	if enrollKeysCmdOptions.KeepEnrolledCerts {
+		oems = append(oems, "firmware-enrolled")
+	}
+
+	if len(state.Config.DbAdditions) != 0 {
+		for _, k := range state.Config.DbAdditions {
+			if !slices.Contains(oems, k) {
+				oems = append(oems, k)
+			}
+		}
+	}
+	return oems
+}
+
+// includesMicrosoftDb returns true if any of the enrolled microsoft sets
+// contain the db certificates signing option ROMs.
+func includesMicrosoftDb() bool {
+	return enrollKeysCmdOptions.MicrosoftKeys || enrollKeysCmdOptions.MicrosoftDb || enrollKeysCmdOptions.Microsoft2023
+}
+
 func vendorFlags(cmd *cobra.Command) {
 	f := cmd.Flags()
 	f.BoolVarP(&enrollKeysCmdOptions.MicrosoftKeys, "microsoft", "m", false, "include microsoft keys into key enrollment")
+	f.BoolVarP(&enrollKeysCmdOptions.MicrosoftKEK, "microsoft-kek", "", false, "include only the microsoft 2011 KEK into key enrollment")
+	f.BoolVarP(&enrollKeysCmdOptions.MicrosoftDb, "microsoft-db", "", false, "include only the microsoft 2011 db certificates into key enrollment")
+	f.BoolVarP(&enrollKeysCmdOptions.Microsoft2023, "microsoft-2023", "", false, "include only the microsoft 2023 KEK and UEFI CA certificates into key enrollment")
 	f.BoolVarP(&enrollKeysCmdOptions.TPMEventlogChecksums, "tpm-eventlog", "t", false, "include TPM eventlog checksums into the db database")
 	f.BoolVarP(&enrollKeysCmdOptions.Custom, "custom", "c", false, "include custom db and KEK")
+	f.StringArrayVarP(&enrollKeysCmdOptions.CustomDbCerts, "custom-db-cert", "", nil, "include the PEM or DER encoded certificate into db, can be passed multiple times")
 	// f.BoolVarP(&enrollKeysCmdOptions.BuiltinFirmwareCerts, "firmware-builtin", "f", false, "include keys indicated by the firmware as being part of the default database")
 	l := f.VarPF(&enrollKeysCmdOptions.BuiltinFirmwareCerts, "firmware-builtin", "f", "include keys indicated by the firmware as being part of the default database")
 	l.NoOptDefVal = "db,KEK"
+	f.BoolVarP(&enrollKeysCmdOptions.KeepEnrolledCerts, "builtin-firmware-certs", "", false, "keep the certificates currently enrolled in db and KEK, like the ones firmware updates are signed with")
 }
 
 func enrollKeysCmdFlags(cmd *cobra.Command) {
@@ -385,14 +914,38 @@ func enrollKeysCmdFlags(cmd *cobra.Command) {
 	f.BoolVarP(&enrollKeysCmdOptions.IgnoreImmutable, "ignore-immutable", "i", false, "ignore checking for immutable efivarfs files")
 	f.VarPF(&enrollKeysCmdOptions.Export, "export", "", "export the EFI database values to current directory instead of enrolling")
 	f.VarPF(&enrollKeysCmdOptions.Partial, "partial", "p", "enroll a partial set of keys")
+	_ = cmd.RegisterFlagCompletionFunc("partial", completeStringSet(&enrollKeysCmdOptions.Partial))
+	f.BoolVarP(&enrollKeysCmdOptions.CheckAttributes, "append-only-dbx-lock", "", false, "read back the attributes of PK, KEK, db and dbx after enrolling, and fail if writes to them aren't authenticated or dbx rejects an append write")
+	f.BoolVarP(&enrollKeysCmdOptions.Progress, "progress", "", false, "print each variable as it is written, as JSON on stderr with --json")
+	f.StringVarP(&enrollKeysCmdOptions.OwnerGUID, "owner-guid", "", "", "signature owner GUID of the enrolled sbctl certificates. Defaults to owner_guid from the configuration, or the GUID file")
+	f.StringVarP(&enrollKeysCmdOptions.EnrollmentOrder, "enrollment-order", "", "", "order to write the variables in, as a comma separated list of db, KEK and PK")
 	f.StringVarP(&enrollKeysCmdOptions.CustomBytes, "custom-bytes", "", "", "path to the bytefile to be enrolled to efivar")
 	f.BoolVarP(&enrollKeysCmdOptions.Append, "append", "a", false, "append the key to the existing ones")
+	f.BoolVarP(&enrollKeysCmdOptions.AppendWrite, "append-write", "", false, "write the variables with the append write attribute, so the firmware appends the keys to the enrolled ones")
+	f.BoolVarP(&enrollKeysCmdOptions.NoTimeBased, "no-time-based", "", false, "write the signature lists without time based authentication, only accepted in setup mode")
+	f.BoolVarP(&enrollKeysCmdOptions.ResetBefore, "reset-before", "", false, "remove the enrolled keys to enter Setup Mode before enrolling, requires --yes-this-might-brick-my-machine")
+	f.StringVarP(&enrollKeysCmdOptions.DbESL, "db-esl", "", "", "enroll the EFI signature list in the file to db, signed with the KEK")
+	f.StringVarP(&enrollKeysCmdOptions.KEKESL, "kek-esl", "", "", "enroll the EFI signature list in the file to KEK, signed with the PK")
+	f.StringVarP(&enrollKeysCmdOptions.PKESL, "pk-esl", "", "", "enroll the EFI signature list in the file to PK, signed with the PK")
+	f.StringVarP(&enrollKeysCmdOptions.DbAuth, "db-auth", "", "", "write the signed update in the file to db")
+	f.StringVarP(&enrollKeysCmdOptions.KEKAuth, "kek-auth", "", "", "write the signed update in the file to KEK")
+	f.StringVarP(&enrollKeysCmdOptions.PKAuth, "pk-auth", "", "", "write the signed update in the file to PK")
+	f.StringVarP(&enrollKeysCmdOptions.DbURL, "db-url", "", "", "download the signed update over HTTPS and write it to db")
+	f.StringVarP(&enrollKeysCmdOptions.KEKURL, "kek-url", "", "", "download the signed update over HTTPS and write it to KEK")
+	f.StringVarP(&enrollKeysCmdOptions.PKURL, "pk-url", "", "", "download the signed update over HTTPS and write it to PK")
+	f.StringVarP(&enrollKeysCmdOptions.PKCert, "pk-cert", "", "", "enroll the PEM or DER encoded certificate as PK without signing it, requires setup mode")
+	f.StringVarP(&enrollKeysCmdOptions.CACert, "ca-cert", "", "", "only trust servers with a certificate issued by the CA certificates in the PEM file")
+	f.StringToStringVarP(&enrollKeysCmdOptions.SHA256, "sha256", "", nil, "SHA256 checksum the downloaded update of a variable has to match, as VARIABLE=CHECKSUM")
+	tokenFlags(f, &enrollKeysCmdOptions.Token)
 }
 
 func init() {
 	enrollKeysCmdFlags(enrollKeysCmd)
 	vendorFlags(enrollKeysCmd)
 	CliCommands = append(CliCommands, cliCommand{
-		Cmd: enrollKeysCmd,
+		Cmd:    enrollKeysCmd,
+		DryRun: true,
+		Lock:   true,
+		Hooks:  true,
 	})
 }
@@ -0,0 +1,864 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/foxboron/go-uefi/efi/efitest"
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efi/util"
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/foxboron/go-uefi/efivarfs"
+	"github.com/foxboron/go-uefi/efivarfs/testfs"
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/certs"
+	"github.com/foxboron/sbctl/config"
+	"github.com/spf13/afero"
+)
+
+func setupEnrollState(t *testing.T) *config.State {
+	mapfs := fstest.MapFS{
+		systemEventlog: {Data: mustBytes("../../tests/tpm_eventlogs/t480s_eventlog")},
+	}
+
+	conf := config.DefaultConfig()
+	conf.Landlock = false
+
+	state := &config.State{
+		Fs: efitest.FromMapFS(mapfs),
+		Efivarfs: testfs.NewTestFS().
+			With(efitest.SetUpModeOn(),
+				mapfs,
+			).
+			Open(),
+		Config: conf,
+	}
+
+	enrollKeysCmdOptions.IgnoreImmutable = true
+	t.Cleanup(func() {
+		enrollKeysCmdOptions.MicrosoftKEK = false
+		enrollKeysCmdOptions.MicrosoftDb = false
+		enrollKeysCmdOptions.Microsoft2023 = false
+		enrollKeysCmdOptions.Force = false
+	})
+	return state
+}
+
+func TestEnrollMicrosoftKEKOnly(t *testing.T) {
+	state := setupEnrollState(t)
+	enrollKeysCmdOptions.MicrosoftKEK = true
+	enrollKeysCmdOptions.Force = true
+
+	if err := SetupInstallation(state); err != nil {
+		t.Fatalf("failed running SetupInstallation: %v", err)
+	}
+
+	kek, err := state.Efivarfs.GetKEK()
+	if err != nil {
+		t.Fatalf("can't read KEK: %v", err)
+	}
+	if !slices.Contains(certs.DetectVendorCerts(kek), "microsoft") {
+		t.Fatalf("microsoft KEK was not enrolled")
+	}
+
+	db, err := state.Efivarfs.Getdb()
+	if err != nil {
+		t.Fatalf("can't read db: %v", err)
+	}
+	if slices.Contains(certs.DetectVendorCerts(db), "microsoft") {
+		t.Fatalf("microsoft db certificates should not be enrolled")
+	}
+}
+
+func TestEnrollMicrosoftDbOnly(t *testing.T) {
+	state := setupEnrollState(t)
+	enrollKeysCmdOptions.MicrosoftDb = true
+
+	if err := SetupInstallation(state); err != nil {
+		t.Fatalf("failed running SetupInstallation: %v", err)
+	}
+
+	kek, err := state.Efivarfs.GetKEK()
+	if err != nil {
+		t.Fatalf("can't read KEK: %v", err)
+	}
+	if slices.Contains(certs.DetectVendorCerts(kek), "microsoft") {
+		t.Fatalf("microsoft KEK should not be enrolled")
+	}
+
+	db, err := state.Efivarfs.Getdb()
+	if err != nil {
+		t.Fatalf("can't read db: %v", err)
+	}
+	if !slices.Contains(certs.DetectVendorCerts(db), "microsoft") {
+		t.Fatalf("microsoft db certificates were not enrolled")
+	}
+}
+
+func TestEnrollKeepEnrolledCerts(t *testing.T) {
+	state := setupEnrollState(t)
+	enrollKeysCmdOptions.MicrosoftDb = true
+	enrollKeysCmdOptions.Force = true
+	t.Cleanup(func() {
+		enrollKeysCmdOptions.KeepEnrolledCerts = false
+	})
+
+	// The microsoft db certificates stand in for the ones of the firmware
+	if err := SetupInstallation(state); err != nil {
+		t.Fatalf("failed running SetupInstallation: %v", err)
+	}
+	enrollKeysCmdOptions.MicrosoftDb = false
+	enrollKeysCmdOptions.KeepEnrolledCerts = true
+	if err := RunEnrollKeys(state); err != nil {
+		t.Fatalf("failed enrolling keys: %v", err)
+	}
+
+	db, err := state.Efivarfs.Getdb()
+	if err != nil {
+		t.Fatalf("can't read db: %v", err)
+	}
+	if !slices.Contains(certs.DetectVendorCerts(db), "microsoft") {
+		t.Fatalf("the enrolled microsoft db certificates were not kept")
+	}
+	msDb, err := certs.GetOEMCertsGeneration("microsoft", "db", "2011")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want, got int
+	for _, list := range *msDb {
+		want += len(list.Signatures)
+	}
+	// The sbctl db key is enrolled once as well
+	want++
+	for _, list := range *db {
+		got += len(list.Signatures)
+	}
+	if got != want {
+		t.Fatalf("expected %d signatures in db without duplicates, got %d", want, got)
+	}
+}
+
+func TestEnrollMicrosoft2023Missing(t *testing.T) {
+	if kek, _ := certs.GetOEMCertsGeneration("microsoft", "KEK", "2023"); len(*kek) != 0 {
+		t.Skip("microsoft 2023 certificates are bundled")
+	}
+	state := setupEnrollState(t)
+	enrollKeysCmdOptions.Microsoft2023 = true
+
+	if err := SetupInstallation(state); !errors.Is(err, ErrNoMicrosoft2023Certs) {
+		t.Fatalf("expected ErrNoMicrosoft2023Certs, got: %v", err)
+	}
+}
+
+func TestEnrollMicrosoft2023(t *testing.T) {
+	if kek, _ := certs.GetOEMCertsGeneration("microsoft", "KEK", "2023"); len(*kek) == 0 {
+		t.Skip("microsoft 2023 certificates are not bundled")
+	}
+	state := setupEnrollState(t)
+	enrollKeysCmdOptions.Microsoft2023 = true
+
+	if err := SetupInstallation(state); err != nil {
+		t.Fatalf("failed running SetupInstallation: %v", err)
+	}
+
+	kek, err := state.Efivarfs.GetKEK()
+	if err != nil {
+		t.Fatalf("can't read KEK: %v", err)
+	}
+	db, err := state.Efivarfs.Getdb()
+	if err != nil {
+		t.Fatalf("can't read db: %v", err)
+	}
+	cas := append(certs.DetectMicrosoftCAs("KEK", kek), certs.DetectMicrosoftCAs("db", db)...)
+	var names []string
+	for _, ca := range cas {
+		if ca.Generation != "2023" {
+			t.Fatalf("unexpected %s CA %s", ca.Variable, ca.Name)
+		}
+		names = append(names, ca.Name)
+	}
+	for _, name := range []string{"Microsoft Corporation KEK 2K CA 2023", "Windows UEFI CA 2023", "Microsoft UEFI CA 2023"} {
+		if !slices.Contains(names, name) {
+			t.Fatalf("%s was not enrolled, got %v", name, names)
+		}
+	}
+}
+
+func TestEnrollSignatureList(t *testing.T) {
+	state := setupRotateState(t)
+	t.Cleanup(func() {
+		enrollKeysCmdOptions.DbESL = ""
+		enrollKeysCmdOptions.Append = false
+	})
+
+	guid, err := state.Config.GetGUID(state.Fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vendor := sha256.Sum256([]byte("vendor binary"))
+	esl := signature.NewSignatureDatabase()
+	if err := esl.Append(signature.CERT_SHA256_GUID, *guid, vendor[:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(state.Fs, "/tmp/vendor.esl", esl.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(state.Fs, "/tmp/invalid.esl", []byte("not a signature list"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	enrollKeysCmdOptions.DbESL = "/tmp/invalid.esl"
+	if err := EnrollSignatureFiles(state, enrollSignatureFiles()); err == nil {
+		t.Fatal("expected an error for an invalid signature list")
+	}
+
+	enrollKeysCmdOptions.DbESL = "/tmp/vendor.esl"
+	enrollKeysCmdOptions.Append = true
+	if err := EnrollSignatureFiles(state, enrollSignatureFiles()); err != nil {
+		t.Fatalf("failed enrolling signature list: %v", err)
+	}
+
+	db, err := state.Efivarfs.Getdb()
+	if err != nil {
+		t.Fatalf("can't read db: %v", err)
+	}
+	if !db.SigDataExists(signature.CERT_SHA256_GUID, &signature.SignatureData{Owner: *guid, Data: vendor[:]}) {
+		t.Fatal("vendor hash was not enrolled")
+	}
+	if !slices.ContainsFunc(enrolledKeys(db), func(k EnrolledKey) bool { return k.Type == "X509" }) {
+		t.Fatal("existing db certificate was removed when appending")
+	}
+
+	// The list replaces db, the sbctl db certificate is kept
+	enrollKeysCmdOptions.Append = false
+	if err := EnrollSignatureFiles(state, enrollSignatureFiles()); err != nil {
+		t.Fatalf("failed enrolling signature list: %v", err)
+	}
+	if db, err = state.Efivarfs.Getdb(); err != nil {
+		t.Fatalf("can't read db: %v", err)
+	}
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := sbctl.DbEnrollCertificate(state, kh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner, ok := sbctl.CertificateOwner(db, cert); !ok || !util.CmpEFIGUID(owner, *guid) {
+		t.Fatal("the sbctl db certificate was removed when replacing db")
+	}
+	if !db.SigDataExists(signature.CERT_SHA256_GUID, &signature.SignatureData{Owner: *guid, Data: vendor[:]}) || len(*db) != 2 {
+		t.Fatalf("expected db to hold the list and the sbctl db certificate, got %d lists", len(*db))
+	}
+	if list, err := sbctl.VerifyFileEnrolled(state, "/boot/new.efi"); err != nil || list == nil {
+		t.Fatalf("expected the signed file to be allowed by db: %v", err)
+	}
+}
+
+func TestEnrollSignedUpdate(t *testing.T) {
+	state := setupRotateState(t)
+	t.Cleanup(func() {
+		enrollKeysCmdOptions.DbAuth = ""
+	})
+
+	guid, err := state.Config.GetGUID(state.Fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	efistate, err := sbctl.SystemEFIVariables(state.Efivarfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vendor := sha256.Sum256([]byte("vendor binary"))
+	if err := efistate.Db.Append(signature.CERT_SHA256_GUID, *guid, vendor[:]); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := SignSiglist(kh, efivar.Db, efistate.Db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(state.Fs, "/tmp/db.auth", auth, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(state.Fs, "/tmp/db.esl", efistate.Db.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	enrollKeysCmdOptions.DbAuth = "/tmp/db.esl"
+	if err := EnrollSignatureFiles(state, enrollSignatureFiles()); err == nil {
+		t.Fatal("expected an error for an unsigned update")
+	}
+
+	enrollKeysCmdOptions.DbAuth = "/tmp/db.auth"
+	if err := EnrollSignatureFiles(state, enrollSignatureFiles()); err != nil {
+		t.Fatalf("failed enrolling signed update: %v", err)
+	}
+	db, err := state.Efivarfs.Getdb()
+	if err != nil {
+		t.Fatalf("can't read db: %v", err)
+	}
+	if !db.SigDataExists(signature.CERT_SHA256_GUID, &signature.SignatureData{Owner: *guid, Data: vendor[:]}) {
+		t.Fatal("vendor hash was not enrolled")
+	}
+}
+
+func TestEnrollRemoteUpdate(t *testing.T) {
+	state := setupRotateState(t)
+	t.Cleanup(func() {
+		enrollKeysCmdOptions.DbURL = ""
+		enrollKeysCmdOptions.CACert = ""
+		enrollKeysCmdOptions.SHA256 = nil
+		clear(enrollRemoteUpdates)
+	})
+
+	guid, err := state.Config.GetGUID(state.Fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	efistate, err := sbctl.SystemEFIVariables(state.Efivarfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vendor := sha256.Sum256([]byte("vendor binary"))
+	if err := efistate.Db.Append(signature.CERT_SHA256_GUID, *guid, vendor[:]); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := SignSiglist(kh, efivar.Db, efistate.Db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(auth)
+	}))
+	defer srv.Close()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := afero.WriteFile(state.Fs, "/tmp/ca.pem", ca, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	vendorEnrolled := func() bool {
+		db, err := state.Efivarfs.Getdb()
+		if err != nil {
+			t.Fatalf("can't read db: %v", err)
+		}
+		return db.SigDataExists(signature.CERT_SHA256_GUID, &signature.SignatureData{Owner: *guid, Data: vendor[:]})
+	}
+
+	// The test server isn't trusted by the system roots
+	enrollKeysCmdOptions.DbURL = srv.URL + "/db.auth"
+	if err := EnrollSignatureFiles(state, enrollSignatureFiles()); err == nil {
+		t.Fatal("expected a TLS verification error")
+	}
+
+	enrollKeysCmdOptions.CACert = "/tmp/ca.pem"
+	enrollKeysCmdOptions.SHA256 = map[string]string{"db": strings.Repeat("00", sha256.Size)}
+	if err := EnrollSignatureFiles(state, enrollSignatureFiles()); !errors.Is(err, sbctl.ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+	}
+	if vendorEnrolled() {
+		t.Fatal("update was enrolled with a mismatching checksum")
+	}
+
+	// A checksum is only accepted for the update of its own variable
+	sum := sha256.Sum256(auth)
+	enrollKeysCmdOptions.SHA256 = map[string]string{"KEK": hex.EncodeToString(sum[:])}
+	if err := EnrollSignatureFiles(state, enrollSignatureFiles()); err == nil || !strings.Contains(err.Error(), "--kek-url") {
+		t.Fatalf("expected an error for the KEK checksum, got %v", err)
+	}
+
+	enrollKeysCmdOptions.SHA256 = map[string]string{"db": hex.EncodeToString(sum[:])}
+	if err := EnrollSignatureFiles(state, enrollSignatureFiles()); err != nil {
+		t.Fatalf("failed enrolling remote update: %v", err)
+	}
+	if !vendorEnrolled() {
+		t.Fatal("vendor hash was not enrolled")
+	}
+}
+
+func TestParseEnrollmentOrder(t *testing.T) {
+	for _, c := range []struct {
+		order string
+		want  []string
+		err   bool
+	}{
+		{order: "pk,kek,db", want: []string{"PK", "KEK", "db"}},
+		{order: "db, KEK, PK", want: []string{"db", "KEK", "PK"}},
+		{order: "db,kek", err: true},
+		{order: "db,kek,kek", err: true},
+		{order: "db,kek,dbx", err: true},
+	} {
+		vars, err := parseEnrollmentOrder(strings.Split(c.order, ","))
+		if c.err {
+			if err == nil {
+				t.Errorf("%q: expected an error", c.order)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", c.order, err)
+		}
+		names := []string{}
+		for _, v := range vars {
+			names = append(names, v.Name)
+		}
+		if !slices.Equal(names, c.want) {
+			t.Errorf("%q: got %v, want %v", c.order, names, c.want)
+		}
+	}
+}
+
+// writeOrderEFIVars records the variables written to it
+type writeOrderEFIVars struct {
+	efivarfs.EFIVars
+	written []string
+}
+
+func (w *writeOrderEFIVars) WriteVar(v efivar.Efivar, m efivar.Marshallable) error {
+	w.written = append(w.written, v.Name)
+	return w.EFIVars.WriteVar(v, m)
+}
+
+func TestEnrollmentOrderQuirk(t *testing.T) {
+	for _, c := range []struct {
+		vendor string
+		order  string
+		want   []string
+	}{
+		{"", "", []string{"db", "KEK", "PK"}},
+		{"American Megatrends International, LLC.", "", []string{"KEK", "db", "PK"}},
+		{"Insyde Corp.", "", []string{"KEK", "db", "PK"}},
+		{"LENOVO", "", []string{"db", "KEK", "PK"}},
+		// --enrollment-order overrides the firmware quirks
+		{"American Megatrends International, LLC.", "pk,kek,db", []string{"PK", "KEK", "db"}},
+	} {
+		state := setupEnrollState(t)
+		if c.vendor != "" {
+			if err := afero.WriteFile(state.Fs, "/sys/devices/virtual/dmi/id/bios_vendor", []byte(c.vendor+"\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		enrollKeysCmdOptions.EnrollmentOrder = c.order
+		t.Cleanup(func() { enrollKeysCmdOptions.EnrollmentOrder = "" })
+		writes := &writeOrderEFIVars{EFIVars: state.Efivarfs.EFIVars}
+		state.Efivarfs = efivarfs.Open(writes)
+
+		if err := SetupInstallation(state); err != nil {
+			t.Fatalf("%q: failed running SetupInstallation: %v", c.vendor, err)
+		}
+		if !slices.Equal(writes.written, c.want) {
+			t.Fatalf("%q %q: expected the variables written in the order %v, got %v", c.vendor, c.order, c.want, writes.written)
+		}
+	}
+}
+
+func TestEnrollProgress(t *testing.T) {
+	state := setupEnrollState(t)
+	var out bytes.Buffer
+	enrollKeysCmdOptions.Progress = true
+	enrollKeysCmdOptions.Force = true
+	cmdOptions.JsonOutput = true
+	enrollProgressOutput = &out
+	t.Cleanup(func() {
+		enrollKeysCmdOptions.Progress = false
+		cmdOptions.JsonOutput = false
+		enrollProgressOutput = os.Stderr
+	})
+
+	if err := SetupInstallation(state); err != nil {
+		t.Fatalf("failed running SetupInstallation: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected a progress object per variable, got:\n%s", out.String())
+	}
+	for i, line := range lines {
+		var p sbctl.EnrollProgress
+		if err := json.Unmarshal([]byte(line), &p); err != nil {
+			t.Fatalf("invalid json line %q: %v", line, err)
+		}
+		if p.Variable != []string{"db", "KEK", "PK"}[i] || p.Step != i+1 || p.Total != 3 || p.Size == 0 {
+			t.Fatalf("unexpected progress %+v", p)
+		}
+	}
+}
+
+func TestEnrollOwnerGUID(t *testing.T) {
+	state := setupEnrollState(t)
+	owner := "8e6b5f3b-0c3d-4d0f-9b8e-2a4b3c1d5e6f"
+	enrollKeysCmdOptions.OwnerGUID = owner
+	t.Cleanup(func() { enrollKeysCmdOptions.OwnerGUID = "" })
+
+	if err := SetupInstallation(state); err != nil {
+		t.Fatalf("failed running SetupInstallation: %v", err)
+	}
+	keys, err := ListEnrolledKeys(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range append(append(keys.PK, keys.KEK...), keys.Db...) {
+		if k.Label == keyLabelSbctl && k.Owner != owner {
+			t.Fatalf("expected the owner %s, got %+v", owner, k)
+		}
+	}
+	if installed, err := EnrolledSbctlKeys(state); err != nil || !installed.PK || !installed.KEK || !installed.Db {
+		t.Fatalf("expected the keys to be enrolled with the owner: %+v %v", installed, err)
+	}
+
+	// The keys are found without the override, by their certificates
+	enrollKeysCmdOptions.OwnerGUID = ""
+	state.Config.OwnerGUID = ""
+	if installed, err := EnrolledSbctlKeys(state); err != nil || !installed.PK || !installed.KEK || !installed.Db {
+		t.Fatalf("expected the keys to be enrolled without the override: %+v %v", installed, err)
+	}
+
+	enrollKeysCmdOptions.OwnerGUID = "not-a-guid"
+	if err := RunEnrollKeys(state); err == nil {
+		t.Fatalf("expected an invalid GUID to fail")
+	}
+}
+
+func TestEnrollCustomDbCert(t *testing.T) {
+	state := setupEnrollState(t)
+	t.Cleanup(func() {
+		enrollKeysCmdOptions.CustomDbCerts = nil
+		enrollDbCerts = nil
+	})
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Partner db"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(state.Fs, "/tmp/partner.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(state.Fs, "/tmp/invalid.pem", []byte("not a certificate"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	enrollKeysCmdOptions.CustomDbCerts = []string{"/tmp/invalid.pem"}
+	if err := RunEnrollKeys(state); !errors.Is(err, sbctl.ErrInvalidCertificate) {
+		t.Fatalf("expected ErrInvalidCertificate, got %v", err)
+	}
+	enrollKeysCmdOptions.CustomDbCerts = []string{"/tmp/partner.pem", "/tmp/partner.pem"}
+	if err := RunEnrollKeys(state); err == nil {
+		t.Fatalf("expected the same certificate passed twice to fail")
+	}
+	if _, err := state.Efivarfs.Getdb(); err == nil {
+		t.Fatalf("expected nothing to be enrolled after an invalid certificate")
+	}
+
+	enrollKeysCmdOptions.CustomDbCerts = []string{"/tmp/partner.pem"}
+	if err := SetupInstallation(state); err != nil {
+		t.Fatalf("failed running SetupInstallation: %v", err)
+	}
+	db, err := state.Efivarfs.Getdb()
+	if err != nil {
+		t.Fatalf("can't read db: %v", err)
+	}
+	var found bool
+	for _, list := range *db {
+		for _, sig := range list.Signatures {
+			if bytes.Equal(sig.Data, der) {
+				found = true
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("the partner certificate was not enrolled into db")
+	}
+	if slices.Contains(certs.DetectVendorCerts(db), "microsoft") {
+		t.Fatalf("microsoft db certificates should not be enrolled")
+	}
+	if installed, err := EnrolledSbctlKeys(state); err != nil || !installed.Db {
+		t.Fatalf("expected the sbctl db key to be enrolled next to the partner certificate: %+v %v", installed, err)
+	}
+}
+
+func TestEnrollPKSignedUpdate(t *testing.T) {
+	state := setupRotateState(t)
+	t.Cleanup(func() {
+		enrollKeysCmdOptions.PKAuth = ""
+	})
+
+	guid, err := state.Config.GetGUID(state.Fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk := signature.NewSignatureDatabase()
+	if err := pk.Append(signature.CERT_X509_GUID, *guid, kh.PK.Certificate().Raw); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := SignSiglist(kh, efivar.PK, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the signature has to be PKCS7
+	unsupported := bytes.Clone(auth)
+	copy(unsupported[24:40], signature.EFI_CERT_TYPE_RSA2048_SHA256_GUID.Bytes())
+	if err := pk.Append(signature.CERT_X509_GUID, *guid, kh.KEK.Certificate().Raw); err != nil {
+		t.Fatal(err)
+	}
+	twoCerts, err := SignSiglist(kh, efivar.PK, pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file, b := range map[string][]byte{
+		"/tmp/PK.auth":          auth,
+		"/tmp/unsupported.auth": unsupported,
+		"/tmp/two.auth":         twoCerts,
+	} {
+		if err := afero.WriteFile(state.Fs, file, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, file := range []string{"/tmp/unsupported.auth", "/tmp/two.auth"} {
+		enrollKeysCmdOptions.PKAuth = file
+		if err := EnrollSignatureFiles(state, enrollSignatureFiles()); err == nil {
+			t.Fatalf("expected an error enrolling %s", file)
+		}
+	}
+	enrollKeysCmdOptions.PKAuth = "/tmp/PK.auth"
+	if err := EnrollSignatureFiles(state, enrollSignatureFiles()); err != nil {
+		t.Fatalf("failed enrolling the PK update: %v", err)
+	}
+}
+
+func TestEnrollPKCert(t *testing.T) {
+	state := setupEnrollState(t)
+	state.Config.OwnerGUID = "8e6b5f3b-0c3d-4d0f-9b8e-2a4b3c1d5e6f"
+	t.Cleanup(func() {
+		enrollKeysCmdOptions.PKCert = ""
+		enrollKeysCmdOptions.PKESL = ""
+	})
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Central PK"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(state.Fs, "/tmp/PK.der", der, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	enrollKeysCmdOptions.PKCert = "/tmp/PK.der"
+	enrollKeysCmdOptions.PKESL = "/tmp/PK.esl"
+	if err := RunEnrollKeys(state); err == nil {
+		t.Fatal("expected --pk-cert together with --pk-esl to fail")
+	}
+	enrollKeysCmdOptions.PKESL = ""
+	if err := RunEnrollKeys(state); err != nil {
+		t.Fatalf("failed enrolling the PK certificate: %v", err)
+	}
+	pk, err := state.Efivarfs.GetPK()
+	if err != nil {
+		t.Fatalf("can't read PK: %v", err)
+	}
+	if !pk.SigDataExists(signature.CERT_X509_GUID, &signature.SignatureData{Owner: *util.StringToGUID(state.Config.OwnerGUID), Data: der}) {
+		t.Fatal("the PK certificate was not enrolled")
+	}
+
+	// efitest.SetUpModeOff() enables setup mode as well
+	state.Efivarfs = testfs.NewTestFS().With(fstest.MapFS{
+		"/sys/firmware/efi/efivars/SetupMode-8be4df61-93ca-11d2-aa0d-00e098032b8c": {Data: []byte{0x6, 0x0, 0x0, 0x0, 0x0}},
+	}).Open()
+	if err := RunEnrollKeys(state); !errors.Is(err, ErrSetupModeDisabled) {
+		t.Fatalf("expected ErrSetupModeDisabled outside of setup mode, got %v", err)
+	}
+}
+
+func TestEnrollResetBefore(t *testing.T) {
+	state := setupRotateState(t)
+	t.Cleanup(func() {
+		enrollKeysCmdOptions.ResetBefore = false
+		enrollKeysCmdOptions.Force = false
+	})
+
+	enrollKeysCmdOptions.ResetBefore = true
+	if err := RunEnrollKeys(state); !errors.Is(err, ErrResetBeforeConfirm) {
+		t.Fatalf("expected ErrResetBeforeConfirm, got %v", err)
+	}
+	enrollKeysCmdOptions.Force = true
+	enrollKeysCmdOptions.Append = true
+	if err := RunEnrollKeys(state); !errors.Is(err, ErrResetBeforeArgs) {
+		t.Fatalf("expected ErrResetBeforeArgs, got %v", err)
+	}
+	enrollKeysCmdOptions.Append = false
+
+	// Nothing is reset in setup mode
+	if err := RunEnrollKeys(state); err != nil {
+		t.Fatalf("failed enrolling in setup mode: %v", err)
+	}
+
+	// The test efivarfs doesn't enter setup mode when PK is removed
+	state.Efivarfs = testfs.NewTestFS().With(fstest.MapFS{
+		"/sys/firmware/efi/efivars/SetupMode-8be4df61-93ca-11d2-aa0d-00e098032b8c": {Data: []byte{0x6, 0x0, 0x0, 0x0, 0x0}},
+	}).Open()
+	out, err := captureOutput(func() error {
+		return RunEnrollKeys(state)
+	})
+	if !errors.Is(err, ErrSetupModeDisabled) {
+		t.Fatalf("expected ErrSetupModeDisabled after the reset, got %v", err)
+	}
+	if !strings.Contains(string(out), "Removed Platform Key") {
+		t.Fatalf("expected the keys to be removed first, got %q", out)
+	}
+}
+
+func TestEnrollAppendWrite(t *testing.T) {
+	state := setupRotateState(t)
+	t.Cleanup(func() {
+		enrollKeysCmdOptions.AppendWrite = false
+		enrollKeysCmdOptions.Append = false
+		enrollKeysCmdOptions.Partial.Value = ""
+	})
+	efivars := state.Efivarfs
+	var plan *sbctl.DryRun
+	state.Efivarfs, plan = sbctl.DryRunEfivarWrites(efivars)
+
+	// PK holds a single certificate and can't be appended to
+	enrollKeysCmdOptions.AppendWrite = true
+	if err := KeySync(state, []string{}); !errors.Is(err, sbctl.ErrInvalidAttributes) {
+		t.Fatalf("expected ErrInvalidAttributes, got %v", err)
+	}
+
+	enrollKeysCmdOptions.Append = true
+	if err := RunEnrollKeys(state); !errors.Is(err, ErrWriteAttributesArgs) {
+		t.Fatalf("expected ErrWriteAttributesArgs, got %v", err)
+	}
+	enrollKeysCmdOptions.Append = false
+
+	if err := enrollKeysCmdOptions.Partial.Set("db"); err != nil {
+		t.Fatal(err)
+	}
+	if err := KeySync(state, []string{}); err != nil {
+		t.Fatalf("failed enrolling db: %v", err)
+	}
+	if len(plan.Writes) != 1 || plan.Writes[0].Variable != "db" || !plan.Writes[0].Append || !plan.Writes[0].Signed {
+		t.Fatalf("expected an append write of db, got %+v", plan.Writes)
+	}
+}
+
+// readOnlyEFIVars fails every write
+type readOnlyEFIVars struct {
+	efivarfs.EFIVars
+	writes int
+}
+
+func (r *readOnlyEFIVars) WriteVar(v efivar.Efivar, m efivar.Marshallable) error {
+	r.writes++
+	return &os.PathError{Op: "write", Path: v.Name, Err: syscall.EPERM}
+}
+
+func TestEnrollCheckAttributesReadOnly(t *testing.T) {
+	state := setupRotateState(t)
+	enrollKeysCmdOptions.CheckAttributes = true
+	t.Cleanup(func() { enrollKeysCmdOptions.CheckAttributes = false })
+
+	revoked := sha256.Sum256([]byte("revoked"))
+	writeDbxUpdate(t, state, "/tmp/dbx.esl", revoked[:])
+	if err := RunEnrollDbx(state, "/tmp/dbx.esl", ""); err != nil {
+		t.Fatalf("failed enrolling dbx: %v", err)
+	}
+
+	// The check only reads the variables
+	readOnly := &readOnlyEFIVars{EFIVars: state.Efivarfs.EFIVars}
+	state.Efivarfs = efivarfs.Open(readOnly)
+	out, err := captureOutput(func() error {
+		return checkEnrolledAttributes(state)
+	})
+	if err != nil {
+		t.Fatalf("failed checking the attributes: %v", err)
+	}
+	if readOnly.writes != 0 {
+		t.Fatalf("expected no writes, got %d", readOnly.writes)
+	}
+	// The test efivarfs keeps the APPEND_WRITE attribute of the dbx update
+	if !strings.Contains(string(out), "dbx reports append-only writes") {
+		t.Fatalf("expected the append-only writes of dbx to be reported, got %q", out)
+	}
+}
+
+func TestEnrollKeysHooks(t *testing.T) {
+	state := setupEnrollState(t)
+	if err := RunCreateKeys(state); err != nil {
+		t.Fatal(err)
+	}
+	log := t.TempDir() + "/hooks.log"
+	state.Config.Hooks = &config.HooksConfig{
+		PreEnroll:  []string{`echo "$SBCTL_HOOK" >> ` + log},
+		PostEnroll: []string{`echo "$SBCTL_HOOK $SBCTL_VARIABLES $SBCTL_RESULT" >> ` + log},
+	}
+	var hooks *sbctl.EnrollHooks
+	state.Efivarfs, hooks = sbctl.HookEfivarWrites(state.Efivarfs, state.Config)
+	enrollKeysCmdOptions.Force = true
+
+	err := RunEnrollKeys(state)
+	hooks.Finish(err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "pre_enroll\npost_enroll db KEK PK ok\n" {
+		t.Fatalf("expected the hooks to run once for the enrollment, got %q", b)
+	}
+
+	// Landlock is only disabled for the commands running the hooks
+	if !runsHooks(enrollKeysCmd) || !runsHooks(signCmd) || !runsHooks(mokEnrollCmd) || runsHooks(statusCmd) || runsHooks(mokListCmd) {
+		t.Fatalf("unexpected commands running the hooks")
+	}
+}
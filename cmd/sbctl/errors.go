@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/backend"
+)
+
+// ErrorOutput is printed instead of the error message when a command fails
+// with --json or --yaml
+type ErrorOutput struct {
+	Error ErrorMessage `json:"error"`
+	// Code is stable for the sentinel errors, see errorCodes
+	Code string `json:"code"`
+}
+
+type ErrorMessage struct {
+	Message string `json:"message"`
+	// How to fix the error, as printed without --json
+	Help string `json:"help,omitempty"`
+}
+
+// errorCodes are the codes of the structured error output. The codes shared
+// with doctor are the same as its problem IDs.
+var errorCodes = []struct {
+	Err  error
+	Code string
+	Help string
+}{
+	{os.ErrPermission, "not_root", "sbctl requires root to run"},
+	{sbctl.ErrNoEfivarfs, "no_efivarfs", ""},
+	{sbctl.ErrImmutable, "immutable_efivars", immutableErrorMsg},
+	{sbctl.ErrOprom, "oprom", opromErrorMsg},
+	{sbctl.ErrNoEventlog, "no_eventlog", noEventlogErrorMsg},
+	{ErrSetupModeDisabled, "setup_mode_disabled", setupModeDisabled},
+	{ErrUnprotectedVariables, "unprotected_variables", ""},
+	{ErrRevokesBootloader, "revokes_bootloader", ""},
+	{backend.ErrPCRsChanged, "pcrs_changed", pcrsChangedMsg},
+	{backend.ErrNoTPM, "no_tpm", ""},
+	{ErrTPMTimeout, "tpm_timeout", ""},
+	{sbctl.ErrWrongPassphrase, "wrong_passphrase", ""},
+	{sbctl.ErrChecksumMismatch, "checksum_mismatch", ""},
+	{sbctl.ErrInvalidCertificate, "invalid_certificate", ""},
+	{sbctl.ErrUnwritableFiles, "unwritable_files", ""},
+	{ErrNoExplicitConfig, "no_config", ""},
+	{ErrUnknownConfigKey, "unknown_config_key", ""},
+	{os.ErrNotExist, "not_found", ""},
+}
+
+// usageError is a flag error, whose usage is printed already
+type usageError struct {
+	err error
+}
+
+func (e *usageError) Error() string        { return e.err.Error() }
+func (e *usageError) Unwrap() error        { return e.err }
+func (e *usageError) Is(target error) bool { return target == ErrSilent }
+
+// newErrorOutput returns the structured error output for err
+func newErrorOutput(err error) *ErrorOutput {
+	out := &ErrorOutput{
+		Error: ErrorMessage{Message: err.Error()},
+		Code:  "error",
+	}
+	var usageErr *usageError
+	switch {
+	case errors.As(err, &usageErr):
+		out.Code = "usage"
+		return out
+	case strings.HasPrefix(err.Error(), "unknown command"):
+		out.Code = "unknown_command"
+		return out
+	case errors.Is(err, ErrSilent):
+		// The errors have been logged already
+		out.Error.Message = "the command failed"
+		out.Code = "failed"
+		return out
+	}
+	for _, c := range errorCodes {
+		if errors.Is(err, c.Err) {
+			out.Code = c.Code
+			out.Error.Help = c.Help
+			break
+		}
+	}
+	return out
+}
+
+// exitStructuredError prints the structured error output for err, unless it
+// is an ExitCodeError without an error, and exits
+func exitStructuredError(err error) {
+	code := 1
+	var exitErr *ExitCodeError
+	if errors.As(err, &exitErr) {
+		code = exitErr.Code
+		err = exitErr.Err
+	}
+	if err != nil {
+		_ = StructuredOut(newErrorOutput(err))
+	}
+	os.Exit(code)
+}
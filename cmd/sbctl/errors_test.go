@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/foxboron/sbctl"
+)
+
+func TestErrorOutput(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		code string
+		help bool
+	}{
+		{fmt.Errorf("couldn't enroll: %w", ErrSetupModeDisabled), "setup_mode_disabled", true},
+		{fmt.Errorf("enrolling: %w", sbctl.ErrOprom), "oprom", true},
+		{&ExitCodeError{Code: 2, Err: sbctl.ErrNoEfivarfs}, "no_efivarfs", false},
+		{&os.PathError{Op: "open", Path: "/sys/firmware/efi/efivars/PK", Err: os.ErrPermission}, "not_root", true},
+		{&usageError{errors.New("unknown flag: --foo")}, "usage", false},
+		{errors.New(`unknown command "foo" for "sbctl"`), "unknown_command", false},
+		{ErrSilent, "failed", false},
+		{errors.New("something else"), "error", false},
+	} {
+		out := newErrorOutput(c.err)
+		if out.Code != c.code {
+			t.Fatalf("%v: expected code %s, got %s", c.err, c.code, out.Code)
+		}
+		if (out.Error.Help != "") != c.help {
+			t.Fatalf("%v: unexpected help %q", c.err, out.Error.Help)
+		}
+		if out.Error.Message == "" {
+			t.Fatalf("%v: no message", c.err)
+		}
+	}
+	if msg := newErrorOutput(&usageError{errors.New("unknown flag: --foo")}).Error.Message; msg != "unknown flag: --foo" {
+		t.Fatalf("unexpected usage message %q", msg)
+	}
+}
@@ -91,7 +91,8 @@ func init() {
 	exportEnrolledKeysCmd.Flags().StringVar(&format, "format", "der", "the export format. One of \"der\", \"esl\"")
 
 	CliCommands = append(CliCommands, cliCommand{
-		Cmd: exportEnrolledKeysCmd,
+		Cmd:      exportEnrolledKeysCmd,
+		Efivarfs: true,
 	})
 }
 
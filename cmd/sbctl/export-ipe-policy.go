@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/foxboron/sbctl/stringset"
+	"github.com/landlock-lsm/go-landlock/landlock"
+	"github.com/spf13/cobra"
+)
+
+type ExportIPEPolicyCmdOptions struct {
+	Output  string
+	Name    string
+	Version string
+	Op      stringset.StringSet
+}
+
+var (
+	exportIPEPolicyCmdOptions = ExportIPEPolicyCmdOptions{
+		Op: stringset.StringSet{
+			Allowed:    sbctl.IPEOperations,
+			Value:      sbctl.IPEPolicyOperation,
+			IgnoreCase: true,
+		},
+	}
+	exportIPEPolicyCmd = &cobra.Command{
+		Use:   "export-ipe-policy",
+		Short: "Export an IPE policy allowing the tracked files",
+		Long: `Export an IPE policy allowing the tracked files.
+
+The policy allows the operation only for the files in the file database, by
+their fs-verity digest, and leaves the other operations allowed. IPE only
+matches files with fs-verity enabled, which needs a filesystem supporting it,
+so it doesn't apply to files on a FAT formatted ESP.
+
+Set ipe_policy in the configuration to regenerate the policy whenever files
+are signed.`,
+		Args: cobra.NoArgs,
+		RunE: RunExportIPEPolicy,
+	}
+)
+
+func RunExportIPEPolicy(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+
+	var output string
+	if exportIPEPolicyCmdOptions.Output != "" {
+		var err error
+		if output, err = filepath.Abs(exportIPEPolicyCmdOptions.Output); err != nil {
+			return err
+		}
+	}
+
+	if state.Config.Landlock {
+		if err := sbctl.LandlockFromFileDatabase(state); err != nil {
+			return err
+		}
+		if output != "" {
+			lsm.RestrictAdditionalPaths(landlock.RWDirs(filepath.Dir(output)))
+		}
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+
+	// The version of the policy being replaced is bumped, as IPE refuses
+	// updates with a lower version
+	version := exportIPEPolicyCmdOptions.Version
+	if version == "" {
+		var old []byte
+		if output != "" {
+			var err error
+			old, err = fs.ReadFile(state.Fs, output)
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		version = sbctl.NextIPEPolicyVersion(old)
+	}
+
+	policy, err := sbctl.IPEPolicy(state, exportIPEPolicyCmdOptions.Name, version, exportIPEPolicyCmdOptions.Op.Value)
+	if err != nil {
+		return err
+	}
+	if output == "" {
+		fmt.Print(string(policy))
+		return nil
+	}
+	if err := fs.WriteFile(state.Fs, output, policy, 0o644); err != nil {
+		return err
+	}
+	logging.Ok("Wrote the IPE policy to %s", output)
+	return nil
+}
+
+func exportIPEPolicyCmdFlags(cmd *cobra.Command) {
+	f := cmd.Flags()
+	f.StringVarP(&exportIPEPolicyCmdOptions.Output, "output", "o", "", "write the policy to a file instead of stdout")
+	f.StringVarP(&exportIPEPolicyCmdOptions.Name, "name", "", sbctl.IPEPolicyName, "policy_name of the policy")
+	f.StringVarP(&exportIPEPolicyCmdOptions.Version, "policy-version", "", "", "policy_version of the policy (default: the version of the policy in --output bumped, or 0.0.1)")
+	f.VarPF(&exportIPEPolicyCmdOptions.Op, "op", "", "IPE operation the tracked files are allowed for")
+	_ = cmd.RegisterFlagCompletionFunc("op", completeStringSet(&exportIPEPolicyCmdOptions.Op))
+}
+
+func init() {
+	exportIPEPolicyCmdFlags(exportIPEPolicyCmd)
+	CliCommands = append(CliCommands, cliCommand{
+		Cmd: exportIPEPolicyCmd,
+	})
+}
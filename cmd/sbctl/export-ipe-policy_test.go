@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/spf13/cobra"
+)
+
+func TestExportIPEPolicy(t *testing.T) {
+	state := setupRotateState(t)
+	state.Config.IPEPolicy = "/etc/ipe/sbctl.pol"
+	if err := state.Fs.MkdirAll("/etc/ipe", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Signing regenerates the configured policy
+	if _, err := SignAllFiles(state, 1, false); err != nil {
+		t.Fatal(err)
+	}
+	f, err := state.Fs.Open("/boot/new.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := sbctl.FsverityDigest(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := "op=KEXEC_IMAGE fsverity_digest=sha256:" + hex.EncodeToString(digest) + " action=ALLOW\n"
+	b, err := fs.ReadFile(state.Fs, state.Config.IPEPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), "policy_name=sbctl policy_version=0.0.1\n") || !strings.Contains(string(b), rule) {
+		t.Fatalf("unexpected policy:\n%s", b)
+	}
+
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.WithValue(context.Background(), stateDataKey{}, state))
+	exportIPEPolicyCmdOptions.Output = state.Config.IPEPolicy
+	if err := exportIPEPolicyCmdOptions.Op.Set("kexec_initramfs"); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		exportIPEPolicyCmdOptions.Output = ""
+		exportIPEPolicyCmdOptions.Op.Value = sbctl.IPEPolicyOperation
+	}()
+	if err := RunExportIPEPolicy(cmd, nil); err != nil {
+		t.Fatal(err)
+	}
+	b, err = fs.ReadFile(state.Fs, state.Config.IPEPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), "policy_name=sbctl policy_version=0.0.2\n") ||
+		!strings.Contains(string(b), "DEFAULT op=KEXEC_INITRAMFS action=DENY\n") ||
+		!strings.Contains(string(b), strings.Replace(rule, "KEXEC_IMAGE", "KEXEC_INITRAMFS", 1)) {
+		t.Fatalf("unexpected policy:\n%s", b)
+	}
+}
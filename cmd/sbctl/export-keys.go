@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/landlock-lsm/go-landlock/landlock"
+	"github.com/spf13/cobra"
+)
+
+type ExportKeysCmdOptions struct {
+	Output         string
+	PassphraseFile string
+}
+
+var (
+	exportKeysCmdOptions = ExportKeysCmdOptions{}
+	exportKeysCmd        = &cobra.Command{
+		Use:   "export-keys",
+		Short: "Export the secure boot keys into an encrypted archive",
+		RunE:  RunExportKeys,
+	}
+)
+
+func RunExportKeys(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+
+	if exportKeysCmdOptions.Output == "" {
+		return fmt.Errorf("--output needs to be set")
+	}
+	output, err := filepath.Abs(exportKeysCmdOptions.Output)
+	if err != nil {
+		return err
+	}
+
+	if state.Config.Landlock {
+		lsm.RestrictAdditionalPaths(
+			landlock.RWDirs(filepath.Dir(output)),
+			landlock.ROFiles(configPath()).IgnoreIfMissing(),
+		)
+		if exportKeysCmdOptions.PassphraseFile != "" {
+			lsm.RestrictAdditionalPaths(
+				landlock.ROFiles(exportKeysCmdOptions.PassphraseFile),
+			)
+		}
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+
+	if !state.IsInstalled() {
+		return fmt.Errorf("sbctl is not installed")
+	}
+
+	archive, err := sbctl.ReadKeyArchive(state, configPath())
+	if err != nil {
+		return fmt.Errorf("can't read keys: %w", err)
+	}
+
+	passphrase, err := readPassphrase(state.Fs, exportKeysCmdOptions.PassphraseFile, true)
+	if err != nil {
+		return err
+	}
+	defer clear(passphrase)
+
+	logging.Print("Exporting keys to %s...", output)
+	b, err := archive.Encrypt(passphrase)
+	if err != nil {
+		logging.NotOk("")
+		return fmt.Errorf("couldn't encrypt key archive: %w", err)
+	}
+	if err := sbctl.WriteEncryptedKeyArchive(state.Fs, output, b); err != nil {
+		logging.NotOk("")
+		return fmt.Errorf("couldn't write key archive: %w", err)
+	}
+	logging.Ok("")
+	return nil
+}
+
+func exportKeysCmdFlags(cmd *cobra.Command) {
+	f := cmd.Flags()
+	f.StringVarP(&exportKeysCmdOptions.Output, "output", "o", "", "path of the encrypted key archive")
+	f.StringVarP(&exportKeysCmdOptions.PassphraseFile, "passphrase-file", "", "", "read the archive passphrase from a file")
+}
+
+func init() {
+	exportKeysCmdFlags(exportKeysCmd)
+	CliCommands = append(CliCommands, cliCommand{
+		Cmd: exportKeysCmd,
+	})
+}
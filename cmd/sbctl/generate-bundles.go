@@ -13,7 +13,10 @@ import (
 )
 
 var (
-	sign bool
+	sign                  bool
+	generateESP           string
+	generateCmdline       string
+	generateLoaderEntries bool
 )
 
 var generateBundlesCmd = &cobra.Command{
@@ -21,57 +24,114 @@ var generateBundlesCmd = &cobra.Command{
 	Short: "Generate all EFI stub bundles",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		state := cmd.Context().Value(stateDataKey{}).(*config.State)
+		if generateCmdline != "" {
+			state.Config.CmdlineFile = generateCmdline
+		}
+		return GenerateBundles(state, sign, false)
+	},
+}
 
-		logging.Errorf("The bundle/uki support in sbctl is deprecated. Please move to dracut/mkinitcpio/ukify.")
+// GenerateBundles creates the bundles in the bundle database and signs them if
+// signBundles is set. With onlyStale, bundles which are up to date with their
+// inputs are signed without being regenerated. Failures are logged, and the
+// remaining bundles are still generated.
+func GenerateBundles(state *config.State, signBundles, onlyStale bool) error {
+	logging.Errorf("The bundle/uki support in sbctl is deprecated. Please move to dracut/mkinitcpio/ukify.")
 
-		logging.Println("Generating EFI bundles....")
-		out_create := true
-		out_sign := true
-		var out_err error
-		err := sbctl.BundleIter(state, func(bundle *sbctl.Bundle) error {
-			err := sbctl.CreateBundle(state, *bundle)
+	logging.Println("Generating EFI bundles....")
+	var kh *backend.KeyHierarchy
+	var esp string
+	failed := false
+	err := sbctl.BundleIter(state, func(bundle *sbctl.Bundle) error {
+		// Bundles saved without an ESP fall back to the detected one
+		if bundle.ESP == "" {
+			if esp == "" {
+				var err error
+				if esp, err = sbctl.ResolveESP(state, generateESP); err != nil {
+					return err
+				}
+			}
+			bundle.ESP = esp
+		}
+		stale := true
+		if onlyStale {
+			var err error
+			stale, err = sbctl.BundleStale(state.Fs, bundle)
 			if err != nil {
-				out_create = false
-				out_err = fmt.Errorf("failed creating bundle %s: %w", bundle.Output, err)
+				failed = true
+				logging.Error(fmt.Errorf("failed checking bundle %s: %w", bundle.Output, err))
 				return nil
 			}
-			logging.Print("Wrote EFI bundle %s\n", bundle.Output)
-			if sign {
-				file := bundle.Output
-				kh, err := backend.GetKeyHierarchy(state.Fs, state)
-				if err != nil {
-					return err
-				}
-				err = sbctl.SignFile(state, kh, hierarchy.Db, file, file)
-				if errors.Is(err, sbctl.ErrAlreadySigned) {
-					logging.Unknown("Bundle has already been signed")
-				} else if err != nil {
-					out_sign = false
-					out_err = fmt.Errorf("failed signing bundle %s: %w", bundle.Output, err)
-				} else {
-					logging.Ok("Signed %s", file)
-				}
+		}
+		if stale {
+			if changed, err := sbctl.BundleCmdlineChanged(state.Fs, bundle); err != nil {
+				logging.Warn("Can't read the kernel command line %s: %v", bundle.Cmdline, err)
+			} else if changed {
+				logging.Warn("The kernel command line in %s has changed since %s was generated", bundle.Cmdline, bundle.Output)
+			}
+			if err := sbctl.CreateBundle(state, *bundle); err != nil {
+				failed = true
+				logging.Error(fmt.Errorf("failed creating bundle %s: %w", bundle.Output, err))
+				return nil
 			}
+			logging.Print("Wrote EFI bundle %s\n", bundle.Output)
+		} else {
+			logging.Print("EFI bundle %s is up to date\n", bundle.Output)
+		}
+		// Entries written before are updated without --loader-entries, so
+		// they stay in sync with the bundles
+		if changed, err := sbctl.WriteLoaderEntry(state.Fs, bundle, !generateLoaderEntries); errors.Is(err, sbctl.ErrLoaderEntryType2) {
+			logging.Warn("Not writing a loader entry for %s: %v", bundle.Output, err)
+		} else if err != nil {
+			failed = true
+			logging.Error(fmt.Errorf("failed writing the loader entry of %s: %w", bundle.Output, err))
+		} else if changed {
+			logging.Print("Wrote loader entry %s\n", sbctl.LoaderEntryPath(bundle))
+		}
+		if !signBundles {
 			return nil
-		})
-		if !out_create || !out_sign {
-			return out_err
 		}
-		if err != nil {
-			return err
+		if kh == nil {
+			var err error
+			if kh, err = backend.GetKeyHierarchy(state.Fs, state); err != nil {
+				return err
+			}
+		}
+		file := bundle.Output
+		err := sbctl.SignFile(state, kh, hierarchy.Db, file, file)
+		if errors.Is(err, sbctl.ErrAlreadySigned) {
+			logging.Unknown("Bundle has already been signed")
+		} else if err != nil {
+			failed = true
+			logging.Error(fmt.Errorf("failed signing bundle %s: %w", bundle.Output, err))
+		} else {
+			logging.Ok("Signed %s", file)
 		}
 		return nil
-	},
+	})
+	if err != nil {
+		return err
+	}
+	if failed {
+		// The failures have already been logged
+		return ErrSilent
+	}
+	return nil
 }
 
 func generateBundlesCmdFlags(cmd *cobra.Command) {
 	f := cmd.Flags()
 	f.BoolVarP(&sign, "sign", "s", false, "Sign all the generated bundles")
+	f.StringVarP(&generateESP, "esp", "p", "", "ESP location for bundles saved without one")
+	f.BoolVarP(&generateLoaderEntries, "loader-entries", "", false, "write a systemd-boot loader entry for each bundle to loader/entries on the ESP")
+	f.StringVarP(&generateCmdline, "cmdline-file", "", "", "kernel command line for bundles saved without one. Defaults to cmdline_file from the configuration")
 }
 
 func init() {
 	generateBundlesCmdFlags(generateBundlesCmd)
 	CliCommands = append(CliCommands, cliCommand{
-		Cmd: generateBundlesCmd,
+		Cmd:   generateBundlesCmd,
+		Lock:  true,
+		Hooks: true,
 	})
 }
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/landlock-lsm/go-landlock/landlock"
+	"github.com/spf13/cobra"
+)
+
+var importCertCmd = &cobra.Command{
+	Use:   "import-cert",
+	Short: "Trust an additional certificate when verifying files",
+	Long: `Trust an additional certificate when verifying files.
+
+The PEM or DER encoded certificate is stored in the trusted directory of the
+key directory. verify accepts files signed by it in addition to the db key.
+The certificate is not enrolled into the firmware.`,
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: completeFiles,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		state := cmd.Context().Value(stateDataKey{}).(*config.State)
+		if state.Config.Landlock {
+			lsm.RestrictAdditionalPaths(
+				landlock.ROFiles(args[0]).IgnoreIfMissing(),
+			)
+			if err := lsm.Restrict(); err != nil {
+				return err
+			}
+		}
+
+		logging.Print("Importing %s...", args[0])
+		tc, err := sbctl.ImportTrustedCert(state, args[0])
+		if err != nil {
+			logging.NotOk("")
+			return fmt.Errorf("can't import %s: %w", args[0], err)
+		}
+		logging.Ok("")
+		logging.Print("Trusting %s\n", tc.Certificate.Subject)
+		logging.Print("  Fingerprint:\t%s\n", tc.Fingerprint)
+		return nil
+	},
+}
+
+func init() {
+	CliCommands = append(CliCommands, cliCommand{
+		Cmd:  importCertCmd,
+		Lock: true,
+	})
+}
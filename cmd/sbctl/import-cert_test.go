@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"encoding/pem"
+	"errors"
+	"testing"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/hierarchy"
+	"github.com/spf13/afero"
+)
+
+func TestImportCert(t *testing.T) {
+	state := setupRotateState(t)
+
+	// Sign a binary with the db key of another installation
+	partner := setupRotateState(t)
+	kh, err := backend.GetKeyHierarchy(partner.Fs, partner)
+	if err != nil {
+		t.Fatalf("can't get key hierarchy: %v", err)
+	}
+	peBinary, err := authenticode.Parse(bytes.NewReader(mustBytes("../../tests/binaries/test.pecoff")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := kh.SignFile(hierarchy.Db, peBinary)
+	if err != nil {
+		t.Fatalf("failed signing: %v", err)
+	}
+	if err := afero.WriteFile(state.Fs, "/boot/partner.efi", signed, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: kh.Db.Certificate().Raw})
+	if err := afero.WriteFile(state.Fs, "/tmp/partner.pem", certPem, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	verifiedFiles = nil
+	if err := VerifyOneFile(state, "/boot/partner.efi"); err != nil {
+		t.Fatalf("failed verifying: %v", err)
+	}
+	if verifiedFiles[0].IsSigned != 0 {
+		t.Fatalf("expected the partner binary to be untrusted before importing, got %+v", verifiedFiles[0])
+	}
+
+	tc, err := sbctl.ImportTrustedCert(state, "/tmp/partner.pem")
+	if err != nil {
+		t.Fatalf("failed importing the certificate: %v", err)
+	}
+	if _, err := sbctl.ImportTrustedCert(state, "/tmp/partner.pem"); !errors.Is(err, sbctl.ErrCertificateImported) {
+		t.Fatalf("expected ErrCertificateImported importing twice, got %v", err)
+	}
+
+	verifiedFiles = nil
+	for _, f := range []string{"/boot/partner.efi", "/boot/new.efi"} {
+		if err := VerifyOneFile(state, f); err != nil {
+			t.Fatalf("failed verifying %s: %v", f, err)
+		}
+	}
+	if verifiedFiles[0].IsSigned != 1 || verifiedFiles[0].ImportedCert != tc.Fingerprint {
+		t.Fatalf("expected the partner binary to be signed by the imported certificate, got %+v", verifiedFiles[0])
+	}
+	if verifiedFiles[1].IsSigned != 1 || verifiedFiles[1].ImportedCert != "" {
+		t.Fatalf("expected the binary to be signed by the db key, got %+v", verifiedFiles[1])
+	}
+
+	certs, err := ListLocalCerts(state)
+	if err != nil {
+		t.Fatalf("failed listing certificates: %v", err)
+	}
+	if len(certs.Sbctl) != 3 || len(certs.Imported) != 1 {
+		t.Fatalf("expected 3 sbctl and 1 imported certificate, got %+v", certs)
+	}
+	if c := certs.Imported[0]; c.Label != keyLabelImported || c.Fingerprint != tc.Fingerprint || c.Path != tc.Path {
+		t.Fatalf("unexpected imported certificate %+v", c)
+	}
+}
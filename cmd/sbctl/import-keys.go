@@ -10,6 +10,7 @@ import (
 	"github.com/foxboron/go-uefi/efi/util"
 	"github.com/foxboron/sbctl"
 	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/fs"
 	"github.com/foxboron/sbctl/logging"
 	"github.com/foxboron/sbctl/lsm"
 	"github.com/landlock-lsm/go-landlock/landlock"
@@ -26,6 +27,9 @@ type ImportKeysCmdOptions struct {
 	PKCert    string
 	PKKey     string
 	Directory string
+
+	Archive        string
+	PassphraseFile string
 }
 
 var (
@@ -81,6 +85,43 @@ func ImportKeysFromDirectory(state *config.State, dir string) error {
 	return nil
 }
 
+func ImportKeysFromArchive(state *config.State, file string) error {
+	b, err := fs.ReadFile(state.Fs, file)
+	if err != nil {
+		return err
+	}
+
+	passphrase, err := readPassphrase(state.Fs, importKeysCmdOptions.PassphraseFile, false)
+	if err != nil {
+		return err
+	}
+	defer clear(passphrase)
+
+	// Decrypting also validates the archive, nothing is written until we know
+	// it is complete
+	archive, err := sbctl.DecryptKeyArchive(b, passphrase)
+	if err != nil {
+		return err
+	}
+
+	conffile := ""
+	if _, ok := archive[sbctl.KeyArchiveConfig]; ok {
+		if ok, _ := afero.Exists(state.Fs, configPath()); !ok || importKeysCmdOptions.Force {
+			conffile = configPath()
+		} else {
+			logging.Warn("Not overwriting existing configuration file %s", configPath())
+		}
+	}
+
+	logging.Print("Importing keys from %s...", file)
+	if err := sbctl.WriteKeyArchive(state, archive, conffile); err != nil {
+		logging.NotOk("")
+		return err
+	}
+	logging.Ok("")
+	return nil
+}
+
 func RunImportKeys(cmd *cobra.Command, args []string) error {
 	var err error
 	keypairs := []struct {
@@ -115,6 +156,18 @@ func RunImportKeys(cmd *cobra.Command, args []string) error {
 			)
 		}
 
+		if importKeysCmdOptions.Archive != "" {
+			lsm.RestrictAdditionalPaths(
+				landlock.ROFiles(importKeysCmdOptions.Archive),
+				landlock.RWDirs(filepath.Dir(configPath())).IgnoreIfMissing(),
+			)
+			if importKeysCmdOptions.PassphraseFile != "" {
+				lsm.RestrictAdditionalPaths(
+					landlock.ROFiles(importKeysCmdOptions.PassphraseFile),
+				)
+			}
+		}
+
 		if err := lsm.Restrict(); err != nil {
 			return err
 		}
@@ -127,6 +180,14 @@ func RunImportKeys(cmd *cobra.Command, args []string) error {
 		}
 		return ImportKeysFromDirectory(state, importKeysCmdOptions.Directory)
 	}
+
+	if importKeysCmdOptions.Archive != "" {
+		_, err := state.Fs.Stat(state.Config.Keydir)
+		if err == nil && !importKeysCmdOptions.Force {
+			return fmt.Errorf("key directory exists. Use --force to overwrite the current directory")
+		}
+		return ImportKeysFromArchive(state, importKeysCmdOptions.Archive)
+	}
 	for _, key := range keypairs {
 		if key.Key == "" && key.Cert == "" {
 			continue
@@ -172,12 +233,15 @@ func importKeysCmdFlags(cmd *cobra.Command) {
 	f.StringVarP(&importKeysCmdOptions.PKCert, "pk-cert", "", "", "Platform Key (PK) certificate")
 	f.StringVarP(&importKeysCmdOptions.PKKey, "pk-key", "", "", "Platform Key (PK) key")
 	f.StringVarP(&importKeysCmdOptions.Directory, "directory", "d", "", "Import keys from a directory")
+	f.StringVarP(&importKeysCmdOptions.Archive, "archive", "", "", "Import keys from an encrypted archive created by export-keys")
+	f.StringVarP(&importKeysCmdOptions.PassphraseFile, "passphrase-file", "", "", "Read the archive passphrase from a file")
 	f.BoolVarP(&importKeysCmdOptions.Force, "force", "", false, "Force import")
 }
 
 func init() {
 	importKeysCmdFlags(importKeysCmd)
 	CliCommands = append(CliCommands, cliCommand{
-		Cmd: importKeysCmd,
+		Cmd:  importKeysCmd,
+		Lock: true,
 	})
 }
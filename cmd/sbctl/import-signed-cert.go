@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/landlock-lsm/go-landlock/landlock"
+	"github.com/spf13/cobra"
+)
+
+var (
+	importSignedCertChain string
+	importSignedCertCmd   = &cobra.Command{
+		Use:   "import-signed-cert",
+		Short: "Install a db certificate issued by a CA",
+		Long: `Install a db certificate issued by a CA.
+
+The certificate replaces the self-signed db certificate, and has to be for the
+db key, e.g. issued from the request written by create-keys --csr. The chain
+given with --chain has to end with the self-signed root CA. Its intermediate
+certificates are embedded into signatures, and the root CA is enrolled into db
+by enroll-keys instead of the db certificate.`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeFiles,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			state := cmd.Context().Value(stateDataKey{}).(*config.State)
+			if state.Config.Landlock {
+				lsm.RestrictAdditionalPaths(
+					landlock.ROFiles(args[0]).IgnoreIfMissing(),
+				)
+				if importSignedCertChain != "" {
+					lsm.RestrictAdditionalPaths(
+						landlock.ROFiles(importSignedCertChain).IgnoreIfMissing(),
+					)
+				}
+				if err := lsm.Restrict(); err != nil {
+					return err
+				}
+			}
+
+			kh, err := backend.GetKeyHierarchy(state.Fs, state)
+			if err != nil {
+				return err
+			}
+			logging.Print("Importing %s...", args[0])
+			cert, err := sbctl.ImportSignedCert(state, kh, args[0], importSignedCertChain)
+			if err != nil {
+				logging.NotOk("")
+				return fmt.Errorf("can't import %s: %w", args[0], err)
+			}
+			logging.Ok("")
+			logging.Print("The db certificate is now %s, issued by %s\n", cert.Subject, cert.Issuer)
+			logging.Print("Enroll the keys again for the firmware to trust the CA\n")
+			return nil
+		},
+	}
+)
+
+func importSignedCertCmdFlags(cmd *cobra.Command) {
+	f := cmd.Flags()
+	f.StringVarP(&importSignedCertChain, "chain", "", "", "PEM file with the certificate chain, from the issuer of the certificate to the root CA")
+}
+
+func init() {
+	importSignedCertCmdFlags(importSignedCertCmd)
+	CliCommands = append(CliCommands, cliCommand{
+		Cmd:  importSignedCertCmd,
+		Lock: true,
+	})
+}
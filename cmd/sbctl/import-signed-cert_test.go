@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/foxboron/sbctl/hierarchy"
+	"github.com/spf13/afero"
+)
+
+type testCA struct {
+	key  *ecdsa.PrivateKey
+	cert *x509.Certificate
+}
+
+func newTestCA(t *testing.T, name string, parent *testCA) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	parentCert, parentKey := tmpl, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parentCert, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{key: key, cert: cert}
+}
+
+// issue signs the certificate signing request
+func (ca *testCA) issue(t *testing.T, csr *x509.CertificateRequest) []byte {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      csr.Subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, csr.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+// noRenameFs fails renames, as if sbctl was interrupted before replacing the
+// file
+type noRenameFs struct {
+	afero.Fs
+}
+
+func (noRenameFs) Rename(oldname, newname string) error {
+	return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: syscall.EIO}
+}
+
+func TestImportSignedCert(t *testing.T) {
+	state := setupRotateState(t)
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		t.Fatalf("can't get key hierarchy: %v", err)
+	}
+
+	csrPath, err := sbctl.CreateDbCSR(state, kh)
+	if err != nil {
+		t.Fatalf("failed creating the certificate signing request: %v", err)
+	}
+	b, err := fs.ReadFile(state.Fs, csrPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(b)
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		t.Fatalf("invalid certificate signing request: %v", err)
+	}
+
+	root := newTestCA(t, "Test Root CA", nil)
+	intermediate := newTestCA(t, "Test Intermediate CA", root)
+	other := newTestCA(t, "Other CA", nil)
+	intermediatePem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: intermediate.cert.Raw})
+	chainPem := append(intermediatePem, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.cert.Raw})...)
+	for file, data := range map[string][]byte{
+		"/tmp/leaf.pem":         intermediate.issue(t, csr),
+		"/tmp/chain.pem":        chainPem,
+		"/tmp/intermediate.pem": intermediatePem,
+		"/tmp/other.pem":        pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: other.cert.Raw}),
+	} {
+		if err := afero.WriteFile(state.Fs, file, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := sbctl.ImportSignedCert(state, kh, "/tmp/other.pem", ""); !errors.Is(err, sbctl.ErrCertificateMismatch) {
+		t.Fatalf("expected ErrCertificateMismatch for a certificate of another key, got %v", err)
+	}
+	if _, err := sbctl.ImportSignedCert(state, kh, "/tmp/leaf.pem", "/tmp/other.pem"); !errors.Is(err, sbctl.ErrInvalidChain) {
+		t.Fatalf("expected ErrInvalidChain for a chain which didn't issue the certificate, got %v", err)
+	}
+	for _, chainFile := range []string{"", "/tmp/intermediate.pem"} {
+		if _, err := sbctl.ImportSignedCert(state, kh, "/tmp/leaf.pem", chainFile); !errors.Is(err, sbctl.ErrInvalidChain) {
+			t.Fatalf("expected ErrInvalidChain for a chain %q without the root CA, got %v", chainFile, err)
+		}
+	}
+
+	// The db certificate and its chain are kept if they can't be replaced
+	certPath := filepath.Join(state.Config.Keydir, "db", "db.pem")
+	before, err := fs.ReadFile(state.Fs, certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vfs := state.Fs
+	state.Fs = noRenameFs{vfs}
+	if _, err := sbctl.ImportSignedCert(state, kh, "/tmp/leaf.pem", "/tmp/chain.pem"); !errors.Is(err, syscall.EIO) {
+		t.Fatalf("expected the rename to fail, got %v", err)
+	}
+	state.Fs = vfs
+	if b, err := fs.ReadFile(state.Fs, certPath); err != nil || !bytes.Equal(b, before) {
+		t.Fatalf("the db certificate was changed: %v", err)
+	}
+	if ok, err := afero.Exists(state.Fs, sbctl.DbChainPath(state.Config)); err != nil || ok {
+		t.Fatalf("the chain was installed: %v", err)
+	}
+	if tmp, err := afero.Glob(state.Fs, filepath.Join(filepath.Dir(certPath), ".db*-*")); err != nil || len(tmp) != 0 {
+		t.Fatalf("the temporary files were left behind: %v %v", tmp, err)
+	}
+
+	leaf, err := sbctl.ImportSignedCert(state, kh, "/tmp/leaf.pem", "/tmp/chain.pem")
+	if err != nil {
+		t.Fatalf("failed importing the signed certificate: %v", err)
+	}
+
+	kh, err = backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		t.Fatalf("can't get key hierarchy: %v", err)
+	}
+	if !kh.Db.Certificate().Equal(leaf) {
+		t.Fatalf("the db certificate was not replaced")
+	}
+
+	// Signatures embed the intermediate certificate but not the enrolled root
+	if err := sbctl.SignFile(state, kh, hierarchy.Db, "/boot/test.efi", "/boot/signed.efi"); err != nil {
+		t.Fatalf("failed signing: %v", err)
+	}
+	if ok, err := sbctl.VerifyFile(state, kh, hierarchy.Db, "/boot/signed.efi"); err != nil || !ok {
+		t.Fatalf("the signed file doesn't verify: %v", err)
+	}
+	f, err := state.Fs.Open("/boot/signed.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	peBinary, err := authenticode.Parse(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigs, err := peBinary.Signatures()
+	if err != nil || len(sigs) != 1 {
+		t.Fatalf("expected one signature, got %d: %v", len(sigs), err)
+	}
+	auth, err := authenticode.ParseAuthenticode(sigs[0].Certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(auth.Pkcs.Certs) != 2 || !auth.Pkcs.Certs[0].Equal(leaf) || !auth.Pkcs.Certs[1].Equal(intermediate.cert) {
+		t.Fatalf("expected the db and intermediate certificate in the signature, got %d certificates", len(auth.Pkcs.Certs))
+	}
+
+	// The root CA is enrolled instead of the db certificate
+	efistate, err := ExpectedEFIVariables(state, kh, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	guid, err := state.Config.GetGUID(state.Fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !efistate.Db.SigDataExists(signature.CERT_X509_GUID, &signature.SignatureData{Owner: *guid, Data: root.cert.Raw}) {
+		t.Fatalf("the root CA is not in db")
+	}
+	if efistate.Db.SigDataExists(signature.CERT_X509_GUID, &signature.SignatureData{Owner: *guid, Data: leaf.Raw}) {
+		t.Fatalf("the db certificate should not be in db")
+	}
+
+	// The firmware also trusts the files if only the intermediate CA which
+	// issued the signing certificate is enrolled
+	enrolled, err := sbctl.SystemEFIVariables(state.Efivarfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := enrolled.Db.Append(signature.CERT_X509_GUID, *guid, intermediate.cert.Raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := enrolled.EnrollKey(efivar.Db, kh); err != nil {
+		t.Fatal(err)
+	}
+	list, err := sbctl.VerifyFileEnrolled(state, "/boot/signed.efi")
+	if err != nil || list == nil || !bytes.Equal(list.Signatures[0].Data, intermediate.cert.Raw) {
+		t.Fatalf("expected the file to be verified by the enrolled intermediate CA, got %+v: %v", list, err)
+	}
+}
+
+func TestVerifyEnrolledIntermediate(t *testing.T) {
+	state := setupRotateState(t)
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		t.Fatalf("can't get key hierarchy: %v", err)
+	}
+
+	// The signature embeds the intermediate CA but not the root, which is
+	// enrolled like the Microsoft CAs in db
+	root := newTestCA(t, "Test Root CA", nil)
+	intermediate := newTestCA(t, "Test Intermediate CA", root)
+	csrPath, err := sbctl.CreateDbCSR(state, kh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := fs.ReadFile(state.Fs, csrPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(b)
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file, data := range map[string][]byte{
+		"/tmp/leaf.pem": intermediate.issue(t, csr),
+		"/tmp/chain.pem": append(
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: intermediate.cert.Raw}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.cert.Raw})...),
+	} {
+		if err := afero.WriteFile(state.Fs, file, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := sbctl.ImportSignedCert(state, kh, "/tmp/leaf.pem", "/tmp/chain.pem"); err != nil {
+		t.Fatalf("failed importing the signed certificate: %v", err)
+	}
+	if kh, err = backend.GetKeyHierarchy(state.Fs, state); err != nil {
+		t.Fatal(err)
+	}
+	if err := sbctl.SignFile(state, kh, hierarchy.Db, "/boot/test.efi", "/boot/signed.efi"); err != nil {
+		t.Fatalf("failed signing: %v", err)
+	}
+
+	efistate, err := sbctl.SystemEFIVariables(state.Efivarfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	guid, err := state.Config.GetGUID(state.Fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enroll := func(ca *testCA) {
+		if err := efistate.Db.Append(signature.CERT_X509_GUID, *guid, ca.cert.Raw); err != nil {
+			t.Fatal(err)
+		}
+		if err := efistate.EnrollKey(efivar.Db, kh); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Neither the rotated db certificate nor another root CA issued the
+	// signing certificate
+	enroll(newTestCA(t, "Other CA", nil))
+	if list, err := sbctl.VerifyFileEnrolled(state, "/boot/signed.efi"); err != nil || list != nil {
+		t.Fatalf("expected the file to not be verified, got %+v: %v", list, err)
+	}
+
+	enroll(root)
+	list, err := sbctl.VerifyFileEnrolled(state, "/boot/signed.efi")
+	if err != nil || list == nil || !bytes.Equal(list.Signatures[0].Data, root.cert.Raw) {
+		t.Fatalf("expected the file to be verified by the enrolled root CA, got %+v: %v", list, err)
+	}
+}
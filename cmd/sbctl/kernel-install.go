@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/landlock-lsm/go-landlock/landlock"
+	"github.com/spf13/afero"
+)
+
+var (
+	// Plugins in /etc mask the packaged plugin with the same name
+	kernelInstallPluginPath     = "/etc/kernel/install.d/91-sbctl.install"
+	packagedKernelInstallPlugin = "/usr/lib/kernel/install.d/91-sbctl.install"
+
+	ErrKernelInstallPluginExists = errors.New("kernel-install plugin already exists, use --force to overwrite it")
+
+	kernelInstallPluginTemplate = template.Must(template.New("plugin").Funcs(template.FuncMap{
+		"quote": shellQuote,
+	}).Parse(`#!/bin/sh
+# Generated by sbctl setup --generate-kernel-install-plugin
+
+COMMAND="$1"
+KERNEL_VERSION="$2"
+ENTRY_DIR_ABS="$3"
+
+IMAGE_FILE="$ENTRY_DIR_ABS/linux"
+
+if [ "$KERNEL_INSTALL_LAYOUT" = "uki" ]; then
+	UKI_DIR="$KERNEL_INSTALL_BOOT_ROOT/EFI/Linux"
+	TRIES_FILE="${KERNEL_INSTALL_CONF_ROOT:-/etc/kernel}/tries"
+
+	if [ -f "$TRIES_FILE" ]; then
+		read -r TRIES <"$TRIES_FILE"
+		if ! echo "$TRIES" | grep -q '^[0-9][0-9]*$'; then
+			echo "$TRIES_FILE does not contain an integer." >&2
+			exit 1
+		fi
+		IMAGE_FILE="$UKI_DIR/$KERNEL_INSTALL_ENTRY_TOKEN-$KERNEL_VERSION+$TRIES.efi"
+	else
+		IMAGE_FILE="$UKI_DIR/$KERNEL_INSTALL_ENTRY_TOKEN-$KERNEL_VERSION.efi"
+	fi
+fi
+
+# Files tracked by sbctl when the plugin was generated
+TRACKED=0
+for f in{{range .}} {{quote .}}{{end}}; do
+	[ "$f" = "$IMAGE_FILE" ] && TRACKED=1
+done
+
+case "$COMMAND" in
+add)
+	if ! [ "$(sbctl setup --print-state --json | awk '/installed/ { gsub(/,$/,"",$2); print $2 }')" = "true" ]; then
+		echo "Secureboot key directory doesn't exist, not signing!"
+		exit 0
+	fi
+
+	if [ "$TRACKED" = 0 ]; then
+		printf 'sbctl: Signing kernel %s\n' "$IMAGE_FILE"
+		sbctl sign "$IMAGE_FILE" 1>/dev/null || exit 1
+	fi
+	# Bootloaders and bundles can be updated along with the kernel
+	sbctl sign-all -g 1>/dev/null
+	;;
+remove)
+	[ "$KERNEL_INSTALL_VERBOSE" -gt 0 ] &&
+		printf 'sbctl: Removing kernel %s from signing database\n' "$IMAGE_FILE"
+	sbctl remove-file "$IMAGE_FILE" 1>/dev/null || :
+	;;
+esac
+`))
+)
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// KernelInstallTracked returns the tracked files and bundles the generated
+// plugin knows about
+func KernelInstallTracked(state *config.State) ([]string, error) {
+	var files []string
+	if err := sbctl.SigningEntryIter(state, func(s *sbctl.SigningEntry) error {
+		files = append(files, s.File)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if ok, _ := afero.Exists(state.Fs, state.Config.BundlesDb); ok {
+		if err := sbctl.BundleIter(state, func(b *sbctl.Bundle) error {
+			files = append(files, b.Output)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	slices.Sort(files)
+	return slices.Compact(files), nil
+}
+
+// kernelInstallLandlockRules needs to be called before any other part of setup
+// restricts sbctl
+func kernelInstallLandlockRules() {
+	lsm.RestrictAdditionalPaths(
+		landlock.RWDirs(filepath.Dir(filepath.Dir(kernelInstallPluginPath))).IgnoreIfMissing(),
+	)
+}
+
+// GenerateKernelInstallPlugin writes a kernel-install plugin signing the
+// installed kernel or UKI, and the files tracked by sbctl. dracut and ukify
+// build their images through kernel-install before the plugin runs.
+func GenerateKernelInstallPlugin(state *config.State, force bool) error {
+	if state.Config.Landlock {
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+
+	if ok, _ := afero.Exists(state.Fs, kernelInstallPluginPath); ok && !force {
+		return fmt.Errorf("%s: %w", kernelInstallPluginPath, ErrKernelInstallPluginExists)
+	}
+
+	files, err := KernelInstallTracked(state)
+	if err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	if err := kernelInstallPluginTemplate.Execute(&b, files); err != nil {
+		return err
+	}
+	if err := state.Fs.MkdirAll(filepath.Dir(kernelInstallPluginPath), os.ModePerm); err != nil {
+		return err
+	}
+	if err := fs.WriteFile(state.Fs, kernelInstallPluginPath, b.Bytes(), 0o755); err != nil {
+		return err
+	}
+	logging.Ok("Wrote kernel-install plugin to %s", kernelInstallPluginPath)
+
+	if ok, _ := afero.Exists(state.Fs, packagedKernelInstallPlugin); ok {
+		logging.Print("It replaces the packaged plugin %s\n", packagedKernelInstallPlugin)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/foxboron/sbctl/fs"
+)
+
+func TestGenerateKernelInstallPlugin(t *testing.T) {
+	state := setupRotateState(t)
+
+	if err := GenerateKernelInstallPlugin(state, false); err != nil {
+		t.Fatalf("failed generating kernel-install plugin: %v", err)
+	}
+	b, err := fs.ReadFile(state.Fs, kernelInstallPluginPath)
+	if err != nil {
+		t.Fatalf("can't read kernel-install plugin: %v", err)
+	}
+	for _, want := range []string{"for f in '/boot/test.efi'; do", "sbctl sign-all -g"} {
+		if !strings.Contains(string(b), want) {
+			t.Fatalf("kernel-install plugin is missing %q:\n%s", want, b)
+		}
+	}
+	if _, err := exec.LookPath("sh"); err == nil {
+		cmd := exec.Command("sh", "-n")
+		cmd.Stdin = strings.NewReader(string(b))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("kernel-install plugin is not a valid shell script: %v\n%s", err, out)
+		}
+	}
+
+	if err := GenerateKernelInstallPlugin(state, false); !errors.Is(err, ErrKernelInstallPluginExists) {
+		t.Fatalf("expected ErrKernelInstallPluginExists, got: %v", err)
+	}
+	if err := GenerateKernelInstallPlugin(state, true); err != nil {
+		t.Fatalf("failed overwriting kernel-install plugin: %v", err)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	if got := shellQuote("/efi/it's.efi"); got != `'/efi/it'\''s.efi'` {
+		t.Fatalf("unexpected quoting: %s", got)
+	}
+}
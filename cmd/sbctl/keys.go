@@ -0,0 +1,462 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/hierarchy"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/spf13/cobra"
+)
+
+// Fingerprint formats of keys fingerprint. x509-sha256 is the hash of the
+// TBSCertificate, which EFI_CERT_X509_SHA256 entries in dbx revoke
+// certificates by.
+const (
+	fingerprintSHA1       = "sha1"
+	fingerprintSHA256     = "sha256"
+	fingerprintX509SHA256 = "x509-sha256"
+)
+
+var fingerprintFormats = []string{
+	fingerprintSHA1,
+	fingerprintSHA256,
+	fingerprintX509SHA256,
+}
+
+type KeysFingerprintCmdOptions struct {
+	Formats []string
+}
+
+// KeyFingerprint is the certificate of one of the sbctl keys
+type KeyFingerprint struct {
+	Hierarchy string `json:"hierarchy"`
+	Subject   string `json:"subject"`
+	Serial    string `json:"serial"`
+	// Fingerprints by format
+	Fingerprints map[string]string `json:"fingerprints"`
+}
+
+type KeysShowCmdOptions struct {
+	PEM bool
+}
+
+// KeyCertificate is the decoded certificate of one of the sbctl keys
+type KeyCertificate struct {
+	Hierarchy          string                 `json:"hierarchy"`
+	Type               string                 `json:"type"`
+	Version            int                    `json:"version"`
+	Subject            string                 `json:"subject"`
+	Issuer             string                 `json:"issuer"`
+	Serial             string                 `json:"serial"`
+	NotBefore          time.Time              `json:"not_before"`
+	NotAfter           time.Time              `json:"not_after"`
+	SignatureAlgorithm string                 `json:"signature_algorithm"`
+	PublicKey          KeyPublicKey           `json:"public_key"`
+	Extensions         []CertificateExtension `json:"extensions"`
+	// Fingerprints by format, as keys fingerprint prints them
+	Fingerprints map[string]string `json:"fingerprints"`
+}
+
+// KeyPublicKey is the subject public key info of a certificate
+type KeyPublicKey struct {
+	Algorithm string `json:"algorithm"`
+	// Digest of the DER encoded SubjectPublicKeyInfo
+	SHA256 string `json:"sha256"`
+	// RSA modulus or uncompressed EC point
+	Key      string `json:"key"`
+	Exponent int    `json:"exponent,omitempty"`
+}
+
+// CertificateExtension is an extension with its value decoded for the well
+// known extensions, and hex encoded otherwise
+type CertificateExtension struct {
+	OID      string `json:"oid"`
+	Name     string `json:"name,omitempty"`
+	Critical bool   `json:"critical"`
+	Value    string `json:"value"`
+}
+
+var keyHierarchies = map[string]hierarchy.Hierarchy{
+	"pk":  hierarchy.PK,
+	"kek": hierarchy.KEK,
+	"db":  hierarchy.Db,
+}
+
+var keyUsageNames = []struct {
+	usage x509.KeyUsage
+	name  string
+}{
+	{x509.KeyUsageDigitalSignature, "Digital Signature"},
+	{x509.KeyUsageContentCommitment, "Content Commitment"},
+	{x509.KeyUsageKeyEncipherment, "Key Encipherment"},
+	{x509.KeyUsageDataEncipherment, "Data Encipherment"},
+	{x509.KeyUsageKeyAgreement, "Key Agreement"},
+	{x509.KeyUsageCertSign, "Certificate Sign"},
+	{x509.KeyUsageCRLSign, "CRL Sign"},
+	{x509.KeyUsageEncipherOnly, "Encipher Only"},
+	{x509.KeyUsageDecipherOnly, "Decipher Only"},
+}
+
+var extKeyUsageNames = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:             "Any Extended Key Usage",
+	x509.ExtKeyUsageServerAuth:      "TLS Web Server Authentication",
+	x509.ExtKeyUsageClientAuth:      "TLS Web Client Authentication",
+	x509.ExtKeyUsageCodeSigning:     "Code Signing",
+	x509.ExtKeyUsageEmailProtection: "E-mail Protection",
+	x509.ExtKeyUsageTimeStamping:    "Time Stamping",
+	x509.ExtKeyUsageOCSPSigning:     "OCSP Signing",
+}
+
+var (
+	keysShowCmdOptions        = KeysShowCmdOptions{}
+	keysFingerprintCmdOptions = KeysFingerprintCmdOptions{}
+	keysCmd                   = &cobra.Command{
+		Use:   "keys",
+		Short: "Inspect the sbctl keys",
+	}
+	keysFingerprintCmd = &cobra.Command{
+		Use:   "fingerprint",
+		Short: "Print the fingerprints of the PK, KEK and db certificates",
+		Long: `Print the fingerprints of the PK, KEK and db certificates.
+
+sha1 and sha256 are digests of the DER encoded certificate, sha256 is the
+fingerprint list-enrolled-keys shows. x509-sha256 is the digest of the
+TBSCertificate, the hash dbx revokes certificates by.`,
+		RunE: RunKeysFingerprint,
+	}
+	keysShowCmd = &cobra.Command{
+		Use:   "show <pk|kek|db>",
+		Short: "Print the certificate of the PK, KEK or db key",
+		Long: `Print the certificate of the PK, KEK or db key in the key directory.
+
+The subject, issuer, serial, validity, signature algorithm, public key and
+extensions are decoded, like openssl x509 -text does.`,
+		Args:      cobra.ExactArgs(1),
+		ValidArgs: []string{"pk", "kek", "db"},
+		RunE:      RunKeysShow,
+	}
+)
+
+// certificateFingerprint returns the fingerprint of cert in the format
+func certificateFingerprint(cert *x509.Certificate, format string) string {
+	switch format {
+	case fingerprintSHA1:
+		sum := sha1.Sum(cert.Raw)
+		return hex.EncodeToString(sum[:])
+	case fingerprintX509SHA256:
+		sum := sha256.Sum256(cert.RawTBSCertificate)
+		return hex.EncodeToString(sum[:])
+	default:
+		sum := sha256.Sum256(cert.Raw)
+		return hex.EncodeToString(sum[:])
+	}
+}
+
+// KeyFingerprints returns the fingerprints of the sbctl certificates in the
+// formats
+func KeyFingerprints(state *config.State, formats []string) ([]KeyFingerprint, error) {
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		return nil, err
+	}
+	keys := []KeyFingerprint{}
+	for _, hier := range []hierarchy.Hierarchy{hierarchy.PK, hierarchy.KEK, hierarchy.Db} {
+		cert := kh.GetKeyBackend(hier.Efivar()).Certificate()
+		key := KeyFingerprint{
+			Hierarchy:    hier.String(),
+			Subject:      cert.Subject.String(),
+			Serial:       hex.EncodeToString(cert.SerialNumber.Bytes()),
+			Fingerprints: map[string]string{},
+		}
+		for _, format := range formats {
+			key.Fingerprints[format] = certificateFingerprint(cert, format)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func RunKeysFingerprint(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+
+	formats := fingerprintFormats
+	if len(keysFingerprintCmdOptions.Formats) != 0 {
+		formats = []string{}
+		for _, format := range keysFingerprintCmdOptions.Formats {
+			format = strings.ToLower(format)
+			if !slices.Contains(fingerprintFormats, format) {
+				return fmt.Errorf("unknown fingerprint format %s, allowed values are: %s", format, strings.Join(fingerprintFormats, ", "))
+			}
+			formats = append(formats, format)
+		}
+	}
+
+	if state.Config.Landlock {
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+
+	keys, err := KeyFingerprints(state, formats)
+	if err != nil {
+		return err
+	}
+	if cmdOptions.StructuredOutput() {
+		return StructuredOut(keys)
+	}
+	for _, k := range keys {
+		logging.Print("%s:\n", k.Hierarchy)
+		logging.Print("  Subject:\t%s\n", k.Subject)
+		logging.Print("  Serial:\t%s\n", k.Serial)
+		for _, format := range formats {
+			logging.Print("  %s:\t%s\n", strings.ToUpper(format), k.Fingerprints[format])
+		}
+	}
+	return nil
+}
+
+// colonHex formats b as colon separated hex bytes, like openssl does
+func colonHex(b []byte) string {
+	s := make([]string, len(b))
+	for i, c := range b {
+		s[i] = fmt.Sprintf("%02x", c)
+	}
+	return strings.Join(s, ":")
+}
+
+// certificateExtensions decodes the extensions of cert
+func certificateExtensions(cert *x509.Certificate) []CertificateExtension {
+	exts := []CertificateExtension{}
+	for _, ext := range cert.Extensions {
+		e := CertificateExtension{
+			OID:      ext.Id.String(),
+			Critical: ext.Critical,
+			Value:    hex.EncodeToString(ext.Value),
+		}
+		switch {
+		case ext.Id.Equal(asn1.ObjectIdentifier{2, 5, 29, 19}):
+			e.Name = "Basic Constraints"
+			e.Value = fmt.Sprintf("CA:%t", cert.IsCA)
+			if cert.MaxPathLen > 0 || cert.MaxPathLenZero {
+				e.Value += fmt.Sprintf(", pathlen:%d", cert.MaxPathLen)
+			}
+		case ext.Id.Equal(asn1.ObjectIdentifier{2, 5, 29, 15}):
+			e.Name = "Key Usage"
+			var usages []string
+			for _, u := range keyUsageNames {
+				if cert.KeyUsage&u.usage != 0 {
+					usages = append(usages, u.name)
+				}
+			}
+			e.Value = strings.Join(usages, ", ")
+		case ext.Id.Equal(asn1.ObjectIdentifier{2, 5, 29, 37}):
+			e.Name = "Extended Key Usage"
+			var usages []string
+			for _, u := range cert.ExtKeyUsage {
+				if name, ok := extKeyUsageNames[u]; ok {
+					usages = append(usages, name)
+				} else {
+					usages = append(usages, fmt.Sprintf("unknown (%d)", u))
+				}
+			}
+			for _, oid := range cert.UnknownExtKeyUsage {
+				usages = append(usages, oid.String())
+			}
+			e.Value = strings.Join(usages, ", ")
+		case ext.Id.Equal(asn1.ObjectIdentifier{2, 5, 29, 14}):
+			e.Name = "Subject Key Identifier"
+			e.Value = colonHex(cert.SubjectKeyId)
+		case ext.Id.Equal(asn1.ObjectIdentifier{2, 5, 29, 35}):
+			e.Name = "Authority Key Identifier"
+			e.Value = colonHex(cert.AuthorityKeyId)
+		case ext.Id.Equal(asn1.ObjectIdentifier{2, 5, 29, 17}):
+			e.Name = "Subject Alternative Name"
+			var names []string
+			for _, n := range cert.DNSNames {
+				names = append(names, "DNS:"+n)
+			}
+			for _, n := range cert.EmailAddresses {
+				names = append(names, "email:"+n)
+			}
+			for _, n := range cert.IPAddresses {
+				names = append(names, "IP:"+n.String())
+			}
+			for _, n := range cert.URIs {
+				names = append(names, "URI:"+n.String())
+			}
+			e.Value = strings.Join(names, ", ")
+		}
+		exts = append(exts, e)
+	}
+	return exts
+}
+
+// certificatePublicKey decodes the public key of cert
+func certificatePublicKey(cert *x509.Certificate) KeyPublicKey {
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pub := KeyPublicKey{
+		Algorithm: string(backend.AlgorithmFromPublicKey(cert.PublicKey)),
+		SHA256:    hex.EncodeToString(spki[:]),
+	}
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		pub.Key = hex.EncodeToString(key.N.Bytes())
+		pub.Exponent = key.E
+	case *ecdsa.PublicKey:
+		if k, err := key.ECDH(); err == nil {
+			pub.Key = hex.EncodeToString(k.Bytes())
+		}
+	}
+	if pub.Algorithm == "" {
+		pub.Algorithm = cert.PublicKeyAlgorithm.String()
+	}
+	return pub
+}
+
+// ShowKey returns the decoded certificate of the sbctl key for hier
+func ShowKey(state *config.State, hier hierarchy.Hierarchy) (*KeyCertificate, error) {
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		return nil, err
+	}
+	kb := kh.GetKeyBackend(hier.Efivar())
+	cert := kb.Certificate()
+	key := &KeyCertificate{
+		Hierarchy:          hier.String(),
+		Type:               string(kb.Type()),
+		Version:            cert.Version,
+		Subject:            cert.Subject.String(),
+		Issuer:             cert.Issuer.String(),
+		Serial:             hex.EncodeToString(cert.SerialNumber.Bytes()),
+		NotBefore:          cert.NotBefore,
+		NotAfter:           cert.NotAfter,
+		SignatureAlgorithm: cert.SignatureAlgorithm.String(),
+		PublicKey:          certificatePublicKey(cert),
+		Extensions:         certificateExtensions(cert),
+		Fingerprints:       map[string]string{},
+	}
+	for _, format := range fingerprintFormats {
+		key.Fingerprints[format] = certificateFingerprint(cert, format)
+	}
+	return key, nil
+}
+
+// printHexBlock prints the hex encoded s as colon separated bytes, 16 per
+// line
+func printHexBlock(indent, s string) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return
+	}
+	for len(b) > 0 {
+		n := min(len(b), 16)
+		logging.Print("%s%s\n", indent, colonHex(b[:n]))
+		b = b[n:]
+	}
+}
+
+func printKeyCertificate(k *KeyCertificate) {
+	logging.Print("%s (%s key):\n", k.Hierarchy, k.Type)
+	logging.Print("  Version:\t\t%d\n", k.Version)
+	logging.Print("  Serial:\t\t%s\n", k.Serial)
+	logging.Print("  Signature Algorithm:\t%s\n", k.SignatureAlgorithm)
+	logging.Print("  Issuer:\t\t%s\n", k.Issuer)
+	logging.Print("  Validity:\n")
+	logging.Print("    Not Before:\t\t%s\n", k.NotBefore.Format(time.RFC3339))
+	logging.Print("    Not After:\t\t%s\n", k.NotAfter.Format(time.RFC3339))
+	logging.Print("  Subject:\t\t%s\n", k.Subject)
+	logging.Print("  Public Key:\n")
+	logging.Print("    Algorithm:\t\t%s\n", k.PublicKey.Algorithm)
+	if k.PublicKey.Exponent != 0 {
+		logging.Print("    Exponent:\t\t%d\n", k.PublicKey.Exponent)
+	}
+	logging.Print("    SPKI SHA256:\t%s\n", k.PublicKey.SHA256)
+	logging.Print("    Key:\n")
+	printHexBlock("      ", k.PublicKey.Key)
+	if len(k.Extensions) > 0 {
+		logging.Print("  Extensions:\n")
+	}
+	for _, e := range k.Extensions {
+		name := e.Name
+		if name == "" {
+			name = e.OID
+		}
+		if e.Critical {
+			name += " (critical)"
+		}
+		logging.Print("    %s:\n      %s\n", name, e.Value)
+	}
+	logging.Print("  Fingerprints:\n")
+	for _, format := range fingerprintFormats {
+		logging.Print("    %s:\t%s\n", strings.ToUpper(format), k.Fingerprints[format])
+	}
+}
+
+func RunKeysShow(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+
+	hier, ok := keyHierarchies[strings.ToLower(args[0])]
+	if !ok {
+		return fmt.Errorf("unknown key %s, allowed values are: pk, kek, db", args[0])
+	}
+	if keysShowCmdOptions.PEM && cmdOptions.StructuredOutput() {
+		return fmt.Errorf("--pem can't be combined with --json or --yaml")
+	}
+
+	if state.Config.Landlock {
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+
+	if keysShowCmdOptions.PEM {
+		kh, err := backend.GetKeyHierarchy(state.Fs, state)
+		if err != nil {
+			return err
+		}
+		logging.Print("%s", kh.GetKeyBackend(hier.Efivar()).CertificateBytes())
+		return nil
+	}
+	key, err := ShowKey(state, hier)
+	if err != nil {
+		return err
+	}
+	if cmdOptions.StructuredOutput() {
+		return StructuredOut(key)
+	}
+	printKeyCertificate(key)
+	return nil
+}
+
+func keysShowCmdFlags(cmd *cobra.Command) {
+	f := cmd.Flags()
+	f.BoolVarP(&keysShowCmdOptions.PEM, "pem", "", false, "print the PEM encoded certificate")
+}
+
+func keysFingerprintCmdFlags(cmd *cobra.Command) {
+	f := cmd.Flags()
+	f.StringSliceVarP(&keysFingerprintCmdOptions.Formats, "format", "f", nil, "fingerprint formats to print: "+strings.Join(fingerprintFormats, ", ")+" (default: all)")
+}
+
+func init() {
+	keysFingerprintCmdFlags(keysFingerprintCmd)
+	keysShowCmdFlags(keysShowCmd)
+	keysCmd.AddCommand(keysFingerprintCmd)
+	keysCmd.AddCommand(keysShowCmd)
+	CliCommands = append(CliCommands, cliCommand{
+		Cmd: keysCmd,
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/hierarchy"
+	"github.com/foxboron/sbctl/logging"
+)
+
+func TestKeyFingerprints(t *testing.T) {
+	state := setupEnrollState(t)
+	if err := RunCreateKeys(state); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunEnrollKeys(state); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := KeyFingerprints(state, fingerprintFormats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enrolled, err := ListEnrolledKeys(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The sha256 fingerprints match the ones list-enrolled-keys reports
+	for i, list := range [][]EnrolledKey{enrolled.PK, enrolled.KEK, enrolled.Db} {
+		k := keys[i]
+		if len(k.Fingerprints) != len(fingerprintFormats) {
+			t.Fatalf("%s: expected all formats, got %v", k.Hierarchy, k.Fingerprints)
+		}
+		if len(list) != 1 || list[0].Fingerprint != k.Fingerprints[fingerprintSHA256] || list[0].Serial != k.Serial {
+			t.Fatalf("%s: fingerprint %s doesn't match the enrolled keys %+v", k.Hierarchy, k.Fingerprints[fingerprintSHA256], list)
+		}
+		if len(k.Fingerprints[fingerprintSHA1]) != 40 {
+			t.Fatalf("%s: unexpected sha1 fingerprint %q", k.Hierarchy, k.Fingerprints[fingerprintSHA1])
+		}
+	}
+
+	keys, err = KeyFingerprints(state, []string{fingerprintX509SHA256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys[0].Fingerprints) != 1 || keys[0].Fingerprints[fingerprintX509SHA256] == "" {
+		t.Fatalf("expected only the x509-sha256 fingerprint, got %v", keys[0].Fingerprints)
+	}
+}
+
+func TestKeysShow(t *testing.T) {
+	state := setupEnrollState(t)
+	if err := RunCreateKeys(state); err != nil {
+		t.Fatal(err)
+	}
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := kh.Db.Certificate()
+
+	key, err := ShowKey(state, hierarchy.Db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Hierarchy != "db" || key.Subject != cert.Subject.String() || key.Issuer != cert.Issuer.String() {
+		t.Fatalf("unexpected certificate %+v", key)
+	}
+	if key.PublicKey.Algorithm != string(backend.GetKeyAlgorithm(kh.Db)) || key.PublicKey.Exponent != 65537 {
+		t.Fatalf("unexpected public key %+v", key.PublicKey)
+	}
+	if key.Fingerprints[fingerprintSHA256] != certificateFingerprint(cert, fingerprintSHA256) {
+		t.Fatalf("unexpected fingerprints %v", key.Fingerprints)
+	}
+	if len(key.Extensions) != len(cert.Extensions) {
+		t.Fatalf("expected %d extensions, got %+v", len(cert.Extensions), key.Extensions)
+	}
+
+	logging.PrintOn()
+	out, err := captureOutput(func() error {
+		printKeyCertificate(key)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"db (file key):", "Subject:\t\t" + key.Subject, "SPKI SHA256:\t" + key.PublicKey.SHA256} {
+		if !bytes.Contains(out, []byte(s)) {
+			t.Fatalf("expected %q in the output, got:\n%s", s, out)
+		}
+	}
+}
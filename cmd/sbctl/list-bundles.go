@@ -15,8 +15,12 @@ import (
 type JsonBundle struct {
 	sbctl.Bundle
 	IsSigned bool `json:"is_signed"`
+	// Status is set with --verify
+	Status sbctl.BundleStatus `json:"status,omitempty"`
 }
 
+var listBundlesVerify bool
+
 var listBundlesCmd = &cobra.Command{
 	Use: "list-bundles",
 	Aliases: []string{
@@ -78,21 +82,43 @@ var listBundlesCmd = &cobra.Command{
 				if s.IntelMicrocode != "" {
 					logging.Print("\tIntel Microcode:      └─%s\n", s.IntelMicrocode)
 				}
-				bundles = append(bundles, JsonBundle{*s, isSigned})
+				var status sbctl.BundleStatus
+				if listBundlesVerify {
+					status, err = sbctl.VerifyBundle(state.Fs, s)
+					if err != nil {
+						return fmt.Errorf("%s: %w", s.Output, err)
+					}
+					logging.Print("\tStatus:\t\t")
+					switch status {
+					case sbctl.BundleFresh:
+						logging.Ok("Fresh")
+					case sbctl.BundleOutdated:
+						logging.NotOk("Stale, run sbctl generate-bundles")
+					case sbctl.BundleMissingInput:
+						logging.NotOk("Missing input files")
+					}
+				}
+				bundles = append(bundles, JsonBundle{*s, isSigned, status})
 				logging.Println("")
 				return nil
 			})
 		if err != nil {
 			return err
 		}
-		if cmdOptions.JsonOutput {
-			return JsonOut(bundles)
+		if cmdOptions.StructuredOutput() {
+			return StructuredOut(bundles)
 		}
 		return nil
 	},
 }
 
+func listBundlesCmdFlags(cmd *cobra.Command) {
+	f := cmd.Flags()
+	f.BoolVarP(&listBundlesVerify, "verify", "", false, "check if the bundles are up to date with their input files")
+}
+
 func init() {
+	listBundlesCmdFlags(listBundlesCmd)
 	CliCommands = append(CliCommands, cliCommand{
 		Cmd: listBundlesCmd,
 	})
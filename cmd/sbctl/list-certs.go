@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"time"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/hierarchy"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/spf13/cobra"
+)
+
+// LocalCert is a certificate sbctl trusts locally, either one of the sbctl
+// keys or a certificate imported with import-cert
+type LocalCert struct {
+	// Variable the sbctl key is for, unset for imported certificates
+	Variable    string     `json:"variable,omitempty"`
+	Label       string     `json:"label"`
+	Subject     string     `json:"subject"`
+	Issuer      string     `json:"issuer"`
+	Serial      string     `json:"serial"`
+	Fingerprint string     `json:"fingerprint"`
+	NotBefore   *time.Time `json:"not_before"`
+	NotAfter    *time.Time `json:"not_after"`
+	// Set for imported certificates
+	Path string `json:"path,omitempty"`
+}
+
+type LocalCerts struct {
+	Sbctl    []LocalCert `json:"sbctl"`
+	Imported []LocalCert `json:"imported"`
+}
+
+// Label of certificates imported with import-cert
+const keyLabelImported = "imported"
+
+var listCertsCmd = &cobra.Command{
+	Use: "list-certs",
+	Aliases: []string{
+		"ls-certs",
+	},
+	Short: "List the certificates verify trusts",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		state := cmd.Context().Value(stateDataKey{}).(*config.State)
+		if state.Config.Landlock {
+			if err := lsm.Restrict(); err != nil {
+				return err
+			}
+		}
+
+		certs, err := ListLocalCerts(state)
+		if err != nil {
+			return err
+		}
+
+		if cmdOptions.StructuredOutput() {
+			return StructuredOut(certs)
+		}
+
+		printLocalCerts("sbctl", certs.Sbctl, "No sbctl keys")
+		printLocalCerts("Imported", certs.Imported, "No certificates imported")
+		return nil
+	},
+}
+
+func init() {
+	CliCommands = append(CliCommands, cliCommand{
+		Cmd: listCertsCmd,
+	})
+}
+
+func localCert(cert *x509.Certificate, label string) LocalCert {
+	sum := sha256.Sum256(cert.Raw)
+	return LocalCert{
+		Label:       label,
+		Subject:     cert.Subject.String(),
+		Issuer:      cert.Issuer.String(),
+		Serial:      hex.EncodeToString(cert.SerialNumber.Bytes()),
+		Fingerprint: hex.EncodeToString(sum[:]),
+		NotBefore:   &cert.NotBefore,
+		NotAfter:    &cert.NotAfter,
+	}
+}
+
+// ListLocalCerts returns the certificates of the sbctl keys and the imported
+// certificates. The sbctl keys are skipped if they can't be read, e.g. when
+// sbctl isn't set up.
+func ListLocalCerts(state *config.State) (*LocalCerts, error) {
+	certs := &LocalCerts{Sbctl: []LocalCert{}, Imported: []LocalCert{}}
+	if kh, err := backend.GetKeyHierarchy(state.Fs, state); err == nil {
+		for _, hier := range []hierarchy.Hierarchy{hierarchy.PK, hierarchy.KEK, hierarchy.Db} {
+			c := localCert(kh.GetKeyBackend(hier.Efivar()).Certificate(), keyLabelSbctl)
+			c.Variable = hier.String()
+			certs.Sbctl = append(certs.Sbctl, c)
+		}
+	}
+	trusted, err := sbctl.TrustedCerts(state)
+	if err != nil {
+		return nil, err
+	}
+	for _, tc := range trusted {
+		c := localCert(tc.Certificate, keyLabelImported)
+		c.Path = tc.Path
+		certs.Imported = append(certs.Imported, c)
+	}
+	return certs, nil
+}
+
+func printLocalCerts(title string, certs []LocalCert, empty string) {
+	logging.Print("%s:\n", title)
+	if len(certs) == 0 {
+		logging.Print("  %s\n", empty)
+		return
+	}
+	for _, c := range certs {
+		logging.Print("  %s\n", c.Subject)
+		if c.Variable != "" {
+			logging.Print("    Variable:\t%s\n", c.Variable)
+		}
+		logging.Print("    Issuer:\t%s\n", c.Issuer)
+		logging.Print("    Serial:\t%s\n", c.Serial)
+		logging.Print("    Fingerprint:\t%s\n", c.Fingerprint)
+		logging.Print("    Label:\t%s\n", c.Label)
+		if c.Path != "" {
+			logging.Print("    Path:\t%s\n", c.Path)
+		}
+		logging.Print("    Valid:\t%s to %s\n", c.NotBefore.Format(time.DateOnly), c.NotAfter.Format(time.DateOnly))
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/spf13/cobra"
+)
+
+var listDbxCmd = &cobra.Command{
+	Use: "list-dbx",
+	Aliases: []string{
+		"ls-dbx",
+	},
+	Short: "List the entries of the forbidden signature database (dbx)",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		state := cmd.Context().Value(stateDataKey{}).(*config.State)
+		if state.Config.Landlock {
+			if err := lsm.Restrict(); err != nil {
+				return err
+			}
+		}
+
+		dbx, err := state.Efivarfs.Getdbx()
+		if errors.Is(err, os.ErrNotExist) {
+			dbx = signature.NewSignatureDatabase()
+		} else if err != nil {
+			return err
+		}
+
+		entries := sbctl.ListDbx(dbx)
+		if cmdOptions.StructuredOutput() {
+			return StructuredOut(entries)
+		}
+		for _, entry := range entries {
+			fmt.Printf("%s\t%s\n", entry.Type, entry.Value)
+		}
+		return nil
+	},
+}
+
+func init() {
+	CliCommands = append(CliCommands, cliCommand{
+		Cmd:      listDbxCmd,
+		Efivarfs: true,
+	})
+}
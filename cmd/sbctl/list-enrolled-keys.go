@@ -1,17 +1,54 @@
 package main
 
 import (
+	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
 	"fmt"
+	"time"
 
-	"github.com/foxboron/go-uefi/efi"
 	"github.com/foxboron/go-uefi/efi/signature"
-	"github.com/foxboron/go-uefi/efi/util"
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/certs"
 	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/logging"
 	"github.com/foxboron/sbctl/lsm"
 	"github.com/spf13/cobra"
 )
 
+// EnrolledKey is a signature in one of the firmware signature databases. The
+// certificate fields are only set for X509 entries.
+type EnrolledKey struct {
+	Type        string `json:"type"`
+	Owner       string `json:"owner"`
+	Fingerprint string `json:"fingerprint"`
+	// Label is who the key belongs to, see the keyLabel constants
+	Label     string     `json:"label"`
+	Subject   string     `json:"subject,omitempty"`
+	Issuer    string     `json:"issuer,omitempty"`
+	Serial    string     `json:"serial,omitempty"`
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	NotAfter  *time.Time `json:"not_after,omitempty"`
+
+	// Certificate of X509 entries
+	der []byte
+}
+
+// Labels of an EnrolledKey. Keys are matched by their fingerprint, an unknown
+// key isn't in the sbctl keys or the vendor certificates bundled with sbctl.
+// Bundled vendor certificates are labeled with the vendor, e.g. "microsoft".
+const (
+	keyLabelSbctl   = "sbctl"
+	keyLabelUnknown = "unknown"
+)
+
+type EnrolledKeys struct {
+	PK  []EnrolledKey `json:"PK"`
+	KEK []EnrolledKey `json:"KEK"`
+	Db  []EnrolledKey `json:"db"`
+}
+
 var listKeysCmd = &cobra.Command{
 	Use: "list-enrolled-keys",
 	Aliases: []string{
@@ -26,70 +63,148 @@ var listKeysCmd = &cobra.Command{
 			}
 		}
 
-		var err error
-		certList := map[string]([]*x509.Certificate){}
-
-		pk, err := efi.GetPK()
-		if err != nil {
-			return err
-		}
-		kek, err := efi.GetKEK()
-		if err != nil {
-			return err
-		}
-		db, err := efi.Getdb()
+		keys, err := ListEnrolledKeys(state)
 		if err != nil {
 			return err
 		}
 
-		certList["PK"] = ExtractCertsFromSignatureDatabase(pk)
-		certList["KEK"] = ExtractCertsFromSignatureDatabase(kek)
-		certList["DB"] = ExtractCertsFromSignatureDatabase(db)
-
-		if cmdOptions.JsonOutput {
-			return JsonOut(certList)
+		if cmdOptions.StructuredOutput() {
+			return StructuredOut(keys)
 		}
 
-		printCertsPlainText(certList)
-
+		printEnrolledKeys("PK", keys.PK)
+		printEnrolledKeys("KEK", keys.KEK)
+		printEnrolledKeys("db", keys.Db)
 		return nil
 	},
 }
 
 func init() {
 	CliCommands = append(CliCommands, cliCommand{
-		Cmd: listKeysCmd,
+		Cmd:      listKeysCmd,
+		Efivarfs: true,
 	})
 }
 
-// ExtractCertsFromSignatureDatabase returns a []*x509.Certificate from a *signature.SignatureDatabase
-func ExtractCertsFromSignatureDatabase(database *signature.SignatureDatabase) []*x509.Certificate {
-	var result []*x509.Certificate
-	for _, k := range *database {
-		if isValidSignature(k.SignatureType) {
-			for _, k1 := range k.Signatures {
-				// Note the S at the end of the function, we are parsing multiple certs, not just one
-				certificates, err := x509.ParseCertificates(k1.Data)
-				if err != nil {
-					continue
-				}
-				result = append(result, certificates...)
-			}
+// ListEnrolledKeys reads the signature databases from the firmware
+func ListEnrolledKeys(state *config.State) (*EnrolledKeys, error) {
+	pk, err := state.Efivarfs.GetPK()
+	if err != nil {
+		return nil, fmt.Errorf("can't read PK: %w", err)
+	}
+	kek, err := state.Efivarfs.GetKEK()
+	if err != nil {
+		return nil, fmt.Errorf("can't read KEK: %w", err)
+	}
+	db, err := state.Efivarfs.Getdb()
+	if err != nil {
+		return nil, fmt.Errorf("can't read db: %w", err)
+	}
+	keys := &EnrolledKeys{
+		PK:  enrolledKeys(pk),
+		KEK: enrolledKeys(kek),
+		Db:  enrolledKeys(db),
+	}
+	labelEnrolledKeys(state, keys)
+	return keys, nil
+}
+
+// labelEnrolledKeys labels the keys matching the sbctl certificates, or the
+// bundled Microsoft certificates. The sbctl keys are skipped if they can't be
+// read, e.g. when sbctl isn't set up.
+func labelEnrolledKeys(state *config.State, keys *EnrolledKeys) {
+	labelKeys(sbctlKeyFingerprints(state), keys.PK, keys.KEK, keys.Db)
+}
+
+// sbctlKeyFingerprints returns the sha256 fingerprints of the sbctl
+// certificates, empty if they can't be read
+func sbctlKeyFingerprints(state *config.State) map[string]bool {
+	sbctlKeys := map[string]bool{}
+	if kh, err := backend.GetKeyHierarchy(state.Fs, state); err == nil {
+		for _, kb := range []backend.KeyBackend{kh.PK, kh.KEK, kh.Db} {
+			sum := sha256.Sum256(kb.Certificate().Raw)
+			sbctlKeys[hex.EncodeToString(sum[:])] = true
+		}
+		if cert, err := sbctl.DbEnrollCertificate(state, kh); err == nil {
+			sum := sha256.Sum256(cert)
+			sbctlKeys[hex.EncodeToString(sum[:])] = true
 		}
 	}
-	return result
+	return sbctlKeys
 }
 
-// isValidSignature identifies a signature based as a DER-encoded X.509 certificate
-func isValidSignature(sign util.EFIGUID) bool {
-	return sign == signature.CERT_X509_GUID
+func labelKeys(sbctlKeys map[string]bool, lists ...[]EnrolledKey) {
+	for _, list := range lists {
+		for i := range list {
+			list[i].Label = keyLabel(sbctlKeys, list[i])
+		}
+	}
 }
 
-func printCertsPlainText(certList map[string][]*x509.Certificate) {
-	for db, certs := range certList {
-		fmt.Printf("%s:\n", db)
-		for _, c := range certs {
-			fmt.Printf("  %s\n", c.Issuer.CommonName)
+func keyLabel(sbctlKeys map[string]bool, key EnrolledKey) string {
+	if key.Type != "X509" {
+		return keyLabelUnknown
+	}
+	if sbctlKeys[key.Fingerprint] {
+		return keyLabelSbctl
+	}
+	if vendor := certs.BundledCertVendor(key.der); vendor != "" {
+		return vendor
+	}
+	return keyLabelUnknown
+}
+
+func enrolledKeys(database *signature.SignatureDatabase) []EnrolledKey {
+	keys := []EnrolledKey{}
+	for _, list := range *database {
+		for _, sig := range list.Signatures {
+			key := EnrolledKey{Owner: sig.Owner.Format()}
+			switch list.SignatureType {
+			case signature.CERT_X509_GUID:
+				sum := sha256.Sum256(sig.Data)
+				key.Type = "X509"
+				key.der = sig.Data
+				key.Fingerprint = hex.EncodeToString(sum[:])
+				if cert, err := x509.ParseCertificate(sig.Data); err == nil {
+					key.Subject = cert.Subject.String()
+					key.Issuer = cert.Issuer.String()
+					key.Serial = hex.EncodeToString(cert.SerialNumber.Bytes())
+					key.NotBefore = &cert.NotBefore
+					key.NotAfter = &cert.NotAfter
+				}
+			case signature.CERT_SHA256_GUID:
+				key.Type = "SHA256"
+				key.Fingerprint = hex.EncodeToString(sig.Data)
+			default:
+				sum := sha256.Sum256(sig.Data)
+				key.Type = list.SignatureType.Format()
+				key.Fingerprint = hex.EncodeToString(sum[:])
+			}
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func printEnrolledKeys(variable string, keys []EnrolledKey) {
+	logging.Print("%s:\n", variable)
+	if len(keys) == 0 {
+		logging.Print("  No keys enrolled\n")
+		return
+	}
+	for _, k := range keys {
+		if k.Subject != "" {
+			logging.Print("  %s\n", k.Subject)
+			logging.Print("    Issuer:\t%s\n", k.Issuer)
+			logging.Print("    Serial:\t%s\n", k.Serial)
+		} else {
+			logging.Print("  %s\n", k.Type)
+		}
+		logging.Print("    Fingerprint:\t%s\n", k.Fingerprint)
+		logging.Print("    Label:\t%s\n", k.Label)
+		logging.Print("    Owner:\t%s\n", k.Owner)
+		if k.NotBefore != nil {
+			logging.Print("    Valid:\t%s to %s\n", k.NotBefore.Format(time.DateOnly), k.NotAfter.Format(time.DateOnly))
 		}
 	}
 }
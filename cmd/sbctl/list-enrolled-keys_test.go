@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/certs"
+)
+
+func TestListEnrolledKeys(t *testing.T) {
+	state := setupRotateState(t)
+
+	keys, err := ListEnrolledKeys(state)
+	if err != nil {
+		t.Fatalf("failed listing enrolled keys: %v", err)
+	}
+	for name, list := range map[string][]EnrolledKey{"PK": keys.PK, "KEK": keys.KEK, "db": keys.Db} {
+		if len(list) != 1 {
+			t.Fatalf("expected one key in %s, got %+v", name, list)
+		}
+		k := list[0]
+		if k.Type != "X509" || k.Subject == "" || k.Serial == "" || k.NotAfter == nil {
+			t.Fatalf("unexpected key in %s: %+v", name, k)
+		}
+		if k.Label != keyLabelSbctl {
+			t.Fatalf("expected the %s key to be labeled sbctl, got %s", name, k.Label)
+		}
+	}
+}
+
+func TestListEnrolledKeysLabels(t *testing.T) {
+	state := setupRotateState(t)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Unexpected Key"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+	}
+	unknown, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	guid, err := state.Config.GetGUID(state.Fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	efistate, err := sbctl.SystemEFIVariables(state.Efivarfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	microsoft, err := certs.GetOEMCerts("microsoft", "db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	efistate.Db.AppendDatabase(microsoft)
+	if err := efistate.Db.Append(signature.CERT_X509_GUID, *guid, unknown); err != nil {
+		t.Fatal(err)
+	}
+	if err := efistate.EnrollKey(efivar.Db, kh); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := ListEnrolledKeys(state)
+	if err != nil {
+		t.Fatalf("failed listing enrolled keys: %v", err)
+	}
+	labels := map[string]int{}
+	for _, k := range keys.Db {
+		labels[k.Label]++
+	}
+	if labels[keyLabelSbctl] != 1 || labels["microsoft"] != len(*microsoft) || labels[keyLabelUnknown] != 1 {
+		t.Fatalf("unexpected labels in db: %v", labels)
+	}
+
+	issues := statusIssues(&Status{Installed: true, SecureBoot: true, EnrolledKeys: keys})
+	var found bool
+	for _, issue := range issues {
+		if issue.ID == statusIssueUnknownKey {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected the unknown certificate to be reported, got %+v", issues)
+	}
+}
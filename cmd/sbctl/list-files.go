@@ -1,30 +1,126 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"text/tabwriter"
 
 	"github.com/foxboron/sbctl"
 	"github.com/foxboron/sbctl/backend"
 	"github.com/foxboron/sbctl/config"
-	"github.com/foxboron/sbctl/hierarchy"
 	"github.com/foxboron/sbctl/logging"
 	"github.com/foxboron/sbctl/lsm"
+	"github.com/foxboron/sbctl/stringset"
 	"github.com/spf13/cobra"
 )
 
-var listFilesCmd = &cobra.Command{
-	Use: "list-files",
-	Aliases: []string{
-		"ls-files",
-		"ls",
-	},
-	Short: "List enrolled files",
-	RunE:  RunList,
+// Statuses of the tracked files
+const (
+	fileStatusSigned   = "signed"
+	fileStatusUnsigned = "unsigned"
+	fileStatusMissing  = "missing"
+	fileStatusMismatch = "mismatch"
+)
+
+type ListFilesCmdOptions struct {
+	OutputFormat stringset.StringSet
+	Filter       stringset.StringSet
 }
 
+var (
+	listFilesCmdOptions = ListFilesCmdOptions{
+		OutputFormat: stringset.StringSet{Allowed: []string{"plain", "table", "json"}, Value: "plain"},
+		Filter: stringset.StringSet{
+			Allowed: []string{"all", fileStatusSigned, fileStatusUnsigned, fileStatusMissing, fileStatusMismatch},
+			Value:   "all",
+		},
+	}
+	listFilesCmd = &cobra.Command{
+		Use: "list-files",
+		Aliases: []string{
+			"ls-files",
+			"ls",
+		},
+		Short: "List enrolled files",
+		Long: `List enrolled files.
+
+The files are checked like verify does. A file is signed if the db key or an
+imported certificate signed it, missing if it or the file it is signed from
+doesn't exist, and mismatch if it is signed but the file it is signed from
+has changed since. --filter only lists the files with that status.`,
+		RunE: RunList,
+	}
+)
+
 type JsonFile struct {
 	sbctl.SigningEntry
-	IsSigned bool `json:"is_signed"`
+	IsSigned      bool   `json:"is_signed"`
+	ChecksumMatch bool   `json:"checksum_match"`
+	Status        string `json:"status"`
+}
+
+// listFile checks the tracked file with the checks of verify
+func listFile(state *config.State, kh *backend.KeyHierarchy, s *sbctl.SigningEntry) (JsonFile, error) {
+	f := JsonFile{SigningEntry: *s, Status: fileStatusMissing}
+	ok, _, err := sbctl.VerifyFileTrusted(state, kh, s.OutputFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	} else if err != nil {
+		return f, fmt.Errorf("%s: %w", s.OutputFile, err)
+	}
+	f.IsSigned = ok
+	match, err := sbctl.ChecksumMatches(state, s.File, s.OutputFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	} else if err != nil {
+		return f, fmt.Errorf("%s: %w", s.File, err)
+	}
+	f.ChecksumMatch = match
+	switch {
+	case !ok:
+		f.Status = fileStatusUnsigned
+	case !match:
+		f.Status = fileStatusMismatch
+	default:
+		f.Status = fileStatusSigned
+	}
+	return f, nil
+}
+
+func printFilePlain(f JsonFile) {
+	logging.Println(f.File)
+	logging.Print("Signed:\t\t")
+	switch f.Status {
+	case fileStatusMissing:
+		logging.NotOk("Missing")
+	case fileStatusUnsigned:
+		logging.NotOk("Not Signed")
+	case fileStatusMismatch:
+		logging.NotOk("Changed since it was signed")
+	default:
+		logging.Ok("Signed")
+	}
+	if f.File != f.OutputFile {
+		logging.Print("Output File:\t%s\n", f.OutputFile)
+	}
+	logging.Println("")
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func printFilesTable(files []JsonFile) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tSIGNED\tCHECKSUM MATCH")
+	for _, f := range files {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", f.OutputFile, yesNo(f.IsSigned), yesNo(f.ChecksumMatch))
+	}
+	return w.Flush()
 }
 
 func RunList(cmd *cobra.Command, args []string) error {
@@ -39,47 +135,69 @@ func RunList(cmd *cobra.Command, args []string) error {
 		}
 	}
 
+	format := listFilesCmdOptions.OutputFormat.Value
+	if cmdOptions.StructuredOutput() {
+		format = "json"
+	}
+	if format == "json" {
+		logging.PrintOff()
+	}
+
+	// json is streamed as the files are checked, only the table needs all of
+	// them
+	filter := listFilesCmdOptions.Filter.Value
 	files := []JsonFile{}
-	var isSigned bool
+	stream := &StructuredStream{}
 	err := sbctl.SigningEntryIter(state,
 		func(s *sbctl.SigningEntry) error {
 			kh, err := backend.GetKeyHierarchy(state.Fs, state)
 			if err != nil {
 				return err
 			}
-			ok, err := sbctl.VerifyFile(state, kh, hierarchy.Db, s.OutputFile)
+			f, err := listFile(state, kh, s)
 			if err != nil {
-				logging.Error(fmt.Errorf("%s: %w", s.OutputFile, err))
+				logging.Error(err)
 				logging.Error(fmt.Errorf(""))
 				return nil
 			}
-			logging.Println(s.File)
-			logging.Print("Signed:\t\t")
-			if ok {
-				isSigned = true
-				logging.Ok("Signed")
-			} else if !ok {
-				isSigned = false
-				logging.NotOk("Not Signed")
+			if filter != "all" && f.Status != filter {
+				return nil
 			}
-			if s.File != s.OutputFile {
-				logging.Print("Output File:\t%s\n", s.OutputFile)
+			switch format {
+			case "plain":
+				printFilePlain(f)
+			case "json":
+				return stream.Add(f)
+			case "table":
+				files = append(files, f)
 			}
-			logging.Println("")
-			files = append(files, JsonFile{*s, isSigned})
 			return nil
 		},
 	)
+	if format == "json" {
+		// Close the listing so the output is valid json up to the error
+		if err := stream.Close(); err != nil {
+			return err
+		}
+	}
 	if err != nil {
 		return err
 	}
-	if cmdOptions.JsonOutput {
-		return JsonOut(files)
+	if format == "table" {
+		return printFilesTable(files)
 	}
 	return nil
 }
 
+func listFilesCmdFlags(cmd *cobra.Command) {
+	f := cmd.Flags()
+	f.VarPF(&listFilesCmdOptions.OutputFormat, "output-format", "", "output format")
+	f.VarPF(&listFilesCmdOptions.Filter, "filter", "", "only list the files with this status")
+	_ = cmd.RegisterFlagCompletionFunc("filter", completeStringSet(&listFilesCmdOptions.Filter))
+}
+
 func init() {
+	listFilesCmdFlags(listFilesCmd)
 	CliCommands = append(CliCommands, cliCommand{
 		Cmd: listFilesCmd,
 	})
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/foxboron/sbctl"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+func TestListFilesChecksumMatch(t *testing.T) {
+	state := setupRotateState(t)
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.WithValue(context.Background(), stateDataKey{}, state))
+
+	var files []JsonFile
+	if err := captureJsonOutput(&files, func() error {
+		return RunList(cmd, []string{})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || !files[0].IsSigned || !files[0].ChecksumMatch {
+		t.Fatalf("expected a signed and matching file, got %+v", files)
+	}
+
+	// Modify the input to simulate an update that hasn't been signed yet
+	b, err := afero.ReadFile(state.Fs, "/boot/test.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)/4] ^= 0xff
+	if err := afero.WriteFile(state.Fs, "/boot/test.efi", b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := captureJsonOutput(&files, func() error {
+		return RunList(cmd, []string{})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].ChecksumMatch {
+		t.Fatalf("expected a checksum mismatch, got %+v", files)
+	}
+}
+
+func TestListFilesFilter(t *testing.T) {
+	state := setupRotateState(t)
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.WithValue(context.Background(), stateDataKey{}, state))
+
+	files, err := sbctl.ReadFileDatabase(state.Fs, state.Config.FilesDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files["/boot/gone.efi"] = &sbctl.SigningEntry{File: "/boot/gone.efi", OutputFile: "/boot/gone.efi"}
+	if err := sbctl.WriteFileDatabase(state.Fs, state.Config.FilesDb, files); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { listFilesCmdOptions.Filter.Value = "all" }()
+
+	list := func(filter string) []JsonFile {
+		t.Helper()
+		if err := listFilesCmdOptions.Filter.Set(filter); err != nil {
+			t.Fatal(err)
+		}
+		var listed []JsonFile
+		if err := captureJsonOutput(&listed, func() error {
+			return RunList(cmd, []string{})
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return listed
+	}
+	if listed := list("all"); len(listed) != 2 {
+		t.Fatalf("expected both files, got %+v", listed)
+	}
+	if listed := list("missing"); len(listed) != 1 || listed[0].OutputFile != "/boot/gone.efi" {
+		t.Fatalf("expected the missing file, got %+v", listed)
+	}
+	if listed := list("signed"); len(listed) != 1 || listed[0].OutputFile != "/boot/new.efi" || listed[0].Status != "signed" {
+		t.Fatalf("expected the signed file, got %+v", listed)
+	}
+
+	b, err := afero.ReadFile(state.Fs, "/boot/test.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)/4] ^= 0xff
+	if err := afero.WriteFile(state.Fs, "/boot/test.efi", b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if listed := list("mismatch"); len(listed) != 1 || listed[0].OutputFile != "/boot/new.efi" {
+		t.Fatalf("expected the changed file, got %+v", listed)
+	}
+	if listed := list("unsigned"); len(listed) != 0 {
+		t.Fatalf("expected no unsigned files, got %+v", listed)
+	}
+}
+
+func TestStructuredStream(t *testing.T) {
+	defer func() { cmdOptions.JsonOutput, cmdOptions.JsonCompact = false, false }()
+	cmdOptions.JsonOutput = true
+	for _, files := range [][]JsonFile{
+		{},
+		{{Status: fileStatusSigned}},
+		{{Status: fileStatusSigned}, {Status: fileStatusMissing, IsSigned: true}},
+	} {
+		want, _ := captureOutput(func() error { return JsonOut(files) })
+		got, _ := captureOutput(func() error {
+			stream := &StructuredStream{}
+			for _, f := range files {
+				if err := stream.Add(f); err != nil {
+					return err
+				}
+			}
+			return stream.Close()
+		})
+		if !bytes.Equal(got, want) {
+			t.Fatalf("expected the stream to match JsonOut:\n%s\ngot:\n%s", want, got)
+		}
+	}
+}
+
+func TestListFilesJsonCompact(t *testing.T) {
+	state := setupRotateState(t)
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.WithValue(context.Background(), stateDataKey{}, state))
+
+	files, err := sbctl.ReadFileDatabase(state.Fs, state.Config.FilesDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files["/boot/gone.efi"] = &sbctl.SigningEntry{File: "/boot/gone.efi", OutputFile: "/boot/gone.efi"}
+	if err := sbctl.WriteFileDatabase(state.Fs, state.Config.FilesDb, files); err != nil {
+		t.Fatal(err)
+	}
+
+	cmdOptions.JsonCompact = true
+	defer func() { cmdOptions.JsonCompact = false }()
+	out, err := captureOutput(func() error {
+		return RunList(cmd, []string{})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := bytes.Split(bytes.TrimSpace(out), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("expected one line per file, got %s", out)
+	}
+	for _, line := range lines {
+		var f JsonFile
+		if err := json.Unmarshal(line, &f); err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/foxboron/sbctl/config"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+var ErrLocked = errors.New("another sbctl process is running")
+
+// lockPollInterval is how often the lock is retried while waiting for it
+const lockPollInterval = 100 * time.Millisecond
+
+// lockPath is the lockfile in the state directory, next to the file
+// database. Profiles share the file database, so they share the lock as well.
+func lockPath(state *config.State) string {
+	return filepath.Join(filepath.Dir(filepath.Clean(state.Config.FilesDb)), "sbctl.lock")
+}
+
+// needsLock returns true if cmd, or the command it belongs to, changes the
+// keys, the file database or the EFI variables
+func needsLock(cmd *cobra.Command) bool {
+	for ; cmd != nil; cmd = cmd.Parent() {
+		for _, c := range CliCommands {
+			if c.Cmd == cmd && c.Lock {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// acquireLock takes an exclusive flock on path, waiting up to timeout for
+// another sbctl process to release it. The lock is held until the returned
+// file is closed, or sbctl exits.
+func acquireLock(path string, timeout time.Duration) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, unix.EWOULDBLOCK) {
+			f.Close()
+			return nil, fmt.Errorf("can't lock %s: %w", path, err)
+		}
+		if time.Now().After(deadline) {
+			pid := lockHolder(f)
+			f.Close()
+			if pid != "" {
+				return nil, fmt.Errorf("%w (pid %s), gave up waiting for %s after %s", ErrLocked, pid, path, timeout)
+			}
+			return nil, fmt.Errorf("%w, gave up waiting for %s after %s", ErrLocked, path, timeout)
+		}
+		slog.Debug("waiting for the lock", slog.String("path", path))
+		time.Sleep(lockPollInterval)
+	}
+	// The pid is only informational, for the error of the next process
+	if err := f.Truncate(0); err == nil {
+		_, _ = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return f, nil
+}
+
+// lockHolder returns the pid written to the lockfile by the process holding
+// the lock
+func lockHolder(f *os.File) string {
+	b := make([]byte, 32)
+	n, _ := f.ReadAt(b, 0)
+	pid := strings.TrimSpace(string(b[:n]))
+	if _, err := strconv.Atoi(pid); err != nil {
+		return ""
+	}
+	return pid
+}
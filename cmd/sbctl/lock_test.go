@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcquireLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sbctl", "sbctl.lock")
+	lock, err := acquireLock(path, 0)
+	if err != nil {
+		t.Fatalf("failed taking the lock: %v", err)
+	}
+
+	start := time.Now()
+	_, err = acquireLock(path, 300*time.Millisecond)
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+	if time.Since(start) < 300*time.Millisecond {
+		t.Fatalf("expected to wait for the lock before giving up")
+	}
+	if !strings.Contains(err.Error(), "pid "+strconv.Itoa(os.Getpid())) {
+		t.Fatalf("expected the pid of the holder in the error, got %v", err)
+	}
+
+	// The lock is free once the holder is done
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		lock.Close()
+	}()
+	lock, err = acquireLock(path, 5*time.Second)
+	if err != nil {
+		t.Fatalf("failed taking the released lock: %v", err)
+	}
+	lock.Close()
+
+	if !needsLock(signAllCmd) || !needsLock(enrollKeysCmd) || needsLock(statusCmd) || needsLock(verifyCmd) {
+		t.Fatalf("unexpected commands holding the lock")
+	}
+	// Only the subcommands which write the state take the lock
+	if !needsLock(configSetCmd) || !needsLock(profileUseCmd) || !needsLock(tpmSaveGoldenCmd) || needsLock(configGetCmd) || needsLock(profileListCmd) || needsLock(tpmPredictCmd) {
+		t.Fatalf("unexpected subcommands holding the lock")
+	}
+}
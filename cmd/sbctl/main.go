@@ -5,35 +5,83 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
-	"github.com/foxboron/go-uefi/efivarfs"
 	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/backend"
 	"github.com/foxboron/sbctl/config"
 	"github.com/foxboron/sbctl/logging"
 	"github.com/foxboron/sbctl/lsm"
 	"github.com/google/go-tpm/tpm2/transport"
+	"github.com/landlock-lsm/go-landlock/landlock"
 	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
+
+	yaml "github.com/goccy/go-yaml"
 )
 
 type CmdOptions struct {
 	JsonOutput      bool
+	JsonCompact     bool
+	YamlOutput      bool
 	QuietOutput     bool
 	Config          string
+	ConfigOnly      bool
+	Keydir          string
+	EfivarfsPath    string
 	DisableLandlock bool
 	Debug           bool
+	LogFormat       string
+	TPMTimeout      time.Duration
+	LandlockAllow   []string
+	DryRun          bool
+	ChattrAuto      bool
+	ConcurrencySafe bool
+	LockTimeout     time.Duration
 }
 
 type cliCommand struct {
+	// Cmd is added to the root command, unless it is a subcommand which has
+	// been added to its group already
 	Cmd *cobra.Command
+	// Efivarfs is true for commands which can't run without the EFI
+	// variables
+	Efivarfs bool
+	// DryRun is true for commands which write EFI variables. They get the
+	// --dry-run flag, which records the writes instead.
+	DryRun bool
+	// Lock is true for commands which change the keys, the file database or
+	// the EFI variables. With --concurrency-safe they hold the sbctl lock
+	// while they run, so overlapping runs can't corrupt the state.
+	Lock bool
+	// Hooks is true for commands which sign files or write EFI variables, and
+	// run the hooks of the configuration. Landlock is disabled in them when
+	// hooks are configured.
+	Hooks bool
 }
 
 type stateDataKey struct{}
 
+// ExitCodeError exits sbctl with Code, printing Err if it is set
+type ExitCodeError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitCodeError) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("exit code %d", e.Code)
+}
+
+func (e *ExitCodeError) Unwrap() error { return e.Err }
+
 var (
 	cmdOptions  = CmdOptions{}
 	CliCommands = []cliCommand{}
@@ -54,102 +102,373 @@ There are three flags that can be used:
 Please read the FAQ for more information: https://github.com/Foxboron/sbctl/wiki/FAQ#option-rom`
 	opromErrorMsg      = `Found OptionROM in the bootchain. This means we should not enroll keys into UEFI without some precautions.` + baseErrorMsg
 	noEventlogErrorMsg = `Could not find any TPM Eventlog in the system. This means we do not know if there is any OptionROM present on the system.` + baseErrorMsg
+	immutableErrorMsg  = `The immutable attribute of the files in efivarfs could not be cleared, or clearing it was disabled with --chattr-auto=false. Run chattr -i on the files in /sys/firmware/efi/efivars.`
 	setupModeDisabled  = `Your system is not in Setup Mode! Please reboot your machine and reset secure boot keys before attempting to enroll the keys.`
+	pcrsChangedMsg     = `The signing key is sealed to the TPM and the PCR values it was sealed to have changed. PCR 7 changes when the Secure Boot state or the enrolled keys change.
+Boot with the Secure Boot configuration the key was created under to use it.`
 )
 
 func baseFlags(cmd *cobra.Command) {
 	flags := cmd.PersistentFlags()
 	flags.BoolVar(&cmdOptions.JsonOutput, "json", false, "Output as json")
+	flags.BoolVar(&cmdOptions.JsonCompact, "json-compact", false, "Output as compact json, with listings printed as one json object per line")
+	flags.BoolVar(&cmdOptions.YamlOutput, "yaml", false, "Output as yaml")
 	flags.BoolVar(&cmdOptions.QuietOutput, "quiet", false, "Mute info from logging")
 	flags.BoolVar(&cmdOptions.DisableLandlock, "disable-landlock", false, "Disable landlock sandboxing")
+	flags.StringSliceVar(&cmdOptions.LandlockAllow, "landlock-allow", nil, "Allow reading and writing in the directory under landlock")
 	flags.BoolVar(&cmdOptions.Debug, "debug", false, "Enable verbose debug logging")
+	flags.StringVar(&cmdOptions.LogFormat, "log-format", "text", "Format of the log messages, text or json")
 	flags.StringVarP(&cmdOptions.Config, "config", "", "", "Path to configuration file")
+	_ = cmd.RegisterFlagCompletionFunc("config", completeConfigFiles)
+	flags.BoolVar(&cmdOptions.ConfigOnly, "config-only", false, "Only use the configuration given with --config or $SBCTL_CONFIG, without falling back to the system configuration")
+	flags.StringVarP(&cmdOptions.Keydir, "keydir", "", "", "Path to the key directory, overrides the active profile")
+	flags.StringVarP(&cmdOptions.EfivarfsPath, "efivarfs-path", "", "", "Read and write EFI variables in this directory instead of efivarfs")
+	flags.DurationVar(&cmdOptions.TPMTimeout, "tpm-timeout", 5*time.Second, "Consider the TPM unavailable if it doesn't respond within this duration")
+	flags.BoolVar(&cmdOptions.ChattrAuto, "chattr-auto", true, "Clear the immutable attribute of EFI variables which can't be written because of it")
+	flags.BoolVar(&cmdOptions.ConcurrencySafe, "concurrency-safe", true, "Lock the state directory in commands which change it, so other sbctl processes wait for them")
+	flags.DurationVar(&cmdOptions.LockTimeout, "lock-timeout", 30*time.Second, "How long to wait for another sbctl process to release the lock")
 }
 
 func JsonOut(v interface{}) error {
-	b, err := json.MarshalIndent(v, "", "  ")
+	var b []byte
+	var err error
+	if cmdOptions.JsonCompact {
+		b, err = json.Marshal(v)
+	} else {
+		b, err = json.MarshalIndent(v, "", "  ")
+	}
 	if err != nil {
 		return fmt.Errorf("could not marshal json: %w", err)
 	}
 	logging.PrintOn()
-	logging.Println(string(b))
+	logging.Print("%s\n", b)
 	// Json should always be the last print call, but lets safe it :)
 	logging.PrintOff()
 	return nil
 }
 
+// YamlOut prints v as yaml. It is converted from the json encoding so both
+// outputs share the same schema.
+func YamlOut(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("could not marshal json: %w", err)
+	}
+	b, err = yaml.JSONToYAML(b)
+	if err != nil {
+		return fmt.Errorf("could not marshal yaml: %w", err)
+	}
+	logging.PrintOn()
+	logging.Print("%s", b)
+	logging.PrintOff()
+	return nil
+}
+
+// StructuredOutput is true when either --json, --json-compact or --yaml has
+// been passed
+func (c *CmdOptions) StructuredOutput() bool {
+	return c.JsonOutput || c.JsonCompact || c.YamlOutput
+}
+
+// StructuredOut prints v in the requested machine readable format
+func StructuredOut(v interface{}) error {
+	if cmdOptions.YamlOutput {
+		return YamlOut(v)
+	}
+	return JsonOut(v)
+}
+
+// StructuredStream prints a listing one element at a time, so the output starts
+// right away and the listing isn't kept in memory. The json output is the same
+// as StructuredOut of the whole slice, and with --json-compact every element is
+// printed on its own line instead. yaml is printed on Close.
+type StructuredStream struct {
+	count int
+	yaml  []any
+}
+
+func (s *StructuredStream) Add(v any) error {
+	if cmdOptions.YamlOutput {
+		s.yaml = append(s.yaml, v)
+		return nil
+	}
+	var b []byte
+	var err error
+	if cmdOptions.JsonCompact {
+		b, err = json.Marshal(v)
+	} else {
+		b, err = json.MarshalIndent(v, "  ", "  ")
+	}
+	if err != nil {
+		return fmt.Errorf("could not marshal json: %w", err)
+	}
+	logging.PrintOn()
+	switch {
+	case cmdOptions.JsonCompact:
+		logging.Print("%s\n", b)
+	case s.count == 0:
+		logging.Print("[\n  %s", b)
+	default:
+		logging.Print(",\n  %s", b)
+	}
+	logging.PrintOff()
+	s.count++
+	return nil
+}
+
+// Close ends the listing
+func (s *StructuredStream) Close() error {
+	if cmdOptions.YamlOutput {
+		if s.yaml == nil {
+			s.yaml = []any{}
+		}
+		return YamlOut(s.yaml)
+	}
+	if cmdOptions.JsonCompact {
+		return nil
+	}
+	logging.PrintOn()
+	if s.count == 0 {
+		logging.Print("[]\n")
+	} else {
+		logging.Print("\n]\n")
+	}
+	logging.PrintOff()
+	return nil
+}
+
+func hasOldConfig(fs afero.Fs) bool {
+	return config.HasOldConfig(fs, sbctl.DatabasePath) && !config.HasConfigurationFile(fs, "/etc/sbctl/sbctl.conf")
+}
+
+// configEnv is read for the configuration file if --config isn't given
+const configEnv = "SBCTL_CONFIG"
+
+var ErrNoExplicitConfig = errors.New("--config-only requires a configuration file from --config or $" + configEnv)
+
+// explicitConfigPath returns the configuration file given with --config or
+// $SBCTL_CONFIG
+func explicitConfigPath() string {
+	if cmdOptions.Config != "" {
+		return cmdOptions.Config
+	}
+	return os.Getenv(configEnv)
+}
+
+// readConfig reads the configuration given with --config or $SBCTL_CONFIG, or
+// the system configuration. With --config-only there is no fallback to the
+// system or default configuration.
+func readConfig(fs afero.Fs) (*config.Config, error) {
+	if p := explicitConfigPath(); p != "" {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		// TODO: Do we want to overwrite the provided configuration with out existing keys?
+		// something to figure out
+		// kh, err := backend.GetKeyHierarchy(fs, state)
+		// if err != nil {
+		// 	return err
+		// }
+		// state.Config.Keys = kh.GetConfig(state.Config.Keydir)
+		// state.Config.DbAdditions = sbctl.GetEnrolledVendorCerts()
+		return config.NewConfigFormat(b, config.DetectFormat(p, b))
+	}
+	if cmdOptions.ConfigOnly {
+		return nil, ErrNoExplicitConfig
+	}
+	if hasOldConfig(fs) {
+		return config.OldConfig(sbctl.DatabasePath), nil
+	}
+	if ok, _ := afero.Exists(fs, "/etc/sbctl/sbctl.conf"); ok {
+		b, err := os.ReadFile("/etc/sbctl/sbctl.conf")
+		if err != nil {
+			return nil, err
+		}
+		return config.NewConfig(b)
+	}
+	return config.DefaultConfig(), nil
+}
+
+// setupLogging sets up slog for --debug and --log-format. Structured logs are
+// written to stderr, so they can be used along with --json.
+func setupLogging() error {
+	opts := &slog.HandlerOptions{
+		Level: slog.LevelInfo,
+	}
+	if cmdOptions.Debug {
+		opts.Level = slog.LevelDebug
+	}
+	switch cmdOptions.LogFormat {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, opts)))
+	case "json":
+		logger := slog.New(slog.NewJSONHandler(os.Stderr, opts))
+		slog.SetDefault(logger)
+		logging.SetLogger(logger)
+	default:
+		return fmt.Errorf("unknown log format %q, must be text or json", cmdOptions.LogFormat)
+	}
+	return nil
+}
+
+// needsEfivarfs returns true if cmd, or the command it belongs to, needs the
+// EFI variables
+func needsEfivarfs(cmd *cobra.Command) bool {
+	for ; cmd != nil; cmd = cmd.Parent() {
+		for _, c := range CliCommands {
+			if c.Cmd == cmd && c.Efivarfs {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// runsHooks returns true if cmd, or the command it belongs to, runs the hooks
+func runsHooks(cmd *cobra.Command) bool {
+	for ; cmd != nil; cmd = cmd.Parent() {
+		for _, c := range CliCommands {
+			if c.Cmd == cmd && c.Hooks {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requireEfivarfs returns ErrNoEfivarfs if the EFI variables can't be read,
+// for commands which only need them for some flags
+func requireEfivarfs(state *config.State) error {
+	if !sbctl.EfivarfsAvailable(state.Efivarfs) {
+		return sbctl.ErrNoEfivarfs
+	}
+	return nil
+}
+
+// checkImmutable returns ErrImmutable if files in efivarfs are immutable.
+// With --chattr-auto the immutable attribute is cleared instead, and the
+// error is only returned if that fails.
+func checkImmutable(state *config.State) error {
+	err := sbctl.CheckImmutable(state.Fs)
+	if !errors.Is(err, sbctl.ErrImmutable) || !cmdOptions.ChattrAuto {
+		return err
+	}
+	if uerr := sbctl.UnsetImmutable(state.Fs); uerr != nil {
+		logging.Warn("%v", uerr)
+		return err
+	}
+	if sbctl.CheckImmutable(state.Fs) != nil {
+		return err
+	}
+	return nil
+}
+
 func main() {
 	for _, cmd := range CliCommands {
-		rootCmd.AddCommand(cmd.Cmd)
+		if !cmd.Cmd.HasParent() {
+			rootCmd.AddCommand(cmd.Cmd)
+		}
+		if cmd.DryRun {
+			dryRunFlags(cmd.Cmd)
+		}
 	}
 
 	fs := afero.NewOsFs()
 
 	baseFlags(rootCmd)
 
-	// We save tpmerr and print it when we can print debug messages
-	rwc, tpmerr := transport.OpenTPM()
-	if tpmerr == nil {
-		defer rwc.Close()
-	}
+	var rwc transport.TPMCloser
+	var lock *os.File
+	var enrollHooks *sbctl.EnrollHooks
+	defer func() {
+		if rwc != nil {
+			rwc.Close()
+		}
+		if lock != nil {
+			lock.Close()
+		}
+	}()
 
 	// We need to set this after we have parsed stuff
 	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, _ []string) error {
+		if err := setupLogging(); err != nil {
+			return err
+		}
+
+		var tpmerr error
+		rwc, tpmerr = openTPM(cmd.Context(), transport.OpenTPM, cmdOptions.TPMTimeout)
+		if tpmerr != nil {
+			slog.Debug("can't open tpm", slog.Any("err", tpmerr))
+		}
+
 		state := &config.State{
 			Fs: fs,
 			TPM: func() transport.TPMCloser {
 				return rwc
 			},
-			Efivarfs: efivarfs.NewFS().
-				CheckImmutable().
-				UnsetImmutable().
-				Open(),
+			Efivarfs:   sbctl.OpenEfivarfs(),
+			Passphrase: keyPassphrase(fs),
+		}
+		if cmdOptions.EfivarfsPath != "" {
+			state.Efivarfs = sbctl.OpenEfivarsDir(fs, cmdOptions.EfivarfsPath)
+		} else if cmdOptions.ChattrAuto {
+			state.Efivarfs = sbctl.ChattrEfivarWrites(state.Efivarfs)
 		}
 
-		var conf *config.Config
-
-		if cmdOptions.Config != "" {
-			b, err := os.ReadFile(cmdOptions.Config)
-			if err != nil {
+		conf, err := readConfig(fs)
+		if err != nil {
+			// config validate reports the errors in the configuration
+			if cmd != configValidateCmd || cmdOptions.ConfigOnly {
 				return err
 			}
-			conf, err = config.NewConfig(b)
-			if err != nil {
+			conf = config.DefaultConfig()
+		}
+		if explicitConfigPath() == "" && cmd != migrateCmd && hasOldConfig(fs) {
+			logging.Error(fmt.Errorf("old configuration detected. Please use `sbctl migrate`"))
+		}
+		state.Config = conf
+
+		state.Efivarfs, err = sbctl.RetryEfivarWrites(state.Efivarfs, state.Config)
+		if err != nil {
+			return err
+		}
+		state.Efivarfs, enrollHooks = sbctl.HookEfivarWrites(state.Efivarfs, state.Config)
+		// Fail early instead of with errors from reading the variables
+		if needsEfivarfs(cmd) {
+			if err := requireEfivarfs(state); err != nil {
 				return err
 			}
+		}
+		if cmdOptions.DryRun {
+			state.Efivarfs, dryRunPlan = sbctl.DryRunEfivarWrites(state.Efivarfs)
+		}
 
-			state.Config = conf
-
-			// TODO: Do we want to overwrite the provided configuration with out existing keys?
-			// something to figure out
-			// kh, err := backend.GetKeyHierarchy(fs, state)
-			// if err != nil {
-			// 	return err
-			// }
-			// state.Config.Keys = kh.GetConfig(state.Config.Keydir)
-			// state.Config.DbAdditions = sbctl.GetEnrolledVendorCerts()
-		} else {
-			if config.HasOldConfig(fs, sbctl.DatabasePath) && !config.HasConfigurationFile(fs, "/etc/sbctl/sbctl.conf") {
-				logging.Error(fmt.Errorf("old configuration detected. Please use `sbctl setup --migrate`"))
-				conf = config.OldConfig(sbctl.DatabasePath)
-				state.Config = conf
-			} else if ok, _ := afero.Exists(fs, "/etc/sbctl/sbctl.conf"); ok {
-				b, err := os.ReadFile("/etc/sbctl/sbctl.conf")
-				if err != nil {
-					log.Fatal(err)
-				}
-				conf, err = config.NewConfig(b)
-				if err != nil {
-					log.Fatal(err)
-				}
-				state.Config = conf
-			} else {
-				conf = config.DefaultConfig()
-				state.Config = conf
+		// The active profile is state of the host, so it is ignored with
+		// --config-only
+		if cmdOptions.Keydir != "" {
+			state.Config.SetKeydir(cmdOptions.Keydir)
+		} else if cmdOptions.ConfigOnly {
+			slog.Debug("ignoring the active profile with --config-only")
+		} else if err := state.Config.UseActiveProfile(fs); err != nil {
+			return fmt.Errorf("can't read active profile: %w", err)
+		}
+
+		if cmdOptions.ConcurrencySafe && needsLock(cmd) {
+			lock, err = acquireLock(lockPath(state), cmdOptions.LockTimeout)
+			if err != nil {
+				return err
 			}
 		}
 
-		if cmdOptions.JsonOutput {
+		// --json-compact only changes how the json is printed
+		if cmdOptions.JsonCompact {
+			cmdOptions.JsonOutput = true
+		}
+		if cmdOptions.JsonOutput && cmdOptions.YamlOutput {
+			return fmt.Errorf("--json and --yaml can't be used together")
+		}
+		if cmdOptions.StructuredOutput() {
 			logging.PrintOff()
 		}
 		if cmdOptions.QuietOutput {
@@ -158,49 +477,80 @@ func main() {
 		if cmdOptions.DisableLandlock {
 			state.Config.Landlock = false
 		}
-
-		// Setup debug logging
-		opts := &slog.HandlerOptions{
-			Level: slog.LevelInfo,
-		}
-		if cmdOptions.Debug {
-			opts.Level = slog.LevelDebug
+		// The hooks inherit the restrictions, which would break most of them
+		if state.Config.Landlock && state.Config.Hooks.Configured() && runsHooks(cmd) {
+			logging.Warn("Landlock is disabled as hooks are configured")
+			state.Config.Landlock = false
 		}
-		logger := slog.New(slog.NewTextHandler(os.Stdout, opts))
-		slog.SetDefault(logger)
 
-		if !state.HasTPM() {
-			slog.Debug("can't open tpm", slog.Any("err", tpmerr))
+		// The directory is created before landlock, which ignores rules for
+		// missing paths
+		if writesStatusFile(cmd, state) {
+			if err := state.Fs.MkdirAll(filepath.Dir(state.Config.StatusFile), 0o755); err != nil {
+				return err
+			}
 		}
 
 		if state.Config.Landlock {
 			lsm.LandlockRulesFromConfig(state.Config)
+			extra := append(slices.Clone(state.Config.LandlockExtraPaths), cmdOptions.LandlockAllow...)
+			if err := lsm.LandlockExtraPaths(fs, extra); err != nil {
+				return err
+			}
+			if cmdOptions.EfivarfsPath != "" {
+				lsm.RestrictAdditionalPaths(landlock.RWDirs(cmdOptions.EfivarfsPath))
+			}
 		}
 		ctx := context.WithValue(cmd.Context(), stateDataKey{}, state)
 		cmd.SetContext(ctx)
 		return nil
 	}
 
+	rootCmd.PersistentPostRunE = func(cmd *cobra.Command, _ []string) error {
+		if dryRunPlan != nil {
+			return printDryRun(dryRunPlan)
+		}
+		// status writes the status it printed
+		if state, ok := cmd.Context().Value(stateDataKey{}).(*config.State); ok && cmd != statusCmd && writesStatusFile(cmd, state) {
+			updateStatusFile(state)
+		}
+		return nil
+	}
+
 	// This returns i the flag is not found with a specific error
 	rootCmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
 		cmd.Println(err)
 		cmd.Println(cmd.UsageString())
-		return ErrSilent
+		return &usageError{err}
 	})
 
-	if err := rootCmd.Execute(); err != nil {
+	err := rootCmd.Execute()
+	enrollHooks.Finish(err)
+	if err != nil {
+		if cmdOptions.StructuredOutput() {
+			exitStructuredError(err)
+		}
+		var exitErr *ExitCodeError
+		if errors.As(err, &exitErr) {
+			if exitErr.Err != nil {
+				logging.Error(exitErr.Err)
+			}
+			os.Exit(exitErr.Code)
+		}
 		if strings.HasPrefix(err.Error(), "unknown command") {
 			logging.Println(err.Error())
 		} else if errors.Is(err, os.ErrPermission) {
 			logging.Error(fmt.Errorf("sbctl requires root to run: %w", err))
 		} else if errors.Is(err, sbctl.ErrImmutable) {
-			logging.Println("You need to chattr -i files in efivarfs")
+			logging.Println(immutableErrorMsg)
 		} else if errors.Is(err, sbctl.ErrOprom) {
 			logging.Error(errors.New(opromErrorMsg))
 		} else if errors.Is(err, sbctl.ErrNoEventlog) {
 			logging.Error(errors.New(noEventlogErrorMsg))
 		} else if errors.Is(err, ErrSetupModeDisabled) {
 			logging.Error(errors.New(setupModeDisabled))
+		} else if errors.Is(err, backend.ErrPCRsChanged) {
+			logging.Error(fmt.Errorf("%w\n\n%s", err, pcrsChangedMsg))
 		} else if !errors.Is(err, ErrSilent) {
 			logging.Error(err)
 		}
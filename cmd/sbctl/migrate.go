@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/goccy/go-yaml"
+	"github.com/landlock-lsm/go-landlock/landlock"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+type MigrateCmdOptions struct {
+	BackupDir string
+	DryRun    bool
+}
+
+var (
+	migrateCmdOptions = MigrateCmdOptions{}
+	migrateCmd        = &cobra.Command{
+		Use:   "migrate",
+		Short: "Upgrade an installation from an older sbctl version",
+		Long: `Upgrade an installation from an older sbctl version.
+
+Moves the keys and databases kept in /usr/share/secureboot by older versions
+to /var/lib/sbctl, renames the databases to their current names and writes a
+configuration file if there is none. The old files are backed up first.
+Running it again on a migrated installation does nothing.`,
+		RunE: RunMigrate,
+	}
+
+	ErrMigrateConflict = errors.New("both the old and the current key directory exist")
+)
+
+// Migration is a layout of an older sbctl version that was upgraded
+type Migration struct {
+	Layout      string `json:"layout"`
+	Description string `json:"description"`
+}
+
+type MigrateResult struct {
+	DryRun     bool        `json:"dry_run"`
+	BackupDir  string      `json:"backup_dir,omitempty"`
+	Migrations []Migration `json:"migrations"`
+}
+
+// migrationStep upgrades one historical layout to the layout of conf
+type migrationStep struct {
+	layout string
+	// detect returns a description of the migration if the layout is found
+	detect  func(vfs afero.Fs, conf *config.Config) (string, bool)
+	migrate func(vfs afero.Fs, conf *config.Config) error
+}
+
+// oldDatabases are the database names used before they were renamed to .json
+func oldDatabases(dir string, conf *config.Config) [][2]string {
+	return [][2]string{
+		{path.Join(dir, "files.db"), conf.FilesDb},
+		{path.Join(dir, "bundles.db"), conf.BundlesDb},
+	}
+}
+
+// renameDatabases renames the old databases in dir that have no current
+// database yet
+func renameDatabases(vfs afero.Fs, dir string, conf *config.Config) error {
+	for _, db := range oldDatabases(dir, conf) {
+		old, current := db[0], db[1]
+		if ok, _ := afero.Exists(vfs, old); !ok {
+			continue
+		}
+		if ok, _ := afero.Exists(vfs, current); ok {
+			continue
+		}
+		if err := vfs.Rename(old, current); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var migrationSteps = []migrationStep{
+	{
+		// sbctl kept everything in /usr/share/secureboot before 0.14
+		layout: "secureboot-dir",
+		detect: func(vfs afero.Fs, conf *config.Config) (string, bool) {
+			dir := path.Dir(conf.Keydir)
+			if path.Clean(sbctl.DatabasePath) == dir {
+				return "", false
+			}
+			if ok, _ := afero.DirExists(vfs, sbctl.DatabasePath); !ok {
+				return "", false
+			}
+			return fmt.Sprintf("move %s to %s", path.Clean(sbctl.DatabasePath), dir), true
+		},
+		migrate: func(vfs afero.Fs, conf *config.Config) error {
+			if ok, _ := afero.DirExists(vfs, conf.Keydir); ok {
+				return fmt.Errorf("%w: remove %s or %s", ErrMigrateConflict, path.Clean(sbctl.DatabasePath), conf.Keydir)
+			}
+			dir := path.Dir(conf.Keydir)
+			if err := sbctl.CopyDirectory(vfs, sbctl.DatabasePath, dir); err != nil {
+				return err
+			}
+			if err := renameDatabases(vfs, dir, conf); err != nil {
+				return err
+			}
+			return vfs.RemoveAll(sbctl.DatabasePath)
+		},
+	},
+	{
+		// The databases were named files.db and bundles.db
+		layout: "database-names",
+		detect: func(vfs afero.Fs, conf *config.Config) (string, bool) {
+			var renames []string
+			for _, db := range oldDatabases(path.Dir(conf.FilesDb), conf) {
+				old, current := db[0], db[1]
+				if ok, _ := afero.Exists(vfs, old); !ok {
+					continue
+				}
+				if ok, _ := afero.Exists(vfs, current); ok {
+					continue
+				}
+				renames = append(renames, fmt.Sprintf("%s to %s", old, current))
+			}
+			if len(renames) == 0 {
+				return "", false
+			}
+			return "rename " + strings.Join(renames, " and "), true
+		},
+		migrate: func(vfs afero.Fs, conf *config.Config) error {
+			return renameDatabases(vfs, path.Dir(conf.FilesDb), conf)
+		},
+	},
+	{
+		// Installations without a configuration file use the defaults
+		layout: "configuration-file",
+		detect: func(vfs afero.Fs, conf *config.Config) (string, bool) {
+			if config.HasConfigurationFile(vfs, configPath()) {
+				return "", false
+			}
+			installed, _ := afero.DirExists(vfs, conf.Keydir)
+			old, _ := afero.DirExists(vfs, sbctl.DatabasePath)
+			if !installed && !old {
+				return "", false
+			}
+			return fmt.Sprintf("write %s", configPath()), true
+		},
+		migrate: func(vfs afero.Fs, conf *config.Config) error {
+			b, err := yaml.Marshal(conf)
+			if err != nil {
+				return err
+			}
+			if err := vfs.MkdirAll(filepath.Dir(configPath()), os.ModePerm); err != nil {
+				return err
+			}
+			return fs.WriteFile(vfs, configPath(), b, 0o644)
+		},
+	},
+}
+
+// migrationConfig returns the configuration the installation is migrated
+// to, the defaults unless there is a configuration file
+func migrationConfig(state *config.State) *config.Config {
+	if config.HasConfigurationFile(state.Fs, configPath()) {
+		return state.Config
+	}
+	return config.DefaultConfig()
+}
+
+// backupInstallation copies the directories of the current and the old
+// layout to backupDir
+func backupInstallation(vfs afero.Fs, conf *config.Config, backupDir string) error {
+	for _, dir := range []string{path.Clean(sbctl.DatabasePath), path.Dir(conf.Keydir)} {
+		if ok, _ := afero.DirExists(vfs, dir); !ok {
+			continue
+		}
+		if err := sbctl.CopyDirectory(vfs, dir, filepath.Join(backupDir, path.Base(dir))); err != nil {
+			return fmt.Errorf("failed backing up %s: %w", dir, err)
+		}
+	}
+	return nil
+}
+
+// MigrateInstallation upgrades every historical layout found to the current
+// one
+func MigrateInstallation(state *config.State, backupDir string, dryRun bool) (*MigrateResult, error) {
+	conf := migrationConfig(state)
+	result := &MigrateResult{
+		DryRun:     dryRun,
+		Migrations: []Migration{},
+	}
+	var pending []migrationStep
+	for _, step := range migrationSteps {
+		if desc, ok := step.detect(state.Fs, conf); ok {
+			result.Migrations = append(result.Migrations, Migration{Layout: step.layout, Description: desc})
+			pending = append(pending, step)
+		}
+	}
+	if len(pending) == 0 || dryRun {
+		return result, nil
+	}
+
+	if backupDir == "" {
+		backupDir = filepath.Join(tmpPath, fmt.Sprintf("sbctl_migrate_%d", time.Now().Unix()))
+	}
+	if err := backupInstallation(state.Fs, conf, backupDir); err != nil {
+		return nil, err
+	}
+	logging.Print("Backed up the installation to %s\n", backupDir)
+	result.BackupDir = backupDir
+
+	for i, step := range pending {
+		logging.Print("Migrating %s...", step.layout)
+		if err := step.migrate(state.Fs, conf); err != nil {
+			logging.NotOk("")
+			return nil, fmt.Errorf("failed to %s: %w", result.Migrations[i].Description, err)
+		}
+		logging.Ok("")
+	}
+	state.Config = conf
+	return result, nil
+}
+
+func RunMigrate(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+	conf := migrationConfig(state)
+
+	if state.Config.Landlock && !migrateCmdOptions.DryRun {
+		backupDir := tmpPath
+		if migrateCmdOptions.BackupDir != "" {
+			backupDir = filepath.Dir(filepath.Clean(migrateCmdOptions.BackupDir))
+		}
+		// The parent directories need to exist before landlock is applied
+		for _, dir := range []string{backupDir, path.Dir(conf.Keydir), filepath.Dir(configPath())} {
+			if err := state.Fs.MkdirAll(dir, os.ModePerm); err != nil {
+				return err
+			}
+		}
+		lsm.RestrictAdditionalPaths(
+			landlock.RWDirs(filepath.Dir(filepath.Clean(sbctl.DatabasePath))).IgnoreIfMissing(),
+			landlock.RWDirs(backupDir, path.Dir(conf.Keydir), filepath.Dir(configPath())),
+		)
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+
+	result, err := MigrateInstallation(state, migrateCmdOptions.BackupDir, migrateCmdOptions.DryRun)
+	if err != nil {
+		return err
+	}
+	if cmdOptions.StructuredOutput() {
+		return StructuredOut(result)
+	}
+	if len(result.Migrations) == 0 {
+		logging.Println("Nothing to migrate, the installation is up to date.")
+		return nil
+	}
+	for _, m := range result.Migrations {
+		if result.DryRun {
+			logging.Print("Would %s (%s)\n", m.Description, m.Layout)
+		} else {
+			logging.Print("Migrated %s: %s\n", m.Layout, m.Description)
+		}
+	}
+	return nil
+}
+
+func migrateCmdFlags(cmd *cobra.Command) {
+	f := cmd.Flags()
+	f.StringVarP(&migrateCmdOptions.BackupDir, "backup-dir", "b", "", "back up the old installation to directory")
+	f.BoolVarP(&migrateCmdOptions.DryRun, "dry-run", "", false, "print the migrations without changing anything")
+}
+
+func init() {
+	migrateCmdFlags(migrateCmd)
+	CliCommands = append(CliCommands, cliCommand{
+		Cmd:  migrateCmd,
+		Lock: true,
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/spf13/afero"
+)
+
+func TestMigrate(t *testing.T) {
+	logging.PrintOn()
+	vfs := afero.NewMemMapFs()
+	for f, data := range map[string]string{
+		"/usr/share/secureboot/GUID":             "2cf27a47-2dad-4a4e-9a4c-ff1c8b8e4b8e",
+		"/usr/share/secureboot/files.db":         "{}",
+		"/usr/share/secureboot/bundles.db":       "{}",
+		"/usr/share/secureboot/keys/PK/PK.key":   "pk",
+		"/usr/share/secureboot/keys/PK/PK.pem":   "pk",
+		"/usr/share/secureboot/keys/db/db.key":   "db",
+		"/usr/share/secureboot/keys/KEK/KEK.pem": "kek",
+	} {
+		if err := afero.WriteFile(vfs, f, []byte(data), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	state := &config.State{
+		Fs:     vfs,
+		Config: config.OldConfig("/usr/share/secureboot"),
+	}
+
+	result, err := MigrateInstallation(state, "/var/tmp/backup", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Migrations) != 2 {
+		t.Fatalf("expected 2 migrations, got %+v", result.Migrations)
+	}
+	if ok, _ := afero.DirExists(vfs, "/var/lib/sbctl"); ok {
+		t.Fatal("dry run created /var/lib/sbctl")
+	}
+
+	result, err = MigrateInstallation(state, "/var/tmp/backup", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.BackupDir != "/var/tmp/backup" {
+		t.Fatalf("unexpected backup directory %q", result.BackupDir)
+	}
+	for _, f := range []string{
+		"/var/tmp/backup/secureboot/files.db",
+		"/var/tmp/backup/secureboot/keys/PK/PK.key",
+		"/var/lib/sbctl/GUID",
+		"/var/lib/sbctl/files.json",
+		"/var/lib/sbctl/bundles.json",
+		"/var/lib/sbctl/keys/PK/PK.key",
+		"/var/lib/sbctl/keys/KEK/KEK.pem",
+		"/etc/sbctl/sbctl.conf",
+	} {
+		if ok, _ := afero.Exists(vfs, f); !ok {
+			t.Fatalf("%s is missing after the migration", f)
+		}
+	}
+	if ok, _ := afero.DirExists(vfs, "/usr/share/secureboot"); ok {
+		t.Fatal("/usr/share/secureboot was not removed")
+	}
+	b, err := afero.ReadFile(vfs, "/etc/sbctl/sbctl.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := config.NewConfig(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Keydir != "/var/lib/sbctl/keys" || conf.FilesDb != "/var/lib/sbctl/files.json" {
+		t.Fatalf("unexpected configuration %+v", conf)
+	}
+
+	// Nothing is left to migrate
+	result, err = MigrateInstallation(state, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Migrations) != 0 || result.BackupDir != "" {
+		t.Fatalf("expected no migrations, got %+v", result)
+	}
+}
+
+func TestMigrateDatabaseNames(t *testing.T) {
+	vfs := afero.NewMemMapFs()
+	for _, f := range []string{
+		"/etc/sbctl/sbctl.conf",
+		"/var/lib/sbctl/files.db",
+		"/var/lib/sbctl/bundles.json",
+		"/var/lib/sbctl/keys/db/db.key",
+	} {
+		if err := afero.WriteFile(vfs, f, []byte("{}"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	state := &config.State{
+		Fs:     vfs,
+		Config: config.DefaultConfig(),
+	}
+	result, err := MigrateInstallation(state, "/var/tmp/backup", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Migrations) != 1 || result.Migrations[0].Layout != "database-names" {
+		t.Fatalf("unexpected migrations %+v", result.Migrations)
+	}
+	if ok, _ := afero.Exists(vfs, "/var/lib/sbctl/files.json"); !ok {
+		t.Fatal("files.db was not renamed")
+	}
+	if ok, _ := afero.Exists(vfs, "/var/tmp/backup/sbctl/files.db"); !ok {
+		t.Fatal("files.db was not backed up")
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/landlock-lsm/go-landlock/landlock"
+	"github.com/spf13/cobra"
+)
+
+type MokEnrollCmdOptions struct {
+	PasswordFile string
+}
+
+// MokKeys are the Machine Owner Keys of shim
+type MokKeys struct {
+	Enrolled []EnrolledKey `json:"enrolled"`
+	// Waiting for confirmation in MokManager on the next boot
+	Pending []EnrolledKey `json:"pending"`
+}
+
+var (
+	mokEnrollCmdOptions = MokEnrollCmdOptions{}
+	mokCmd              = &cobra.Command{
+		Use:   "mok",
+		Short: "Manage the Machine Owner Keys of shim",
+	}
+	mokEnrollCmd = &cobra.Command{
+		Use:   "enroll [CERT]...",
+		Short: "Request the enrollment of certificates as MOKs",
+		Long: `Request the enrollment of certificates as Machine Owner Keys.
+
+The PEM or DER encoded certificates are written to the MokNew variable, with
+the password MokManager asks for. Without certificates the sbctl db
+certificate is enrolled, so shim trusts the files signed by sbctl.
+
+The enrollment has to be confirmed in MokManager, which shim starts on the
+next boot.`,
+		ValidArgsFunction: completeFiles,
+		RunE:              RunMokEnroll,
+	}
+	mokListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List the enrolled and pending MOKs",
+		RunE:  RunMokList,
+	}
+	mokCancelCmd = &cobra.Command{
+		Use:   "cancel",
+		Short: "Cancel the pending MOK enrollment",
+		RunE:  RunMokCancel,
+	}
+)
+
+const mokRebootMsg = `Reboot to finish the enrollment. shim starts MokManager, which asks to press a
+key to perform MOK management: choose "Enroll MOK", review the keys, confirm
+them and enter the password. The enrollment is discarded if it isn't confirmed
+during that boot.`
+
+// readMokPassword reads the MOK password from file, or prompts for it twice
+func readMokPassword(state *config.State, file string) ([]byte, error) {
+	if file != "" {
+		return readSecretFile(state.Fs, file, "password")
+	}
+	password, err := promptPassphrase("MOK password: ")
+	if err != nil {
+		return nil, err
+	}
+	again, err := promptPassphrase("Repeat MOK password: ")
+	if err != nil {
+		return nil, err
+	}
+	if string(password) != string(again) {
+		return nil, fmt.Errorf("passwords do not match")
+	}
+	return password, nil
+}
+
+// mokCertificates reads the certificates in files, or the sbctl db
+// certificate without files
+func mokCertificates(state *config.State, files []string) ([]*x509.Certificate, error) {
+	if len(files) == 0 {
+		kh, err := backend.GetKeyHierarchy(state.Fs, state)
+		if err != nil {
+			return nil, err
+		}
+		b, err := sbctl.DbEnrollCertificate(state, kh)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := x509.ParseCertificate(b)
+		if err != nil {
+			return nil, err
+		}
+		return []*x509.Certificate{cert}, nil
+	}
+	var certs []*x509.Certificate
+	for _, file := range files {
+		b, err := fs.ReadFile(state.Fs, file)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := sbctl.ParseCertificate(b)
+		if err != nil {
+			return nil, fmt.Errorf("can't read %s: %w", file, err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// ListMokKeys reads the enrolled and pending MOKs
+func ListMokKeys(state *config.State) (*MokKeys, error) {
+	enrolled, err := sbctl.GetMokList(state.Efivarfs)
+	if err != nil {
+		return nil, err
+	}
+	pending, err := sbctl.GetMokNew(state.Efivarfs)
+	if err != nil {
+		return nil, err
+	}
+	keys := &MokKeys{
+		Enrolled: enrolledKeys(enrolled),
+		Pending:  enrolledKeys(pending),
+	}
+	labelKeys(sbctlKeyFingerprints(state), keys.Enrolled, keys.Pending)
+	return keys, nil
+}
+
+func RunMokEnroll(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+	if state.Config.Landlock {
+		lsm.RestrictAdditionalPaths(landlock.ROFiles(args...).IgnoreIfMissing())
+		if mokEnrollCmdOptions.PasswordFile != "" {
+			lsm.RestrictAdditionalPaths(landlock.ROFiles(mokEnrollCmdOptions.PasswordFile))
+		}
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+
+	certs, err := mokCertificates(state, args)
+	if err != nil {
+		return err
+	}
+	password, err := readMokPassword(state, mokEnrollCmdOptions.PasswordFile)
+	if err != nil {
+		return err
+	}
+	defer clear(password)
+	if err := sbctl.EnrollMok(state.Efivarfs, certs, password); err != nil {
+		return err
+	}
+	// The writes are only printed
+	if cmdOptions.DryRun {
+		return nil
+	}
+
+	keys, err := ListMokKeys(state)
+	if err != nil {
+		return err
+	}
+	if cmdOptions.StructuredOutput() {
+		return StructuredOut(keys)
+	}
+	for _, cert := range certs {
+		logging.Ok("Requested the enrollment of %s", cert.Subject)
+	}
+	logging.Println("\n" + mokRebootMsg)
+	return nil
+}
+
+func RunMokList(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+	if state.Config.Landlock {
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+
+	keys, err := ListMokKeys(state)
+	if err != nil {
+		return err
+	}
+	if cmdOptions.StructuredOutput() {
+		return StructuredOut(keys)
+	}
+	printEnrolledKeys("Enrolled", keys.Enrolled)
+	if len(keys.Pending) == 0 {
+		logging.Print("Pending:\n  No enrollment pending\n")
+		return nil
+	}
+	printEnrolledKeys("Pending", keys.Pending)
+	logging.Println("\n" + mokRebootMsg)
+	return nil
+}
+
+func RunMokCancel(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+	if state.Config.Landlock {
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+
+	if err := sbctl.CancelMok(state.Efivarfs); errors.Is(err, sbctl.ErrMokNoRequest) {
+		logging.Print("No MOK enrollment is pending\n")
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if cmdOptions.DryRun {
+		return nil
+	}
+	logging.Ok("Cancelled the pending MOK enrollment")
+	return nil
+}
+
+func mokEnrollCmdFlags(cmd *cobra.Command) {
+	f := cmd.Flags()
+	f.StringVarP(&mokEnrollCmdOptions.PasswordFile, "password-file", "", "", "read the password MokManager asks for from a file instead of prompting")
+}
+
+func init() {
+	mokEnrollCmdFlags(mokEnrollCmd)
+	mokCmd.AddCommand(mokEnrollCmd)
+	mokCmd.AddCommand(mokListCmd)
+	mokCmd.AddCommand(mokCancelCmd)
+	CliCommands = append(CliCommands,
+		cliCommand{
+			Cmd:      mokCmd,
+			Efivarfs: true,
+		},
+		cliCommand{
+			Cmd:    mokEnrollCmd,
+			DryRun: true,
+			Lock:   true,
+			Hooks:  true,
+		},
+		cliCommand{
+			Cmd:    mokCancelCmd,
+			DryRun: true,
+			Lock:   true,
+			Hooks:  true,
+		},
+	)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/foxboron/sbctl"
+	"github.com/spf13/afero"
+)
+
+func TestMokEnroll(t *testing.T) {
+	state := setupEnrollState(t)
+	if err := RunCreateKeys(state); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without certificates the sbctl db certificate is enrolled
+	certs, err := mokCertificates(state, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(state.Fs, "/mok-password", []byte("password\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	password, err := readMokPassword(state, "/mok-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sbctl.EnrollMok(state.Efivarfs, certs, password); err != nil {
+		t.Fatalf("failed enrolling the MOK: %v", err)
+	}
+
+	keys, err := ListMokKeys(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys.Enrolled) != 0 || len(keys.Pending) != 1 {
+		t.Fatalf("expected one pending MOK, got %+v", keys)
+	}
+	if keys.Pending[0].Label != keyLabelSbctl || keys.Pending[0].Subject != certs[0].Subject.String() {
+		t.Fatalf("expected the sbctl db certificate to be pending, got %+v", keys.Pending[0])
+	}
+
+	if err := sbctl.CancelMok(state.Efivarfs); err != nil {
+		t.Fatalf("failed cancelling the enrollment: %v", err)
+	}
+}
+
+func TestMokDryRun(t *testing.T) {
+	state := setupEnrollState(t)
+	if err := RunCreateKeys(state); err != nil {
+		t.Fatal(err)
+	}
+	certs, err := mokCertificates(state, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setupDryRun(t, state)
+
+	if err := sbctl.EnrollMok(state.Efivarfs, certs, []byte("password")); err != nil {
+		t.Fatalf("failed enrolling the MOK with --dry-run: %v", err)
+	}
+	if len(dryRunPlan.Writes) != 2 {
+		t.Fatalf("expected MokNew and MokAuth in the plan, got %+v", dryRunPlan.Writes)
+	}
+	keys, err := ListMokKeys(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys.Pending) != 0 {
+		t.Fatalf("expected nothing to be written with --dry-run, got %+v", keys.Pending)
+	}
+
+	// Only the commands writing the MOK variables hold the lock
+	if !needsLock(mokEnrollCmd) || !needsLock(mokCancelCmd) || needsLock(mokListCmd) {
+		t.Fatalf("unexpected mok commands holding the lock")
+	}
+}
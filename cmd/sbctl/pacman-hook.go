@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/landlock-lsm/go-landlock/landlock"
+	"github.com/spf13/afero"
+)
+
+var (
+	pacmanHookPath     = "/etc/pacman.d/hooks/zz-sbctl.hook"
+	packagedPacmanHook = "/usr/share/libalpm/hooks/99-sbctl.hook"
+
+	ErrPacmanHookExists = errors.New("pacman hook already exists, use --force to overwrite it")
+
+	pacmanHookTemplate = template.Must(template.New("hook").Parse(`# Generated by sbctl setup --generate-pacman-hook
+[Trigger]
+Type = Path
+Operation = Install
+Operation = Upgrade
+Operation = Remove
+{{- range .}}
+Target = {{.}}
+{{- end}}
+
+[Action]
+Description = Signing EFI binaries...
+When = PostTransaction
+Exec = /usr/bin/sbctl sign-all -g
+`))
+)
+
+// pacmanSourceTargets returns the package paths a tracked file is installed
+// from. Pacman only triggers on files owned by packages, while the kernel and
+// bootloader on the ESP are copied there by other hooks.
+func pacmanSourceTargets(p string) []string {
+	base := filepath.Base(p)
+	switch {
+	case strings.HasPrefix(base, "systemd-boot"):
+		return []string{"usr/lib/systemd/boot/efi/*.efi"}
+	case strings.HasPrefix(base, "vmlinuz"), strings.Contains(p, "/EFI/Linux/"):
+		return []string{"usr/lib/modules/*/vmlinuz"}
+	}
+	return nil
+}
+
+func pacmanTarget(p string) string {
+	return strings.TrimPrefix(filepath.Clean(p), "/")
+}
+
+// PacmanHookTargets returns the trigger paths for the tracked files and
+// bundles
+func PacmanHookTargets(state *config.State) ([]string, error) {
+	var targets []string
+	add := func(p string) {
+		if p == "" {
+			return
+		}
+		targets = append(targets, pacmanTarget(p))
+		targets = append(targets, pacmanSourceTargets(p)...)
+	}
+	if err := sbctl.SigningEntryIter(state, func(s *sbctl.SigningEntry) error {
+		add(s.File)
+		add(s.OutputFile)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if ok, _ := afero.Exists(state.Fs, state.Config.BundlesDb); ok {
+		if err := sbctl.BundleIter(state, func(b *sbctl.Bundle) error {
+			add(b.Output)
+			add(b.KernelImage)
+			// Bundles always need to be regenerated on kernel upgrades
+			targets = append(targets, "usr/lib/modules/*/vmlinuz")
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	slices.Sort(targets)
+	return slices.Compact(targets), nil
+}
+
+// pacmanHookLandlockRules needs to be called before any other part of setup
+// restricts sbctl
+func pacmanHookLandlockRules() {
+	lsm.RestrictAdditionalPaths(
+		landlock.RWDirs(filepath.Dir(filepath.Dir(pacmanHookPath))).IgnoreIfMissing(),
+	)
+}
+
+func GeneratePacmanHook(state *config.State, force bool) error {
+	if state.Config.Landlock {
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+
+	if ok, _ := afero.Exists(state.Fs, pacmanHookPath); ok && !force {
+		return fmt.Errorf("%s: %w", pacmanHookPath, ErrPacmanHookExists)
+	}
+
+	targets, err := PacmanHookTargets(state)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("no files are tracked by sbctl, add files with sbctl sign -s")
+	}
+
+	var b bytes.Buffer
+	if err := pacmanHookTemplate.Execute(&b, targets); err != nil {
+		return err
+	}
+	if err := state.Fs.MkdirAll(filepath.Dir(pacmanHookPath), os.ModePerm); err != nil {
+		return err
+	}
+	if err := fs.WriteFile(state.Fs, pacmanHookPath, b.Bytes(), 0o644); err != nil {
+		return err
+	}
+	logging.Ok("Wrote pacman hook to %s", pacmanHookPath)
+
+	if ok, _ := afero.Exists(state.Fs, packagedPacmanHook); ok {
+		logging.Warn("%s is also installed and will sign the files as well", packagedPacmanHook)
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/foxboron/sbctl/fs"
+)
+
+func TestGeneratePacmanHook(t *testing.T) {
+	state := setupRotateState(t)
+
+	if err := GeneratePacmanHook(state, false); err != nil {
+		t.Fatalf("failed generating pacman hook: %v", err)
+	}
+	b, err := fs.ReadFile(state.Fs, pacmanHookPath)
+	if err != nil {
+		t.Fatalf("can't read pacman hook: %v", err)
+	}
+	for _, target := range []string{"Target = boot/test.efi", "Target = boot/new.efi", "Exec = /usr/bin/sbctl sign-all -g"} {
+		if !strings.Contains(string(b), target) {
+			t.Fatalf("pacman hook is missing %q:\n%s", target, b)
+		}
+	}
+
+	if err := GeneratePacmanHook(state, false); !errors.Is(err, ErrPacmanHookExists) {
+		t.Fatalf("expected ErrPacmanHookExists, got: %v", err)
+	}
+	if err := GeneratePacmanHook(state, true); err != nil {
+		t.Fatalf("failed overwriting pacman hook: %v", err)
+	}
+}
+
+func TestPacmanSourceTargets(t *testing.T) {
+	for p, want := range map[string]string{
+		"/efi/EFI/systemd/systemd-bootx64.efi": "usr/lib/systemd/boot/efi/*.efi",
+		"/boot/vmlinuz-linux":                  "usr/lib/modules/*/vmlinuz",
+		"/efi/EFI/Linux/arch-linux.efi":        "usr/lib/modules/*/vmlinuz",
+	} {
+		got := pacmanSourceTargets(p)
+		if len(got) != 1 || got[0] != want {
+			t.Fatalf("pacmanSourceTargets(%s): got %v, expected %s", p, got, want)
+		}
+	}
+	if got := pacmanSourceTargets("/efi/EFI/BOOT/BOOTX64.EFI"); len(got) != 0 {
+		t.Fatalf("unexpected targets: %v", got)
+	}
+}
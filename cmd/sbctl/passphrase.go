@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/foxboron/sbctl/fs"
+	"github.com/spf13/afero"
+	"golang.org/x/sys/unix"
+)
+
+// promptPassphrase reads a line from stdin with echo disabled
+func promptPassphrase(prompt string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return nil, fmt.Errorf("can't prompt for passphrase, stdin is not a terminal")
+	}
+	noecho := *termios
+	noecho.Lflag &^= unix.ECHO
+	noecho.Lflag |= unix.ICANON | unix.ISIG
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, &noecho); err != nil {
+		return nil, err
+	}
+	defer unix.IoctlSetTermios(fd, unix.TCSETS, termios)
+
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
+
+// readSecretFile reads a secret from file, without the trailing newline
+func readSecretFile(vfs afero.Fs, file string, name string) ([]byte, error) {
+	b, err := fs.ReadFile(vfs, file)
+	if err != nil {
+		return nil, fmt.Errorf("can't read %s file: %w", name, err)
+	}
+	b = bytes.TrimRight(b, "\r\n")
+	if len(b) == 0 {
+		return nil, fmt.Errorf("%s file %s is empty", name, file)
+	}
+	return b, nil
+}
+
+// Environment variables used when no secret file is passed
+const (
+	passphraseEnv = "SBCTL_PASSPHRASE"
+	pinEnv        = "SBCTL_PIN"
+)
+
+// readSecretEnv reads a secret from the environment variable env. The variable
+// is removed afterwards so it isn't inherited by the programs we execute.
+func readSecretEnv(env string, name string) ([]byte, bool, error) {
+	v, ok := os.LookupEnv(env)
+	if !ok {
+		return nil, false, nil
+	}
+	os.Unsetenv(env)
+	if v == "" {
+		return nil, true, fmt.Errorf("%s is set, but the %s is empty", env, name)
+	}
+	return []byte(v), true, nil
+}
+
+// readPassphrase reads the passphrase from file, then from $SBCTL_PASSPHRASE,
+// and prompts for it if neither is set. If confirm is set the user has to type
+// the passphrase twice. The caller should clear the passphrase when done.
+func readPassphrase(vfs afero.Fs, file string, confirm bool) ([]byte, error) {
+	if file != "" {
+		return readSecretFile(vfs, file, "passphrase")
+	}
+	if passphrase, ok, err := readSecretEnv(passphraseEnv, "passphrase"); ok {
+		return passphrase, err
+	}
+
+	passphrase, err := promptPassphrase("Passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("passphrase can't be empty")
+	}
+	if confirm {
+		again, err := promptPassphrase("Repeat passphrase: ")
+		if err != nil {
+			clear(passphrase)
+			return nil, err
+		}
+		defer clear(again)
+		if !bytes.Equal(passphrase, again) {
+			clear(passphrase)
+			return nil, fmt.Errorf("passphrases do not match")
+		}
+	}
+	return passphrase, nil
+}
+
+// keyPassphrase returns the passphrase of encrypted keys for config.State. The
+// passphrase is read once, like readPassphrase without a file, and shared by
+// all the keys.
+func keyPassphrase(vfs afero.Fs) func(confirm bool) ([]byte, error) {
+	var mu sync.Mutex
+	var passphrase []byte
+	return func(confirm bool) ([]byte, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if passphrase == nil {
+			p, err := readPassphrase(vfs, "", confirm)
+			if err != nil {
+				return nil, err
+			}
+			passphrase = p
+		}
+		// The caller clears its copy
+		return bytes.Clone(passphrase), nil
+	}
+}
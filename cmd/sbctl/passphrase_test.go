@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestReadPassphrase(t *testing.T) {
+	vfs := afero.NewMemMapFs()
+	if err := afero.WriteFile(vfs, "/passphrase", []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("file takes precedence", func(t *testing.T) {
+		t.Setenv(passphraseEnv, "from-env")
+		b, err := readPassphrase(vfs, "/passphrase", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "from-file" {
+			t.Fatalf("expected passphrase from file, got %q", b)
+		}
+	})
+
+	t.Run("environment", func(t *testing.T) {
+		t.Setenv(passphraseEnv, "from-env")
+		b, err := readPassphrase(vfs, "", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "from-env" {
+			t.Fatalf("expected passphrase from environment, got %q", b)
+		}
+		if _, ok := os.LookupEnv(passphraseEnv); ok {
+			t.Fatalf("%s was not removed from the environment", passphraseEnv)
+		}
+	})
+
+	t.Run("empty environment", func(t *testing.T) {
+		t.Setenv(passphraseEnv, "")
+		if _, err := readPassphrase(vfs, "", false); err == nil {
+			t.Fatal("expected an error for an empty passphrase")
+		}
+	})
+}
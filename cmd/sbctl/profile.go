@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/landlock-lsm/go-landlock/landlock"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+type Profile struct {
+	Name   string `json:"name"`
+	Keydir string `json:"keydir"`
+	Active bool   `json:"active"`
+}
+
+var (
+	profileCmd = &cobra.Command{
+		Use:   "profile",
+		Short: "Show or switch the active key profile",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			state := cmd.Context().Value(stateDataKey{}).(*config.State)
+			if err := restrictProfile(state); err != nil {
+				return err
+			}
+			name, err := state.Config.ActiveProfile(state.Fs)
+			if err != nil {
+				return err
+			}
+			p := Profile{Name: name, Keydir: state.Config.Keydir, Active: true}
+			if cmdOptions.StructuredOutput() {
+				return StructuredOut(p)
+			}
+			logging.Print("Profile:\t%s\n", p.Name)
+			logging.Print("Key directory:\t%s\n", p.Keydir)
+			return nil
+		},
+	}
+	profileUseCmd = &cobra.Command{
+		Use:   "use <name>",
+		Short: "Switch the key directory used by sbctl to the named profile",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			state := cmd.Context().Value(stateDataKey{}).(*config.State)
+			if err := restrictProfile(state); err != nil {
+				return err
+			}
+			return RunProfileUse(state, args[0])
+		},
+	}
+	profileListCmd = &cobra.Command{
+		Use:     "list",
+		Aliases: []string{"ls"},
+		Short:   "List the key profiles",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			state := cmd.Context().Value(stateDataKey{}).(*config.State)
+			if err := restrictProfile(state); err != nil {
+				return err
+			}
+			profiles, err := ListProfiles(state)
+			if err != nil {
+				return err
+			}
+			if cmdOptions.StructuredOutput() {
+				return StructuredOut(profiles)
+			}
+			for _, p := range profiles {
+				if p.Active {
+					logging.Print("* %s\t%s\n", p.Name, p.Keydir)
+				} else {
+					logging.Print("  %s\t%s\n", p.Name, p.Keydir)
+				}
+			}
+			return nil
+		},
+	}
+)
+
+func restrictProfile(state *config.State) error {
+	if !state.Config.Landlock {
+		return nil
+	}
+	lsm.RestrictAdditionalPaths(
+		landlock.RWDirs(filepath.Dir(filepath.Clean(state.Config.ProfilesDir))).IgnoreIfMissing(),
+	)
+	return lsm.Restrict()
+}
+
+func RunProfileUse(state *config.State, name string) error {
+	if err := state.Config.SetActiveProfile(state.Fs, name); err != nil {
+		return err
+	}
+	if name == config.DefaultProfile {
+		logging.Ok("Switched to the default profile")
+		return nil
+	}
+	keydir, err := state.Config.ProfileKeydir(name)
+	if err != nil {
+		return err
+	}
+	logging.Ok("Switched to profile %s", name)
+	if ok, _ := afero.DirExists(state.Fs, keydir); !ok {
+		logging.Warn("Profile %s has no keys yet, create them with sbctl create-keys", name)
+	}
+	return nil
+}
+
+// ListProfiles returns the profiles along with their key directories
+func ListProfiles(state *config.State) ([]Profile, error) {
+	active, err := state.Config.ActiveProfile(state.Fs)
+	if err != nil {
+		return nil, err
+	}
+	names, err := state.Config.ListProfiles(state.Fs)
+	if err != nil {
+		return nil, err
+	}
+	profiles := []Profile{}
+	for _, name := range names {
+		p := Profile{Name: name, Active: name == active}
+		if name == config.DefaultProfile {
+			p.Keydir = state.Config.ConfigKeydir()
+		} else if p.Keydir, err = state.Config.ProfileKeydir(name); err != nil {
+			return nil, fmt.Errorf("profile %s: %w", name, err)
+		}
+		profiles = append(profiles, p)
+	}
+	return profiles, nil
+}
+
+func init() {
+	profileCmd.AddCommand(profileUseCmd)
+	profileCmd.AddCommand(profileListCmd)
+	CliCommands = append(CliCommands, cliCommand{
+		Cmd: profileCmd,
+	}, cliCommand{
+		Cmd:  profileUseCmd,
+		Lock: true,
+	})
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/foxboron/sbctl/stringset"
+	"github.com/landlock-lsm/go-landlock/landlock"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+// Hooks provision can install
+const (
+	provisionHookAuto          = "auto"
+	provisionHookPacman        = "pacman"
+	provisionHookKernelInstall = "kernel-install"
+	provisionHookNone          = "none"
+)
+
+type ProvisionCmdOptions struct {
+	Resume bool
+	ESP    string
+	Hook   stringset.StringSet
+}
+
+// provisionProgress records the steps provision has completed, so --resume
+// can continue after the last one
+type provisionProgress struct {
+	Done []string `json:"done"`
+}
+
+type provisionStep struct {
+	Name        string
+	Description string
+	Run         func(state *config.State) error
+}
+
+var (
+	provisionCmdOptions = ProvisionCmdOptions{
+		Hook: stringset.StringSet{
+			Allowed: []string{provisionHookAuto, provisionHookPacman, provisionHookKernelInstall, provisionHookNone},
+			Value:   provisionHookAuto,
+		},
+	}
+	provisionCmd = &cobra.Command{
+		Use:   "provision",
+		Short: "Create, enroll and sign everything needed to boot with Secure Boot",
+		Long: `Create, enroll and sign everything needed to boot with Secure Boot.
+
+Creates the keys if they are missing, enrolls them if they aren't enrolled,
+signs the bootchain and installs a hook signing it on updates. Steps which are
+done already are skipped, so provision can be run again. With --resume the
+steps completed by an interrupted run are skipped without checking them.`,
+		RunE: RunProvision,
+	}
+	provisionSteps = []provisionStep{
+		{"keys", "Creating the Secure Boot keys", provisionKeys},
+		{"enroll", "Enrolling the keys", provisionEnroll},
+		{"sign", "Signing the bootchain", provisionSign},
+		{"hook", "Installing the signing hook", provisionHook},
+	}
+)
+
+// provisionProgressPath returns the file the progress of provision is kept in
+func provisionProgressPath(state *config.State) string {
+	return filepath.Join(filepath.Dir(state.Config.FilesDb), "provision.json")
+}
+
+func readProvisionProgress(state *config.State) (*provisionProgress, error) {
+	progress := &provisionProgress{}
+	b, err := fs.ReadFile(state.Fs, provisionProgressPath(state))
+	if errors.Is(err, os.ErrNotExist) {
+		return progress, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, progress); err != nil {
+		return nil, fmt.Errorf("invalid provision progress %s: %w", provisionProgressPath(state), err)
+	}
+	return progress, nil
+}
+
+func writeProvisionProgress(state *config.State, progress *provisionProgress) error {
+	b, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	return fs.WriteFile(state.Fs, provisionProgressPath(state), b, 0o644)
+}
+
+// provisionEnrolled returns true if all of the sbctl keys are enrolled
+func provisionEnrolled(state *config.State) bool {
+	if !state.IsInstalled() {
+		return false
+	}
+	keys, err := EnrolledSbctlKeys(state)
+	return err == nil && keys.PK && keys.KEK && keys.Db
+}
+
+func provisionKeys(state *config.State) error {
+	return RunCreateKeys(state)
+}
+
+func provisionEnroll(state *config.State) error {
+	if provisionEnrolled(state) {
+		logging.Ok("The keys are enrolled already")
+		return nil
+	}
+	return RunEnrollKeys(state)
+}
+
+// provisionSign tracks the files in the configuration, or the files of the
+// active boot entries if no files are tracked, and signs the tracked files
+func provisionSign(state *config.State) error {
+	files, err := sbctl.ReadFileDatabase(state.Fs, state.Config.FilesDb)
+	if err != nil {
+		return err
+	}
+	for _, f := range state.Config.Files {
+		if f.Output == "" {
+			f.Output = f.Path
+		}
+		files[f.Path] = &sbctl.SigningEntry{File: f.Path, OutputFile: f.Output}
+	}
+	if len(files) == 0 {
+		esp, err := sbctl.ResolveESP(state, provisionCmdOptions.ESP)
+		if err != nil {
+			return fmt.Errorf("can't find the bootchain: %w", err)
+		}
+		entries, err := sbctl.GetBootEntries(state.Efivarfs, esp)
+		if err != nil {
+			return fmt.Errorf("can't find the bootchain: %w", err)
+		}
+		for _, entry := range entries {
+			if !entry.Active || entry.File == "" {
+				continue
+			}
+			if ok, _ := afero.Exists(state.Fs, entry.File); !ok {
+				logging.Warn("Skipping %s (%s), %s doesn't exist", entry.Name, entry.Description, entry.File)
+				continue
+			}
+			logging.Print("Tracking %s from %s (%s)\n", entry.File, entry.Name, entry.Description)
+			files[entry.File] = &sbctl.SigningEntry{File: entry.File, OutputFile: entry.File}
+		}
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no files to sign, add them with sbctl sign -s")
+	}
+	if err := sbctl.WriteFileDatabase(state.Fs, state.Config.FilesDb, files); err != nil {
+		return err
+	}
+	return SignAll(state)
+}
+
+// provisionHookType returns the hook to install, detecting the package manager
+// with auto
+func provisionHookType(state *config.State) string {
+	hook := provisionCmdOptions.Hook.Value
+	if hook != provisionHookAuto {
+		return hook
+	}
+	if ok, _ := afero.Exists(state.Fs, "/etc/pacman.conf"); ok {
+		return provisionHookPacman
+	}
+	if ok, _ := afero.DirExists(state.Fs, filepath.Dir(kernelInstallPluginPath)); ok {
+		return provisionHookKernelInstall
+	}
+	return provisionHookNone
+}
+
+func provisionHook(state *config.State) error {
+	var err error
+	switch provisionHookType(state) {
+	case provisionHookPacman:
+		err = GeneratePacmanHook(state, false)
+	case provisionHookKernelInstall:
+		err = GenerateKernelInstallPlugin(state, false)
+	default:
+		logging.Print("No hook to install, sign updated files with sbctl sign-all\n")
+		return nil
+	}
+	if errors.Is(err, ErrPacmanHookExists) || errors.Is(err, ErrKernelInstallPluginExists) {
+		logging.Ok("The hook is installed already")
+		return nil
+	}
+	return err
+}
+
+// restrictProvision restricts provision with landlock. The directories of the
+// keys and the file database are created first: the rules for them are
+// dropped if they are missing, which they are on a fresh install.
+func restrictProvision(state *config.State) error {
+	for _, dir := range []string{
+		filepath.Dir(filepath.Clean(state.Config.Keydir)),
+		filepath.Dir(state.Config.GUID),
+		filepath.Dir(provisionProgressPath(state)),
+	} {
+		if err := sbctl.CreateDirectory(state.Fs, dir); err != nil {
+			return err
+		}
+	}
+	if err := sbctl.LandlockFromFileDatabase(state); err != nil {
+		return err
+	}
+	// The bootchain is tracked from the ESP
+	if esp, err := sbctl.ResolveESP(state, provisionCmdOptions.ESP); err == nil {
+		lsm.RestrictAdditionalPaths(landlock.RWDirs(esp))
+	}
+	lsm.RestrictAdditionalPaths(
+		landlock.RWDirs(filepath.Dir(provisionProgressPath(state))),
+	)
+	for _, f := range state.Config.Files {
+		lsm.RestrictAdditionalPaths(landlock.RWFiles(f.Path).IgnoreIfMissing())
+		lsm.RestrictAdditionalPaths(landlock.RWDirs(filepath.Dir(f.Output)).IgnoreIfMissing())
+	}
+	switch provisionHookType(state) {
+	case provisionHookPacman:
+		pacmanHookLandlockRules()
+	case provisionHookKernelInstall:
+		kernelInstallLandlockRules()
+	}
+	return lsm.Restrict()
+}
+
+func RunProvision(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+
+	// The keys, the signed files and the hook are written to memory with
+	// --dry-run, so the enrolled variables can be printed
+	if cmdOptions.DryRun {
+		dryRun := *state
+		dryRun.Fs = afero.NewCopyOnWriteFs(afero.NewReadOnlyFs(state.Fs), afero.NewMemMapFs())
+		state = &dryRun
+	}
+
+	if state.Config.Landlock {
+		if err := restrictProvision(state); err != nil {
+			return err
+		}
+	}
+
+	progress := &provisionProgress{}
+	if provisionCmdOptions.Resume {
+		var err error
+		if progress, err = readProvisionProgress(state); err != nil {
+			return err
+		}
+	}
+
+	// Fail before changing anything if the keys can't be enrolled
+	if !slices.Contains(progress.Done, "enroll") && !provisionEnrolled(state) {
+		if ok, _ := state.Efivarfs.GetSetupMode(); !ok {
+			return ErrSetupModeDisabled
+		}
+	}
+
+	for i, step := range provisionSteps {
+		logging.Print("[%d/%d] %s\n", i+1, len(provisionSteps), step.Description)
+		if slices.Contains(progress.Done, step.Name) {
+			logging.Ok("Done in the previous run, skipping")
+			continue
+		}
+		if err := step.Run(state); err != nil {
+			logging.Print("Run sbctl provision --resume to continue after fixing the error\n")
+			return fmt.Errorf("%s: %w", strings.ToLower(step.Description), err)
+		}
+		progress.Done = append(progress.Done, step.Name)
+		if err := writeProvisionProgress(state, progress); err != nil {
+			return err
+		}
+	}
+
+	if err := state.Fs.Remove(provisionProgressPath(state)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if cmdOptions.DryRun {
+		return nil
+	}
+	logging.Println("Secure Boot is provisioned! Enable Secure Boot in the firmware settings if it isn't already")
+	return nil
+}
+
+func provisionCmdFlags(cmd *cobra.Command) {
+	f := cmd.Flags()
+	f.BoolVarP(&provisionCmdOptions.Resume, "resume", "", false, "skip the steps completed by an interrupted run")
+	f.StringVarP(&provisionCmdOptions.ESP, "esp", "", "", "ESP the bootchain is signed on (default: detected)")
+	f.VarPF(&provisionCmdOptions.Hook, "hook", "", "hook signing the bootchain on updates to install")
+	_ = cmd.RegisterFlagCompletionFunc("hook", completeStringSet(&provisionCmdOptions.Hook))
+}
+
+func init() {
+	provisionCmdFlags(provisionCmd)
+	vendorFlags(provisionCmd)
+	CliCommands = append(CliCommands, cliCommand{
+		Cmd:      provisionCmd,
+		Efivarfs: true,
+		DryRun:   true,
+		Lock:     true,
+		Hooks:    true,
+	})
+}
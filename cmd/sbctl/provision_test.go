@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+	"testing/fstest"
+
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/foxboron/go-uefi/efivarfs/testfs"
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/hierarchy"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/spf13/afero"
+)
+
+func TestProvision(t *testing.T) {
+	state := setupEnrollState(t)
+	enrollKeysCmdOptions.Force = true
+	provisionCmdOptions.ESP = "/boot"
+	provisionCmdOptions.Hook.Value = provisionHookNone
+	t.Cleanup(func() {
+		provisionCmdOptions.ESP = ""
+		provisionCmdOptions.Resume = false
+		provisionCmdOptions.Hook.Value = provisionHookAuto
+	})
+	cmd := provisionCmd
+	cmd.SetContext(context.WithValue(context.Background(), stateDataKey{}, state))
+
+	if err := afero.WriteFile(state.Fs, "/boot/EFI/Linux/linux.efi", mustBytes("../../tests/binaries/test.pecoff"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// One entry loading the UKI, and one whose file is missing
+	for name, data := range map[string][]byte{
+		"Boot0001": loadOptionBytes(true, "Linux", `\EFI\Linux\linux.efi`),
+		"Boot0002": loadOptionBytes(true, "Missing", `\EFI\missing.efi`),
+	} {
+		v := efivar.BootEntry
+		v.Name = name
+		if err := state.Efivarfs.WriteVar(v, rawVar(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := state.Efivarfs.WriteVar(efivar.BootOrder, rawVar{0x01, 0x00, 0x02, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Interrupted after enrolling
+	if err := writeProvisionProgress(state, &provisionProgress{Done: []string{"keys", "enroll"}}); err != nil {
+		t.Fatal(err)
+	}
+	provisionCmdOptions.Resume = true
+	if err := RunProvision(cmd, nil); err == nil {
+		t.Fatalf("expected signing without keys to fail")
+	}
+	progress, err := readProvisionProgress(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(progress.Done) != 2 {
+		t.Fatalf("unexpected progress after the failed step: %+v", progress)
+	}
+
+	provisionCmdOptions.Resume = false
+	if err := RunProvision(cmd, nil); err != nil {
+		t.Fatalf("failed provisioning: %v", err)
+	}
+	if !provisionEnrolled(state) {
+		t.Fatalf("the keys were not enrolled")
+	}
+	files, err := sbctl.ReadFileDatabase(state.Fs, state.Config.FilesDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files["/boot/EFI/Linux/linux.efi"] == nil {
+		t.Fatalf("expected the bootchain to be tracked: %+v", files)
+	}
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := sbctl.VerifyFile(state, kh, hierarchy.Db, "/boot/EFI/Linux/linux.efi"); err != nil || !ok {
+		t.Fatalf("the bootchain was not signed: %v", err)
+	}
+	if ok, _ := afero.Exists(state.Fs, provisionProgressPath(state)); ok {
+		t.Fatalf("the progress should be removed after provisioning")
+	}
+
+	// Everything is done already
+	if err := RunProvision(cmd, nil); err != nil {
+		t.Fatalf("failed provisioning again: %v", err)
+	}
+}
+
+func TestProvisionDryRun(t *testing.T) {
+	state := setupEnrollState(t)
+	enrollKeysCmdOptions.Force = true
+	provisionCmdOptions.ESP = "/boot"
+	provisionCmdOptions.Hook.Value = provisionHookNone
+	cmdOptions.DryRun = true
+	t.Cleanup(func() {
+		provisionCmdOptions.ESP = ""
+		provisionCmdOptions.Hook.Value = provisionHookAuto
+		cmdOptions.DryRun = false
+	})
+	var plan *sbctl.DryRun
+	state.Efivarfs, plan = sbctl.DryRunEfivarWrites(state.Efivarfs)
+	state.Config.Files = []*config.FileConfig{{Path: "/boot/test.efi"}}
+	if err := afero.WriteFile(state.Fs, "/boot/test.efi", mustBytes("../../tests/binaries/test.pecoff"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := provisionCmd
+	cmd.SetContext(context.WithValue(context.Background(), stateDataKey{}, state))
+
+	if err := RunProvision(cmd, nil); err != nil {
+		t.Fatalf("failed provisioning with --dry-run: %v", err)
+	}
+	var vars []string
+	for _, w := range plan.Writes {
+		vars = append(vars, w.Variable)
+	}
+	if len(vars) != 3 || !slices.Contains(vars, "PK") || !slices.Contains(vars, "KEK") || !slices.Contains(vars, "db") {
+		t.Fatalf("expected PK, KEK and db to be written, got %v", vars)
+	}
+
+	// Nothing is written
+	if state.IsInstalled() {
+		t.Fatalf("the keys were created with --dry-run")
+	}
+	if ok, _ := afero.Exists(state.Fs, state.Config.FilesDb); ok {
+		t.Fatalf("the file database was written with --dry-run")
+	}
+	if b, _ := afero.ReadFile(state.Fs, "/boot/test.efi"); !bytes.Equal(b, mustBytes("../../tests/binaries/test.pecoff")) {
+		t.Fatalf("the bootchain was signed with --dry-run")
+	}
+	if _, err := state.Efivarfs.GetPK(); err == nil {
+		t.Fatalf("PK was written with --dry-run")
+	}
+}
+
+func TestProvisionSetupModeDisabled(t *testing.T) {
+	state := setupEnrollState(t)
+	// efitest.SetUpModeOff() enables setup mode as well
+	state.Efivarfs = testfs.NewTestFS().With(fstest.MapFS{
+		"/sys/firmware/efi/efivars/SetupMode-8be4df61-93ca-11d2-aa0d-00e098032b8c": {Data: []byte{0x6, 0x0, 0x0, 0x0, 0x0}},
+	}).Open()
+	cmd := provisionCmd
+	cmd.SetContext(context.WithValue(context.Background(), stateDataKey{}, state))
+	if err := RunProvision(cmd, nil); !errors.Is(err, ErrSetupModeDisabled) {
+		t.Fatalf("expected ErrSetupModeDisabled, got %v", err)
+	}
+	if state.IsInstalled() {
+		t.Fatalf("keys should not be created without setup mode")
+	}
+}
+
+// TestProvisionLandlock creates the keys on an empty root with landlock
+// enabled. Landlock can't be lifted again, so each layout is tested in a
+// subprocess.
+func TestProvisionLandlock(t *testing.T) {
+	root := os.Getenv("SBCTL_TEST_LANDLOCK_ROOT")
+	if root == "" {
+		for name, keydir := range map[string]string{
+			"default":         "var/lib/sbctl/keys",
+			"separate keydir": "etc/secureboot/keys",
+		} {
+			t.Run(name, func(t *testing.T) {
+				cmd := exec.Command(os.Args[0], "-test.run=^TestProvisionLandlock$")
+				cmd.Env = append(os.Environ(), "SBCTL_TEST_LANDLOCK_ROOT="+t.TempDir(), "SBCTL_TEST_LANDLOCK_KEYDIR="+keydir)
+				if out, err := cmd.CombinedOutput(); err != nil {
+					t.Fatalf("provision failed under landlock: %v\n%s", err, out)
+				}
+			})
+		}
+		return
+	}
+
+	state := setupEnrollState(t)
+	state.Fs = afero.NewOsFs()
+	state.Config = config.MkConfig(filepath.Join(root, "var/lib/sbctl"))
+	state.Config.SetKeydir(filepath.Join(root, os.Getenv("SBCTL_TEST_LANDLOCK_KEYDIR")))
+	provisionCmdOptions.ESP = filepath.Join(root, "boot")
+	if err := os.Mkdir(provisionCmdOptions.ESP, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	provisionCmdOptions.Hook.Value = provisionHookNone
+	lsm.LandlockRulesFromConfig(state.Config)
+	if err := restrictProvision(state); err != nil {
+		t.Fatalf("failed restricting provision: %v", err)
+	}
+	if err := provisionKeys(state); err != nil {
+		t.Fatalf("failed creating the keys: %v", err)
+	}
+	if _, err := backend.GetKeyHierarchy(state.Fs, state); err != nil {
+		t.Fatalf("failed reading the created keys: %v", err)
+	}
+	// Nothing outside the allowed paths can be written
+	if err := os.WriteFile(filepath.Join(root, "outside"), nil, 0o644); err == nil {
+		t.Fatalf("expected landlock to deny writes outside the state directory")
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"os"
 
 	"github.com/foxboron/sbctl"
@@ -14,7 +15,8 @@ var removeBundleCmd = &cobra.Command{
 	Aliases: []string{
 		"rm-bundle",
 	},
-	Short: "Remove bundle from database",
+	Short:             "Remove bundle from database",
+	ValidArgsFunction: completeBundles,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		state := cmd.Context().Value(stateDataKey{}).(*config.State)
 
@@ -29,7 +31,8 @@ var removeBundleCmd = &cobra.Command{
 			return err
 		}
 
-		if _, ok := bundles[args[0]]; !ok {
+		bundle, ok := bundles[args[0]]
+		if !ok {
 			logging.Print("Bundle %s doesn't exist in database!\n", args[0])
 			os.Exit(1)
 		}
@@ -39,12 +42,29 @@ var removeBundleCmd = &cobra.Command{
 			return err
 		}
 		logging.Print("Removed %s from the database.\n", args[0])
+
+		// The loader entry written by generate-bundles --loader-entries
+		if bundle.ESP == "" {
+			bundle.ESP, _ = sbctl.GetESP(state.Fs)
+		}
+		if bundle.ESP != "" {
+			removed, err := sbctl.RemoveLoaderEntry(state.Fs, bundle)
+			switch {
+			case errors.Is(err, sbctl.ErrLoaderEntryNotOwned):
+				logging.Print("Kept loader entry %s, it wasn't written by sbctl.\n", sbctl.LoaderEntryPath(bundle))
+			case err != nil:
+				return err
+			case removed:
+				logging.Print("Removed loader entry %s.\n", sbctl.LoaderEntryPath(bundle))
+			}
+		}
 		return nil
 	},
 }
 
 func init() {
 	CliCommands = append(CliCommands, cliCommand{
-		Cmd: removeBundleCmd,
+		Cmd:  removeBundleCmd,
+		Lock: true,
 	})
 }
@@ -16,7 +16,8 @@ var removeFileCmd = &cobra.Command{
 		"rm-file",
 		"rm",
 	},
-	Short: "Remove file from database",
+	Short:             "Remove file from database",
+	ValidArgsFunction: completeTrackedFiles,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		state := cmd.Context().Value(stateDataKey{}).(*config.State)
 
@@ -49,6 +50,7 @@ var removeFileCmd = &cobra.Command{
 
 func init() {
 	CliCommands = append(CliCommands, cliCommand{
-		Cmd: removeFileCmd,
+		Cmd:  removeFileCmd,
+		Lock: true,
 	})
 }
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"slices"
 	"strings"
 
 	"github.com/foxboron/go-uefi/efi/signature"
@@ -18,84 +23,120 @@ import (
 )
 
 type resetCmdOptions struct {
-	Partial   stringset.StringSet
-	CertFiles string
+	Partial         stringset.StringSet
+	CertFiles       string
+	IgnoreImmutable bool
+	Yes             bool
+}
+
+// ResetVariable is an EFI variable cleared by reset
+type ResetVariable struct {
+	Name string `json:"name"`
+	// Set when only the certificates given with --cert-files were removed
+	Certificates []string `json:"certificates,omitempty"`
+}
+
+type ResetSummary struct {
+	Cleared   []ResetVariable `json:"cleared"`
+	SetupMode bool            `json:"setup_mode"`
 }
 
 var (
 	resetCmdOpts = resetCmdOptions{
-		Partial: stringset.StringSet{Allowed: []string{"PK", "KEK", "db"}},
+		Partial: stringset.StringSet{Allowed: []string{"PK", "KEK", "db"}, IgnoreCase: true},
 	}
 	resetCmd = &cobra.Command{
 		Use:   "reset",
 		Short: "Reset Secure Boot Keys",
 		RunE:  RunReset,
 	}
+	// db and KEK are signed by keys further up the hierarchy, so PK has
+	// to be removed last
+	resetOrder = []efivar.Efivar{efivar.Db, efivar.KEK, efivar.PK}
+	resetNames = map[string]string{
+		"db":  "Signature Database",
+		"KEK": "Key Exchange Keys",
+		"PK":  "Platform Key",
+	}
+	// Read by the confirmation prompt, replaced in tests
+	confirmInput io.Reader = os.Stdin
+
+	ErrResetAborted = errors.New("reset aborted, pass --yes to skip the confirmation")
 )
 
-func resetKeys(state *config.State) error {
+func resetTargets() []efivar.Efivar {
 	if resetCmdOpts.Partial.Value == "" {
-		if err := resetPK(state); err != nil {
-			return fmt.Errorf("could not reset PK: %v", err)
+		return resetOrder
+	}
+	for _, ev := range resetOrder {
+		if ev.Name == resetCmdOpts.Partial.Value {
+			return []efivar.Efivar{ev}
 		}
+	}
+	return nil
+}
 
+// confirmReset asks before the variables in targets are removed
+func confirmReset(targets []efivar.Efivar) error {
+	var names []string
+	for _, ev := range targets {
+		names = append(names, ev.Name)
+	}
+	fmt.Fprintf(os.Stderr, "This removes %s from the firmware", strings.Join(names, ", "))
+	if slices.Contains(targets, efivar.PK) {
+		fmt.Fprint(os.Stderr, " and puts the system into Setup Mode")
+	}
+	fmt.Fprint(os.Stderr, ". Continue? [y/N] ")
+	line, err := bufio.NewReader(confirmInput).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
 		return nil
 	}
+	return ErrResetAborted
+}
 
+func resetKeys(state *config.State) (*ResetSummary, error) {
 	var paths []string
-
 	if resetCmdOpts.CertFiles != "" {
+		if resetCmdOpts.Partial.Value == "" {
+			return nil, fmt.Errorf("--cert-files can only be used with --partial")
+		}
 		paths = strings.Split(resetCmdOpts.CertFiles, ";")
 	}
 
-	switch partial := resetCmdOpts.Partial.Value; partial {
-	case "db":
-		if err := resetDB(state, paths...); err != nil {
-			return err
-		}
-	case "KEK":
-		if err := resetKEK(state, paths...); err != nil {
-			return err
-		}
-	case "PK":
-		if err := resetPK(state, paths...); err != nil {
-			return err
-		}
-	default:
-		return fmt.Errorf("unsupported type to reset: %s, allowed values are: %s", partial, enrollKeysCmdOptions.Partial.Type())
+	targets := resetTargets()
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("unsupported type to reset: %s, allowed values are: %s", resetCmdOpts.Partial.Value, resetCmdOpts.Partial.Type())
 	}
 
-	return nil
-}
-
-func resetDB(state *config.State, certPaths ...string) error {
-	if err := resetDatabase(state, efivar.Db, certPaths...); err != nil {
-		return err
+	if !resetCmdOpts.IgnoreImmutable {
+		if err := checkImmutable(state); err != nil {
+			return nil, err
+		}
 	}
 
-	logging.Ok("Removed Signature Database!")
-	logging.Println("Use `sbctl enroll-keys` to enroll the Signature Database again.")
-	return nil
-}
-
-func resetKEK(state *config.State, certPaths ...string) error {
-	if err := resetDatabase(state, efivar.KEK, certPaths...); err != nil {
-		return err
+	if !resetCmdOpts.Yes && !cmdOptions.DryRun {
+		if err := confirmReset(targets); err != nil {
+			return nil, err
+		}
 	}
 
-	logging.Ok("Removed Key Exchange Keys!")
-	logging.Println("Use `sbctl enroll-keys` to enroll a Key Exchange Key again.")
-	return nil
-}
-
-func resetPK(state *config.State, certPaths ...string) error {
-	if err := resetDatabase(state, efivar.PK, certPaths...); err != nil {
-		return err
+	summary := &ResetSummary{Cleared: []ResetVariable{}}
+	for _, ev := range targets {
+		if err := resetDatabase(state, ev, paths...); err != nil {
+			return summary, fmt.Errorf("could not reset %s: %w", ev.Name, err)
+		}
+		summary.Cleared = append(summary.Cleared, ResetVariable{Name: ev.Name, Certificates: paths})
+		logging.Ok("Removed %s!", resetNames[ev.Name])
 	}
-
-	logging.Ok("Removed Platform Key!")
-	logging.Println("Use `sbctl enroll-keys` to enroll the Platform Key again.")
-	return nil
+	if ok, _ := state.Efivarfs.GetSetupMode(); ok {
+		summary.SetupMode = true
+	}
+	logging.Println("Use `sbctl enroll-keys` to enroll the keys again.")
+	return summary, nil
 }
 
 func resetDatabase(state *config.State, ev efivar.Efivar, certPaths ...string) error {
@@ -107,17 +148,8 @@ func resetDatabase(state *config.State, ev efivar.Efivar, certPaths ...string) e
 	db := signature.NewSignatureDatabase()
 
 	if len(certPaths) != 0 {
-		var (
-			err error
-		)
-
 		db = efistate.GetSiglist(ev)
 
-		guid, err := state.Config.GetGUID(state.Fs)
-		if err != nil {
-			return err
-		}
-
 		for _, certPath := range certPaths {
 			buf, err := fs.ReadFile(state.Fs, certPath)
 			if err != nil {
@@ -128,7 +160,7 @@ func resetDatabase(state *config.State, ev efivar.Efivar, certPaths ...string) e
 			if err != nil {
 				return err
 			}
-			if err := db.Remove(signature.CERT_X509_GUID, *guid, cert.Raw); err != nil {
+			if err := sbctl.RemoveCertificate(db, cert.Raw); err != nil {
 				return err
 			}
 
@@ -163,9 +195,14 @@ func RunReset(cmd *cobra.Command, args []string) error {
 			return err
 		}
 	}
-	if err := resetKeys(state); err != nil {
+	summary, err := resetKeys(state)
+	if err != nil {
 		return err
 	}
+	// The planned writes are printed instead
+	if cmdOptions.StructuredOutput() && !cmdOptions.DryRun {
+		return StructuredOut(summary)
+	}
 	return nil
 }
 
@@ -173,11 +210,17 @@ func resetKeysCmdFlags(cmd *cobra.Command) {
 	f := cmd.Flags()
 	f.VarPF(&resetCmdOpts.Partial, "partial", "p", "reset a partial set of keys")
 	f.StringVarP(&resetCmdOpts.CertFiles, "cert-files", "c", "", "optional paths to certificate file to remove from the hierachy (seperate individual paths by ';')")
+	f.BoolVarP(&resetCmdOpts.IgnoreImmutable, "ignore-immutable", "i", false, "ignore checking for immutable efivarfs files")
+	f.BoolVarP(&resetCmdOpts.Yes, "yes", "y", false, "don't ask for confirmation")
 }
 
 func init() {
 	resetKeysCmdFlags(resetCmd)
 	CliCommands = append(CliCommands, cliCommand{
-		Cmd: resetCmd,
+		Cmd:      resetCmd,
+		Efivarfs: true,
+		DryRun:   true,
+		Lock:     true,
+		Hooks:    true,
 	})
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/foxboron/sbctl/config"
+)
+
+func resetTestState(t *testing.T) *config.State {
+	state := setupRotateState(t)
+	resetCmdOpts.IgnoreImmutable = true
+	t.Cleanup(func() {
+		resetCmdOpts.Partial.Value = ""
+		resetCmdOpts.Yes = false
+		confirmInput = strings.NewReader("")
+	})
+	return state
+}
+
+func clearedNames(summary *ResetSummary) string {
+	var cleared []string
+	for _, v := range summary.Cleared {
+		cleared = append(cleared, v.Name)
+	}
+	return strings.Join(cleared, ",")
+}
+
+// The test efivarfs doesn't truncate variables when they are written, so we
+// can't read back the cleared variables.
+func TestResetAll(t *testing.T) {
+	state := resetTestState(t)
+	resetCmdOpts.Yes = true
+
+	summary, err := resetKeys(state)
+	if err != nil {
+		t.Fatalf("failed resetting keys: %v", err)
+	}
+	if cleared := clearedNames(summary); cleared != "db,KEK,PK" {
+		t.Fatalf("unexpected reset order: %v", cleared)
+	}
+}
+
+func TestResetPartial(t *testing.T) {
+	state := resetTestState(t)
+	if err := resetCmdOpts.Partial.Set("kek"); err != nil {
+		t.Fatal(err)
+	}
+	confirmInput = strings.NewReader("y\n")
+
+	summary, err := resetKeys(state)
+	if err != nil {
+		t.Fatalf("failed resetting KEK: %v", err)
+	}
+	if cleared := clearedNames(summary); cleared != "KEK" {
+		t.Fatalf("only KEK should be cleared, got %v", cleared)
+	}
+}
+
+func TestResetAborted(t *testing.T) {
+	state := resetTestState(t)
+	confirmInput = strings.NewReader("n\n")
+
+	summary, err := resetKeys(state)
+	if !errors.Is(err, ErrResetAborted) {
+		t.Fatalf("expected ErrResetAborted, got %v", err)
+	}
+	if summary != nil {
+		t.Fatalf("nothing should be cleared without confirmation")
+	}
+}
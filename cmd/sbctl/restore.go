@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/landlock-lsm/go-landlock/landlock"
+	"github.com/spf13/cobra"
+)
+
+type RestoreCmdOptions struct {
+	Yes             bool
+	IgnoreImmutable bool
+}
+
+var (
+	restoreCmdOptions = RestoreCmdOptions{}
+	restoreCmd        = &cobra.Command{
+		Use:   "restore <BACKUP>",
+		Short: "Restore the Secure Boot variables from a backup",
+		Long: `Write the variables in a backup made with sbctl backup back to the firmware.
+
+The updates are signed with the sbctl keys. Outside of Setup Mode the firmware
+only accepts them if the sbctl keys own the variables, a backup of the vendor
+configuration can only be restored in Setup Mode or with the original keys.`,
+		Args: cobra.ExactArgs(1),
+		RunE: RunRestore,
+	}
+
+	ErrRestoreAborted = errors.New("restore aborted, pass --yes to skip the confirmation")
+)
+
+// confirmRestore asks before the variables in the backup are written
+func confirmRestore(vars []sbctl.FirmwareVariable) error {
+	var names []string
+	for _, v := range vars {
+		names = append(names, v.Var.Name)
+	}
+	fmt.Fprintf(os.Stderr, "This replaces %s in the firmware. Continue? [y/N] ", strings.Join(names, ", "))
+	line, err := bufio.NewReader(confirmInput).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return nil
+	}
+	return ErrRestoreAborted
+}
+
+func RunRestore(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+
+	file, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	if state.Config.Landlock {
+		lsm.RestrictAdditionalPaths(
+			landlock.ROFiles(file),
+		)
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+
+	b, err := fs.ReadFile(state.Fs, file)
+	if err != nil {
+		return err
+	}
+	vars, err := sbctl.ReadFirmwareBackup(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	if len(vars) == 0 {
+		return fmt.Errorf("%s doesn't contain any variables", file)
+	}
+
+	// The variables are authenticated, restoring them needs the keys which
+	// own them
+	logging.Warn("The restored variables are signed with the sbctl keys, the firmware rejects them outside of Setup Mode unless the sbctl keys own PK and KEK")
+
+	if !restoreCmdOptions.IgnoreImmutable {
+		if err := checkImmutable(state); err != nil {
+			return err
+		}
+	}
+	if !restoreCmdOptions.Yes && !cmdOptions.DryRun {
+		if err := confirmRestore(vars); err != nil {
+			return err
+		}
+	}
+
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		return fmt.Errorf("the sbctl keys are needed to sign the restored variables: %w", err)
+	}
+	for _, v := range vars {
+		logging.Print("Restoring %s...", v.Var.Name)
+		if err := sbctl.RestoreFirmwareVariables(state.Efivarfs, kh, []sbctl.FirmwareVariable{v}); err != nil {
+			logging.NotOk("")
+			return err
+		}
+		logging.Ok("")
+	}
+	return nil
+}
+
+func restoreCmdFlags(cmd *cobra.Command) {
+	f := cmd.Flags()
+	f.BoolVarP(&restoreCmdOptions.Yes, "yes", "y", false, "don't ask for confirmation")
+	f.BoolVarP(&restoreCmdOptions.IgnoreImmutable, "ignore-immutable", "i", false, "ignore checking for immutable efivarfs files")
+}
+
+func init() {
+	restoreCmdFlags(restoreCmd)
+	CliCommands = append(CliCommands, cliCommand{
+		Cmd:      restoreCmd,
+		Efivarfs: true,
+		DryRun:   true,
+		Lock:     true,
+		Hooks:    true,
+	})
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"path/filepath"
+	"slices"
 	"time"
 
 	"github.com/foxboron/go-uefi/efi/signature"
@@ -24,6 +25,7 @@ type RotateKeysCmdOptions struct {
 	Partial    stringset.StringSet
 	KeyFile    string
 	CertFile   string
+	DryRun     bool
 
 	Keytype                          string
 	PKKeytype, KEKKeytype, DbKeytype string
@@ -47,6 +49,9 @@ func rotateCerts(state *config.State, hier hierarchy.Hierarchy, oldkeys *backend
 		return err
 	}
 
+	// The new keys are enrolled with the owner of the old ones, which may not
+	// be the GUID if it was overridden when they were enrolled
+	//
 	// Note:
 	// PK needs to be signed by the old key hierarchy, as old PK signs new PK
 	// However db and KEK needs to be signed by new key hierarchy, as new PK -> new KEK,
@@ -56,35 +61,41 @@ func rotateCerts(state *config.State, hier hierarchy.Hierarchy, oldkeys *backend
 	case hierarchy.PK:
 		// fmt.Printf("Old PK: %s\n", oldkeys.PK.Certificate().SerialNumber.String())
 		// fmt.Printf("New PK: %s\n", newkeys.PK.Certificate().SerialNumber.String())
+		owner := *guid
 		cert := oldkeys.PK.Certificate().Raw
-		if efistate.PK.SigDataExists(signature.CERT_X509_GUID, &signature.SignatureData{Owner: *guid, Data: cert}) {
-			if err := efistate.PK.Remove(signature.CERT_X509_GUID, *guid, cert); err != nil {
+		if enrolled, ok := sbctl.CertificateOwner(efistate.PK, cert); ok {
+			owner = enrolled
+			if err := efistate.PK.Remove(signature.CERT_X509_GUID, owner, cert); err != nil {
 				return fmt.Errorf("can't remove old key from PK siglist: %v", err)
 			}
 		}
-		efistate.PK.Append(signature.CERT_X509_GUID, *guid, newkeys.PK.CertificateBytes())
+		efistate.PK.Append(signature.CERT_X509_GUID, owner, newkeys.PK.CertificateBytes())
 		return efistate.EnrollKey(hier.Efivar(), oldkeys)
 	case hierarchy.KEK:
 		// fmt.Printf("Old KEK: %s\n", oldkeys.KEK.Certificate().SerialNumber.String())
 		// fmt.Printf("New KEK: %s\n", newkeys.KEK.Certificate().SerialNumber.String())
+		owner := *guid
 		cert := oldkeys.KEK.Certificate().Raw
-		if efistate.KEK.SigDataExists(signature.CERT_X509_GUID, &signature.SignatureData{Owner: *guid, Data: cert}) {
-			if err := efistate.KEK.Remove(signature.CERT_X509_GUID, *guid, cert); err != nil {
+		if enrolled, ok := sbctl.CertificateOwner(efistate.KEK, cert); ok {
+			owner = enrolled
+			if err := efistate.KEK.Remove(signature.CERT_X509_GUID, owner, cert); err != nil {
 				return fmt.Errorf("can't remove old key from KEK siglist: %v", err)
 			}
 		}
-		efistate.KEK.Append(signature.CERT_X509_GUID, *guid, newkeys.KEK.CertificateBytes())
+		efistate.KEK.Append(signature.CERT_X509_GUID, owner, newkeys.KEK.CertificateBytes())
 		return efistate.EnrollKey(hier.Efivar(), newkeys)
 	case hierarchy.Db:
 		// fmt.Printf("Old Db: %s\n", oldkeys.Db.Certificate().SerialNumber.String())
 		// fmt.Printf("New Db: %s\n", newkeys.Db.Certificate().SerialNumber.String())
+		owner := *guid
 		cert := oldkeys.Db.Certificate().Raw
-		if efistate.Db.SigDataExists(signature.CERT_X509_GUID, &signature.SignatureData{Owner: *guid, Data: cert}) {
-			if err := efistate.Db.Remove(signature.CERT_X509_GUID, *guid, cert); err != nil {
+		if enrolled, ok := sbctl.CertificateOwner(efistate.Db, cert); ok {
+			owner = enrolled
+			if err := efistate.Db.Remove(signature.CERT_X509_GUID, owner, cert); err != nil {
 				return fmt.Errorf("can't remove old key from Db siglist: %v", err)
 			}
 		}
-		efistate.Db.Append(signature.CERT_X509_GUID, *guid, newkeys.Db.CertificateBytes())
+		efistate.Db.Append(signature.CERT_X509_GUID, owner, newkeys.Db.CertificateBytes())
 		return efistate.EnrollKey(hier.Efivar(), newkeys)
 	default:
 		return fmt.Errorf("unknown efivar hierarchy")
@@ -102,6 +113,16 @@ func RunRotateKeys(cmd *cobra.Command, args []string) error {
 		lsm.RestrictAdditionalPaths(
 			landlock.RWDirs(tmpPath),
 		)
+		if rotateKeysCmdOptions.BackupDir != "" {
+			lsm.RestrictAdditionalPaths(
+				landlock.RWDirs(filepath.Dir(filepath.Clean(rotateKeysCmdOptions.BackupDir))),
+			)
+		}
+		if rotateKeysCmdOptions.NewKeysDir != "" {
+			lsm.RestrictAdditionalPaths(
+				landlock.RODirs(rotateKeysCmdOptions.NewKeysDir),
+			)
+		}
 		if err := sbctl.LandlockFromFileDatabase(state); err != nil {
 			return err
 		}
@@ -112,27 +133,135 @@ func RunRotateKeys(cmd *cobra.Command, args []string) error {
 
 	partial := rotateKeysCmdOptions.Partial.Value
 
+	var result *RotateKeysResult
+	var err error
+
 	// rotate all keys if no specific key should be replaced
 	if partial == "" {
-		if err := rotateAllKeys(state, rotateKeysCmdOptions.BackupDir, rotateKeysCmdOptions.NewKeysDir); err != nil {
-			return err
-		}
+		result, err = rotateAllKeys(state, rotateKeysCmdOptions.BackupDir, rotateKeysCmdOptions.NewKeysDir)
+	} else {
+		result, err = rotateKey(state, partial, rotateKeysCmdOptions.KeyFile, rotateKeysCmdOptions.CertFile)
+	}
+	if err != nil {
+		return err
+	}
 
+	if cmdOptions.StructuredOutput() {
+		return StructuredOut(result)
+	}
+	return nil
+}
+
+type RotatedKey struct {
+	Hierarchy      string `json:"hierarchy"`
+	OldFingerprint string `json:"old_fingerprint"`
+	NewFingerprint string `json:"new_fingerprint,omitempty"`
+}
+
+type RotateKeysResult struct {
+	DryRun    bool         `json:"dry_run"`
+	BackupDir string       `json:"backup_dir,omitempty"`
+	Keys      []RotatedKey `json:"keys"`
+	Files     []string     `json:"files"`
+}
+
+func newRotateKeysResult(state *config.State, oldkeys *backend.KeyHierarchy, hiers ...hierarchy.Hierarchy) (*RotateKeysResult, error) {
+	result := &RotateKeysResult{
+		DryRun: rotateKeysCmdOptions.DryRun,
+		Keys:   []RotatedKey{},
+		Files:  []string{},
+	}
+	for _, hier := range hiers {
+		result.Keys = append(result.Keys, RotatedKey{
+			Hierarchy:      hier.String(),
+			OldFingerprint: backend.Fingerprint(oldkeys.GetKeyBackend(hier.Efivar())),
+		})
+	}
+	if err := sbctl.SigningEntryIter(state, func(s *sbctl.SigningEntry) error {
+		result.Files = append(result.Files, s.OutputFile)
 		return nil
+	}); err != nil {
+		return nil, err
+	}
+	slices.Sort(result.Files)
+	return result, nil
+}
+
+func (r *RotateKeysResult) setNewKeys(newkeys *backend.KeyHierarchy) {
+	for i, k := range r.Keys {
+		switch k.Hierarchy {
+		case hierarchy.PK.String():
+			r.Keys[i].NewFingerprint = backend.Fingerprint(newkeys.PK)
+		case hierarchy.KEK.String():
+			r.Keys[i].NewFingerprint = backend.Fingerprint(newkeys.KEK)
+		case hierarchy.Db.String():
+			r.Keys[i].NewFingerprint = backend.Fingerprint(newkeys.Db)
+		}
 	}
+}
+
+func (r *RotateKeysResult) printDryRun() {
+	for _, k := range r.Keys {
+		logging.Print("Would rotate %s (%s)\n", k.Hierarchy, k.OldFingerprint)
+	}
+	for _, f := range r.Files {
+		logging.Print("Would re-sign %s\n", f)
+	}
+}
 
-	return rotateKey(state, partial, rotateKeysCmdOptions.KeyFile, rotateKeysCmdOptions.CertFile)
+// rollbackRotation re-enrolls the old certificates for the hierarchies that
+// have already been rotated and re-signs the tracked files with the old keys.
+// The old keys need to be restored to the key directory by the caller.
+func rollbackRotation(state *config.State, rotated []hierarchy.Hierarchy, oldkeys *backend.KeyHierarchy, newkeys *backend.KeyHierarchy, efistate *sbctl.EFIVariables) error {
+	logging.Warn("Rolling back key rotation...")
+	// Swapping the old and new keys reverses the rotation. The order is
+	// preserved as the PK has to be restored before it can sign the KEK, and
+	// the KEK before it can sign the db.
+	for _, hier := range rotated {
+		if err := rotateCerts(state, hier, newkeys, oldkeys, efistate); err != nil {
+			return fmt.Errorf("could not restore %s: %v", hier, err)
+		}
+	}
+	if err := SignAll(state); err != nil {
+		return fmt.Errorf("failed resigning files with the old keys: %v", err)
+	}
+	return nil
 }
 
-func rotateAllKeys(state *config.State, backupDir, newKeysDir string) error {
+func rotateAllKeys(state *config.State, backupDir, newKeysDir string) (*RotateKeysResult, error) {
 	oldKeys, err := backend.GetKeyHierarchy(state.Fs, state)
 	if err != nil {
-		return fmt.Errorf("can't read old keys from dir: %v", err)
+		return nil, fmt.Errorf("can't read old keys from dir: %v", err)
+	}
+
+	result, err := newRotateKeysResult(state, oldKeys, hierarchy.PK, hierarchy.KEK, hierarchy.Db)
+	if err != nil {
+		return nil, err
 	}
 
+	var newKeyHierarchy *backend.KeyHierarchy
+
+	if newKeysDir != "" {
+		// Read the new keys before touching anything
+		newKeyHierarchy, err = backend.ImportKeys(state, newKeysDir)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't import secure boot keys: %w", err)
+		}
+		result.setNewKeys(newKeyHierarchy)
+	}
+
+	if rotateKeysCmdOptions.DryRun {
+		result.printDryRun()
+		return result, nil
+	}
+
+	// Only a dry run works without the EFI variables
+	if err := requireEfivarfs(state); err != nil {
+		return nil, err
+	}
 	efistate, err := sbctl.SystemEFIVariables(state.Efivarfs)
 	if err != nil {
-		return fmt.Errorf("can't read efivariables: %v", err)
+		return nil, fmt.Errorf("can't read efivariables: %v", err)
 	}
 
 	if backupDir == "" {
@@ -140,12 +269,20 @@ func rotateAllKeys(state *config.State, backupDir, newKeysDir string) error {
 	}
 
 	if err := sbctl.CopyDirectory(state.Fs, state.Config.Keydir, backupDir); err != nil {
-		return err
+		return nil, err
 	}
 	logging.Print("Backed up keys to %s\n", backupDir)
+	result.BackupDir = backupDir
+
+	restoreKeys := func() error {
+		if err := state.Fs.RemoveAll(state.Config.Keydir); err != nil {
+			return err
+		}
+		return sbctl.CopyDirectory(state.Fs, backupDir, state.Config.Keydir)
+	}
 
 	if err := state.Fs.RemoveAll(state.Config.Keydir); err != nil {
-		return fmt.Errorf("failed removing old keys: %v", err)
+		return nil, fmt.Errorf("failed removing old keys: %v", err)
 	}
 
 	// Should be own flag type, and deduplicated
@@ -166,94 +303,147 @@ func rotateAllKeys(state *config.State, backupDir, newKeysDir string) error {
 		}
 	}
 
-	var newKeyHierarchy *backend.KeyHierarchy
-
 	if newKeysDir == "" {
 		logging.Print("Creating secure boot keys...")
 		newKeyHierarchy, err = backend.CreateKeys(state)
 		if err != nil {
 			logging.NotOk("")
-			return fmt.Errorf("couldn't initialize secure boot: %w", err)
+			if rerr := restoreKeys(); rerr != nil {
+				return nil, fmt.Errorf("couldn't restore old keys from %s: %v", backupDir, rerr)
+			}
+			return nil, fmt.Errorf("couldn't initialize secure boot: %w", err)
 		}
 		err = newKeyHierarchy.SaveKeys(state.Fs, state.Config.Keydir)
 		if err != nil {
 			logging.NotOk("")
-			return fmt.Errorf("couldn't initialize secure boot: %w", err)
+			if rerr := restoreKeys(); rerr != nil {
+				return nil, fmt.Errorf("couldn't restore old keys from %s: %v", backupDir, rerr)
+			}
+			return nil, fmt.Errorf("couldn't initialize secure boot: %w", err)
 		}
 		logging.Ok("")
 		logging.Println("Secure boot keys created!")
-
 	} else {
 		logging.Print("Importing new secure boot keys from %s...", newKeysDir)
-		newKeyHierarchy, err = backend.ImportKeys(newKeysDir)
-		if err != nil {
-			logging.NotOk("")
-			return fmt.Errorf("couldn't import secure boot keys: %w", err)
-		}
 		err = newKeyHierarchy.SaveKeys(state.Fs, state.Config.Keydir)
 		if err != nil {
 			logging.NotOk("")
-			return fmt.Errorf("couldn't import secure boot keys: %w", err)
+			if rerr := restoreKeys(); rerr != nil {
+				return nil, fmt.Errorf("couldn't restore old keys from %s: %v", backupDir, rerr)
+			}
+			return nil, fmt.Errorf("couldn't import secure boot keys: %w", err)
 		}
 		logging.Ok("")
 		logging.Println("Secure boot keys updated!")
-
-	}
-
-	if err := rotateCerts(state, hierarchy.PK, oldKeys, newKeyHierarchy, efistate); err != nil {
-		return fmt.Errorf("could not rotate PK: %v", err)
 	}
+	result.setNewKeys(newKeyHierarchy)
 
-	if err := rotateCerts(state, hierarchy.KEK, oldKeys, newKeyHierarchy, efistate); err != nil {
-		return fmt.Errorf("could not rotate KEK: %v", err)
+	// rollback restores the old keys and firmware state if any later step fails
+	var rotated []hierarchy.Hierarchy
+	rollback := func(err error) error {
+		if rerr := restoreKeys(); rerr != nil {
+			return fmt.Errorf("%v: couldn't restore old keys from %s: %v", err, backupDir, rerr)
+		}
+		if rerr := rollbackRotation(state, rotated, oldKeys, newKeyHierarchy, efistate); rerr != nil {
+			return fmt.Errorf("%v: rollback failed: %v", err, rerr)
+		}
+		logging.Println("Rolled back to the old keys")
+		return err
 	}
 
-	if err := rotateCerts(state, hierarchy.Db, oldKeys, newKeyHierarchy, efistate); err != nil {
-		return fmt.Errorf("could not rotate Db: %v", err)
+	for _, hier := range []hierarchy.Hierarchy{hierarchy.PK, hierarchy.KEK, hierarchy.Db} {
+		if err := rotateCerts(state, hier, oldKeys, newKeyHierarchy, efistate); err != nil {
+			return nil, rollback(fmt.Errorf("could not rotate %s: %v", hier, err))
+		}
+		rotated = append(rotated, hier)
 	}
 
 	logging.Ok("Enrolled new keys into UEFI!")
 
 	if err := SignAll(state); err != nil {
-		return fmt.Errorf("failed resigning files: %v", err)
+		return nil, rollback(fmt.Errorf("failed resigning files: %v", err))
 	}
 
-	return nil
+	return result, nil
 }
 
-func rotateKey(state *config.State, hiera string, keyPath, certPath string) error {
+func rotateKey(state *config.State, hiera string, keyPath, certPath string) (*RotateKeysResult, error) {
 	if keyPath == "" {
-		return fmt.Errorf("a new key needs to be provided for a partial reset of %s", hiera)
+		return nil, fmt.Errorf("a new key needs to be provided for a partial reset of %s", hiera)
 	}
 
 	if certPath == "" {
-		return fmt.Errorf("a new certificate needs to be provided for a partial reset of %s", hiera)
+		return nil, fmt.Errorf("a new certificate needs to be provided for a partial reset of %s", hiera)
 	}
 
 	oldKH, err := backend.GetKeyHierarchy(state.Fs, state)
 	if err != nil {
-		return fmt.Errorf("can't read old keys from dir: %v", err)
+		return nil, fmt.Errorf("can't read old keys from dir: %v", err)
 	}
 
 	newCert, err := fs.ReadFile(state.Fs, certPath)
 	if err != nil {
-		return fmt.Errorf("can't read new certificate from path %s: %v", certPath, err)
+		return nil, fmt.Errorf("can't read new certificate from path %s: %v", certPath, err)
 	}
 
 	newKey, err := fs.ReadFile(state.Fs, keyPath)
 	if err != nil {
-		return fmt.Errorf("can't read new certificate from path %s: %v", certPath, err)
+		return nil, fmt.Errorf("can't read new certificate from path %s: %v", certPath, err)
 	}
 
 	// We will mutate this to the new state
 	newKH, err := backend.GetKeyHierarchy(state.Fs, state)
 	if err != nil {
-		return fmt.Errorf("can't read old keys from dir: %v", err)
+		return nil, fmt.Errorf("can't read old keys from dir: %v", err)
 	}
 
+	var hier hierarchy.Hierarchy
+	switch hiera {
+	case hierarchy.PK.String():
+		hier = hierarchy.PK
+	case hierarchy.KEK.String():
+		hier = hierarchy.KEK
+	case hierarchy.Db.String():
+		hier = hierarchy.Db
+	default:
+		return nil, fmt.Errorf("unknown efivar hierarchy: %s", hiera)
+	}
+
+	bk, err := backend.InitBackendFromKeys(state, newKey, newCert, hier)
+	if err != nil {
+		return nil, fmt.Errorf("could not rotate %s: %v", hier, err)
+	}
+	switch hier {
+	case hierarchy.PK:
+		newKH.PK = bk
+	case hierarchy.KEK:
+		newKH.KEK = bk
+	case hierarchy.Db:
+		newKH.Db = bk
+	}
+
+	result, err := newRotateKeysResult(state, oldKH, hier)
+	if err != nil {
+		return nil, err
+	}
+	// Only the db key signs files
+	if hier != hierarchy.Db {
+		result.Files = []string{}
+	}
+	result.setNewKeys(newKH)
+
+	if rotateKeysCmdOptions.DryRun {
+		result.printDryRun()
+		return result, nil
+	}
+
+	// Only a dry run works without the EFI variables
+	if err := requireEfivarfs(state); err != nil {
+		return nil, err
+	}
 	efistate, err := sbctl.SystemEFIVariables(state.Efivarfs)
 	if err != nil {
-		return fmt.Errorf("can't read efivariables: %v", err)
+		return nil, fmt.Errorf("can't read efivariables: %v", err)
 	}
 
 	// Should be own flag type, and deduplicated
@@ -274,43 +464,31 @@ func rotateKey(state *config.State, hiera string, keyPath, certPath string) erro
 		}
 	}
 
-	switch hiera {
-	case hierarchy.PK.String():
-		bk, err := backend.InitBackendFromKeys(state, newKey, newCert, hierarchy.PK)
-		if err != nil {
-			return fmt.Errorf("could not rotate PK: %v", err)
-		}
-		newKH.PK = bk
-		if err := rotateCerts(state, hierarchy.PK, oldKH, newKH, efistate); err != nil {
-			return fmt.Errorf("could not rotate PK: %v", err)
-		}
-	case hierarchy.KEK.String():
-		bk, err := backend.InitBackendFromKeys(state, newKey, newCert, hierarchy.KEK)
-		if err != nil {
-			return fmt.Errorf("could not rotate KEK: %v", err)
-		}
-		newKH.KEK = bk
-		if err := rotateCerts(state, hierarchy.KEK, oldKH, newKH, efistate); err != nil {
-			return fmt.Errorf("could not rotate KEK: %v", err)
-		}
-	case hierarchy.Db.String():
-		bk, err := backend.InitBackendFromKeys(state, newKey, newCert, hierarchy.Db)
-		if err != nil {
-			return fmt.Errorf("could not rotate db: %v", err)
-		}
-		newKH.Db = bk
-		if err := rotateCerts(state, hierarchy.Db, oldKH, newKH, efistate); err != nil {
-			return fmt.Errorf("could not rotate db: %v", err)
-		}
+	if err := rotateCerts(state, hier, oldKH, newKH, efistate); err != nil {
+		return nil, fmt.Errorf("could not rotate %s: %v", hier, err)
 	}
 
 	if err := newKH.SaveKeys(state.Fs, state.Config.Keydir); err != nil {
-		return fmt.Errorf("can't save new key hierarchy: %v", err)
+		return nil, fmt.Errorf("can't save new key hierarchy: %v", err)
 	}
 
 	logging.Ok("Enrolled new key of hierarchy %s into UEFI!", hiera)
 
-	return nil
+	if hier == hierarchy.Db {
+		if err := SignAll(state); err != nil {
+			serr := fmt.Errorf("failed resigning files: %v", err)
+			if rerr := oldKH.SaveKeys(state.Fs, state.Config.Keydir); rerr != nil {
+				return nil, fmt.Errorf("%v: couldn't restore old keys: %v", serr, rerr)
+			}
+			if rerr := rollbackRotation(state, []hierarchy.Hierarchy{hier}, oldKH, newKH, efistate); rerr != nil {
+				return nil, fmt.Errorf("%v: rollback failed: %v", serr, rerr)
+			}
+			logging.Println("Rolled back to the old keys")
+			return nil, serr
+		}
+	}
+
+	return result, nil
 }
 
 func rotateKeysCmdFlags(cmd *cobra.Command) {
@@ -320,6 +498,7 @@ func rotateKeysCmdFlags(cmd *cobra.Command) {
 	f.VarPF(&rotateKeysCmdOptions.Partial, "partial", "p", "rotate a key of a specific hierarchy")
 	f.StringVarP(&rotateKeysCmdOptions.KeyFile, "key-file", "k", "", "key file to replace (only with partial flag)")
 	f.StringVarP(&rotateKeysCmdOptions.CertFile, "cert-file", "c", "", "certificate file to replace (only with partial flag)")
+	f.BoolVarP(&rotateKeysCmdOptions.DryRun, "dry-run", "", false, "print the keys and files that would change without changing anything")
 
 	f.StringVarP(&rotateKeysCmdOptions.Keytype, "keytype", "", "", "key type for all keys")
 	f.StringVarP(&rotateKeysCmdOptions.PKKeytype, "pk-keytype", "", "", "PK key type (default: file)")
@@ -330,6 +509,8 @@ func rotateKeysCmdFlags(cmd *cobra.Command) {
 func init() {
 	rotateKeysCmdFlags(rotateKeysCmd)
 	CliCommands = append(CliCommands, cliCommand{
-		Cmd: rotateKeysCmd,
+		Cmd:   rotateKeysCmd,
+		Lock:  true,
+		Hooks: true,
 	})
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/foxboron/go-uefi/efi/efitest"
+	"github.com/foxboron/go-uefi/efivarfs/testfs"
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/hierarchy"
+)
+
+func setupRotateState(t *testing.T) *config.State {
+	mapfs := fstest.MapFS{
+		systemEventlog:   {Data: mustBytes("../../tests/tpm_eventlogs/t480s_eventlog")},
+		"/boot/test.efi": {Data: mustBytes("../../tests/binaries/test.pecoff")},
+	}
+
+	conf := config.DefaultConfig()
+	conf.Landlock = false
+	conf.Files = []*config.FileConfig{
+		{Path: "/boot/test.efi", Output: "/boot/new.efi"},
+	}
+
+	state := &config.State{
+		Fs: efitest.FromMapFS(mapfs),
+		Efivarfs: testfs.NewTestFS().
+			With(efitest.SetUpModeOn(),
+				mapfs,
+			).
+			Open(),
+		Config: conf,
+	}
+
+	enrollKeysCmdOptions.IgnoreImmutable = true
+	if err := SetupInstallation(state); err != nil {
+		t.Fatalf("failed running SetupInstallation: %v", err)
+	}
+	return state
+}
+
+func TestRotateAllKeys(t *testing.T) {
+	state := setupRotateState(t)
+
+	oldKeys, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		t.Fatalf("can't get key hierarchy: %v", err)
+	}
+
+	result, err := rotateAllKeys(state, "", "")
+	if err != nil {
+		t.Fatalf("failed rotating keys: %v", err)
+	}
+
+	newKeys, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		t.Fatalf("can't get key hierarchy: %v", err)
+	}
+	if backend.Fingerprint(oldKeys.Db) == backend.Fingerprint(newKeys.Db) {
+		t.Fatalf("db key was not rotated")
+	}
+	for _, k := range result.Keys {
+		if k.NewFingerprint == "" || k.NewFingerprint == k.OldFingerprint {
+			t.Fatalf("%s: unexpected fingerprints %s -> %s", k.Hierarchy, k.OldFingerprint, k.NewFingerprint)
+		}
+	}
+
+	ok, err := sbctl.VerifyFile(state, newKeys, hierarchy.Db, "/boot/new.efi")
+	if err != nil {
+		t.Fatalf("can't verify file: %v", err)
+	}
+	if !ok {
+		t.Fatalf("file is not signed with the new db key")
+	}
+}
+
+func TestRotateAllKeysDryRun(t *testing.T) {
+	state := setupRotateState(t)
+
+	oldKeys, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		t.Fatalf("can't get key hierarchy: %v", err)
+	}
+
+	rotateKeysCmdOptions.DryRun = true
+	defer func() { rotateKeysCmdOptions.DryRun = false }()
+
+	result, err := rotateAllKeys(state, "", "")
+	if err != nil {
+		t.Fatalf("failed rotating keys: %v", err)
+	}
+	if len(result.Files) != 1 || result.Files[0] != "/boot/new.efi" {
+		t.Fatalf("unexpected files in dry run: %v", result.Files)
+	}
+
+	keys, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		t.Fatalf("can't get key hierarchy: %v", err)
+	}
+	if backend.Fingerprint(oldKeys.Db) != backend.Fingerprint(keys.Db) {
+		t.Fatalf("dry run rotated the db key")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/landlock-lsm/go-landlock/landlock"
+	"github.com/spf13/cobra"
+)
+
+// SbatSection is the .sbat section of a binary
+type SbatSection struct {
+	File    string            `json:"file"`
+	Entries []sbctl.SbatEntry `json:"entries"`
+}
+
+var (
+	sbatCmd = &cobra.Command{
+		Use:   "sbat",
+		Short: "SBAT related commands",
+	}
+	sbatShowCmd = &cobra.Command{
+		Use:   "show <file>...",
+		Short: "Print the .sbat section of EFI binaries",
+		Long: `Print the .sbat section of EFI binaries.
+
+Shim and GRUB carry the generation of their components in the .sbat section.
+Shim refuses binaries with a component below the generation in its SbatLevel
+policy, which verify warns about.`,
+		Args:              cobra.MinimumNArgs(1),
+		ValidArgsFunction: completeFiles,
+		RunE:              RunSbatShow,
+	}
+)
+
+func RunSbatShow(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+
+	if state.Config.Landlock {
+		lsm.RestrictAdditionalPaths(
+			landlock.ROFiles(args...).IgnoreIfMissing(),
+		)
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+
+	sections := []SbatSection{}
+	for _, file := range args {
+		entries, err := sbctl.ReadSbat(state.Fs, file)
+		if err != nil {
+			return err
+		}
+		sections = append(sections, SbatSection{File: file, Entries: entries})
+	}
+	if cmdOptions.StructuredOutput() {
+		return StructuredOut(sections)
+	}
+
+	for i, s := range sections {
+		if i > 0 {
+			logging.Print("\n")
+		}
+		logging.Print("%s:\n", s.File)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "COMPONENT\tGENERATION\tVENDOR\tPACKAGE\tVERSION\tURL")
+		for _, e := range s.Entries {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n", e.Component, e.Generation, e.Vendor, e.Package, e.Version, e.URL)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifySbat warns if shim would refuse the file for its SBAT generations.
+// Files without a readable .sbat section, and systems not booted with shim,
+// are skipped.
+func verifySbat(state *config.State, fileentry *VerifiedFile) {
+	if state.Efivarfs == nil {
+		return
+	}
+	level, err := sbctl.GetSbatLevel(state.Efivarfs)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	} else if err != nil {
+		logging.Warn("can't read the SBAT policy of shim: %v", err)
+		return
+	}
+	entries, err := sbctl.ReadSbat(state.Fs, fileentry.FileName)
+	if errors.Is(err, sbctl.ErrInvalidSbat) {
+		logging.Warn("%v", err)
+		return
+	} else if err != nil {
+		return
+	}
+	fileentry.SbatRevoked = level.Revoked(entries)
+	for _, r := range fileentry.SbatRevoked {
+		logging.Warn("%s is revoked by SBAT: %s generation %d is below %d, shim refuses to load it",
+			fileentry.FileName, r.Component, r.Generation, r.Required)
+	}
+}
+
+func init() {
+	sbatCmd.AddCommand(sbatShowCmd)
+	CliCommands = append(CliCommands, cliCommand{
+		Cmd: sbatCmd,
+	})
+}
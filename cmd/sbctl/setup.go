@@ -22,6 +22,9 @@ type SetupCmdOptions struct {
 	PrintState  bool
 	Migrate     bool
 	Setup       bool
+	PacmanHook  bool
+	KernelHook  bool
+	Force       bool
 }
 
 var (
@@ -45,7 +48,7 @@ func PrintConfig(state *config.State) error {
 		if err != nil {
 			return err
 		}
-		state.Config, err = config.NewConfig(b)
+		state.Config, err = config.NewConfigFormat(b, config.DetectFormat(cmdOptions.Config, b))
 		if err != nil {
 			return err
 		}
@@ -75,8 +78,8 @@ func PrintConfig(state *config.State) error {
 	}
 
 	ser = state.Config
-	if setupCmdOptions.PrintState && !cmdOptions.JsonOutput {
-		return fmt.Errorf("can only use --print-state with --json")
+	if setupCmdOptions.PrintState && !cmdOptions.StructuredOutput() {
+		return fmt.Errorf("can only use --print-state with --json or --yaml")
 	}
 
 	if setupCmdOptions.PrintState {
@@ -85,8 +88,8 @@ func PrintConfig(state *config.State) error {
 		ser = state.Config
 	}
 
-	if cmdOptions.JsonOutput {
-		if err := JsonOut(ser); err != nil {
+	if cmdOptions.StructuredOutput() {
+		if err := StructuredOut(ser); err != nil {
 			return err
 		}
 		return nil
@@ -212,6 +215,13 @@ func MigrateSetup(state *config.State) error {
 func RunSetup(cmd *cobra.Command, args []string) error {
 	state := cmd.Context().Value(stateDataKey{}).(*config.State)
 
+	if setupCmdOptions.PacmanHook && state.Config.Landlock {
+		pacmanHookLandlockRules()
+	}
+	if setupCmdOptions.KernelHook && state.Config.Landlock {
+		kernelInstallLandlockRules()
+	}
+
 	if setupCmdOptions.Setup {
 		if err := SetupInstallation(state); err != nil {
 			return err
@@ -224,6 +234,18 @@ func RunSetup(cmd *cobra.Command, args []string) error {
 		}
 	}
 
+	if setupCmdOptions.PacmanHook {
+		if err := GeneratePacmanHook(state, setupCmdOptions.Force); err != nil {
+			return err
+		}
+	}
+
+	if setupCmdOptions.KernelHook {
+		if err := GenerateKernelInstallPlugin(state, setupCmdOptions.Force); err != nil {
+			return err
+		}
+	}
+
 	if setupCmdOptions.PrintConfig || setupCmdOptions.PrintState {
 		return PrintConfig(state)
 	}
@@ -237,11 +259,17 @@ func setupCmdFlags(cmd *cobra.Command) {
 	f.BoolVarP(&setupCmdOptions.PrintState, "print-state", "", false, "print the state of sbctl")
 	f.BoolVarP(&setupCmdOptions.Migrate, "migrate", "", false, "migrate the sbctl installation")
 	f.BoolVarP(&setupCmdOptions.Setup, "setup", "", false, "setup the sbctl installation")
+	f.BoolVarP(&setupCmdOptions.PacmanHook, "generate-pacman-hook", "", false, "write a pacman hook signing the tracked files")
+	f.BoolVarP(&setupCmdOptions.KernelHook, "generate-kernel-install-plugin", "", false, "write a kernel-install plugin signing installed kernels and the tracked files")
+	f.BoolVarP(&setupCmdOptions.Force, "force", "", false, "overwrite an existing pacman hook or kernel-install plugin")
 }
 
 func init() {
 	setupCmdFlags(setupCmd)
+	vendorFlags(setupCmd)
 	CliCommands = append(CliCommands, cliCommand{
-		Cmd: setupCmd,
+		Cmd:   setupCmd,
+		Lock:  true,
+		Hooks: true,
 	})
 }
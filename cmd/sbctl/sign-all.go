@@ -7,14 +7,18 @@ import (
 	"github.com/foxboron/sbctl"
 	"github.com/foxboron/sbctl/backend"
 	"github.com/foxboron/sbctl/config"
-	"github.com/foxboron/sbctl/hierarchy"
 	"github.com/foxboron/sbctl/logging"
 	"github.com/foxboron/sbctl/lsm"
 	"github.com/spf13/cobra"
 )
 
 var (
-	generate bool
+	generate               bool
+	signAllJobs            int
+	signAllIgnoreImmutable bool
+	signAllIfUnsigned      bool
+	signAllOnly            []string
+	signAllExclude         []string
 )
 
 var signAllCmd = &cobra.Command{
@@ -23,6 +27,12 @@ var signAllCmd = &cobra.Command{
 	RunE: func(cmd *cobra.Command, args []string) error {
 		var gerr error
 		state := cmd.Context().Value(stateDataKey{}).(*config.State)
+		if err := checkGlobs("--only", signAllOnly); err != nil {
+			return err
+		}
+		if err := checkGlobs("--exclude", signAllExclude); err != nil {
+			return err
+		}
 		// Don't run landlock if we are making UKIs
 		if state.Config.Landlock && !generate {
 			if err := sbctl.LandlockFromFileDatabase(state); err != nil {
@@ -33,14 +43,31 @@ var signAllCmd = &cobra.Command{
 			}
 		}
 
+		// Bundles are regenerated when their inputs changed. A failed bundle
+		// doesn't stop the remaining files from being signed, but fails the
+		// command.
 		if generate {
-			sign = true
-			if err := generateBundlesCmd.RunE(cmd, args); err != nil {
+			if err := GenerateBundles(state, true, true); err != nil {
 				gerr = ErrSilent
-				logging.Error(err)
+				if !errors.Is(err, ErrSilent) {
+					logging.Error(err)
+				}
 			}
 		}
-		serr := SignAll(state)
+		results, serr := SignAllFiles(state, signAllJobs, signAllIgnoreImmutable)
+		if results == nil && serr != nil {
+			return serr
+		}
+		if len(results) == 0 && (len(signAllOnly) > 0 || len(signAllExclude) > 0) {
+			logging.Warn("No tracked files match the --only and --exclude patterns")
+		}
+		if cmdOptions.StructuredOutput() {
+			if err := StructuredOut(results); err != nil {
+				return err
+			}
+		} else if signAllIfUnsigned {
+			printSignSummary(results)
+		}
 		if serr != nil || gerr != nil {
 			return ErrSilent
 		}
@@ -48,48 +75,97 @@ var signAllCmd = &cobra.Command{
 	},
 }
 
+// SignAll signs all files in the file database. Failures are logged.
 func SignAll(state *config.State) error {
-	var signerr error
-	files, err := sbctl.ReadFileDatabase(state.Fs, state.Config.FilesDb)
-	if err != nil {
+	results, err := SignAllFiles(state, signAllJobs, false)
+	if results == nil && err != nil {
 		return err
 	}
-	for _, entry := range files {
+	if err != nil {
+		// Ensure we are getting os.Exit(1)
+		return ErrSilent
+	}
+	return nil
+}
 
-		kh, err := backend.GetKeyHierarchy(state.Fs, state)
-		if err != nil {
-			return err
+// SignAllFiles signs the files in the file database with up to jobs files in
+// parallel and logs the result of each file, see sbctl.Signer.SignAll.
+func SignAllFiles(state *config.State, jobs int, skipUnwritable bool) ([]*sbctl.SignResult, error) {
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		return nil, err
+	}
+	signer := sbctl.NewSigner(state, kh)
+	signer.Jobs = jobs
+	signer.SkipUnwritable = skipUnwritable
+	signer.IfUnsigned = signAllIfUnsigned
+	if len(signAllOnly) > 0 || len(signAllExclude) > 0 {
+		signer.Filter = signAllSelected
+	}
+	signer.OnResult = func(res *sbctl.SignResult) {
+		switch res.Status {
+		case sbctl.SignStatusAlreadySigned:
+			logging.Print("File has already been signed %s\n", res.OutputFile)
+		case sbctl.SignStatusSkipped:
+			logging.Warn("Skipping %s as it can't be written: %v", res.OutputFile, res.Err)
+		case sbctl.SignStatusFailed:
+			logging.Error(fmt.Errorf("failed signing %s: %w", res.File, res.Err))
+		case sbctl.SignStatusSigned:
+			logging.Ok("Signed %s", res.OutputFile)
 		}
-
-		err = sbctl.SignFile(state, kh, hierarchy.Db, entry.File, entry.OutputFile)
-		if errors.Is(err, sbctl.ErrAlreadySigned) {
-			logging.Print("File has already been signed %s\n", entry.OutputFile)
-		} else if err != nil {
-			logging.Error(fmt.Errorf("failed signing %s: %w", entry.File, err))
-			// Ensure we are getting os.Exit(1)
-			signerr = ErrSilent
-			continue
-		} else {
-			logging.Ok("Signed %s", entry.OutputFile)
+	}
+	results, err := signer.SignAll()
+	if results != nil {
+		if perr := sbctl.WriteIPEPolicy(state); perr != nil {
+			logging.Error(fmt.Errorf("failed updating the IPE policy: %w", perr))
+			err = errors.Join(err, perr)
 		}
+	}
+	return results, err
+}
 
-		// Update checksum after we signed it
-		files[entry.File] = entry
-		if err := sbctl.WriteFileDatabase(state.Fs, state.Config.FilesDb, files); err != nil {
-			return err
+// signAllSelected returns true if the file or its output matches one of the
+// --only patterns, and neither matches an --exclude pattern
+func signAllSelected(entry *sbctl.SigningEntry) bool {
+	matches := func(patterns []string) bool {
+		return matchesGlob(patterns, entry.File) || matchesGlob(patterns, entry.OutputFile)
+	}
+	if len(signAllOnly) > 0 && !matches(signAllOnly) {
+		return false
+	}
+	return !matches(signAllExclude)
+}
+
+// printSignSummary prints how many files were signed, and how many were
+// skipped as they are already signed
+func printSignSummary(results []*sbctl.SignResult) {
+	var signed, skipped int
+	for _, res := range results {
+		switch res.Status {
+		case sbctl.SignStatusSigned:
+			signed++
+		case sbctl.SignStatusAlreadySigned:
+			skipped++
 		}
 	}
-	return signerr
+	logging.Print("Signed %d files, skipped %d already signed files\n", signed, skipped)
 }
 
 func signAllCmdFlags(cmd *cobra.Command) {
 	f := cmd.Flags()
-	f.BoolVarP(&generate, "generate", "g", false, "run all generate-* sub-commands before signing")
+	f.BoolVarP(&generate, "generate", "g", false, "regenerate bundles with changed inputs before signing")
+	f.IntVarP(&signAllJobs, "jobs", "j", 0, "number of files to sign in parallel, 1 with sign hooks configured (default GOMAXPROCS)")
+	f.BoolVarP(&signAllIgnoreImmutable, "ignore-immutable", "", false, "skip files on read-only mounts or with the immutable bit set and sign the rest")
+	f.StringArrayVarP(&signAllOnly, "only", "", nil, "only sign the tracked files matching the glob pattern, can be passed multiple times")
+	f.StringArrayVarP(&signAllExclude, "exclude", "", nil, "skip the tracked files matching the glob pattern, can be passed multiple times")
+	f.BoolVarP(&signAllIfUnsigned, "if-unsigned", "", false, "check for files already signed by the current db key before signing, and print how many files were signed and skipped")
 }
 
 func init() {
 	signAllCmdFlags(signAllCmd)
 	CliCommands = append(CliCommands, cliCommand{
-		Cmd: signAllCmd,
+		Cmd:   signAllCmd,
+		Lock:  true,
+		Hooks: true,
 	})
 }
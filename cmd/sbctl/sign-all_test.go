@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"testing"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/hierarchy"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/spf13/afero"
+)
+
+func TestSignAllFilesParallel(t *testing.T) {
+	state := setupRotateState(t)
+
+	files, err := sbctl.ReadFileDatabase(state.Fs, state.Config.FilesDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		f := fmt.Sprintf("/boot/test%d.efi", i)
+		if err := afero.WriteFile(state.Fs, f, mustBytes("../../tests/binaries/test.pecoff"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		files[f] = &sbctl.SigningEntry{File: f, OutputFile: f}
+	}
+	if err := sbctl.WriteFileDatabase(state.Fs, state.Config.FilesDb, files); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := SignAllFiles(state, 4, false)
+	if err != nil {
+		t.Fatalf("failed signing files: %v", err)
+	}
+	if len(results) != len(files) {
+		t.Fatalf("expected %d results, got %d", len(files), len(results))
+	}
+	if !sort.SliceIsSorted(results, func(i, j int) bool { return results[i].File < results[j].File }) {
+		t.Fatalf("results are not sorted by path")
+	}
+
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, res := range results {
+		if res.Status != "signed" && res.Status != "already signed" {
+			t.Fatalf("%s: unexpected status %s", res.File, res.Status)
+		}
+		ok, err := sbctl.VerifyFile(state, kh, hierarchy.Db, res.OutputFile)
+		if err != nil || !ok {
+			t.Fatalf("%s is not signed: %v", res.OutputFile, err)
+		}
+	}
+}
+
+func TestSignAllFilesFailure(t *testing.T) {
+	state := setupRotateState(t)
+
+	files, err := sbctl.ReadFileDatabase(state.Fs, state.Config.FilesDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files["/boot/missing.efi"] = &sbctl.SigningEntry{File: "/boot/missing.efi", OutputFile: "/boot/missing.efi"}
+	if err := sbctl.WriteFileDatabase(state.Fs, state.Config.FilesDb, files); err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := SignAllFiles(state, 1, false)
+	if err == nil {
+		t.Fatalf("expected an error signing a missing file")
+	}
+	if results[0].File != "/boot/missing.efi" || results[0].Status != "failed" {
+		t.Fatalf("unexpected result %+v", results[0])
+	}
+	// The first failure cancels the remaining files
+	if results[1].Status != "skipped" {
+		t.Fatalf("expected %s to be skipped, got %s", results[1].File, results[1].Status)
+	}
+}
+
+// immutableFs fails writes to the path like a file with the immutable bit set
+type immutableFs struct {
+	afero.Fs
+	path string
+}
+
+func (i immutableFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if name == i.path && flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EPERM}
+	}
+	return i.Fs.OpenFile(name, flag, perm)
+}
+
+func TestSignAllFilesIgnoreImmutable(t *testing.T) {
+	state := setupRotateState(t)
+
+	files, err := sbctl.ReadFileDatabase(state.Fs, state.Config.FilesDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Sorts before /boot/test.efi so signing would be cancelled
+	if err := afero.WriteFile(state.Fs, "/boot/locked.efi", mustBytes("../../tests/binaries/test.pecoff"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	files["/boot/locked.efi"] = &sbctl.SigningEntry{File: "/boot/locked.efi", OutputFile: "/boot/locked.efi"}
+	if err := sbctl.WriteFileDatabase(state.Fs, state.Config.FilesDb, files); err != nil {
+		t.Fatal(err)
+	}
+	state.Fs = immutableFs{Fs: state.Fs, path: "/boot/locked.efi"}
+
+	results, err := SignAllFiles(state, 1, true)
+	if !errors.Is(err, sbctl.ErrUnwritableFiles) {
+		t.Fatalf("expected sbctl.ErrUnwritableFiles, got %v", err)
+	}
+	if results[0].File != "/boot/locked.efi" || results[0].Status != "skipped" || results[0].Error == "" {
+		t.Fatalf("unexpected result %+v", results[0])
+	}
+	if results[1].Status != "already signed" {
+		t.Fatalf("expected %s to be signed, got %s", results[1].File, results[1].Status)
+	}
+}
+
+func TestSignAllIfUnsigned(t *testing.T) {
+	state := setupRotateState(t)
+	signAllIfUnsigned = true
+	defer func() { signAllIfUnsigned = false }()
+
+	statuses := func() map[string]string {
+		results, err := SignAllFiles(state, 1, false)
+		if err != nil {
+			t.Fatalf("failed signing files: %v", err)
+		}
+		m := map[string]string{}
+		for _, res := range results {
+			m[res.OutputFile] = res.Status
+		}
+		return m
+	}
+
+	signed, err := afero.ReadFile(state.Fs, "/boot/new.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := statuses(); s["/boot/new.efi"] != sbctl.SignStatusAlreadySigned {
+		t.Fatalf("expected the signed file to be skipped: %v", s)
+	}
+	if b, _ := afero.ReadFile(state.Fs, "/boot/new.efi"); !bytes.Equal(b, signed) {
+		t.Fatalf("the skipped file was written")
+	}
+
+	// Files signed by the rotated key are signed again
+	if _, err := rotateAllKeys(state, "", ""); err != nil {
+		t.Fatalf("failed rotating keys: %v", err)
+	}
+	if err := afero.WriteFile(state.Fs, "/boot/new.efi", signed, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if s := statuses(); s["/boot/new.efi"] != sbctl.SignStatusSigned {
+		t.Fatalf("expected the file signed by the old key to be signed: %v", s)
+	}
+	if s := statuses(); s["/boot/new.efi"] != sbctl.SignStatusAlreadySigned {
+		t.Fatalf("expected the file to be skipped after signing it: %v", s)
+	}
+
+	logging.PrintOn()
+	out, err := captureOutput(func() error {
+		printSignSummary([]*sbctl.SignResult{{Status: sbctl.SignStatusSigned}, {Status: sbctl.SignStatusAlreadySigned}, {Status: sbctl.SignStatusAlreadySigned}})
+		return nil
+	})
+	if err != nil || !bytes.Contains(out, []byte("Signed 1 files, skipped 2 already signed files")) {
+		t.Fatalf("unexpected summary %q", out)
+	}
+}
+
+func TestSignAllOnlyExclude(t *testing.T) {
+	state := setupRotateState(t)
+
+	files, err := sbctl.ReadFileDatabase(state.Fs, state.Config.FilesDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"/boot/vmlinuz-linux", "/boot/vmlinuz-linux-lts", "/boot/EFI/BOOT/BOOTX64.EFI"} {
+		if err := afero.WriteFile(state.Fs, f, mustBytes("../../tests/binaries/test.pecoff"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		files[f] = &sbctl.SigningEntry{File: f, OutputFile: f}
+	}
+	if err := sbctl.WriteFileDatabase(state.Fs, state.Config.FilesDb, files); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { signAllOnly, signAllExclude = nil, nil }()
+
+	signed := func() []string {
+		results, err := SignAllFiles(state, 2, false)
+		if err != nil {
+			t.Fatalf("failed signing files: %v", err)
+		}
+		var files []string
+		for _, res := range results {
+			files = append(files, res.File)
+		}
+		return files
+	}
+
+	signAllOnly = []string{"vmlinuz-*"}
+	if s := signed(); fmt.Sprint(s) != "[/boot/vmlinuz-linux /boot/vmlinuz-linux-lts]" {
+		t.Fatalf("expected only the kernels to be signed, got %v", s)
+	}
+	signAllExclude = []string{"*-lts"}
+	if s := signed(); fmt.Sprint(s) != "[/boot/vmlinuz-linux]" {
+		t.Fatalf("expected the lts kernel to be excluded, got %v", s)
+	}
+	signAllOnly, signAllExclude = nil, []string{"/boot/EFI/*/*", "*.efi"}
+	if s := signed(); fmt.Sprint(s) != "[/boot/vmlinuz-linux /boot/vmlinuz-linux-lts]" {
+		t.Fatalf("expected the bootloaders to be excluded, got %v", s)
+	}
+
+	if err := checkGlobs("--only", []string{"["}); err == nil {
+		t.Fatalf("expected an error for a malformed pattern")
+	}
+}
+
+func TestSignAllFilesHooksSerial(t *testing.T) {
+	state := setupRotateState(t)
+
+	files, err := sbctl.ReadFileDatabase(state.Fs, state.Config.FilesDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		f := fmt.Sprintf("/boot/test%d.efi", i)
+		if err := afero.WriteFile(state.Fs, f, mustBytes("../../tests/binaries/test.pecoff"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		files[f] = &sbctl.SigningEntry{File: f, OutputFile: f}
+	}
+	if err := sbctl.WriteFileDatabase(state.Fs, state.Config.FilesDb, files); err != nil {
+		t.Fatal(err)
+	}
+
+	// pre_sign fails if the hooks of another file are still running
+	lock := filepath.Join(t.TempDir(), "lock")
+	state.Config.Hooks = &config.HooksConfig{
+		PreSign:  []string{"mkdir " + lock + " && sleep 0.05"},
+		PostSign: []string{"rmdir " + lock},
+	}
+	results, err := SignAllFiles(state, 4, false)
+	if err != nil {
+		t.Fatalf("the sign hooks ran in parallel: %v", err)
+	}
+	if len(results) != len(files) {
+		t.Fatalf("expected %d results, got %d", len(files), len(results))
+	}
+}
@@ -1,28 +1,73 @@
 package main
 
 import (
+	"crypto/x509"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 
 	"github.com/foxboron/sbctl"
 	"github.com/foxboron/sbctl/backend"
 	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/foxboron/sbctl/hierarchy"
 	"github.com/foxboron/sbctl/logging"
 	"github.com/foxboron/sbctl/lsm"
+	"github.com/foxboron/sbctl/stringset"
 	"github.com/landlock-lsm/go-landlock/landlock"
 	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
 )
 
 var (
-	save   bool
-	output string
+	save      bool
+	output    string
+	detached  bool
+	uki       bool
+	tbsHash   bool
+	attachSig bool
+	signRoot  string
+	timestamp string
+	hashAlgo  = stringset.StringSet{Allowed: backend.HashAlgorithms, IgnoreCase: true}
+	signToken TokenCmdOptions
+	// Skip files already signed by the current db key before anything is
+	// written
+	ifUnsigned bool
+	// Sign the EFI binaries in the directories given as arguments
+	signRecursive bool
+	signExclude   []string
+	// Update the PE checksum of the signed file, or only update it
+	peChecksumFix     bool
+	peChecksumFixOnly bool
+	// Sign with this key and certificate instead of the db key
+	signKey  string
+	signCert string
+
+	ErrDetachedSave = errors.New("detached signatures can't be saved to the database")
+	ErrDetachedUKI  = errors.New("--uki can't be combined with --detached")
+	ErrPolicySave   = errors.New("the PCR policy of --uki --output is only signed into the output, sign-all would replace it from the input file. Sign the file in place to save it")
+	ErrExternalSign = errors.New("--tbs-hash and --attach-signature can't be combined with --detached, --uki or --save")
+	ErrAttachArgs   = errors.New("--attach-signature requires a file and a signature")
+	ErrRootUKI      = errors.New("--root can't be combined with --uki")
+	ErrIfUnsigned   = errors.New("--if-unsigned can't be combined with --detached, --tbs-hash or --attach-signature")
+	ErrRecursive    = errors.New("--recursive can't be combined with --output, --detached, --uki, --tbs-hash, --attach-signature or --root")
+	ErrHashAlgo     = errors.New("--hash-algo can't be combined with --tbs-hash or --attach-signature")
+	ErrChecksumOnly = errors.New("--pe-checksum-fix-only can't be combined with --save, --detached, --uki, --tbs-hash, --attach-signature, --if-unsigned or --recursive")
+	ErrSignKeyCert  = errors.New("--key and --cert have to be given together, unless --cert is given with --attach-signature")
+	ErrSignKey      = errors.New("--key can't be combined with --save, --recursive, --tbs-hash, --attach-signature, --pe-checksum-fix-only, --token or --signer")
 )
 
+type TBSHashResult struct {
+	File    string `json:"file"`
+	TBSHash string `json:"tbs_hash"`
+}
+
 var signCmd = &cobra.Command{
-	Use:   "sign",
-	Short: "Sign a file with secure boot keys",
+	Use:               "sign",
+	Short:             "Sign a file with secure boot keys",
+	ValidArgsFunction: completeFiles,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		state := cmd.Context().Value(stateDataKey{}).(*config.State)
 
@@ -30,16 +75,132 @@ var signCmd = &cobra.Command{
 			logging.Print("Requires a file to sign\n")
 			os.Exit(1)
 		}
+		if ifUnsigned && (detached || tbsHash || attachSig) {
+			return ErrIfUnsigned
+		}
+		if peChecksumFixOnly && (save || detached || uki || tbsHash || attachSig || ifUnsigned || signRecursive) {
+			return ErrChecksumOnly
+		}
+		// --cert alone names the certificate of a raw --attach-signature
+		if signKey != "" || (signCert != "" && !attachSig) {
+			if signKey == "" || signCert == "" {
+				return ErrSignKeyCert
+			}
+			if save || signRecursive || tbsHash || attachSig || peChecksumFixOnly || signToken.Token != "" || signToken.Signer != "" {
+				return ErrSignKey
+			}
+			// The key directory and the file database are left alone
+			conf := *state.Config
+			conf.Keydir = ""
+			conf.IPEPolicy = ""
+			keyState := *state
+			keyState.Config = &conf
+			state = &keyState
+		}
+		if peChecksumFix {
+			state.Config.FixPEChecksum = true
+		}
+		if tbsHash || attachSig {
+			if hashAlgo.Value != "" {
+				return ErrHashAlgo
+			}
+		} else if err := setHashAlgo(state); err != nil {
+			return err
+		}
+		if signRecursive {
+			if output != "" || detached || uki || tbsHash || attachSig || signRoot != "" {
+				return ErrRecursive
+			}
+			if timestamp != "" {
+				state.Config.TimestampURL = timestamp
+				lsm.AllowNetwork()
+			}
+			return signTree(state, args)
+		}
 
 		var rules []landlock.Rule
+		if signKey != "" {
+			rules = append(rules, landlock.ROFiles(signKey, signCert).IgnoreIfMissing())
+		}
+
+		// The keys are always read from the host, everything else from the
+		// root if one is given
+		hostState := state
+		root, err := signRootPath()
+		if err != nil {
+			return err
+		}
+		if root != "" {
+			if uki {
+				return ErrRootUKI
+			}
+			rootState := *state
+			rootState.Fs = afero.NewBasePathFs(state.Fs, root)
+			state = &rootState
+		}
+		// Landlock rules are given the paths on the host
+		hostPath := func(p string) string { return filepath.Join(root, p) }
 
 		// Ensure we have absolute paths
-		file, err := filepath.Abs(args[0])
+		file, err := signPath(args[0])
 		if err != nil {
 			return err
 		}
-		// Get output path from database for file if output not specified
-		if output == "" {
+		if uki && detached {
+			return ErrDetachedUKI
+		}
+		if (tbsHash || attachSig) && (detached || uki || save) {
+			return ErrExternalSign
+		}
+		if timestamp != "" {
+			if tbsHash || attachSig {
+				return errors.New("--timestamp-url can't be combined with --tbs-hash or --attach-signature")
+			}
+			state.Config.TimestampURL = timestamp
+			lsm.AllowNetwork()
+		}
+		if tbsHash && attachSig {
+			return errors.New("--tbs-hash can't be combined with --attach-signature")
+		}
+		if tbsHash {
+			return printTBSHash(state, file, hostPath(file))
+		}
+		var sigFile, certFile string
+		// The IPE policy has the digests of all of the tracked files
+		if root == "" && !detached && state.Config.IPEPolicy != "" {
+			if err := sbctl.LandlockFromFileDatabase(state); err != nil {
+				return err
+			}
+		}
+
+		if attachSig {
+			if len(args) != 2 {
+				return ErrAttachArgs
+			}
+			if sigFile, err = filepath.Abs(args[1]); err != nil {
+				return err
+			}
+			certFile = signCert
+			if certFile == "" {
+				certFile = state.Config.Keys.Db.Pubkey
+			}
+			if certFile, err = filepath.Abs(certFile); err != nil {
+				return err
+			}
+			rules = append(rules, landlock.ROFiles(sigFile, certFile).IgnoreIfMissing())
+		}
+		if detached {
+			if save {
+				return ErrDetachedSave
+			}
+			if output == "" {
+				output = file + ".sig"
+			}
+		}
+
+		// Get output path from database for file if output not specified. The
+		// checksum is fixed in place, the saved output is signed.
+		if output == "" && !peChecksumFixOnly && signKey == "" {
 			files, err := sbctl.ReadFileDatabase(state.Fs, state.Config.FilesDb)
 			if err != nil {
 				return err
@@ -54,21 +215,115 @@ var signCmd = &cobra.Command{
 
 		if output == "" {
 			output = file
-			rules = append(rules, lsm.TruncFile(file).IgnoreIfMissing())
+			rules = append(rules, lsm.TruncFile(hostPath(file)).IgnoreIfMissing())
 		} else {
-			output, err = filepath.Abs(output)
+			output, err = signPath(output)
 			if err != nil {
 				return err
 			}
 			// Set input file to RO and output dir/file to RW
-			rules = append(rules, landlock.ROFiles(file).IgnoreIfMissing())
+			rules = append(rules, landlock.ROFiles(hostPath(file)).IgnoreIfMissing())
 			if ok, _ := afero.Exists(state.Fs, output); ok {
-				rules = append(rules, lsm.TruncFile(output))
+				rules = append(rules, lsm.TruncFile(hostPath(output)))
 			} else {
-				rules = append(rules, landlock.RWDirs(filepath.Dir(output)))
+				rules = append(rules, landlock.RWDirs(hostPath(filepath.Dir(output))))
+			}
+		}
+
+		// The file database of the image is used, and created when saving
+		// the first file to it
+		if root != "" {
+			if save {
+				if err := state.Fs.MkdirAll(filepath.Dir(state.Config.FilesDb), 0755); err != nil {
+					return err
+				}
 			}
+			rules = append(rules, landlock.RWDirs(hostPath(filepath.Dir(state.Config.FilesDb))).IgnoreIfMissing())
 		}
 
+		if attachSig {
+			if state.Config.Landlock {
+				lsm.RestrictAdditionalPaths(rules...)
+				if err := lsm.Restrict(); err != nil {
+					return err
+				}
+			}
+			sig, err := fs.ReadFile(hostState.Fs, sigFile)
+			if err != nil {
+				return err
+			}
+			// The certificate is only needed for a raw signature
+			var cert *x509.Certificate
+			if b, err := fs.ReadFile(hostState.Fs, certFile); err == nil {
+				if cert, err = sbctl.ParseCertificate(b); err != nil {
+					return fmt.Errorf("%s: %w", certFile, err)
+				}
+			}
+			if err := sbctl.AttachSignature(state, file, output, sig, cert); err != nil {
+				return err
+			}
+			logging.Ok("Attached the signature to %s", output)
+			return nil
+		}
+
+		if peChecksumFixOnly {
+			if state.Config.Landlock {
+				lsm.RestrictAdditionalPaths(rules...)
+				if err := lsm.Restrict(); err != nil {
+					return err
+				}
+			}
+			fixed, err := sbctl.FixPEChecksumFile(state, file, output)
+			if err != nil {
+				return err
+			}
+			if fixed {
+				logging.Ok("Fixed the PE checksum of %s", output)
+			} else {
+				logging.Print("The PE checksum of %s is correct\n", output)
+			}
+			return nil
+		}
+
+		tokenKey, err := openToken(hostState, &signToken)
+		if err != nil {
+			return err
+		}
+		if tokenKey != nil {
+			defer tokenKey.Close()
+		}
+
+		var ukiImage *sbctl.UKI
+		if uki {
+			if ukiImage, err = sbctl.ReadUKI(state.Fs, file); err != nil {
+				return err
+			}
+		}
+		signPolicy := ukiImage != nil && state.Config.PCRPolicy != nil
+
+		// systemd-measure and objcopy are executed to sign the PCR policy,
+		// which read the key and the measured sections, and objcopy writes a
+		// temporary file next to the image
+		var policyDir string
+		if signPolicy {
+			if policyDir, err = os.MkdirTemp("", "sbctl-uki-"); err != nil {
+				return err
+			}
+			defer os.RemoveAll(policyDir)
+			policy := state.Config.PCRPolicy
+			rules = append(rules,
+				landlock.ROFiles(policy.Privkey).IgnoreIfMissing(),
+				landlock.RWDirs(policyDir, filepath.Dir(output)),
+			)
+			if policy.Pubkey != "" {
+				rules = append(rules, landlock.ROFiles(policy.Pubkey).IgnoreIfMissing())
+			}
+			if policy.KeyType() == config.PCRPolicyTPM {
+				// The TPM devices are allowed by default
+				rules = append(rules, landlock.RODirs("/etc/tpm2-tss").IgnoreIfMissing())
+			}
+			lsm.AllowExec(sbctl.UKIPolicyPrograms()...)
+		}
 		if state.Config.Landlock {
 			lsm.RestrictAdditionalPaths(rules...)
 			if err := lsm.Restrict(); err != nil {
@@ -76,12 +331,65 @@ var signCmd = &cobra.Command{
 			}
 		}
 
-		kh, err := backend.GetKeyHierarchy(state.Fs, state)
+		var kh *backend.KeyHierarchy
+		if signKey != "" {
+			kh, err = backend.SigningKeyHierarchy(hostState, signKey, signCert)
+		} else {
+			kh, err = backend.GetKeyHierarchy(hostState.Fs, hostState)
+		}
 		if err != nil {
 			return err
 		}
+		if err := useToken(kh, tokenKey); err != nil {
+			return err
+		}
+
+		// Checked before the PCR policy is signed, which rewrites the file
+		if skip, err := skipSigned(state, kh, file, output, save); err != nil {
+			return err
+		} else if skip {
+			if save && root == "" {
+				if err := sbctl.WriteIPEPolicy(state); err != nil {
+					return fmt.Errorf("failed updating the IPE policy: %w", err)
+				}
+			}
+			logging.Print("File has already been signed %s\n", output)
+			return nil
+		}
+
+		if detached {
+			if err := sbctl.SignFileDetached(state, kh, hierarchy.Db, file, output); err != nil {
+				return err
+			}
+			logging.Ok("Wrote detached signature %s", output)
+			return nil
+		}
+
+		if signPolicy && output != file {
+			if save {
+				return ErrPolicySave
+			}
+			// Leave the input untouched and add the policy sections to a
+			// copy, which is then signed in place
+			if ukiImage, err = copyUKI(state, file, output); err != nil {
+				return err
+			}
+			file = output
+		}
+		if signPolicy {
+			// The policy sections are added to the file itself, so signing
+			// it again from the file database keeps them
+			if err := sbctl.SignUKIPolicy(state, ukiImage, policyDir); err != nil {
+				return err
+			}
+			logging.Ok("Signed the PCR policy of %s", file)
+		}
 
-		err = sbctl.Sign(state, kh, file, output, save)
+		if signKey != "" {
+			err = sbctl.SignFile(state, kh, hierarchy.Db, file, output)
+		} else {
+			err = sbctl.Sign(state, kh, file, output, save)
+		}
 		if errors.Is(err, sbctl.ErrAlreadySigned) {
 			logging.Print("File has already been signed %s\n", output)
 		} else if err != nil {
@@ -89,19 +397,288 @@ var signCmd = &cobra.Command{
 		} else {
 			logging.Ok("Signed %s", output)
 		}
+		if root == "" {
+			if err := sbctl.WriteIPEPolicy(state); err != nil {
+				return fmt.Errorf("failed updating the IPE policy: %w", err)
+			}
+		}
 		return nil
 	},
 }
 
+// matchesGlob returns true if path or its base name matches one of the glob
+// patterns
+func matchesGlob(patterns []string, path string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, filepath.Base(path)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkGlobs returns an error for the first malformed pattern of flag
+func checkGlobs(flag string, patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid %s pattern %q: %w", flag, pattern, err)
+		}
+	}
+	return nil
+}
+
+// signExcluded returns true if path or its base name matches one of the
+// --exclude patterns
+func signExcluded(path string) bool {
+	return matchesGlob(signExclude, path)
+}
+
+// findEFIBinaries returns the PE executables below dir, skipping the files
+// and directories matching --exclude
+func findEFIBinaries(state *config.State, dir string) ([]string, error) {
+	var files []string
+	err := afero.Walk(state.Fs, dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && signExcluded(path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := state.Fs.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if ok, err := sbctl.CheckPE(f); err != nil {
+			return fmt.Errorf("failed to read file %s: %w", path, err)
+		} else if ok {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// skipSigned reports if signing is skipped with --if-unsigned, as output is
+// already signed by the current db key. Only signing is skipped, with save the
+// file is still saved to the file database.
+func skipSigned(state *config.State, kh *backend.KeyHierarchy, file, output string, save bool) (bool, error) {
+	if !ifUnsigned {
+		return false, nil
+	}
+	if ok, err := sbctl.IsSigned(state, kh, file, output); err != nil || !ok {
+		return false, err
+	}
+	if save {
+		if err := sbctl.SaveFile(state, file, output); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// signTree signs the EFI binaries in the directories and saves them to the
+// file database. Files which are already in the database are signed to their
+// saved output, and the outputs of other files are left to sign-all.
+func signTree(state *config.State, dirs []string) error {
+	if err := checkGlobs("--exclude", signExclude); err != nil {
+		return err
+	}
+	for i, dir := range dirs {
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		dirs[i] = dir
+	}
+	if state.Config.Landlock {
+		for _, dir := range dirs {
+			lsm.RestrictAdditionalPaths(landlock.RWDirs(dir).IgnoreIfMissing())
+		}
+	}
+
+	tokenKey, err := openToken(state, &signToken)
+	if err != nil {
+		return err
+	}
+	if tokenKey != nil {
+		defer tokenKey.Close()
+	}
+	if state.Config.Landlock {
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		return err
+	}
+	if err := useToken(kh, tokenKey); err != nil {
+		return err
+	}
+
+	files, err := sbctl.ReadFileDatabase(state.Fs, state.Config.FilesDb)
+	if err != nil {
+		return err
+	}
+	outputs := make(map[string]bool)
+	for _, entry := range files {
+		if entry.OutputFile != entry.File {
+			outputs[entry.OutputFile] = true
+		}
+	}
+
+	var failed bool
+	var results []*sbctl.SignResult
+	for _, dir := range dirs {
+		binaries, err := findEFIBinaries(state, dir)
+		if err != nil {
+			return err
+		}
+		for _, file := range binaries {
+			if outputs[file] {
+				continue
+			}
+			out, save := file, true
+			if entry, ok := files[file]; ok {
+				out, save = entry.OutputFile, false
+			}
+			res := &sbctl.SignResult{File: file, OutputFile: out}
+			skip, err := skipSigned(state, kh, file, out, save)
+			if skip {
+				err = sbctl.ErrAlreadySigned
+			} else if err == nil {
+				err = sbctl.Sign(state, kh, file, out, save)
+			}
+			switch {
+			case errors.Is(err, sbctl.ErrAlreadySigned):
+				logging.Print("File has already been signed %s\n", out)
+				res.Status = sbctl.SignStatusAlreadySigned
+			case err != nil:
+				logging.Error(fmt.Errorf("failed signing %s: %w", file, err))
+				res.Status = sbctl.SignStatusFailed
+				failed = true
+			default:
+				logging.Ok("Signed %s", out)
+				res.Status = sbctl.SignStatusSigned
+			}
+			results = append(results, res)
+		}
+	}
+	if ifUnsigned {
+		printSignSummary(results)
+	}
+	if failed {
+		return ErrSilent
+	}
+	return nil
+}
+
+// printTBSHash prints the digest an external signer has to sign for
+// --attach-signature
+func printTBSHash(state *config.State, file, hostFile string) error {
+	if state.Config.Landlock {
+		lsm.RestrictAdditionalPaths(landlock.ROFiles(hostFile).IgnoreIfMissing())
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+	digest, err := sbctl.TBSHash(state, file)
+	if err != nil {
+		return err
+	}
+	if cmdOptions.StructuredOutput() {
+		return StructuredOut(TBSHashResult{File: file, TBSHash: hex.EncodeToString(digest)})
+	}
+	logging.Println(hex.EncodeToString(digest))
+	return nil
+}
+
+// signRootPath returns the absolute path of --root, or an empty string if
+// files are signed on the host
+func signRootPath() (string, error) {
+	if signRoot == "" {
+		return "", nil
+	}
+	return filepath.Abs(signRoot)
+}
+
+// signPath makes path absolute. Under --root, relative paths are relative to
+// the root rather than the working directory.
+func signPath(path string) (string, error) {
+	if signRoot != "" {
+		return filepath.Join("/", path), nil
+	}
+	return filepath.Abs(path)
+}
+
+// copyUKI copies the unified kernel image in file to output
+func copyUKI(state *config.State, file, output string) (*sbctl.UKI, error) {
+	fi, err := state.Fs.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	b, err := fs.ReadFile(state.Fs, file)
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.WriteFile(state.Fs, output, b, fi.Mode()); err != nil {
+		return nil, err
+	}
+	return sbctl.ReadUKI(state.Fs, output)
+}
+
+// setHashAlgo applies --hash-algo to the configuration and warns if the digest
+// algorithm is one firmware might not accept
+func setHashAlgo(state *config.State) error {
+	if hashAlgo.Value != "" {
+		state.Config.HashAlgo = hashAlgo.Value
+	}
+	alg, err := backend.ParseHashAlgorithm(state.Config.HashAlgo)
+	if err != nil {
+		return err
+	}
+	if !alg.IsCommon() {
+		logging.Warn("Most UEFI firmware only verifies %s signatures, %s signed files might not boot", backend.SHA256, alg)
+	}
+	return nil
+}
+
 func signCmdFlags(cmd *cobra.Command) {
 	f := cmd.Flags()
 	f.BoolVarP(&save, "save", "s", false, "save file to the database")
-	f.StringVarP(&output, "output", "o", "", "output filename. Default replaces the file")
+	f.StringVarP(&output, "output", "o", "", "write the signed file to this path and leave the file untouched. Default replaces the file")
+	f.BoolVarP(&detached, "detached", "", false, "write a detached signature to <file>.sig instead of embedding it")
+	f.BoolVarP(&tbsHash, "tbs-hash", "", false, "print the authenticode hash to be signed by an external signer instead of signing")
+	f.BoolVarP(&attachSig, "attach-signature", "", false, "embed the PKCS#7 signature given as the second argument, made by an external signer, into the file")
+	f.StringVarP(&timestamp, "timestamp-url", "", "", "timestamp the signature with the RFC 3161 TSA at this url")
+	f.VarPF(&hashAlgo, "hash-algo", "", "digest algorithm of the signature, overrides hash_algo of the configuration (default: sha256)")
+	f.StringVarP(&signRoot, "root", "", "", "sign files inside this directory, such as a mounted disk image, using its file database")
+	f.BoolVarP(&signRecursive, "recursive", "r", false, "sign and save all EFI binaries in the directories given as arguments")
+	f.StringArrayVarP(&signExclude, "exclude", "", nil, "skip files and directories matching the glob pattern with --recursive, can be passed multiple times")
+	f.BoolVarP(&ifUnsigned, "if-unsigned", "", false, "skip the file if it is already signed by the current db key and print how many files were signed and skipped")
+	f.BoolVarP(&peChecksumFix, "pe-checksum-fix", "", false, "update the PE checksum of the signed file, enabled for every file by fix_pe_checksum in the configuration")
+	f.BoolVarP(&peChecksumFixOnly, "pe-checksum-fix-only", "", false, "update the PE checksum of the file without signing it")
+	f.BoolVarP(&uki, "uki", "", false, "validate the file as a unified kernel image and sign its PCR policy with the pcr_policy key")
+	f.StringVarP(&signKey, "key", "", "", "sign with this private key instead of the db key, without using the key directory or the file database")
+	f.StringVarP(&signCert, "cert", "", "", "certificate of the --key private key, or of the key which made a raw --attach-signature signature")
+	tokenFlags(f, &signToken)
 }
 
 func init() {
 	signCmdFlags(signCmd)
 	CliCommands = append(CliCommands, cliCommand{
-		Cmd: signCmd,
+		Cmd:   signCmd,
+		Lock:  true,
+		Hooks: true,
 	})
 }
@@ -0,0 +1,877 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/foxboron/sbctl/hierarchy"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+
+	ll "github.com/landlock-lsm/go-landlock/landlock/syscall"
+)
+
+func TestSignOutput(t *testing.T) {
+	state := setupRotateState(t)
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.WithValue(context.Background(), stateDataKey{}, state))
+
+	before, err := sbctl.ReadFileDatabase(state.Fs, state.Config.FilesDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output = "/boot/signed.efi"
+	defer func() { output = "" }()
+	if err := signCmd.RunE(cmd, []string{"/boot/test.efi"}); err != nil {
+		t.Fatalf("failed signing to output: %v", err)
+	}
+
+	b, err := fs.ReadFile(state.Fs, "/boot/test.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, mustBytes("../../tests/binaries/test.pecoff")) {
+		t.Fatalf("signing with --output modified the input")
+	}
+	verifiedFiles = nil
+	if err := VerifyOneFile(state, "/boot/signed.efi"); err != nil || verifiedFiles[0].IsSigned != 1 {
+		t.Fatalf("expected the output to be signed: %v %+v", err, verifiedFiles)
+	}
+
+	after, err := sbctl.ReadFileDatabase(state.Fs, state.Config.FilesDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) || after["/boot/test.efi"].OutputFile != "/boot/new.efi" {
+		t.Fatalf("signing with --output changed the file database: %+v", after)
+	}
+}
+
+func TestAttachSignature(t *testing.T) {
+	state := setupRotateState(t)
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.WithValue(context.Background(), stateDataKey{}, state))
+
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sign the TBS hash the way an external signer would, the certificate of
+	// the raw signature defaults to the db certificate
+	digest, err := sbctl.TBSHash(state, "/boot/test.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := kh.Db.Signer().Sign(rand.Reader, digest, crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile(state.Fs, "/boot/test.efi.sig", sig, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	attachSig = true
+	output = "/boot/signed.efi"
+	defer func() { attachSig = false; output = "" }()
+	if err := signCmd.RunE(cmd, []string{"/boot/test.efi", "/boot/test.efi.sig"}); err != nil {
+		t.Fatalf("failed attaching the signature: %v", err)
+	}
+	ok, err := sbctl.VerifyFile(state, kh, hierarchy.Db, "/boot/signed.efi")
+	if err != nil || !ok {
+		t.Fatalf("expected the output to be signed: %v", err)
+	}
+
+	// A complete PKCS#7 signature is attached as it is
+	b, err := fs.ReadFile(state.Fs, "/boot/test.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peBinary, err := authenticode.Parse(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs7Sig, err := backend.SignAuthenticode(kh.Db.Signer(), kh.Db.Certificate(), peBinary.HashContent.Bytes(), crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sbctl.AttachSignature(state, "/boot/test.efi", "/boot/pkcs7.efi", pkcs7Sig, nil); err != nil {
+		t.Fatalf("failed attaching the PKCS#7 signature: %v", err)
+	}
+
+	other, err := kh.Db.Signer().Sign(rand.Reader, bytes.Repeat([]byte{0x01}, len(digest)), crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sbctl.AttachSignature(state, "/boot/test.efi", "/boot/other.efi", other, kh.Db.Certificate()); !errors.Is(err, sbctl.ErrSignatureMismatch) {
+		t.Fatalf("expected ErrSignatureMismatch, got %v", err)
+	}
+}
+
+func TestAttachSignatureSigner(t *testing.T) {
+	state := setupRotateState(t)
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.WithValue(context.Background(), stateDataKey{}, state))
+
+	// An external signer only exposes a crypto.Signer and its certificate
+	var signer crypto.Signer
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer = key
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "HSM db key"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, signer.Public(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile(state.Fs, "/etc/hsm/db.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	digest, err := sbctl.TBSHash(state, "/boot/test.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := signer.Sign(rand.Reader, digest, crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile(state.Fs, "/boot/test.efi.sig", sig, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	attachSig = true
+	signCert = "/etc/hsm/db.pem"
+	output = "/boot/signed.efi"
+	defer func() { attachSig = false; signCert = ""; output = "" }()
+	if err := signCmd.RunE(cmd, []string{"/boot/test.efi", "/boot/test.efi.sig"}); err != nil {
+		t.Fatalf("failed attaching the signature: %v", err)
+	}
+
+	b, err := fs.ReadFile(state.Fs, "/boot/signed.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peBinary, err := authenticode.Parse(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := backend.VerifyPEBinary(peBinary, cert); err != nil || !ok {
+		t.Fatalf("expected the output to verify with the signer certificate: %v", err)
+	}
+	if ok, err := peBinary.Verify(cert); err != nil || !ok {
+		t.Fatalf("expected the output to verify with go-uefi: %v", err)
+	}
+}
+
+func TestSignRoot(t *testing.T) {
+	state := setupRotateState(t)
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.WithValue(context.Background(), stateDataKey{}, state))
+
+	if err := fs.WriteFile(state.Fs, "/mnt/image/foo/bootx64.efi", mustBytes("../../tests/binaries/test.pecoff"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	before, err := sbctl.ReadFileDatabase(state.Fs, state.Config.FilesDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signRoot = "/mnt/image"
+	save = true
+	defer func() { signRoot = ""; save = false }()
+	if err := signCmd.RunE(cmd, []string{"foo/bootx64.efi"}); err != nil {
+		t.Fatalf("failed signing under the root: %v", err)
+	}
+
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := sbctl.VerifyFile(state, kh, hierarchy.Db, "/mnt/image/foo/bootx64.efi")
+	if err != nil || !ok {
+		t.Fatalf("expected the file in the image to be signed: %v", err)
+	}
+
+	image, err := sbctl.ReadFileDatabase(state.Fs, filepath.Join("/mnt/image", state.Config.FilesDb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, ok := image["/foo/bootx64.efi"]; !ok || entry.OutputFile != "/foo/bootx64.efi" {
+		t.Fatalf("expected the file in the file database of the image: %+v", image)
+	}
+	after, err := sbctl.ReadFileDatabase(state.Fs, state.Config.FilesDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Fatalf("signing under the root changed the file database of the host: %+v", after)
+	}
+}
+
+func TestSignRecursive(t *testing.T) {
+	state := setupRotateState(t)
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.WithValue(context.Background(), stateDataKey{}, state))
+
+	pecoff := mustBytes("../../tests/binaries/test.pecoff")
+	for path, data := range map[string][]byte{
+		"/boot/EFI/Linux/a.EFI":   pecoff,
+		"/boot/EFI/tools/shell":   pecoff,
+		"/boot/EFI/skip/b.efi":    pecoff,
+		"/boot/EFI/tools/old.efi": pecoff,
+		"/boot/EFI/readme.txt":    []byte("not an EFI binary"),
+		"/boot/EFI/tools/dos":     append([]byte("MZ"), make([]byte, 128)...),
+	} {
+		if err := fs.WriteFile(state.Fs, path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Earlier commands leave the output of the file database behind
+	output = ""
+	signRecursive = true
+	signExclude = []string{"skip", "*.efi"}
+	defer func() { signRecursive, signExclude = false, nil }()
+	if err := signCmd.RunE(cmd, []string{"/boot"}); err != nil {
+		t.Fatalf("failed signing recursively: %v", err)
+	}
+
+	files, err := sbctl.ReadFileDatabase(state.Fs, state.Config.FilesDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"/boot/EFI/Linux/a.EFI", "/boot/EFI/tools/shell"} {
+		if files[f] == nil || files[f].OutputFile != f {
+			t.Fatalf("expected %s to be saved, got %+v", f, files)
+		}
+		verifiedFiles = nil
+		if err := VerifyOneFile(state, f); err != nil || verifiedFiles[0].IsSigned != 1 {
+			t.Fatalf("expected %s to be signed: %v %+v", f, err, verifiedFiles)
+		}
+	}
+	for _, f := range []string{"/boot/EFI/skip/b.efi", "/boot/EFI/tools/old.efi", "/boot/EFI/readme.txt", "/boot/EFI/tools/dos"} {
+		if files[f] != nil {
+			t.Fatalf("expected %s to be skipped", f)
+		}
+	}
+	// Files in the database keep their output
+	if len(files) != 3 || files["/boot/test.efi"].OutputFile != "/boot/new.efi" {
+		t.Fatalf("unexpected file database %+v", files)
+	}
+
+	signRecursive, signExclude = true, []string{"["}
+	if err := signCmd.RunE(cmd, []string{"/boot"}); err == nil {
+		t.Fatalf("expected an invalid pattern to fail")
+	}
+	signRecursive, signExclude, output = true, nil, "/boot/out.efi"
+	defer func() { output = "" }()
+	if err := signCmd.RunE(cmd, []string{"/boot"}); !errors.Is(err, ErrRecursive) {
+		t.Fatalf("expected ErrRecursive, got %v", err)
+	}
+}
+
+func TestSignRecursiveIfUnsigned(t *testing.T) {
+	state := setupRotateState(t)
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.WithValue(context.Background(), stateDataKey{}, state))
+
+	if err := fs.WriteFile(state.Fs, "/boot/EFI/Linux/a.efi", mustBytes("../../tests/binaries/test.pecoff"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	output = ""
+	signRecursive = true
+	defer func() { signRecursive, ifUnsigned, hashAlgo.Value = false, false, "" }()
+	if err := signCmd.RunE(cmd, []string{"/boot/EFI"}); err != nil {
+		t.Fatalf("failed signing recursively: %v", err)
+	}
+	signed, err := fs.ReadFile(state.Fs, "/boot/EFI/Linux/a.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The already signed file is left untouched
+	ifUnsigned = true
+	if err := signCmd.RunE(cmd, []string{"/boot/EFI"}); err != nil {
+		t.Fatalf("failed signing recursively: %v", err)
+	}
+	if b, _ := fs.ReadFile(state.Fs, "/boot/EFI/Linux/a.efi"); !bytes.Equal(b, signed) {
+		t.Fatal("the already signed file was signed again")
+	}
+
+	// A signature with another digest algorithm doesn't count
+	hashAlgo.Value = "sha384"
+	if err := signCmd.RunE(cmd, []string{"/boot/EFI"}); err != nil {
+		t.Fatalf("failed signing recursively: %v", err)
+	}
+	b, err := fs.ReadFile(state.Fs, "/boot/EFI/Linux/a.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	peBinary, err := authenticode.Parse(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigs, err := peBinary.Signatures()
+	if err != nil || len(sigs) != 2 {
+		t.Fatalf("expected the file to be signed again, got %d signatures: %v", len(sigs), err)
+	}
+	auth, err := authenticode.ParseAuthenticode(sigs[1].Certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, err := backend.AuthenticodeHash(auth); err != nil || h != crypto.SHA384 {
+		t.Fatalf("expected a %s signature, got %s: %v", crypto.SHA384, h, err)
+	}
+}
+
+func TestSignHashAlgo(t *testing.T) {
+	state := setupRotateState(t)
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.WithValue(context.Background(), stateDataKey{}, state))
+	defer func() {
+		output = ""
+		hashAlgo.Value = ""
+	}()
+
+	for _, tc := range []struct {
+		flag   string
+		config string
+		hash   crypto.Hash
+	}{
+		{"", "", crypto.SHA256},
+		{"sha384", "", crypto.SHA384},
+		{"", "sha512", crypto.SHA512},
+		{"sha256", "sha512", crypto.SHA256},
+	} {
+		state.Config.HashAlgo = tc.config
+		hashAlgo.Value = tc.flag
+		output = "/boot/signed-" + tc.hash.String() + ".efi"
+		if err := signCmd.RunE(cmd, []string{"/boot/test.efi"}); err != nil {
+			t.Fatalf("failed signing with %s: %v", tc.hash, err)
+		}
+
+		b, err := fs.ReadFile(state.Fs, output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peBinary, err := authenticode.Parse(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sigs, err := peBinary.Signatures()
+		if err != nil || len(sigs) != 1 {
+			t.Fatalf("expected one signature, got %d: %v", len(sigs), err)
+		}
+		auth, err := authenticode.ParseAuthenticode(sigs[0].Certificate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h, err := backend.AuthenticodeHash(auth); err != nil || h != tc.hash {
+			t.Fatalf("expected a %s signature, got %s: %v", tc.hash, h, err)
+		}
+
+		verifiedFiles = nil
+		if err := VerifyOneFile(state, output); err != nil || verifiedFiles[0].IsSigned != 1 {
+			t.Fatalf("expected the %s signature to verify: %v %+v", tc.hash, err, verifiedFiles)
+		}
+
+		// The signature doesn't verify for a modified binary
+		b[len(b)/4] ^= 0xff
+		if err := fs.WriteFile(state.Fs, "/boot/modified.efi", b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		verifiedFiles = nil
+		if err := VerifyOneFile(state, "/boot/modified.efi"); err == nil && verifiedFiles[0].IsSigned == 1 {
+			t.Fatalf("expected the modified %s binary to not verify", tc.hash)
+		}
+	}
+
+	// Switching the digest algorithm signs the file again
+	state.Config.HashAlgo = ""
+	hashAlgo.Value = "sha384"
+	output = "/boot/signed-SHA-256.efi"
+	if err := signCmd.RunE(cmd, []string{"/boot/test.efi"}); err != nil {
+		t.Fatalf("failed signing with %s: %v", crypto.SHA384, err)
+	}
+	b, err := fs.ReadFile(state.Fs, output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peBinary, err := authenticode.Parse(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigs, err := peBinary.Signatures()
+	if err != nil || len(sigs) != 1 {
+		t.Fatalf("expected one signature, got %d: %v", len(sigs), err)
+	}
+	auth, err := authenticode.ParseAuthenticode(sigs[0].Certificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h, err := backend.AuthenticodeHash(auth); err != nil || h != crypto.SHA384 {
+		t.Fatalf("expected the file to be signed again with %s, got %s: %v", crypto.SHA384, h, err)
+	}
+
+	output = ""
+	hashAlgo.Value = "sha512"
+	tbsHash = true
+	defer func() { tbsHash = false }()
+	if err := signCmd.RunE(cmd, []string{"/boot/test.efi"}); !errors.Is(err, ErrHashAlgo) {
+		t.Fatalf("expected ErrHashAlgo with --tbs-hash, got %v", err)
+	}
+}
+
+func TestSignPEChecksum(t *testing.T) {
+	state := setupRotateState(t)
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.WithValue(context.Background(), stateDataKey{}, state))
+	defer func() {
+		output = ""
+		peChecksumFix = false
+		peChecksumFixOnly = false
+	}()
+
+	// Mangle the checksum of the test binary
+	b := mustBytes("../../tests/binaries/test.pecoff")
+	b[binary.LittleEndian.Uint32(b[0x3c:])+4+20+64] ^= 0xff
+	if err := fs.WriteFile(state.Fs, "/boot/mangled.efi", b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	checksumValid := func(file string) bool {
+		t.Helper()
+		b, err := fs.ReadFile(state.Fs, file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored, computed, err := sbctl.PEChecksum(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stored == computed
+	}
+
+	peChecksumFixOnly = true
+	output = "/boot/fixed.efi"
+	if err := signCmd.RunE(cmd, []string{"/boot/mangled.efi"}); err != nil {
+		t.Fatalf("failed fixing the checksum: %v", err)
+	}
+	if !checksumValid("/boot/fixed.efi") || checksumValid("/boot/mangled.efi") {
+		t.Fatal("expected only the output checksum to be fixed")
+	}
+	save = true
+	if err := signCmd.RunE(cmd, []string{"/boot/mangled.efi"}); !errors.Is(err, ErrChecksumOnly) {
+		t.Fatalf("expected ErrChecksumOnly, got %v", err)
+	}
+	save = false
+	peChecksumFixOnly = false
+
+	peChecksumFix = true
+	output = "/boot/signed.efi"
+	if err := signCmd.RunE(cmd, []string{"/boot/mangled.efi"}); err != nil {
+		t.Fatalf("failed signing: %v", err)
+	}
+	if !checksumValid("/boot/signed.efi") {
+		t.Fatal("the checksum of the signed file is stale")
+	}
+	verifiedFiles = nil
+	if err := VerifyOneFile(state, "/boot/signed.efi"); err != nil || verifiedFiles[0].IsSigned != 1 {
+		t.Fatalf("expected the output to be signed: %v %+v", err, verifiedFiles)
+	}
+
+	if _, err := exec.LookPath("sbverify"); err != nil {
+		t.Skip("sbverify is not installed")
+	}
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	signed, err := fs.ReadFile(state.Fs, "/boot/signed.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "signed.efi"), signed, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: kh.Db.Certificate().Raw})
+	if err := os.WriteFile(filepath.Join(dir, "db.pem"), cert, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("sbverify", "--cert", filepath.Join(dir, "db.pem"), filepath.Join(dir, "signed.efi")).CombinedOutput()
+	if err != nil {
+		t.Fatalf("sbverify failed: %v\n%s", err, out)
+	}
+}
+
+func TestSignKeyCert(t *testing.T) {
+	state := setupRotateState(t)
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.WithValue(context.Background(), stateDataKey{}, state))
+
+	key, err := backend.NewFileKey(hierarchy.Db, "Ephemeral Key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := backend.NewFileKey(hierarchy.Db, "Other Key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for file, b := range map[string][]byte{
+		"/tmp/key.pem":   key.PrivateKeyBytes(),
+		"/tmp/cert.pem":  key.CertificateBytes(),
+		"/tmp/other.pem": other.CertificateBytes(),
+	} {
+		if err := fs.WriteFile(state.Fs, file, b, 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, err := fs.ReadFile(state.Fs, state.Config.FilesDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() { signKey, signCert = "", "" }()
+	signKey, signCert = "/tmp/key.pem", "/tmp/other.pem"
+	if err := signCmd.RunE(cmd, []string{"/boot/test.efi"}); !errors.Is(err, backend.ErrKeyMismatch) {
+		t.Fatalf("expected ErrKeyMismatch, got %v", err)
+	}
+	save = true
+	if err := signCmd.RunE(cmd, []string{"/boot/test.efi"}); !errors.Is(err, ErrSignKey) {
+		t.Fatalf("expected ErrSignKey with --save, got %v", err)
+	}
+	save = false
+
+	// The saved output of the file is ignored, it is signed in place
+	signCert = "/tmp/cert.pem"
+	if err := signCmd.RunE(cmd, []string{"/boot/test.efi"}); err != nil {
+		t.Fatalf("failed signing with --key: %v", err)
+	}
+	f, err := state.Fs.Open("/boot/test.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	kh := &backend.KeyHierarchy{Db: key}
+	if ok, err := kh.VerifyFile(hierarchy.Db, f); err != nil || !ok {
+		t.Fatalf("expected the file to be signed by the given key: %v", err)
+	}
+	verifiedFiles = nil
+	if err := VerifyOneFile(state, "/boot/test.efi"); err != nil || verifiedFiles[0].IsSigned != 0 {
+		t.Fatalf("expected the file not to be signed by the db key: %v %+v", err, verifiedFiles)
+	}
+	after, err := fs.ReadFile(state.Fs, state.Config.FilesDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Fatalf("signing with --key changed the file database")
+	}
+}
+
+func TestSignIfUnsignedSave(t *testing.T) {
+	state := setupRotateState(t)
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.WithValue(context.Background(), stateDataKey{}, state))
+
+	output = "/boot/signed.efi"
+	defer func() { output = ""; ifUnsigned = false; save = false }()
+	if err := signCmd.RunE(cmd, []string{"/boot/test.efi"}); err != nil {
+		t.Fatalf("failed signing: %v", err)
+	}
+	signed, err := fs.ReadFile(state.Fs, "/boot/signed.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The signed file isn't signed again, but it is saved
+	ifUnsigned = true
+	save = true
+	if err := signCmd.RunE(cmd, []string{"/boot/test.efi"}); err != nil {
+		t.Fatalf("failed signing: %v", err)
+	}
+	if b, _ := fs.ReadFile(state.Fs, "/boot/signed.efi"); !bytes.Equal(b, signed) {
+		t.Fatal("the already signed file was signed again")
+	}
+	files, err := sbctl.ReadFileDatabase(state.Fs, state.Config.FilesDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, ok := files["/boot/test.efi"]; !ok || entry.OutputFile != "/boot/signed.efi" {
+		t.Fatalf("expected the file to be saved, got %+v", files)
+	}
+}
+
+// TestSignRootLandlock saves a file to the missing file database of an image
+// with landlock enabled, in a subprocess as landlock can't be lifted again
+func TestSignRootLandlock(t *testing.T) {
+	root := os.Getenv("SBCTL_TEST_LANDLOCK_ROOT")
+	if root == "" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestSignRootLandlock$")
+		cmd.Env = append(os.Environ(), "SBCTL_TEST_LANDLOCK_ROOT="+t.TempDir())
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("signing under the root failed under landlock: %v\n%s", err, out)
+		}
+		return
+	}
+
+	state := setupEnrollState(t)
+	state.Fs = afero.NewOsFs()
+	state.Config = config.MkConfig(filepath.Join(root, "var/lib/sbctl"))
+	state.Config.Landlock = false
+	if err := RunCreateKeys(state); err != nil {
+		t.Fatal(err)
+	}
+	state.Config.Landlock = true
+	image := filepath.Join(root, "image")
+	if err := os.MkdirAll(filepath.Join(image, "foo"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile(state.Fs, filepath.Join(image, "foo/bootx64.efi"), mustBytes("../../tests/binaries/test.pecoff"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.WithValue(context.Background(), stateDataKey{}, state))
+
+	// With --output the file database isn't read before landlock restricts
+	// sbctl, so it is created afterwards
+	signRoot = image
+	save = true
+	output = "/foo/signed.efi"
+	defer func() { signRoot = ""; save = false; output = "" }()
+	lsm.LandlockRulesFromConfig(state.Config)
+	if err := signCmd.RunE(cmd, []string{"foo/bootx64.efi"}); err != nil {
+		t.Fatalf("failed signing under the root: %v", err)
+	}
+	db, err := sbctl.ReadFileDatabase(state.Fs, filepath.Join(image, state.Config.FilesDb))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := db["/foo/bootx64.efi"]; !ok {
+		t.Fatalf("expected the file in the file database of the image: %+v", db)
+	}
+	if err := os.WriteFile(filepath.Join(image, "outside"), nil, 0o644); err == nil {
+		t.Fatalf("expected landlock to deny writes outside the allowed paths")
+	}
+}
+
+// TestTimestampLandlockNetwork connects to a TSA with landlock enabled, in a
+// subprocess as landlock can't be lifted again
+func TestTimestampLandlockNetwork(t *testing.T) {
+	root := os.Getenv("SBCTL_TEST_LANDLOCK_ROOT")
+	if root == "" {
+		run := func(env ...string) ([]byte, error) {
+			cmd := exec.Command(os.Args[0], "-test.run=^TestTimestampLandlockNetwork$", "-test.v")
+			cmd.Env = append(append(os.Environ(), "SBCTL_TEST_LANDLOCK_ROOT="+t.TempDir()), env...)
+			return cmd.CombinedOutput()
+		}
+		// Some kernels report the network ABI without denying connections
+		if _, err := run("SBCTL_TEST_LANDLOCK_PROBE=1"); err != nil {
+			t.Skip("landlock doesn't restrict TCP connections on this system")
+		}
+		if out, err := run(); err != nil {
+			t.Fatalf("connecting under landlock failed: %v\n%s", err, out)
+		}
+		return
+	}
+	if abi, err := ll.LandlockGetABIVersion(); err != nil || abi < 4 {
+		t.Fatal("landlock doesn't restrict the network on this kernel")
+	}
+	other, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if os.Getenv("SBCTL_TEST_LANDLOCK_PROBE") != "" {
+		lsm.Restrict()
+		if _, err := net.Dial("tcp", other.Addr().String()); !errors.Is(err, syscall.EACCES) {
+			t.Fatalf("expected landlock to deny connecting to %s, got %v", other.Addr(), err)
+		}
+		return
+	}
+	https, err := net.Listen("tcp", "127.0.0.1:443")
+	if err != nil {
+		t.Skipf("can't listen on the HTTPS port: %v", err)
+	}
+	defer https.Close()
+
+	conf := config.MkConfig(filepath.Join(root, "var/lib/sbctl"))
+	conf.TimestampURL = "https://tsa.example.com"
+	lsm.LandlockRulesFromConfig(conf)
+	if err := lsm.Restrict(); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", https.Addr().String())
+	if err != nil {
+		t.Fatalf("expected connecting to the HTTPS port to be allowed: %v", err)
+	}
+	conn.Close()
+	if _, err := net.Dial("tcp", other.Addr().String()); !errors.Is(err, syscall.EACCES) {
+		t.Fatalf("expected landlock to deny connecting to %s, got %v", other.Addr(), err)
+	}
+}
+
+// The test binary stands in for systemd-measure when it's executed by that
+// name, and reads the files systemd-measure is given
+func init() {
+	if filepath.Base(os.Args[0]) != "systemd-measure" {
+		return
+	}
+	for _, arg := range os.Args[2:] {
+		name, p, _ := strings.Cut(arg, "=")
+		if name == "--json" || name == "--bank" || name == "--private-key-source" {
+			continue
+		}
+		if _, err := os.ReadFile(p); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	fmt.Println(`{"sha256":[]}`)
+	os.Exit(0)
+}
+
+func TestSignUKIPolicyLandlock(t *testing.T) {
+	if _, err := exec.LookPath("objcopy"); err != nil {
+		t.Skip("objcopy is not installed")
+	}
+	root := os.Getenv("SBCTL_TEST_LANDLOCK_ROOT")
+	if root == "" {
+		test, err := os.Executable()
+		if err != nil {
+			t.Fatal(err)
+		}
+		bin := t.TempDir()
+		if err := os.Symlink(test, filepath.Join(bin, "systemd-measure")); err != nil {
+			t.Fatal(err)
+		}
+		cmd := exec.Command(test, "-test.run=^TestSignUKIPolicyLandlock$")
+		cmd.Env = append(os.Environ(), "SBCTL_TEST_LANDLOCK_ROOT="+t.TempDir(), "PATH="+bin+":"+os.Getenv("PATH"))
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("signing the PCR policy failed under landlock: %v\n%s", err, out)
+		}
+		return
+	}
+
+	state := setupEnrollState(t)
+	state.Fs = afero.NewOsFs()
+	state.Config = config.MkConfig(filepath.Join(root, "var/lib/sbctl"))
+	state.Config.Landlock = false
+	if err := RunCreateKeys(state); err != nil {
+		t.Fatal(err)
+	}
+	state.Config.Landlock = true
+
+	// A file key, as the TPM2 OpenSSL provider isn't available to the
+	// systemd-measure stand-in
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{"etc", "efi"} {
+		if err := os.MkdirAll(filepath.Join(root, d), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	policy := &config.PCRPolicyConfig{
+		Privkey: filepath.Join(root, "etc/pcr-policy.key"),
+		Pubkey:  filepath.Join(root, "etc/pcr-policy.pem"),
+		Type:    config.PCRPolicyFile,
+	}
+	if err := fs.WriteFile(state.Fs, policy.Privkey, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: mustMarshalPKCS8(t, key)}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.WriteFile(state.Fs, policy.Pubkey, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	state.Config.PCRPolicy = policy
+
+	// The sections systemd-stub needs, at addresses after the image
+	dir := filepath.Join(root, "efi")
+	file := filepath.Join(dir, "uki.efi")
+	if err := fs.WriteFile(state.Fs, file, mustBytes("../../tests/binaries/test.pecoff"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{}
+	for i, name := range []string{".linux", ".osrel", ".cmdline"} {
+		p := filepath.Join(root, name[1:])
+		if err := os.WriteFile(p, []byte("contents of "+name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		args = append(args,
+			"--add-section", name+"="+p,
+			"--change-section-vma", fmt.Sprintf("%s=%#x", name, 0x1000000+i*0x100000),
+		)
+	}
+	if out, err := exec.Command("objcopy", append(args, file, file)...).CombinedOutput(); err != nil {
+		t.Fatalf("objcopy failed: %v\n%s", err, out)
+	}
+
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.WithValue(context.Background(), stateDataKey{}, state))
+	uki = true
+	defer func() { uki = false }()
+	lsm.LandlockRulesFromConfig(state.Config)
+	if err := signCmd.RunE(cmd, []string{file}); err != nil {
+		t.Fatalf("failed signing the UKI: %v", err)
+	}
+	signed, err := sbctl.ReadUKI(state.Fs, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signed.Section(".pcrsig") == nil || signed.Section(".pcrpkey") == nil {
+		t.Fatalf("expected the PCR policy sections in the signed image")
+	}
+	if err := os.WriteFile(filepath.Join(root, "outside"), nil, 0o644); err == nil {
+		t.Fatalf("expected landlock to deny writes outside the allowed paths")
+	}
+}
+
+func mustMarshalPKCS8(t *testing.T, key crypto.Signer) []byte {
+	t.Helper()
+	b, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+// writesStatusFile returns true if cmd reads or changes the state, and the
+// status should be written to status_file afterwards. Nothing is changed with
+// --dry-run, so the status is left alone.
+func writesStatusFile(cmd *cobra.Command, state *config.State) bool {
+	if state.Config.StatusFile == "" || cmdOptions.DryRun {
+		return false
+	}
+	return needsLock(cmd) || needsEfivarfs(cmd)
+}
+
+// WriteStatusFile writes the status to status_file, with the same schema as
+// status --json. The file is replaced atomically, so readers never see a
+// partial status.
+func WriteStatusFile(state *config.State, stat *Status) error {
+	b, err := json.MarshalIndent(stat, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not marshal json: %w", err)
+	}
+	dir := filepath.Dir(state.Config.StatusFile)
+	f, err := afero.TempFile(state.Fs, dir, "."+filepath.Base(state.Config.StatusFile)+"-*")
+	if err != nil {
+		return err
+	}
+	defer state.Fs.Remove(f.Name())
+	_, err = f.Write(append(b, '\n'))
+	if err1 := f.Close(); err1 != nil && err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+	if err := state.Fs.Chmod(f.Name(), 0o644); err != nil {
+		return err
+	}
+	return state.Fs.Rename(f.Name(), state.Config.StatusFile)
+}
+
+// updateStatusFile reads the status and writes it to status_file. Failures
+// are logged, they don't fail the command which ran.
+func updateStatusFile(state *config.State) {
+	// Commands like sign run without the EFI variables
+	if !sbctl.EfivarfsAvailable(state.Efivarfs) {
+		slog.Debug("not updating the status file without efivarfs")
+		return
+	}
+	stat, err := GetStatus(state, nil)
+	if err == nil {
+		err = WriteStatusFile(state, stat)
+	}
+	if err != nil {
+		logging.Warn("Can't update the status file: %v", err)
+	}
+}
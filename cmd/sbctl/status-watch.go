@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/logging"
+	"golang.org/x/sys/unix"
+)
+
+// Moves the cursor home and clears the screen
+const clearScreen = "\x1b[H\x1b[2J"
+
+// isTerminal returns true if f is a terminal
+func isTerminal(f *os.File) bool {
+	_, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	return err == nil
+}
+
+// printStatusFrame shows one refresh of status --watch. On a terminal the
+// screen is redrawn, otherwise the status is printed again below the last one.
+func printStatusFrame(s *Status, now time.Time, tty bool, first bool) {
+	if tty {
+		logging.Print(clearScreen)
+		logging.Print("sbctl status, every %s, press Ctrl-C to exit\t%s\n\n", statusCmdOptions.Interval, now.Format(time.RFC3339))
+	} else {
+		if !first {
+			logging.Print("\n")
+		}
+		logging.Print("Status at %s:\n", now.Format(time.RFC3339))
+	}
+	PrintStatus(s)
+}
+
+// WatchStatus shows the status until ctx is done. It is refreshed every
+// interval and when efivarfs changes. Without a terminal the status is only
+// printed again when it changed.
+func WatchStatus(ctx context.Context, state *config.State, bootchain []string, interval time.Duration, tty bool) error {
+	notify := watchInotify(ctx, state)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last []byte
+	for {
+		stat, err := GetStatus(state, bootchain)
+		if err != nil {
+			return err
+		}
+		b, err := json.Marshal(stat)
+		if err != nil {
+			return err
+		}
+		if tty || !bytes.Equal(b, last) {
+			printStatusFrame(stat, time.Now(), tty, last == nil)
+			last = b
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case <-notify:
+		}
+	}
+}
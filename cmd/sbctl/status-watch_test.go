@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/foxboron/go-uefi/efi/efitest"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/logging"
+)
+
+func TestWatchStatus(t *testing.T) {
+	cmd := SetFS(efitest.SecureBootOn(), efitest.SetUpModeOff())
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+	cmdOptions.JsonOutput = false
+	// Earlier tests with --json turn printing off
+	logging.PrintOn()
+
+	// The loop exits after the first frame when the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b, err := captureOutput(func() error {
+		return WatchStatus(ctx, state, nil, time.Hour, true)
+	})
+	if err != nil {
+		t.Fatalf("failed watching the status: %v", err)
+	}
+	if !bytes.HasPrefix(b, []byte(clearScreen)) || !bytes.Contains(b, []byte("Secure Boot:")) {
+		t.Fatalf("unexpected terminal output %q", b)
+	}
+
+	// Without a terminal an unchanged status is printed once
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	b, err = captureOutput(func() error {
+		return WatchStatus(ctx, state, nil, 10*time.Millisecond, false)
+	})
+	if err != nil {
+		t.Fatalf("failed watching the status: %v", err)
+	}
+	if bytes.Contains(b, []byte(clearScreen)) || bytes.Count(b, []byte("Status at")) != 1 {
+		t.Fatalf("unexpected output %q", b)
+	}
+
+	statusCmdOptions.Watch = true
+	cmdOptions.JsonOutput = true
+	defer func() { statusCmdOptions.Watch, cmdOptions.JsonOutput = false, false }()
+	if err := RunStatus(cmd, nil); err == nil {
+		t.Fatalf("expected --watch to fail with --json")
+	}
+}
@@ -1,46 +1,249 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/foxboron/go-uefi/efi/signature"
 	"github.com/foxboron/sbctl"
 	"github.com/foxboron/sbctl/backend"
 	"github.com/foxboron/sbctl/certs"
 	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/dmi"
 	"github.com/foxboron/sbctl/logging"
 	"github.com/foxboron/sbctl/lsm"
 	"github.com/foxboron/sbctl/quirks"
+	"github.com/landlock-lsm/go-landlock/landlock"
 	"github.com/spf13/cobra"
 )
 
-var statusCmd = &cobra.Command{
-	Use:   "status",
-	Short: "Show current boot status",
-	RunE:  RunStatus,
+type StatusCmdOptions struct {
+	CheckFirmware bool
+	DbxUpdate     string
+	ExpiryWarning int
+	Watch         bool
+	Interval      time.Duration
+	Required      []string
+	PCRCompare    bool
+}
+
+var (
+	statusCmdOptions = StatusCmdOptions{}
+	statusCmd        = &cobra.Command{
+		Use:   "status",
+		Short: "Show current boot status",
+		RunE:  RunStatus,
+	}
+)
+
+// RevokedFile is a bootchain binary forbidden by a revocation list
+type RevokedFile struct {
+	File string `json:"file"`
+	// Either "dbx" for the enrolled revocations, the path of the update, or
+	// the name of the update bundled with sbctl
+	Source  string           `json:"source"`
+	Entries []sbctl.DbxEntry `json:"entries"`
+}
+
+// statusSchemaVersion is bumped when fields of Status are changed or removed.
+// New fields can be added without changing it.
+const statusSchemaVersion = 1
+
+// InstalledKeys reports which of the sbctl keys are enrolled in the firmware
+type InstalledKeys struct {
+	PK  bool `json:"pk"`
+	KEK bool `json:"kek"`
+	Db  bool `json:"db"`
+}
+
+// StatusIssue is a problem with the Secure Boot setup. ID is one of the
+// statusIssue constants.
+type StatusIssue struct {
+	ID      string `json:"id"`
+	Message string `json:"message"`
+}
+
+const (
+	statusIssueNotInstalled       = "not_installed"
+	statusIssueSetupMode          = "setup_mode"
+	statusIssueSecureBootDisabled = "secure_boot_disabled"
+	statusIssueKeyNotEnrolled     = "key_not_enrolled"
+	statusIssueFirmwareQuirk      = "firmware_quirk"
+	statusIssueMissing2023CAs     = "microsoft_2023_cas_missing"
+	statusIssueRevokedBinary      = "revoked_binary"
+	statusIssueCertExpiring       = "certificate_expiring"
+	statusIssueCertExpired        = "certificate_expired"
+	statusIssueUnknownKey         = "unknown_key_enrolled"
+	statusIssuePCRMismatch        = "pcr_mismatch"
+)
+
+// Conditions --required can check
+const (
+	statusConditionSetupMode         = "setupmode"
+	statusConditionSecureBoot        = "secureboot"
+	statusConditionTPM               = "tpm"
+	statusConditionKeysEnrolled      = "keys-enrolled"
+	statusConditionMicrosoftEnrolled = "microsoft-enrolled"
+)
+
+var statusConditions = []string{
+	statusConditionSetupMode,
+	statusConditionSecureBoot,
+	statusConditionTPM,
+	statusConditionKeysEnrolled,
+	statusConditionMicrosoftEnrolled,
 }
 
 type Status struct {
-	Installed      bool           `json:"installed"`
-	GUID           string         `json:"guid"`
-	SetupMode      bool           `json:"setup_mode"`
-	SecureBoot     bool           `json:"secure_boot"`
-	Vendors        []string       `json:"vendors"`
-	FirmwareQuirks []quirks.Quirk `json:"firmware_quirks"`
+	SchemaVersion int      `json:"schema_version"`
+	Installed     bool     `json:"installed"`
+	GUID          string   `json:"guid"`
+	SetupMode     bool     `json:"setup_mode"`
+	SecureBoot    bool     `json:"secure_boot"`
+	Vendors       []string `json:"vendors"`
+	// Firmware vendor from the DMI table
+	Vendor         string            `json:"vendor"`
+	InstalledKeys  InstalledKeys     `json:"installed_keys"`
+	TPMAvailable   bool              `json:"tpm_available"`
+	FirmwareQuirks []quirks.Quirk    `json:"firmware_quirks"`
+	KeyAlgorithms  map[string]string `json:"key_algorithms,omitempty"`
+	// Backend of the sbctl keys, "encrypted" for keys with a passphrase
+	KeyTypes map[string]string `json:"key_types,omitempty"`
+	// Expiry of the sbctl certificates
+	KeyExpiry    map[string]time.Time `json:"key_expiry,omitempty"`
+	MicrosoftCAs []certs.MicrosoftCA  `json:"microsoft_cas"`
+	// Enrolled keys labeled as sbctl, microsoft or unknown
+	EnrolledKeys *EnrolledKeys `json:"enrolled_keys,omitempty"`
+	// Only set with --check-firmware
+	Revoked []RevokedFile `json:"revoked,omitempty"`
+	// Only set with --pcr-compare
+	PCRComparison []PCRComparison `json:"pcr_comparison,omitempty"`
+	Issues        []StatusIssue   `json:"issues"`
 }
 
 func NewStatus() *Status {
 	return &Status{
+		SchemaVersion:  statusSchemaVersion,
 		Installed:      false,
 		GUID:           "",
 		SetupMode:      false,
 		SecureBoot:     false,
 		Vendors:        []string{},
 		FirmwareQuirks: []quirks.Quirk{},
+		MicrosoftCAs:   []certs.MicrosoftCA{},
+		Issues:         []StatusIssue{},
+	}
+}
+
+// statusIssues lists the problems found in the status
+func statusIssues(s *Status) []StatusIssue {
+	issues := []StatusIssue{}
+	add := func(id, msg string, a ...any) {
+		issues = append(issues, StatusIssue{ID: id, Message: fmt.Sprintf(msg, a...)})
+	}
+	if !s.Installed {
+		add(statusIssueNotInstalled, "sbctl is not installed")
+	}
+	if s.SetupMode {
+		add(statusIssueSetupMode, "Setup Mode is enabled")
+	}
+	if !s.SecureBoot {
+		add(statusIssueSecureBootDisabled, "Secure Boot is disabled")
+	}
+	// Keys are not expected to be enrolled in Setup Mode
+	if s.Installed && !s.SetupMode {
+		keys := []struct {
+			name     string
+			enrolled bool
+		}{
+			{"PK", s.InstalledKeys.PK},
+			{"KEK", s.InstalledKeys.KEK},
+			{"db", s.InstalledKeys.Db},
+		}
+		for _, k := range keys {
+			if !k.enrolled {
+				add(statusIssueKeyNotEnrolled, "the sbctl %s key is not enrolled", k.name)
+			}
+		}
+	}
+	for _, q := range s.FirmwareQuirks {
+		add(statusIssueFirmwareQuirk, "%s: %s (%s)", q.ID, q.Name, q.Severity)
+	}
+	if len(s.MicrosoftCAs) > 0 && !slices.ContainsFunc(s.MicrosoftCAs, func(ca certs.MicrosoftCA) bool { return ca.Generation == "2023" }) {
+		add(statusIssueMissing2023CAs, "the Microsoft 2023 CAs are not enrolled")
+	}
+	for _, r := range s.Revoked {
+		add(statusIssueRevokedBinary, "%s is forbidden by %s", r.File, r.Source)
+	}
+	if s.EnrolledKeys != nil {
+		for _, v := range []struct {
+			name string
+			keys []EnrolledKey
+		}{
+			{"PK", s.EnrolledKeys.PK},
+			{"KEK", s.EnrolledKeys.KEK},
+			{"db", s.EnrolledKeys.Db},
+		} {
+			for _, k := range v.keys {
+				// Hashes can't be attributed to anyone
+				if k.Label == keyLabelUnknown && k.Type == "X509" {
+					add(statusIssueUnknownKey, "%s has an unknown certificate: %s", v.name, k.Subject)
+				}
+			}
+		}
+	}
+	if changed := changedPCRs(s.PCRComparison); len(changed) > 0 {
+		add(statusIssuePCRMismatch, "PCR %s changed since the golden values were saved", strings.Join(changed, ", "))
+	}
+	now := time.Now()
+	for _, key := range sbctl.SecureBootKeys {
+		notAfter, ok := s.KeyExpiry[key.Key]
+		if !ok {
+			continue
+		}
+		if now.After(notAfter) {
+			add(statusIssueCertExpired, "the sbctl %s certificate expired on %s", key.Key, notAfter.Format(time.DateOnly))
+		} else if now.AddDate(0, 0, statusCmdOptions.ExpiryWarning).After(notAfter) {
+			add(statusIssueCertExpiring, "the sbctl %s certificate expires on %s", key.Key, notAfter.Format(time.DateOnly))
+		}
+	}
+	return issues
+}
+
+// statusCondition reports if the --required condition holds
+func statusCondition(s *Status, condition string) bool {
+	switch condition {
+	case statusConditionSetupMode:
+		return s.SetupMode
+	case statusConditionSecureBoot:
+		return s.SecureBoot
+	case statusConditionTPM:
+		return s.TPMAvailable
+	case statusConditionKeysEnrolled:
+		return s.Installed && s.InstalledKeys.PK && s.InstalledKeys.KEK && s.InstalledKeys.Db
+	case statusConditionMicrosoftEnrolled:
+		return len(s.MicrosoftCAs) > 0
+	}
+	return false
+}
+
+// failedConditions returns the conditions in required which don't hold
+func failedConditions(s *Status, required []string) []string {
+	var failed []string
+	for _, c := range required {
+		if !statusCondition(s, c) {
+			failed = append(failed, c)
+		}
 	}
+	return failed
 }
 
 func PrintStatus(s *Status) {
@@ -51,6 +254,18 @@ func PrintStatus(s *Status) {
 			logging.Print("Owner GUID:\t")
 			logging.Println(s.GUID)
 		}
+		if len(s.KeyAlgorithms) > 0 {
+			logging.Print("Key Algorithm:\t")
+			var algs []string
+			for _, key := range sbctl.SecureBootKeys {
+				if alg, ok := s.KeyAlgorithms[key.Key]; ok {
+					algs = append(algs, key.Key+": "+alg)
+				}
+			}
+			logging.Println(strings.Join(algs, ", "))
+		}
+		printKeyEncryption(s)
+		printKeyExpiry(s)
 	} else {
 		logging.NotOk("sbctl is not installed")
 	}
@@ -74,6 +289,12 @@ func PrintStatus(s *Status) {
 	} else {
 		logging.Println("none")
 	}
+	if len(s.MicrosoftCAs) > 0 {
+		printMicrosoftCAs(s.MicrosoftCAs)
+	}
+	if s.EnrolledKeys != nil {
+		printKeyLabels(s)
+	}
 	if len(s.FirmwareQuirks) > 0 {
 		logging.Print("Firmware:\t")
 		logging.Print(logging.Warnf("Your firmware has known quirks"))
@@ -81,33 +302,243 @@ func PrintStatus(s *Status) {
 			logging.Println("\t\t- " + quirk.ID + ": " + quirk.Name + " (" + quirk.Severity + ")\n\t\t  " + quirk.Link)
 		}
 	}
+	if statusCmdOptions.CheckFirmware {
+		logging.Print("Bootchain:\t")
+		if len(s.Revoked) == 0 {
+			logging.Ok("No revoked binaries found")
+		} else {
+			logging.Print(logging.Warnf("Booting revoked binaries"))
+			for _, r := range s.Revoked {
+				logging.Println("\t\t- " + r.File + " is forbidden by " + r.Source)
+				for _, e := range r.Entries {
+					logging.Println("\t\t  " + e.Type + " " + e.Value)
+				}
+			}
+		}
+	}
+	if statusCmdOptions.PCRCompare {
+		printPCRComparison(s)
+	}
 }
 
-func RunDebug(state *config.State) error {
+// printPCRComparison shows whether the PCRs match the golden values saved with
+// tpm save-golden
+func printPCRComparison(s *Status) {
+	logging.Print("PCRs:\t\t")
+	changed := changedPCRs(s.PCRComparison)
+	if len(changed) == 0 {
+		var pcrs []string
+		for _, c := range s.PCRComparison {
+			pcrs = append(pcrs, strconv.Itoa(c.PCR))
+		}
+		logging.Ok("PCR %s match the golden values", strings.Join(pcrs, ", "))
+		return
+	}
+	logging.Print(logging.Warnf("PCR %s changed since the golden values were saved", strings.Join(changed, ", ")))
+	for _, c := range s.PCRComparison {
+		if !c.Match {
+			logging.Println(fmt.Sprintf("\t\t- PCR %d: %s, golden %s", c.PCR, c.Current, c.Golden))
+		}
+	}
+}
+
+// printKeyEncryption lists the sbctl keys which are encrypted with a
+// passphrase, if there are any
+func printKeyEncryption(s *Status) {
+	var encrypted []string
+	for _, key := range sbctl.SecureBootKeys {
+		if s.KeyTypes[key.Key] == string(backend.EncryptedBackend) {
+			encrypted = append(encrypted, key.Key)
+		}
+	}
+	if len(encrypted) == 0 {
+		return
+	}
+	logging.Print("Key Encryption:\t")
+	logging.Ok("%s encrypted with a passphrase", strings.Join(encrypted, ", "))
+}
+
+// printKeyExpiry warns about sbctl certificates which have expired or expire
+// within --expiry-warning days
+func printKeyExpiry(s *Status) {
+	var expiring []StatusIssue
+	for _, issue := range s.Issues {
+		if issue.ID == statusIssueCertExpiring || issue.ID == statusIssueCertExpired {
+			expiring = append(expiring, issue)
+		}
+	}
+	if len(expiring) == 0 {
+		return
+	}
+	logging.Print("Key Expiry:\t")
+	logging.Print(logging.Warnf("Rotate the keys with sbctl rotate-keys"))
+	for _, issue := range expiring {
+		logging.Println("\t\t- " + issue.Message)
+	}
+}
+
+// printKeyLabels counts the enrolled keys by label, and lists the unknown
+// certificates
+func printKeyLabels(s *Status) {
+	var counts []string
+	for _, v := range []struct {
+		name string
+		keys []EnrolledKey
+	}{
+		{"PK", s.EnrolledKeys.PK},
+		{"KEK", s.EnrolledKeys.KEK},
+		{"db", s.EnrolledKeys.Db},
+	} {
+		n := map[string]int{}
+		for _, k := range v.keys {
+			n[k.Label]++
+		}
+		var labels []string
+		for _, label := range slices.Concat([]string{keyLabelSbctl}, certs.GetVendors(), []string{keyLabelUnknown}) {
+			if n[label] > 0 {
+				labels = append(labels, fmt.Sprintf("%d %s", n[label], label))
+			}
+		}
+		if len(labels) == 0 {
+			labels = append(labels, "none")
+		}
+		counts = append(counts, v.name+": "+strings.Join(labels, ", "))
+	}
+	logging.Print("Enrolled Keys:\t")
+	logging.Println(strings.Join(counts, "; "))
+	for _, issue := range s.Issues {
+		if issue.ID == statusIssueUnknownKey {
+			logging.Print("\t\t%s", logging.Warnf("%s", issue.Message))
+		}
+	}
+}
+
+// printMicrosoftCAs lists the enrolled CA generations, and warns if the 2023
+// CAs replacing the expiring 2011 CAs are missing
+func printMicrosoftCAs(cas []certs.MicrosoftCA) {
+	generations := map[string][]string{}
+	var order []string
+	for _, ca := range cas {
+		if _, ok := generations[ca.Generation]; !ok {
+			order = append(order, ca.Generation)
+		}
+		if !slices.Contains(generations[ca.Generation], ca.Variable) {
+			generations[ca.Generation] = append(generations[ca.Generation], ca.Variable)
+		}
+	}
+	slices.Sort(order)
+	var out []string
+	for _, gen := range order {
+		out = append(out, fmt.Sprintf("%s (%s)", gen, strings.Join(generations[gen], ", ")))
+	}
+	logging.Print("Microsoft CAs:\t")
+	logging.Println(strings.Join(out, " "))
+	if _, ok := generations["2023"]; !ok {
+		logging.Print("\t\t")
+		logging.Print(logging.Warnf("The Microsoft 2023 CAs are not enrolled"))
+	}
+}
+
+type revocationList struct {
+	source string
+	db     *signature.SignatureDatabase
+}
+
+// CheckBootchainRevoked checks the bootchain binaries against the enrolled
+// dbx, and the revocation list in update, or the one bundled with sbctl if it
+// isn't set. The files which can't be checked are returned as errors, along
+// with the revoked files found among the rest.
+func CheckBootchainRevoked(state *config.State, files []string, update string) ([]RevokedFile, error) {
+	efistate, err := sbctl.SystemEFIVariables(state.Efivarfs)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read efivariables: %w", err)
+	}
+	dbs := []revocationList{{"dbx", efistate.Dbx}}
+	if update != "" {
+		db, err := sbctl.ReadDbxUpdate(state.Fs, update)
+		if err != nil {
+			return nil, err
+		}
+		dbs = append(dbs, revocationList{update, db})
+	} else {
+		db, err := sbctl.ReadBundledDbxUpdate()
+		if err != nil {
+			return nil, err
+		}
+		dbs = append(dbs, revocationList{sbctl.BundledDbxUpdate, db})
+	}
+
+	revoked := []RevokedFile{}
+	var errs []error
+	for _, file := range files {
+		for _, d := range dbs {
+			entries, err := revokedBy(state, d.db, file)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("couldn't check %s against %s: %w", file, d.source, err))
+				continue
+			}
+			if len(entries) > 0 {
+				revoked = append(revoked, RevokedFile{File: file, Source: d.source, Entries: entries})
+			}
+		}
+	}
+	return revoked, errors.Join(errs...)
+}
+
+func revokedBy(state *config.State, db *signature.SignatureDatabase, file string) ([]sbctl.DbxEntry, error) {
+	f, err := state.Fs.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return sbctl.RevokedBy(db, f)
+}
+
+// EnrolledSbctlKeys checks which of the sbctl keys are enrolled in the
+// firmware
+func EnrolledSbctlKeys(state *config.State) (*InstalledKeys, error) {
 	kh, err := backend.GetKeyHierarchy(state.Fs, state)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	efistate, err := sbctl.SystemEFIVariables(state.Efivarfs)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// A db key issued by a CA is enrolled by the certificate of the CA. The
+	// keys may have been enrolled with another owner, see --owner-guid.
+	dbCert, err := sbctl.DbEnrollCertificate(state, kh)
+	if err != nil {
+		return nil, err
+	}
+	enrolled := func(db *signature.SignatureDatabase, cert []byte) bool {
+		_, ok := sbctl.CertificateOwner(db, cert)
+		return ok
 	}
+	return &InstalledKeys{
+		PK:  enrolled(efistate.PK, kh.PK.Certificate().Raw),
+		KEK: enrolled(efistate.KEK, kh.KEK.Certificate().Raw),
+		Db:  enrolled(efistate.Db, dbCert),
+	}, nil
+}
 
-	guid, err := state.Config.GetGUID(state.Fs)
+func RunDebug(state *config.State) error {
+	keys, err := EnrolledSbctlKeys(state)
 	if err != nil {
 		return err
 	}
 
-	if efistate.PK.SigDataExists(signature.CERT_X509_GUID, &signature.SignatureData{Owner: *guid, Data: kh.PK.Certificate().Raw}) {
+	if keys.PK {
 		slog.Debug("PK is fine")
 	}
 
-	if efistate.KEK.SigDataExists(signature.CERT_X509_GUID, &signature.SignatureData{Owner: *guid, Data: kh.KEK.Certificate().Raw}) {
+	if keys.KEK {
 		slog.Debug("KEK is fine")
 	}
 
-	if efistate.Db.SigDataExists(signature.CERT_X509_GUID, &signature.SignatureData{Owner: *guid, Data: kh.Db.Certificate().Raw}) {
+	if keys.Db {
 		slog.Debug("db is fine")
 	}
 
@@ -117,6 +548,31 @@ func RunDebug(state *config.State) error {
 func RunStatus(cmd *cobra.Command, args []string) error {
 	state := cmd.Context().Value(stateDataKey{}).(*config.State)
 
+	if statusCmdOptions.DbxUpdate != "" && !statusCmdOptions.CheckFirmware {
+		return fmt.Errorf("--dbx-update requires --check-firmware")
+	}
+	for _, c := range statusCmdOptions.Required {
+		if !slices.Contains(statusConditions, c) {
+			return fmt.Errorf("unknown condition %q, valid conditions are: %s", c, strings.Join(statusConditions, ", "))
+		}
+	}
+
+	// Needs to be resolved before landlock as we call lsblk
+	var bootchain []string
+	if statusCmdOptions.CheckFirmware {
+		esp, err := sbctl.GetESP(state.Fs)
+		if err != nil {
+			return fmt.Errorf("couldn't find the ESP to check the bootchain: %w", err)
+		}
+		bootchain = sbctl.BootchainFiles(state.Fs, state.Efivarfs, esp)
+		if state.Config.Landlock {
+			lsm.RestrictAdditionalPaths(landlock.RODirs(esp))
+			if statusCmdOptions.DbxUpdate != "" {
+				lsm.RestrictAdditionalPaths(landlock.ROFiles(statusCmdOptions.DbxUpdate))
+			}
+		}
+	}
+
 	if state.Config.Landlock {
 		if err := lsm.Restrict(); err != nil {
 			return err
@@ -127,9 +583,49 @@ func RunStatus(cmd *cobra.Command, args []string) error {
 		RunDebug(state)
 	}
 
+	if statusCmdOptions.Watch {
+		if cmdOptions.StructuredOutput() {
+			return fmt.Errorf("--watch can't be combined with --json or --yaml")
+		}
+		if len(statusCmdOptions.Required) > 0 {
+			return fmt.Errorf("--watch can't be combined with --required")
+		}
+		if statusCmdOptions.Interval <= 0 {
+			return fmt.Errorf("--interval needs to be positive")
+		}
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		return WatchStatus(ctx, state, bootchain, statusCmdOptions.Interval, isTerminal(os.Stdout))
+	}
+
+	stat, err := GetStatus(state, bootchain)
+	if err != nil {
+		return err
+	}
+	if writesStatusFile(cmd, state) {
+		if err := WriteStatusFile(state, stat); err != nil {
+			logging.Warn("Can't update the status file: %v", err)
+		}
+	}
+	if cmdOptions.StructuredOutput() {
+		if err := StructuredOut(stat); err != nil {
+			return err
+		}
+	} else {
+		PrintStatus(stat)
+	}
+	if failed := failedConditions(stat, statusCmdOptions.Required); len(failed) > 0 {
+		return &ExitCodeError{Code: 1, Err: fmt.Errorf("required conditions don't hold: %s", strings.Join(failed, ", "))}
+	}
+	return nil
+}
+
+// GetStatus reads the Secure Boot status, checking the bootchain files
+// against the revocations with --check-firmware
+func GetStatus(state *config.State, bootchain []string) (*Status, error) {
 	stat := NewStatus()
-	if _, err := state.Fs.Stat("/sys/firmware/efi/efivars/SetupMode-8be4df61-93ca-11d2-aa0d-00e098032b8c"); os.IsNotExist(err) {
-		return fmt.Errorf("system is not booted with UEFI")
+	if _, err := state.Efivarfs.GetSetupMode(); errors.Is(err, os.ErrNotExist) {
+		return nil, sbctl.ErrNoEfivarfs
 	}
 
 	if state.IsInstalled() {
@@ -138,7 +634,28 @@ func RunStatus(cmd *cobra.Command, args []string) error {
 		if err == nil {
 			stat.GUID = u.Format()
 		}
+		if kh, err := backend.GetKeyHierarchy(state.Fs, state); err == nil {
+			stat.KeyAlgorithms = map[string]string{
+				"PK":  string(backend.GetKeyAlgorithm(kh.PK)),
+				"KEK": string(backend.GetKeyAlgorithm(kh.KEK)),
+				"db":  string(backend.GetKeyAlgorithm(kh.Db)),
+			}
+			stat.KeyTypes = map[string]string{
+				"PK":  string(kh.PK.Type()),
+				"KEK": string(kh.KEK.Type()),
+				"db":  string(kh.Db.Type()),
+			}
+			stat.KeyExpiry = map[string]time.Time{
+				"PK":  kh.PK.Certificate().NotAfter,
+				"KEK": kh.KEK.Certificate().NotAfter,
+				"db":  kh.Db.Certificate().NotAfter,
+			}
+		}
+		if keys, err := EnrolledSbctlKeys(state); err == nil {
+			stat.InstalledKeys = *keys
+		}
 	}
+	stat.TPMAvailable = state.HasTPM()
 	if ok, _ := state.Efivarfs.GetSetupMode(); ok {
 		stat.SetupMode = true
 	}
@@ -151,19 +668,56 @@ func RunStatus(cmd *cobra.Command, args []string) error {
 	if keys, err := certs.BuiltinSignatureOwners(); err == nil {
 		stat.Vendors = append(stat.Vendors, keys...)
 	}
+	if kek, err := state.Efivarfs.GetKEK(); err == nil {
+		stat.MicrosoftCAs = append(stat.MicrosoftCAs, certs.DetectMicrosoftCAs("KEK", kek)...)
+	}
+	if db, err := state.Efivarfs.Getdb(); err == nil {
+		stat.MicrosoftCAs = append(stat.MicrosoftCAs, certs.DetectMicrosoftCAs("db", db)...)
+	}
+	if keys, err := ListEnrolledKeys(state); err == nil {
+		stat.EnrolledKeys = keys
+	}
 	stat.FirmwareQuirks = quirks.CheckFirmwareQuirks(state)
-	if cmdOptions.JsonOutput {
-		if err := JsonOut(stat); err != nil {
-			return err
+	// The DMI table is read by the quirk checks
+	stat.Vendor = dmi.Table.FirmwareVendor
+	if statusCmdOptions.CheckFirmware {
+		revoked, err := CheckBootchainRevoked(state, bootchain, statusCmdOptions.DbxUpdate)
+		if revoked == nil {
+			return nil, err
+		} else if err != nil {
+			logging.Warn("%v", err)
 		}
-	} else {
-		PrintStatus(stat)
+		stat.Revoked = revoked
 	}
-	return nil
+	if statusCmdOptions.PCRCompare {
+		golden, err := ReadGoldenPCRs(state)
+		if err != nil {
+			return nil, err
+		}
+		if stat.PCRComparison, err = ComparePCRs(state, golden); err != nil {
+			return nil, err
+		}
+	}
+	stat.Issues = statusIssues(stat)
+	return stat, nil
+}
+
+func statusCmdFlags(cmd *cobra.Command) {
+	f := cmd.Flags()
+	f.BoolVarP(&statusCmdOptions.CheckFirmware, "check-firmware", "", false, "check the bootloader and shim against the revocation list (dbx)")
+	f.StringVarP(&statusCmdOptions.DbxUpdate, "dbx-update", "", "", "check against the revocations in this EFI signature list instead of the bundled dbx update")
+	f.IntVarP(&statusCmdOptions.ExpiryWarning, "expiry-warning", "", 30, "warn about sbctl certificates expiring within this many days")
+	f.BoolVarP(&statusCmdOptions.Watch, "watch", "", false, "keep showing the status, refreshed when the EFI variables change")
+	f.DurationVarP(&statusCmdOptions.Interval, "interval", "", 2*time.Second, "how often the status is refreshed with --watch")
+	f.BoolVarP(&statusCmdOptions.PCRCompare, "pcr-compare", "", false, "compare the PCRs with the golden values saved with tpm save-golden")
+	f.StringSliceVarP(&statusCmdOptions.Required, "required", "", nil, "exit with 1 unless all of the comma separated conditions hold: "+strings.Join(statusConditions, ", "))
+	_ = cmd.RegisterFlagCompletionFunc("required", cobra.FixedCompletions(statusConditions, cobra.ShellCompDirectiveNoFileComp))
 }
 
 func init() {
+	statusCmdFlags(statusCmd)
 	CliCommands = append(CliCommands, cliCommand{
-		Cmd: statusCmd,
+		Cmd:      statusCmd,
+		Efivarfs: true,
 	})
 }
@@ -1,12 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"os"
 	"reflect"
 	"testing"
 	"testing/fstest"
 
+	"github.com/foxboron/go-uefi/authenticode"
 	"github.com/foxboron/go-uefi/efi/efitest"
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/config"
 	"github.com/foxboron/sbctl/quirks"
+	"github.com/spf13/afero"
 )
 
 var (
@@ -30,6 +39,26 @@ func TestStatusOff(t *testing.T) {
 	}
 }
 
+func TestStatusYaml(t *testing.T) {
+	cmd := SetFS(efitest.SecureBootOn(),
+		efitest.SetUpModeOff())
+
+	var jsonOut, yamlOut Status
+	if err := captureJsonOutput(&jsonOut, func() error {
+		return RunStatus(cmd, []string{})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := captureYamlOutput(&yamlOut, func() error {
+		return RunStatus(cmd, []string{})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(jsonOut, yamlOut) {
+		t.Fatalf("yaml output differs from json: %+v != %+v", yamlOut, jsonOut)
+	}
+}
+
 func TestStatusOn(t *testing.T) {
 	cmd := SetFS(efitest.SecureBootOn(),
 		efitest.SetUpModeOff())
@@ -198,3 +227,205 @@ func TestFQ0001WrongVendor(t *testing.T) {
 		t.Fatal("quirk got detected using '" + fq0001.Method + "' method")
 	}
 }
+
+func TestCheckBootchainRevoked(t *testing.T) {
+	state := setupRotateState(t)
+
+	revoked, err := CheckBootchainRevoked(state, []string{"/boot/test.efi"}, "")
+	if err != nil {
+		t.Fatalf("failed checking bootchain: %v", err)
+	}
+	if len(revoked) != 0 {
+		t.Fatalf("expected no revoked files, got %+v", revoked)
+	}
+
+	peBinary, err := authenticode.Parse(bytes.NewReader(mustBytes("../../tests/binaries/test.pecoff")))
+	if err != nil {
+		t.Fatalf("can't parse binary: %v", err)
+	}
+	writeDbxUpdate(t, state, "/tmp/dbx.esl", peBinary.Hash(crypto.SHA256))
+
+	revoked, err = CheckBootchainRevoked(state, []string{"/boot/test.efi"}, "/tmp/dbx.esl")
+	if err != nil {
+		t.Fatalf("failed checking bootchain: %v", err)
+	}
+	if len(revoked) != 1 || revoked[0].Source != "/tmp/dbx.esl" || revoked[0].File != "/boot/test.efi" {
+		t.Fatalf("unexpected revoked files: %+v", revoked)
+	}
+
+	// Files which can't be checked don't stop the others from being checked
+	revoked, err = CheckBootchainRevoked(state, []string{"/boot/missing.efi", "/boot/test.efi"}, "/tmp/dbx.esl")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the missing file to fail, got %v", err)
+	}
+	if len(revoked) != 1 || revoked[0].File != "/boot/test.efi" {
+		t.Fatalf("unexpected revoked files: %+v", revoked)
+	}
+}
+
+func TestBundledDbxUpdate(t *testing.T) {
+	db, err := sbctl.ReadBundledDbxUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries := sbctl.ListDbx(db); len(entries) == 0 {
+		t.Fatalf("expected revocations in %s", sbctl.BundledDbxUpdate)
+	}
+}
+
+func TestStatusSchema(t *testing.T) {
+	cmd := SetFS(
+		fstest.MapFS{"/sys/devices/virtual/dmi/id/bios_vendor": {Data: []byte("LENOVO\n")}},
+		efitest.SecureBootOff(),
+		efitest.SetUpModeOn(),
+	)
+
+	var stat Status
+	if err := captureJsonOutput(&stat, func() error {
+		return RunStatus(cmd, []string{})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if stat.SchemaVersion != statusSchemaVersion {
+		t.Fatalf("unexpected schema version %d", stat.SchemaVersion)
+	}
+	if stat.Vendor != "LENOVO" || stat.TPMAvailable {
+		t.Fatalf("unexpected vendor or tpm: %+v", stat)
+	}
+	var ids []string
+	for _, issue := range stat.Issues {
+		ids = append(ids, issue.ID)
+	}
+	want := []string{statusIssueNotInstalled, statusIssueSetupMode, statusIssueSecureBootDisabled}
+	if !reflect.DeepEqual(ids, want) {
+		t.Fatalf("expected issues %v, got %v", want, ids)
+	}
+}
+
+func TestStatusInstalledKeys(t *testing.T) {
+	state := setupRotateState(t)
+
+	keys, err := EnrolledSbctlKeys(state)
+	if err != nil {
+		t.Fatalf("failed checking enrolled keys: %v", err)
+	}
+	if !keys.PK || !keys.KEK || !keys.Db {
+		t.Fatalf("expected all keys to be enrolled: %+v", keys)
+	}
+	issues := statusIssues(&Status{Installed: true, SecureBoot: true, InstalledKeys: InstalledKeys{PK: true}})
+	if len(issues) != 2 || issues[0].ID != statusIssueKeyNotEnrolled || issues[1].Message != "the sbctl db key is not enrolled" {
+		t.Fatalf("unexpected issues: %+v", issues)
+	}
+}
+
+func TestStatusNoEfivarfs(t *testing.T) {
+	cmd := SetFS()
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+
+	if err := RunStatus(cmd, []string{}); !errors.Is(err, sbctl.ErrNoEfivarfs) {
+		t.Fatalf("expected ErrNoEfivarfs, got %v", err)
+	}
+	if err := RunEnrollKeys(state); !errors.Is(err, sbctl.ErrNoEfivarfs) {
+		t.Fatalf("expected ErrNoEfivarfs enrolling keys, got %v", err)
+	}
+	for _, flag := range []*bool{&verifyCmdOptions.Bootchain, &verifyCmdOptions.AgainstEnrolled} {
+		*flag = true
+		err := RunVerify(cmd, []string{})
+		*flag = false
+		if !errors.Is(err, sbctl.ErrNoEfivarfs) {
+			t.Fatalf("expected ErrNoEfivarfs verifying against the EFI variables, got %v", err)
+		}
+	}
+	if !needsEfivarfs(statusCmd) || needsEfivarfs(signCmd) || needsEfivarfs(createKeysCmd) {
+		t.Fatalf("unexpected commands requiring efivarfs")
+	}
+}
+
+func TestStatusRequired(t *testing.T) {
+	cmd := SetFS(efitest.SecureBootOn(),
+		efitest.SetUpModeOff())
+	defer func() { statusCmdOptions.Required = nil }()
+
+	statusCmdOptions.Required = []string{"secureboot"}
+	if _, err := captureOutput(func() error {
+		return RunStatus(cmd, []string{})
+	}); err != nil {
+		t.Fatalf("expected secureboot to hold: %v", err)
+	}
+
+	statusCmdOptions.Required = []string{"secureboot", "keys-enrolled", "microsoft-enrolled"}
+	_, err := captureOutput(func() error {
+		return RunStatus(cmd, []string{})
+	})
+	var exitErr *ExitCodeError
+	if !errors.As(err, &exitErr) || exitErr.Code != 1 {
+		t.Fatalf("expected exit code 1, got %v", err)
+	}
+	if exitErr.Err.Error() != "required conditions don't hold: keys-enrolled, microsoft-enrolled" {
+		t.Fatalf("unexpected failing conditions: %v", exitErr.Err)
+	}
+
+	statusCmdOptions.Required = []string{"secure-boot"}
+	if err := RunStatus(cmd, []string{}); err == nil || errors.As(err, &exitErr) {
+		t.Fatalf("expected an unknown condition to be rejected, got %v", err)
+	}
+}
+
+func TestStatusRequiredOwnerGUID(t *testing.T) {
+	state := setupEnrollState(t)
+	enrollKeysCmdOptions.OwnerGUID = "8e6b5f3b-0c3d-4d0f-9b8e-2a4b3c1d5e6f"
+	t.Cleanup(func() { enrollKeysCmdOptions.OwnerGUID = "" })
+	if err := SetupInstallation(state); err != nil {
+		t.Fatalf("failed running SetupInstallation: %v", err)
+	}
+
+	// The keys enrolled with another owner hold for a later status
+	enrollKeysCmdOptions.OwnerGUID = ""
+	state.Config.OwnerGUID = ""
+	stat, err := GetStatus(state, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failed := failedConditions(stat, []string{"keys-enrolled"}); len(failed) != 0 {
+		t.Fatalf("expected the keys to be enrolled: %+v", stat.InstalledKeys)
+	}
+}
+
+func TestStatusFile(t *testing.T) {
+	cmd := SetFS(efitest.SecureBootOn(),
+		efitest.SetUpModeOff())
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+
+	if writesStatusFile(signCmd, state) {
+		t.Fatalf("expected no status file without status_file")
+	}
+	state.Config.StatusFile = "/run/sbctl/status.json"
+	if !writesStatusFile(signCmd, state) || !writesStatusFile(statusCmd, state) || writesStatusFile(verifyCmd, state) {
+		t.Fatalf("unexpected commands writing the status file")
+	}
+	if err := state.Fs.MkdirAll("/run/sbctl", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	updateStatusFile(state)
+
+	var jsonOut, fileOut Status
+	if err := captureJsonOutput(&jsonOut, func() error {
+		return RunStatus(cmd, []string{})
+	}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := afero.ReadFile(state.Fs, "/run/sbctl/status.json")
+	if err != nil {
+		t.Fatalf("failed reading the status file: %v", err)
+	}
+	if err := json.Unmarshal(b, &fileOut); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(jsonOut, fileOut) {
+		t.Fatalf("status file differs from status --json: %+v != %+v", fileOut, jsonOut)
+	}
+	// The temporary file is renamed over the status file
+	if entries, _ := afero.ReadDir(state.Fs, "/run/sbctl"); len(entries) != 1 {
+		t.Fatalf("expected only the status file, got %d files", len(entries))
+	}
+}
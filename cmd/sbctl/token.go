@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/spf13/afero"
+	"github.com/spf13/pflag"
+)
+
+type TokenCmdOptions struct {
+	Token   string
+	PinFile string
+	Signer  string
+}
+
+var (
+	ErrTokenSigner   = errors.New("--token can't be combined with --signer")
+	ErrUnknownSigner = errors.New("unknown signer, use gpg:KEYID")
+)
+
+func tokenFlags(f *pflag.FlagSet, o *TokenCmdOptions) {
+	f.StringVarP(&o.Token, "token", "", "", "sign with a key on a PKCS#11 token, e.g. \"pkcs11:token=YubiKey;object=sbctl\"")
+	f.StringVarP(&o.PinFile, "pin-file", "", "", "read the token PIN from a file")
+	f.StringVarP(&o.Signer, "signer", "", "", "sign with a key held by gpg-agent, like on an OpenPGP card, e.g. \"gpg:KEYID\"")
+}
+
+// tokenKey is the key opened with --token or --signer
+type tokenKey struct {
+	pkcs11 *backend.PKCS11Key
+	gpg    *backend.GPGKey
+}
+
+func (k *tokenKey) Close() error {
+	if k.pkcs11 != nil {
+		return k.pkcs11.Close()
+	}
+	return k.gpg.Close()
+}
+
+// readPin reads the PIN from file, then from $SBCTL_PIN, and prompts for it if
+// neither is set
+func readPin(vfs afero.Fs, file string) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		if file != "" {
+			return readSecretFile(vfs, file, "PIN")
+		}
+		if pin, ok, err := readSecretEnv(pinEnv, "PIN"); ok {
+			return pin, err
+		}
+		return promptPassphrase("PIN: ")
+	}
+}
+
+// openToken opens the token key if --token or --signer is set. This needs to
+// happen before landlock is enabled as the module loads its own dependencies,
+// and gpg is executed to look up the key.
+func openToken(state *config.State, o *TokenCmdOptions) (*tokenKey, error) {
+	if o.Token != "" && o.Signer != "" {
+		return nil, ErrTokenSigner
+	}
+	if o.Signer != "" {
+		kind, id, _ := strings.Cut(o.Signer, ":")
+		if kind != "gpg" || id == "" {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownSigner, o.Signer)
+		}
+		key, err := backend.OpenGPGKey(id)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't open gpg key: %w", err)
+		}
+		return &tokenKey{gpg: key}, nil
+	}
+	if o.Token == "" {
+		return nil, nil
+	}
+	key, err := backend.OpenPKCS11Key(state.Config.PKCS11Module, o.Token, readPin(state.Fs, o.PinFile))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open token key: %w", err)
+	}
+	return &tokenKey{pkcs11: key}, nil
+}
+
+// useToken swaps the matching key in the hierarchy for the token key
+func useToken(kh *backend.KeyHierarchy, key *tokenKey) error {
+	if key == nil {
+		return nil
+	}
+	if key.gpg != nil {
+		hier, err := kh.UseGPGKey(key.gpg)
+		if err != nil {
+			return err
+		}
+		logging.Print("Using %s key from gpg\n", hier)
+		return nil
+	}
+	hier, err := kh.UseTokenKey(key.pkcs11)
+	if err != nil {
+		return err
+	}
+	logging.Print("Using %s key from token\n", hier)
+	return nil
+}
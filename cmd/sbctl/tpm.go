@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+	"github.com/landlock-lsm/go-landlock/landlock"
+	"github.com/spf13/cobra"
+)
+
+type TPMPredictCmdOptions struct {
+	PCRs     []int
+	Eventlog string
+	ESP      string
+}
+
+type TPMSaveGoldenCmdOptions struct {
+	PCRs []int
+}
+
+// GoldenPCRs are the PCR values saved with tpm save-golden, which
+// status --pcr-compare compares the current values with
+type GoldenPCRs struct {
+	Bank  string    `json:"bank"`
+	Saved time.Time `json:"saved"`
+	// Hex encoded values keyed by the PCR index
+	PCRs map[int]string `json:"pcrs"`
+}
+
+// PCRComparison is the golden and current value of a PCR
+type PCRComparison struct {
+	PCR     int    `json:"pcr"`
+	Golden  string `json:"golden"`
+	Current string `json:"current"`
+	Match   bool   `json:"match"`
+}
+
+type PCRPrediction struct {
+	PCR       int    `json:"pcr"`
+	Bank      string `json:"bank"`
+	Predicted string `json:"predicted"`
+	// Value of the PCR in the TPM, if one is available
+	Current string `json:"current,omitempty"`
+}
+
+var (
+	tpmPredictCmdOptions = TPMPredictCmdOptions{}
+	tpmCmd               = &cobra.Command{
+		Use:   "tpm",
+		Short: "TPM related commands",
+	}
+	tpmPredictCmd = &cobra.Command{
+		Use:   "predict",
+		Short: "Predict the PCR values of the next boot",
+		Long: `Predict the PCR values of the next boot.
+
+The TPM eventlog of the current boot is replayed with the measurements of the
+Secure Boot variables recomputed from their current contents for PCR 7, and
+the measurements of the boot applications recomputed from the files on the
+ESP for PCR 4. Images verified by a db certificate which is no longer
+enrolled are assumed to be signed with the sbctl db key.`,
+		RunE: RunTPMPredict,
+	}
+	tpmSaveGoldenCmdOptions = TPMSaveGoldenCmdOptions{}
+	tpmSaveGoldenCmd        = &cobra.Command{
+		Use:   "save-golden",
+		Short: "Save the current PCR values for status --pcr-compare",
+		Long: `Save the current PCR values for status --pcr-compare.
+
+The SHA256 values of the PCRs are read from the TPM and saved to
+golden_pcrs.json in the key directory. Run it again after an expected change,
+like a firmware or bootloader update.`,
+		RunE: RunTPMSaveGolden,
+	}
+	tpmCreatePolicyKeyCmd = &cobra.Command{
+		Use:   "create-policy-key",
+		Short: "Create the pcr_policy key in the TPM",
+		Long: `Create the pcr_policy key in the TPM.
+
+The key sign --uki signs the PCR policy of unified kernel images with is
+created in the TPM, and written to the pcr_policy privkey file of the
+configuration wrapped by the TPM. It can't be used without the TPM which
+created it. The public key is written to the pcr_policy pubkey file.`,
+		RunE: RunTPMCreatePolicyKey,
+	}
+)
+
+// ErrNoGoldenPCRs is returned when no golden PCR values have been saved
+var ErrNoGoldenPCRs = errors.New("no golden PCR values have been saved, save them with sbctl tpm save-golden")
+
+// ErrTPMTimeout is returned by TPM commands which didn't complete within
+// --tpm-timeout
+var ErrTPMTimeout = errors.New("timed out waiting for the TPM")
+
+// deadlineTPM fails TPM commands which take longer than timeout. The command
+// can't be aborted, so the TPM is considered unavailable after a timeout and
+// the following commands fail immediately.
+type deadlineTPM struct {
+	transport.TPMCloser
+	ctx     context.Context
+	timeout time.Duration
+
+	mu  sync.Mutex
+	err error
+}
+
+func (t *deadlineTPM) Send(input []byte) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err != nil {
+		return nil, t.err
+	}
+	ctx, cancel := context.WithTimeout(t.ctx, t.timeout)
+	defer cancel()
+
+	type response struct {
+		b   []byte
+		err error
+	}
+	ch := make(chan response, 1)
+	go func() {
+		b, err := t.TPMCloser.Send(input)
+		ch <- response{b, err}
+	}()
+	select {
+	case rsp := <-ch:
+		return rsp.b, rsp.err
+	case <-ctx.Done():
+		t.err = fmt.Errorf("%w: %w", ErrTPMTimeout, ctx.Err())
+		slog.Debug("tpm command timed out", slog.Duration("timeout", t.timeout))
+		return nil, t.err
+	}
+}
+
+// openTPM opens the system TPM, giving up after timeout. The commands sent to
+// the returned TPM are bounded by the same timeout.
+func openTPM(ctx context.Context, open func(...string) (transport.TPMCloser, error), timeout time.Duration) (transport.TPMCloser, error) {
+	octx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	type result struct {
+		rwc transport.TPMCloser
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		rwc, err := open()
+		ch <- result{rwc, err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return &deadlineTPM{TPMCloser: r.rwc, ctx: ctx, timeout: timeout}, nil
+	case <-octx.Done():
+		// Close the TPM if it is opened after we stopped waiting
+		go func() {
+			if r := <-ch; r.err == nil {
+				r.rwc.Close()
+			}
+		}()
+		return nil, fmt.Errorf("%w: %w", ErrTPMTimeout, octx.Err())
+	}
+}
+
+// readPCR reads the SHA256 bank of the PCR from the TPM
+func readPCR(rwc transport.TPM, pcr int) ([]byte, error) {
+	rsp, err := tpm2.PCRRead{
+		PCRSelectionIn: tpm2.TPMLPCRSelection{
+			PCRSelections: []tpm2.TPMSPCRSelection{
+				{
+					Hash:      tpm2.TPMAlgSHA256,
+					PCRSelect: tpm2.PCClientCompatible.PCRs(uint(pcr)),
+				},
+			},
+		},
+	}.Execute(rwc)
+	if err != nil {
+		return nil, err
+	}
+	if len(rsp.PCRValues.Digests) != 1 {
+		return nil, fmt.Errorf("TPM returned no value for PCR %d", pcr)
+	}
+	return rsp.PCRValues.Digests[0].Buffer, nil
+}
+
+// PredictPCRs predicts the values of the PCRs, and reads the current values
+// from the TPM if there is one
+func PredictPCRs(state *config.State, eventlog, esp string, pcrs []int) ([]PCRPrediction, error) {
+	predictions := []PCRPrediction{}
+	for _, pcr := range pcrs {
+		digest, err := sbctl.PredictPCR(state, eventlog, esp, pcr)
+		if err != nil {
+			return nil, fmt.Errorf("can't predict PCR %d: %w", pcr, err)
+		}
+		p := PCRPrediction{
+			PCR:       pcr,
+			Bank:      "sha256",
+			Predicted: hex.EncodeToString(digest),
+		}
+		if state.HasTPM() {
+			current, err := readPCR(state.TPM(), pcr)
+			if err != nil {
+				return nil, fmt.Errorf("can't read PCR %d: %w", pcr, err)
+			}
+			p.Current = hex.EncodeToString(current)
+		}
+		predictions = append(predictions, p)
+	}
+	return predictions, nil
+}
+
+// goldenPCRsPath is where the golden PCR values are saved, in the key
+// directory
+func goldenPCRsPath(state *config.State) string {
+	return filepath.Join(state.Config.Keydir, "golden_pcrs.json")
+}
+
+// SaveGoldenPCRs reads the PCRs from the TPM and saves them as the golden
+// values
+func SaveGoldenPCRs(state *config.State, pcrs []int) (*GoldenPCRs, error) {
+	if !state.HasTPM() {
+		return nil, fmt.Errorf("can't read the PCRs: %w", backend.ErrNoTPM)
+	}
+	golden := &GoldenPCRs{
+		Bank:  "sha256",
+		Saved: time.Now().UTC().Truncate(time.Second),
+		PCRs:  map[int]string{},
+	}
+	for _, pcr := range pcrs {
+		if pcr < 0 || pcr > 23 {
+			return nil, fmt.Errorf("invalid PCR %d", pcr)
+		}
+		value, err := readPCR(state.TPM(), pcr)
+		if err != nil {
+			return nil, fmt.Errorf("can't read PCR %d: %w", pcr, err)
+		}
+		golden.PCRs[pcr] = hex.EncodeToString(value)
+	}
+	b, err := json.MarshalIndent(golden, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	if err := fs.WriteFile(state.Fs, goldenPCRsPath(state), b, 0o644); err != nil {
+		return nil, err
+	}
+	return golden, nil
+}
+
+// ReadGoldenPCRs reads the PCR values saved with SaveGoldenPCRs
+func ReadGoldenPCRs(state *config.State) (*GoldenPCRs, error) {
+	b, err := fs.ReadFile(state.Fs, goldenPCRsPath(state))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoGoldenPCRs
+	} else if err != nil {
+		return nil, err
+	}
+	var golden GoldenPCRs
+	if err := json.Unmarshal(b, &golden); err != nil {
+		return nil, fmt.Errorf("can't parse %s: %w", goldenPCRsPath(state), err)
+	}
+	return &golden, nil
+}
+
+// ComparePCRs compares the PCRs in the TPM with the golden values
+func ComparePCRs(state *config.State, golden *GoldenPCRs) ([]PCRComparison, error) {
+	if !state.HasTPM() {
+		return nil, fmt.Errorf("can't read the PCRs: %w", backend.ErrNoTPM)
+	}
+	var pcrs []int
+	for pcr := range golden.PCRs {
+		pcrs = append(pcrs, pcr)
+	}
+	slices.Sort(pcrs)
+	comparisons := []PCRComparison{}
+	for _, pcr := range pcrs {
+		value, err := readPCR(state.TPM(), pcr)
+		if err != nil {
+			return nil, fmt.Errorf("can't read PCR %d: %w", pcr, err)
+		}
+		current := hex.EncodeToString(value)
+		comparisons = append(comparisons, PCRComparison{
+			PCR:     pcr,
+			Golden:  golden.PCRs[pcr],
+			Current: current,
+			Match:   strings.EqualFold(golden.PCRs[pcr], current),
+		})
+	}
+	return comparisons, nil
+}
+
+// changedPCRs lists the PCRs which don't match their golden value
+func changedPCRs(comparisons []PCRComparison) []string {
+	var changed []string
+	for _, c := range comparisons {
+		if !c.Match {
+			changed = append(changed, strconv.Itoa(c.PCR))
+		}
+	}
+	return changed
+}
+
+func RunTPMSaveGolden(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+	if state.Config.Landlock {
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+	golden, err := SaveGoldenPCRs(state, tpmSaveGoldenCmdOptions.PCRs)
+	if err != nil {
+		return err
+	}
+	if cmdOptions.StructuredOutput() {
+		return StructuredOut(golden)
+	}
+	for _, pcr := range tpmSaveGoldenCmdOptions.PCRs {
+		logging.Print("PCR %d (%s):\t%s\n", pcr, golden.Bank, golden.PCRs[pcr])
+	}
+	logging.Ok("Saved the golden PCR values to %s", goldenPCRsPath(state))
+	return nil
+}
+
+func RunTPMCreatePolicyKey(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+	policy := state.Config.PCRPolicy
+	if policy == nil || policy.Privkey == "" {
+		return sbctl.ErrNoPCRPolicy
+	}
+	if state.Config.Landlock {
+		for _, p := range []string{policy.Privkey, policy.Pubkey} {
+			if p == "" {
+				continue
+			}
+			if err := state.Fs.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+				return err
+			}
+			lsm.RestrictAdditionalPaths(landlock.RWDirs(filepath.Dir(p)))
+		}
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+	if err := sbctl.CreatePCRPolicyKey(state); err != nil {
+		return err
+	}
+	logging.Ok("Created the pcr_policy key %s", policy.Privkey)
+	return nil
+}
+
+func RunTPMPredict(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+	for _, pcr := range tpmPredictCmdOptions.PCRs {
+		if !slices.Contains(sbctl.PredictablePCRs, pcr) {
+			return fmt.Errorf("PCR %d: %w", pcr, sbctl.ErrUnsupportedPCR)
+		}
+	}
+
+	// PCR 4 is recomputed from the boot applications on the ESP. This needs
+	// to be resolved before landlock as we call lsblk.
+	var esp string
+	if slices.Contains(tpmPredictCmdOptions.PCRs, 4) {
+		var err error
+		esp, err = sbctl.ResolveESP(state, tpmPredictCmdOptions.ESP)
+		if err != nil {
+			logging.Warn("Couldn't find the ESP, the boot applications are replayed from the eventlog: %v", err)
+		}
+	}
+
+	if state.Config.Landlock {
+		lsm.RestrictAdditionalPaths(
+			landlock.ROFiles(tpmPredictCmdOptions.Eventlog).IgnoreIfMissing(),
+		)
+		if esp != "" {
+			lsm.RestrictAdditionalPaths(
+				landlock.RODirs(esp).IgnoreIfMissing(),
+			)
+		}
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+
+	predictions, err := PredictPCRs(state, tpmPredictCmdOptions.Eventlog, esp, tpmPredictCmdOptions.PCRs)
+	if err != nil {
+		return err
+	}
+	if cmdOptions.StructuredOutput() {
+		return StructuredOut(predictions)
+	}
+	for _, p := range predictions {
+		logging.Print("PCR %d (%s):\n", p.PCR, p.Bank)
+		logging.Print("  Predicted:\t%s\n", p.Predicted)
+		if p.Current != "" {
+			logging.Print("  Current:\t%s\n", p.Current)
+		}
+	}
+	return nil
+}
+
+func tpmPredictCmdFlags(cmd *cobra.Command) {
+	f := cmd.Flags()
+	f.IntSliceVarP(&tpmPredictCmdOptions.PCRs, "pcr", "", []int{7}, "PCRs to predict, 4 and 7 are supported")
+	f.StringVarP(&tpmPredictCmdOptions.Eventlog, "eventlog", "", systemEventlog, "TPM eventlog of the current boot")
+	f.StringVarP(&tpmPredictCmdOptions.ESP, "esp", "", "", "ESP the boot applications are read from")
+}
+
+func tpmSaveGoldenCmdFlags(cmd *cobra.Command) {
+	f := cmd.Flags()
+	f.IntSliceVarP(&tpmSaveGoldenCmdOptions.PCRs, "pcr", "", []int{7}, "PCRs to save, e.g. 4, 7 and 11")
+}
+
+func init() {
+	tpmPredictCmdFlags(tpmPredictCmd)
+	tpmSaveGoldenCmdFlags(tpmSaveGoldenCmd)
+	tpmCmd.AddCommand(tpmPredictCmd)
+	tpmCmd.AddCommand(tpmSaveGoldenCmd)
+	tpmCmd.AddCommand(tpmCreatePolicyKeyCmd)
+	CliCommands = append(CliCommands, cliCommand{
+		Cmd: tpmCmd,
+	}, cliCommand{
+		Cmd:  tpmSaveGoldenCmd,
+		Lock: true,
+	}, cliCommand{
+		Cmd:  tpmCreatePolicyKeyCmd,
+		Lock: true,
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"slices"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/foxboron/go-uefi/efi/efitest"
+	"github.com/foxboron/sbctl/config"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpm2/transport"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+)
+
+// hangingTPM blocks every command until it is closed
+type hangingTPM struct {
+	done chan struct{}
+}
+
+func (h *hangingTPM) Send([]byte) ([]byte, error) {
+	<-h.done
+	return nil, errors.New("closed")
+}
+
+func (h *hangingTPM) Close() error {
+	close(h.done)
+	return nil
+}
+
+func TestOpenTPMTimeout(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+	open := func(...string) (transport.TPMCloser, error) {
+		<-block
+		return nil, errors.New("closed")
+	}
+	if _, err := openTPM(context.Background(), open, 10*time.Millisecond); !errors.Is(err, ErrTPMTimeout) {
+		t.Fatalf("expected ErrTPMTimeout opening the TPM, got %v", err)
+	}
+
+	h := &hangingTPM{done: make(chan struct{})}
+	defer h.Close()
+	open = func(...string) (transport.TPMCloser, error) {
+		return h, nil
+	}
+	rwc, err := openTPM(context.Background(), open, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rwc.Send(nil); !errors.Is(err, ErrTPMTimeout) {
+		t.Fatalf("expected ErrTPMTimeout sending a command, got %v", err)
+	}
+	// The TPM is unavailable after a timeout
+	start := time.Now()
+	if _, err := rwc.Send(nil); !errors.Is(err, ErrTPMTimeout) || time.Since(start) > time.Second {
+		t.Fatalf("expected the next command to fail immediately, got %v", err)
+	}
+}
+
+func TestGoldenPCRs(t *testing.T) {
+	rwc, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rwc.Close()
+	state := &config.State{
+		TPM:    func() transport.TPMCloser { return rwc },
+		Fs:     efitest.FromMapFS(fstest.MapFS{}),
+		Config: config.DefaultConfig(),
+	}
+
+	if _, err := ReadGoldenPCRs(state); !errors.Is(err, ErrNoGoldenPCRs) {
+		t.Fatalf("expected ErrNoGoldenPCRs, got %v", err)
+	}
+	if _, err := SaveGoldenPCRs(state, []int{4, 7}); err != nil {
+		t.Fatalf("failed saving golden PCRs: %v", err)
+	}
+	golden, err := ReadGoldenPCRs(state)
+	if err != nil {
+		t.Fatalf("failed reading golden PCRs: %v", err)
+	}
+	comparisons, err := ComparePCRs(state, golden)
+	if err != nil {
+		t.Fatalf("failed comparing PCRs: %v", err)
+	}
+	if len(comparisons) != 2 || len(changedPCRs(comparisons)) != 0 {
+		t.Fatalf("expected PCR 4 and 7 to match, got %+v", comparisons)
+	}
+
+	digest := sha256.Sum256([]byte("drift"))
+	_, err = tpm2.PCRExtend{
+		PCRHandle: tpm2.AuthHandle{
+			Handle: tpm2.TPMHandle(7),
+			Auth:   tpm2.PasswordAuth(nil),
+		},
+		Digests: tpm2.TPMLDigestValues{
+			Digests: []tpm2.TPMTHA{
+				{HashAlg: tpm2.TPMAlgSHA256, Digest: digest[:]},
+			},
+		},
+	}.Execute(rwc)
+	if err != nil {
+		t.Fatalf("failed extending PCR: %v", err)
+	}
+	comparisons, err = ComparePCRs(state, golden)
+	if err != nil {
+		t.Fatalf("failed comparing PCRs: %v", err)
+	}
+	if changed := changedPCRs(comparisons); len(changed) != 1 || changed[0] != "7" {
+		t.Fatalf("expected PCR 7 to change, got %+v", comparisons)
+	}
+	issues := statusIssues(&Status{Installed: true, SecureBoot: true, PCRComparison: comparisons})
+	if !slices.ContainsFunc(issues, func(i StatusIssue) bool { return i.ID == statusIssuePCRMismatch }) {
+		t.Fatalf("expected a pcr_mismatch issue, got %+v", issues)
+	}
+
+	if _, err := SaveGoldenPCRs(state, []int{24}); err == nil {
+		t.Fatalf("expected an error saving PCR 24")
+	}
+}
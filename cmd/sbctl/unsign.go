@@ -0,0 +1,108 @@
+package main
+
+import (
+	"path/filepath"
+
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/landlock-lsm/go-landlock/landlock"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+type UnsignCmdOptions struct {
+	Output  string
+	Untrack bool
+}
+
+var (
+	unsignCmdOptions = UnsignCmdOptions{}
+	unsignCmd        = &cobra.Command{
+		Use:   "unsign <file>",
+		Short: "Remove the signatures from a file",
+		Long: `Remove the signatures from a file.
+
+The certificate table is removed from the PE image and the header is fixed up,
+which gives back the file as it was before it was signed by sbctl. The file is
+changed in place unless --output is given.`,
+		Args:              cobra.ExactArgs(1),
+		ValidArgsFunction: completeFiles,
+		RunE:              RunUnsign,
+	}
+)
+
+func RunUnsign(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+
+	file, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+	output := file
+	if unsignCmdOptions.Output != "" {
+		if output, err = filepath.Abs(unsignCmdOptions.Output); err != nil {
+			return err
+		}
+	}
+
+	if state.Config.Landlock {
+		if output == file {
+			lsm.RestrictAdditionalPaths(lsm.TruncFile(file).IgnoreIfMissing())
+		} else {
+			lsm.RestrictAdditionalPaths(landlock.ROFiles(file).IgnoreIfMissing())
+			if ok, _ := afero.Exists(state.Fs, output); ok {
+				lsm.RestrictAdditionalPaths(lsm.TruncFile(output))
+			} else {
+				lsm.RestrictAdditionalPaths(landlock.RWDirs(filepath.Dir(output)))
+			}
+		}
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+
+	if err := sbctl.RemoveSignaturesFile(state, file, output); err != nil {
+		return err
+	}
+	logging.Ok("Removed the signatures from %s", output)
+
+	if !unsignCmdOptions.Untrack {
+		return nil
+	}
+	files, err := sbctl.ReadFileDatabase(state.Fs, state.Config.FilesDb)
+	if err != nil {
+		return err
+	}
+	var untracked bool
+	for path, entry := range files {
+		if entry.File == file || entry.OutputFile == file {
+			delete(files, path)
+			untracked = true
+		}
+	}
+	if !untracked {
+		logging.Warn("%s is not in the database", file)
+		return nil
+	}
+	if err := sbctl.WriteFileDatabase(state.Fs, state.Config.FilesDb, files); err != nil {
+		return err
+	}
+	logging.Print("Removed %s from the database.\n", file)
+	return nil
+}
+
+func unsignCmdFlags(cmd *cobra.Command) {
+	f := cmd.Flags()
+	f.StringVarP(&unsignCmdOptions.Output, "output", "o", "", "write the unsigned file to this path instead of changing the file")
+	f.BoolVarP(&unsignCmdOptions.Untrack, "untrack", "", false, "remove the file from the database, so sign-all doesn't sign it again")
+}
+
+func init() {
+	unsignCmdFlags(unsignCmd)
+	CliCommands = append(CliCommands, cliCommand{
+		Cmd:  unsignCmd,
+		Lock: true,
+	})
+}
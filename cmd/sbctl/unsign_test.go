@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/foxboron/sbctl"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+func TestUnsign(t *testing.T) {
+	state := setupRotateState(t)
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.WithValue(context.Background(), stateDataKey{}, state))
+	defer func() { unsignCmdOptions = UnsignCmdOptions{} }()
+
+	original, err := afero.ReadFile(state.Fs, "/boot/test.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Signing and unsigning gives back the original file
+	unsignCmdOptions.Output = "/boot/unsigned.efi"
+	if err := RunUnsign(cmd, []string{"/boot/new.efi"}); err != nil {
+		t.Fatalf("failed unsigning: %v", err)
+	}
+	b, err := afero.ReadFile(state.Fs, "/boot/unsigned.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, original) {
+		t.Fatalf("expected the unsigned file to be the original file, got %d bytes instead of %d", len(b), len(original))
+	}
+	if err := RunUnsign(cmd, []string{"/boot/unsigned.efi"}); !errors.Is(err, sbctl.ErrNotSigned) {
+		t.Fatalf("expected ErrNotSigned, got %v", err)
+	}
+
+	unsignCmdOptions = UnsignCmdOptions{Untrack: true}
+	if err := RunUnsign(cmd, []string{"/boot/new.efi"}); err != nil {
+		t.Fatalf("failed unsigning: %v", err)
+	}
+	files, err := sbctl.ReadFileDatabase(state.Fs, state.Config.FilesDb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("expected the file to be untracked, got %+v", files)
+	}
+}
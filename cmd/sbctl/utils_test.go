@@ -14,6 +14,8 @@ import (
 	"github.com/foxboron/sbctl/config"
 	"github.com/foxboron/sbctl/logging"
 	"github.com/spf13/cobra"
+
+	yaml "github.com/goccy/go-yaml"
 )
 
 func captureOutput(f func() error) ([]byte, error) {
@@ -33,6 +35,17 @@ func captureJsonOutput(out any, f func() error) error {
 	return json.Unmarshal(output, &out)
 }
 
+func captureYamlOutput(out any, f func() error) error {
+	cmdOptions.JsonOutput = false
+	cmdOptions.YamlOutput = true
+	defer func() { cmdOptions.YamlOutput = false }()
+	output, err := captureOutput(f)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(output, out)
+}
+
 func SetFS(files ...fstest.MapFS) *cobra.Command {
 	fs := efitest.NewFS().
 		With(files...).
@@ -41,12 +54,16 @@ func SetFS(files ...fstest.MapFS) *cobra.Command {
 	// TODO: Remove and move to proper efifs implementation
 	efs.SetFS(fs)
 
+	// Landlock would restrict the whole test binary
+	conf := config.DefaultConfig()
+	conf.Landlock = false
+
 	state := &config.State{
 		Fs: fs,
 		Efivarfs: testfs.NewTestFS().
 			With(files...).
 			Open(),
-		Config: config.DefaultConfig(),
+		Config: conf,
 	}
 	cmd := &cobra.Command{}
 	ctx := context.WithValue(context.Background(), stateDataKey{}, state)
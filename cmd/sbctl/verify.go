@@ -1,10 +1,19 @@
 package main
 
 import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/foxboron/go-uefi/efi/signature"
 	"github.com/foxboron/sbctl"
 	"github.com/foxboron/sbctl/backend"
 	"github.com/foxboron/sbctl/config"
@@ -14,25 +23,120 @@ import (
 	"github.com/landlock-lsm/go-landlock/landlock"
 	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
+
+	yaml "github.com/goccy/go-yaml"
 )
 
 type VerifiedFile struct {
-	FileName       string         `json:"file_name"`
+	FileName string `json:"file_name"`
 	// IsSigned should be set to one of these values:
 	//   -  0: "unsigned"
 	//   -  1: "signed"
 	//   - -1: "file does not exist"
-	IsSigned       int8           `json:"is_signed"`
+	IsSigned int8 `json:"is_signed"`
+	// SHA256 checksum of the file, unset if it doesn't exist
+	SHA256 string `json:"sha256,omitempty"`
+	// Certificate the file is signed with, unset for unsigned files and files
+	// enrolled by their hash
+	Signer *VerifiedSigner `json:"signer,omitempty"`
+	// Set with --bootchain
+	BootEntry   string `json:"boot_entry,omitempty"`
+	Description string `json:"description,omitempty"`
+	// Set with --against-enrolled to the db entry the file is verified by
+	EnrolledKey *EnrolledKey `json:"enrolled_key,omitempty"`
+	// Set to the fingerprint of the imported certificate the file is signed
+	// with, if it isn't signed by the db key
+	ImportedCert string `json:"imported_cert,omitempty"`
+	// Timestamp of the signature, if it has one
+	Timestamp      *sbctl.Timestamp `json:"timestamp,omitempty"`
+	TimestampError string           `json:"timestamp_error,omitempty"`
+	// Components below the SBAT policy of shim
+	SbatRevoked []sbctl.SbatRevocation `json:"sbat_revoked,omitempty"`
+	// Set with --deep to the problems found in the PE structure
+	StructureProblems []string `json:"structure_problems,omitempty"`
+	// Set with --bootchain when the entry couldn't be verified, "missing" for
+	// stale entries in BootOrder and missing files
+	Error string `json:"error,omitempty"`
+}
+
+type VerifiedSigner struct {
+	Subject     string `json:"subject"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+func verifiedSigner(cert *x509.Certificate) *VerifiedSigner {
+	sum := sha256.Sum256(cert.Raw)
+	return &VerifiedSigner{
+		Subject:     cert.Subject.String(),
+		Fingerprint: hex.EncodeToString(sum[:]),
+	}
 }
 
+// fileSHA256 returns the SHA256 checksum of the file
+func fileSHA256(vfs afero.Fs, file string) (string, error) {
+	f, err := vfs.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type VerifyCmdOptions struct {
+	ExitCode        bool
+	Detached        bool
+	Bootchain       bool
+	AgainstEnrolled bool
+	Deep            bool
+	ESP             string
+	FileList        string
+}
+
+const (
+	verifyExitUnsigned = 1
+	verifyExitError    = 2
+)
+
 var (
 	ErrInvalidHeader = errors.New("invalid pe header")
+	ErrCantReadFile  = errors.New("can't read file")
+	verifyCmdOptions = VerifyCmdOptions{}
 	verifyCmd        = &cobra.Command{
-		Use:   "verify",
-		Short: "Find and check if files in the ESP are signed or not",
-		RunE:  RunVerify,
+		Use:               "verify",
+		Short:             "Find and check if files in the ESP are signed or not",
+		ValidArgsFunction: completeFiles,
+		Long: `Find and check if files in the ESP are signed or not.
+
+With --against-enrolled files are checked against the db variable of the
+firmware instead of the sbctl keys, and the db entry which allows each file to
+boot is shown.
+
+With --deep the PE structure of each file is checked as well: the section
+alignment, that the authenticode hash covers the whole image and the signatures
+are for it, and that no data is appended after the signatures.
+
+With --file-list the files to verify are read from a file, or stdin with "-",
+one path per line. The results are printed as each file is verified, with
+--json as one object per line.
+
+With --exit-code the exit status reflects the files in the database, or the
+files given as arguments:
+  0  all files are present and signed
+  1  a file is missing, unsigned, or has changed since it was signed, or with
+     --deep has a problem in its PE structure
+  2  a file could not be read or verified
+
+Combined with --quiet nothing is printed, including warnings and errors, and
+the exit status is the only result.`,
+		RunE: RunVerify,
 	}
-	verifiedFiles      []VerifiedFile
+	verifiedFiles []VerifiedFile
+	// Read by --file-list -
+	verifyStdin io.Reader = os.Stdin
 )
 
 func VerifyOneFile(state *config.State, f string) error {
@@ -45,7 +149,7 @@ func VerifyOneFile(state *config.State, f string) error {
 		return nil
 	} else if errors.Is(err, os.ErrPermission) {
 		logging.Warn("%s permission denied. Can't read file\n", f)
-		return nil
+		return ErrCantReadFile
 	}
 	defer o.Close()
 	ok, err := sbctl.CheckMSDos(o)
@@ -55,21 +159,46 @@ func VerifyOneFile(state *config.State, f string) error {
 	if !ok {
 		return ErrInvalidHeader
 	}
+	if fileentry.SHA256, err = fileSHA256(state.Fs, f); err != nil {
+		return fmt.Errorf("failed to read file %s: %w", f, err)
+	}
+	verifySbat(state, &fileentry)
+	if err := verifyStructure(state, &fileentry); err != nil {
+		return err
+	}
+
+	if verifyCmdOptions.AgainstEnrolled {
+		return verifyEnrolled(state, fileentry)
+	}
 
 	kh, err := backend.GetKeyHierarchy(state.Fs, state)
 	if err != nil {
 		return err
 	}
 
-	ok, err = sbctl.VerifyFile(state, kh, hierarchy.Db, f)
-	if err != nil {
+	ok, imported, err := sbctl.VerifyFileTrusted(state, kh, f)
+	if err != nil && len(fileentry.StructureProblems) > 0 {
+		// The problems found by --deep explain why the signature can't be
+		// verified
+		logging.NotOk("%s can't be verified: %v", f, err)
+		verifiedFiles = append(verifiedFiles, fileentry)
+		return nil
+	} else if err != nil {
 		return err
 	}
 
-	if ok {
+	switch {
+	case ok && imported != nil:
+		logging.Ok("%s is signed by the imported certificate %s", f, imported.Certificate.Subject)
+		fileentry.IsSigned = 1
+		fileentry.ImportedCert = imported.Fingerprint
+		fileentry.Signer = verifiedSigner(imported.Certificate)
+	case ok:
 		logging.Ok("%s is signed", f)
 		fileentry.IsSigned = 1
-	} else {
+		fileentry.Signer = verifiedSigner(kh.Db.Certificate())
+		verifyTimestamp(state, kh, &fileentry)
+	default:
 		logging.NotOk("%s is not signed", f)
 	}
 	verifiedFiles = append(verifiedFiles, fileentry)
@@ -77,13 +206,361 @@ func VerifyOneFile(state *config.State, f string) error {
 	return nil
 }
 
+// verifyTimestamp prints the timestamp of the signature of a signed file
+func verifyTimestamp(state *config.State, kh *backend.KeyHierarchy, fileentry *VerifiedFile) {
+	ts, err := sbctl.FileTimestamp(state, kh, hierarchy.Db, fileentry.FileName)
+	switch {
+	case err != nil:
+		logging.NotOk("%s has an invalid timestamp: %v", fileentry.FileName, err)
+		fileentry.TimestampError = err.Error()
+	case ts == nil:
+	case ts.Trusted:
+		logging.Print("  Timestamped %s by %s\n", ts.Time.Format(time.RFC3339), ts.TSA)
+	default:
+		logging.Print("  Timestamped %s by %s, which is not trusted by the system\n", ts.Time.Format(time.RFC3339), ts.TSA)
+	}
+	fileentry.Timestamp = ts
+}
+
+// verifyStructure checks the PE structure of the file with --deep, and prints
+// the problems found
+func verifyStructure(state *config.State, fileentry *VerifiedFile) error {
+	if !verifyCmdOptions.Deep {
+		return nil
+	}
+	problems, err := sbctl.CheckPEStructureFile(state, fileentry.FileName)
+	if errors.Is(err, sbctl.ErrNotPE) {
+		return ErrInvalidHeader
+	} else if err != nil {
+		return fmt.Errorf("failed to check the structure of %s: %w", fileentry.FileName, err)
+	}
+	for _, p := range problems {
+		logging.NotOk("%s: %s", fileentry.FileName, p)
+	}
+	fileentry.StructureProblems = problems
+	return nil
+}
+
+// verifyEnrolled verifies the file against the entries in the firmware db
+func verifyEnrolled(state *config.State, fileentry VerifiedFile) error {
+	list, err := sbctl.VerifyFileEnrolled(state, fileentry.FileName)
+	if err != nil {
+		return err
+	}
+	if list == nil {
+		logging.NotOk("%s is not signed by a certificate or hash in db", fileentry.FileName)
+		verifiedFiles = append(verifiedFiles, fileentry)
+		return nil
+	}
+	key := enrolledKeys(&signature.SignatureDatabase{list})[0]
+	fileentry.IsSigned = 1
+	fileentry.EnrolledKey = &key
+	if key.Subject != "" {
+		fileentry.Signer = &VerifiedSigner{Subject: key.Subject, Fingerprint: key.Fingerprint}
+	}
+	switch {
+	case key.Type == "SHA256":
+		logging.Ok("%s is enrolled by its hash in db", fileentry.FileName)
+	case key.Subject != "":
+		logging.Ok("%s is signed by %s (%s) in db", fileentry.FileName, key.Subject, key.Fingerprint)
+	default:
+		logging.Ok("%s is signed by %s in db", fileentry.FileName, key.Fingerprint)
+	}
+	verifiedFiles = append(verifiedFiles, fileentry)
+	return nil
+}
+
+// verifyTracked verifies a file we expect to be signed and returns the exit
+// code for --exit-code.
+func verifyTracked(state *config.State, file *sbctl.SigningEntry) (int, error) {
+	if err := VerifyOneFile(state, file.OutputFile); errors.Is(err, ErrCantReadFile) {
+		return verifyExitError, nil
+	} else if errors.Is(err, ErrInvalidHeader) {
+		logging.Error(fmt.Errorf("%s is not a valid EFI binary", file.OutputFile))
+		return verifyExitUnsigned, nil
+	} else if err != nil {
+		return verifyExitError, err
+	}
+	if verified := verifiedFiles[len(verifiedFiles)-1]; verified.IsSigned != 1 || len(verified.StructureProblems) > 0 {
+		return verifyExitUnsigned, nil
+	}
+	ok, err := sbctl.ChecksumMatches(state, file.File, file.OutputFile)
+	if err != nil {
+		logging.Warn("%s: can't compare with %s: %v", file.OutputFile, file.File, err)
+		return verifyExitError, nil
+	}
+	if !ok {
+		logging.NotOk("%s has changed since %s was signed", file.File, file.OutputFile)
+		return verifyExitUnsigned, nil
+	}
+	return 0, nil
+}
+
+func verifyResult(code int, err error) error {
+	if !verifyCmdOptions.ExitCode {
+		return err
+	}
+	if err != nil {
+		return &ExitCodeError{Code: verifyExitError, Err: err}
+	}
+	if code != 0 {
+		return &ExitCodeError{Code: code}
+	}
+	return nil
+}
+
+// verifyDetached checks a file against a detached signature, which defaults to
+// <file>.sig
+func verifyDetached(state *config.State, args []string) (int, error) {
+	if len(args) < 1 || len(args) > 2 {
+		return verifyExitError, fmt.Errorf("--detached requires a file and optionally its signature")
+	}
+	file := args[0]
+	sigfile := file + ".sig"
+	if len(args) == 2 {
+		sigfile = args[1]
+	}
+
+	if state.Config.Landlock {
+		lsm.RestrictAdditionalPaths(
+			landlock.ROFiles(file, sigfile).IgnoreIfMissing(),
+		)
+		if err := lsm.Restrict(); err != nil {
+			return verifyExitError, err
+		}
+	}
+
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		return verifyExitError, err
+	}
+
+	fileentry := VerifiedFile{FileName: file, IsSigned: 0}
+	ok, imported, err := sbctl.VerifyFileDetachedTrusted(state, kh, file, sigfile)
+	var pathErr *os.PathError
+	if errors.Is(err, os.ErrNotExist) && errors.As(err, &pathErr) {
+		logging.Warn("%s does not exist", pathErr.Path)
+		fileentry.IsSigned = -1
+	} else if err != nil {
+		return verifyExitError, fmt.Errorf("failed to verify %s: %w", file, err)
+	} else if ok && imported != nil {
+		logging.Ok("%s is signed by %s with the imported certificate %s", file, sigfile, imported.Certificate.Subject)
+		fileentry.IsSigned = 1
+		fileentry.ImportedCert = imported.Fingerprint
+		fileentry.Signer = verifiedSigner(imported.Certificate)
+	} else if ok {
+		logging.Ok("%s is signed by %s", file, sigfile)
+		fileentry.IsSigned = 1
+		fileentry.Signer = verifiedSigner(kh.Db.Certificate())
+	} else {
+		logging.NotOk("%s is not signed by %s", file, sigfile)
+	}
+	if fileentry.IsSigned != -1 {
+		if fileentry.SHA256, err = fileSHA256(state.Fs, file); err != nil {
+			return verifyExitError, fmt.Errorf("failed to read file %s: %w", file, err)
+		}
+		if err := verifyStructure(state, &fileentry); errors.Is(err, ErrInvalidHeader) {
+			return verifyExitUnsigned, fmt.Errorf("%s is not a valid EFI binary", file)
+		} else if err != nil {
+			return verifyExitError, err
+		}
+	}
+	verifiedFiles = append(verifiedFiles, fileentry)
+
+	if cmdOptions.StructuredOutput() {
+		if err := StructuredOut(verifiedFiles); err != nil {
+			return verifyExitError, err
+		}
+	}
+	if fileentry.IsSigned != 1 || len(fileentry.StructureProblems) > 0 {
+		return verifyExitUnsigned, nil
+	}
+	return 0, nil
+}
+
+// verifyBootchain verifies the binaries loaded by the entries in BootOrder
+func verifyBootchain(state *config.State, espPath string) (int, error) {
+	entries, err := sbctl.GetBootEntries(state.Efivarfs, espPath)
+	if err != nil {
+		return verifyExitError, err
+	}
+	logging.Print("Verifying the boot entries in BootOrder...\n")
+	exitCode := 0
+	for _, entry := range entries {
+		// A stale or broken entry doesn't stop the others from being verified
+		if entry.Missing {
+			logging.Warn("%s is in BootOrder but does not exist", entry.Name)
+			verifiedFiles = append(verifiedFiles, VerifiedFile{BootEntry: entry.Name, Error: "missing"})
+			exitCode = max(exitCode, verifyExitUnsigned)
+			continue
+		}
+		if !entry.Active {
+			logging.Print("%s (%s) is not active, skipping\n", entry.Name, entry.Description)
+			continue
+		}
+		if entry.File == "" {
+			logging.Print("%s (%s) does not load a file, skipping\n", entry.Name, entry.Description)
+			continue
+		}
+		n := len(verifiedFiles)
+		err := VerifyOneFile(state, entry.File)
+		if errors.Is(err, ErrInvalidHeader) {
+			logging.Error(fmt.Errorf("%s is not a valid EFI binary", entry.File))
+			verifiedFiles = append(verifiedFiles, VerifiedFile{FileName: entry.File})
+		} else if err != nil {
+			if !errors.Is(err, ErrCantReadFile) {
+				logging.Error(fmt.Errorf("%s: %w", entry.File, err))
+			}
+			verifiedFiles = append(verifiedFiles[:n], VerifiedFile{FileName: entry.File, Error: err.Error()})
+			exitCode = max(exitCode, verifyExitError)
+		}
+		verified := &verifiedFiles[len(verifiedFiles)-1]
+		verified.BootEntry = entry.Name
+		verified.Description = entry.Description
+		if verified.IsSigned == -1 {
+			verified.Error = "missing"
+		}
+		if verified.IsSigned != 1 || len(verified.StructureProblems) > 0 {
+			exitCode = max(exitCode, verifyExitUnsigned)
+		}
+	}
+	if cmdOptions.StructuredOutput() {
+		if err := StructuredOut(verifiedFiles); err != nil {
+			return verifyExitError, err
+		}
+	}
+	return exitCode, nil
+}
+
+// printVerifiedFile prints the result of a file verified with --file-list. With
+// --json every result is printed as an object on its own line so the output
+// can be streamed.
+func printVerifiedFile(f VerifiedFile) error {
+	var out []byte
+	switch {
+	case cmdOptions.JsonOutput:
+		b, err := json.Marshal(f)
+		if err != nil {
+			return err
+		}
+		out = append(b, '\n')
+	case cmdOptions.YamlOutput:
+		b, err := json.Marshal(f)
+		if err != nil {
+			return err
+		}
+		if b, err = yaml.JSONToYAML(b); err != nil {
+			return err
+		}
+		out = append([]byte("---\n"), b...)
+	default:
+		return nil
+	}
+	logging.PrintOn()
+	logging.Print("%s", out)
+	logging.PrintOff()
+	return nil
+}
+
+// verifyFileList verifies the files listed in file, or stdin if it is "-".
+// The list is read before verifying anything, so the files can be allowed by
+// landlock.
+func verifyFileList(state *config.State, file string) (int, error) {
+	var r io.Reader = verifyStdin
+	if file != "-" {
+		f, err := state.Fs.Open(file)
+		if err != nil {
+			return verifyExitError, err
+		}
+		defer f.Close()
+		r = f
+	}
+	var files []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			files = append(files, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return verifyExitError, fmt.Errorf("can't read the file list: %w", err)
+	}
+
+	if state.Config.Landlock {
+		lsm.RestrictAdditionalPaths(
+			landlock.ROFiles(files...).IgnoreIfMissing(),
+		)
+		if err := lsm.Restrict(); err != nil {
+			return verifyExitError, err
+		}
+	}
+
+	exitCode := 0
+	for _, file := range files {
+		n := len(verifiedFiles)
+		code, err := verifyTracked(state, &sbctl.SigningEntry{File: file, OutputFile: file})
+		if err != nil {
+			return code, err
+		}
+		exitCode = max(exitCode, code)
+		// Unreadable and invalid files aren't added by verifyTracked
+		if len(verifiedFiles) == n {
+			verifiedFiles = append(verifiedFiles, VerifiedFile{FileName: file})
+		}
+		if err := printVerifiedFile(verifiedFiles[len(verifiedFiles)-1]); err != nil {
+			return verifyExitError, err
+		}
+	}
+	return exitCode, nil
+}
+
 func RunVerify(cmd *cobra.Command, args []string) error {
 	state := cmd.Context().Value(stateDataKey{}).(*config.State)
 
+	// With --quiet the exit status is the only output of --exit-code, the
+	// warnings and errors are silenced as well
+	if cmdOptions.QuietOutput && verifyCmdOptions.ExitCode {
+		logging.SetLogger(nil)
+		logging.PrintOff()
+	}
+
+	// Timestamps are checked against the certificates trusted by the system
+	if state.Config.Landlock {
+		lsm.AllowCertificates()
+	}
+
+	if verifyCmdOptions.Detached {
+		if verifyCmdOptions.AgainstEnrolled {
+			return verifyResult(0, fmt.Errorf("--detached can't be combined with --against-enrolled"))
+		}
+		return verifyResult(verifyDetached(state, args))
+	}
+
+	// Both read the EFI variables
+	if verifyCmdOptions.Bootchain || verifyCmdOptions.AgainstEnrolled {
+		if err := requireEfivarfs(state); err != nil {
+			return verifyResult(0, err)
+		}
+	}
+
+	if verifyCmdOptions.FileList != "" {
+		if len(args) > 0 || verifyCmdOptions.Bootchain {
+			return verifyResult(0, fmt.Errorf("--file-list can't be combined with files or --bootchain"))
+		}
+		return verifyResult(verifyFileList(state, verifyCmdOptions.FileList))
+	}
+
 	// Exit early if we can't verify files
-	espPath, err := sbctl.GetESP(state.Fs)
+	var espPath string
+	var err error
+	if verifyCmdOptions.Bootchain || verifyCmdOptions.ESP != "" {
+		// Boot entries refer to a single ESP, so don't guess between several
+		espPath, err = sbctl.ResolveESP(state, verifyCmdOptions.ESP)
+	} else {
+		espPath, err = sbctl.GetESP(state.Fs)
+	}
 	if err != nil {
-		return err
+		return verifyResult(0, err)
 	}
 
 	if state.Config.Landlock {
@@ -91,37 +568,44 @@ func RunVerify(cmd *cobra.Command, args []string) error {
 			landlock.RWDirs(espPath),
 		)
 		if err := sbctl.LandlockFromFileDatabase(state); err != nil {
-			return err
+			return verifyResult(0, err)
 		}
 		if err := lsm.Restrict(); err != nil {
-			return err
+			return verifyResult(0, err)
 		}
 	}
 
+	if verifyCmdOptions.Bootchain {
+		return verifyResult(verifyBootchain(state, espPath))
+	}
+
+	exitCode := 0
 	if len(args) > 0 {
 		for _, file := range args {
-			if err := VerifyOneFile(state, file); err != nil {
-				if errors.Is(ErrInvalidHeader, err) {
-					logging.Error(fmt.Errorf("%s is not a valid EFI binary", file))
-					return nil
-				}
-				return err
+			code, err := verifyTracked(state, &sbctl.SigningEntry{File: file, OutputFile: file})
+			if err != nil {
+				return verifyResult(code, err)
 			}
+			exitCode = max(exitCode, code)
 		}
-		if cmdOptions.JsonOutput {
-			return JsonOut(verifiedFiles)
+		if cmdOptions.StructuredOutput() {
+			if err := StructuredOut(verifiedFiles); err != nil {
+				return err
+			}
 		}
-		return nil
+		return verifyResult(exitCode, nil)
 	}
 	logging.Print("Verifying file database and EFI images in %s...\n", espPath)
 	if err := sbctl.SigningEntryIter(state, func(file *sbctl.SigningEntry) error {
 		sbctl.AddChecked(file.OutputFile)
-		if err := VerifyOneFile(state, file.OutputFile); err != nil {
+		code, err := verifyTracked(state, file)
+		if err != nil {
 			return err
 		}
+		exitCode = max(exitCode, code)
 		return nil
 	}); err != nil {
-		return err
+		return verifyResult(0, err)
 	}
 
 	if err := afero.Walk(state.Fs, espPath, func(path string, info os.FileInfo, err error) error {
@@ -135,23 +619,37 @@ func RunVerify(cmd *cobra.Command, args []string) error {
 			return nil
 		}
 		if err = VerifyOneFile(state, path); err != nil {
-			// We are scanning the ESP, so ignore invalid files
-			if errors.Is(ErrInvalidHeader, err) {
+			// We are scanning the ESP, so ignore invalid and unreadable files
+			if errors.Is(ErrInvalidHeader, err) || errors.Is(err, ErrCantReadFile) {
 				return nil
 			}
 			logging.Error(fmt.Errorf("failed to verify file %s: %s", path, err))
 		}
 		return nil
 	}); err != nil {
-		return err
+		return verifyResult(0, err)
 	}
-	if cmdOptions.JsonOutput {
-		return JsonOut(verifiedFiles)
+	if cmdOptions.StructuredOutput() {
+		if err := StructuredOut(verifiedFiles); err != nil {
+			return err
+		}
 	}
-	return nil
+	return verifyResult(exitCode, nil)
+}
+
+func verifyCmdFlags(cmd *cobra.Command) {
+	f := cmd.Flags()
+	f.BoolVarP(&verifyCmdOptions.ExitCode, "exit-code", "", false, "exit with 1 if a file is unsigned, and 2 if a file can't be verified")
+	f.BoolVarP(&verifyCmdOptions.Detached, "detached", "", false, "verify a file against a detached signature")
+	f.BoolVarP(&verifyCmdOptions.Bootchain, "bootchain", "", false, "verify the binaries loaded by the boot entries in BootOrder")
+	f.BoolVarP(&verifyCmdOptions.AgainstEnrolled, "against-enrolled", "", false, "verify against the certificates and hashes enrolled in the firmware db instead of the sbctl keys")
+	f.BoolVarP(&verifyCmdOptions.Deep, "deep", "", false, "also check the PE structure, the section alignment and the coverage of the authenticode hash, and look for data appended after the signatures")
+	f.StringVarP(&verifyCmdOptions.ESP, "esp", "", "", "ESP location. Defaults to esp_mountpoint from the configuration, or the detected ESP")
+	f.StringVarP(&verifyCmdOptions.FileList, "file-list", "", "", "verify the files listed in the file, one per line, or - to read them from stdin")
 }
 
 func init() {
+	verifyCmdFlags(verifyCmd)
 	CliCommands = append(CliCommands, cliCommand{
 		Cmd: verifyCmd,
 	})
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efi/util"
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/foxboron/sbctl/hierarchy"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+func TestVerifyExitCode(t *testing.T) {
+	state := setupRotateState(t)
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.WithValue(context.Background(), stateDataKey{}, state))
+
+	t.Setenv("SYSTEMD_ESP_PATH", "/boot")
+	verifyCmdOptions.ExitCode = true
+	defer func() { verifyCmdOptions.ExitCode = false }()
+
+	verifiedFiles = nil
+	if err := RunVerify(cmd, []string{}); err != nil {
+		t.Fatalf("expected all files to verify, got %v", err)
+	}
+
+	// Replace the signed output with the unsigned binary
+	if err := afero.WriteFile(state.Fs, "/boot/new.efi", mustBytes("../../tests/binaries/test.pecoff"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var exitErr *ExitCodeError
+	verifiedFiles = nil
+	if err := RunVerify(cmd, []string{}); !errors.As(err, &exitErr) || exitErr.Code != verifyExitUnsigned {
+		t.Fatalf("expected exit code %d, got %v", verifyExitUnsigned, err)
+	}
+
+	if err := state.Fs.Remove("/boot/new.efi"); err != nil {
+		t.Fatal(err)
+	}
+	verifiedFiles = nil
+	if err := RunVerify(cmd, []string{}); !errors.As(err, &exitErr) || exitErr.Code != verifyExitUnsigned {
+		t.Fatalf("expected exit code %d for a missing file, got %v", verifyExitUnsigned, err)
+	}
+}
+
+func TestVerifyDetached(t *testing.T) {
+	state := setupRotateState(t)
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.WithValue(context.Background(), stateDataKey{}, state))
+
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		t.Fatalf("can't get key hierarchy: %v", err)
+	}
+	if err := sbctl.SignFileDetached(state, kh, hierarchy.Db, "/boot/test.efi", ""); err != nil {
+		t.Fatalf("failed signing detached: %v", err)
+	}
+
+	// The binary itself should be left untouched
+	b, err := fs.ReadFile(state.Fs, "/boot/test.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, mustBytes("../../tests/binaries/test.pecoff")) {
+		t.Fatalf("detached signing modified the binary")
+	}
+
+	verifyCmdOptions.ExitCode = true
+	verifyCmdOptions.Detached = true
+	defer func() {
+		verifyCmdOptions.ExitCode = false
+		verifyCmdOptions.Detached = false
+	}()
+
+	verifiedFiles = nil
+	if err := RunVerify(cmd, []string{"/boot/test.efi"}); err != nil {
+		t.Fatalf("expected detached signature to verify, got %v", err)
+	}
+
+	// The signature should not match a modified binary
+	b[len(b)/4] ^= 0xff
+	if err := afero.WriteFile(state.Fs, "/boot/modified.efi", b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var exitErr *ExitCodeError
+	verifiedFiles = nil
+	if err := RunVerify(cmd, []string{"/boot/modified.efi", "/boot/test.efi.sig"}); !errors.As(err, &exitErr) || exitErr.Code != verifyExitUnsigned {
+		t.Fatalf("expected exit code %d, got %v", verifyExitUnsigned, err)
+	}
+}
+
+func TestVerifyDeep(t *testing.T) {
+	state := setupRotateState(t)
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.WithValue(context.Background(), stateDataKey{}, state))
+
+	t.Setenv("SYSTEMD_ESP_PATH", "/boot")
+
+	verifyCmdOptions.ExitCode = true
+	verifyCmdOptions.Deep = true
+	defer func() {
+		verifyCmdOptions.ExitCode = false
+		verifyCmdOptions.Deep = false
+	}()
+
+	verifiedFiles = nil
+	if err := RunVerify(cmd, []string{"/boot/new.efi"}); err != nil {
+		t.Fatalf("expected the signed binary to verify, got %v", err)
+	}
+
+	// Data appended after the signature doesn't invalidate it, but is reported
+	b, err := fs.ReadFile(state.Fs, "/boot/new.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := afero.WriteFile(state.Fs, "/boot/appended.efi", append(b, "appended"...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var exitErr *ExitCodeError
+	verifiedFiles = nil
+	if err := RunVerify(cmd, []string{"/boot/appended.efi"}); !errors.As(err, &exitErr) || exitErr.Code != verifyExitUnsigned {
+		t.Fatalf("expected exit code %d, got %v", verifyExitUnsigned, err)
+	}
+	if problems := verifiedFiles[0].StructureProblems; len(problems) == 0 || !strings.Contains(problems[0], "appended after the certificate table") {
+		t.Fatalf("expected the appended data to be reported, got %q", problems)
+	}
+}
+
+type rawVar []byte
+
+func (r rawVar) Marshal(b *bytes.Buffer) {
+	b.Write(r)
+}
+
+func (r rawVar) Bytes() []byte {
+	return r
+}
+
+func utf16Bytes(s string) []byte {
+	var b []byte
+	for _, c := range utf16.Encode([]rune(s + "\x00")) {
+		b = binary.LittleEndian.AppendUint16(b, c)
+	}
+	return b
+}
+
+// loadOptionBytes returns an EFI_LOAD_OPTION with a hard drive node followed
+// by the file path
+func loadOptionBytes(active bool, description, path string) []byte {
+	var devpath []byte
+	hd := make([]byte, 42)
+	hd[0], hd[1] = 0x04, 0x01
+	binary.LittleEndian.PutUint16(hd[2:], uint16(len(hd)))
+	devpath = append(devpath, hd...)
+	file := utf16Bytes(path)
+	devpath = append(devpath, 0x04, 0x04)
+	devpath = binary.LittleEndian.AppendUint16(devpath, uint16(4+len(file)))
+	devpath = append(devpath, file...)
+	devpath = append(devpath, 0x7f, 0xff, 0x04, 0x00)
+
+	var b []byte
+	if active {
+		b = binary.LittleEndian.AppendUint32(b, 1)
+	} else {
+		b = binary.LittleEndian.AppendUint32(b, 0)
+	}
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(devpath)))
+	b = append(b, utf16Bytes(description)...)
+	return append(b, devpath...)
+}
+
+func TestVerifyBootchain(t *testing.T) {
+	state := setupRotateState(t)
+
+	entries := map[string][]byte{
+		"Boot0001": loadOptionBytes(true, "Signed", `\new.efi`),
+		"Boot0002": loadOptionBytes(false, "Inactive", `\inactive.efi`),
+		"Boot000A": loadOptionBytes(true, "Missing", `\EFI\missing.efi`),
+	}
+	for name, data := range entries {
+		v := efivar.BootEntry
+		v.Name = name
+		if err := state.Efivarfs.WriteVar(v, rawVar(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Boot0005 is a stale entry without a variable
+	if err := state.Efivarfs.WriteVar(efivar.BootOrder, rawVar{0x05, 0x00, 0x01, 0x00, 0x02, 0x00, 0x0a, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+
+	bootEntries, err := sbctl.GetBootEntries(state.Efivarfs, "/boot")
+	if err != nil {
+		t.Fatalf("failed reading boot entries: %v", err)
+	}
+	if len(bootEntries) != 4 || !bootEntries[0].Missing || bootEntries[3].Name != "Boot000A" || bootEntries[3].File != "/boot/EFI/missing.efi" {
+		t.Fatalf("unexpected boot entries: %+v", bootEntries)
+	}
+
+	verifiedFiles = nil
+	code, err := verifyBootchain(state, "/boot")
+	if err != nil {
+		t.Fatalf("failed verifying bootchain: %v", err)
+	}
+	if code != verifyExitUnsigned {
+		t.Fatalf("expected exit code %d for a missing file, got %d", verifyExitUnsigned, code)
+	}
+	if len(verifiedFiles) != 3 {
+		t.Fatalf("inactive entries should be skipped: %+v", verifiedFiles)
+	}
+	if f := verifiedFiles[0]; f.BootEntry != "Boot0005" || f.Error != "missing" {
+		t.Fatalf("expected Boot0005 to be missing: %+v", f)
+	}
+	if f := verifiedFiles[1]; f.BootEntry != "Boot0001" || f.IsSigned != 1 || f.Error != "" {
+		t.Fatalf("expected Boot0001 to be signed: %+v", f)
+	}
+	if f := verifiedFiles[2]; f.BootEntry != "Boot000A" || f.IsSigned != -1 || f.Error != "missing" {
+		t.Fatalf("expected the file of Boot000A to be missing: %+v", f)
+	}
+}
+
+func TestVerifyAgainstEnrolled(t *testing.T) {
+	state := setupRotateState(t)
+
+	verifyCmdOptions.AgainstEnrolled = true
+	defer func() { verifyCmdOptions.AgainstEnrolled = false }()
+
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		t.Fatalf("can't get key hierarchy: %v", err)
+	}
+
+	verifiedFiles = nil
+	if err := VerifyOneFile(state, "/boot/new.efi"); err != nil {
+		t.Fatalf("failed verifying file: %v", err)
+	}
+	f := verifiedFiles[0]
+	if f.IsSigned != 1 || f.EnrolledKey == nil || f.EnrolledKey.Fingerprint != backend.Fingerprint(kh.Db) {
+		t.Fatalf("expected the file to be verified by the enrolled db key: %+v", f)
+	}
+
+	// Enroll the hash of the unsigned binary
+	peFile, err := state.Fs.Open("/boot/test.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peFile.Close()
+	peBinary, err := authenticode.Parse(peFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	efistate, err := sbctl.SystemEFIVariables(state.Efivarfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := efistate.Db.Append(signature.CERT_SHA256_GUID, *util.StringToGUID("11111111-2222-3333-4444-123456789abc"), peBinary.Hash(crypto.SHA256)); err != nil {
+		t.Fatal(err)
+	}
+	if err := efistate.EnrollKey(efivar.Db, kh); err != nil {
+		t.Fatal(err)
+	}
+
+	// A modified binary matches neither
+	b, err := fs.ReadFile(state.Fs, "/boot/test.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)/4] ^= 0xff
+	if err := afero.WriteFile(state.Fs, "/boot/modified.efi", b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	verifiedFiles = nil
+	for _, file := range []string{"/boot/test.efi", "/boot/modified.efi"} {
+		if err := VerifyOneFile(state, file); err != nil {
+			t.Fatalf("failed verifying %s: %v", file, err)
+		}
+	}
+	if f := verifiedFiles[0]; f.IsSigned != 1 || f.EnrolledKey == nil || f.EnrolledKey.Type != "SHA256" {
+		t.Fatalf("expected the file to be verified by its enrolled hash: %+v", f)
+	}
+	if f := verifiedFiles[1]; f.IsSigned != 0 || f.EnrolledKey != nil {
+		t.Fatalf("expected the modified file to not be verified: %+v", f)
+	}
+}
+
+func TestVerifyFileList(t *testing.T) {
+	state := setupRotateState(t)
+	kh, err := backend.GetKeyHierarchy(state.Fs, state)
+	if err != nil {
+		t.Fatalf("can't get key hierarchy: %v", err)
+	}
+
+	verifyStdin = strings.NewReader("/boot/new.efi\n\n/boot/test.efi\n/boot/missing.efi\n")
+	cmdOptions.JsonOutput = true
+	logging.PrintOff()
+	defer func() {
+		verifyStdin = os.Stdin
+		cmdOptions.JsonOutput = false
+		logging.PrintOn()
+	}()
+
+	verifiedFiles = nil
+	var code int
+	out, err := captureOutput(func() error {
+		var err error
+		code, err = verifyFileList(state, "-")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed verifying file list: %v", err)
+	}
+	if code != verifyExitUnsigned {
+		t.Fatalf("expected exit code %d, got %d", verifyExitUnsigned, code)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	want := map[string]int8{"/boot/new.efi": 1, "/boot/test.efi": 0, "/boot/missing.efi": -1}
+	if len(lines) != len(want) {
+		t.Fatalf("expected one line per file, got:\n%s", out)
+	}
+	for _, line := range lines {
+		var f VerifiedFile
+		if err := json.Unmarshal([]byte(line), &f); err != nil {
+			t.Fatalf("invalid json line %q: %v", line, err)
+		}
+		if f.IsSigned != want[f.FileName] {
+			t.Fatalf("%s: expected is_signed %d, got %d", f.FileName, want[f.FileName], f.IsSigned)
+		}
+		if f.IsSigned == -1 {
+			continue
+		}
+		b, err := fs.ReadFile(state.Fs, f.FileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sum := sha256.Sum256(b); f.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Fatalf("%s: unexpected sha256 %s", f.FileName, f.SHA256)
+		}
+		switch {
+		case f.IsSigned == 0 && f.Signer != nil:
+			t.Fatalf("%s: unsigned file has a signer %+v", f.FileName, f.Signer)
+		case f.IsSigned == 1 && (f.Signer == nil || *f.Signer != *verifiedSigner(kh.Db.Certificate())):
+			t.Fatalf("%s: expected the db key as signer, got %+v", f.FileName, f.Signer)
+		}
+	}
+}
+
+func TestVerifyQuietExitCode(t *testing.T) {
+	state := setupRotateState(t)
+	cmd := &cobra.Command{}
+	cmd.SetContext(context.WithValue(context.Background(), stateDataKey{}, state))
+
+	t.Setenv("SYSTEMD_ESP_PATH", "/boot")
+	verifyCmdOptions.ExitCode = true
+	cmdOptions.QuietOutput = true
+	defer func() {
+		verifyCmdOptions.ExitCode = false
+		cmdOptions.QuietOutput = false
+		logging.PrintOn()
+	}()
+
+	if err := state.Fs.Remove("/boot/new.efi"); err != nil {
+		t.Fatal(err)
+	}
+	var exitErr *ExitCodeError
+	verifiedFiles = nil
+	out, err := captureOutput(func() error { return RunVerify(cmd, []string{}) })
+	if !errors.As(err, &exitErr) || exitErr.Code != verifyExitUnsigned {
+		t.Fatalf("expected exit code %d for a missing file, got %v", verifyExitUnsigned, err)
+	}
+	if len(out) != 0 {
+		t.Fatalf("expected no output, got %q", out)
+	}
+}
@@ -1,24 +1,169 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strings"
 
 	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/certs"
+	"github.com/goccy/go-yaml"
 	"github.com/spf13/cobra"
+
+	ll "github.com/landlock-lsm/go-landlock/landlock/syscall"
 )
 
+// VersionFeature is an optional feature of sbctl
+type VersionFeature struct {
+	Name string `json:"name"`
+	// Compiled is true if support for the feature is built into sbctl
+	Compiled bool `json:"compiled"`
+	// Available is true if the feature can be used on this system
+	Available bool   `json:"available"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+type VersionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	GoVersion string `json:"go_version"`
+	// Vendor certificates embedded into sbctl
+	Certificates *certs.Bundle     `json:"certificates"`
+	Features     []*VersionFeature `json:"features"`
+}
+
 var (
 	versionCmd = &cobra.Command{
 		Use:    "version",
 		Short:  "Print sbctl version",
 		Hidden: true,
 		Run: func(cmd *cobra.Command, args []string) {
-			fmt.Println(sbctl.Version)
+			fmt.Print(versionOutput())
 		},
 	}
+	versionFeatureNames = map[string]string{
+		"landlock": "Landlock",
+		"tpm":      "TPM",
+		"pkcs11":   "PKCS#11",
+	}
+	// TPM devices checked for the tpm feature
+	versionTPMDevices = []string{"/dev/tpmrm0", "/dev/tpm0"}
 )
 
+// vcsCommit returns the commit sbctl was built from, if the build recorded it
+func vcsCommit() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	var commit string
+	var modified bool
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			commit = s.Value
+		case "vcs.modified":
+			modified = s.Value == "true"
+		}
+	}
+	if commit == "" {
+		return "unknown"
+	}
+	if modified {
+		commit += "-dirty"
+	}
+	return commit
+}
+
+func GetVersionInfo() (*VersionInfo, error) {
+	bundle, err := certs.EmbeddedBundle()
+	if err != nil {
+		return nil, err
+	}
+
+	landlock := &VersionFeature{Name: "landlock", Compiled: true}
+	if abi, err := ll.LandlockGetABIVersion(); err == nil && abi > 0 {
+		landlock.Available = true
+		landlock.Detail = fmt.Sprintf("ABI %d", abi)
+	}
+	// The TPM isn't opened as it can be slow to respond
+	tpm := &VersionFeature{Name: "tpm", Compiled: true}
+	for _, dev := range versionTPMDevices {
+		if _, err := os.Stat(dev); err == nil {
+			tpm.Available = true
+			tpm.Detail = dev
+			break
+		}
+	}
+	pkcs11 := &VersionFeature{Name: "pkcs11", Compiled: backend.PKCS11Supported, Available: backend.PKCS11Supported}
+
+	return &VersionInfo{
+		Version:      sbctl.Version,
+		Commit:       vcsCommit(),
+		GoVersion:    runtime.Version(),
+		Certificates: bundle,
+		Features:     []*VersionFeature{landlock, tpm, pkcs11},
+	}, nil
+}
+
+func (f *VersionFeature) String() string {
+	switch {
+	case !f.Compiled:
+		return "not compiled in"
+	case !f.Available:
+		return "not available"
+	case f.Detail != "":
+		return fmt.Sprintf("available (%s)", f.Detail)
+	default:
+		return "available"
+	}
+}
+
+// versionOutput returns the output of --version, as json or yaml with
+// --json and --yaml
+func versionOutput() string {
+	info, err := GetVersionInfo()
+	if err != nil {
+		return fmt.Sprintf("sbctl version %s\n%v\n", sbctl.Version, err)
+	}
+
+	if cmdOptions.StructuredOutput() {
+		b, err := json.MarshalIndent(info, "", "  ")
+		if err == nil && cmdOptions.YamlOutput {
+			b, err = yaml.JSONToYAML(b)
+		}
+		if err != nil {
+			return fmt.Sprintf("could not marshal the version: %v\n", err)
+		}
+		return strings.TrimSuffix(string(b), "\n") + "\n"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "sbctl version %s\n", info.Version)
+	fmt.Fprintf(&b, "%-16s%s\n", "Commit:", info.Commit)
+	fmt.Fprintf(&b, "%-16s%s\n", "Go version:", info.GoVersion)
+	fmt.Fprintf(&b, "%-16s%s, issued up to %s\n", "Certificates:", strings.Join(info.Certificates.Generations, ", "), info.Certificates.Date)
+	if !slices.Contains(info.Certificates.Generations, "2023") {
+		fmt.Fprintf(&b, "%-16sThe 2023 Microsoft CAs are not embedded\n", "")
+	}
+	for _, c := range info.Certificates.Certificates {
+		fmt.Fprintf(&b, "%-16s%s %s: %s (%s)\n", "", c.Vendor, c.Variable, c.Name, c.Date)
+	}
+	for _, f := range info.Features {
+		fmt.Fprintf(&b, "%-16s%s\n", versionFeatureNames[f.Name]+":", f)
+	}
+	return b.String()
+}
+
 func init() {
+	rootCmd.Version = sbctl.Version
+	cobra.AddTemplateFunc("sbctlVersion", versionOutput)
+	rootCmd.SetVersionTemplate("{{sbctlVersion}}")
 	CliCommands = append(CliCommands, cliCommand{
 		Cmd: versionCmd,
 	})
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/sbctl"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/lsm"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+
+	yaml "github.com/goccy/go-yaml"
+)
+
+type WatchCmdOptions struct {
+	Interval time.Duration
+}
+
+type WatchEvent struct {
+	Time     time.Time `json:"time"`
+	Variable string    `json:"variable"`
+	// Set for SecureBoot and SetupMode
+	Old string `json:"old,omitempty"`
+	New string `json:"new,omitempty"`
+	// Set for the signature databases
+	Diff *sbctl.SignatureDiff `json:"diff,omitempty"`
+}
+
+type watchSnapshot struct {
+	SecureBoot bool
+	SetupMode  bool
+	vars       *sbctl.EFIVariables
+}
+
+var (
+	watchCmdOptions = WatchCmdOptions{}
+	watchCmd        = &cobra.Command{
+		Use:   "watch",
+		Short: "Print an event when the Secure Boot state or the enrolled keys change",
+		RunE:  RunWatch,
+	}
+	// Events are written here, replaced in tests
+	watchOutput io.Writer = os.Stdout
+)
+
+func enabledString(b bool) string {
+	if b {
+		return "enabled"
+	}
+	return "disabled"
+}
+
+func takeWatchSnapshot(state *config.State) (*watchSnapshot, error) {
+	vars, err := sbctl.SystemEFIVariables(state.Efivarfs)
+	if err != nil {
+		return nil, fmt.Errorf("can't read efivariables: %w", err)
+	}
+	s := &watchSnapshot{vars: vars}
+	s.SecureBoot, _ = state.Efivarfs.GetSecureBoot()
+	s.SetupMode, _ = state.Efivarfs.GetSetupMode()
+	return s, nil
+}
+
+// watchEvents returns the changes between two snapshots
+func watchEvents(now time.Time, old, cur *watchSnapshot) []WatchEvent {
+	var events []WatchEvent
+	for _, b := range []struct {
+		name     string
+		old, cur bool
+	}{
+		{"SecureBoot", old.SecureBoot, cur.SecureBoot},
+		{"SetupMode", old.SetupMode, cur.SetupMode},
+	} {
+		if b.old != b.cur {
+			events = append(events, WatchEvent{Time: now, Variable: b.name, Old: enabledString(b.old), New: enabledString(b.cur)})
+		}
+	}
+	for _, db := range []struct {
+		name     string
+		old, cur *signature.SignatureDatabase
+	}{
+		{"PK", old.vars.PK, cur.vars.PK},
+		{"KEK", old.vars.KEK, cur.vars.KEK},
+		{"db", old.vars.Db, cur.vars.Db},
+		{"dbx", old.vars.Dbx, cur.vars.Dbx},
+	} {
+		if diff := sbctl.DiffSignatureDatabase(db.old, db.cur); diff.HasChanges() {
+			events = append(events, WatchEvent{Time: now, Variable: db.name, Diff: diff})
+		}
+	}
+	return events
+}
+
+func printWatchEvent(e WatchEvent) error {
+	switch {
+	case cmdOptions.JsonOutput:
+		// One object per line so the output can be streamed
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(watchOutput, "%s\n", b)
+		return err
+	case cmdOptions.YamlOutput:
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if b, err = yaml.JSONToYAML(b); err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(watchOutput, "---\n%s", b)
+		return err
+	}
+	ts := e.Time.Format(time.RFC3339)
+	if e.Diff != nil {
+		_, err := fmt.Fprintf(watchOutput, "%s %s: %d added, %d removed\n", ts, e.Variable, len(e.Diff.Added), len(e.Diff.Removed))
+		return err
+	}
+	_, err := fmt.Fprintf(watchOutput, "%s %s: %s -> %s\n", ts, e.Variable, e.Old, e.New)
+	return err
+}
+
+// watchInotify wakes the watch loop when a file in efivarfs changes. EFI
+// variables changed by the firmware itself don't generate any events, which
+// is why we keep polling.
+func watchInotify(ctx context.Context, state *config.State) <-chan struct{} {
+	if _, ok := state.Fs.(*afero.OsFs); !ok {
+		return nil
+	}
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		slog.Debug("inotify is not available", slog.Any("err", err))
+		return nil
+	}
+	dir := "/sys/firmware/efi/efivars"
+	if cmdOptions.EfivarfsPath != "" {
+		dir = cmdOptions.EfivarfsPath
+	}
+	if _, err := unix.InotifyAddWatch(fd, dir, unix.IN_CLOSE_WRITE|unix.IN_CREATE|unix.IN_DELETE|unix.IN_MODIFY); err != nil {
+		slog.Debug("can't watch efivarfs", slog.Any("err", err))
+		unix.Close(fd)
+		return nil
+	}
+	ch := make(chan struct{}, 1)
+	go func() {
+		<-ctx.Done()
+		unix.Close(fd)
+	}()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			if _, err := unix.Read(fd, buf); err != nil {
+				return
+			}
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return ch
+}
+
+func Watch(ctx context.Context, state *config.State, interval time.Duration) error {
+	last, err := takeWatchSnapshot(state)
+	if err != nil {
+		return err
+	}
+	notify := watchInotify(ctx, state)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case <-notify:
+		}
+		cur, err := takeWatchSnapshot(state)
+		if err != nil {
+			return err
+		}
+		for _, e := range watchEvents(time.Now(), last, cur) {
+			if err := printWatchEvent(e); err != nil {
+				return err
+			}
+		}
+		last = cur
+	}
+}
+
+func RunWatch(cmd *cobra.Command, args []string) error {
+	state := cmd.Context().Value(stateDataKey{}).(*config.State)
+	if watchCmdOptions.Interval <= 0 {
+		return fmt.Errorf("--interval needs to be positive")
+	}
+	if state.Config.Landlock {
+		if err := lsm.Restrict(); err != nil {
+			return err
+		}
+	}
+	ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return Watch(ctx, state, watchCmdOptions.Interval)
+}
+
+func watchCmdFlags(cmd *cobra.Command) {
+	f := cmd.Flags()
+	f.DurationVarP(&watchCmdOptions.Interval, "interval", "", 5*time.Second, "how often the EFI variables are read")
+}
+
+func init() {
+	watchCmdFlags(watchCmd)
+	CliCommands = append(CliCommands, cliCommand{
+		Cmd:      watchCmd,
+		Efivarfs: true,
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWatchEvents(t *testing.T) {
+	state := setupEnrollState(t)
+
+	old, err := takeWatchSnapshot(state)
+	if err != nil {
+		t.Fatalf("failed reading snapshot: %v", err)
+	}
+	if err := SetupInstallation(state); err != nil {
+		t.Fatalf("failed running SetupInstallation: %v", err)
+	}
+	cur, err := takeWatchSnapshot(state)
+	if err != nil {
+		t.Fatalf("failed reading snapshot: %v", err)
+	}
+
+	if events := watchEvents(time.Now(), cur, cur); len(events) != 0 {
+		t.Fatalf("expected no events, got %+v", events)
+	}
+
+	events := watchEvents(time.Now(), old, cur)
+	var vars []string
+	for _, e := range events {
+		vars = append(vars, e.Variable)
+		if e.Diff == nil || len(e.Diff.Added) != 1 {
+			t.Fatalf("expected one added certificate for %s: %+v", e.Variable, e.Diff)
+		}
+	}
+	if len(vars) != 3 || vars[0] != "PK" || vars[1] != "KEK" || vars[2] != "db" {
+		t.Fatalf("unexpected events: %v", vars)
+	}
+}
+
+func TestPrintWatchEventJson(t *testing.T) {
+	var buf bytes.Buffer
+	watchOutput = &buf
+	cmdOptions.JsonOutput = true
+	defer func() {
+		watchOutput = os.Stdout
+		cmdOptions.JsonOutput = false
+	}()
+
+	e := WatchEvent{Time: time.Unix(0, 0).UTC(), Variable: "SetupMode", Old: "disabled", New: "enabled"}
+	if err := printWatchEvent(e); err != nil {
+		t.Fatal(err)
+	}
+	var out WatchEvent
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatalf("invalid json line %q: %v", buf.String(), err)
+	}
+	if out != e {
+		t.Fatalf("unexpected event: %+v", out)
+	}
+}
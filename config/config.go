@@ -3,9 +3,11 @@ package config
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/foxboron/sbctl/fs"
 	"github.com/landlock-lsm/go-landlock/landlock"
@@ -32,7 +34,50 @@ type KeyConfig struct {
 	Privkey     string `json:"privkey"`
 	Pubkey      string `json:"pubkey"`
 	Type        string `json:"type"`
+	Algorithm   string `json:"algorithm,omitempty"`
 	Description string `json:"description,omitempty"`
+	// PCRs the private key is sealed to, for tpm-sealed keys
+	PCRs []uint `json:"pcrs,omitempty"`
+}
+
+// PCRPolicyConfig is the key systemd-measure signs the PCR policy of unified
+// kernel images with
+type PCRPolicyConfig struct {
+	Privkey string `json:"privkey"`
+	Pubkey  string `json:"pubkey,omitempty"`
+	// "tpm" for a key held by the TPM, created with sbctl tpm
+	// create-policy-key, or "file" for a PEM private key. Defaults to "tpm".
+	Type string `json:"type,omitempty"`
+	// PCR banks to sign a policy for, systemd-measure defaults to sha256
+	Banks []string `json:"banks,omitempty"`
+}
+
+// Types of the pcr_policy key
+const (
+	PCRPolicyTPM  = "tpm"
+	PCRPolicyFile = "file"
+)
+
+// KeyType returns the type of the key, a TPM key if none is set
+func (p *PCRPolicyConfig) KeyType() string {
+	if p.Type == "" {
+		return PCRPolicyTPM
+	}
+	return p.Type
+}
+
+// HooksConfig are shell commands run around signing files and writing EFI
+// variables
+type HooksConfig struct {
+	PreSign    []string `json:"pre_sign,omitempty"`
+	PostSign   []string `json:"post_sign,omitempty"`
+	PreEnroll  []string `json:"pre_enroll,omitempty"`
+	PostEnroll []string `json:"post_enroll,omitempty"`
+}
+
+// Configured returns true if any hook commands are set
+func (h *HooksConfig) Configured() bool {
+	return h != nil && len(h.PreSign)+len(h.PostSign)+len(h.PreEnroll)+len(h.PostEnroll) != 0
 }
 
 type Keys struct {
@@ -60,9 +105,55 @@ type Config struct {
 	DbAdditions []string      `json:"db_additions,omitempty"`
 	Files       []*FileConfig `json:"files,omitempty"`
 	Keys        *Keys         `json:"keys"`
+	// Path to the PKCS#11 module used for --token
+	PKCS11Module string `json:"pkcs11_module,omitempty"`
+	// Directory containing the key directories of the profiles
+	ProfilesDir string `json:"profiles_dir"`
+	// Mountpoint of the EFI system partition, detected when unset
+	ESPMountpoint string `json:"esp_mountpoint,omitempty"`
+	// Key for sign --uki to sign the PCR policy of unified kernel images
+	PCRPolicy *PCRPolicyConfig `json:"pcr_policy,omitempty"`
+	// Number of times a write to an EFI variable is retried when the firmware
+	// is busy, and the delay before the first retry. The delay doubles for
+	// every retry.
+	EfivarRetries int    `json:"efivar_retries"`
+	EfivarBackoff string `json:"efivar_backoff"`
+	// Directories landlock allows reading and writing in addition to the
+	// paths sbctl uses
+	LandlockExtraPaths []string `json:"landlock_extra_paths,omitempty"`
+	// URL of the RFC 3161 TSA signatures are timestamped with
+	TimestampURL string `json:"timestamp_url,omitempty"`
+	// Kernel command line of the bundles saved without their own
+	CmdlineFile string `json:"cmdline_file"`
+	// Signature owner of the enrolled sbctl certificates, used instead of
+	// the GUID file when set
+	OwnerGUID string `json:"owner_guid,omitempty"`
+	// Digest algorithm of authenticode signatures, sha256 when unset
+	HashAlgo string `json:"hash_algo,omitempty"`
+	// Recompute the PE checksum of the images when signing them
+	FixPEChecksum bool `json:"fix_pe_checksum,omitempty"`
+	// IPE policy regenerated with the digests of the tracked files when they
+	// are signed
+	IPEPolicy string `json:"ipe_policy,omitempty"`
+	// Commands run before and after signing files and enrolling keys
+	Hooks *HooksConfig `json:"hooks,omitempty"`
+	// File the status is written to after commands which read or change the
+	// state, for monitoring agents
+	StatusFile string `json:"status_file,omitempty"`
+
+	// Key directory from the configuration file, before any profile or
+	// --keydir override
+	configKeydir string
 }
 
 func (c *Config) GetGUID(vfs afero.Fs) (*util.EFIGUID, error) {
+	if c.OwnerGUID != "" {
+		u, err := uuid.Parse(c.OwnerGUID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid owner_guid: %w", err)
+		}
+		return util.StringToGUID(u.String()), nil
+	}
 	b, err := fs.ReadFile(vfs, c.GUID)
 	if err != nil {
 		return nil, err
@@ -77,11 +168,16 @@ func (c *Config) GetGUID(vfs afero.Fs) (*util.EFIGUID, error) {
 
 func MkConfig(dir string) *Config {
 	conf := &Config{
-		Landlock:  true,
-		GUID:      path.Join(dir, "GUID"),
-		Keydir:    path.Join(dir, "keys"),
-		FilesDb:   path.Join(dir, "files.json"),
-		BundlesDb: path.Join(dir, "bundles.json"),
+		Landlock:    true,
+		GUID:        path.Join(dir, "GUID"),
+		Keydir:      path.Join(dir, "keys"),
+		FilesDb:     path.Join(dir, "files.json"),
+		BundlesDb:   path.Join(dir, "bundles.json"),
+		ProfilesDir: path.Join(dir, "profiles"),
+		CmdlineFile: "/etc/kernel/cmdline",
+		// Writing a large db can take the firmware a while
+		EfivarRetries: 3,
+		EfivarBackoff: "100ms",
 	}
 	conf.Keys = &Keys{
 		PK: &KeyConfig{
@@ -103,6 +199,50 @@ func MkConfig(dir string) *Config {
 	return conf
 }
 
+// SetKeydir points the configuration at another key directory. Key paths
+// inside the previous key directory are moved along with it.
+func (c *Config) SetKeydir(dir string) {
+	old := path.Clean(c.Keydir)
+	dir = path.Clean(dir)
+	if c.Keys != nil {
+		for _, kc := range c.Keys.GetKeysConfigs() {
+			if kc == nil {
+				continue
+			}
+			if rel, ok := strings.CutPrefix(kc.Privkey, old+"/"); ok {
+				kc.Privkey = path.Join(dir, rel)
+			}
+			if rel, ok := strings.CutPrefix(kc.Pubkey, old+"/"); ok {
+				kc.Pubkey = path.Join(dir, rel)
+			}
+		}
+	}
+	if c.configKeydir == "" {
+		c.configKeydir = c.Keydir
+	}
+	c.Keydir = dir
+}
+
+// ConfigKeydir returns the key directory of the configuration file
+func (c *Config) ConfigKeydir() string {
+	if c.configKeydir == "" {
+		return c.Keydir
+	}
+	return c.configKeydir
+}
+
+// EfivarBackoffDuration parses efivar_backoff
+func (c *Config) EfivarBackoffDuration() (time.Duration, error) {
+	d, err := time.ParseDuration(c.EfivarBackoff)
+	if err != nil {
+		return 0, fmt.Errorf("invalid efivar_backoff: %w", err)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("efivar_backoff can't be negative")
+	}
+	return d, nil
+}
+
 func DefaultConfig() *Config {
 	return MkConfig("/var/lib/sbctl")
 }
@@ -125,8 +265,21 @@ func HasConfigurationFile(fs afero.Fs, file string) bool {
 	return !os.IsNotExist(err)
 }
 
+// NewConfig parses the configuration, detecting if it is YAML or TOML from
+// the content
 func NewConfig(b []byte) (*Config, error) {
+	return NewConfigFormat(b, DetectFormat("", b))
+}
+
+// NewConfigFormat parses the configuration in format
+func NewConfigFormat(b []byte, format Format) (*Config, error) {
 	conf := DefaultConfig()
+	if format == FormatTOML {
+		if err := UnmarshalTOML(b, conf, false); err != nil {
+			return nil, err
+		}
+		return conf, nil
+	}
 	if err := yaml.Unmarshal(b, conf); err != nil {
 		return nil, err
 	}
@@ -139,6 +292,8 @@ type State struct {
 	TPM      func() transport.TPMCloser
 	Config   *Config
 	Efivarfs *efivarfs.Efivarfs
+	// Passphrase of encrypted keys. With confirm it's for a new key.
+	Passphrase func(confirm bool) ([]byte, error)
 }
 
 func (s *State) IsInstalled() bool {
@@ -148,8 +303,9 @@ func (s *State) IsInstalled() bool {
 	return true
 }
 
+// HasTPM is true when a TPM could be opened
 func (s *State) HasTPM() bool {
-	return s.TPM != nil
+	return s.TPM != nil && s.TPM() != nil
 }
 
 func (s *State) HasLandlock() bool {
@@ -1,8 +1,12 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"reflect"
 	"testing"
+
+	"github.com/spf13/afero"
 )
 
 var conf = `
@@ -39,3 +43,53 @@ func TestParseConfig(t *testing.T) {
 	}
 	fmt.Println(conf.Keys.PK)
 }
+
+func TestSetKeydir(t *testing.T) {
+	conf := DefaultConfig()
+	conf.SetKeydir("/srv/keys/nas/")
+	if conf.Keydir != "/srv/keys/nas" {
+		t.Fatalf("unexpected keydir: %s", conf.Keydir)
+	}
+	if conf.Keys.PK.Privkey != "/srv/keys/nas/PK/PK.key" || conf.Keys.Db.Pubkey != "/srv/keys/nas/db/db.pem" {
+		t.Fatalf("key paths were not moved: %+v %+v", conf.Keys.PK, conf.Keys.Db)
+	}
+	if conf.ConfigKeydir() != "/var/lib/sbctl/keys" {
+		t.Fatalf("unexpected configuration keydir: %s", conf.ConfigKeydir())
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	vfs := afero.NewMemMapFs()
+	conf := DefaultConfig()
+
+	if err := conf.SetActiveProfile(vfs, "../keys"); !errors.Is(err, ErrInvalidProfile) {
+		t.Fatalf("expected ErrInvalidProfile, got %v", err)
+	}
+	if err := conf.SetActiveProfile(vfs, "nas"); err != nil {
+		t.Fatalf("failed setting profile: %v", err)
+	}
+	if err := vfs.MkdirAll("/var/lib/sbctl/profiles/nas", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	profiles, err := conf.ListProfiles(vfs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(profiles, []string{DefaultProfile, "nas"}) {
+		t.Fatalf("unexpected profiles: %v", profiles)
+	}
+
+	if err := conf.UseActiveProfile(vfs); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Keydir != "/var/lib/sbctl/profiles/nas" {
+		t.Fatalf("unexpected keydir: %s", conf.Keydir)
+	}
+
+	if err := conf.SetActiveProfile(vfs, DefaultProfile); err != nil {
+		t.Fatal(err)
+	}
+	if name, _ := conf.ActiveProfile(vfs); name != DefaultProfile {
+		t.Fatalf("expected default profile, got %s", name)
+	}
+}
@@ -0,0 +1,100 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/foxboron/sbctl/fs"
+	"github.com/spf13/afero"
+)
+
+// DefaultProfile is the key directory from the configuration file
+const DefaultProfile = "default"
+
+var ErrInvalidProfile = errors.New("invalid profile name")
+
+// activeProfileFile stores the name of the profile in use
+func (c *Config) activeProfileFile() string {
+	return path.Join(c.ProfilesDir, ".active")
+}
+
+// ProfileKeydir returns the key directory of the named profile
+func (c *Config) ProfileKeydir(name string) (string, error) {
+	if name == "" || name == DefaultProfile || strings.HasPrefix(name, ".") || strings.ContainsRune(name, '/') {
+		return "", fmt.Errorf("%w: %q", ErrInvalidProfile, name)
+	}
+	return path.Join(c.ProfilesDir, name), nil
+}
+
+// ActiveProfile returns the name of the profile in use
+func (c *Config) ActiveProfile(vfs afero.Fs) (string, error) {
+	b, err := fs.ReadFile(vfs, c.activeProfileFile())
+	if errors.Is(err, os.ErrNotExist) {
+		return DefaultProfile, nil
+	} else if err != nil {
+		return "", err
+	}
+	name := strings.TrimSpace(string(b))
+	if name == "" {
+		return DefaultProfile, nil
+	}
+	return name, nil
+}
+
+// SetActiveProfile switches the profile used by later invocations
+func (c *Config) SetActiveProfile(vfs afero.Fs, name string) error {
+	if name == DefaultProfile {
+		if err := vfs.Remove(c.activeProfileFile()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	if _, err := c.ProfileKeydir(name); err != nil {
+		return err
+	}
+	if err := vfs.MkdirAll(c.ProfilesDir, os.ModePerm); err != nil {
+		return err
+	}
+	return fs.WriteFile(vfs, c.activeProfileFile(), []byte(name+"\n"), 0o644)
+}
+
+// ListProfiles returns the profiles in the profiles directory, including the
+// default profile
+func (c *Config) ListProfiles(vfs afero.Fs) ([]string, error) {
+	profiles := []string{DefaultProfile}
+	entries, err := afero.ReadDir(vfs, c.ProfilesDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return profiles, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") || e.Name() == DefaultProfile {
+			continue
+		}
+		profiles = append(profiles, e.Name())
+	}
+	slices.Sort(profiles[1:])
+	return profiles, nil
+}
+
+// UseActiveProfile points the key directory at the active profile
+func (c *Config) UseActiveProfile(vfs afero.Fs) error {
+	name, err := c.ActiveProfile(vfs)
+	if err != nil {
+		return err
+	}
+	if name == DefaultProfile {
+		return nil
+	}
+	keydir, err := c.ProfileKeydir(name)
+	if err != nil {
+		return err
+	}
+	c.SetKeydir(keydir)
+	return nil
+}
@@ -0,0 +1,122 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Format is the format of a configuration file
+type Format string
+
+const (
+	FormatYAML Format = "yaml"
+	FormatTOML Format = "toml"
+)
+
+// tomlKeyValue matches the start of a TOML key/value pair, which YAML writes
+// as "key: value"
+var tomlKeyValue = regexp.MustCompile(`^(?:[A-Za-z0-9_-]+|"[^"]*"|'[^']*')(?:\s*\.\s*(?:[A-Za-z0-9_-]+|"[^"]*"|'[^']*'))*\s*=`)
+
+// DetectFormat returns the format of a configuration file, from the .toml,
+// .yaml and .yml extensions of name or else from the first line of b which
+// isn't a comment. Files which don't start with a TOML table or key/value
+// pair are YAML.
+func DetectFormat(name string, b []byte) Format {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".toml":
+		return FormatTOML
+	case ".yaml", ".yml":
+		return FormatYAML
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") || tomlKeyValue.MatchString(line) {
+			return FormatTOML
+		}
+		return FormatYAML
+	}
+	return FormatYAML
+}
+
+// DecodeTOML parses a TOML document into maps, the way encoding/json decodes
+// into map[string]any. Integers are int64 and arrays of tables are
+// []map[string]any.
+func DecodeTOML(b []byte) (map[string]any, error) {
+	m := map[string]any{}
+	if err := toml.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// UnmarshalTOML parses a TOML document into v through the json tags of v
+func UnmarshalTOML(b []byte, v any, strict bool) error {
+	m, err := DecodeTOML(b)
+	if err != nil {
+		return err
+	}
+	j, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(j))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("toml: %w", err)
+	}
+	return nil
+}
+
+// EncodeTOML writes maps decoded by DecodeTOML or encoding/json as a TOML
+// document. Nil values are left out, as TOML has no null.
+func EncodeTOML(m map[string]any) ([]byte, error) {
+	var b bytes.Buffer
+	enc := toml.NewEncoder(&b)
+	enc.Indent = ""
+	if err := enc.Encode(tomlIntegers(m)); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// tomlIntegers turns the numbers decoded by encoding/json back into integers,
+// which are all floats
+func tomlIntegers(v any) any {
+	switch v := v.(type) {
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return int64(v)
+		}
+	case map[string]any:
+		m := make(map[string]any, len(v))
+		for k, e := range v {
+			m[k] = tomlIntegers(e)
+		}
+		return m
+	case []map[string]any:
+		a := make([]map[string]any, len(v))
+		for i, e := range v {
+			a[i] = tomlIntegers(e).(map[string]any)
+		}
+		return a
+	case []any:
+		a := make([]any, len(v))
+		for i, e := range v {
+			a[i] = tomlIntegers(e)
+		}
+		return a
+	}
+	return v
+}
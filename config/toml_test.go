@@ -0,0 +1,131 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+var tomlConf = `
+# sbctl configuration
+keydir = "/etc/sbctl/keys"
+guid = '/var/lib/sbctl/GUID'
+landlock = false
+efivar_retries = 3
+db_additions = [
+  "microsoft", # for the GPU
+]
+
+[[files]]
+path = "/boot/vmlinuz-linux-lts"
+
+[[files]]
+path = "/usr/lib/fwupd/efi/fwupdx64.efi"
+output = "/usr/lib/fwupd/efi/fwupdx64.efi.signed"
+
+[keys.pk]
+privkey = "/etc/sbctl/keys/PK/PK.key"
+pubkey = "/etc/sbctl/keys/PK/PK.pem"
+type = "file"
+
+[keys.db]
+type = "tpm"
+pcrs = [0, 7]
+`
+
+func TestDetectFormat(t *testing.T) {
+	for _, c := range []struct {
+		name, conf string
+		format     Format
+	}{
+		{"/etc/sbctl/sbctl.conf", conf, FormatYAML},
+		{"/etc/sbctl/sbctl.conf", tomlConf, FormatTOML},
+		{"/etc/sbctl/sbctl.conf", "[keys.db]\ntype = \"file\"\n", FormatTOML},
+		{"/etc/sbctl/sbctl.conf", "keydir: /etc/sbctl/keys # a=b\n", FormatYAML},
+		{"/etc/sbctl/sbctl.conf", "", FormatYAML},
+		{"/etc/sbctl/sbctl.toml", "", FormatTOML},
+		{"/etc/sbctl/sbctl.yaml", tomlConf, FormatYAML},
+	} {
+		if format := DetectFormat(c.name, []byte(c.conf)); format != c.format {
+			t.Fatalf("expected %s for %s %q, got %s", c.format, c.name, c.conf, format)
+		}
+	}
+}
+
+func TestParseTOMLConfig(t *testing.T) {
+	conf, err := NewConfig([]byte(tomlConf))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if conf.Keydir != "/etc/sbctl/keys" || conf.GUID != "/var/lib/sbctl/GUID" || conf.Landlock || conf.EfivarRetries != 3 {
+		t.Fatalf("unexpected values: %+v", conf)
+	}
+	if !reflect.DeepEqual(conf.DbAdditions, []string{"microsoft"}) {
+		t.Fatalf("unexpected db_additions: %v", conf.DbAdditions)
+	}
+	if len(conf.Files) != 2 || conf.Files[1].Output != "/usr/lib/fwupd/efi/fwupdx64.efi.signed" {
+		t.Fatalf("unexpected files: %+v", conf.Files)
+	}
+	if conf.Keys.PK.Privkey != "/etc/sbctl/keys/PK/PK.key" || conf.Keys.Db.Type != "tpm" || !reflect.DeepEqual(conf.Keys.Db.PCRs, []uint{0, 7}) {
+		t.Fatalf("unexpected keys: %+v %+v", conf.Keys.PK, conf.Keys.Db)
+	}
+	// Tables missing in the file keep their defaults
+	if conf.Keys.KEK.Pubkey != "/var/lib/sbctl/keys/KEK/KEK.pem" {
+		t.Fatalf("unexpected KEK: %+v", conf.Keys.KEK)
+	}
+
+	for _, invalid := range []string{
+		"keydir = ",
+		"keydir = \"/etc\nguid = \"/var\"",
+		"keydir = \"a\"\nkeydir = \"b\"",
+		"[keys]\n[keys]",
+		"landlock = yes",
+	} {
+		if _, err := NewConfigFormat([]byte(invalid), FormatTOML); err == nil {
+			t.Fatalf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestParseTOMLConfigSpec(t *testing.T) {
+	// Valid TOML sbctl doesn't write itself, as config management tools do
+	conf, err := NewConfigFormat([]byte(`
+keydir = """
+/etc/sbctl/keys"""
+generated = 2024-10-01T12:00:00Z
+
+[keys.db]
+type = 'tpm'
+`), FormatTOML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.Keydir != "/etc/sbctl/keys" || conf.Keys.Db.Type != "tpm" {
+		t.Fatalf("unexpected values: %+v", conf)
+	}
+}
+
+func TestEncodeTOML(t *testing.T) {
+	m, err := DecodeTOML([]byte(tomlConf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := EncodeTOML(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeTOML(b)
+	if err != nil {
+		t.Fatalf("failed decoding\n%s\n%v", b, err)
+	}
+	if !reflect.DeepEqual(m, decoded) {
+		t.Fatalf("values changed after encoding:\n%s", b)
+	}
+
+	b, err = EncodeTOML(map[string]any{"a b": "\"quoted\"\n", "n": float64(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "\"a b\" = \"\\\"quoted\\\"\\n\"\nn = 2\n" {
+		t.Fatalf("unexpected encoding %q", b)
+	}
+}
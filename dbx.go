@@ -0,0 +1,227 @@
+package sbctl
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	_ "embed"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/foxboron/go-uefi/efi/attributes"
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efi/util"
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/foxboron/go-uefi/efivarfs"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/spf13/afero"
+)
+
+// BundledDbxUpdate is the x64 revocation list published by the UEFI forum
+// which is embedded into sbctl. The bootchain is checked against it unless
+// another update is given.
+const BundledDbxUpdate = "dbxupdate_x64-2021-04-29.bin"
+
+//go:embed dbx/dbxupdate_x64-2021-04-29.bin
+var bundledDbxUpdate []byte
+
+var (
+	ErrNoRunningBootloader = errors.New("couldn't determine the running bootloader")
+
+	// LoaderImageIdentifier is set by systemd-boot to the ESP relative path of
+	// its own image.
+	LoaderImageIdentifier = efivar.Efivar{
+		Name:       "LoaderImageIdentifier",
+		GUID:       util.StringToGUID("4a67b082-0a4c-41cf-b6c7-440b29bb8c4f"),
+		Attributes: attributes.EFI_VARIABLE_BOOTSERVICE_ACCESS | attributes.EFI_VARIABLE_RUNTIME_ACCESS,
+	}
+
+	// ESP relative locations of shims and bootloaders
+	bootchainGlobs = []string{
+		"EFI/BOOT/BOOT*.EFI",
+		"EFI/BOOT/boot*.efi",
+		"EFI/*/shim*.efi",
+		"EFI/*/grub*.efi",
+		"EFI/systemd/systemd-boot*.efi",
+		"EFI/Microsoft/Boot/bootmgfw.efi",
+	}
+)
+
+type DbxEntry struct {
+	Type  string `json:"type"`
+	Owner string `json:"owner"`
+	Value string `json:"value"`
+}
+
+func dbxEntry(certtype util.EFIGUID, sig signature.SignatureData) DbxEntry {
+	entry := DbxEntry{Owner: sig.Owner.Format()}
+	switch certtype {
+	case signature.CERT_SHA256_GUID:
+		entry.Type = "SHA256"
+		entry.Value = hex.EncodeToString(sig.Data)
+	case signature.CERT_X509_GUID:
+		entry.Type = "X509"
+		if cert, err := x509.ParseCertificate(sig.Data); err == nil {
+			entry.Value = cert.Subject.String()
+		} else {
+			entry.Value = hex.EncodeToString(sig.Data)
+		}
+	default:
+		entry.Type = certtype.Format()
+		entry.Value = hex.EncodeToString(sig.Data)
+	}
+	return entry
+}
+
+// ListDbx returns all entries in a dbx signature database
+func ListDbx(db *signature.SignatureDatabase) []DbxEntry {
+	entries := []DbxEntry{}
+	for _, list := range *db {
+		for _, sig := range list.Signatures {
+			entries = append(entries, dbxEntry(list.SignatureType, sig))
+		}
+	}
+	return entries
+}
+
+// isAuthenticatedVariable checks if b starts with an EFI_VARIABLE_AUTHENTICATION_2
+// header, which is how revocation lists are usually distributed.
+func isAuthenticatedVariable(b []byte) (int, bool) {
+	// EFI_TIME followed by the WIN_CERTIFICATE header
+	if len(b) < 16+signature.SizeofWINCertificate {
+		return 0, false
+	}
+	length := binary.LittleEndian.Uint32(b[16:20])
+	revision := binary.LittleEndian.Uint16(b[20:22])
+	certtype := signature.WINCertType(binary.LittleEndian.Uint16(b[22:24]))
+	if revision != signature.WIN_CERTIFICATE_REVISION || certtype != signature.WIN_CERT_TYPE_EFI_GUID {
+		return 0, false
+	}
+	if 16+int(length) > len(b) {
+		return 0, false
+	}
+	return 16 + int(length), true
+}
+
+// ReadDbxUpdate reads a revocation list from an EFI signature list file. Signed
+// updates have their authentication header stripped as we sign the update with
+// our own KEK.
+func ReadDbxUpdate(vfs afero.Fs, file string) (*signature.SignatureDatabase, error) {
+	b, err := fs.ReadFile(vfs, file)
+	if err != nil {
+		return nil, err
+	}
+	return parseDbxUpdate(file, b)
+}
+
+// ReadBundledDbxUpdate returns the revocation list of BundledDbxUpdate
+func ReadBundledDbxUpdate() (*signature.SignatureDatabase, error) {
+	return parseDbxUpdate(BundledDbxUpdate, bundledDbxUpdate)
+}
+
+func parseDbxUpdate(file string, b []byte) (*signature.SignatureDatabase, error) {
+	if offset, ok := isAuthenticatedVariable(b); ok {
+		b = b[offset:]
+	}
+	db, err := signature.ReadSignatureDatabase(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse %s as an EFI signature list: %w", file, err)
+	}
+	if len(db) == 0 {
+		return nil, fmt.Errorf("%s contains no signature lists", file)
+	}
+	return &db, nil
+}
+
+// MergeDbx appends the entries of update which are not already present in
+// current, and returns the added entries.
+func MergeDbx(current, update *signature.SignatureDatabase) ([]DbxEntry, error) {
+	added := []DbxEntry{}
+	for _, list := range *update {
+		for _, sig := range list.Signatures {
+			if current.SigDataExists(list.SignatureType, &sig) {
+				continue
+			}
+			if err := current.Append(list.SignatureType, sig.Owner, sig.Data); err != nil {
+				return nil, err
+			}
+			added = append(added, dbxEntry(list.SignatureType, sig))
+		}
+	}
+	return added, nil
+}
+
+// RevokedBy returns the entries in db that forbid the PE/COFF binary in r
+func RevokedBy(db *signature.SignatureDatabase, r io.ReaderAt) ([]DbxEntry, error) {
+	peBinary, err := authenticode.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+	digest := peBinary.Hash(crypto.SHA256)
+
+	revoked := []DbxEntry{}
+	for _, list := range *db {
+		for _, sig := range list.Signatures {
+			switch list.SignatureType {
+			case signature.CERT_SHA256_GUID:
+				if !bytes.Equal(sig.Data, digest) {
+					continue
+				}
+			case signature.CERT_X509_GUID:
+				cert, err := x509.ParseCertificate(sig.Data)
+				if err != nil {
+					continue
+				}
+				if ok, err := backend.VerifyPEBinary(peBinary, cert); err != nil || !ok {
+					continue
+				}
+			default:
+				continue
+			}
+			revoked = append(revoked, dbxEntry(list.SignatureType, sig))
+		}
+	}
+	return revoked, nil
+}
+
+// GetRunningBootloader returns the path of the bootloader image the system was
+// booted with, as reported by the bootloader.
+func GetRunningBootloader(ev *efivarfs.Efivarfs, esp string) (string, error) {
+	var id efivar.Efistring
+	if err := ev.GetVar(LoaderImageIdentifier, &id); err != nil {
+		return "", ErrNoRunningBootloader
+	}
+	p := strings.ReplaceAll(string(id), `\`, "/")
+	if p == "" {
+		return "", ErrNoRunningBootloader
+	}
+	return filepath.Join(esp, p), nil
+}
+
+// BootchainFiles returns the running bootloader along with the shims and
+// bootloaders found in the usual locations on the ESP
+func BootchainFiles(vfs afero.Fs, ev *efivarfs.Efivarfs, esp string) []string {
+	var files []string
+	if bootloader, err := GetRunningBootloader(ev, esp); err == nil {
+		if ok, _ := afero.Exists(vfs, bootloader); ok {
+			files = append(files, bootloader)
+		}
+	}
+	for _, glob := range bootchainGlobs {
+		matches, err := afero.Glob(vfs, filepath.Join(esp, glob))
+		if err != nil {
+			continue
+		}
+		files = append(files, matches...)
+	}
+	slices.Sort(files)
+	return slices.Compact(files)
+}
@@ -0,0 +1,96 @@
+package sbctl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efi/util"
+)
+
+type SignatureEntry struct {
+	Fingerprint string `json:"fingerprint"`
+	Type        string `json:"type"`
+	Owner       string `json:"owner"`
+	Description string `json:"description"`
+	data        []byte
+}
+
+type SignatureDiff struct {
+	Added   []SignatureEntry `json:"added"`
+	Removed []SignatureEntry `json:"removed"`
+}
+
+// HasChanges returns true if the databases differ
+func (d *SignatureDiff) HasChanges() bool {
+	return len(d.Added) != 0 || len(d.Removed) != 0
+}
+
+func signatureEntry(certtype util.EFIGUID, sig signature.SignatureData) SignatureEntry {
+	entry := SignatureEntry{
+		Owner: sig.Owner.Format(),
+		data:  sig.Data,
+	}
+	switch certtype {
+	case signature.CERT_X509_GUID:
+		sum := sha256.Sum256(sig.Data)
+		entry.Type = "X509"
+		entry.Fingerprint = hex.EncodeToString(sum[:])
+		if cert, err := x509.ParseCertificate(sig.Data); err == nil {
+			entry.Description = cert.Subject.String()
+		}
+	case signature.CERT_SHA256_GUID:
+		// The checksum is its own fingerprint
+		entry.Type = "SHA256"
+		entry.Fingerprint = hex.EncodeToString(sig.Data)
+	default:
+		sum := sha256.Sum256(sig.Data)
+		entry.Type = certtype.Format()
+		entry.Fingerprint = hex.EncodeToString(sum[:])
+	}
+	return entry
+}
+
+// SignatureEntries returns all the signatures in the database
+func SignatureEntries(db *signature.SignatureDatabase) []SignatureEntry {
+	entries := []SignatureEntry{}
+	for _, list := range *db {
+		for _, sig := range list.Signatures {
+			entries = append(entries, signatureEntry(list.SignatureType, sig))
+		}
+	}
+	return entries
+}
+
+func containsEntry(entries []SignatureEntry, e SignatureEntry) bool {
+	for _, entry := range entries {
+		if entry.Type == e.Type && bytes.Equal(entry.data, e.data) {
+			return true
+		}
+	}
+	return false
+}
+
+// DiffSignatureDatabase returns the signatures which would be added and
+// removed by replacing current with expected
+func DiffSignatureDatabase(current, expected *signature.SignatureDatabase) *SignatureDiff {
+	diff := &SignatureDiff{
+		Added:   []SignatureEntry{},
+		Removed: []SignatureEntry{},
+	}
+	currentEntries := SignatureEntries(current)
+	expectedEntries := SignatureEntries(expected)
+	for _, e := range expectedEntries {
+		if !containsEntry(currentEntries, e) {
+			diff.Added = append(diff.Added, e)
+		}
+	}
+	for _, e := range currentEntries {
+		if !containsEntry(expectedEntries, e) {
+			diff.Removed = append(diff.Removed, e)
+		}
+	}
+	return diff
+}
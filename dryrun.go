@@ -0,0 +1,76 @@
+package sbctl
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/foxboron/go-uefi/efi/attributes"
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/foxboron/go-uefi/efivarfs"
+)
+
+// PlannedWrite is a write to an EFI variable which was skipped by a dry run
+type PlannedWrite struct {
+	Variable string `json:"variable"`
+	GUID     string `json:"guid"`
+	// Attributes as a hex string, e.g. "0x27"
+	Attributes string `json:"attributes"`
+	Append     bool   `json:"append"`
+	// Size of the update in bytes, including the authentication header
+	Size int `json:"size"`
+	// Signed is set for authenticated variable updates
+	Signed bool `json:"signed"`
+	// Entries of the signature lists in the update
+	Entries []DbxEntry `json:"entries"`
+}
+
+// DryRun collects the writes to the EFI variables instead of writing them
+type DryRun struct {
+	Writes []PlannedWrite `json:"writes"`
+}
+
+// Add records the update b of the variable
+func (d *DryRun) Add(v efivar.Efivar, b []byte) {
+	w := PlannedWrite{
+		Variable:   v.Name,
+		Attributes: fmt.Sprintf("%#x", uint32(v.Attributes)),
+		Append:     v.Attributes&attributes.EFI_VARIABLE_APPEND_WRITE != 0,
+		Size:       len(b),
+		Entries:    []DbxEntry{},
+	}
+	if v.GUID != nil {
+		w.GUID = v.GUID.Format()
+	}
+	payload := b
+	if offset, ok := isAuthenticatedVariable(b); ok {
+		w.Signed = true
+		payload = b[offset:]
+	}
+	// Not every update is a signature database, those are only listed with
+	// their size
+	if db, err := signature.ReadSignatureDatabase(bytes.NewReader(payload)); err == nil {
+		w.Entries = ListDbx(&db)
+	}
+	d.Writes = append(d.Writes, w)
+}
+
+// dryRunEFIVars reads the variables but only records the writes
+type dryRunEFIVars struct {
+	efivarfs.EFIVars
+	plan *DryRun
+}
+
+func (d *dryRunEFIVars) WriteVar(v efivar.Efivar, m efivar.Marshallable) error {
+	var b bytes.Buffer
+	m.Marshal(&b)
+	d.plan.Add(v, b.Bytes())
+	return nil
+}
+
+// DryRunEfivarWrites returns e with every write recorded in the returned
+// DryRun instead of written to the firmware
+func DryRunEfivarWrites(e *efivarfs.Efivarfs) (*efivarfs.Efivarfs, *DryRun) {
+	plan := &DryRun{Writes: []PlannedWrite{}}
+	return efivarfs.Open(&dryRunEFIVars{EFIVars: e.EFIVars, plan: plan}), plan
+}
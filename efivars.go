@@ -0,0 +1,298 @@
+package sbctl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/foxboron/go-uefi/efi/attributes"
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/foxboron/go-uefi/efivarfs"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/logging"
+	"github.com/spf13/afero"
+)
+
+// EfivarfsAvailable returns false if the EFI variables can't be read, as
+// efivarfs isn't mounted or the system isn't booted with UEFI
+func EfivarfsAvailable(efifs *efivarfs.Efivarfs) bool {
+	_, err := efifs.GetSetupMode()
+	return !errors.Is(err, os.ErrNotExist)
+}
+
+// efivarsDirFs maps the efivarfs mountpoint to a directory, so the variables
+// can be read from a copy of efivarfs.
+type efivarsDirFs struct {
+	afero.Fs
+}
+
+func (e *efivarsDirFs) path(name string) string {
+	if rel, ok := strings.CutPrefix(filepath.Clean(name), attributes.Efivars); ok {
+		return "/" + rel
+	}
+	return name
+}
+
+func (e *efivarsDirFs) Name() string { return "efivarsDirFs" }
+
+func (e *efivarsDirFs) Create(name string) (afero.File, error) {
+	return e.Fs.Create(e.path(name))
+}
+
+func (e *efivarsDirFs) Mkdir(name string, perm os.FileMode) error {
+	return e.Fs.Mkdir(e.path(name), perm)
+}
+
+func (e *efivarsDirFs) MkdirAll(path string, perm os.FileMode) error {
+	return e.Fs.MkdirAll(e.path(path), perm)
+}
+
+func (e *efivarsDirFs) Open(name string) (afero.File, error) {
+	return e.Fs.Open(e.path(name))
+}
+
+// OpenFile truncates files opened for writing unless they are appended to, as
+// a write replaces the whole variable in efivarfs
+func (e *efivarsDirFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 && flag&os.O_APPEND == 0 {
+		flag |= os.O_TRUNC
+	}
+	return e.Fs.OpenFile(e.path(name), flag, perm)
+}
+
+func (e *efivarsDirFs) Remove(name string) error {
+	return e.Fs.Remove(e.path(name))
+}
+
+func (e *efivarsDirFs) RemoveAll(path string) error {
+	return e.Fs.RemoveAll(e.path(path))
+}
+
+func (e *efivarsDirFs) Rename(oldname, newname string) error {
+	return e.Fs.Rename(e.path(oldname), e.path(newname))
+}
+
+func (e *efivarsDirFs) Stat(name string) (os.FileInfo, error) {
+	return e.Fs.Stat(e.path(name))
+}
+
+func (e *efivarsDirFs) Chmod(name string, mode os.FileMode) error {
+	return e.Fs.Chmod(e.path(name), mode)
+}
+
+func (e *efivarsDirFs) Chown(name string, uid, gid int) error {
+	return e.Fs.Chown(e.path(name), uid, gid)
+}
+
+func (e *efivarsDirFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	return e.Fs.Chtimes(e.path(name), atime, mtime)
+}
+
+// OpenEfivarsDir returns an Efivarfs using the variables in dir instead of
+// /sys/firmware/efi/efivars. The files in dir are named like the files in
+// efivarfs. Immutable bits are left alone as they only exist on efivarfs.
+func OpenEfivarsDir(vfs afero.Fs, dir string) *efivarfs.Efivarfs {
+	fs := efivarfs.NewFS()
+	fs.SetFS(&shortWriteFs{&efivarsDirFs{afero.NewBasePathFs(vfs, dir)}})
+	return fs.Open()
+}
+
+// OpenEfivarfs returns the Efivarfs of /sys/firmware/efi/efivars, which
+// refuses to write to variables with the immutable bit set
+func OpenEfivarfs() *efivarfs.Efivarfs {
+	fs := efivarfs.NewFS().CheckImmutable()
+	fs.SetFS(&shortWriteFs{afero.NewOsFs()})
+	return fs.Open()
+}
+
+// shortWriteFs returns io.ErrShortWrite for writes to a variable which wrote
+// less than the whole update, so they can be retried
+type shortWriteFs struct {
+	afero.Fs
+}
+
+func (s *shortWriteFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	f, err := s.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &shortWriteFile{f}, nil
+}
+
+type shortWriteFile struct {
+	afero.File
+}
+
+func (f *shortWriteFile) Write(b []byte) (int, error) {
+	n, err := f.File.Write(b)
+	if err == nil && n != len(b) {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+// retryEFIVars retries writes to EFI variables which fail because the firmware
+// is busy or the write was cut short. SetVariable() either stores the whole
+// update or nothing, so the complete update is written again on every
+// attempt. The immutable bit is checked before every attempt.
+type retryEFIVars struct {
+	efivarfs.EFIVars
+	retries int
+	backoff time.Duration
+	sleep   func(time.Duration)
+}
+
+func retryableWrite(err error) bool {
+	return errors.Is(err, syscall.EBUSY) ||
+		errors.Is(err, syscall.EAGAIN) ||
+		errors.Is(err, syscall.EINTR) ||
+		errors.Is(err, io.ErrShortWrite)
+}
+
+func (r *retryEFIVars) WriteVar(v efivar.Efivar, m efivar.Marshallable) error {
+	// Every attempt writes the same update
+	var b bytes.Buffer
+	m.Marshal(&b)
+	update := signedUpdate(b.Bytes())
+
+	delay := r.backoff
+	attempts := 0
+	for {
+		attempts++
+		err := r.EFIVars.WriteVar(v, update)
+		if err == nil {
+			return nil
+		}
+		if !retryableWrite(err) {
+			return err
+		}
+		if attempts > r.retries {
+			return fmt.Errorf("failed writing %s after %d attempts: %w", v.Name, attempts, err)
+		}
+		slog.Debug("retrying efivar write", slog.String("var", v.Name), slog.Int("attempt", attempts), slog.Any("err", err))
+		r.sleep(delay)
+		delay *= 2
+	}
+}
+
+// RetryEfivarWrites retries the failed writes to the variables in e as
+// configured by efivar_retries and efivar_backoff
+func RetryEfivarWrites(e *efivarfs.Efivarfs, conf *config.Config) (*efivarfs.Efivarfs, error) {
+	backoff, err := conf.EfivarBackoffDuration()
+	if err != nil {
+		return nil, err
+	}
+	if conf.EfivarRetries < 0 {
+		return nil, fmt.Errorf("efivar_retries can't be negative")
+	}
+	return efivarfs.Open(&retryEFIVars{
+		EFIVars: e.EFIVars,
+		retries: conf.EfivarRetries,
+		backoff: backoff,
+		sleep:   time.Sleep,
+	}), nil
+}
+
+// chattrEFIVars clears the immutable attribute of a variable when the write is
+// refused because of it, and writes the variable once more
+type chattrEFIVars struct {
+	efivarfs.EFIVars
+	unsetImmutable func(string) error
+}
+
+func (c *chattrEFIVars) WriteVar(v efivar.Efivar, m efivar.Marshallable) error {
+	var b bytes.Buffer
+	m.Marshal(&b)
+	update := signedUpdate(b.Bytes())
+
+	err := c.EFIVars.WriteVar(v, update)
+	if !errors.Is(err, efivarfs.ErrImmutable) {
+		return err
+	}
+	file := filepath.Join(attributes.Efivars, fmt.Sprintf("%s-%s", v.Name, v.GUID.Format()))
+	if uerr := c.unsetImmutable(file); uerr != nil {
+		slog.Debug("couldn't unset the immutable attribute", slog.String("file", file), slog.Any("err", uerr))
+		return err
+	}
+	logging.Print("Cleared the immutable attribute of %s\n", file)
+	if rerr := c.EFIVars.WriteVar(v, update); rerr != nil {
+		slog.Debug("write failed after unsetting the immutable attribute", slog.String("var", v.Name), slog.Any("err", rerr))
+		return err
+	}
+	return nil
+}
+
+// ChattrEfivarWrites clears the immutable attribute of the variables in e
+// which can't be written because of it, and retries the write once. The
+// variables need to be opened with CheckImmutable to report the attribute.
+func ChattrEfivarWrites(e *efivarfs.Efivarfs) *efivarfs.Efivarfs {
+	return efivarfs.Open(&chattrEFIVars{
+		EFIVars:        e.EFIVars,
+		unsetImmutable: UnsetImmutableAttr,
+	})
+}
+
+// VariableAttributes are the attributes a variable was read back with
+type VariableAttributes struct {
+	Variable string `json:"variable"`
+	Exists   bool   `json:"exists"`
+	// Attributes as a hex string, e.g. "0x27"
+	Attributes string `json:"attributes,omitempty"`
+	// Authenticated is set if writes need a time based authenticated update
+	Authenticated bool `json:"authenticated"`
+	// AppendWrite is set if the firmware reports the append write attribute.
+	// It is a flag of the write, so most firmware doesn't keep it.
+	AppendWrite bool `json:"append_write"`
+	// Missing are the expected attributes the firmware didn't keep
+	Missing []string `json:"missing,omitempty"`
+}
+
+var attributeNames = []struct {
+	attr attributes.Attributes
+	name string
+}{
+	{attributes.EFI_VARIABLE_NON_VOLATILE, "NON_VOLATILE"},
+	{attributes.EFI_VARIABLE_BOOTSERVICE_ACCESS, "BOOTSERVICE_ACCESS"},
+	{attributes.EFI_VARIABLE_RUNTIME_ACCESS, "RUNTIME_ACCESS"},
+	{attributes.EFI_VARIABLE_TIME_BASED_AUTHENTICATED_WRITE_ACCESS, "TIME_BASED_AUTHENTICATED_WRITE_ACCESS"},
+	{attributes.EFI_VARIABLE_APPEND_WRITE, "APPEND_WRITE"},
+}
+
+// ReadVariableAttributes reads back the attributes of the variables, and
+// compares them with the attributes they are written with
+func ReadVariableAttributes(e *efivarfs.Efivarfs, vars ...efivar.Efivar) ([]VariableAttributes, error) {
+	results := []VariableAttributes{}
+	for _, v := range vars {
+		res := VariableAttributes{Variable: v.Name}
+		var sigdb signature.SignatureDatabase
+		attrs, err := e.GetVarWithAttributes(v, &sigdb)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			results = append(results, res)
+			continue
+		// The attributes are returned when they differ from the expected ones
+		case errors.Is(err, efivarfs.ErrIncorrectAttributes):
+		case err != nil:
+			return nil, fmt.Errorf("can't read %s: %w", v.Name, err)
+		}
+		res.Exists = true
+		res.Attributes = fmt.Sprintf("%#x", uint32(attrs))
+		res.Authenticated = attrs&attributes.EFI_VARIABLE_TIME_BASED_AUTHENTICATED_WRITE_ACCESS != 0
+		res.AppendWrite = attrs&attributes.EFI_VARIABLE_APPEND_WRITE != 0
+		for _, a := range attributeNames {
+			if v.Attributes&a.attr != 0 && attrs&a.attr == 0 {
+				res.Missing = append(res.Missing, a.name)
+			}
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
@@ -0,0 +1,237 @@
+package sbctl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/foxboron/go-uefi/efivarfs"
+	"github.com/foxboron/sbctl/config"
+	"github.com/spf13/afero"
+)
+
+func TestOpenEfivarsDir(t *testing.T) {
+	vfs := afero.NewMemMapFs()
+	ev := OpenEfivarsDir(vfs, "/tmp/efivars")
+
+	if _, err := ev.GetSetupMode(); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected a missing SetupMode variable, got %v", err)
+	}
+
+	// Attributes followed by the value
+	setupMode := []byte{0x06, 0x00, 0x00, 0x00, 0x01}
+	if err := afero.WriteFile(vfs, "/tmp/efivars/SetupMode-8be4df61-93ca-11d2-aa0d-00e098032b8c", setupMode, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ok, err := ev.GetSetupMode()
+	if err != nil {
+		t.Fatalf("failed reading SetupMode: %v", err)
+	}
+	if !ok {
+		t.Fatalf("expected setup mode to be enabled")
+	}
+}
+
+func TestEfivarsDirReplacesVariables(t *testing.T) {
+	vfs := afero.NewMemMapFs()
+	dir := &efivarsDirFs{afero.NewBasePathFs(vfs, "/efivars")}
+	write := func(flag int, b []byte) {
+		f, err := dir.OpenFile("db-d719b2cb-3d3a-4596-a3bc-dad00e67656f", flag, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A shorter write replaces the variable, an append write extends it
+	write(os.O_WRONLY|os.O_CREATE, []byte{0x07, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03})
+	write(os.O_WRONLY|os.O_CREATE, []byte{0x07, 0x00, 0x00, 0x00, 0x04})
+	write(os.O_WRONLY|os.O_APPEND, []byte{0x05})
+	b, err := afero.ReadFile(vfs, "/efivars/db-d719b2cb-3d3a-4596-a3bc-dad00e67656f")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != string([]byte{0x07, 0x00, 0x00, 0x00, 0x04, 0x05}) {
+		t.Fatalf("unexpected variable %x", b)
+	}
+}
+
+type busyEFIVars struct {
+	efivarfs.EFIVars
+	failures int
+	writes   int
+}
+
+func (b *busyEFIVars) WriteVar(v efivar.Efivar, m efivar.Marshallable) error {
+	b.writes++
+	if b.writes <= b.failures {
+		return &os.PathError{Op: "write", Path: v.Name, Err: syscall.EBUSY}
+	}
+	return b.EFIVars.WriteVar(v, m)
+}
+
+func TestRetryEfivarWrites(t *testing.T) {
+	conf := config.DefaultConfig()
+	conf.EfivarRetries = 2
+	busy := &busyEFIVars{EFIVars: OpenEfivarsDir(afero.NewMemMapFs(), "/efivars").EFIVars, failures: 2}
+	ev, err := RetryEfivarWrites(efivarfs.Open(busy), conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var delays []time.Duration
+	ev.EFIVars.(*retryEFIVars).sleep = func(d time.Duration) { delays = append(delays, d) }
+
+	if err := ev.WriteVar(efivar.Db, signedUpdate("update")); err != nil {
+		t.Fatalf("expected the write to succeed after retrying, got %v", err)
+	}
+	if busy.writes != 3 || len(delays) != 2 || delays[1] != 2*delays[0] {
+		t.Fatalf("unexpected retries: %d writes, delays %v", busy.writes, delays)
+	}
+	var raw rawVariable
+	if err := ev.GetVar(efivar.Db, &raw); err != nil || string(raw) != "update" {
+		t.Fatalf("unexpected variable contents %q: %v", raw, err)
+	}
+
+	busy.writes, busy.failures = 0, 3
+	if err := ev.WriteVar(efivar.Db, signedUpdate("update")); !errors.Is(err, syscall.EBUSY) || !strings.Contains(err.Error(), "3 attempts") {
+		t.Fatalf("expected the write to fail after 3 attempts, got %v", err)
+	}
+}
+
+// shortFs cuts the first writes short
+type shortFs struct {
+	afero.Fs
+	failures int
+	writes   int
+}
+
+func (s *shortFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	f, err := s.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &shortFile{f, s}, nil
+}
+
+type shortFile struct {
+	afero.File
+	fs *shortFs
+}
+
+func (f *shortFile) Write(b []byte) (int, error) {
+	f.fs.writes++
+	if f.fs.writes <= f.fs.failures {
+		return f.File.Write(b[:len(b)-1])
+	}
+	return f.File.Write(b)
+}
+
+func TestRetryShortWrites(t *testing.T) {
+	vfs := &shortFs{Fs: afero.NewMemMapFs(), failures: 1}
+	fs := efivarfs.NewFS()
+	fs.SetFS(&shortWriteFs{vfs})
+	ev, err := RetryEfivarWrites(fs.Open(), config.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev.EFIVars.(*retryEFIVars).sleep = func(time.Duration) {}
+
+	if err := ev.WriteVar(efivar.Db, signedUpdate("update")); err != nil {
+		t.Fatalf("expected the short write to be retried, got %v", err)
+	}
+	if vfs.writes != 2 {
+		t.Fatalf("expected two writes, got %d", vfs.writes)
+	}
+	var raw rawVariable
+	if err := ev.GetVar(efivar.Db, &raw); err != nil || string(raw) != "update" {
+		t.Fatalf("unexpected variable contents %q: %v", raw, err)
+	}
+
+	vfs.writes, vfs.failures = 0, 4
+	if err := ev.WriteVar(efivar.Db, signedUpdate("update")); !errors.Is(err, io.ErrShortWrite) || !strings.Contains(err.Error(), "4 attempts") {
+		t.Fatalf("expected the write to fail after 4 attempts, got %v", err)
+	}
+}
+
+// immutableEFIVars refuses writes until the immutable attribute is unset
+type immutableEFIVars struct {
+	efivarfs.EFIVars
+	immutable bool
+	writes    int
+}
+
+func (i *immutableEFIVars) WriteVar(v efivar.Efivar, m efivar.Marshallable) error {
+	i.writes++
+	if i.immutable {
+		return fmt.Errorf("%s: %w", v.Name, efivarfs.ErrImmutable)
+	}
+	return i.EFIVars.WriteVar(v, m)
+}
+
+func TestChattrEfivarWrites(t *testing.T) {
+	immutable := &immutableEFIVars{EFIVars: OpenEfivarsDir(afero.NewMemMapFs(), "/efivars").EFIVars, immutable: true}
+	var unset []string
+	ev := efivarfs.Open(&chattrEFIVars{
+		EFIVars: immutable,
+		unsetImmutable: func(file string) error {
+			unset = append(unset, file)
+			immutable.immutable = false
+			return nil
+		},
+	})
+	if err := ev.WriteVar(efivar.Db, signedUpdate("update")); err != nil {
+		t.Fatalf("expected the write to succeed after unsetting the immutable attribute, got %v", err)
+	}
+	if immutable.writes != 2 || len(unset) != 1 || unset[0] != "/sys/firmware/efi/efivars/db-d719b2cb-3d3a-4596-a3bc-dad00e67656f" {
+		t.Fatalf("unexpected writes %d, unset %v", immutable.writes, unset)
+	}
+
+	// The original error is returned if the attribute can't be unset
+	immutable.immutable, immutable.writes = true, 0
+	ev.EFIVars.(*chattrEFIVars).unsetImmutable = func(string) error { return syscall.EPERM }
+	if err := ev.WriteVar(efivar.Db, signedUpdate("update")); !errors.Is(err, efivarfs.ErrImmutable) || immutable.writes != 1 {
+		t.Fatalf("expected ErrImmutable without a retry, got %v after %d writes", err, immutable.writes)
+	}
+}
+
+func TestReadVariableAttributes(t *testing.T) {
+	vfs := afero.NewMemMapFs()
+	ev := OpenEfivarsDir(vfs, "/efivars")
+
+	// PK is written with the expected attributes, the firmware stripped the
+	// time based authenticated write attribute from db
+	for name, attrs := range map[string]byte{
+		"PK-8be4df61-93ca-11d2-aa0d-00e098032b8c": 0x27,
+		"db-d719b2cb-3d3a-4596-a3bc-dad00e67656f": 0x07,
+	} {
+		if err := afero.WriteFile(vfs, "/efivars/"+name, []byte{attrs, 0x00, 0x00, 0x00}, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results, err := ReadVariableAttributes(ev, efivar.PK, efivar.Db, efivar.Dbx)
+	if err != nil {
+		t.Fatalf("failed reading the attributes: %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected three results, got %+v", results)
+	}
+	if pk := results[0]; !pk.Exists || !pk.Authenticated || len(pk.Missing) != 0 || pk.Attributes != "0x27" {
+		t.Fatalf("unexpected PK attributes: %+v", pk)
+	}
+	if db := results[1]; !db.Exists || db.Authenticated || strings.Join(db.Missing, ",") != "TIME_BASED_AUTHENTICATED_WRITE_ACCESS" {
+		t.Fatalf("unexpected db attributes: %+v", db)
+	}
+	if dbx := results[2]; dbx.Exists {
+		t.Fatalf("expected dbx to be missing: %+v", dbx)
+	}
+}
@@ -0,0 +1,236 @@
+package sbctl
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/certs"
+	"github.com/foxboron/sbctl/config"
+)
+
+var ErrNoMicrosoft2023Certs = errors.New("no microsoft 2023 certificates are bundled with this build of sbctl")
+
+// Vendor certificates an Enroller can include next to the sbctl keys
+var EnrollVendors = []string{
+	"microsoft",
+	"microsoft-kek",
+	"microsoft-db",
+	"microsoft-2023",
+	"tpm-eventlog",
+	"custom",
+	"firmware-builtin",
+	"firmware-enrolled",
+}
+
+// Enroller enrolls the sbctl keys, and optionally vendor certificates, into
+// the Secure Boot variables. It doesn't print anything.
+type Enroller struct {
+	state *config.State
+	kh    *backend.KeyHierarchy
+
+	// Append adds the keys to the enrolled variables instead of replacing
+	// them
+	Append bool
+	// Vendors are the vendor certificates to include, see EnrollVendors.
+	// "firmware-enrolled" keeps the certificates and hashes enrolled in db and
+	// KEK.
+	Vendors []string
+	// FirmwareBuiltin are the variables, db, KEK or PK, whose certificates
+	// built into the firmware are included with the "firmware-builtin" vendor
+	FirmwareBuiltin []string
+	// DbCerts are additional certificates enrolled into db next to the db
+	// key
+	DbCerts []*x509.Certificate
+	// Eventlog is the TPM eventlog the OpROM checksums are read from with the
+	// "tpm-eventlog" vendor
+	Eventlog string
+	// Progress is called before each variable is written
+	Progress func(EnrollProgress)
+}
+
+// EnrollProgress describes the variable an Enroller is about to write
+type EnrollProgress struct {
+	Variable string `json:"variable"`
+	// Step counts the variables from 1 to Total
+	Step  int `json:"step"`
+	Total int `json:"total"`
+	// Size of the signature database in bytes
+	Size int `json:"size"`
+}
+
+// NewEnroller returns an Enroller for the keys in the key hierarchy
+func NewEnroller(state *config.State, kh *backend.KeyHierarchy) *Enroller {
+	return &Enroller{state: state, kh: kh}
+}
+
+// Variables returns the signature databases the Enroller would enroll
+func (e *Enroller) Variables() (*EFIVariables, error) {
+	guid, err := e.state.Config.GetGUID(e.state.Fs)
+	if err != nil {
+		return nil, err
+	}
+
+	var efistate *EFIVariables
+	if !e.Append {
+		efistate = NewEFIVariables(e.state.Efivarfs)
+	} else {
+		efistate, err = SystemEFIVariables(e.state.Efivarfs)
+		if err != nil {
+			return nil, fmt.Errorf("can't read efivariables: %v", err)
+		}
+	}
+
+	dbCert, err := DbEnrollCertificate(e.state, e.kh)
+	if err != nil {
+		return nil, err
+	}
+	if err = efistate.Db.Append(signature.CERT_X509_GUID, *guid, dbCert); err != nil {
+		return nil, err
+	}
+	if err = efistate.KEK.Append(signature.CERT_X509_GUID, *guid, e.kh.KEK.CertificateBytes()); err != nil {
+		return nil, err
+	}
+	if err = efistate.PK.Append(signature.CERT_X509_GUID, *guid, e.kh.PK.CertificateBytes()); err != nil {
+		return nil, err
+	}
+
+	if len(e.DbCerts) != 0 {
+		dbCerts, err := certs.GetCertsDatabase(e.DbCerts)
+		if err != nil {
+			return nil, fmt.Errorf("could not enroll db certificates: %w", err)
+		}
+		efistate.Db.AppendDatabase(dbCerts)
+	}
+
+	for _, vendor := range e.Vendors {
+		switch vendor {
+		case "tpm-eventlog":
+			eventlogDB, err := GetEventlogChecksums(e.state.Fs, e.Eventlog)
+			if err != nil {
+				return nil, fmt.Errorf("could not enroll db keys: %w", err)
+			}
+			if len((*eventlogDB)) == 0 {
+				return nil, fmt.Errorf("could not find any OpROM entries in the TPM eventlog")
+			}
+			efistate.Db.AppendDatabase(eventlogDB)
+		case "microsoft":
+			oemSigDb, err := certs.GetOEMCerts(vendor, "db")
+			if err != nil {
+				return nil, fmt.Errorf("could not enroll db keys: %w", err)
+			}
+			efistate.Db.AppendDatabase(oemSigDb)
+
+			oemSigKEK, err := certs.GetOEMCerts(vendor, "KEK")
+			if err != nil {
+				return nil, fmt.Errorf("could not enroll KEK keys: %w", err)
+			}
+			efistate.KEK.AppendDatabase(oemSigKEK)
+
+			// We are not enrolling PK keys from Microsoft
+		case "microsoft-kek":
+			oemSigKEK, err := certs.GetOEMCertsGeneration("microsoft", "KEK", "2011")
+			if err != nil {
+				return nil, fmt.Errorf("could not enroll KEK keys: %w", err)
+			}
+			efistate.KEK.AppendDatabase(oemSigKEK)
+		case "microsoft-db":
+			oemSigDb, err := certs.GetOEMCertsGeneration("microsoft", "db", "2011")
+			if err != nil {
+				return nil, fmt.Errorf("could not enroll db keys: %w", err)
+			}
+			efistate.Db.AppendDatabase(oemSigDb)
+		case "microsoft-2023":
+			oemSigDb, err := certs.GetOEMCertsGeneration("microsoft", "db", "2023")
+			if err != nil {
+				return nil, fmt.Errorf("could not enroll db keys: %w", err)
+			}
+			oemSigKEK, err := certs.GetOEMCertsGeneration("microsoft", "KEK", "2023")
+			if err != nil {
+				return nil, fmt.Errorf("could not enroll KEK keys: %w", err)
+			}
+			if len(*oemSigDb) == 0 && len(*oemSigKEK) == 0 {
+				return nil, ErrNoMicrosoft2023Certs
+			}
+			efistate.Db.AppendDatabase(oemSigDb)
+			efistate.KEK.AppendDatabase(oemSigKEK)
+		case "custom":
+			customSigDb, err := certs.GetCustomCerts(e.state.Config.Keydir, "db")
+			if err != nil {
+				return nil, fmt.Errorf("could not enroll custom db keys: %w", err)
+			}
+			efistate.Db.AppendDatabase(customSigDb)
+
+			customSigKEK, err := certs.GetCustomCerts(e.state.Config.Keydir, "KEK")
+			if err != nil {
+				return nil, fmt.Errorf("could not enroll custom KEK keys: %w", err)
+			}
+			efistate.KEK.AppendDatabase(customSigKEK)
+		case "firmware-builtin":
+			for _, cert := range e.FirmwareBuiltin {
+				builtinSigDb, err := certs.GetBuiltinCertificates(cert)
+				if err != nil {
+					return nil, fmt.Errorf("could not enroll built-in firmware keys: %w", err)
+				}
+				switch cert {
+				case "db":
+					efistate.Db.AppendDatabase(builtinSigDb)
+				case "KEK":
+					efistate.KEK.AppendDatabase(builtinSigDb)
+				case "PK":
+					efistate.PK.AppendDatabase(builtinSigDb)
+				}
+			}
+		}
+	}
+	// Merged last, so signatures other vendors include aren't duplicated
+	if slices.Contains(e.Vendors, "firmware-enrolled") {
+		enrolled, err := SystemEFIVariables(e.state.Efivarfs)
+		if err != nil {
+			return nil, fmt.Errorf("can't read the enrolled keys: %w", err)
+		}
+		if _, err := MergeSignatureDatabase(efistate.Db, enrolled.Db); err != nil {
+			return nil, fmt.Errorf("could not enroll the enrolled db keys: %w", err)
+		}
+		if _, err := MergeSignatureDatabase(efistate.KEK, enrolled.KEK); err != nil {
+			return nil, fmt.Errorf("could not enroll the enrolled KEK keys: %w", err)
+		}
+	}
+	return efistate, nil
+}
+
+// EnrollVariables writes the signature databases returned by Variables to the
+// variables, or to db, KEK and PK in that order if vars is empty
+func (e *Enroller) EnrollVariables(efistate *EFIVariables, vars ...efivar.Efivar) error {
+	if len(vars) == 0 {
+		vars = []efivar.Efivar{efivar.Db, efivar.KEK, efivar.PK}
+	}
+	for i, v := range vars {
+		if e.Progress != nil {
+			e.Progress(EnrollProgress{
+				Variable: v.Name,
+				Step:     i + 1,
+				Total:    len(vars),
+				Size:     len(efistate.GetSiglist(v).Bytes()),
+			})
+		}
+		if err := efistate.EnrollKey(v, e.kh); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Enroll builds the signature databases and writes them to the variables, or
+// to db, KEK and PK if vars is empty
+func (e *Enroller) Enroll(vars ...efivar.Efivar) error {
+	efistate, err := e.Variables()
+	if err != nil {
+		return err
+	}
+	return e.EnrollVariables(efistate, vars...)
+}
@@ -0,0 +1,154 @@
+package sbctl
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/foxboron/go-uefi/efi/attributes"
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/foxboron/go-uefi/efivarfs"
+	"github.com/foxboron/sbctl/backend"
+)
+
+// Firmware backups are a tarball of the Secure Boot variables as read from
+// efivarfs. Each entry is named NAME-GUID and holds the 4 byte attributes
+// followed by the value, the same layout as --efivarfs-path.
+
+// FirmwareBackupVariables are the variables in a firmware backup, in the order
+// they are restored. PK comes last as enrolling it ends Setup Mode.
+var FirmwareBackupVariables = []efivar.Efivar{efivar.Dbx, efivar.Db, efivar.KEK, efivar.PK}
+
+var ErrInvalidFirmwareBackup = errors.New("invalid firmware backup")
+
+// FirmwareVariable is the content of a variable exactly as the firmware has it
+type FirmwareVariable struct {
+	Var        efivar.Efivar
+	Attributes attributes.Attributes
+	Data       []byte
+}
+
+func (f FirmwareVariable) name() string {
+	return fmt.Sprintf("%s-%s", f.Var.Name, f.Var.GUID.Format())
+}
+
+// BackupFirmwareVariables reads the variables in FirmwareBackupVariables.
+// Variables which are not set are left out.
+func BackupFirmwareVariables(e *efivarfs.Efivarfs) ([]FirmwareVariable, error) {
+	vars := []FirmwareVariable{}
+	for _, v := range FirmwareBackupVariables {
+		var raw rawVariable
+		attrs, err := e.GetVarWithAttributes(v, &raw)
+		// Read the value again with the attributes the firmware reports
+		if errors.Is(err, efivarfs.ErrIncorrectAttributes) {
+			reported := v
+			reported.Attributes = attrs
+			attrs, err = e.GetVarWithAttributes(reported, &raw)
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("can't read %s: %w", v.Name, err)
+		}
+		vars = append(vars, FirmwareVariable{Var: v, Attributes: attrs, Data: raw})
+	}
+	return vars, nil
+}
+
+// WriteFirmwareBackup writes the variables as a tarball to w
+func WriteFirmwareBackup(w io.Writer, vars []FirmwareVariable) error {
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	for _, v := range vars {
+		var b bytes.Buffer
+		if err := binary.Write(&b, binary.LittleEndian, uint32(v.Attributes)); err != nil {
+			return err
+		}
+		b.Write(v.Data)
+		hdr := &tar.Header{
+			Name:    v.name(),
+			Mode:    0644,
+			Size:    int64(b.Len()),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(b.Bytes()); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// ReadFirmwareBackup parses a firmware backup. The variables are returned in
+// the order they are restored in.
+func ReadFirmwareBackup(r io.Reader) ([]FirmwareVariable, error) {
+	// Entries are removed once read, so duplicates are rejected
+	known := map[string]efivar.Efivar{}
+	for _, v := range FirmwareBackupVariables {
+		known[FirmwareVariable{Var: v}.name()] = v
+	}
+
+	vars := []FirmwareVariable{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidFirmwareBackup, err)
+		}
+		v, ok := known[hdr.Name]
+		if !ok {
+			return nil, fmt.Errorf("%w: unexpected entry %s", ErrInvalidFirmwareBackup, hdr.Name)
+		}
+		delete(known, hdr.Name)
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidFirmwareBackup, err)
+		}
+		if len(b) < 4 {
+			return nil, fmt.Errorf("%w: %s is missing the attributes", ErrInvalidFirmwareBackup, hdr.Name)
+		}
+		data := b[4:]
+		if _, err := signature.ReadSignatureDatabase(bytes.NewReader(data)); len(data) != 0 && err != nil {
+			return nil, fmt.Errorf("%w: can't parse the signature lists of %s: %v", ErrInvalidFirmwareBackup, v.Name, err)
+		}
+		vars = append(vars, FirmwareVariable{
+			Var:        v,
+			Attributes: attributes.Attributes(binary.LittleEndian.Uint32(b[:4])),
+			Data:       data,
+		})
+	}
+	slices.SortStableFunc(vars, func(a, b FirmwareVariable) int {
+		return slices.IndexFunc(FirmwareBackupVariables, func(v efivar.Efivar) bool { return v == a.Var }) -
+			slices.IndexFunc(FirmwareBackupVariables, func(v efivar.Efivar) bool { return v == b.Var })
+	})
+	return vars, nil
+}
+
+// RestoreFirmwareVariables writes the variables back to the firmware. The
+// updates are signed with the keys in the key hierarchy, so outside of Setup
+// Mode the firmware only accepts them if the key hierarchy owns the variables.
+func RestoreFirmwareVariables(e *efivarfs.Efivarfs, kh *backend.KeyHierarchy, vars []FirmwareVariable) error {
+	efistate := NewEFIVariables(e)
+	for _, v := range vars {
+		sigdb, err := signature.ReadSignatureDatabase(bytes.NewReader(v.Data))
+		if err != nil && len(v.Data) != 0 {
+			return fmt.Errorf("can't parse %s: %w", v.Var.Name, err)
+		}
+		*efistate.GetSiglist(v.Var) = sigdb
+		if err := efistate.EnrollKey(v.Var, kh); err != nil {
+			return fmt.Errorf("can't restore %s: %w", v.Var.Name, err)
+		}
+	}
+	return nil
+}
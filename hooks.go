@@ -0,0 +1,159 @@
+package sbctl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/foxboron/go-uefi/efivarfs"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/logging"
+)
+
+var ErrHookFailed = errors.New("hook failed")
+
+// Names of the hooks, passed to the commands as SBCTL_HOOK
+const (
+	HookPreSign    = "pre_sign"
+	HookPostSign   = "post_sign"
+	HookPreEnroll  = "pre_enroll"
+	HookPostEnroll = "post_enroll"
+)
+
+func hookCommands(conf *config.Config, hook string) []string {
+	if conf == nil || conf.Hooks == nil {
+		return nil
+	}
+	switch hook {
+	case HookPreSign:
+		return conf.Hooks.PreSign
+	case HookPostSign:
+		return conf.Hooks.PostSign
+	case HookPreEnroll:
+		return conf.Hooks.PreEnroll
+	case HookPostEnroll:
+		return conf.Hooks.PostEnroll
+	}
+	return nil
+}
+
+// RunHook runs the commands of the hook with /bin/sh, with SBCTL_HOOK and env
+// added to the environment. The output of the commands goes to stderr to keep
+// the structured output intact. The first failing command stops the hook.
+func RunHook(conf *config.Config, hook string, env ...string) error {
+	for _, c := range hookCommands(conf, hook) {
+		slog.Debug("running hook", slog.String("hook", hook), slog.String("command", c))
+		cmd := exec.Command("/bin/sh", "-c", c)
+		cmd.Env = append(os.Environ(), "SBCTL_HOOK="+hook)
+		cmd.Env = append(cmd.Env, env...)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s hook %q: %w: %v", hook, c, ErrHookFailed, err)
+		}
+	}
+	return nil
+}
+
+// withHooks runs fn between the pre and post hooks. A failing pre hook aborts
+// before fn is run. The post hook runs even if fn fails, with SBCTL_RESULT set
+// to ok or failed, and it failing is only warned about.
+func withHooks(conf *config.Config, pre, post string, env []string, fn func() error) error {
+	if err := RunHook(conf, pre, env...); err != nil {
+		return err
+	}
+	err := fn()
+	result := "ok"
+	if err != nil {
+		result = "failed"
+	}
+	if herr := RunHook(conf, post, append(env, "SBCTL_RESULT="+result)...); herr != nil {
+		logging.Warn("%v", herr)
+	}
+	return err
+}
+
+// EnrollHooks runs the enroll hooks once for a command: pre_enroll before the
+// first write to an EFI variable, and post_enroll when the command is done,
+// with the written variables in SBCTL_VARIABLES. Commands which don't write
+// any variables don't run the hooks.
+type EnrollHooks struct {
+	conf      *config.Config
+	started   bool
+	variables []string
+	failed    bool
+}
+
+// begin runs pre_enroll before the first write. A failing pre_enroll fails
+// every write, as none of them should be made.
+func (h *EnrollHooks) begin() error {
+	if h.started {
+		return nil
+	}
+	if err := RunHook(h.conf, HookPreEnroll); err != nil {
+		return err
+	}
+	h.started = true
+	return nil
+}
+
+// Finish runs post_enroll if any variable has been written, with SBCTL_RESULT
+// set to ok, or failed if a write or the command failed. The hook failing is
+// only warned about.
+func (h *EnrollHooks) Finish(err error) {
+	if h == nil || !h.started {
+		return
+	}
+	result := "ok"
+	if err != nil || h.failed {
+		result = "failed"
+	}
+	env := []string{"SBCTL_VARIABLES=" + strings.Join(h.variables, " "), "SBCTL_RESULT=" + result}
+	if herr := RunHook(h.conf, HookPostEnroll, env...); herr != nil {
+		logging.Warn("%v", herr)
+	}
+	h.started = false
+	h.variables = nil
+	h.failed = false
+}
+
+// hookEFIVars runs the enroll hooks around the writes to EFI variables
+type hookEFIVars struct {
+	efivarfs.EFIVars
+	hooks *EnrollHooks
+}
+
+func (h *hookEFIVars) WriteVar(v efivar.Efivar, m efivar.Marshallable) error {
+	var b bytes.Buffer
+	m.Marshal(&b)
+	update := signedUpdate(b.Bytes())
+
+	if err := h.hooks.begin(); err != nil {
+		return err
+	}
+	err := h.EFIVars.WriteVar(v, update)
+	if err != nil {
+		h.hooks.failed = true
+	}
+	if !slices.Contains(h.hooks.variables, v.Name) {
+		h.hooks.variables = append(h.hooks.variables, v.Name)
+	}
+	return err
+}
+
+// HookEfivarWrites runs the pre_enroll and post_enroll hooks of the
+// configuration around the writes to the variables in e. Finish has to be
+// called on the returned hooks once the command is done.
+func HookEfivarWrites(e *efivarfs.Efivarfs, conf *config.Config) (*efivarfs.Efivarfs, *EnrollHooks) {
+	hooks := &EnrollHooks{conf: conf}
+	return efivarfs.Open(&hookEFIVars{
+		EFIVars: e.EFIVars,
+		hooks:   hooks,
+	}), hooks
+}
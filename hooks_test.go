@@ -0,0 +1,95 @@
+package sbctl
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/foxboron/go-uefi/efivarfs"
+	"github.com/foxboron/sbctl/config"
+	"github.com/spf13/afero"
+)
+
+func TestHookEfivarWrites(t *testing.T) {
+	log := filepath.Join(t.TempDir(), "hooks.log")
+	conf := config.DefaultConfig()
+	conf.Hooks = &config.HooksConfig{
+		PreEnroll:  []string{`echo "$SBCTL_HOOK" >> ` + log},
+		PostEnroll: []string{`echo "$SBCTL_HOOK $SBCTL_VARIABLES $SBCTL_RESULT" >> ` + log},
+	}
+	ev, hooks := HookEfivarWrites(OpenEfivarsDir(afero.NewMemMapFs(), "/efivars"), conf)
+
+	// The hooks run once for all the writes of a command
+	for _, v := range []efivar.Efivar{efivar.Db, efivar.KEK, efivar.Db} {
+		if err := ev.WriteVar(v, signedUpdate("update")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hooks.Finish(nil)
+	var raw rawVariable
+	if err := ev.GetVar(efivar.Db, &raw); err != nil || string(raw) != "update" {
+		t.Fatalf("unexpected variable contents %q: %v", raw, err)
+	}
+	b, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "pre_enroll\npost_enroll db KEK ok\n" {
+		t.Fatalf("unexpected hook runs %q", b)
+	}
+
+	// Nothing is run without writes
+	hooks.Finish(nil)
+	if b, _ := os.ReadFile(log); strings.Count(string(b), "\n") != 2 {
+		t.Fatalf("unexpected hook runs without writes %q", b)
+	}
+
+	// A failing pre hook aborts the writes
+	conf.Hooks.PreEnroll = []string{"exit 1"}
+	conf.Hooks.PostEnroll = nil
+	if err := ev.WriteVar(efivar.KEK, signedUpdate("update")); !errors.Is(err, ErrHookFailed) {
+		t.Fatalf("expected ErrHookFailed, got %v", err)
+	}
+	if err := ev.WriteVar(efivar.PK, signedUpdate("update")); !errors.Is(err, ErrHookFailed) {
+		t.Fatalf("expected ErrHookFailed, got %v", err)
+	}
+	if err := ev.GetVar(efivar.PK, &raw); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected PK to be left unwritten, got %v", err)
+	}
+}
+
+// failingEFIVars refuses every write
+type failingEFIVars struct {
+	efivarfs.EFIVars
+}
+
+func (f *failingEFIVars) WriteVar(v efivar.Efivar, m efivar.Marshallable) error {
+	return os.ErrPermission
+}
+
+func TestHookEfivarWritesFailure(t *testing.T) {
+	log := filepath.Join(t.TempDir(), "hooks.log")
+	conf := config.DefaultConfig()
+	conf.Hooks = &config.HooksConfig{
+		PostEnroll: []string{`echo "$SBCTL_RESULT" >> ` + log, "exit 1"},
+	}
+	failing := &failingEFIVars{OpenEfivarsDir(afero.NewMemMapFs(), "/efivars").EFIVars}
+	ev, hooks := HookEfivarWrites(efivarfs.Open(failing), conf)
+
+	// The post hook runs after a failed write, and its own failure is only
+	// warned about
+	if err := ev.WriteVar(efivar.PK, signedUpdate("update")); !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("expected the write error, got %v", err)
+	}
+	hooks.Finish(nil)
+	b, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(b)) != "failed" {
+		t.Fatalf("unexpected SBCTL_RESULT %q", b)
+	}
+}
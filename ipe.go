@@ -0,0 +1,168 @@
+package sbctl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/foxboron/sbctl/logging"
+)
+
+// IPE operations the policy can allow the signed files for
+var IPEOperations = []string{
+	"KEXEC_IMAGE",
+	"KEXEC_INITRAMFS",
+	"EXECUTE",
+	"FIRMWARE",
+	"KMODULE",
+}
+
+const (
+	IPEPolicyName      = "sbctl"
+	IPEPolicyOperation = "KEXEC_IMAGE"
+
+	fsverityBlockSize = 4096
+)
+
+// FsverityDigest returns the fs-verity file digest of r, with SHA-256 and
+// 4096 byte blocks and no salt. It is the digest IPE matches fsverity_digest
+// against, the SHA-256 of the fsverity_descriptor with the root hash of the
+// Merkle tree over the file.
+func FsverityDigest(r io.Reader) ([]byte, error) {
+	var size uint64
+	var level []byte
+	block := make([]byte, fsverityBlockSize)
+	for {
+		n, err := io.ReadFull(r, block)
+		if n > 0 {
+			clear(block[n:])
+			sum := sha256.Sum256(block)
+			level = append(level, sum[:]...)
+			size += uint64(n)
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	// The hashes of a level are hashed in blocks until one hash is left, the
+	// root hash. It is all zeros for empty files.
+	for len(level) > sha256.Size {
+		var next []byte
+		for i := 0; i < len(level); i += fsverityBlockSize {
+			clear(block)
+			copy(block, level[i:])
+			sum := sha256.Sum256(block)
+			next = append(next, sum[:]...)
+		}
+		level = next
+	}
+
+	// struct fsverity_descriptor
+	desc := make([]byte, 256)
+	desc[0] = 1  // version
+	desc[1] = 1  // FS_VERITY_HASH_ALG_SHA256
+	desc[2] = 12 // log2 of the block size
+	binary.LittleEndian.PutUint64(desc[8:], size)
+	copy(desc[16:80], level)
+	sum := sha256.Sum256(desc)
+	return sum[:], nil
+}
+
+// NextIPEPolicyVersion returns the policy_version after the one in policy. IPE
+// refuses updates to a policy with a lower version, so regenerated policies
+// bump the last component. Policies without a version start at 0.0.1.
+func NextIPEPolicyVersion(policy []byte) string {
+	header, _, _ := bytes.Cut(policy, []byte("\n"))
+	for _, field := range strings.Fields(string(header)) {
+		v, ok := strings.CutPrefix(field, "policy_version=")
+		if !ok {
+			continue
+		}
+		parts := strings.Split(v, ".")
+		if len(parts) != 3 {
+			break
+		}
+		patch, err := strconv.ParseUint(parts[2], 10, 16)
+		if err != nil || patch == 0xffff {
+			break
+		}
+		return fmt.Sprintf("%s.%s.%d", parts[0], parts[1], patch+1)
+	}
+	return "0.0.1"
+}
+
+// IPEPolicy returns an IPE policy allowing op only for the files in the file
+// database, by their fs-verity digest. Other operations are allowed. Files
+// which don't exist are warned about and left out.
+func IPEPolicy(state *config.State, name, version, op string) ([]byte, error) {
+	files, err := ReadFileDatabase(state.Fs, state.Config.FilesDb)
+	if err != nil {
+		return nil, err
+	}
+	var outputs []string
+	for _, entry := range files {
+		outputs = append(outputs, entry.OutputFile)
+	}
+	sort.Strings(outputs)
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "policy_name=%s policy_version=%s\n", name, version)
+	fmt.Fprintf(&b, "DEFAULT action=ALLOW\n\n")
+	fmt.Fprintf(&b, "DEFAULT op=%s action=DENY\n", op)
+	for _, file := range outputs {
+		f, err := state.Fs.Open(file)
+		if errors.Is(err, os.ErrNotExist) {
+			logging.Warn("%s does not exist, leaving it out of the IPE policy", file)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		digest, err := FsverityDigest(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed reading %s: %w", file, err)
+		}
+		fmt.Fprintf(&b, "# %s\n", file)
+		fmt.Fprintf(&b, "op=%s fsverity_digest=sha256:%s action=ALLOW\n", op, hex.EncodeToString(digest))
+	}
+	return b.Bytes(), nil
+}
+
+// WriteIPEPolicy regenerates the IPE policy at ipe_policy, if it is
+// configured, with the version of the previous policy bumped
+func WriteIPEPolicy(state *config.State) error {
+	path := state.Config.IPEPolicy
+	if path == "" {
+		return nil
+	}
+	old, err := fs.ReadFile(state.Fs, path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	policy, err := IPEPolicy(state, IPEPolicyName, NextIPEPolicyVersion(old), IPEPolicyOperation)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(ipePolicyRules(old), ipePolicyRules(policy)) {
+		return nil
+	}
+	return fs.WriteFile(state.Fs, path, policy, 0o644)
+}
+
+// ipePolicyRules returns the policy without the header line with the version
+func ipePolicyRules(policy []byte) []byte {
+	_, rules, _ := bytes.Cut(policy, []byte("\n"))
+	return rules
+}
@@ -0,0 +1,44 @@
+package sbctl
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestFsverityDigest(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		data   []byte
+		digest string
+	}{
+		// fsverity digest of an empty file
+		{"empty", nil, "3d248ca542a24fc62d1c43b916eae5016878e2533c88238480b26128a1f1af95"},
+		{"one level", bytes.Repeat([]byte("a"), 5000), "918347c69490f04c08ed15c9711f5da336fac318892ef517e47f6c5c3f1c5811"},
+		// 130 data blocks need two levels of hash blocks
+		{"two levels", bytes.Repeat([]byte("b"), 4096*129+1), "978d900bd16a02af6fe00dfb3dfaccb347167998fb291851864aa63280483def"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			digest, err := FsverityDigest(bytes.NewReader(tc.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hex.EncodeToString(digest) != tc.digest {
+				t.Fatalf("unexpected digest %x, expected %s", digest, tc.digest)
+			}
+		})
+	}
+}
+
+func TestNextIPEPolicyVersion(t *testing.T) {
+	for policy, version := range map[string]string{
+		"": "0.0.1",
+		"policy_name=sbctl policy_version=1.2.3\nDEFAULT action=ALLOW\n": "1.2.4",
+		"policy_name=sbctl\n":        "0.0.1",
+		"policy_version=0.0.65535\n": "0.0.1",
+	} {
+		if got := NextIPEPolicyVersion([]byte(policy)); got != version {
+			t.Errorf("NextIPEPolicyVersion(%q) = %s, expected %s", policy, got, version)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package sbctl
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Key archives are a gzipped tarball of the key hierarchy, the owner GUID and
+// optionally the configuration file. The tarball is encrypted with AES-256-GCM
+// using a key derived from a passphrase with scrypt.
+//
+// Layout: magic | version | salt | nonce | ciphertext
+
+var (
+	keyArchiveMagic   = []byte("SBCTLKEYS")
+	keyArchiveVersion = byte(1)
+
+	ErrInvalidKeyArchive = errors.New("invalid key archive")
+	ErrWrongPassphrase   = errors.New("wrong passphrase or corrupted key archive")
+)
+
+const (
+	keyArchiveSaltSize = 16
+
+	// Names of the non-key entries in the archive
+	KeyArchiveGUID   = "GUID"
+	KeyArchiveConfig = "sbctl.conf"
+)
+
+// KeyArchive maps the archive entry name to the file content
+type KeyArchive map[string][]byte
+
+// KeyArchiveKeyFiles returns the key files, relative to the key directory,
+// which are stored in a key archive.
+func KeyArchiveKeyFiles() []string {
+	var files []string
+	for _, key := range SecureBootKeys {
+		files = append(files,
+			path.Join(key.Key, key.Key+".key"),
+			path.Join(key.Key, key.Key+".pem"),
+		)
+	}
+	return files
+}
+
+// ReadKeyArchive collects the key hierarchy, the GUID and the configuration
+// file, if it exists, into a KeyArchive.
+func ReadKeyArchive(state *config.State, conffile string) (KeyArchive, error) {
+	archive := KeyArchive{}
+	for _, f := range KeyArchiveKeyFiles() {
+		b, err := fs.ReadFile(state.Fs, filepath.Join(state.Config.Keydir, f))
+		if err != nil {
+			return nil, err
+		}
+		archive[path.Join("keys", f)] = b
+	}
+
+	b, err := fs.ReadFile(state.Fs, state.Config.GUID)
+	if err != nil {
+		return nil, err
+	}
+	archive[KeyArchiveGUID] = b
+
+	if conffile != "" {
+		b, err := fs.ReadFile(state.Fs, conffile)
+		if errors.Is(err, os.ErrNotExist) {
+			return archive, nil
+		} else if err != nil {
+			return nil, err
+		}
+		archive[KeyArchiveConfig] = b
+	}
+	return archive, nil
+}
+
+// WriteKeyArchive writes the key hierarchy and GUID from the archive into the
+// locations given by the configuration. The configuration file is written to
+// conffile if it is part of the archive and conffile is not empty.
+func WriteKeyArchive(state *config.State, archive KeyArchive, conffile string) error {
+	if err := archive.Validate(); err != nil {
+		return err
+	}
+	for _, f := range KeyArchiveKeyFiles() {
+		dst := filepath.Join(state.Config.Keydir, f)
+		if err := state.Fs.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+			return err
+		}
+		if err := fs.WriteFile(state.Fs, dst, archive[path.Join("keys", f)], 0o400); err != nil {
+			return err
+		}
+	}
+	if err := state.Fs.MkdirAll(filepath.Dir(state.Config.GUID), os.ModePerm); err != nil {
+		return err
+	}
+	if err := fs.WriteFile(state.Fs, state.Config.GUID, archive[KeyArchiveGUID], 0o644); err != nil {
+		return err
+	}
+	if b, ok := archive[KeyArchiveConfig]; ok && conffile != "" {
+		if err := state.Fs.MkdirAll(filepath.Dir(conffile), os.ModePerm); err != nil {
+			return err
+		}
+		if err := fs.WriteFile(state.Fs, conffile, b, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate checks that all the required entries are present in the archive
+func (k KeyArchive) Validate() error {
+	for _, f := range KeyArchiveKeyFiles() {
+		if _, ok := k[path.Join("keys", f)]; !ok {
+			return fmt.Errorf("%w: missing %s", ErrInvalidKeyArchive, f)
+		}
+	}
+	if _, ok := k[KeyArchiveGUID]; !ok {
+		return fmt.Errorf("%w: missing %s", ErrInvalidKeyArchive, KeyArchiveGUID)
+	}
+	return nil
+}
+
+func keyArchiveCipher(passphrase, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt serializes the archive and encrypts it with the passphrase
+func (k KeyArchive) Encrypt(passphrase []byte) ([]byte, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("passphrase can't be empty")
+	}
+
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for _, name := range k.names() {
+		hdr := &tar.Header{
+			Name: name,
+			Mode: 0600,
+			Size: int64(len(k[name])),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(k[name]); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, keyArchiveSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := keyArchiveCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	header := append([]byte{}, keyArchiveMagic...)
+	header = append(header, keyArchiveVersion)
+	header = append(header, salt...)
+	header = append(header, nonce...)
+
+	// The header is authenticated as additional data
+	return aead.Seal(header, nonce, buf.Bytes(), header), nil
+}
+
+// DecryptKeyArchive decrypts and parses an encrypted key archive. The archive
+// is validated before it is returned.
+func DecryptKeyArchive(b []byte, passphrase []byte) (KeyArchive, error) {
+	if !bytes.HasPrefix(b, keyArchiveMagic) {
+		return nil, ErrInvalidKeyArchive
+	}
+	n := len(keyArchiveMagic)
+	if len(b) < n+1+keyArchiveSaltSize {
+		return nil, ErrInvalidKeyArchive
+	}
+	if b[n] != keyArchiveVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidKeyArchive, b[n])
+	}
+	salt := b[n+1 : n+1+keyArchiveSaltSize]
+
+	aead, err := keyArchiveCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	headerSize := n + 1 + keyArchiveSaltSize + aead.NonceSize()
+	if len(b) < headerSize {
+		return nil, ErrInvalidKeyArchive
+	}
+	header := b[:headerSize]
+	nonce := b[n+1+keyArchiveSaltSize : headerSize]
+
+	plain, err := aead.Open(nil, nonce, b[headerSize:], header)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+
+	gr, err := gzip.NewReader(bytes.NewReader(plain))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidKeyArchive, err)
+	}
+	defer gr.Close()
+
+	archive := KeyArchive{}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidKeyArchive, err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidKeyArchive, err)
+		}
+		archive[path.Clean(hdr.Name)] = content
+	}
+	if err := archive.Validate(); err != nil {
+		return nil, err
+	}
+	return archive, nil
+}
+
+// WriteEncryptedKeyArchive writes the encrypted archive to output. The file is
+// never world-readable.
+func WriteEncryptedKeyArchive(vfs afero.Fs, output string, b []byte) error {
+	if err := fs.WriteFile(vfs, output, b, 0o600); err != nil {
+		return err
+	}
+	// WriteFile does not change the mode of existing files
+	return vfs.Chmod(output, 0o600)
+}
+
+// names returns the archive entries in a stable order
+func (k KeyArchive) names() []string {
+	var names []string
+	for _, f := range KeyArchiveKeyFiles() {
+		if _, ok := k[path.Join("keys", f)]; ok {
+			names = append(names, path.Join("keys", f))
+		}
+	}
+	for _, f := range []string{KeyArchiveGUID, KeyArchiveConfig} {
+		if _, ok := k[f]; ok {
+			names = append(names, f)
+		}
+	}
+	return names
+}
@@ -0,0 +1,68 @@
+package sbctl
+
+import (
+	"bytes"
+	"errors"
+	"path"
+	"testing"
+)
+
+func testKeyArchive() KeyArchive {
+	archive := KeyArchive{
+		KeyArchiveGUID:   []byte("a9fbbdb7-a05f-48d5-b63a-08c5df45ee70"),
+		KeyArchiveConfig: []byte("keydir: /var/lib/sbctl/keys\n"),
+	}
+	for _, f := range KeyArchiveKeyFiles() {
+		archive[path.Join("keys", f)] = []byte(f)
+	}
+	return archive
+}
+
+func TestKeyArchiveRoundtrip(t *testing.T) {
+	archive := testKeyArchive()
+	b, err := archive.Encrypt([]byte("hunter2"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	decrypted, err := DecryptKeyArchive(b, []byte("hunter2"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(decrypted) != len(archive) {
+		t.Fatalf("expected %d entries, got %d", len(archive), len(decrypted))
+	}
+	for name, content := range archive {
+		if !bytes.Equal(decrypted[name], content) {
+			t.Fatalf("entry %s does not match", name)
+		}
+	}
+}
+
+func TestKeyArchiveWrongPassphrase(t *testing.T) {
+	b, err := testKeyArchive().Encrypt([]byte("hunter2"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := DecryptKeyArchive(b, []byte("hunter3")); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("expected ErrWrongPassphrase, got %v", err)
+	}
+
+	// Flip a bit in the header, which is authenticated
+	b[len(keyArchiveMagic)+1] ^= 0x1
+	if _, err := DecryptKeyArchive(b, []byte("hunter2")); !errors.Is(err, ErrWrongPassphrase) {
+		t.Fatalf("expected ErrWrongPassphrase, got %v", err)
+	}
+}
+
+func TestKeyArchiveIncomplete(t *testing.T) {
+	archive := testKeyArchive()
+	delete(archive, "keys/PK/PK.key")
+	b, err := archive.Encrypt([]byte("hunter2"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := DecryptKeyArchive(b, []byte("hunter2")); !errors.Is(err, ErrInvalidKeyArchive) {
+		t.Fatalf("expected ErrInvalidKeyArchive, got %v", err)
+	}
+}
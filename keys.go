@@ -3,6 +3,8 @@ package sbctl
 import (
 	"bytes"
 	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"os"
@@ -10,6 +12,9 @@ import (
 
 	"github.com/foxboron/go-uefi/authenticode"
 	"github.com/foxboron/go-uefi/efi"
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/foxboron/go-uefi/efivarfs"
 	"github.com/foxboron/sbctl/backend"
 	"github.com/foxboron/sbctl/certs"
 	"github.com/foxboron/sbctl/config"
@@ -18,8 +23,18 @@ import (
 	"github.com/spf13/afero"
 )
 
-func EnrollCustom(customBytes []byte, efivar string) error {
-	return efi.WriteEFIVariable(efivar, customBytes)
+// EnrollCustom writes the signed update customBytes to the db, KEK or PK
+// variable
+func EnrollCustom(ev *efivarfs.Efivarfs, customBytes []byte, variable string) error {
+	v, ok := map[string]efivar.Efivar{
+		"db":  efivar.Db,
+		"KEK": efivar.KEK,
+		"PK":  efivar.PK,
+	}[variable]
+	if !ok {
+		return fmt.Errorf("can't enroll %s", variable)
+	}
+	return ev.WriteVar(v, signedUpdate(customBytes))
 }
 
 func VerifyFile(state *config.State, kh *backend.KeyHierarchy, ev hierarchy.Hierarchy, file string) (bool, error) {
@@ -31,6 +46,135 @@ func VerifyFile(state *config.State, kh *backend.KeyHierarchy, ev hierarchy.Hier
 	return kh.VerifyFile(ev, peFile)
 }
 
+// ChecksumMatches reports if the signed output has the same authenticode
+// checksum as the file it was signed from. A mismatch means the file has been
+// updated since it was last signed.
+func ChecksumMatches(state *config.State, file, output string) (bool, error) {
+	if file == output {
+		return true, nil
+	}
+	hash := func(p string) ([]byte, error) {
+		f, err := state.Fs.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		peBinary, err := authenticode.Parse(f)
+		if err != nil {
+			return nil, err
+		}
+		return peBinary.Hash(crypto.SHA256), nil
+	}
+	fileHash, err := hash(file)
+	if err != nil {
+		return false, err
+	}
+	outputHash, err := hash(output)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(fileHash, outputHash), nil
+}
+
+// verifyFileHash is VerifyFile for the signatures with the digest algorithm in
+// the configuration, a file signed with another one has to be signed again
+func verifyFileHash(state *config.State, kh *backend.KeyHierarchy, ev hierarchy.Hierarchy, file string) (bool, error) {
+	alg, err := backend.ParseHashAlgorithm(state.Config.HashAlgo)
+	if err != nil {
+		return false, err
+	}
+	peFile, err := state.Fs.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer peFile.Close()
+	peBinary, err := authenticode.Parse(peFile)
+	if err != nil {
+		return false, err
+	}
+	ok, err := backend.VerifyPEBinaryHash(peBinary, kh.GetKeyBackend(ev.Efivar()).Certificate(), alg.Hash())
+	if errors.Is(err, authenticode.ErrNoSignatures) {
+		return false, nil
+	}
+	return ok, err
+}
+
+// IsSigned reports if output is signed by the current db key from the
+// unchanged file, so signing it again wouldn't change it. Files signed by a
+// rotated db key or with another digest algorithm are not signed.
+func IsSigned(state *config.State, kh *backend.KeyHierarchy, file, output string) (bool, error) {
+	ok, err := verifyFileHash(state, kh, hierarchy.Db, output)
+	if errors.Is(err, authenticode.ErrNoValidSignatures) || errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil || !ok {
+		return false, err
+	}
+	return ChecksumMatches(state, file, output)
+}
+
+// VerifyFileEnrolled checks the file against the firmware db instead of the
+// sbctl keys. The authenticode signatures are verified against the enrolled
+// X509 certificates, which need to be the signing certificate or on its chain
+// through the certificates embedded in the signature, and the authenticode
+// hash is compared with the enrolled SHA256 hashes. The db entry that allows
+// the file to boot is returned as a single signature list, or nil if no entry
+// matches.
+func VerifyFileEnrolled(state *config.State, file string) (*signature.SignatureList, error) {
+	db, err := state.Efivarfs.Getdb()
+	if err != nil {
+		return nil, fmt.Errorf("can't read db: %w", err)
+	}
+	peFile, err := state.Fs.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer peFile.Close()
+	peBinary, err := authenticode.Parse(peFile)
+	if err != nil {
+		return nil, err
+	}
+	sigs, err := peBinary.Signatures()
+	if err != nil {
+		return nil, err
+	}
+	hash := peBinary.Hash(crypto.SHA256)
+
+	for _, list := range *db {
+		for _, sig := range list.Signatures {
+			switch list.SignatureType {
+			case signature.CERT_X509_GUID:
+				if len(sigs) == 0 {
+					continue
+				}
+				cert, err := x509.ParseCertificate(sig.Data)
+				if err != nil {
+					continue
+				}
+				ok, err := backend.VerifyPEBinaryChain(peBinary, cert)
+				if errors.Is(err, authenticode.ErrNoValidSignatures) {
+					continue
+				} else if err != nil {
+					return nil, err
+				}
+				if !ok {
+					continue
+				}
+			case signature.CERT_SHA256_GUID:
+				if !bytes.Equal(sig.Data, hash) {
+					continue
+				}
+			default:
+				continue
+			}
+			return &signature.SignatureList{
+				SignatureType: list.SignatureType,
+				Signatures:    []signature.SignatureData{sig},
+			}, nil
+		}
+	}
+	return nil, nil
+}
+
 var ErrAlreadySigned = errors.New("already signed file")
 
 func SignFile(state *config.State, kh *backend.KeyHierarchy, ev hierarchy.Hierarchy, file, output string) error {
@@ -87,7 +231,7 @@ func SignFile(state *config.State, kh *backend.KeyHierarchy, ev hierarchy.Hierar
 	// Let's check if we have signed it already AND the original file hasn't changed
 	// TODO: This will run authenticode.Parse again, *and* open the file
 	// this should be refactored to be nicer
-	ok, err := VerifyFile(state, kh, ev, output)
+	ok, err := verifyFileHash(state, kh, ev, output)
 	if errors.Is(err, authenticode.ErrNoValidSignatures) {
 		// If we tried to verify the file, but it has signatures but nothing signed
 		// by our key, we catch the error and continue.
@@ -101,16 +245,206 @@ func SignFile(state *config.State, kh *backend.KeyHierarchy, ev hierarchy.Hierar
 		return err
 	}
 
-	b, err := kh.SignFile(ev, inputBinary)
+	sig, err := fileSignature(state, kh, ev, inputBinary)
+	if err != nil {
+		return err
+	}
+	if err := inputBinary.AppendSignature(sig); err != nil {
+		return err
+	}
+
+	b, err := signedImage(state, inputBinary)
+	if err != nil {
+		return err
+	}
+	return writeSigned(state, file, output, b, si.Mode())
+}
+
+// writeSigned writes the signed file to output between the sign hooks
+func writeSigned(state *config.State, file, output string, b []byte, perm os.FileMode) error {
+	env := []string{"SBCTL_FILE=" + file, "SBCTL_OUTPUT=" + output}
+	return withHooks(state.Config, HookPreSign, HookPostSign, env, func() error {
+		return fs.WriteFile(state.Fs, output, b, perm)
+	})
+}
+
+// signedImage returns the bytes of the signed binary. The PE checksum covers
+// the signatures, so with fix_pe_checksum it is updated after they are added.
+func signedImage(state *config.State, peBinary *authenticode.PECOFFBinary) ([]byte, error) {
+	b := peBinary.Bytes()
+	if state.Config.FixPEChecksum {
+		if _, err := FixPEChecksum(b); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// fileSignature returns the authenticode signature of the binary, hashed with
+// the algorithm in the configuration. Signatures by a db key issued by a CA
+// embed the certificate chain, and they are timestamped by the TSA in the
+// configuration.
+func fileSignature(state *config.State, kh *backend.KeyHierarchy, ev hierarchy.Hierarchy, peBinary *authenticode.PECOFFBinary) ([]byte, error) {
+	alg, err := backend.ParseHashAlgorithm(state.Config.HashAlgo)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := kh.SignFileDetached(ev, peBinary, alg)
+	if err != nil {
+		return nil, err
+	}
+	if ev == hierarchy.Db {
+		chain, err := DbCertChain(state, kh)
+		if err != nil {
+			return nil, err
+		}
+		// The root CA is enrolled in db, only the intermediates are embedded
+		if len(chain) > 1 {
+			if sig, err = embedCertificates(sig, chain[:len(chain)-1]); err != nil {
+				return nil, fmt.Errorf("can't embed the certificate chain: %w", err)
+			}
+		}
+	}
+	if state.Config.TimestampURL != "" {
+		if sig, err = TimestampSignature(state.Config.TimestampURL, sig); err != nil {
+			return nil, err
+		}
+	}
+	return sig, nil
+}
+
+// SignFileDetached writes the authenticode signature of file to output,
+// leaving file untouched.
+func SignFileDetached(state *config.State, kh *backend.KeyHierarchy, ev hierarchy.Hierarchy, file, output string) error {
+	if output == "" {
+		output = file + ".sig"
+	}
+
+	peFile, err := state.Fs.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s does not exist", file)
+	} else if err != nil {
+		return err
+	}
+	defer peFile.Close()
+
+	peBinary, err := authenticode.Parse(peFile)
 	if err != nil {
 		return err
 	}
 
-	if err = fs.WriteFile(state.Fs, output, b, si.Mode()); err != nil {
+	sig, err := fileSignature(state, kh, ev, peBinary)
+	if err != nil {
 		return err
 	}
+	return writeSigned(state, file, output, sig, 0o644)
+}
 
-	return nil
+// VerifyFileDetached checks file against the detached signature in sigfile
+func VerifyFileDetached(state *config.State, kh *backend.KeyHierarchy, ev hierarchy.Hierarchy, file, sigfile string) (bool, error) {
+	sig, err := fs.ReadFile(state.Fs, sigfile)
+	if err != nil {
+		return false, err
+	}
+	peFile, err := state.Fs.Open(file)
+	if err != nil {
+		return false, err
+	}
+	defer peFile.Close()
+	return kh.VerifyFileDetached(ev, peFile, sig)
+}
+
+var ErrSignatureMismatch = errors.New("the signature is not for this file")
+
+// TBSHash returns the SHA256 digest of the DER encoded signed attributes of
+// the authenticode signature of file. An external signer signs the digest,
+// and the raw signature is attached with AttachSignature.
+func TBSHash(state *config.State, file string) ([]byte, error) {
+	peFile, err := state.Fs.Open(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%s does not exist", file)
+	} else if err != nil {
+		return nil, err
+	}
+	defer peFile.Close()
+
+	peBinary, err := authenticode.Parse(peFile)
+	if err != nil {
+		return nil, err
+	}
+	attributes, err := backend.ExternalSignedAttributes(peBinary.HashContent.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(attributes)
+	return digest[:], nil
+}
+
+// AttachSignature embeds a signature produced outside of sbctl into file and
+// writes it to output. sig is either the raw signature of the TBSHash digest,
+// made with the key of cert, or a PKCS#7 authenticode signature, which has to
+// be for the authenticode hash of the file and verify with one of the
+// certificates included in it.
+func AttachSignature(state *config.State, file, output string, sig []byte, cert *x509.Certificate) error {
+	if output == "" {
+		output = file
+	}
+
+	si, err := state.Fs.Stat(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s does not exist", file)
+	} else if err != nil {
+		return fmt.Errorf("failed stat of file: %w", err)
+	}
+	peFile, err := state.Fs.Open(file)
+	if err != nil {
+		return err
+	}
+	defer peFile.Close()
+
+	peBinary, err := authenticode.Parse(peFile)
+	if err != nil {
+		return err
+	}
+
+	auth, err := authenticode.ParseAuthenticode(sig)
+	if err != nil {
+		// A raw signature, the SignedData around it is built here
+		if cert == nil {
+			return errors.New("the certificate of the signing key is needed to attach a raw signature")
+		}
+		sig, err = backend.ExternalAuthenticode(cert, peBinary.HashContent.Bytes(), sig)
+		if err != nil {
+			return err
+		}
+		if auth, err = authenticode.ParseAuthenticode(sig); err != nil {
+			return err
+		}
+	}
+	if ok, err := backend.SignatureDigestMatches(auth, peBinary); err != nil {
+		return err
+	} else if !ok {
+		return ErrSignatureMismatch
+	}
+	var verified bool
+	for _, cert := range auth.Pkcs.Certs {
+		if ok, err := backend.VerifyAuthenticode(auth, cert, peBinary.HashContent.Bytes()); err == nil && ok {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return fmt.Errorf("%w: it doesn't verify with the certificates it includes", ErrSignatureMismatch)
+	}
+
+	if err := peBinary.AppendSignature(sig); err != nil {
+		return err
+	}
+	b, err := signedImage(state, peBinary)
+	if err != nil {
+		return err
+	}
+	return writeSigned(state, file, output, b, si.Mode())
 }
 
 // Map up our default keys in a struct
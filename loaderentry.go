@@ -0,0 +1,200 @@
+package sbctl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/foxboron/sbctl/fs"
+	"github.com/spf13/afero"
+)
+
+var (
+	ErrLoaderEntryNotOwned = errors.New("the loader entry wasn't written by sbctl")
+	ErrLoaderEntryType2    = errors.New("systemd-boot lists the bundles in EFI/Linux on its own, a loader entry would show the bundle twice")
+)
+
+// loaderEntryMarker is the first line of the loader entries written by sbctl.
+// Entries without it have been written by someone else, and are left alone.
+const loaderEntryMarker = "# Generated by sbctl, changes are overwritten\n"
+
+// LoaderEntry is a systemd-boot entry starting an EFI binary, as described by
+// the Boot Loader Specification
+type LoaderEntry struct {
+	Title   string
+	Version string
+	// EFI is the path of the binary relative to the ESP
+	EFI string
+}
+
+func (l *LoaderEntry) Bytes() []byte {
+	var b bytes.Buffer
+	b.WriteString(loaderEntryMarker)
+	fmt.Fprintf(&b, "title %s\n", l.Title)
+	if l.Version != "" {
+		fmt.Fprintf(&b, "version %s\n", l.Version)
+	}
+	fmt.Fprintf(&b, "efi %s\n", l.EFI)
+	return b.Bytes()
+}
+
+// LoaderEntryPath returns the path of the loader entry of the bundle, named
+// after the bundle in loader/entries on the ESP
+func LoaderEntryPath(bundle *Bundle) string {
+	name := strings.TrimSuffix(filepath.Base(bundle.Output), filepath.Ext(bundle.Output))
+	return filepath.Join(bundle.ESP, "loader", "entries", name+".conf")
+}
+
+// isSbctlLoaderEntry reports if the loader entry was written by sbctl
+func isSbctlLoaderEntry(b []byte) bool {
+	return bytes.HasPrefix(b, []byte(loaderEntryMarker))
+}
+
+// inLinuxDir reports if the bundle is in EFI/Linux on the ESP, where
+// systemd-boot picks up unified kernel images as Type #2 entries. The ESP is
+// FAT, so the case doesn't matter.
+func inLinuxDir(bundle *Bundle) bool {
+	rel, err := filepath.Rel(bundle.ESP, filepath.Dir(bundle.Output))
+	return err == nil && strings.EqualFold(filepath.ToSlash(rel), "EFI/Linux")
+}
+
+// osReleaseTitle returns PRETTY_NAME, or NAME, from an os-release file
+func osReleaseTitle(vfs afero.Fs, file string) (string, error) {
+	b, err := fs.ReadFile(vfs, file)
+	if err != nil {
+		return "", err
+	}
+	values := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok || strings.HasPrefix(key, "#") {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else {
+			value = strings.Trim(value, `'"`)
+		}
+		values[key] = value
+	}
+	for _, key := range []string{"PRETTY_NAME", "NAME"} {
+		if values[key] != "" {
+			return values[key], nil
+		}
+	}
+	return "Linux", nil
+}
+
+// kernelVersion reads the version string from the setup header of an x86
+// kernel image. Other images don't carry it, and an empty version is
+// returned.
+func kernelVersion(vfs afero.Fs, file string) (string, error) {
+	f, err := vfs.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	// The version string is within 64KiB of the setup header
+	b, err := io.ReadAll(io.LimitReader(f, 0x200+0x10000))
+	if err != nil {
+		return "", err
+	}
+	if len(b) < 0x210 || string(b[0x202:0x206]) != "HdrS" {
+		return "", nil
+	}
+	off := 0x200 + int(binary.LittleEndian.Uint16(b[0x20e:]))
+	if off >= len(b) {
+		return "", nil
+	}
+	version, _, _ := bytes.Cut(b[off:], []byte{0})
+	fields := strings.Fields(string(version))
+	if len(fields) == 0 {
+		return "", nil
+	}
+	return fields[0], nil
+}
+
+// BundleLoaderEntry returns the loader entry starting the bundle. The title is
+// taken from the os-release file and the version from the kernel image.
+func BundleLoaderEntry(vfs afero.Fs, bundle *Bundle) (*LoaderEntry, error) {
+	rel, err := filepath.Rel(bundle.ESP, bundle.Output)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return nil, fmt.Errorf("%s is not on the ESP %s", bundle.Output, bundle.ESP)
+	}
+	title, err := osReleaseTitle(vfs, bundle.OSRelease)
+	if err != nil {
+		return nil, err
+	}
+	version, err := kernelVersion(vfs, bundle.KernelImage)
+	if err != nil {
+		return nil, err
+	}
+	return &LoaderEntry{
+		Title:   title,
+		Version: version,
+		EFI:     "/" + filepath.ToSlash(rel),
+	}, nil
+}
+
+// WriteLoaderEntry writes the loader entry of the bundle. With onlyExisting
+// it's only updated if it was written before, so it's kept in sync with the
+// bundle. Entries which weren't written by sbctl are never replaced, and no
+// entry is written for bundles systemd-boot lists on its own. It reports if
+// the entry changed.
+func WriteLoaderEntry(vfs afero.Fs, bundle *Bundle, onlyExisting bool) (bool, error) {
+	path := LoaderEntryPath(bundle)
+	current, err := fs.ReadFile(vfs, path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if onlyExisting {
+			return false, nil
+		}
+	case err != nil:
+		return false, err
+	case !isSbctlLoaderEntry(current):
+		if onlyExisting {
+			return false, nil
+		}
+		return false, fmt.Errorf("%s: %w", path, ErrLoaderEntryNotOwned)
+	}
+	if !onlyExisting && inLinuxDir(bundle) {
+		return false, ErrLoaderEntryType2
+	}
+	entry, err := BundleLoaderEntry(vfs, bundle)
+	if err != nil {
+		return false, err
+	}
+	b := entry.Bytes()
+	if bytes.Equal(current, b) {
+		return false, nil
+	}
+	if err := vfs.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return false, err
+	}
+	return true, fs.WriteFile(vfs, path, b, 0o644)
+}
+
+// RemoveLoaderEntry removes the loader entry of the bundle. It reports if
+// there was an entry, and returns ErrLoaderEntryNotOwned for entries which
+// weren't written by sbctl, which are kept.
+func RemoveLoaderEntry(vfs afero.Fs, bundle *Bundle) (bool, error) {
+	path := LoaderEntryPath(bundle)
+	b, err := fs.ReadFile(vfs, path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if !isSbctlLoaderEntry(b) {
+		return false, fmt.Errorf("%s: %w", path, ErrLoaderEntryNotOwned)
+	}
+	return true, vfs.Remove(path)
+}
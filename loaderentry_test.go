@@ -0,0 +1,106 @@
+package sbctl
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+// fakeBzImage returns the start of an x86 kernel image with version in its
+// setup header
+func fakeBzImage(version string) []byte {
+	b := make([]byte, 0x400)
+	copy(b[0x202:], "HdrS")
+	binary.LittleEndian.PutUint16(b[0x20e:], 0x100)
+	copy(b[0x300:], version+" (builder@host) #1 SMP PREEMPT_DYNAMIC\x00")
+	return b
+}
+
+func TestWriteLoaderEntry(t *testing.T) {
+	vfs := afero.NewMemMapFs()
+	afero.WriteFile(vfs, "/usr/lib/os-release", []byte("NAME=\"Arch Linux\"\nPRETTY_NAME=\"Arch Linux\"\nID=arch\n"), 0o644)
+	afero.WriteFile(vfs, "/boot/vmlinuz-linux", fakeBzImage("6.11.1-arch1-1"), 0o644)
+	bundle := &Bundle{
+		Output:      "/efi/EFI/arch/linux.efi",
+		KernelImage: "/boot/vmlinuz-linux",
+		OSRelease:   "/usr/lib/os-release",
+		ESP:         "/efi",
+	}
+
+	// Only entries which were written before are updated
+	if changed, err := WriteLoaderEntry(vfs, bundle, true); err != nil || changed {
+		t.Fatalf("expected no entry to be written, got %v: %v", changed, err)
+	}
+	if changed, err := WriteLoaderEntry(vfs, bundle, false); err != nil || !changed {
+		t.Fatalf("expected the entry to be written, got %v: %v", changed, err)
+	}
+	b, err := afero.ReadFile(vfs, "/efi/loader/entries/linux.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "# Generated by sbctl, changes are overwritten\ntitle Arch Linux\nversion 6.11.1-arch1-1\nefi /EFI/arch/linux.efi\n"
+	if string(b) != expected {
+		t.Fatalf("expected entry:\n%s\ngot:\n%s", expected, b)
+	}
+	if changed, err := WriteLoaderEntry(vfs, bundle, true); err != nil || changed {
+		t.Fatalf("expected the entry to be up to date, got %v: %v", changed, err)
+	}
+
+	afero.WriteFile(vfs, "/boot/vmlinuz-linux", fakeBzImage("6.11.2-arch1-1"), 0o644)
+	if changed, err := WriteLoaderEntry(vfs, bundle, true); err != nil || !changed {
+		t.Fatalf("expected the entry to be updated, got %v: %v", changed, err)
+	}
+
+	// systemd-boot lists the bundles in EFI/Linux on its own
+	bundle.Output = "/efi/EFI/Linux/linux-lts.efi"
+	if _, err := WriteLoaderEntry(vfs, bundle, false); !errors.Is(err, ErrLoaderEntryType2) {
+		t.Fatalf("expected ErrLoaderEntryType2, got %v", err)
+	}
+
+	bundle.Output = "/boot/linux.efi"
+	if _, err := WriteLoaderEntry(vfs, bundle, false); err == nil {
+		t.Fatal("expected an error for a bundle outside of the ESP")
+	}
+}
+
+func TestLoaderEntryNotOwned(t *testing.T) {
+	vfs := afero.NewMemMapFs()
+	afero.WriteFile(vfs, "/usr/lib/os-release", []byte("NAME=\"Arch Linux\"\n"), 0o644)
+	afero.WriteFile(vfs, "/boot/vmlinuz-linux", fakeBzImage("6.11.1-arch1-1"), 0o644)
+	bundle := &Bundle{
+		Output:      "/efi/EFI/arch/linux.efi",
+		KernelImage: "/boot/vmlinuz-linux",
+		OSRelease:   "/usr/lib/os-release",
+		ESP:         "/efi",
+	}
+	handWritten := "title My Linux\nefi /EFI/arch/linux.efi\noptions quiet\n"
+	afero.WriteFile(vfs, "/efi/loader/entries/linux.conf", []byte(handWritten), 0o644)
+
+	// Entries written by someone else are neither updated nor removed
+	if changed, err := WriteLoaderEntry(vfs, bundle, true); err != nil || changed {
+		t.Fatalf("expected the entry to be left alone, got %v: %v", changed, err)
+	}
+	if _, err := WriteLoaderEntry(vfs, bundle, false); !errors.Is(err, ErrLoaderEntryNotOwned) {
+		t.Fatalf("expected ErrLoaderEntryNotOwned, got %v", err)
+	}
+	if _, err := RemoveLoaderEntry(vfs, bundle); !errors.Is(err, ErrLoaderEntryNotOwned) {
+		t.Fatalf("expected ErrLoaderEntryNotOwned, got %v", err)
+	}
+	if b, _ := afero.ReadFile(vfs, "/efi/loader/entries/linux.conf"); string(b) != handWritten {
+		t.Fatalf("the entry was changed:\n%s", b)
+	}
+
+	// Entries written by sbctl are removed
+	vfs.Remove("/efi/loader/entries/linux.conf")
+	if _, err := WriteLoaderEntry(vfs, bundle, false); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := RemoveLoaderEntry(vfs, bundle); err != nil || !removed {
+		t.Fatalf("expected the entry to be removed, got %v: %v", removed, err)
+	}
+	if ok, _ := afero.Exists(vfs, "/efi/loader/entries/linux.conf"); ok {
+		t.Fatal("the entry still exists")
+	}
+}
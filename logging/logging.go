@@ -1,9 +1,12 @@
 package logging
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
+	"strings"
 
 	"github.com/fatih/color"
 )
@@ -32,6 +35,10 @@ var (
 	on          bool
 	DisableInfo bool      = false
 	output      io.Writer = os.Stdout
+	// logger receives the messages of Println, Ok, NotOk, Unknown, Warn,
+	// Error and Fatal instead of them being printed, which allows structured
+	// log formats. Print is left alone as it prints the output of commands.
+	logger *slog.Logger
 )
 
 func PrintOn() {
@@ -46,6 +53,21 @@ func SetOutput(w io.Writer) {
 	output = w
 }
 
+// SetLogger routes log messages through l. Passing nil prints them again.
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
+// log sends msg to the logger if one is set. The logger writes to stderr, so
+// turning printing off for the output on stdout doesn't silence it.
+func log(level slog.Level, msg string) bool {
+	if logger == nil {
+		return false
+	}
+	logger.Log(context.Background(), level, strings.TrimRight(msg, "\n"))
+	return true
+}
+
 func PrintWithFile(f io.Writer, msg string, a ...interface{}) {
 	if on {
 		fmt.Fprintf(f, msg, a...)
@@ -63,6 +85,9 @@ func Println(msg string) {
 	if DisableInfo && output == os.Stdout {
 		return
 	}
+	if log(slog.LevelInfo, msg) {
+		return
+	}
 	PrintWithFile(output, msg+"\n")
 }
 
@@ -72,6 +97,9 @@ func Okf(m string, a ...interface{}) string {
 
 // Print ok string to stdout
 func Ok(m string, a ...interface{}) {
+	if log(slog.LevelInfo, fmt.Sprintf(m, a...)) {
+		return
+	}
 	Print(Okf(m, a...))
 }
 
@@ -81,6 +109,9 @@ func NotOkf(m string, a ...interface{}) string {
 
 // Print ok string to stdout
 func NotOk(m string, a ...interface{}) {
+	if log(slog.LevelWarn, fmt.Sprintf(m, a...)) {
+		return
+	}
 	Print(NotOkf(m, a...))
 }
 
@@ -89,6 +120,9 @@ func Unknownf(m string, a ...interface{}) string {
 }
 
 func Unknown(m string, a ...interface{}) {
+	if log(slog.LevelWarn, fmt.Sprintf(m, a...)) {
+		return
+	}
 	Print(Unknownf(m, a...))
 }
 
@@ -96,6 +130,9 @@ func Warnf(m string, a ...interface{}) string {
 	return fmt.Sprintf("%s %s\n", warn, fmt.Sprintf(m, a...))
 }
 func Warn(m string, a ...interface{}) {
+	if log(slog.LevelWarn, fmt.Sprintf(m, a...)) {
+		return
+	}
 	PrintWithFile(os.Stderr, Warnf(m, a...))
 }
 
@@ -104,6 +141,9 @@ func Fatalf(m string, a ...interface{}) string {
 }
 
 func Fatal(err error) {
+	if log(slog.LevelError, err.Error()) {
+		return
+	}
 	PrintWithFile(os.Stderr, Fatalf(err.Error()))
 }
 
@@ -112,6 +152,9 @@ func Errorf(m string, a ...interface{}) string {
 }
 
 func Error(err error) {
+	if log(slog.LevelError, err.Error()) {
+		return
+	}
 	PrintWithFile(os.Stderr, Errorf(err.Error()))
 }
 
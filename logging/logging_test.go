@@ -0,0 +1,67 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"testing"
+)
+
+func TestSetLogger(t *testing.T) {
+	var b bytes.Buffer
+	SetLogger(slog.New(slog.NewJSONHandler(&b, nil)))
+	defer SetLogger(nil)
+
+	Error(errors.New("failed"))
+	Println("done\n")
+
+	var lines []map[string]any
+	dec := json.NewDecoder(&b)
+	for dec.More() {
+		var line map[string]any
+		if err := dec.Decode(&line); err != nil {
+			t.Fatalf("log line is not json: %v", err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 log lines, got %d", len(lines))
+	}
+	if lines[0]["level"] != "ERROR" || lines[0]["msg"] != "failed" {
+		t.Fatalf("unexpected error line: %v", lines[0])
+	}
+	if lines[1]["level"] != "INFO" || lines[1]["msg"] != "done" {
+		t.Fatalf("unexpected info line: %v", lines[1])
+	}
+}
+
+func TestSetLoggerPrintOff(t *testing.T) {
+	var logs, out bytes.Buffer
+	SetLogger(slog.New(slog.NewJSONHandler(&logs, nil)))
+	SetOutput(&out)
+	defer SetLogger(nil)
+	defer SetOutput(os.Stdout)
+
+	// Messages are logged instead of printed to the output
+	Ok("signed %s", "/boot/vmlinuz-linux")
+	NotOk("not signed")
+	if out.Len() != 0 {
+		t.Fatalf("expected nothing in the output, got %q", out.String())
+	}
+	if n := bytes.Count(logs.Bytes(), []byte("\n")); n != 2 {
+		t.Fatalf("expected 2 log lines, got %d:\n%s", n, logs.String())
+	}
+
+	// --json turns printing off, the logs are still written
+	logs.Reset()
+	PrintOff()
+	defer PrintOn()
+	Println("done")
+	Warn("careful")
+	Error(errors.New("failed"))
+	if n := bytes.Count(logs.Bytes(), []byte("\n")); n != 3 {
+		t.Fatalf("expected 3 log lines with printing off, got %d:\n%s", n, logs.String())
+	}
+}
@@ -1,20 +1,37 @@
 package lsm
 
 import (
+	"fmt"
 	"log/slog"
+	"os"
 	"path/filepath"
 
 	"github.com/foxboron/sbctl/config"
 	"github.com/landlock-lsm/go-landlock/landlock"
+	"github.com/spf13/afero"
 
 	ll "github.com/landlock-lsm/go-landlock/landlock/syscall"
 )
 
 var (
 	rules []landlock.Rule
+	// Set when a TSA has to be contacted
+	network bool
+
+	// Ports a TSA is connected to, HTTP and HTTPS
+	tsaPorts = []uint16{80, 443}
+
+	// Directories with the certificates trusted by the system
+	certDirs = []string{"/etc/ssl", "/etc/pki", "/etc/ca-certificates", "/usr/share/ca-certificates"}
+
+	// Directories with the shared libraries and the dynamic loader of the
+	// executed programs
+	libDirs = []string{"/lib", "/lib64", "/usr/lib", "/usr/lib64"}
 
 	// Include file truncation
 	truncFile landlock.AccessFSSet = ll.AccessFSExecute | ll.AccessFSWriteFile | ll.AccessFSReadFile | ll.AccessFSTruncate
+	execFile  landlock.AccessFSSet = ll.AccessFSExecute | ll.AccessFSReadFile
+	execDir   landlock.AccessFSSet = ll.AccessFSExecute | ll.AccessFSReadFile | ll.AccessFSReadDir
 )
 
 func TruncFile(p string) landlock.FSRule {
@@ -45,6 +62,60 @@ func LandlockRulesFromConfig(conf *config.Config) {
 			"/dev/tpm0", "/dev/tpmrm0",
 		).IgnoreIfMissing(),
 	)
+	if conf.IPEPolicy != "" {
+		rules = append(rules, landlock.RWDirs(filepath.Dir(conf.IPEPolicy)).IgnoreIfMissing())
+	}
+	if conf.StatusFile != "" {
+		rules = append(rules, landlock.RWDirs(filepath.Dir(conf.StatusFile)).IgnoreIfMissing())
+	}
+	if conf.TimestampURL != "" {
+		AllowNetwork()
+	}
+}
+
+// AllowCertificates allows reading the certificates trusted by the system
+func AllowCertificates() {
+	rules = append(rules, landlock.RODirs(certDirs...).IgnoreIfMissing())
+}
+
+// AllowExec allows executing the programs, and reading the shared libraries
+// and the OpenSSL configuration they load
+func AllowExec(programs ...string) {
+	AllowCertificates()
+	rules = append(rules,
+		landlock.PathAccess(execFile, programs...).IgnoreIfMissing(),
+		landlock.PathAccess(execDir, libDirs...).IgnoreIfMissing(),
+		landlock.ROFiles("/etc/ld.so.cache", os.DevNull).IgnoreIfMissing(),
+	)
+}
+
+// AllowNetwork allows connecting to a TSA on the HTTP and HTTPS ports to
+// timestamp signatures, and reading the files needed to resolve its name and
+// verify its TLS certificate
+func AllowNetwork() {
+	network = true
+	AllowCertificates()
+	rules = append(rules,
+		landlock.ROFiles("/etc/resolv.conf", "/etc/hosts", "/etc/nsswitch.conf").IgnoreIfMissing(),
+	)
+}
+
+// LandlockExtraPaths allows reading and writing in the directories. They need
+// to exist as the rules would be ignored otherwise.
+func LandlockExtraPaths(vfs afero.Fs, paths []string) error {
+	for _, p := range paths {
+		fi, err := vfs.Stat(p)
+		if err != nil {
+			return fmt.Errorf("can't allow %s in landlock: %w", p, err)
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("can't allow %s in landlock: not a directory", p)
+		}
+	}
+	if len(paths) != 0 {
+		rules = append(rules, landlock.RWDirs(paths...))
+	}
+	return nil
 }
 
 func RestrictAdditionalPaths(r ...landlock.Rule) {
@@ -55,6 +126,14 @@ func Restrict() error {
 	for _, r := range rules {
 		slog.Debug("landlock", slog.Any("rule", r))
 	}
-	landlock.V5.BestEffort().RestrictNet()
+	var netRules []landlock.Rule
+	if network {
+		for _, port := range tsaPorts {
+			netRules = append(netRules, landlock.ConnectTCP(port))
+		}
+	}
+	if err := landlock.V5.BestEffort().RestrictNet(netRules...); err != nil {
+		return err
+	}
 	return landlock.V5.BestEffort().RestrictPaths(rules...)
 }
@@ -0,0 +1,172 @@
+package sbctl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/foxboron/go-uefi/efi/attributes"
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efi/util"
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/foxboron/go-uefi/efivarfs"
+)
+
+// Machine Owner Keys are certificates shim trusts in addition to db. They are
+// enrolled by writing the request to MokNew, which MokManager asks to confirm
+// with the password hashed in MokAuth on the next boot. Reference:
+// https://github.com/rhboot/shim/blob/main/MokVars.txt
+
+// Limits mokutil and MokManager put on the MOK password
+const (
+	mokPasswordMin = 1
+	mokPasswordMax = 256
+)
+
+var (
+	ErrMokEnrolled   = errors.New("the certificate is already enrolled as a MOK")
+	ErrMokPending    = errors.New("the certificate is already pending enrollment as a MOK")
+	ErrMokNoRequest  = errors.New("no MOK enrollment is pending")
+	ErrInvalidMokPwd = fmt.Errorf("the MOK password needs to be %d to %d ASCII characters", mokPasswordMin, mokPasswordMax)
+
+	ShimLockGUID = util.StringToGUID("605dab50-e046-4300-abb6-3dd810dd8b23")
+
+	// MokListRT is the runtime copy shim makes of the enrolled MOKs, which
+	// are only readable before ExitBootServices
+	MokListRT = efivar.Efivar{
+		Name:       "MokListRT",
+		GUID:       ShimLockGUID,
+		Attributes: attributes.EFI_VARIABLE_BOOTSERVICE_ACCESS | attributes.EFI_VARIABLE_RUNTIME_ACCESS,
+	}
+	// MokNew holds the MOKs pending enrollment
+	MokNew = efivar.Efivar{
+		Name:       "MokNew",
+		GUID:       ShimLockGUID,
+		Attributes: attributes.EFI_VARIABLE_NON_VOLATILE | attributes.EFI_VARIABLE_BOOTSERVICE_ACCESS | attributes.EFI_VARIABLE_RUNTIME_ACCESS,
+	}
+	// MokAuth is the hash of MokNew and the password of the request
+	MokAuth = efivar.Efivar{
+		Name:       "MokAuth",
+		GUID:       ShimLockGUID,
+		Attributes: attributes.EFI_VARIABLE_NON_VOLATILE | attributes.EFI_VARIABLE_BOOTSERVICE_ACCESS | attributes.EFI_VARIABLE_RUNTIME_ACCESS,
+	}
+)
+
+// readMokList reads a signature list variable of shim. A missing variable is
+// an empty list.
+func readMokList(ev *efivarfs.Efivarfs, v efivar.Efivar) (*signature.SignatureDatabase, error) {
+	var raw rawVariable
+	if err := ev.GetVar(v, &raw); errors.Is(err, os.ErrNotExist) {
+		return signature.NewSignatureDatabase(), nil
+	} else if err != nil {
+		return nil, fmt.Errorf("can't read %s: %w", v.Name, err)
+	}
+	db, err := signature.ReadSignatureDatabase(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("can't parse %s: %w", v.Name, err)
+	}
+	return &db, nil
+}
+
+// GetMokList returns the MOKs enrolled in shim. The list is empty if the
+// system wasn't booted with shim.
+func GetMokList(ev *efivarfs.Efivarfs) (*signature.SignatureDatabase, error) {
+	return readMokList(ev, MokListRT)
+}
+
+// GetMokNew returns the MOKs pending enrollment on the next boot
+func GetMokNew(ev *efivarfs.Efivarfs) (*signature.SignatureDatabase, error) {
+	return readMokList(ev, MokNew)
+}
+
+// MokAuthHash returns the MokAuth of a request, the SHA256 of MokNew followed
+// by the UCS-2 encoded password. mokutil has moved on to crypt(3) hashes, but
+// MokManager still checks the password it prompts for against this format.
+func MokAuthHash(mokNew []byte, password []byte) ([]byte, error) {
+	if len(password) < mokPasswordMin || len(password) > mokPasswordMax {
+		return nil, ErrInvalidMokPwd
+	}
+	h := sha256.New()
+	h.Write(mokNew)
+	for _, c := range password {
+		if c < 0x20 || c > 0x7e {
+			return nil, ErrInvalidMokPwd
+		}
+		_ = binary.Write(h, binary.LittleEndian, uint16(c))
+	}
+	return h.Sum(nil), nil
+}
+
+// EnrollMok adds the certificates to the pending MOK enrollment, which shim
+// asks to confirm with the password on the next boot. Certificates which are
+// already enrolled or pending are refused.
+func EnrollMok(ev *efivarfs.Efivarfs, certs []*x509.Certificate, password []byte) error {
+	enrolled, err := GetMokList(ev)
+	if err != nil {
+		return err
+	}
+	pending, err := GetMokNew(ev)
+	if err != nil {
+		return err
+	}
+	for _, cert := range certs {
+		switch {
+		case mokListContains(enrolled, cert.Raw):
+			return fmt.Errorf("%s: %w", cert.Subject, ErrMokEnrolled)
+		case mokListContains(pending, cert.Raw):
+			return fmt.Errorf("%s: %w", cert.Subject, ErrMokPending)
+		}
+		if err := pending.Append(signature.CERT_X509_GUID, *ShimLockGUID, cert.Raw); err != nil {
+			return err
+		}
+	}
+	auth, err := MokAuthHash(pending.Bytes(), password)
+	if err != nil {
+		return err
+	}
+	if err := ev.WriteVar(MokNew, pending); err != nil {
+		return fmt.Errorf("can't write MokNew: %w", err)
+	}
+	if err := ev.WriteVar(MokAuth, rawVariable(auth)); err != nil {
+		return fmt.Errorf("can't write MokAuth: %w", err)
+	}
+	return nil
+}
+
+// CancelMok removes the pending MOK enrollment. Writing a variable without
+// data deletes it.
+func CancelMok(ev *efivarfs.Efivarfs) error {
+	pending, err := GetMokNew(ev)
+	if err != nil {
+		return err
+	}
+	if len(*pending) == 0 {
+		return ErrMokNoRequest
+	}
+	for _, v := range []efivar.Efivar{MokAuth, MokNew} {
+		if err := ev.WriteVar(v, rawVariable(nil)); err != nil {
+			return fmt.Errorf("can't remove %s: %w", v.Name, err)
+		}
+	}
+	return nil
+}
+
+// mokListContains matches the certificate regardless of the owner, MOKs
+// enrolled by other tools may use another one
+func mokListContains(db *signature.SignatureDatabase, cert []byte) bool {
+	for _, list := range *db {
+		if !util.CmpEFIGUID(list.SignatureType, signature.CERT_X509_GUID) {
+			continue
+		}
+		for _, sig := range list.Signatures {
+			if bytes.Equal(sig.Data, cert) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+package sbctl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/hierarchy"
+	"github.com/spf13/afero"
+)
+
+func TestEnrollMok(t *testing.T) {
+	ev := OpenEfivarsDir(afero.NewMemMapFs(), "/tmp/efivars")
+	key, err := backend.NewFileKey(hierarchy.Db, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := key.Certificate()
+
+	if list, err := GetMokList(ev); err != nil || len(*list) != 0 {
+		t.Fatalf("expected no MOKs without shim, got %v: %v", list, err)
+	}
+	if err := EnrollMok(ev, []*x509.Certificate{cert}, []byte("pässword")); !errors.Is(err, ErrInvalidMokPwd) {
+		t.Fatalf("expected ErrInvalidMokPwd, got %v", err)
+	}
+	if err := EnrollMok(ev, []*x509.Certificate{cert}, []byte("password")); err != nil {
+		t.Fatalf("failed enrolling the MOK: %v", err)
+	}
+	pending, err := GetMokNew(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pending.BytesExists(signature.CERT_X509_GUID, *ShimLockGUID, cert.Raw) {
+		t.Fatalf("expected the certificate to be pending")
+	}
+
+	// MokAuth is the SHA256 of MokNew and the UCS-2 password
+	var raw rawVariable
+	if err := ev.GetVar(MokAuth, &raw); err != nil {
+		t.Fatalf("failed reading MokAuth: %v", err)
+	}
+	h := sha256.New()
+	h.Write(pending.Bytes())
+	_ = binary.Write(h, binary.LittleEndian, utf16.Encode([]rune("password")))
+	if !bytes.Equal(raw, h.Sum(nil)) {
+		t.Fatalf("unexpected MokAuth %x", []byte(raw))
+	}
+
+	if err := EnrollMok(ev, []*x509.Certificate{cert}, []byte("password")); !errors.Is(err, ErrMokPending) {
+		t.Fatalf("expected ErrMokPending, got %v", err)
+	}
+	if err := CancelMok(ev); err != nil {
+		t.Fatalf("failed cancelling the enrollment: %v", err)
+	}
+	if err := CancelMok(ev); !errors.Is(err, ErrMokNoRequest) {
+		t.Fatalf("expected ErrMokNoRequest, got %v", err)
+	}
+}
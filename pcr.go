@@ -0,0 +1,281 @@
+package sbctl
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efi/util"
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/config"
+	"github.com/google/go-attestation/attest"
+)
+
+var (
+	ErrUnsupportedPCR = errors.New("only PCR 4 and 7 can be predicted")
+
+	// Variables measured into PCR 7 which are recomputed from their current
+	// contents
+	secureBootVariables = []efivar.Efivar{
+		efivar.SecureBoot,
+		efivar.PK,
+		efivar.KEK,
+		efivar.Db,
+		efivar.Dbx,
+	}
+)
+
+// PredictablePCRs are the PCRs PredictPCR can compute
+var PredictablePCRs = []int{4, 7}
+
+// variableData is the UEFI_VARIABLE_DATA structure measured for EFI variables
+type variableData struct {
+	GUID util.EFIGUID
+	Name string
+	Data []byte
+}
+
+func parseVariableData(b []byte) (*variableData, error) {
+	var v variableData
+	r := bytes.NewReader(b)
+	var nameLen, dataLen uint64
+	for _, f := range []any{&v.GUID, &nameLen, &dataLen} {
+		if err := binary.Read(r, binary.LittleEndian, f); err != nil {
+			return nil, fmt.Errorf("malformed UEFI_VARIABLE_DATA: %w", err)
+		}
+	}
+	if nameLen*2+dataLen != uint64(r.Len()) {
+		return nil, fmt.Errorf("malformed UEFI_VARIABLE_DATA: unexpected length")
+	}
+	name := make([]uint16, nameLen)
+	if err := binary.Read(r, binary.LittleEndian, name); err != nil {
+		return nil, err
+	}
+	v.Name = string(utf16.Decode(name))
+	v.Data = make([]byte, dataLen)
+	if _, err := r.Read(v.Data); err != nil && dataLen != 0 {
+		return nil, err
+	}
+	return &v, nil
+}
+
+func (v *variableData) Bytes() []byte {
+	var b bytes.Buffer
+	name := utf16.Encode([]rune(v.Name))
+	binary.Write(&b, binary.LittleEndian, v.GUID)
+	binary.Write(&b, binary.LittleEndian, uint64(len(name)))
+	binary.Write(&b, binary.LittleEndian, uint64(len(v.Data)))
+	binary.Write(&b, binary.LittleEndian, name)
+	b.Write(v.Data)
+	return b.Bytes()
+}
+
+func (v *variableData) digest() []byte {
+	sum := sha256.Sum256(v.Bytes())
+	return sum[:]
+}
+
+// rawVariable is the unparsed contents of an EFI variable
+type rawVariable []byte
+
+func (r *rawVariable) Unmarshal(b *bytes.Buffer) error {
+	*r = bytes.Clone(b.Bytes())
+	return nil
+}
+
+func (r rawVariable) Marshal(b *bytes.Buffer) {
+	b.Write(r)
+}
+
+func (r rawVariable) Bytes() []byte {
+	return r
+}
+
+// imageLoadPath returns the file path of the image in a UEFI_IMAGE_LOAD_EVENT.
+// Images loaded from memory have no path.
+func imageLoadPath(b []byte) (string, error) {
+	// ImageLocationInMemory, ImageLengthInMemory, ImageLinkTimeAddress and
+	// LengthOfDevicePath
+	if len(b) < 32 {
+		return "", fmt.Errorf("malformed UEFI_IMAGE_LOAD_EVENT")
+	}
+	pathLen := binary.LittleEndian.Uint64(b[24:])
+	if pathLen > uint64(len(b)-32) {
+		return "", fmt.Errorf("malformed UEFI_IMAGE_LOAD_EVENT")
+	}
+	return devicePathFile(b[32 : 32+pathLen])
+}
+
+func extendPCR(pcr, digest []byte) []byte {
+	h := sha256.New()
+	h.Write(pcr)
+	h.Write(digest)
+	return h.Sum(nil)
+}
+
+type pcrPredictor struct {
+	state *config.State
+	esp   string
+	// Current contents of the Secure Boot variables by name
+	variables map[string][]byte
+	// sbctl's db certificate, measured as the authority for images which
+	// were verified by a certificate that is no longer enrolled
+	authority *signature.SignatureData
+}
+
+func newPCRPredictor(state *config.State, esp string) (*pcrPredictor, error) {
+	p := &pcrPredictor{state: state, esp: esp, variables: map[string][]byte{}}
+	for _, v := range secureBootVariables {
+		var raw rawVariable
+		err := state.Efivarfs.GetVar(v, &raw)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("can't read %s: %w", v.Name, err)
+		}
+		// Missing variables are measured with no data
+		p.variables[v.Name] = raw
+	}
+	if state.IsInstalled() {
+		guid, err := state.Config.GetGUID(state.Fs)
+		if err != nil {
+			return nil, err
+		}
+		kh, err := backend.GetKeyHierarchy(state.Fs, state)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := DbEnrollCertificate(state, kh)
+		if err != nil {
+			return nil, err
+		}
+		// The measured owner is the one the certificate is enrolled with
+		owner := *guid
+		if sb, err := signature.ReadSignatureDatabase(bytes.NewReader(p.variables[efivar.Db.Name])); err == nil {
+			if enrolled, ok := CertificateOwner(&sb, cert); ok {
+				owner = enrolled
+			}
+		}
+		p.authority = &signature.SignatureData{Owner: owner, Data: cert}
+	}
+	return p, nil
+}
+
+// driverConfig recomputes the measurement of a Secure Boot variable from its
+// current contents
+func (p *pcrPredictor) driverConfig(ev attest.Event) ([]byte, error) {
+	v, err := parseVariableData(ev.Data)
+	if err != nil {
+		return nil, err
+	}
+	for _, sbv := range secureBootVariables {
+		if v.Name == sbv.Name && util.CmpEFIGUID(v.GUID, *sbv.GUID) {
+			v.Data = p.variables[v.Name]
+			return v.digest(), nil
+		}
+	}
+	return ev.Digest, nil
+}
+
+// variableAuthority recomputes the measurement of the db entry which verified an
+// image. Entries which are no longer enrolled are assumed to be replaced by
+// the sbctl db certificate.
+func (p *pcrPredictor) variableAuthority(ev attest.Event) ([]byte, error) {
+	v, err := parseVariableData(ev.Data)
+	if err != nil {
+		return nil, err
+	}
+	if v.Name != efivar.Db.Name || !util.CmpEFIGUID(v.GUID, *efivar.Db.GUID) || p.authority == nil || len(v.Data) < int(util.SizeofEFIGUID) {
+		return ev.Digest, nil
+	}
+	db, err := signature.ReadSignatureDatabase(bytes.NewReader(p.variables[efivar.Db.Name]))
+	if err != nil {
+		return nil, fmt.Errorf("can't parse db: %w", err)
+	}
+	for _, list := range db {
+		for _, sig := range list.Signatures {
+			if bytes.Equal(sig.Data, v.Data[util.SizeofEFIGUID:]) {
+				return ev.Digest, nil
+			}
+		}
+	}
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, p.authority.Owner)
+	b.Write(p.authority.Data)
+	v.Data = b.Bytes()
+	return v.digest(), nil
+}
+
+// bootApplication recomputes the measurement of an image loaded from the ESP
+// from the current file
+func (p *pcrPredictor) bootApplication(ev attest.Event) ([]byte, error) {
+	if p.esp == "" {
+		return ev.Digest, nil
+	}
+	path, err := imageLoadPath(ev.Data)
+	if err != nil || path == "" {
+		return ev.Digest, nil
+	}
+	f, err := p.state.Fs.Open(filepath.Join(p.esp, strings.ReplaceAll(path, `\`, "/")))
+	if errors.Is(err, os.ErrNotExist) {
+		return ev.Digest, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	peBinary, err := authenticode.Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("can't parse %s: %w", path, err)
+	}
+	return peBinary.Hash(crypto.SHA256), nil
+}
+
+// PredictPCR computes the SHA256 value of the PCR on the next boot. The events
+// in the eventlog are replayed, with the measurements of the Secure Boot
+// variables and the db authority recomputed for PCR 7, and the measurements of
+// the boot applications on esp recomputed for PCR 4.
+func PredictPCR(state *config.State, eventlog string, esp string, pcr int) ([]byte, error) {
+	if !slices.Contains(PredictablePCRs, pcr) {
+		return nil, ErrUnsupportedPCR
+	}
+	events, err := GetEventlogEvents(state.Fs, eventlog)
+	if err != nil {
+		return nil, err
+	}
+	p, err := newPCRPredictor(state, esp)
+	if err != nil {
+		return nil, err
+	}
+
+	value := make([]byte, sha256.Size)
+	for _, ev := range events {
+		if ev.Index != pcr {
+			continue
+		}
+		digest := ev.Digest
+		switch ev.Type.String() {
+		case "EV_NO_ACTION":
+			continue
+		case "EV_EFI_VARIABLE_DRIVER_CONFIG":
+			digest, err = p.driverConfig(ev)
+		case "EV_EFI_VARIABLE_AUTHORITY":
+			digest, err = p.variableAuthority(ev)
+		case "EV_EFI_BOOT_SERVICES_APPLICATION":
+			digest, err = p.bootApplication(ev)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can't compute %s event: %w", ev.Type, err)
+		}
+		value = extendPCR(value, digest)
+	}
+	return value, nil
+}
@@ -0,0 +1,102 @@
+package sbctl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/foxboron/go-uefi/efi/efitest"
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/foxboron/go-uefi/efivarfs/testfs"
+	"github.com/foxboron/sbctl/config"
+	"github.com/spf13/afero"
+)
+
+func TestVariableData(t *testing.T) {
+	for _, test := range tests {
+		if test.Result == ErrNoEventlog {
+			continue
+		}
+		events, err := GetEventlogEvents(afero.NewOsFs(), test.File)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ev := range events {
+			if ev.Type.String() != "EV_EFI_VARIABLE_DRIVER_CONFIG" {
+				continue
+			}
+			v, err := parseVariableData(ev.Data)
+			if err != nil {
+				t.Fatalf("%s: %v", test.File, err)
+			}
+			if !bytes.Equal(v.digest(), ev.Digest) {
+				t.Fatalf("%s: digest of %s doesn't match the eventlog", test.File, v.Name)
+			}
+		}
+	}
+}
+
+func TestPredictPCR(t *testing.T) {
+	eventlog := "tests/tpm_eventlogs/t480s_eventlog"
+	state := &config.State{
+		Fs:       afero.NewOsFs(),
+		Efivarfs: testfs.NewTestFS().With(efitest.SetUpModeOn()).Open(),
+		Config:   &config.Config{Keydir: "/nonexistent"},
+	}
+	events, err := GetEventlogEvents(state.Fs, eventlog)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Enroll the variables as they were measured, and replay the eventlog
+	replay := make([]byte, sha256.Size)
+	for _, ev := range events {
+		if ev.Index != 7 || ev.Type.String() == "EV_NO_ACTION" {
+			continue
+		}
+		replay = extendPCR(replay, ev.Digest)
+		if ev.Type.String() != "EV_EFI_VARIABLE_DRIVER_CONFIG" {
+			continue
+		}
+		v, err := parseVariableData(ev.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, sbv := range secureBootVariables {
+			if sbv.Name == v.Name && len(v.Data) != 0 {
+				if err := state.Efivarfs.WriteVar(sbv, signedUpdate(v.Data)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	predicted, err := PredictPCR(state, eventlog, "", 7)
+	if err != nil {
+		t.Fatalf("failed predicting PCR 7: %v", err)
+	}
+	if !bytes.Equal(predicted, replay) {
+		t.Fatalf("prediction with unchanged variables doesn't match the eventlog")
+	}
+
+	db := signature.NewSignatureDatabase()
+	sum := sha256.Sum256([]byte("new binary"))
+	if err := db.Append(signature.CERT_SHA256_GUID, eventlogGUID, sum[:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.Efivarfs.WriteVar(efivar.Db, db); err != nil {
+		t.Fatal(err)
+	}
+	predicted, err = PredictPCR(state, eventlog, "", 7)
+	if err != nil {
+		t.Fatalf("failed predicting PCR 7: %v", err)
+	}
+	if bytes.Equal(predicted, replay) {
+		t.Fatalf("prediction didn't change with the enrolled db")
+	}
+
+	if _, err := PredictPCR(state, eventlog, "", 11); err != ErrUnsupportedPCR {
+		t.Fatalf("expected ErrUnsupportedPCR, got %v", err)
+	}
+}
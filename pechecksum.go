@@ -0,0 +1,97 @@
+package sbctl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/fs"
+)
+
+var ErrNotPE = errors.New("not a PE image")
+
+// peChecksumOffset returns the offset of the CheckSum field of the optional
+// header, which is at the same place for PE32 and PE32+
+func peChecksumOffset(b []byte) (int, error) {
+	if len(b) < 0x40 || b[0] != 'M' || b[1] != 'Z' {
+		return 0, ErrNotPE
+	}
+	sig := int64(binary.LittleEndian.Uint32(b[0x3c:]))
+	// PE signature, COFF file header and the optional header up to CheckSum
+	off := sig + 4 + 20 + 64
+	if off+4 > int64(len(b)) || !bytes.Equal(b[sig:sig+4], []byte("PE\x00\x00")) {
+		return 0, ErrNotPE
+	}
+	return int(off), nil
+}
+
+// PEChecksum computes the checksum of the image the way CheckSumMappedFile
+// does, the 16-bit one's complement sum of the image without the CheckSum
+// field plus the size of the image. It returns the checksum stored in the
+// optional header and the computed one.
+func PEChecksum(b []byte) (stored, computed uint32, err error) {
+	off, err := peChecksumOffset(b)
+	if err != nil {
+		return 0, 0, err
+	}
+	var sum uint32
+	for i := 0; i < len(b); i += 2 {
+		var word uint32
+		// The CheckSum field is counted as zero
+		if i < off || i >= off+4 {
+			word = uint32(b[i])
+		}
+		if i+1 < len(b) && (i+1 < off || i+1 >= off+4) {
+			word |= uint32(b[i+1]) << 8
+		}
+		sum += word
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	sum = (sum & 0xffff) + (sum >> 16)
+	return binary.LittleEndian.Uint32(b[off:]), sum + uint32(len(b)), nil
+}
+
+// FixPEChecksum updates the CheckSum field of the image, and reports if it
+// was stale. The field is excluded from the authenticode hash, so fixing it
+// keeps the signatures valid.
+func FixPEChecksum(b []byte) (bool, error) {
+	stored, computed, err := PEChecksum(b)
+	if err != nil {
+		return false, err
+	}
+	if stored == computed {
+		return false, nil
+	}
+	off, _ := peChecksumOffset(b)
+	binary.LittleEndian.PutUint32(b[off:], computed)
+	return true, nil
+}
+
+// FixPEChecksumFile writes file to output with the PE checksum recomputed,
+// without signing it. It reports if the checksum was stale.
+func FixPEChecksumFile(state *config.State, file, output string) (bool, error) {
+	if output == "" {
+		output = file
+	}
+	si, err := state.Fs.Stat(file)
+	if err != nil {
+		return false, err
+	}
+	b, err := fs.ReadFile(state.Fs, file)
+	if err != nil {
+		return false, err
+	}
+	fixed, err := FixPEChecksum(b)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", file, err)
+	}
+	if !fixed && file == output {
+		return false, nil
+	}
+	if err := fs.WriteFile(state.Fs, output, b, si.Mode()); err != nil {
+		return false, err
+	}
+	return fixed, nil
+}
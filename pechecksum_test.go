@@ -0,0 +1,41 @@
+package sbctl
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestFixPEChecksum(t *testing.T) {
+	b, err := os.ReadFile("tests/binaries/test.pecoff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, computed, err := PEChecksum(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != computed {
+		t.Fatalf("expected the checksum of the test binary to be valid, got %x, computed %x", stored, computed)
+	}
+
+	off, err := peChecksumOffset(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.LittleEndian.PutUint32(b[off:], 0xdeadbeef)
+	if fixed, err := FixPEChecksum(b); err != nil || !fixed {
+		t.Fatalf("expected the mangled checksum to be fixed: %v", err)
+	}
+	if got := binary.LittleEndian.Uint32(b[off:]); got != computed {
+		t.Fatalf("expected the checksum %x, got %x", computed, got)
+	}
+	if fixed, err := FixPEChecksum(b); err != nil || fixed {
+		t.Fatalf("expected a valid checksum to be left alone: %v", err)
+	}
+
+	if _, err := FixPEChecksum([]byte("not a PE image")); !errors.Is(err, ErrNotPE) {
+		t.Fatalf("expected ErrNotPE, got %v", err)
+	}
+}
@@ -0,0 +1,216 @@
+package sbctl
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"os"
+	"sort"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/fs"
+)
+
+// checkPEAlignment checks the alignment and layout of the headers and sections
+// against the optional header
+func checkPEAlignment(b []byte, f *pe.File) []string {
+	var problems []string
+	var fileAlign, sectionAlign, sizeOfHeaders, sizeOfImage uint32
+	switch h := f.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		fileAlign, sectionAlign = h.FileAlignment, h.SectionAlignment
+		sizeOfHeaders, sizeOfImage = h.SizeOfHeaders, h.SizeOfImage
+	case *pe.OptionalHeader64:
+		fileAlign, sectionAlign = h.FileAlignment, h.SectionAlignment
+		sizeOfHeaders, sizeOfImage = h.SizeOfHeaders, h.SizeOfImage
+	default:
+		return []string{"the image has no optional header"}
+	}
+	if fileAlign == 0 || bits.OnesCount32(fileAlign) != 1 {
+		problems = append(problems, fmt.Sprintf("FileAlignment %#x is not a power of two", fileAlign))
+		fileAlign = 1
+	}
+	if sectionAlign == 0 || bits.OnesCount32(sectionAlign) != 1 {
+		problems = append(problems, fmt.Sprintf("SectionAlignment %#x is not a power of two", sectionAlign))
+		sectionAlign = 1
+	} else if sectionAlign < fileAlign {
+		problems = append(problems, fmt.Sprintf("SectionAlignment %#x is smaller than FileAlignment %#x", sectionAlign, fileAlign))
+	}
+	if int64(sizeOfHeaders) > int64(len(b)) {
+		problems = append(problems, fmt.Sprintf("SizeOfHeaders %#x is past the end of the file", sizeOfHeaders))
+	}
+	if sizeOfImage%sectionAlign != 0 {
+		problems = append(problems, fmt.Sprintf("SizeOfImage %#x is not aligned to SectionAlignment %#x", sizeOfImage, sectionAlign))
+	}
+
+	raw := make([]*pe.Section, 0, len(f.Sections))
+	for _, s := range f.Sections {
+		if s.VirtualAddress+s.VirtualSize > sizeOfImage {
+			problems = append(problems, fmt.Sprintf("section %s ends past SizeOfImage %#x", s.Name, sizeOfImage))
+		}
+		// Sections without data in the file, like .bss, aren't hashed
+		if s.Size == 0 {
+			continue
+		}
+		if s.VirtualAddress%sectionAlign != 0 {
+			problems = append(problems, fmt.Sprintf("section %s at virtual address %#x is not aligned to SectionAlignment %#x", s.Name, s.VirtualAddress, sectionAlign))
+		}
+		raw = append(raw, s)
+		if s.Offset%fileAlign != 0 {
+			problems = append(problems, fmt.Sprintf("section %s at file offset %#x is not aligned to FileAlignment %#x", s.Name, s.Offset, fileAlign))
+		}
+		if s.Offset < sizeOfHeaders {
+			problems = append(problems, fmt.Sprintf("section %s at file offset %#x overlaps the headers", s.Name, s.Offset))
+		}
+		if int64(s.Offset)+int64(s.Size) > int64(len(b)) {
+			problems = append(problems, fmt.Sprintf("section %s ends past the end of the file", s.Name))
+		}
+	}
+	sort.Slice(raw, func(i, j int) bool { return raw[i].Offset < raw[j].Offset })
+	for i := 1; i < len(raw); i++ {
+		if prev := raw[i-1]; int64(prev.Offset)+int64(prev.Size) > int64(raw[i].Offset) {
+			problems = append(problems, fmt.Sprintf("sections %s and %s overlap in the file", prev.Name, raw[i].Name))
+		}
+	}
+	return problems
+}
+
+// checkPECertTable checks that the certificate table is at the end of the
+// image and only holds signatures, so no data is hidden after them
+func checkPECertTable(b []byte, dir pe.DataDirectory) []string {
+	var problems []string
+	off, size := int64(dir.VirtualAddress), int64(dir.Size)
+	end := off + size
+	switch {
+	case end > int64(len(b)):
+		return []string{fmt.Sprintf("the certificate table at %#x extends %d bytes past the end of the file", off, end-int64(len(b)))}
+	case end < int64(len(b)):
+		problems = append(problems, fmt.Sprintf("%d bytes are appended after the certificate table", int64(len(b))-end))
+	}
+	if off%8 != 0 {
+		problems = append(problems, fmt.Sprintf("the certificate table at %#x is not aligned to 8 bytes", off))
+	}
+	if sectionsEnd := int64(peSectionsEnd(b)); off < sectionsEnd {
+		problems = append(problems, fmt.Sprintf("the certificate table at %#x overlaps the sections, which end at %#x", off, sectionsEnd))
+	}
+
+	table := b[off:end]
+	for i := 0; len(table) > 0; i++ {
+		if len(table) < signature.SizeofWINCertificate {
+			problems = append(problems, fmt.Sprintf("%d bytes of unknown data at the end of the certificate table", len(table)))
+			break
+		}
+		length := int(binary.LittleEndian.Uint32(table))
+		revision := binary.LittleEndian.Uint16(table[4:])
+		certType := binary.LittleEndian.Uint16(table[6:])
+		if length < signature.SizeofWINCertificate || length > len(table) {
+			problems = append(problems, fmt.Sprintf("signature %d has an invalid length of %d bytes", i+1, length))
+			break
+		}
+		if revision != 0x0200 || signature.WINCertType(certType) != signature.WIN_CERT_TYPE_PKCS_SIGNED_DATA {
+			problems = append(problems, fmt.Sprintf("signature %d is not a PKCS#7 signature (revision %#x, type %#x)", i+1, revision, certType))
+		}
+		// Each signature is padded with zeros to 8 bytes
+		padded := min(len(table), (length+7)&^7)
+		if pad := table[length:padded]; bytes.Count(pad, []byte{0}) != len(pad) {
+			problems = append(problems, fmt.Sprintf("the padding of signature %d is not zero", i+1))
+		}
+		table = table[padded:]
+	}
+	return problems
+}
+
+// checkPESignatures checks that the authenticode hash covers everything
+// outside of the checksum and the certificate table, and that the signatures
+// are for that hash
+func checkPESignatures(b []byte, dir pe.DataDirectory) ([]string, error) {
+	peBinary, err := authenticode.Parse(bytes.NewReader(b))
+	if err != nil {
+		return []string{fmt.Sprintf("can't compute the authenticode hash: %v", err)}, nil
+	}
+	var problems []string
+	// The CheckSum field, the certificate table entry and the certificate
+	// table are excluded from the hash, which is padded to 8 bytes
+	expected := len(b) - 4 - 8 - int(dir.Size)
+	_, padding := authenticode.PaddingBytes(len(b), 8)
+	if hashed := peBinary.HashContent.Len() - padding; hashed != expected {
+		problems = append(problems, fmt.Sprintf("the authenticode hash covers %d bytes instead of the %d bytes of the image", hashed, expected))
+	}
+	sigs, err := peBinary.Signatures()
+	if err != nil {
+		return append(problems, fmt.Sprintf("can't read the signatures: %v", err)), nil
+	}
+	for i, sig := range sigs {
+		auth, err := authenticode.ParseAuthenticode(sig.Certificate)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("signature %d can't be parsed: %v", i+1, err))
+			continue
+		}
+		ok, err := backend.SignatureDigestMatches(auth, peBinary)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			problems = append(problems, fmt.Sprintf("signature %d is not for the authenticode hash of the image", i+1))
+		}
+	}
+	return problems, nil
+}
+
+// CheckPEStructure parses the image and returns the problems with its
+// structure: misaligned or overlapping sections, an authenticode hash which
+// doesn't cover the image, signatures which are not for it, and data hidden
+// after the signatures. ErrNotPE is returned if it's not a PE image at all.
+func CheckPEStructure(b []byte) ([]string, error) {
+	if _, err := peChecksumOffset(b); err != nil {
+		return nil, err
+	}
+	f, err := pe.NewFile(bytes.NewReader(b))
+	if err != nil {
+		return []string{fmt.Sprintf("can't parse the PE headers: %v", err)}, nil
+	}
+	defer f.Close()
+	problems := checkPEAlignment(b, f)
+
+	var dir pe.DataDirectory
+	switch h := f.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		if h.NumberOfRvaAndSizes > 4 {
+			dir = h.DataDirectory[4]
+		}
+	case *pe.OptionalHeader64:
+		if h.NumberOfRvaAndSizes > 4 {
+			dir = h.DataDirectory[4]
+		}
+	}
+	if dir.Size != 0 {
+		problems = append(problems, checkPECertTable(b, dir)...)
+		// The hash can't be computed without the whole certificate table
+		if int64(dir.VirtualAddress)+int64(dir.Size) > int64(len(b)) {
+			return problems, nil
+		}
+	}
+	sigProblems, err := checkPESignatures(b, dir)
+	if err != nil {
+		return nil, err
+	}
+	return append(problems, sigProblems...), nil
+}
+
+// CheckPEStructureFile reads file and checks its structure with
+// CheckPEStructure
+func CheckPEStructureFile(state *config.State, file string) ([]string, error) {
+	b, err := fs.ReadFile(state.Fs, file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%s does not exist", file)
+	} else if err != nil {
+		return nil, err
+	}
+	return CheckPEStructure(b)
+}
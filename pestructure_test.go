@@ -0,0 +1,83 @@
+package sbctl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/foxboron/go-uefi/authenticode"
+)
+
+// testSignedPE returns the test binary signed with a throwaway key, and the
+// offset of the certificate table entry
+func testSignedPE(t *testing.T) ([]byte, int) {
+	peBinary, err := authenticode.Parse(bytes.NewReader(mustReadFile(t, "tests/binaries/test.pecoff")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, _ := testAuthenticodeSignature(t, peBinary.HashContent.Bytes())
+	if err := peBinary.AppendSignature(sig); err != nil {
+		t.Fatal(err)
+	}
+	b := peBinary.Bytes()
+	entry, err := peCertTableOffset(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, entry
+}
+
+func mustReadFile(t *testing.T, file string) []byte {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func expectProblem(t *testing.T, b []byte, problem string) {
+	t.Helper()
+	problems, err := CheckPEStructure(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		if strings.Contains(p, problem) {
+			return
+		}
+	}
+	t.Fatalf("expected a problem containing %q, got %q", problem, problems)
+}
+
+func TestCheckPEStructure(t *testing.T) {
+	unsigned := mustReadFile(t, "tests/binaries/test.pecoff")
+	if problems, err := CheckPEStructure(unsigned); err != nil || len(problems) != 0 {
+		t.Fatalf("expected the unsigned binary to be valid, got %q: %v", problems, err)
+	}
+	signed, entry := testSignedPE(t)
+	if problems, err := CheckPEStructure(signed); err != nil || len(problems) != 0 {
+		t.Fatalf("expected the signed binary to be valid, got %q: %v", problems, err)
+	}
+
+	appended := append(bytes.Clone(signed), "hidden data"...)
+	expectProblem(t, appended, "11 bytes are appended after the certificate table")
+
+	// Hiding the appended data in the certificate table keeps the signature
+	// valid, but it isn't a signature
+	hidden := append(bytes.Clone(signed), make([]byte, 16)...)
+	copy(hidden[len(signed):], "hidden data")
+	size := binary.LittleEndian.Uint32(hidden[entry+4:])
+	binary.LittleEndian.PutUint32(hidden[entry+4:], size+16)
+	expectProblem(t, hidden, "signature 2 has an invalid length")
+
+	tampered := bytes.Clone(signed)
+	tampered[len(tampered)/4] ^= 0xff
+	expectProblem(t, tampered, "signature 1 is not for the authenticode hash of the image")
+
+	if _, err := CheckPEStructure([]byte("not a PE image")); !errors.Is(err, ErrNotPE) {
+		t.Fatalf("expected ErrNotPE, got %v", err)
+	}
+}
@@ -0,0 +1,38 @@
+package quirks
+
+import (
+	"strings"
+
+	"github.com/foxboron/sbctl/dmi"
+)
+
+// DefaultEnrollmentOrder is the order the Secure Boot variables are written
+// in. PK comes last as enrolling it ends Setup Mode.
+var DefaultEnrollmentOrder = []string{"db", "KEK", "PK"}
+
+type enrollmentQuirk struct {
+	// Matched against the start of the firmware vendor from the DMI table
+	Vendor string
+	Order  []string
+}
+
+// enrollmentQuirks lists firmware which needs the variables written in a
+// particular order. Writing them in another order may appear to succeed while
+// the firmware drops one of the variables.
+var enrollmentQuirks = []enrollmentQuirk{
+	// Aptio and InsydeH2O check a db update against the enrolled KEK even in
+	// Setup Mode, and drop a db written before the KEK it is signed with
+	{Vendor: "American Megatrends", Order: []string{"KEK", "db", "PK"}},
+	{Vendor: "Insyde", Order: []string{"KEK", "db", "PK"}},
+}
+
+// EnrollmentOrder returns the order the variables have to be written in on
+// this firmware, and the vendor of the matching quirk if there is one
+func EnrollmentOrder(table dmi.DMI) ([]string, string) {
+	for _, q := range enrollmentQuirks {
+		if table.FirmwareVendor != "" && strings.HasPrefix(table.FirmwareVendor, q.Vendor) {
+			return q.Order, q.Vendor
+		}
+	}
+	return DefaultEnrollmentOrder, ""
+}
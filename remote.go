@@ -0,0 +1,86 @@
+package sbctl
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Signed updates are a few KiB, anything larger than this is not an EFI
+// variable
+const maxSignedUpdateSize = 1 << 20
+
+var ErrChecksumMismatch = errors.New("checksum doesn't match")
+
+// NewHTTPSClient returns a client which only accepts servers with a
+// certificate issued by one of the PEM encoded certificates in caCerts, or by
+// the system roots if caCerts is empty.
+func NewHTTPSClient(caCerts []byte) (*http.Client, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(caCerts) != 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCerts) {
+			return nil, fmt.Errorf("no PEM certificates found in the CA certificate")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Scheme != "https" {
+				return fmt.Errorf("refusing redirect to %s", req.URL.Redacted())
+			}
+			if len(via) >= 10 {
+				return errors.New("too many redirects")
+			}
+			return nil
+		},
+	}, nil
+}
+
+// FetchSignedUpdate downloads a signed variable update over HTTPS. If sum is
+// not empty the SHA256 checksum of the download has to match the hex encoded
+// checksum. The update is validated like ReadSignedUpdate.
+func FetchSignedUpdate(client *http.Client, rawURL string, sum string) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("%s is not a https URL", u.Redacted())
+	}
+	resp, err := client.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("can't download %s: %s", u.Redacted(), resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxSignedUpdateSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("can't download %s: %w", u.Redacted(), err)
+	}
+	if len(b) > maxSignedUpdateSize {
+		return nil, fmt.Errorf("%s is larger than %d bytes", u.Redacted(), maxSignedUpdateSize)
+	}
+	if sum != "" {
+		got := sha256.Sum256(b)
+		if !strings.EqualFold(sum, hex.EncodeToString(got[:])) {
+			return nil, fmt.Errorf("%s: %w, got %x", u.Redacted(), ErrChecksumMismatch, got)
+		}
+	}
+	return ParseSignedUpdate(b, u.Redacted())
+}
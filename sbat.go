@@ -0,0 +1,179 @@
+package sbctl
+
+import (
+	"bytes"
+	"debug/pe"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/foxboron/go-uefi/efi/attributes"
+	"github.com/foxboron/go-uefi/efi/util"
+	"github.com/foxboron/go-uefi/efivar"
+	"github.com/foxboron/go-uefi/efivarfs"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/spf13/afero"
+)
+
+// SBAT revokes bootloaders by the generation of their components instead of
+// their hashes. Reference:
+// https://github.com/rhboot/shim/blob/main/SBAT.md
+
+var (
+	ErrNoSbat      = errors.New("no .sbat section")
+	ErrInvalidSbat = errors.New("invalid SBAT data")
+
+	// SbatLevelRT is the runtime copy shim makes of the SbatLevel variable,
+	// which is only readable before ExitBootServices
+	SbatLevelRT = efivar.Efivar{
+		Name:       "SbatLevelRT",
+		GUID:       util.StringToGUID("605dab50-e046-4300-abb6-3dd810dd8b23"),
+		Attributes: attributes.EFI_VARIABLE_BOOTSERVICE_ACCESS | attributes.EFI_VARIABLE_RUNTIME_ACCESS,
+	}
+)
+
+// SbatEntry is a component in the .sbat section of a binary, or in the SBAT
+// policy of shim
+type SbatEntry struct {
+	Component  string `json:"component"`
+	Generation int    `json:"generation"`
+	Vendor     string `json:"vendor,omitempty"`
+	Package    string `json:"package,omitempty"`
+	Version    string `json:"version,omitempty"`
+	URL        string `json:"url,omitempty"`
+}
+
+// parseSbat parses the CSV shim uses for SBAT data. Shim doesn't support
+// quoting, so neither do we.
+func parseSbat(b []byte) ([]SbatEntry, error) {
+	// The section is padded with NUL bytes
+	if i := bytes.IndexByte(b, 0); i != -1 {
+		b = b[:i]
+	}
+	entries := []SbatEntry{}
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) < 2 || fields[0] == "" {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidSbat, line)
+		}
+		gen, err := strconv.Atoi(fields[1])
+		if err != nil || gen < 0 {
+			return nil, fmt.Errorf("%w: invalid generation in %q", ErrInvalidSbat, line)
+		}
+		entry := SbatEntry{Component: fields[0], Generation: gen}
+		for i, f := range []*string{&entry.Vendor, &entry.Package, &entry.Version, &entry.URL} {
+			if len(fields) > i+2 {
+				*f = fields[i+2]
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// ParseSbat parses the contents of a .sbat section
+func ParseSbat(b []byte) ([]SbatEntry, error) {
+	entries, err := parseSbat(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%w: no components", ErrInvalidSbat)
+	}
+	return entries, nil
+}
+
+// ReadSbat returns the components in the .sbat section of a binary
+func ReadSbat(vfs afero.Fs, file string) ([]SbatEntry, error) {
+	b, err := fs.ReadFile(vfs, file)
+	if err != nil {
+		return nil, err
+	}
+	e, err := pe.NewFile(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	defer e.Close()
+	s := e.Section(".sbat")
+	if s == nil {
+		return nil, fmt.Errorf("%s: %w", file, ErrNoSbat)
+	}
+	data, err := s.Data()
+	if err != nil {
+		return nil, fmt.Errorf("%s: can't read .sbat section: %w", file, err)
+	}
+	if uint32(len(data)) > s.VirtualSize {
+		data = data[:s.VirtualSize]
+	}
+	entries, err := ParseSbat(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return entries, nil
+}
+
+// SbatLevel is the SBAT policy of shim. Binaries with a component below the
+// generation in the policy are refused.
+type SbatLevel struct {
+	// Datestamp of the policy, from the sbat line
+	Datestamp  string      `json:"datestamp"`
+	Components []SbatEntry `json:"components"`
+}
+
+// ParseSbatLevel parses the contents of the SbatLevel variable, a sbat line
+// with the datestamp of the policy followed by a component and generation per
+// line
+func ParseSbatLevel(b []byte) (*SbatLevel, error) {
+	entries, err := parseSbat(b)
+	if err != nil {
+		return nil, err
+	}
+	level := &SbatLevel{Components: []SbatEntry{}}
+	for _, e := range entries {
+		if e.Component == "sbat" && level.Datestamp == "" {
+			level.Datestamp = e.Vendor
+		}
+		level.Components = append(level.Components, SbatEntry{Component: e.Component, Generation: e.Generation})
+	}
+	return level, nil
+}
+
+// GetSbatLevel reads the SBAT policy applied by shim. Returns os.ErrNotExist
+// if the system wasn't booted with a shim supporting SBAT.
+func GetSbatLevel(ev *efivarfs.Efivarfs) (*SbatLevel, error) {
+	var raw rawVariable
+	if err := ev.GetVar(SbatLevelRT, &raw); err != nil {
+		return nil, err
+	}
+	return ParseSbatLevel(raw)
+}
+
+// SbatRevocation is a component of a binary below the generation of the SBAT
+// policy
+type SbatRevocation struct {
+	Component  string `json:"component"`
+	Generation int    `json:"generation"`
+	Required   int    `json:"required"`
+}
+
+// Revoked returns the components which make shim refuse the binary
+func (l *SbatLevel) Revoked(entries []SbatEntry) []SbatRevocation {
+	var revoked []SbatRevocation
+	for _, policy := range l.Components {
+		for _, e := range entries {
+			if e.Component == policy.Component && e.Generation < policy.Generation {
+				revoked = append(revoked, SbatRevocation{
+					Component:  e.Component,
+					Generation: e.Generation,
+					Required:   policy.Generation,
+				})
+			}
+		}
+	}
+	return revoked
+}
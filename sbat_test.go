@@ -0,0 +1,93 @@
+package sbctl
+
+import (
+	"debug/pe"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+var testSbat = []byte(`sbat,1,SBAT Version,sbat,1,https://github.com/rhboot/shim/blob/main/SBAT.md
+shim,3,UEFI shim,shim,1,https://github.com/rhboot/shim
+grub,1,Free Software Foundation,grub,2.06,https://www.gnu.org/software/grub/
+` + "\x00\x00")
+
+func TestParseSbat(t *testing.T) {
+	entries, err := ParseSbat(testSbat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 components, got %+v", entries)
+	}
+	grub := SbatEntry{
+		Component:  "grub",
+		Generation: 1,
+		Vendor:     "Free Software Foundation",
+		Package:    "grub",
+		Version:    "2.06",
+		URL:        "https://www.gnu.org/software/grub/",
+	}
+	if entries[2] != grub {
+		t.Fatalf("unexpected grub component: %+v", entries[2])
+	}
+
+	for _, b := range []string{"", "grub\n", "grub,one,vendor\n"} {
+		if _, err := ParseSbat([]byte(b)); !errors.Is(err, ErrInvalidSbat) {
+			t.Fatalf("expected ErrInvalidSbat for %q, got %v", b, err)
+		}
+	}
+}
+
+func TestSbatLevelRevoked(t *testing.T) {
+	level, err := ParseSbatLevel([]byte("sbat,1,2023012900\nshim,2\ngrub,3\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if level.Datestamp != "2023012900" {
+		t.Fatalf("unexpected datestamp %q", level.Datestamp)
+	}
+	entries, err := ParseSbat(testSbat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked := level.Revoked(entries)
+	if len(revoked) != 1 || revoked[0] != (SbatRevocation{Component: "grub", Generation: 1, Required: 3}) {
+		t.Fatalf("unexpected revocations: %+v", revoked)
+	}
+	if revoked := level.Revoked(entries[:2]); len(revoked) != 0 {
+		t.Fatalf("expected shim to be allowed, got %+v", revoked)
+	}
+}
+
+func TestReadSbat(t *testing.T) {
+	vfs := afero.NewOsFs()
+	file := mkUKI(t)
+	if _, err := ReadSbat(vfs, file); !errors.Is(err, ErrNoSbat) {
+		t.Fatalf("expected ErrNoSbat, got %v", err)
+	}
+
+	e, err := pe.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vma := nextSectionVMA(e)
+	e.Close()
+	sbat := filepath.Join(filepath.Dir(file), "sbat.csv")
+	if err := os.WriteFile(sbat, testSbat, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := objcopyAddSections(file, vma, nil, map[string]string{".sbat": sbat}); err != nil {
+		t.Fatalf("objcopy failed: %v", err)
+	}
+	entries, err := ReadSbat(vfs, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[1].Component != "shim" || entries[1].Generation != 3 {
+		t.Fatalf("unexpected components: %+v", entries)
+	}
+}
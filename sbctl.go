@@ -9,6 +9,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"slices"
+	"strings"
 
 	"github.com/foxboron/sbctl/backend"
 	"github.com/foxboron/sbctl/config"
@@ -43,7 +44,46 @@ var espLocations = []string{
 	"/boot",
 	"/boot/efi",
 }
-var ErrNoESP = errors.New("failed to find EFI system partition")
+var (
+	ErrNoESP       = errors.New("failed to find EFI system partition")
+	ErrMultipleESP = errors.New("found multiple EFI system partitions")
+)
+
+func isESP(e *LsblkEntry, pttype string) bool {
+	if e.Pttype != "gpt" && (e.Pttype != "" && pttype != "gpt") {
+		return false
+	}
+	return e.Fstype == "vfat" && e.Parttype == "c12a7328-f81f-11d2-ba4b-00a0c93ec93b"
+}
+
+// findMountedESPs returns the mountpoints of all mounted EFI system
+// partitions, regardless of where they are mounted. Only the first mountpoint
+// of a partition is returned.
+func findMountedESPs(b []byte) ([]string, error) {
+	var lsblkRoot LsblkRoot
+	if err := json.Unmarshal(b, &lsblkRoot); err != nil {
+		return nil, fmt.Errorf("failed to parse json: %v", err)
+	}
+	var esps []string
+	add := func(e *LsblkEntry, pttype string) {
+		if !isESP(e, pttype) {
+			return
+		}
+		for _, m := range append([]string{e.Mountpoint}, e.Mountpoints...) {
+			if m != "" {
+				esps = append(esps, m)
+				return
+			}
+		}
+	}
+	for _, e := range lsblkRoot.Blockdevices {
+		add(e, "")
+		for _, ce := range e.Children {
+			add(ce, e.Pttype)
+		}
+	}
+	return esps, nil
+}
 
 func findESP(b []byte) (string, error) {
 	var lsblkRoot LsblkRoot
@@ -55,15 +95,7 @@ func findESP(b []byte) (string, error) {
 	for _, lsblkEntry := range lsblkRoot.Blockdevices {
 		// This is our check function, that also checks mountpoints
 		checkDev := func(e *LsblkEntry, pttype string) *LsblkEntry {
-			if e.Pttype != "gpt" && (e.Pttype != "" && pttype != "gpt") {
-				return nil
-			}
-
-			if e.Fstype != "vfat" {
-				return nil
-			}
-
-			if e.Parttype != "c12a7328-f81f-11d2-ba4b-00a0c93ec93b" {
+			if !isESP(e, pttype) {
 				return nil
 			}
 
@@ -115,15 +147,57 @@ func GetESP(vfs afero.Fs) (string, error) {
 		_, _ = vfs.Stat(fmt.Sprintf("%s/does-not-exist", location))
 	}
 
-	out, err := exec.Command(
+	out, err := lsblk()
+	if err != nil {
+		return "", err
+	}
+	return findESP(out)
+}
+
+func lsblk() ([]byte, error) {
+	return exec.Command(
 		"lsblk",
 		"--json",
 		"--tree",
 		"--output", "PARTTYPE,MOUNTPOINT,PTTYPE,FSTYPE").Output()
+}
+
+// DetectESP finds the EFI system partition among the mounted filesystems. It
+// fails if more than one is mounted, as we can't tell which one is used.
+func DetectESP() (string, error) {
+	out, err := lsblk()
 	if err != nil {
 		return "", err
 	}
-	return findESP(out)
+	esps, err := findMountedESPs(out)
+	if err != nil {
+		return "", err
+	}
+	switch len(esps) {
+	case 0:
+		return "", ErrNoESP
+	case 1:
+		return esps[0], nil
+	}
+	return "", fmt.Errorf("%w: %s, select one with --esp", ErrMultipleESP, strings.Join(esps, ", "))
+}
+
+// ResolveESP returns the ESP given on the command line, the esp_mountpoint
+// from the configuration, the ESP from the environment, or the detected ESP,
+// in that order.
+func ResolveESP(state *config.State, esp string) (string, error) {
+	if esp != "" {
+		return esp, nil
+	}
+	if state.Config.ESPMountpoint != "" {
+		return state.Config.ESPMountpoint, nil
+	}
+	for _, env := range []string{"SYSTEMD_ESP_PATH", "ESP_PATH"} {
+		if envEspPath, found := os.LookupEnv(env); found {
+			return envEspPath, nil
+		}
+	}
+	return DetectESP()
 }
 
 func Sign(state *config.State, keys *backend.KeyHierarchy, file, output string, enroll bool) error {
@@ -141,11 +215,6 @@ func Sign(state *config.State, keys *backend.KeyHierarchy, file, output string,
 		}
 	}
 
-	kh, err := backend.GetKeyHierarchy(state.Fs, state)
-	if err != nil {
-		return err
-	}
-
 	files, err := ReadFileDatabase(state.Fs, state.Config.FilesDb)
 	if err != nil {
 		return fmt.Errorf("couldn't open database: %s", state.Config.FilesDb)
@@ -159,7 +228,7 @@ func Sign(state *config.State, keys *backend.KeyHierarchy, file, output string,
 	}
 
 	if entry, ok := files[file]; ok && output == entry.OutputFile {
-		err = SignFile(state, kh, hierarchy.Db, entry.File, entry.OutputFile)
+		err = SignFile(state, keys, hierarchy.Db, entry.File, entry.OutputFile)
 		// return early if signing fails
 		if err != nil {
 			return err
@@ -169,7 +238,7 @@ func Sign(state *config.State, keys *backend.KeyHierarchy, file, output string,
 			return err
 		}
 	} else {
-		err = SignFile(state, kh, hierarchy.Db, file, output)
+		err = SignFile(state, keys, hierarchy.Db, file, output)
 		// return early if signing fails
 		if err != nil {
 			return err
@@ -179,6 +248,17 @@ func Sign(state *config.State, keys *backend.KeyHierarchy, file, output string,
 	return err
 }
 
+// SaveFile adds the file, signed to output, to the file database without
+// signing it
+func SaveFile(state *config.State, file, output string) error {
+	files, err := ReadFileDatabase(state.Fs, state.Config.FilesDb)
+	if err != nil {
+		return fmt.Errorf("couldn't open database: %s", state.Config.FilesDb)
+	}
+	files[file] = &SigningEntry{File: file, OutputFile: output}
+	return WriteFileDatabase(state.Fs, state.Config.FilesDb, files)
+}
+
 func CombineFiles(vfs afero.Fs, microcode, initramfs string) (afero.File, error) {
 	for _, file := range []string{microcode, initramfs} {
 		if _, err := vfs.Stat(file); err != nil {
@@ -1,6 +1,7 @@
 package sbctl
 
 import (
+	"slices"
 	"testing"
 )
 
@@ -30,3 +31,28 @@ func TestGetESP(t *testing.T) {
 		}
 	}
 }
+
+func TestFindMountedESPs(t *testing.T) {
+	for _, c := range []struct {
+		lsblk []byte
+		esps  []string
+	}{
+		{
+			// ESPs outside of the usual locations are found as well
+			lsblk: []byte(`{"blockdevices":[{"parttype":null,"mountpoint":null,"pttype":"gpt","fstype":null,"mountpoints":[null],"children":[{"parttype":"c12a7328-f81f-11d2-ba4b-00a0c93ec93b","mountpoint":"/mnt/esp","pttype":"gpt","fstype":"vfat","mountpoints":["/mnt/esp"]},{"parttype":"0fc63daf-8483-4772-8e79-3d69d8477de4","mountpoint":"/","pttype":"gpt","fstype":"ext4","mountpoints":["/"]}]}]}`),
+			esps:  []string{"/mnt/esp"},
+		},
+		{
+			lsblk: []byte(`{"blockdevices":[{"parttype":null,"mountpoint":null,"pttype":"gpt","fstype":null,"mountpoints":[null],"children":[{"parttype":"c12a7328-f81f-11d2-ba4b-00a0c93ec93b","mountpoint":"/efi","pttype":"gpt","fstype":"vfat","mountpoints":["/efi"]}]},{"parttype":null,"mountpoint":null,"pttype":"gpt","fstype":null,"mountpoints":[null],"children":[{"parttype":"c12a7328-f81f-11d2-ba4b-00a0c93ec93b","mountpoint":"/boot","pttype":"gpt","fstype":"vfat","mountpoints":["/boot"]},{"parttype":"c12a7328-f81f-11d2-ba4b-00a0c93ec93b","mountpoint":null,"pttype":"gpt","fstype":"vfat","mountpoints":[null]}]}]}`),
+			esps:  []string{"/efi", "/boot"},
+		},
+	} {
+		esps, err := findMountedESPs(c.lsblk)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if !slices.Equal(esps, c.esps) {
+			t.Fatalf("expected %v, got %v", c.esps, esps)
+		}
+	}
+}
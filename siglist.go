@@ -1,13 +1,23 @@
 package sbctl
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"os"
 
+	"github.com/foxboron/go-uefi/efi/attributes"
 	"github.com/foxboron/go-uefi/efi/signature"
+	"github.com/foxboron/go-uefi/efi/util"
 	"github.com/foxboron/go-uefi/efivar"
 	"github.com/foxboron/go-uefi/efivarfs"
+	"github.com/foxboron/go-uefi/pkcs7"
 	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/spf13/afero"
 )
 
 type EFIVariables struct {
@@ -16,6 +26,49 @@ type EFIVariables struct {
 	KEK *signature.SignatureDatabase
 	Db  *signature.SignatureDatabase
 	Dbx *signature.SignatureDatabase
+	// Attributes the signature lists are enrolled with
+	Attributes WriteAttributes
+}
+
+var ErrInvalidAttributes = errors.New("invalid variable attributes")
+
+// WriteAttributes change the attributes the Secure Boot variables are written
+// with, for firmware which expects other flags than the default time based
+// authenticated write which replaces the variable.
+type WriteAttributes struct {
+	// AppendWrite appends the signature lists to the variable instead of
+	// replacing it
+	AppendWrite bool
+	// NoTimeBased writes the signature lists without the time based
+	// authentication descriptor
+	NoTimeBased bool
+}
+
+// Validate checks the attributes against the rules of the UEFI specification
+// for writes to ev
+func (a WriteAttributes) Validate(ev efivar.Efivar, setupMode bool) error {
+	switch {
+	case ev == efivar.PK && a.AppendWrite:
+		return fmt.Errorf("%w: PK holds a single certificate and can't be appended to", ErrInvalidAttributes)
+	case ev == efivar.PK && a.NoTimeBased:
+		return fmt.Errorf("%w: PK has to be written with time based authentication", ErrInvalidAttributes)
+	case a.NoTimeBased && a.AppendWrite:
+		return fmt.Errorf("%w: append writes to %s have to be authenticated", ErrInvalidAttributes, ev.Name)
+	case a.NoTimeBased && !setupMode:
+		return fmt.Errorf("%w: %s can only be written without time based authentication in setup mode", ErrInvalidAttributes, ev.Name)
+	}
+	return nil
+}
+
+// Efivar returns ev with the attributes applied
+func (a WriteAttributes) Efivar(ev efivar.Efivar) efivar.Efivar {
+	if a.AppendWrite {
+		ev.Attributes |= attributes.EFI_VARIABLE_APPEND_WRITE
+	}
+	if a.NoTimeBased {
+		ev.Attributes &^= attributes.EFI_VARIABLE_TIME_BASED_AUTHENTICATED_WRITE_ACCESS
+	}
+	return ev
 }
 
 func (e *EFIVariables) GetSiglist(ev efivar.Efivar) *signature.SignatureDatabase {
@@ -40,11 +93,40 @@ func (e *EFIVariables) EnrollKey(ev efivar.Efivar, hier *backend.KeyHierarchy) e
 		signer = hier.GetKeyBackend(efivar.PK)
 	case efivar.KEK:
 		signer = hier.GetKeyBackend(efivar.PK)
-	case efivar.Db:
+	case efivar.Db, efivar.Dbx:
 		signer = hier.GetKeyBackend(efivar.KEK)
 	}
+	if err := backend.CheckSigningAlgorithm(signer); err != nil {
+		return err
+	}
 	// fmt.Printf("%s is signed by %s\n", ev.Name, signer.Certificate().SerialNumber.String())
-	return e.fs.WriteSignedUpdate(ev, e.GetSiglist(ev), signer.Signer(), signer.Certificate())
+	siglist := e.GetSiglist(ev)
+	ev = e.Attributes.Efivar(ev)
+	if e.Attributes.NoTimeBased {
+		return e.fs.WriteVar(ev, siglist)
+	}
+	return e.fs.WriteSignedUpdate(ev, siglist, signer.Signer(), signer.Certificate())
+}
+
+// signedUpdate is an authenticated variable update which is written as-is
+type signedUpdate []byte
+
+func (s signedUpdate) Marshal(b *bytes.Buffer) {
+	b.Write(s)
+}
+
+func (s signedUpdate) Bytes() []byte {
+	return s
+}
+
+// WriteSignedUpdate writes an update which has already been signed by the
+// owner of the variable. With appendWrite the signature lists are appended
+// to the variable, the update needs to be signed for an append write.
+func (e *EFIVariables) WriteSignedUpdate(ev efivar.Efivar, update []byte, appendWrite bool) error {
+	if appendWrite {
+		ev.Attributes |= attributes.EFI_VARIABLE_APPEND_WRITE
+	}
+	return e.fs.WriteVar(ev, signedUpdate(update))
 }
 
 func (e *EFIVariables) EnrollAllKeys(hier *backend.KeyHierarchy) error {
@@ -74,8 +156,16 @@ func SystemEFIVariables(fs *efivarfs.Efivarfs) (*EFIVariables, error) {
 	var sigpk *signature.SignatureDatabase
 	var sigkek *signature.SignatureDatabase
 	var sigdb *signature.SignatureDatabase
+	var sigdbx *signature.SignatureDatabase
 	var err error
 
+	sigdbx, err = fs.Getdbx()
+	if errors.Is(err, os.ErrNotExist) {
+		sigdbx = signature.NewSignatureDatabase()
+	} else if err != nil {
+		return nil, err
+	}
+
 	sigdb, err = fs.Getdb()
 	if errors.Is(err, os.ErrNotExist) {
 		sigdb = signature.NewSignatureDatabase()
@@ -102,6 +192,158 @@ func SystemEFIVariables(fs *efivarfs.Efivarfs) (*EFIVariables, error) {
 		PK:  sigpk,
 		KEK: sigkek,
 		Db:  sigdb,
-		Dbx: signature.NewSignatureDatabase(),
+		Dbx: sigdbx,
 	}, nil
 }
+
+// ReadSignatureList reads an EFI signature list (.esl) file
+func ReadSignatureList(vfs afero.Fs, file string) (*signature.SignatureDatabase, error) {
+	b, err := fs.ReadFile(vfs, file)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := isAuthenticatedVariable(b); ok {
+		return nil, fmt.Errorf("%s is a signed update, not an EFI signature list", file)
+	}
+	db, err := signature.ReadSignatureDatabase(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse %s as an EFI signature list: %w", file, err)
+	}
+	if len(db) == 0 {
+		return nil, fmt.Errorf("%s contains no signature lists", file)
+	}
+	return &db, nil
+}
+
+// ReadSignedUpdate reads a signed variable update (.auth file). Only the
+// structure of the PKCS7 signature and the signature lists behind the
+// authentication header are validated, the signature is checked by the
+// firmware when the update is written.
+func ReadSignedUpdate(vfs afero.Fs, file string) ([]byte, error) {
+	b, err := fs.ReadFile(vfs, file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSignedUpdate(b, file)
+}
+
+// ParseSignedUpdate validates the signed variable update b read from file
+func ParseSignedUpdate(b []byte, file string) ([]byte, error) {
+	offset, ok := isAuthenticatedVariable(b)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a signed EFI variable update", file)
+	}
+	// The WIN_CERTIFICATE_UEFI_GUID of EFI_VARIABLE_AUTHENTICATION_2 has to
+	// carry a PKCS7 signature
+	hdr := 16 + int(signature.SizeofWinCertificateUEFIGUID)
+	if offset < hdr {
+		return nil, fmt.Errorf("%s has a truncated authentication header", file)
+	}
+	var certtype util.EFIGUID
+	if err := binary.Read(bytes.NewReader(b[16+signature.SizeofWINCertificate:]), binary.LittleEndian, &certtype); err != nil {
+		return nil, fmt.Errorf("%s has a truncated authentication header: %w", file, err)
+	}
+	if certtype != signature.EFI_CERT_TYPE_PKCS7_GUID {
+		return nil, fmt.Errorf("%s is not signed with PKCS7, the certificate type is %s", file, certtype.Format())
+	}
+	if _, err := pkcs7.ParsePKCS7(b[hdr:offset]); err != nil {
+		return nil, fmt.Errorf("couldn't parse the PKCS7 signature in %s: %w", file, err)
+	}
+	if _, err := signature.ReadSignatureDatabase(bytes.NewReader(b[offset:])); err != nil {
+		return nil, fmt.Errorf("couldn't parse the signature lists in %s: %w", file, err)
+	}
+	return b, nil
+}
+
+// ValidatePKUpdate checks that the signed update of PK read from file holds
+// the single X.509 certificate the platform key consists of
+func ValidatePKUpdate(b []byte, file string) (*x509.Certificate, error) {
+	offset, ok := isAuthenticatedVariable(b)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a signed EFI variable update", file)
+	}
+	db, err := signature.ReadSignatureDatabase(bytes.NewReader(b[offset:]))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse the signature lists in %s: %w", file, err)
+	}
+	if len(db) != 1 || db[0].SignatureType != signature.CERT_X509_GUID || len(db[0].Signatures) != 1 {
+		return nil, fmt.Errorf("%s has to contain a single X.509 certificate to be enrolled as PK", file)
+	}
+	cert, err := x509.ParseCertificate(db[0].Signatures[0].Data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w: %v", file, ErrInvalidCertificate, err)
+	}
+	return cert, nil
+}
+
+// SetupModePKUpdate returns an update enrolling cert as PK without a
+// signature, for platform keys whose private key is not available to sign
+// the update. Only firmware in setup mode accepts it, and some firmware
+// expects the PK to be self-signed even then.
+func SetupModePKUpdate(cert *x509.Certificate, owner util.EFIGUID) ([]byte, error) {
+	db := signature.NewSignatureDatabase()
+	if err := db.Append(signature.CERT_X509_GUID, owner, cert.Raw); err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	signature.NewEFIVariableAuthentication2().Marshal(&b)
+	db.Marshal(&b)
+	return b.Bytes(), nil
+}
+
+// MergeSignatureDatabase appends the signatures in src which aren't in dst
+// already, compared by the SHA256 of their data, and returns how many were
+// added
+func MergeSignatureDatabase(dst, src *signature.SignatureDatabase) (int, error) {
+	seen := map[[32]byte]bool{}
+	key := func(certtype util.EFIGUID, data []byte) [32]byte {
+		return sha256.Sum256(append(certtype.Bytes(), data...))
+	}
+	for _, list := range *dst {
+		for _, sig := range list.Signatures {
+			seen[key(list.SignatureType, sig.Data)] = true
+		}
+	}
+	var n int
+	for _, list := range *src {
+		for _, sig := range list.Signatures {
+			k := key(list.SignatureType, sig.Data)
+			if seen[k] {
+				continue
+			}
+			if err := dst.AppendSignature(list.SignatureType, &signature.SignatureData{Owner: sig.Owner, Data: sig.Data}); err != nil {
+				return n, err
+			}
+			seen[k] = true
+			n++
+		}
+	}
+	return n, nil
+}
+
+// CertificateOwner returns the owner the X.509 certificate is enrolled with
+// in the signature database. The owner sbctl enrolls its certificates with
+// can be overridden, so they are found by the certificate alone.
+func CertificateOwner(sb *signature.SignatureDatabase, cert []byte) (util.EFIGUID, bool) {
+	for _, list := range *sb {
+		if !util.CmpEFIGUID(list.SignatureType, signature.CERT_X509_GUID) {
+			continue
+		}
+		for _, sig := range list.Signatures {
+			if bytes.Equal(sig.Data, cert) {
+				return sig.Owner, true
+			}
+		}
+	}
+	return util.EFIGUID{}, false
+}
+
+// RemoveCertificate removes the X.509 certificate from the signature
+// database, whatever owner it is enrolled with
+func RemoveCertificate(sb *signature.SignatureDatabase, cert []byte) error {
+	owner, ok := CertificateOwner(sb, cert)
+	if !ok {
+		return signature.ErrNotFoundSigData
+	}
+	return sb.Remove(signature.CERT_X509_GUID, owner, cert)
+}
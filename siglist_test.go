@@ -0,0 +1,39 @@
+package sbctl
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/foxboron/go-uefi/efi/attributes"
+	"github.com/foxboron/go-uefi/efivar"
+)
+
+func TestWriteAttributesValidate(t *testing.T) {
+	for _, c := range []struct {
+		attrs     WriteAttributes
+		ev        efivar.Efivar
+		setupMode bool
+		valid     bool
+	}{
+		{WriteAttributes{}, efivar.PK, false, true},
+		{WriteAttributes{AppendWrite: true}, efivar.Db, false, true},
+		{WriteAttributes{AppendWrite: true}, efivar.PK, true, false},
+		{WriteAttributes{NoTimeBased: true}, efivar.PK, true, false},
+		{WriteAttributes{NoTimeBased: true}, efivar.KEK, true, true},
+		{WriteAttributes{NoTimeBased: true}, efivar.KEK, false, false},
+		{WriteAttributes{NoTimeBased: true, AppendWrite: true}, efivar.Dbx, true, false},
+	} {
+		err := c.attrs.Validate(c.ev, c.setupMode)
+		if c.valid && err != nil {
+			t.Fatalf("%+v %s: %v", c.attrs, c.ev.Name, err)
+		}
+		if !c.valid && !errors.Is(err, ErrInvalidAttributes) {
+			t.Fatalf("%+v %s: expected ErrInvalidAttributes, got %v", c.attrs, c.ev.Name, err)
+		}
+	}
+
+	ev := WriteAttributes{AppendWrite: true, NoTimeBased: true}.Efivar(efivar.Db)
+	if ev.Attributes&attributes.EFI_VARIABLE_APPEND_WRITE == 0 || ev.Attributes&attributes.EFI_VARIABLE_TIME_BASED_AUTHENTICATED_WRITE_ACCESS != 0 {
+		t.Fatalf("unexpected attributes %#x", uint32(ev.Attributes))
+	}
+}
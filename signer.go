@@ -0,0 +1,181 @@
+package sbctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"sort"
+	"syscall"
+
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/hierarchy"
+	"golang.org/x/sync/errgroup"
+)
+
+// Status of a file in a SignResult
+const (
+	SignStatusSigned        = "signed"
+	SignStatusAlreadySigned = "already signed"
+	SignStatusFailed        = "failed"
+	// Signing was cancelled before reaching the file, or the file couldn't be
+	// written with SkipUnwritable
+	SignStatusSkipped = "skipped"
+)
+
+var ErrUnwritableFiles = errors.New("files were skipped as they can't be written")
+
+type SignResult struct {
+	File       string `json:"file"`
+	OutputFile string `json:"output_file"`
+	Status     string `json:"status"`
+	Error      string `json:"error,omitempty"`
+	// Err is the error signing the file for failed and skipped files
+	Err error `json:"-"`
+}
+
+// Signer signs files with the db key. It doesn't print anything, the results
+// are returned and passed to OnResult as the files are signed.
+type Signer struct {
+	state *config.State
+	kh    *backend.KeyHierarchy
+
+	// Jobs is the number of files SignAll signs in parallel, defaulting to
+	// GOMAXPROCS. Files are signed one at a time with sign hooks configured.
+	Jobs int
+	// SkipUnwritable makes SignAll skip files which can't be written, instead
+	// of stopping at the first one
+	SkipUnwritable bool
+	// IfUnsigned checks if the output is signed by the current db key before
+	// signing, and skips it without opening the file for signing
+	IfUnsigned bool
+	// Filter selects the files SignAll signs, by the entry in the file
+	// database. Files it returns false for are left out of the results.
+	Filter func(*SigningEntry) bool
+	// OnResult is called with the result of each file. SignAll calls it from
+	// multiple goroutines.
+	OnResult func(*SignResult)
+}
+
+// NewSigner returns a Signer for the keys in the key hierarchy
+func NewSigner(state *config.State, kh *backend.KeyHierarchy) *Signer {
+	return &Signer{state: state, kh: kh}
+}
+
+// unwritable is true for errors writing to immutable files or read-only
+// mounts
+func unwritable(err error) bool {
+	return errors.Is(err, os.ErrPermission) || errors.Is(err, syscall.EROFS)
+}
+
+func (s *Signer) sign(res *SignResult) {
+	var err error
+	if s.IfUnsigned {
+		var signed bool
+		if signed, err = IsSigned(s.state, s.kh, res.File, res.OutputFile); err == nil && signed {
+			err = ErrAlreadySigned
+		}
+	}
+	if err == nil {
+		err = SignFile(s.state, s.kh, hierarchy.Db, res.File, res.OutputFile)
+	}
+	switch {
+	case errors.Is(err, ErrAlreadySigned):
+		res.Status = SignStatusAlreadySigned
+	case err != nil && s.SkipUnwritable && unwritable(err):
+		res.Status = SignStatusSkipped
+		res.Err = err
+		res.Error = err.Error()
+	case err != nil:
+		res.Status = SignStatusFailed
+		res.Err = err
+		res.Error = err.Error()
+	default:
+		res.Status = SignStatusSigned
+	}
+	if s.OnResult != nil {
+		s.OnResult(res)
+	}
+}
+
+// SignFile signs file and writes it to output, or back to file if output is
+// empty. Files which are already signed aren't written again.
+func (s *Signer) SignFile(file, output string) (*SignResult, error) {
+	if output == "" {
+		output = file
+	}
+	res := &SignResult{File: file, OutputFile: output}
+	s.sign(res)
+	if res.Status == SignStatusFailed {
+		return res, res.Err
+	}
+	return res, nil
+}
+
+// SignAll signs the files in the file database. The first failure cancels the
+// remaining files and is returned. With SkipUnwritable, files which can't be
+// written are skipped instead, and ErrUnwritableFiles is returned once the
+// other files are signed. Results are sorted by path and are nil if no file
+// was attempted.
+func (s *Signer) SignAll() ([]*SignResult, error) {
+	files, err := ReadFileDatabase(s.state.Fs, s.state.Config.FilesDb)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*SignResult{}
+	if len(files) == 0 {
+		return results, nil
+	}
+	for _, entry := range files {
+		if s.Filter != nil && !s.Filter(entry) {
+			continue
+		}
+		results = append(results, &SignResult{File: entry.File, OutputFile: entry.OutputFile, Status: SignStatusSkipped})
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].File < results[j].File })
+
+	jobs := s.Jobs
+	if jobs < 1 {
+		jobs = runtime.GOMAXPROCS(0)
+	}
+	// The TPM transport can't be shared between goroutines
+	if t := s.kh.Db.Type(); t != backend.FileBackend && t != backend.EncryptedBackend {
+		jobs = 1
+	}
+	// The sign hooks run around every file and needn't be reentrant
+	if len(hookCommands(s.state.Config, HookPreSign)) != 0 || len(hookCommands(s.state.Config, HookPostSign)) != 0 {
+		jobs = 1
+	}
+
+	g, ctx := errgroup.WithContext(context.Background())
+	g.SetLimit(jobs)
+	for _, res := range results {
+		if ctx.Err() != nil {
+			break
+		}
+		g.Go(func() error {
+			if ctx.Err() != nil {
+				return nil
+			}
+			s.sign(res)
+			if res.Status == SignStatusFailed {
+				return fmt.Errorf("failed signing %s: %w", res.File, res.Err)
+			}
+			return nil
+		})
+	}
+	signerr := g.Wait()
+	if signerr == nil && slices.ContainsFunc(results, func(r *SignResult) bool { return r.Err != nil }) {
+		signerr = ErrUnwritableFiles
+	}
+
+	// Only written once all workers are done
+	if err := WriteFileDatabase(s.state.Fs, s.state.Config.FilesDb, files); err != nil {
+		return results, err
+	}
+	return results, signerr
+}
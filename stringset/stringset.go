@@ -10,6 +10,8 @@ import (
 type StringSet struct {
 	Allowed []string
 	Value   string
+	// Accept values in any case, Value is set to the allowed spelling
+	IgnoreCase bool
 }
 
 func NewStringSet(allowed []string, d string) *StringSet {
@@ -24,6 +26,11 @@ func (s StringSet) String() string {
 }
 
 func (s *StringSet) Set(p string) error {
+	if s.IgnoreCase {
+		if i := slices.IndexFunc(s.Allowed, func(a string) bool { return strings.EqualFold(a, p) }); i != -1 {
+			p = s.Allowed[i]
+		}
+	}
 	if !slices.Contains(s.Allowed, p) {
 		return fmt.Errorf("%s is not included in %s", p, strings.Join(s.Allowed, ","))
 	}
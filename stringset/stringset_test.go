@@ -67,3 +67,16 @@ func TestStringSet(t *testing.T) {
 		})
 	}
 }
+
+func TestStringSetIgnoreCase(t *testing.T) {
+	stringSet := StringSet{Allowed: []string{"PK", "KEK", "db"}, IgnoreCase: true}
+	if err := stringSet.Set("kek"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stringSet.String() != "KEK" {
+		t.Errorf("expected stringSet value KEK, but got %v", stringSet.String())
+	}
+	if err := stringSet.Set("dbx"); err == nil {
+		t.Fatalf("expected error setting dbx")
+	}
+}
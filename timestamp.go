@@ -0,0 +1,560 @@
+package sbctl
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/foxboron/go-uefi/pkcs7"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/hierarchy"
+	"golang.org/x/crypto/cryptobyte"
+	cbasn1 "golang.org/x/crypto/cryptobyte/asn1"
+
+	// Register the hashes used by TSAs
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// RFC 3161 timestamps are requested for the encrypted digest of the
+// authenticode signature, and the token is embedded as an unsigned attribute
+// of the signer info, the same way signtool does.
+
+var (
+	// Unsigned attribute holding an RFC 3161 timestamp token
+	oidRFC3161CounterSign = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 3, 3, 1}
+	oidTSTInfo            = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+
+	timestampHashes = map[string]crypto.Hash{
+		"2.16.840.1.101.3.4.2.1": crypto.SHA256,
+		"2.16.840.1.101.3.4.2.2": crypto.SHA384,
+		"2.16.840.1.101.3.4.2.3": crypto.SHA512,
+	}
+)
+
+// Time a TSA has to respond within
+var timestampTimeout = 30 * time.Second
+
+var (
+	ErrTimestamp        = errors.New("can't timestamp the signature")
+	ErrInvalidTimestamp = errors.New("invalid timestamp")
+)
+
+// Timestamp is an RFC 3161 timestamp embedded in an authenticode signature
+type Timestamp struct {
+	Time time.Time `json:"time"`
+	// Subject of the certificate the TSA signed the timestamp with
+	TSA    string `json:"tsa"`
+	Serial string `json:"serial"`
+	// Trusted is set if the certificate of the TSA chains up to a certificate
+	// trusted by the system
+	Trusted bool `json:"trusted"`
+}
+
+type messageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+type timeStampReq struct {
+	Version        int
+	MessageImprint messageImprint
+	Nonce          *big.Int `asn1:"optional"`
+	CertReq        bool     `asn1:"optional"`
+}
+
+type pkiStatusInfo struct {
+	Status       int
+	StatusString []string       `asn1:"optional"`
+	FailInfo     asn1.BitString `asn1:"optional"`
+}
+
+type timeStampResp struct {
+	Status         pkiStatusInfo
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+type tstAccuracy struct {
+	Seconds int `asn1:"optional"`
+	Millis  int `asn1:"optional,tag:0"`
+	Micros  int `asn1:"optional,tag:1"`
+}
+
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint messageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time     `asn1:"generalized"`
+	Accuracy       tstAccuracy   `asn1:"optional"`
+	Ordering       bool          `asn1:"optional"`
+	Nonce          *big.Int      `asn1:"optional"`
+	TSA            asn1.RawValue `asn1:"optional,explicit,tag:0"`
+	Extensions     asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type cmsEncapContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     []byte `asn1:"explicit,optional,tag:0"`
+}
+
+type cmsSignerInfo struct {
+	Version            int
+	SID                asn1.RawValue
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type cmsSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo cmsEncapContentInfo
+	Certificates     asn1.RawValue   `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue   `asn1:"optional,tag:1"`
+	SignerInfos      []cmsSignerInfo `asn1:"set"`
+}
+
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+type issuerAndSerial struct {
+	Issuer asn1.RawValue
+	Serial *big.Int
+}
+
+// signerInfoElements are the DER elements of an authenticode signature with a
+// single signer info, which is split into its own elements
+type signerInfoElements struct {
+	contentType []byte
+	signedData  []cryptobyte.String
+	signerInfo  []cryptobyte.String
+	signerTags  []cbasn1.Tag
+}
+
+func parseSignerInfoElements(sig []byte) (*signerInfoElements, error) {
+	var s signerInfoElements
+	var contentInfo, explicit, signedData cryptobyte.String
+	in := cryptobyte.String(sig)
+	if !in.ReadASN1(&contentInfo, cbasn1.SEQUENCE) ||
+		!contentInfo.ReadASN1Element((*cryptobyte.String)(&s.contentType), cbasn1.OBJECT_IDENTIFIER) ||
+		!contentInfo.ReadASN1(&explicit, cbasn1.Tag(0).ContextSpecific().Constructed()) ||
+		!explicit.ReadASN1(&signedData, cbasn1.SEQUENCE) {
+		return nil, errors.New("malformed signed data")
+	}
+	for !signedData.Empty() {
+		var elem cryptobyte.String
+		if !signedData.ReadAnyASN1Element(&elem, nil) {
+			return nil, errors.New("malformed signed data")
+		}
+		s.signedData = append(s.signedData, elem)
+	}
+	if len(s.signedData) == 0 {
+		return nil, errors.New("no signer infos")
+	}
+
+	// The signer infos are the last element of the signed data
+	signerInfos := s.signedData[len(s.signedData)-1]
+	s.signedData = s.signedData[:len(s.signedData)-1]
+	var set, signerInfo cryptobyte.String
+	if !signerInfos.ReadASN1(&set, cbasn1.SET) || !set.ReadASN1(&signerInfo, cbasn1.SEQUENCE) {
+		return nil, errors.New("no signer info")
+	}
+	if !set.Empty() {
+		return nil, errors.New("signatures with more than one signer info are not supported")
+	}
+	for !signerInfo.Empty() {
+		var elem cryptobyte.String
+		var tag cbasn1.Tag
+		if !signerInfo.ReadAnyASN1Element(&elem, &tag) {
+			return nil, errors.New("malformed signer info")
+		}
+		s.signerInfo = append(s.signerInfo, elem)
+		s.signerTags = append(s.signerTags, tag)
+	}
+	return &s, nil
+}
+
+// signerElement returns the content of the signer info element with the tag
+func (s *signerInfoElements) signerElement(tag cbasn1.Tag) (cryptobyte.String, bool) {
+	i := slices.Index(s.signerTags, tag)
+	if i < 0 {
+		return nil, false
+	}
+	var content cryptobyte.String
+	elem := s.signerInfo[i]
+	if !elem.ReadASN1(&content, tag) {
+		return nil, false
+	}
+	return content, true
+}
+
+func (s *signerInfoElements) bytes() ([]byte, error) {
+	b := cryptobyte.NewBuilder(nil)
+	b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		b.AddBytes(s.contentType)
+		b.AddASN1(cbasn1.Tag(0).ContextSpecific().Constructed(), func(b *cryptobyte.Builder) {
+			b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+				for _, elem := range s.signedData {
+					b.AddBytes(elem)
+				}
+				b.AddASN1(cbasn1.SET, func(b *cryptobyte.Builder) {
+					b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+						for _, elem := range s.signerInfo {
+							b.AddBytes(elem)
+						}
+					})
+				})
+			})
+		})
+	})
+	return b.Bytes()
+}
+
+var unsignedAttrsTag = cbasn1.Tag(1).ContextSpecific().Constructed()
+
+// TimestampSignature requests an RFC 3161 timestamp for the authenticode
+// signature sig from the TSA at url, and returns the signature with the
+// timestamp embedded
+func TimestampSignature(url string, sig []byte) ([]byte, error) {
+	s, err := parseSignerInfoElements(sig)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTimestamp, err)
+	}
+	if slices.Contains(s.signerTags, unsignedAttrsTag) {
+		return nil, fmt.Errorf("%w: the signature already has unsigned attributes", ErrTimestamp)
+	}
+	encryptedDigest, ok := s.signerElement(cbasn1.OCTET_STRING)
+	if !ok {
+		return nil, fmt.Errorf("%w: the signature has no encrypted digest", ErrTimestamp)
+	}
+	token, err := requestTimestamp(url, encryptedDigest)
+	if err != nil {
+		return nil, err
+	}
+
+	b := cryptobyte.NewBuilder(nil)
+	b.AddASN1(unsignedAttrsTag, func(b *cryptobyte.Builder) {
+		b.AddASN1(cbasn1.SEQUENCE, func(b *cryptobyte.Builder) {
+			b.AddASN1ObjectIdentifier(oidRFC3161CounterSign)
+			b.AddASN1(cbasn1.SET, func(b *cryptobyte.Builder) {
+				b.AddBytes(token)
+			})
+		})
+	})
+	attrs, err := b.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	s.signerInfo = append(s.signerInfo, attrs)
+	s.signerTags = append(s.signerTags, unsignedAttrsTag)
+	return s.bytes()
+}
+
+// requestTimestamp requests a timestamp token for the encrypted digest of a
+// signature. The token is checked before it is returned.
+func requestTimestamp(url string, encryptedDigest []byte) ([]byte, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("%w: %s is not a http or https url", ErrTimestamp, url)
+	}
+	digest := crypto.SHA256.New()
+	digest.Write(encryptedDigest)
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	req, err := asn1.Marshal(timeStampReq{
+		Version: 1,
+		MessageImprint: messageImprint{
+			HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: pkcs7.OIDDigestAlgorithmSHA256, Parameters: asn1.NullRawValue},
+			HashedMessage: digest.Sum(nil),
+		},
+		Nonce:   nonce,
+		CertReq: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: timestampTimeout}
+	rsp, err := client.Post(url, "application/timestamp-query", bytes.NewReader(req))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTimestamp, err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s returned %s", ErrTimestamp, url, rsp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(rsp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTimestamp, err)
+	}
+
+	var resp timeStampResp
+	if rest, err := asn1.Unmarshal(body, &resp); err != nil || len(rest) != 0 {
+		return nil, fmt.Errorf("%w: malformed response from %s", ErrTimestamp, url)
+	}
+	// 0 is granted and 1 granted with modifications
+	if resp.Status.Status != 0 && resp.Status.Status != 1 {
+		return nil, fmt.Errorf("%w: %s rejected the request with status %d %s", ErrTimestamp, url, resp.Status.Status, strings.Join(resp.Status.StatusString, ", "))
+	}
+	token := resp.TimeStampToken.FullBytes
+	if len(token) == 0 {
+		return nil, fmt.Errorf("%w: %s returned no timestamp", ErrTimestamp, url)
+	}
+	tst, err := verifyTimestampToken(token, encryptedDigest)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrTimestamp, err)
+	}
+	if tst.info.Nonce == nil || tst.info.Nonce.Cmp(nonce) != 0 {
+		return nil, fmt.Errorf("%w: the timestamp from %s is not for this request", ErrTimestamp, url)
+	}
+	return token, nil
+}
+
+func timestampHash(alg pkix.AlgorithmIdentifier) (crypto.Hash, error) {
+	h, ok := timestampHashes[alg.Algorithm.String()]
+	if !ok {
+		return 0, fmt.Errorf("%w: unsupported hash %s", ErrInvalidTimestamp, alg.Algorithm)
+	}
+	return h, nil
+}
+
+func hashBytes(h crypto.Hash, b []byte) []byte {
+	hh := h.New()
+	hh.Write(b)
+	return hh.Sum(nil)
+}
+
+// timestampSigner finds the certificate identified by the signer identifier
+func timestampSigner(certs []*x509.Certificate, sid asn1.RawValue) *x509.Certificate {
+	for _, c := range certs {
+		switch {
+		case sid.Class == asn1.ClassUniversal && sid.Tag == asn1.TagSequence:
+			var ias issuerAndSerial
+			if _, err := asn1.Unmarshal(sid.FullBytes, &ias); err == nil &&
+				bytes.Equal(ias.Issuer.FullBytes, c.RawIssuer) && ias.Serial.Cmp(c.SerialNumber) == 0 {
+				return c
+			}
+		case sid.Class == asn1.ClassContextSpecific && sid.Tag == 0:
+			if bytes.Equal(sid.Bytes, c.SubjectKeyId) {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+func checkTimestampSignature(cert *x509.Certificate, h crypto.Hash, signed, sig []byte) error {
+	digest := hashBytes(h, signed)
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, h, digest, sig)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest, sig) {
+			return errors.New("ecdsa verification failure")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported TSA key %T", cert.PublicKey)
+	}
+}
+
+// timestampToken is a verified timestamp token
+type timestampToken struct {
+	info *tstInfo
+	// Certificate the TSA signed the token with
+	cert  *x509.Certificate
+	certs []*x509.Certificate
+}
+
+// verifyTimestampToken checks that the timestamp token is for the encrypted
+// digest and signed by the TSA certificate included in it. The chain of the
+// TSA certificate isn't verified.
+func verifyTimestampToken(token, encryptedDigest []byte) (*timestampToken, error) {
+	var ci cmsContentInfo
+	if rest, err := asn1.Unmarshal(token, &ci); err != nil || len(rest) != 0 || !ci.ContentType.Equal(pkcs7.OIDSignedData) {
+		return nil, fmt.Errorf("%w: malformed timestamp token", ErrInvalidTimestamp)
+	}
+	var sd cmsSignedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, fmt.Errorf("%w: malformed signed data: %v", ErrInvalidTimestamp, err)
+	}
+	if !sd.EncapContentInfo.EContentType.Equal(oidTSTInfo) {
+		return nil, fmt.Errorf("%w: the token doesn't contain a timestamp", ErrInvalidTimestamp)
+	}
+	var info tstInfo
+	if _, err := asn1.Unmarshal(sd.EncapContentInfo.EContent, &info); err != nil {
+		return nil, fmt.Errorf("%w: malformed timestamp info: %v", ErrInvalidTimestamp, err)
+	}
+
+	h, err := timestampHash(info.MessageImprint.HashAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(info.MessageImprint.HashedMessage, hashBytes(h, encryptedDigest)) {
+		return nil, fmt.Errorf("%w: the timestamp is not for this signature", ErrInvalidTimestamp)
+	}
+
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed certificates: %v", ErrInvalidTimestamp, err)
+	}
+	if len(sd.SignerInfos) != 1 {
+		return nil, fmt.Errorf("%w: expected one signer, got %d", ErrInvalidTimestamp, len(sd.SignerInfos))
+	}
+	si := sd.SignerInfos[0]
+	cert := timestampSigner(certs, si.SID)
+	if cert == nil {
+		return nil, fmt.Errorf("%w: the token doesn't include the certificate of the TSA", ErrInvalidTimestamp)
+	}
+	if len(si.SignedAttrs.FullBytes) == 0 {
+		return nil, fmt.Errorf("%w: the token has no signed attributes", ErrInvalidTimestamp)
+	}
+
+	// The signature is over the signed attributes as a SET, not the implicit
+	// tag they are encoded with
+	signed := append([]byte{0x31}, si.SignedAttrs.FullBytes[1:]...)
+	var attrs []cmsAttribute
+	if _, err := asn1.UnmarshalWithParams(signed, &attrs, "set"); err != nil {
+		return nil, fmt.Errorf("%w: malformed signed attributes: %v", ErrInvalidTimestamp, err)
+	}
+	sh, err := timestampHash(si.DigestAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	i := slices.IndexFunc(attrs, func(a cmsAttribute) bool { return a.Type.Equal(pkcs7.OIDAttributeMessageDigest) })
+	var messageDigest []byte
+	if i < 0 || len(attrs[i].Values) != 1 {
+		return nil, fmt.Errorf("%w: the token has no message digest", ErrInvalidTimestamp)
+	}
+	if _, err := asn1.Unmarshal(attrs[i].Values[0].FullBytes, &messageDigest); err != nil ||
+		!bytes.Equal(messageDigest, hashBytes(sh, sd.EncapContentInfo.EContent)) {
+		return nil, fmt.Errorf("%w: the message digest doesn't match the timestamp", ErrInvalidTimestamp)
+	}
+	if err := checkTimestampSignature(cert, sh, signed, si.Signature); err != nil {
+		return nil, fmt.Errorf("%w: bad TSA signature: %v", ErrInvalidTimestamp, err)
+	}
+
+	if !slices.Contains(cert.ExtKeyUsage, x509.ExtKeyUsageTimeStamping) {
+		return nil, fmt.Errorf("%w: the certificate of the TSA is not for timestamping", ErrInvalidTimestamp)
+	}
+	if info.GenTime.Before(cert.NotBefore) || info.GenTime.After(cert.NotAfter) {
+		return nil, fmt.Errorf("%w: the certificate of the TSA was not valid at %s", ErrInvalidTimestamp, info.GenTime)
+	}
+
+	return &timestampToken{info: &info, cert: cert, certs: certs}, nil
+}
+
+// SignatureTimestamp returns the RFC 3161 timestamp embedded in the
+// authenticode signature sig, or nil if it has none. The timestamp has to be
+// for the signature and signed by the TSA.
+func SignatureTimestamp(sig []byte) (*Timestamp, error) {
+	s, err := parseSignerInfoElements(sig)
+	if err != nil {
+		return nil, err
+	}
+	unsigned, ok := s.signerElement(unsignedAttrsTag)
+	if !ok {
+		return nil, nil
+	}
+	encryptedDigest, ok := s.signerElement(cbasn1.OCTET_STRING)
+	if !ok {
+		return nil, errors.New("the signature has no encrypted digest")
+	}
+
+	var token []byte
+	for !unsigned.Empty() {
+		var attr, values cryptobyte.String
+		var oid asn1.ObjectIdentifier
+		if !unsigned.ReadASN1(&attr, cbasn1.SEQUENCE) ||
+			!attr.ReadASN1ObjectIdentifier(&oid) ||
+			!attr.ReadASN1(&values, cbasn1.SET) {
+			return nil, errors.New("malformed unsigned attributes")
+		}
+		if oid.Equal(oidRFC3161CounterSign) {
+			if !values.ReadASN1Element((*cryptobyte.String)(&token), cbasn1.SEQUENCE) {
+				return nil, fmt.Errorf("%w: malformed timestamp token", ErrInvalidTimestamp)
+			}
+			break
+		}
+	}
+	if token == nil {
+		return nil, nil
+	}
+
+	tst, err := verifyTimestampToken(token, encryptedDigest)
+	if err != nil {
+		return nil, err
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range tst.certs {
+		intermediates.AddCert(c)
+	}
+	_, err = tst.cert.Verify(x509.VerifyOptions{
+		Intermediates: intermediates,
+		CurrentTime:   tst.info.GenTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+	})
+	return &Timestamp{
+		Time:    tst.info.GenTime,
+		TSA:     tst.cert.Subject.String(),
+		Serial:  tst.info.SerialNumber.Text(16),
+		Trusted: err == nil,
+	}, nil
+}
+
+// FileTimestamp returns the timestamp of the signature of file made with the
+// key of the hierarchy, or nil if the signature isn't timestamped
+func FileTimestamp(state *config.State, kh *backend.KeyHierarchy, ev hierarchy.Hierarchy, file string) (*Timestamp, error) {
+	peFile, err := state.Fs.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer peFile.Close()
+
+	peBinary, err := authenticode.Parse(peFile)
+	if err != nil {
+		return nil, err
+	}
+	sigs, err := peBinary.Signatures()
+	if err != nil {
+		return nil, err
+	}
+	cert := kh.GetKeyBackend(ev.Efivar()).Certificate()
+	for _, sig := range sigs {
+		auth, err := authenticode.ParseAuthenticode(sig.Certificate)
+		if err != nil {
+			continue
+		}
+		if ok, err := backend.VerifyAuthenticode(auth, cert, peBinary.HashContent.Bytes()); err != nil || !ok {
+			continue
+		}
+		return SignatureTimestamp(sig.Certificate)
+	}
+	return nil, nil
+}
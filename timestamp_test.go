@@ -0,0 +1,239 @@
+package sbctl
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/foxboron/go-uefi/pkcs7"
+)
+
+type testTSA struct {
+	key  *ecdsa.PrivateKey
+	cert *x509.Certificate
+	now  time.Time
+	// Changes the timestamp info before it is signed
+	modify func(*tstInfo)
+}
+
+func newTestTSA(t *testing.T) *testTSA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "Test TSA"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testTSA{key: key, cert: cert, now: now}
+}
+
+func (tsa *testTSA) token(req *timeStampReq) ([]byte, error) {
+	info := tstInfo{
+		Version:        1,
+		Policy:         asn1.ObjectIdentifier{1, 2, 3, 4},
+		MessageImprint: req.MessageImprint,
+		SerialNumber:   big.NewInt(1),
+		GenTime:        tsa.now,
+		Nonce:          req.Nonce,
+	}
+	if tsa.modify != nil {
+		tsa.modify(&info)
+	}
+	content, err := asn1.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(content)
+	contentType, _ := asn1.Marshal(oidTSTInfo)
+	messageDigest, _ := asn1.Marshal(digest[:])
+	attrs, err := asn1.MarshalWithParams([]cmsAttribute{
+		{Type: pkcs7.OIDAttributeContentType, Values: []asn1.RawValue{{FullBytes: contentType}}},
+		{Type: pkcs7.OIDAttributeMessageDigest, Values: []asn1.RawValue{{FullBytes: messageDigest}}},
+	}, "set")
+	if err != nil {
+		return nil, err
+	}
+	attrsDigest := sha256.Sum256(attrs)
+	sig, err := ecdsa.SignASN1(rand.Reader, tsa.key, attrsDigest[:])
+	if err != nil {
+		return nil, err
+	}
+	sid, err := asn1.Marshal(issuerAndSerial{Issuer: asn1.RawValue{FullBytes: tsa.cert.RawIssuer}, Serial: tsa.cert.SerialNumber})
+	if err != nil {
+		return nil, err
+	}
+	sha256Alg := pkix.AlgorithmIdentifier{Algorithm: pkcs7.OIDDigestAlgorithmSHA256, Parameters: asn1.NullRawValue}
+	sd, err := asn1.Marshal(cmsSignedData{
+		Version:          3,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Alg},
+		EncapContentInfo: cmsEncapContentInfo{EContentType: oidTSTInfo, EContent: content},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: tsa.cert.Raw},
+		SignerInfos: []cmsSignerInfo{{
+			Version:            1,
+			SID:                asn1.RawValue{FullBytes: sid},
+			DigestAlgorithm:    sha256Alg,
+			SignedAttrs:        asn1.RawValue{FullBytes: append([]byte{0xa0}, attrs[1:]...)},
+			SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}},
+			Signature:          sig,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(cmsContentInfo{
+		ContentType: pkcs7.OIDSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sd},
+	})
+}
+
+func (tsa *testTSA) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b, _ := io.ReadAll(r.Body)
+	var req timeStampReq
+	if _, err := asn1.Unmarshal(b, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	token, err := tsa.token(&req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rsp, _ := asn1.Marshal(timeStampResp{TimeStampToken: asn1.RawValue{FullBytes: token}})
+	w.Header().Set("Content-Type", "application/timestamp-reply")
+	w.Write(rsp)
+}
+
+func testAuthenticodeSignature(t *testing.T, content []byte) ([]byte, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Test db"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := authenticode.SignAuthenticode(key, cert, content, crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig, cert
+}
+
+func TestTimestampSignature(t *testing.T) {
+	tsa := newTestTSA(t)
+	srv := httptest.NewServer(tsa)
+	defer srv.Close()
+
+	content := []byte("image")
+	sig, cert := testAuthenticodeSignature(t, content)
+	if ts, err := SignatureTimestamp(sig); err != nil || ts != nil {
+		t.Fatalf("expected no timestamp, got %+v %v", ts, err)
+	}
+
+	stamped, err := TimestampSignature(srv.URL, sig)
+	if err != nil {
+		t.Fatalf("failed timestamping the signature: %v", err)
+	}
+	auth, err := authenticode.ParseAuthenticode(stamped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := auth.Verify(cert, content); err != nil || !ok {
+		t.Fatalf("the timestamped signature doesn't verify: %v", err)
+	}
+
+	ts, err := SignatureTimestamp(stamped)
+	if err != nil {
+		t.Fatalf("failed reading the timestamp: %v", err)
+	}
+	if ts == nil || !ts.Time.Equal(tsa.now) || !strings.Contains(ts.TSA, "Test TSA") || ts.Serial != "1" {
+		t.Fatalf("unexpected timestamp %+v", ts)
+	}
+	if ts.Trusted {
+		t.Fatalf("the test TSA shouldn't be trusted")
+	}
+
+	if _, err := TimestampSignature(srv.URL, stamped); !errors.Is(err, ErrTimestamp) {
+		t.Fatalf("expected ErrTimestamp timestamping twice, got %v", err)
+	}
+
+	// A timestamp moved to another signature is not valid
+	other, _ := testAuthenticodeSignature(t, content)
+	s, err := parseSignerInfoElements(stamped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := parseSignerInfoElements(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.signerInfo = append(o.signerInfo, s.signerInfo[len(s.signerInfo)-1])
+	o.signerTags = append(o.signerTags, unsignedAttrsTag)
+	moved, err := o.bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SignatureTimestamp(moved); !errors.Is(err, ErrInvalidTimestamp) {
+		t.Fatalf("expected ErrInvalidTimestamp, got %v", err)
+	}
+}
+
+func TestTimestampSignatureFailures(t *testing.T) {
+	tsa := newTestTSA(t)
+	srv := httptest.NewServer(tsa)
+	sig, _ := testAuthenticodeSignature(t, []byte("image"))
+
+	tsa.modify = func(info *tstInfo) { info.Nonce = big.NewInt(1) }
+	if _, err := TimestampSignature(srv.URL, sig); !errors.Is(err, ErrTimestamp) {
+		t.Fatalf("expected ErrTimestamp for a wrong nonce, got %v", err)
+	}
+
+	tsa.modify = func(info *tstInfo) { info.MessageImprint.HashedMessage = make([]byte, sha256.Size) }
+	if _, err := TimestampSignature(srv.URL, sig); !errors.Is(err, ErrInvalidTimestamp) {
+		t.Fatalf("expected ErrInvalidTimestamp for a wrong imprint, got %v", err)
+	}
+
+	// An unreachable TSA fails instead of leaving the signature untimestamped
+	srv.Close()
+	if _, err := TimestampSignature(srv.URL, sig); !errors.Is(err, ErrTimestamp) {
+		t.Fatalf("expected ErrTimestamp for an unreachable TSA, got %v", err)
+	}
+}
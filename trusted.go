@@ -0,0 +1,199 @@
+package sbctl
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/foxboron/go-uefi/authenticode"
+	"github.com/foxboron/sbctl/backend"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/foxboron/sbctl/hierarchy"
+	"github.com/spf13/afero"
+)
+
+// Imported certificates are only trusted by verify, they are never enrolled
+// into the firmware. Each is stored as PEM in the trusted directory of the
+// keydir, named after its fingerprint.
+
+var (
+	ErrInvalidCertificate  = errors.New("not a PEM or DER encoded certificate")
+	ErrCertificateImported = errors.New("certificate is already imported")
+)
+
+// TrustedCert is a certificate imported with import-cert
+type TrustedCert struct {
+	Path        string
+	Fingerprint string
+	Certificate *x509.Certificate
+}
+
+// TrustedCertsDir returns the directory imported certificates are stored in
+func TrustedCertsDir(conf *config.Config) string {
+	return filepath.Join(conf.Keydir, "trusted")
+}
+
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// ParseCertificate reads a PEM or DER encoded certificate
+func ParseCertificate(b []byte) (*x509.Certificate, error) {
+	if block, _ := pem.Decode(b); block != nil {
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("%w: unexpected PEM block %s", ErrInvalidCertificate, block.Type)
+		}
+		b = block.Bytes
+	}
+	cert, err := x509.ParseCertificate(b)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCertificate, err)
+	}
+	return cert, nil
+}
+
+// ImportTrustedCert stores the certificate in file as an additional
+// certificate verify trusts
+func ImportTrustedCert(state *config.State, file string) (*TrustedCert, error) {
+	b, err := fs.ReadFile(state.Fs, file)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := ParseCertificate(b)
+	if err != nil {
+		return nil, err
+	}
+	tc := &TrustedCert{
+		Fingerprint: certFingerprint(cert),
+		Certificate: cert,
+	}
+	tc.Path = filepath.Join(TrustedCertsDir(state.Config), tc.Fingerprint+".pem")
+	if ok, _ := afero.Exists(state.Fs, tc.Path); ok {
+		return nil, fmt.Errorf("%w: %s", ErrCertificateImported, tc.Path)
+	}
+	if err := state.Fs.MkdirAll(TrustedCertsDir(state.Config), os.ModePerm); err != nil {
+		return nil, err
+	}
+	pemb := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	if err := fs.WriteFile(state.Fs, tc.Path, pemb, 0644); err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
+
+// TrustedCerts returns the imported certificates, ordered by fingerprint
+func TrustedCerts(state *config.State) ([]*TrustedCert, error) {
+	dir := TrustedCertsDir(state.Config)
+	files, err := afero.ReadDir(state.Fs, dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	certs := []*TrustedCert{}
+	for _, f := range files {
+		if !f.Mode().IsRegular() || filepath.Ext(f.Name()) != ".pem" {
+			continue
+		}
+		path := filepath.Join(dir, f.Name())
+		b, err := fs.ReadFile(state.Fs, path)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := ParseCertificate(b)
+		if err != nil {
+			return nil, fmt.Errorf("can't read %s: %w", path, err)
+		}
+		certs = append(certs, &TrustedCert{Path: path, Fingerprint: certFingerprint(cert), Certificate: cert})
+	}
+	sort.Slice(certs, func(i, j int) bool { return certs[i].Fingerprint < certs[j].Fingerprint })
+	return certs, nil
+}
+
+// VerifyFileTrusted checks the file against the db key and the imported
+// certificates. It returns the imported certificate which signed the file, or
+// nil if it is signed by the db key.
+func VerifyFileTrusted(state *config.State, kh *backend.KeyHierarchy, file string) (bool, *TrustedCert, error) {
+	ok, err := VerifyFile(state, kh, hierarchy.Db, file)
+	if err != nil || ok {
+		return ok, nil, err
+	}
+	trusted, err := TrustedCerts(state)
+	if err != nil || len(trusted) == 0 {
+		return false, nil, err
+	}
+
+	peFile, err := state.Fs.Open(file)
+	if err != nil {
+		return false, nil, err
+	}
+	defer peFile.Close()
+	peBinary, err := authenticode.Parse(peFile)
+	if err != nil {
+		return false, nil, err
+	}
+	for _, tc := range trusted {
+		ok, err := backend.VerifyPEBinary(peBinary, tc.Certificate)
+		if errors.Is(err, authenticode.ErrNoValidSignatures) || errors.Is(err, authenticode.ErrNoSignatures) {
+			continue
+		} else if err != nil {
+			return false, nil, err
+		}
+		if ok {
+			return true, tc, nil
+		}
+	}
+	return false, nil, nil
+}
+
+// VerifyFileDetachedTrusted is VerifyFileTrusted for detached signatures
+func VerifyFileDetachedTrusted(state *config.State, kh *backend.KeyHierarchy, file, sigfile string) (bool, *TrustedCert, error) {
+	ok, err := VerifyFileDetached(state, kh, hierarchy.Db, file, sigfile)
+	if err != nil || ok {
+		return ok, nil, err
+	}
+	trusted, err := TrustedCerts(state)
+	if err != nil || len(trusted) == 0 {
+		return false, nil, err
+	}
+
+	sig, err := fs.ReadFile(state.Fs, sigfile)
+	if err != nil {
+		return false, nil, err
+	}
+	peFile, err := state.Fs.Open(file)
+	if err != nil {
+		return false, nil, err
+	}
+	defer peFile.Close()
+	peBinary, err := authenticode.Parse(peFile)
+	if err != nil {
+		return false, nil, err
+	}
+	auth, err := authenticode.ParseAuthenticode(sig)
+	if err != nil {
+		return false, nil, err
+	}
+	// The signature is for a different binary
+	if ok, err := backend.SignatureDigestMatches(auth, peBinary); err != nil || !ok {
+		return false, nil, err
+	}
+	for _, tc := range trusted {
+		ok, err := backend.VerifyAuthenticode(auth, tc.Certificate, peBinary.HashContent.Bytes())
+		if err != nil {
+			return false, nil, err
+		}
+		if ok {
+			return true, tc, nil
+		}
+	}
+	return false, nil, nil
+}
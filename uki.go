@@ -0,0 +1,327 @@
+package sbctl
+
+import (
+	"bytes"
+	"crypto/x509"
+	"debug/pe"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+
+	keyfile "github.com/foxboron/go-tpm-keyfiles"
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/fs"
+	"github.com/google/go-tpm/tpm2"
+	"github.com/spf13/afero"
+)
+
+var (
+	ErrNotUKI        = errors.New("not a unified kernel image")
+	ErrInvalidUKI    = errors.New("invalid unified kernel image")
+	ErrNoPCRPolicy   = errors.New("no pcr_policy key is configured")
+	ErrMeasureFailed = errors.New("systemd-measure failed")
+
+	ErrPCRPolicyKeyType   = errors.New("invalid pcr_policy key type, valid types are tpm and file")
+	ErrPCRPolicyKeyExists = errors.New("the pcr_policy key already exists")
+)
+
+// Sections systemd-stub reads from a UKI, in the order systemd-measure
+// measures them. Reference the UKI specification:
+// https://uapi-group.org/specifications/specs/unified_kernel_image/
+var ukiMeasuredSections = []string{
+	".linux",
+	".osrel",
+	".cmdline",
+	".initrd",
+	".ucode",
+	".splash",
+	".dtb",
+	".uname",
+	".sbat",
+	".pcrpkey",
+}
+
+// Sections that identify a PE binary as a UKI
+var ukiSections = []string{".linux", ".initrd", ".osrel"}
+
+type UKISection struct {
+	Name string
+	VMA  uint64
+	Size uint64
+	data []byte
+}
+
+type UKI struct {
+	File     string
+	Sections []*UKISection
+	// Virtual address after the last section, where new sections can be added
+	nextVMA uint64
+}
+
+func (u *UKI) Section(name string) *UKISection {
+	for _, s := range u.Sections {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func imageBase(e *pe.File) uint64 {
+	switch h := e.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		return uint64(h.ImageBase)
+	case *pe.OptionalHeader64:
+		return h.ImageBase
+	}
+	return 0
+}
+
+// nextSectionVMA returns the virtual address after the last section
+func nextSectionVMA(e *pe.File) uint64 {
+	var vma uint64
+	for _, s := range e.Sections {
+		vma = max(vma, uint64(s.VirtualAddress)+uint64(s.VirtualSize))
+	}
+	return roundUpToBlockSize(imageBase(e) + vma)
+}
+
+// ReadUKI reads the sections of a UKI and validates the layout. The .linux
+// section is required, and the sections can't overlap or be duplicated.
+func ReadUKI(vfs afero.Fs, file string) (*UKI, error) {
+	b, err := fs.ReadFile(vfs, file)
+	if err != nil {
+		return nil, err
+	}
+	e, err := pe.NewFile(bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	defer e.Close()
+
+	uki := &UKI{File: file, nextVMA: nextSectionVMA(e)}
+	base := imageBase(e)
+	isUKI := false
+	for _, s := range e.Sections {
+		if slices.Contains(ukiSections, s.Name) {
+			isUKI = true
+		}
+		if !slices.Contains(ukiMeasuredSections, s.Name) && s.Name != ".pcrsig" {
+			continue
+		}
+		if uki.Section(s.Name) != nil {
+			return nil, fmt.Errorf("%w: %s: duplicate %s section", ErrInvalidUKI, file, s.Name)
+		}
+		data, err := s.Data()
+		if err != nil {
+			return nil, fmt.Errorf("%s: can't read %s section: %w", file, s.Name, err)
+		}
+		// The raw data is padded to the file alignment
+		if uint32(len(data)) > s.VirtualSize {
+			data = data[:s.VirtualSize]
+		}
+		uki.Sections = append(uki.Sections, &UKISection{
+			Name: s.Name,
+			VMA:  base + uint64(s.VirtualAddress),
+			Size: uint64(s.VirtualSize),
+			data: data,
+		})
+	}
+	if !isUKI {
+		return nil, fmt.Errorf("%w: %s", ErrNotUKI, file)
+	}
+	if uki.Section(".linux") == nil {
+		return nil, fmt.Errorf("%w: %s: missing .linux section", ErrInvalidUKI, file)
+	}
+	for i, a := range uki.Sections {
+		for _, b := range uki.Sections[i+1:] {
+			if a.VMA < b.VMA+b.Size && b.VMA < a.VMA+a.Size {
+				return nil, fmt.Errorf("%w: %s: %s and %s sections overlap", ErrInvalidUKI, file, a.Name, b.Name)
+			}
+		}
+	}
+	return uki, nil
+}
+
+func objcopyAddSections(file string, vma uint64, remove []string, sections map[string]string) error {
+	var args []string
+	for _, name := range remove {
+		args = append(args, "--remove-section", name)
+	}
+	// Keep the order stable
+	var names []string
+	for name := range sections {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		fi, err := os.Stat(sections[name])
+		if err != nil {
+			return err
+		}
+		args = append(args,
+			"--add-section", fmt.Sprintf("%s=%s", name, sections[name]),
+			"--set-section-flags", fmt.Sprintf("%s=data,readonly", name),
+			"--change-section-vma", fmt.Sprintf("%s=%#x", name, vma),
+		)
+		vma += roundUpToBlockSize(uint64(fi.Size()))
+	}
+	args = append(args, file, file)
+	cmd := exec.Command("objcopy", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// MeasurePath returns the path of systemd-measure, which usually isn't in
+// PATH
+func MeasurePath() string {
+	if p, err := exec.LookPath("systemd-measure"); err == nil {
+		return p
+	}
+	return "/usr/lib/systemd/systemd-measure"
+}
+
+// UKIPolicyPrograms are the programs SignUKIPolicy executes
+func UKIPolicyPrograms() []string {
+	programs := []string{MeasurePath()}
+	if p, err := exec.LookPath("objcopy"); err == nil {
+		programs = append(programs, p)
+	}
+	return programs
+}
+
+// CreatePCRPolicyKey creates the pcr_policy key in the TPM. The private key
+// file holds the key wrapped by the TPM, so it can only sign with the TPM
+// which created it.
+func CreatePCRPolicyKey(state *config.State) error {
+	policy := state.Config.PCRPolicy
+	if policy == nil || policy.Privkey == "" {
+		return ErrNoPCRPolicy
+	}
+	if policy.KeyType() != config.PCRPolicyTPM {
+		return fmt.Errorf("%w: the pcr_policy key has the type %q", ErrPCRPolicyKeyType, policy.KeyType())
+	}
+	if ok, _ := afero.Exists(state.Fs, policy.Privkey); ok {
+		return fmt.Errorf("%w: %s", ErrPCRPolicyKeyExists, policy.Privkey)
+	}
+
+	key, err := keyfile.NewLoadableKey(state.TPM(), tpm2.TPMAlgRSA, 2048, []byte(nil),
+		keyfile.WithDescription("PCR Policy Key"),
+	)
+	if err != nil {
+		return err
+	}
+	pubkey, err := key.PublicKey()
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKIXPublicKey(pubkey)
+	if err != nil {
+		return err
+	}
+
+	if err := state.Fs.MkdirAll(filepath.Dir(policy.Privkey), os.ModePerm); err != nil {
+		return err
+	}
+	if err := fs.WriteFile(state.Fs, policy.Privkey, key.Bytes(), 0o400); err != nil {
+		return err
+	}
+	if policy.Pubkey != "" {
+		if err := state.Fs.MkdirAll(filepath.Dir(policy.Pubkey), os.ModePerm); err != nil {
+			return err
+		}
+		b := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+		if err := fs.WriteFile(state.Fs, policy.Pubkey, b, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SignUKIPolicy signs the PCR policy of the UKI with systemd-measure and
+// embeds it in the .pcrsig section. The public key is embedded as .pcrpkey
+// first, as it is part of the measurement. The measured sections are written
+// to dir, which has to be allowed in landlock.
+//
+// TPM keys are loaded with the tpm2 OpenSSL provider, which needs systemd 256
+// or later.
+func SignUKIPolicy(state *config.State, uki *UKI, dir string) error {
+	policy := state.Config.PCRPolicy
+	if policy == nil || policy.Privkey == "" {
+		return ErrNoPCRPolicy
+	}
+
+	var remove []string
+	if uki.Section(".pcrsig") != nil {
+		remove = append(remove, ".pcrsig")
+	}
+	if policy.Pubkey != "" {
+		pubkey, err := fs.ReadFile(state.Fs, policy.Pubkey)
+		if err != nil {
+			return fmt.Errorf("can't read PCR policy public key: %w", err)
+		}
+		if s := uki.Section(".pcrpkey"); s == nil || !bytes.Equal(s.data, pubkey) {
+			if s != nil {
+				remove = append(remove, ".pcrpkey")
+			}
+			if err := objcopyAddSections(uki.File, uki.nextVMA, remove, map[string]string{".pcrpkey": policy.Pubkey}); err != nil {
+				return fmt.Errorf("failed adding .pcrpkey section: %w", err)
+			}
+			remove = nil
+			if uki, err = ReadUKI(state.Fs, uki.File); err != nil {
+				return err
+			}
+		}
+	}
+
+	args := []string{"sign", "--json=short", "--private-key=" + policy.Privkey}
+	switch policy.KeyType() {
+	case config.PCRPolicyTPM:
+		args = append(args, "--private-key-source=provider:tpm2")
+	case config.PCRPolicyFile:
+	default:
+		return fmt.Errorf("%w: %q", ErrPCRPolicyKeyType, policy.KeyType())
+	}
+	if policy.Pubkey != "" {
+		args = append(args, "--public-key="+policy.Pubkey)
+	}
+	for _, bank := range policy.Banks {
+		args = append(args, "--bank="+bank)
+	}
+	for _, name := range ukiMeasuredSections {
+		s := uki.Section(name)
+		if s == nil {
+			continue
+		}
+		p := filepath.Join(dir, name[1:])
+		if err := os.WriteFile(p, s.data, 0o600); err != nil {
+			return err
+		}
+		args = append(args, fmt.Sprintf("--%s=%s", name[1:], p))
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command(MeasurePath(), args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return fmt.Errorf("%w: systemd-measure is required to sign the PCR policy", err)
+		}
+		return fmt.Errorf("%w: %w", ErrMeasureFailed, err)
+	}
+
+	sig := filepath.Join(dir, "pcrsig")
+	if err := os.WriteFile(sig, bytes.TrimSpace(stdout.Bytes()), 0o600); err != nil {
+		return err
+	}
+	if err := objcopyAddSections(uki.File, uki.nextVMA, remove, map[string]string{".pcrsig": sig}); err != nil {
+		return fmt.Errorf("failed adding .pcrsig section: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package sbctl
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"debug/pe"
+	"encoding/pem"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	keyfile "github.com/foxboron/go-tpm-keyfiles"
+	"github.com/foxboron/sbctl/config"
+	"github.com/google/go-tpm/tpm2/transport"
+	"github.com/google/go-tpm/tpm2/transport/simulator"
+	"github.com/spf13/afero"
+)
+
+// mkUKI adds the sections to a copy of the test binary
+func mkUKI(t *testing.T, sections ...string) string {
+	t.Helper()
+	if _, err := exec.LookPath("objcopy"); err != nil {
+		t.Skip("objcopy is not installed")
+	}
+	dir := t.TempDir()
+	b, err := os.ReadFile("tests/binaries/test.pecoff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "uki.efi")
+	if err := os.WriteFile(file, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if len(sections) == 0 {
+		return file
+	}
+	e, err := pe.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vma := nextSectionVMA(e)
+	e.Close()
+
+	files := map[string]string{}
+	for _, name := range sections {
+		p := filepath.Join(dir, name[1:])
+		if err := os.WriteFile(p, []byte("contents of "+name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		files[name] = p
+	}
+	if err := objcopyAddSections(file, vma, nil, files); err != nil {
+		t.Fatalf("objcopy failed: %v", err)
+	}
+	return file
+}
+
+func TestReadUKI(t *testing.T) {
+	vfs := afero.NewOsFs()
+
+	uki, err := ReadUKI(vfs, mkUKI(t, ".linux", ".osrel", ".initrd"))
+	if err != nil {
+		t.Fatalf("failed reading UKI: %v", err)
+	}
+	s := uki.Section(".osrel")
+	if s == nil || string(s.data) != "contents of .osrel" {
+		t.Fatalf("unexpected .osrel section: %+v", s)
+	}
+
+	if _, err := ReadUKI(vfs, mkUKI(t)); !errors.Is(err, ErrNotUKI) {
+		t.Fatalf("expected ErrNotUKI, got %v", err)
+	}
+	if _, err := ReadUKI(vfs, mkUKI(t, ".osrel", ".initrd")); !errors.Is(err, ErrInvalidUKI) {
+		t.Fatalf("expected ErrInvalidUKI for a missing .linux section, got %v", err)
+	}
+}
+
+func TestCreatePCRPolicyKey(t *testing.T) {
+	rwc, err := simulator.OpenSimulator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rwc.Close()
+	state := &config.State{
+		TPM: func() transport.TPMCloser { return rwc },
+		Fs:  afero.NewMemMapFs(),
+		Config: &config.Config{
+			PCRPolicy: &config.PCRPolicyConfig{
+				Privkey: "/etc/sbctl/pcr-policy.key",
+				Pubkey:  "/etc/sbctl/pcr-policy.pem",
+			},
+		},
+	}
+	if err := CreatePCRPolicyKey(state); err != nil {
+		t.Fatalf("failed creating the key: %v", err)
+	}
+
+	// The private key is wrapped by the TPM
+	b, err := afero.ReadFile(state.Fs, "/etc/sbctl/pcr-policy.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := keyfile.Decode(b)
+	if err != nil {
+		t.Fatalf("expected a TPM key file: %v", err)
+	}
+	pubkey, err := key.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = afero.ReadFile(state.Fs, "/etc/sbctl/pcr-policy.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		t.Fatalf("expected a PEM public key, got %q", b)
+	}
+	written, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pubkey.(*rsa.PublicKey).Equal(written) {
+		t.Fatalf("the public key doesn't match the TPM key")
+	}
+
+	if err := CreatePCRPolicyKey(state); !errors.Is(err, ErrPCRPolicyKeyExists) {
+		t.Fatalf("expected ErrPCRPolicyKeyExists, got %v", err)
+	}
+	state.Config.PCRPolicy.Type = config.PCRPolicyFile
+	if err := CreatePCRPolicyKey(state); !errors.Is(err, ErrPCRPolicyKeyType) {
+		t.Fatalf("expected ErrPCRPolicyKeyType, got %v", err)
+	}
+}
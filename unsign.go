@@ -0,0 +1,113 @@
+package sbctl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/foxboron/sbctl/config"
+	"github.com/foxboron/sbctl/fs"
+)
+
+var (
+	ErrNotSigned       = errors.New("the file has no signatures")
+	ErrCertTableNotEnd = errors.New("the certificate table is not at the end of the file")
+)
+
+// peCertTableOffset returns the offset of the certificate table entry in the
+// data directories of the optional header
+func peCertTableOffset(b []byte) (int, error) {
+	if _, err := peChecksumOffset(b); err != nil {
+		return 0, err
+	}
+	opt := int(binary.LittleEndian.Uint32(b[0x3c:])) + 4 + 20
+	var count, dirs int
+	switch binary.LittleEndian.Uint16(b[opt:]) {
+	case 0x10b: // PE32
+		count, dirs = opt+92, opt+96
+	case 0x20b: // PE32+
+		count, dirs = opt+108, opt+112
+	default:
+		return 0, ErrNotPE
+	}
+	// The certificate table is the fifth data directory
+	entry := dirs + 4*8
+	if entry+8 > len(b) || binary.LittleEndian.Uint32(b[count:]) < 5 {
+		return 0, ErrNotSigned
+	}
+	return entry, nil
+}
+
+// peSectionsEnd returns the end of the raw data of the last section
+func peSectionsEnd(b []byte) int {
+	coff := int(binary.LittleEndian.Uint32(b[0x3c:])) + 4
+	sections := int(binary.LittleEndian.Uint16(b[coff+2:]))
+	table := coff + 20 + int(binary.LittleEndian.Uint16(b[coff+16:]))
+	var end int
+	for i := 0; i < sections; i++ {
+		s := table + i*40
+		if s+40 > len(b) {
+			break
+		}
+		size := int(binary.LittleEndian.Uint32(b[s+16:]))
+		ptr := int(binary.LittleEndian.Uint32(b[s+20:]))
+		end = max(end, ptr+size)
+	}
+	return end
+}
+
+// RemoveSignatures returns the image without its certificate table, and with
+// the certificate table entry in the header cleared. The zero padding which is
+// added in front of the table when signing is removed as well, it's part of
+// the authenticode hash either way.
+func RemoveSignatures(b []byte) ([]byte, error) {
+	entry, err := peCertTableOffset(b)
+	if err != nil {
+		return nil, err
+	}
+	off := int(binary.LittleEndian.Uint32(b[entry:]))
+	size := int(binary.LittleEndian.Uint32(b[entry+4:]))
+	if size == 0 {
+		return nil, ErrNotSigned
+	}
+	if off+size != len(b) {
+		return nil, ErrCertTableNotEnd
+	}
+
+	unsigned := bytes.Clone(b[:off])
+	binary.LittleEndian.PutUint64(unsigned[entry:], 0)
+	end := max(off-7, peSectionsEnd(unsigned))
+	for len(unsigned) > end && unsigned[len(unsigned)-1] == 0 {
+		unsigned = unsigned[:len(unsigned)-1]
+	}
+	return unsigned, nil
+}
+
+// RemoveSignaturesFile writes file to output without its signatures
+func RemoveSignaturesFile(state *config.State, file, output string) error {
+	if output == "" {
+		output = file
+	}
+	si, err := state.Fs.Stat(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s does not exist", file)
+	} else if err != nil {
+		return err
+	}
+	b, err := fs.ReadFile(state.Fs, file)
+	if err != nil {
+		return err
+	}
+	unsigned, err := RemoveSignatures(b)
+	if err != nil {
+		return fmt.Errorf("%s: %w", file, err)
+	}
+	if state.Config.FixPEChecksum {
+		if _, err := FixPEChecksum(unsigned); err != nil {
+			return err
+		}
+	}
+	return fs.WriteFile(state.Fs, output, unsigned, si.Mode())
+}
@@ -0,0 +1,20 @@
+package sbctl
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestRemoveSignaturesUnsigned(t *testing.T) {
+	b, err := os.ReadFile("tests/binaries/test.pecoff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RemoveSignatures(b); !errors.Is(err, ErrNotSigned) {
+		t.Fatalf("expected ErrNotSigned, got %v", err)
+	}
+	if _, err := RemoveSignatures([]byte("not a PE image")); !errors.Is(err, ErrNotPE) {
+		t.Fatalf("expected ErrNotPE, got %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package sbctl
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
@@ -70,6 +71,7 @@ var EfivarFSFiles = []string{
 
 var ErrImmutable = errors.New("file is immutable")
 var ErrNotImmutable = errors.New("file is not immutable")
+var ErrNoEfivarfs = errors.New("efivarfs not mounted; this command needs UEFI firmware access")
 
 var Immutable = false
 
@@ -120,6 +122,26 @@ func CheckImmutable(vfs afero.Fs) error {
 	return nil
 }
 
+// UnsetImmutable clears the immutable attribute of the files in efivarfs
+func UnsetImmutable(vfs afero.Fs) error {
+	for _, file := range EfivarFSFiles {
+		err := IsImmutable(vfs, file)
+		if errors.Is(err, ErrNotImmutable) || err == nil {
+			continue
+		} else if !errors.Is(err, ErrImmutable) {
+			return fmt.Errorf("couldn't read file: %s", file)
+		}
+		// The workaround of IsImmutable for tests
+		if _, ok := vfs.(afero.OsFs); ok {
+			Immutable = false
+		} else if err := UnsetImmutableAttr(file); err != nil {
+			return fmt.Errorf("couldn't unset the immutable attribute of %s: %w", file, err)
+		}
+		logging.Print("Cleared the immutable attribute of %s\n", file)
+	}
+	return nil
+}
+
 func CheckMSDos(r io.Reader) (bool, error) {
 	// We are looking for MS-DOS executables.
 	// They contain "MZ" as the two first bytes
@@ -139,6 +161,36 @@ func CheckMSDos(r io.Reader) (bool, error) {
 	return true, nil
 }
 
+// CheckPE checks for a PE executable, an MS-DOS header pointing to the "PE"
+// signature of the COFF header
+func CheckPE(r io.ReadSeeker) (bool, error) {
+	if ok, err := CheckMSDos(r); !ok || err != nil {
+		return ok, err
+	}
+	// e_lfanew holds the offset of the PE signature
+	var offset [4]byte
+	if _, err := r.Seek(0x3c, io.SeekStart); err != nil {
+		return false, err
+	}
+	if _, err := io.ReadFull(r, offset[:]); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil
+		}
+		return false, err
+	}
+	if _, err := r.Seek(int64(binary.LittleEndian.Uint32(offset[:])), io.SeekStart); err != nil {
+		return false, nil
+	}
+	var signature [4]byte
+	if _, err := io.ReadFull(r, signature[:]); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil
+		}
+		return false, err
+	}
+	return bytes.Equal(signature[:], []byte{'P', 'E', 0, 0}), nil
+}
+
 var (
 	checked = make(map[string]bool)
 )